@@ -0,0 +1,225 @@
+// Package accesslog provides a persistent, size-bounded log of accesses to
+// entries.
+package accesslog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "github.com/BranLwyd/harpocrates/harpd/proto/accesslog_go_proto"
+)
+
+// Action describes the kind of an access.
+type Action int
+
+const (
+	View Action = iota
+	Update
+	Delete
+)
+
+func (a Action) String() string {
+	switch a {
+	case View:
+		return "view"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Access describes a single access to an entry.
+type Access struct {
+	Time     time.Time
+	ClientIP string
+	Action   Action
+}
+
+// Log stores accesses, keyed by entry path, persisting them to a file on
+// disk. Only the most recent accesses to each entry are kept. It is safe for
+// concurrent use from multiple goroutines.
+type Log struct {
+	filename   string
+	maxEntries int
+
+	mu       sync.Mutex               // protects accesses
+	accesses map[string][]*apb.Access // by entry path, oldest first
+}
+
+// New creates a new access log persisted in the given file, keeping at most
+// maxEntries accesses for each entry. If the file does not yet exist, the log
+// starts out empty; the file will be created on the first call to Record.
+func New(filename string, maxEntries int) (*Log, error) {
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("maxEntries must be positive")
+	}
+	l := &Log{
+		filename:   filename,
+		maxEntries: maxEntries,
+		accesses:   map[string][]*apb.Access{},
+	}
+	logBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	al := &apb.AccessLog{}
+	if err := proto.Unmarshal(logBytes, al); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for k, v := range al.Entry {
+		l.accesses[k] = trim(v.Access, maxEntries)
+	}
+	return l, nil
+}
+
+// Record records an access to the given entry. The update is persisted to
+// disk before Record returns; if persisting fails, the access is not
+// recorded.
+//
+// On POSIX-compliant systems, the update to the file on disk is atomic.
+func (l *Log) Record(entry string, a Access) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldAccesses := l.accesses[entry]
+	newAccesses := make([]*apb.Access, len(oldAccesses), len(oldAccesses)+1)
+	copy(newAccesses, oldAccesses)
+	newAccesses = append(newAccesses, &apb.Access{
+		TimeUnixNanos: a.Time.UnixNano(),
+		ClientIp:      a.ClientIP,
+		Action:        toProto(a.Action),
+	})
+	l.accesses[entry] = trim(newAccesses, l.maxEntries)
+	if err := l.write(); err != nil {
+		if oldAccesses != nil {
+			l.accesses[entry] = oldAccesses
+		} else {
+			delete(l.accesses, entry)
+		}
+		return err
+	}
+	return nil
+}
+
+// Recent returns up to n of the most recent accesses to the given entry, most
+// recent first.
+func (l *Log) Recent(entry string, n int) []Access {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	as := l.accesses[entry]
+	if n > len(as) {
+		n = len(as)
+	}
+	rslt := make([]Access, 0, n)
+	for i := len(as) - 1; i >= len(as)-n; i-- {
+		rslt = append(rslt, Access{
+			Time:     time.Unix(0, as[i].TimeUnixNanos),
+			ClientIP: as[i].ClientIp,
+			Action:   fromProto(as[i].Action),
+		})
+	}
+	return rslt
+}
+
+// Move moves the accesses recorded for oldEntry to newEntry, such as when an
+// entry is renamed. Any accesses previously recorded for newEntry are
+// discarded. As with Record, the update is persisted to disk before Move
+// returns.
+func (l *Log) Move(oldEntry, newEntry string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldAccesses, ok := l.accesses[oldEntry]
+	if !ok {
+		return nil
+	}
+	prevAccesses, hadPrev := l.accesses[newEntry]
+	l.accesses[newEntry] = oldAccesses
+	delete(l.accesses, oldEntry)
+	if err := l.write(); err != nil {
+		l.accesses[oldEntry] = oldAccesses
+		if hadPrev {
+			l.accesses[newEntry] = prevAccesses
+		} else {
+			delete(l.accesses, newEntry)
+		}
+		return err
+	}
+	return nil
+}
+
+// write writes the current accesses to disk. l.mu must be held.
+func (l *Log) write() error {
+	al := &apb.AccessLog{Entry: make(map[string]*apb.Accesses, len(l.accesses))}
+	for k, v := range l.accesses {
+		al.Entry[k] = &apb.Accesses{Access: v}
+	}
+	logBytes, err := proto.Marshal(al)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal access log: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(l.filename), ".harp_accesslog_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0660); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(logBytes); err != nil {
+		return fmt.Errorf("couldn't write access log: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, l.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, l.filename, err)
+	}
+	return nil
+}
+
+// trim returns the last (i.e. most recent) maxEntries accesses of as.
+func trim(as []*apb.Access, maxEntries int) []*apb.Access {
+	if len(as) > maxEntries {
+		return as[len(as)-maxEntries:]
+	}
+	return as
+}
+
+func toProto(a Action) apb.Access_Action {
+	switch a {
+	case View:
+		return apb.Access_VIEW
+	case Update:
+		return apb.Access_UPDATE
+	case Delete:
+		return apb.Access_DELETE
+	default:
+		return apb.Access_UNKNOWN
+	}
+}
+
+func fromProto(a apb.Access_Action) Action {
+	switch a {
+	case apb.Access_VIEW:
+		return View
+	case apb.Access_UPDATE:
+		return Update
+	case apb.Access_DELETE:
+		return Delete
+	default:
+		return -1
+	}
+}
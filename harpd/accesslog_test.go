@@ -0,0 +1,101 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistence(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_accesslog_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "accesslog")
+	l, err := New(filename, 3)
+	if err != nil {
+		t.Fatalf("Could not create access log: %v", err)
+	}
+
+	// Record more accesses than are kept; only the most recent are returned, most recent first.
+	base := time.Unix(1500000000, 0)
+	var accesses []Access
+	for i, a := range []Action{View, Update, View, Delete} {
+		access := Access{Time: base.Add(time.Duration(i) * time.Minute), ClientIP: "192.0.2.1", Action: a}
+		accesses = append(accesses, access)
+		if err := l.Record("/entry", access); err != nil {
+			t.Fatalf("Could not record access: %v", err)
+		}
+	}
+	want := []Access{accesses[3], accesses[2], accesses[1]}
+	if got := l.Recent("/entry", 10); !equalAccesses(got, want) {
+		t.Errorf("Recent(10) = %v, want %v", got, want)
+	}
+	if got := l.Recent("/entry", 1); !equalAccesses(got, want[:1]) {
+		t.Errorf("Recent(1) = %v, want %v", got, want[:1])
+	}
+	if got := l.Recent("/other", 10); len(got) != 0 {
+		t.Errorf("Recent of unaccessed entry = %v, want none", got)
+	}
+
+	// A new log reading the same file sees the same accesses.
+	l, err = New(filename, 3)
+	if err != nil {
+		t.Fatalf("Could not recreate access log: %v", err)
+	}
+	if got := l.Recent("/entry", 10); !equalAccesses(got, want) {
+		t.Errorf("Recent(10) after reload = %v, want %v", got, want)
+	}
+
+	// Moving an entry's accesses moves them to the new entry.
+	if err := l.Move("/entry", "/moved"); err != nil {
+		t.Fatalf("Could not move accesses: %v", err)
+	}
+	if got := l.Recent("/entry", 10); len(got) != 0 {
+		t.Errorf("Recent of moved entry = %v, want none", got)
+	}
+	if got := l.Recent("/moved", 10); !equalAccesses(got, want) {
+		t.Errorf("Recent of new entry = %v, want %v", got, want)
+	}
+}
+
+func TestFailedRecord(t *testing.T) {
+	t.Parallel()
+
+	// Initialization: the log's file lives in a directory that doesn't exist, so writes will fail.
+	dir, err := ioutil.TempDir("", "harp_accesslog_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := New(filepath.Join(dir, "nonexistent", "accesslog"), 3)
+	if err != nil {
+		t.Fatalf("Could not create access log: %v", err)
+	}
+
+	// A failed write leaves no record of the access.
+	if err := l.Record("/entry", Access{Time: time.Now(), ClientIP: "192.0.2.1", Action: View}); err == nil {
+		t.Fatalf("Record unexpectedly succeeded")
+	}
+	if got := l.Recent("/entry", 10); len(got) != 0 {
+		t.Errorf("Recent after failed record = %v, want none", got)
+	}
+}
+
+func equalAccesses(a, b []Access) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].ClientIP != b[i].ClientIP || a[i].Action != b[i].Action {
+			return false
+		}
+	}
+	return true
+}
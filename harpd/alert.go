@@ -4,10 +4,13 @@ package alert
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 )
 
 // Code describes a class of alerts.
@@ -16,6 +19,26 @@ type Code uint8
 const (
 	LOGIN                          Code = iota // A user has fully completed the authentication process.
 	UNAUTHENTICATED_SESSION_CLOSED             // A user session has been closed (e.g. timed out, manually logged out) after successfully starting but not fully completing the authentication process.
+	MFA_COUNTER_REGRESSION                     // An MFA device presented a signature counter that did not increase, indicating that the device may have been cloned.
+	SESSIONS_REVOKED                           // All active sessions have been revoked by a user.
+	SHARE_CREATED                              // A one-time share link for an entry has been created.
+	SHARE_REDEEMED                             // A one-time share link for an entry has been redeemed.
+	SESSION_HIJACK_SUSPECTED                   // A session has been used by a client other than the one that created it.
+	FAILED_LOGIN_BURST                         // A single client has made many failed login attempts within a short period.
+	SESSION_EVICTED                            // A session which had not completed authentication was closed to make room for a new session.
+	API_TOKEN_CREATED                          // An API token has been created.
+	API_TOKEN_REVOKED                          // An API token has been revoked.
+	MFA_LOCKOUT                                // A session has been closed after too many consecutive failed MFA attempts.
+	MFA_DEVICE_ADDED                           // An MFA device has been registered.
+	MFA_DEVICE_REMOVED                         // A registered MFA device has been removed.
+	ENTRY_EXPIRING                             // An entry has expired, or will expire soon.
+	ALERTS_SUPPRESSED                          // Alerts have been dropped because too many were fired within a short period.
+	STORE_TAMPER                               // The password store's files do not match its manifest, indicating that they may have been tampered with.
+	DEVICE_TRUSTED                             // A browser has been trusted to skip multi-factor authentication for directory listings & search.
+	DEVICE_REVOKED                             // A trusted browser has been revoked.
+	PASSWORDLESS_ENABLED                       // An MFA device has been allowed to log in in place of the passphrase.
+	PASSWORDLESS_DISABLED                      // An MFA device is no longer allowed to log in in place of the passphrase.
+	COUNTER_PERSISTENCE_DEGRADED               // MFA signature counters could not be written to disk; they are kept in memory until writing succeeds.
 )
 
 func (c Code) String() string {
@@ -24,6 +47,46 @@ func (c Code) String() string {
 		return "LOGIN"
 	case UNAUTHENTICATED_SESSION_CLOSED:
 		return "UNAUTHENTICATED_SESSION_CLOSED"
+	case MFA_COUNTER_REGRESSION:
+		return "MFA_COUNTER_REGRESSION"
+	case SESSIONS_REVOKED:
+		return "SESSIONS_REVOKED"
+	case SHARE_CREATED:
+		return "SHARE_CREATED"
+	case SHARE_REDEEMED:
+		return "SHARE_REDEEMED"
+	case SESSION_HIJACK_SUSPECTED:
+		return "SESSION_HIJACK_SUSPECTED"
+	case FAILED_LOGIN_BURST:
+		return "FAILED_LOGIN_BURST"
+	case SESSION_EVICTED:
+		return "SESSION_EVICTED"
+	case API_TOKEN_CREATED:
+		return "API_TOKEN_CREATED"
+	case API_TOKEN_REVOKED:
+		return "API_TOKEN_REVOKED"
+	case MFA_LOCKOUT:
+		return "MFA_LOCKOUT"
+	case MFA_DEVICE_ADDED:
+		return "MFA_DEVICE_ADDED"
+	case MFA_DEVICE_REMOVED:
+		return "MFA_DEVICE_REMOVED"
+	case ENTRY_EXPIRING:
+		return "ENTRY_EXPIRING"
+	case ALERTS_SUPPRESSED:
+		return "ALERTS_SUPPRESSED"
+	case STORE_TAMPER:
+		return "STORE_TAMPER"
+	case DEVICE_TRUSTED:
+		return "DEVICE_TRUSTED"
+	case DEVICE_REVOKED:
+		return "DEVICE_REVOKED"
+	case PASSWORDLESS_ENABLED:
+		return "PASSWORDLESS_ENABLED"
+	case PASSWORDLESS_DISABLED:
+		return "PASSWORDLESS_DISABLED"
+	case COUNTER_PERSISTENCE_DEGRADED:
+		return "COUNTER_PERSISTENCE_DEGRADED"
 	default:
 		return "UNKNOWN"
 	}
@@ -70,3 +133,37 @@ func (la logAlerter) Alert(ctx context.Context, code Code, details string) error
 	log.Printf("Alert fired: [%s] %s", code, details)
 	return nil
 }
+
+type multiAlerter struct {
+	alerters []Alerter
+}
+
+// NewMulti creates a new alerter that fires each alert with all of the given
+// alerters concurrently. An error is returned if any of the alerters fail.
+func NewMulti(alerters ...Alerter) Alerter {
+	return &multiAlerter{alerters}
+}
+
+func (ma multiAlerter) Alert(ctx context.Context, code Code, details string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(ma.alerters))
+	for i, a := range ma.alerters {
+		wg.Add(1)
+		go func(i int, a Alerter) {
+			defer wg.Done()
+			errs[i] = a.Alert(ctx, code, details)
+		}(i, a)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// dedupKeyLength is the length of the prefix of an alert's details which,
+	// along with its code, identifies repeats of the alert.
+	dedupKeyLength = 64
+
+	// dedupFlushTimeLimit bounds the time spent firing the alerts summarizing
+	// a window.
+	dedupFlushTimeLimit = 10 * time.Second
+)
+
+type dedupKey struct {
+	code   Code
+	prefix string
+}
+
+// dedupEntry tracks the repeats of an alert within the current window.
+type dedupEntry struct {
+	repeats int    // number of alerts coalesced into the first
+	last    string // details of the most recent repeat
+}
+
+type dedupAlerter struct {
+	a            Alerter
+	window       time.Duration
+	maxPerWindow int
+	afterFunc    func(d time.Duration, f func()) // calls f in its own goroutine after d, as time.AfterFunc does
+
+	mu         sync.Mutex               // protects all fields below
+	open       bool                     // whether a window is open
+	order      []dedupKey               // keys fired in the current window, in order
+	entries    map[dedupKey]*dedupEntry // by key, for keys fired in the current window
+	suppressed int                      // alerts dropped in the current window
+}
+
+// NewDeduping creates a new alerter that limits the alerts fired with a, so
+// that a burst of alerts does not flood their recipient. Alerts are
+// grouped into windows of the given duration, starting with the first alert
+// fired when no window is open. Within a window, the first alert with a given
+// code & details (or prefix of the details, for long details) is fired
+// immediately; repeats are coalesced into a single summary alert such as
+// "Repeated x47 within 1m0s: <details>", fired when the window ends. At most
+// maxPerWindow distinct alerts are fired immediately within a window; further
+// alerts are dropped, & an ALERTS_SUPPRESSED alert counting them is fired when
+// the window ends.
+//
+// Coalesced & dropped alerts are not passed to a, so firing them never
+// returns an error. Summaries are fired in the background; errors firing them
+// are logged.
+func NewDeduping(a Alerter, window time.Duration, maxPerWindow int) Alerter {
+	return newDeduping(a, window, maxPerWindow, func(d time.Duration, f func()) { time.AfterFunc(d, f) })
+}
+
+func newDeduping(a Alerter, window time.Duration, maxPerWindow int, afterFunc func(time.Duration, func())) *dedupAlerter {
+	return &dedupAlerter{
+		a:            a,
+		window:       window,
+		maxPerWindow: maxPerWindow,
+		afterFunc:    afterFunc,
+		entries:      map[dedupKey]*dedupEntry{},
+	}
+}
+
+func (da *dedupAlerter) Alert(ctx context.Context, code Code, details string) error {
+	k := dedupKey{code, details}
+	if len(k.prefix) > dedupKeyLength {
+		k.prefix = k.prefix[:dedupKeyLength]
+	}
+
+	da.mu.Lock()
+	if !da.open {
+		da.open = true
+		da.afterFunc(da.window, da.flush)
+	}
+	if e, ok := da.entries[k]; ok {
+		e.repeats++
+		e.last = details
+		da.mu.Unlock()
+		return nil
+	}
+	if len(da.order) >= da.maxPerWindow {
+		da.suppressed++
+		da.mu.Unlock()
+		return nil
+	}
+	da.order = append(da.order, k)
+	da.entries[k] = &dedupEntry{}
+	da.mu.Unlock()
+
+	return da.a.Alert(ctx, code, details)
+}
+
+// flush ends the current window, firing summaries of the alerts coalesced &
+// dropped within it.
+func (da *dedupAlerter) flush() {
+	da.mu.Lock()
+	order, entries, suppressed := da.order, da.entries, da.suppressed
+	da.open, da.order, da.entries, da.suppressed = false, nil, map[dedupKey]*dedupEntry{}, 0
+	da.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dedupFlushTimeLimit)
+	defer cancel()
+	for _, k := range order {
+		e := entries[k]
+		if e.repeats == 0 {
+			continue
+		}
+		details := fmt.Sprintf("Repeated x%d within %v: %s", e.repeats, da.window, e.last)
+		if err := da.a.Alert(ctx, k.code, details); err != nil {
+			log.Printf("Could not send alert (%s %q): %v", k.code, details, err)
+		}
+	}
+	if suppressed > 0 {
+		details := fmt.Sprintf("%d alerts suppressed within %v, after %d alerts were fired.", suppressed, da.window, len(order))
+		if err := da.a.Alert(ctx, ALERTS_SUPPRESSED, details); err != nil {
+			log.Printf("Could not send alert (%s %q): %v", ALERTS_SUPPRESSED, details, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var smtpTmpl = template.Must(template.New("smtp").Parse(`From: {{.From}}
+To: {{.To}}
+Subject: [harpocrates] {{.Code}}
+Date: {{.Date}}
+Content-Type: text/plain; charset=utf-8
+
+A harpocrates alert was fired.
+
+Code: {{.Code}}
+Details: {{.Details}}
+`))
+
+// SMTPConfig configures an alerter that sends email.
+type SMTPConfig struct {
+	Addr     string   // address of the SMTP server, in "host:port" form
+	Username string   // username to authenticate with; if empty, no authentication is performed
+	Password string   // password to authenticate with
+	From     string   // sender address
+	To       []string // recipient addresses
+}
+
+type smtpAlerter struct {
+	cfg SMTPConfig
+}
+
+// NewSMTP creates a new alerter that sends an email describing each alert.
+// STARTTLS is used if the server supports it; authentication requires TLS
+// unless the server is on localhost.
+func NewSMTP(cfg SMTPConfig) Alerter {
+	return &smtpAlerter{cfg}
+}
+
+func (sa smtpAlerter) Alert(ctx context.Context, code Code, details string) error {
+	var msg bytes.Buffer
+	if err := smtpTmpl.Execute(&msg, struct {
+		From, To, Date string
+		Code           Code
+		Details        string
+	}{sa.cfg.From, strings.Join(sa.cfg.To, ", "), time.Now().Format(time.RFC1123Z), code, details}); err != nil {
+		return fmt.Errorf("couldn't execute email template: %w", err)
+	}
+	// SMTP requires CRLF line endings.
+	body := strings.ReplaceAll(msg.String(), "\n", "\r\n")
+
+	host, _, err := net.SplitHostPort(sa.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("couldn't parse SMTP server address: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", sa.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to SMTP server: %w", err)
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(dl); err != nil {
+			return fmt.Errorf("couldn't set deadline: %w", err)
+		}
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("couldn't start SMTP session: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("couldn't start TLS: %w", err)
+		}
+	}
+	if sa.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sa.cfg.Username, sa.cfg.Password, host)); err != nil {
+			return fmt.Errorf("couldn't authenticate: %w", err)
+		}
+	}
+	if err := c.Mail(sa.cfg.From); err != nil {
+		return fmt.Errorf("couldn't set sender: %w", err)
+	}
+	for _, to := range sa.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("couldn't add recipient %q: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("couldn't start message: %w", err)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return fmt.Errorf("couldn't write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("couldn't send message: %w", err)
+	}
+	if err := c.Quit(); err != nil {
+		return fmt.Errorf("couldn't end SMTP session: %w", err)
+	}
+	return nil
+}
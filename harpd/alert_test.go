@@ -0,0 +1,302 @@
+package alert
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("secret")
+	reqs := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	if err := NewWebhook(srv.URL, secret).Alert(context.Background(), LOGIN, "details"); err != nil {
+		t.Fatalf("Could not send alert: %v", err)
+	}
+	r, body := <-reqs, <-bodies
+	if r.Method != http.MethodPost {
+		t.Errorf("Webhook request used method %q, want %q", r.Method, http.MethodPost)
+	}
+	if want := "sha256=" + webhookSignature(secret, body); r.Header.Get(WebhookSignatureHeader) != want {
+		t.Errorf("Webhook request had signature %q, want %q", r.Header.Get(WebhookSignatureHeader), want)
+	}
+	for _, want := range []string{`"code":"LOGIN"`, `"details":"details"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Webhook payload %q does not contain %q", body, want)
+		}
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	if err := NewWebhook(srv.URL, nil).Alert(context.Background(), LOGIN, "details"); err == nil {
+		t.Errorf("Alert to failing webhook succeeded")
+	}
+
+	// The context deadline is honored.
+	hang := make(chan struct{})
+	slowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-hang }))
+	defer slowSrv.Close()
+	defer close(hang) // before closing the server, which waits for outstanding requests
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := NewWebhook(slowSrv.URL, nil).Alert(ctx, LOGIN, "details"); err == nil {
+		t.Errorf("Alert to hanging webhook succeeded")
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+	msgs := make(chan string, 1)
+	go serveFakeSMTP(l, msgs)
+
+	sa := NewSMTP(SMTPConfig{
+		Addr: l.Addr().String(),
+		From: "harp@example.com",
+		To:   []string{"alice@example.com", "bob@example.com"},
+	})
+	if err := sa.Alert(context.Background(), MFA_COUNTER_REGRESSION, "device may be cloned"); err != nil {
+		t.Fatalf("Could not send alert: %v", err)
+	}
+	msg := <-msgs
+	for _, want := range []string{
+		"MAIL FROM:<harp@example.com>",
+		"RCPT TO:<alice@example.com>",
+		"RCPT TO:<bob@example.com>",
+		"Subject: [harpocrates] MFA_COUNTER_REGRESSION\r\n",
+		"Details: device may be cloned\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("SMTP session %q does not contain %q", msg, want)
+		}
+	}
+}
+
+// serveFakeSMTP accepts a single connection on l, speaking just enough SMTP
+// to accept one message. The client's side of the session is sent to msgs.
+func serveFakeSMTP(l net.Listener, msgs chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var session strings.Builder
+	defer func() { msgs <- session.String() }()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost ESMTP")
+	inData := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		session.WriteString(line)
+		switch {
+		case inData:
+			if line == ".\r\n" {
+				inData = false
+				reply("250 OK")
+			}
+		case strings.HasPrefix(line, "EHLO"):
+			reply("250 localhost")
+		case strings.HasPrefix(line, "DATA"):
+			inData = true
+			reply("354 Go ahead")
+		case strings.HasPrefix(line, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestDeduping(t *testing.T) {
+	t.Parallel()
+	const window = time.Minute
+	recording := &recordingAlerter{}
+	clk := &fakeClock{}
+	da := newDeduping(recording, window, 3, clk.AfterFunc)
+	fire := func(code Code, details string) {
+		t.Helper()
+		if err := da.Alert(context.Background(), code, details); err != nil {
+			t.Fatalf("Could not fire alert: %v", err)
+		}
+	}
+	check := func(desc string, want ...string) {
+		t.Helper()
+		if got := recording.alerts(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got alerts %q, want %q", desc, got, want)
+		}
+	}
+
+	// The first of each alert is fired immediately; repeats are summarized
+	// when the window ends.
+	var wg sync.WaitGroup
+	for i := 0; i < 47; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fire(FAILED_LOGIN_BURST, "Client 192.0.2.1 has made 10 failed login attempts recently.")
+		}()
+	}
+	wg.Wait()
+	fire(LOGIN, "Session started by 192.0.2.2.")
+	check("Alerts within window",
+		"FAILED_LOGIN_BURST Client 192.0.2.1 has made 10 failed login attempts recently.",
+		"LOGIN Session started by 192.0.2.2.")
+	clk.Advance(window)
+	check("Alerts at end of window",
+		"FAILED_LOGIN_BURST Repeated x46 within 1m0s: Client 192.0.2.1 has made 10 failed login attempts recently.")
+
+	// A new window starts with the next alert; only its alerts are counted.
+	fire(FAILED_LOGIN_BURST, "Client 192.0.2.1 has made 10 failed login attempts recently.")
+	check("Alerts in new window",
+		"FAILED_LOGIN_BURST Client 192.0.2.1 has made 10 failed login attempts recently.")
+	clk.Advance(window)
+	check("Alerts at end of new window")
+
+	// Alerts are identified by their code & a prefix of their details; the
+	// most recent details are summarized.
+	long := strings.Repeat("x", dedupKeyLength)
+	fire(SESSION_EVICTED, long+"1")
+	fire(SESSION_EVICTED, long+"2")
+	fire(SESSION_EVICTED, long+"3")
+	fire(SESSION_HIJACK_SUSPECTED, long+"1")
+	check("Alerts with long details", "SESSION_EVICTED "+long+"1", "SESSION_HIJACK_SUSPECTED "+long+"1")
+	clk.Advance(window)
+	check("Alerts at end of window with long details", "SESSION_EVICTED Repeated x2 within 1m0s: "+long+"3")
+
+	// Beyond maxPerWindow distinct alerts, alerts are dropped & counted.
+	for i := 0; i < 5; i++ {
+		fire(UNAUTHENTICATED_SESSION_CLOSED, fmt.Sprintf("Session %d closed.", i))
+	}
+	fire(UNAUTHENTICATED_SESSION_CLOSED, "Session 0 closed.")
+	check("Alerts beyond limit", "UNAUTHENTICATED_SESSION_CLOSED Session 0 closed.", "UNAUTHENTICATED_SESSION_CLOSED Session 1 closed.", "UNAUTHENTICATED_SESSION_CLOSED Session 2 closed.")
+	clk.Advance(window)
+	check("Alerts at end of window beyond limit",
+		"UNAUTHENTICATED_SESSION_CLOSED Repeated x1 within 1m0s: Session 0 closed.",
+		"ALERTS_SUPPRESSED 2 alerts suppressed within 1m0s, after 3 alerts were fired.")
+}
+
+// fakeClock is a clock whose time passes only when advanced, for testing.
+// Functions scheduled with AfterFunc are run synchronously by Advance.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	funcs []scheduledFunc
+}
+
+type scheduledFunc struct {
+	at time.Time
+	f  func()
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.funcs = append(c.funcs, scheduledFunc{c.now.Add(d), f})
+}
+
+// Advance advances the clock, running any functions which become due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	remaining := c.funcs[:0]
+	for _, sf := range c.funcs {
+		if sf.at.After(c.now) {
+			remaining = append(remaining, sf)
+		} else {
+			due = append(due, sf.f)
+		}
+	}
+	c.funcs = remaining
+	c.mu.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
+
+func TestMulti(t *testing.T) {
+	t.Parallel()
+
+	ok := alerterFunc(func(ctx context.Context, code Code, details string) error { return nil })
+	failing := alerterFunc(func(ctx context.Context, code Code, details string) error { return errors.New("failed") })
+	recording := &recordingAlerter{}
+
+	if err := NewMulti(ok, recording).Alert(context.Background(), LOGIN, "details"); err != nil {
+		t.Errorf("Multi alert returned error: %v", err)
+	}
+	if err := NewMulti(ok, failing, recording).Alert(context.Background(), SESSIONS_REVOKED, "details"); err == nil {
+		t.Errorf("Multi alert with failing alerter succeeded")
+	}
+	if got := recording.codes; len(got) != 2 || got[0] != LOGIN || got[1] != SESSIONS_REVOKED {
+		t.Errorf("Recording alerter saw %v, want [LOGIN SESSIONS_REVOKED]", got)
+	}
+}
+
+type alerterFunc func(ctx context.Context, code Code, details string) error
+
+func (af alerterFunc) Alert(ctx context.Context, code Code, details string) error {
+	return af(ctx, code, details)
+}
+
+type recordingAlerter struct {
+	mu      sync.Mutex
+	codes   []Code
+	details []string
+}
+
+func (ra *recordingAlerter) Alert(ctx context.Context, code Code, details string) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.codes = append(ra.codes, code)
+	ra.details = append(ra.details, details)
+	return nil
+}
+
+// alerts returns the alerts recorded since the last call, formatted as
+// "CODE details".
+func (ra *recordingAlerter) alerts() []string {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	var as []string
+	for i, c := range ra.codes {
+		as = append(as, fmt.Sprintf("%s %s", c, ra.details[i]))
+	}
+	ra.codes, ra.details = nil, nil
+	return as
+}
@@ -0,0 +1,73 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WebhookSignatureHeader is the header holding the signature of webhook
+// alert payloads: "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+// request body, keyed with the webhook's secret.
+const WebhookSignatureHeader = "X-Harpocrates-Signature"
+
+type webhookAlerter struct {
+	url        string
+	hmacSecret []byte
+	client     *http.Client
+}
+
+// NewWebhook creates a new alerter that POSTs a JSON payload describing each
+// alert to the given URL. The payload is an object with "code", "details",
+// and "time" fields; it is signed with hmacSecret, with the signature sent in
+// the X-Harpocrates-Signature header.
+func NewWebhook(url string, hmacSecret []byte) Alerter {
+	return &webhookAlerter{
+		url:        url,
+		hmacSecret: hmacSecret,
+		client:     &http.Client{},
+	}
+}
+
+func (wa webhookAlerter) Alert(ctx context.Context, code Code, details string) error {
+	payload, err := json.Marshal(struct {
+		Code    string    `json:"code"`
+		Details string    `json:"details"`
+		Time    time.Time `json:"time"`
+	}{code.String(), details, time.Now()})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal payload: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, wa.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("couldn't create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, "sha256="+webhookSignature(wa.hmacSecret, payload))
+
+	resp, err := wa.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't send webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %q", resp.Status)
+	}
+	return nil
+}
+
+func webhookSignature(secret, payload []byte) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write(payload)
+	return hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,254 @@
+// Package apitoken provides persistent storage for API tokens, which allow
+// non-browser clients to use the API without logging in with the passphrase.
+package apitoken
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	apb "github.com/BranLwyd/harpocrates/harpd/proto/apitoken_go_proto"
+)
+
+const (
+	idLength     = 9
+	secretLength = 32
+	saltLength   = 16
+	nonceLength  = 24
+)
+
+// ErrNoToken is returned when an API token does not exist, or is presented
+// with the wrong secret.
+var ErrNoToken = errors.New("no such API token")
+
+// Token describes an API token. It never includes the token's secret.
+type Token struct {
+	ID        string    // identifies the token; it is not a credential
+	Name      string    // human-readable name of the token
+	CreatedAt time.Time // time the token was created
+	Prefixes  []string  // directory prefixes beneath which entries may be accessed; if empty, every entry may be accessed
+	ReadOnly  bool      // whether entries may not be modified with the token
+}
+
+// Store stores API tokens, keyed by token ID, persisting them to a file on
+// disk. It is safe for concurrent use from multiple goroutines.
+//
+// A token is presented by clients as "<ID>.<secret>". The secret is never
+// stored: only a salted hash of it, used to verify the token, and the
+// passphrase used to unlock the vault, encrypted with a key derived from the
+// secret.
+type Store struct {
+	filename string
+
+	mu     sync.Mutex // protects tokens
+	tokens map[string]*apb.APIToken
+}
+
+// NewStore creates a new token store persisted in the given file. If the file
+// does not yet exist, the store starts out empty; the file will be created on
+// the first call to Create.
+func NewStore(filename string) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		tokens:   map[string]*apb.APIToken{},
+	}
+	tokBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	toks := &apb.APITokens{}
+	if err := proto.Unmarshal(tokBytes, toks); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for id, t := range toks.Token {
+		s.tokens[id] = t
+	}
+	return s, nil
+}
+
+// List returns a description of each stored token, oldest first.
+func (s *Store) List() []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var toks []Token
+	for id, t := range s.tokens {
+		toks = append(toks, token(id, t))
+	}
+	sort.Slice(toks, func(i, j int) bool { return toks[i].CreatedAt.Before(toks[j].CreatedAt) })
+	return toks
+}
+
+// Create creates a new token granting access to the vault unlocked by the
+// given passphrase, restricted to the given directory prefixes (if any) and
+// optionally read-only. It returns the token to be presented by clients, along
+// with a description of the token. The token can't be recovered later. The new
+// token is persisted to disk before Create returns.
+func (s *Store) Create(name, passphrase string, prefixes []string, readOnly bool, now time.Time) (string, Token, error) {
+	var id [idLength]byte
+	var sec [secretLength]byte
+	var salt [saltLength]byte
+	var nonce [nonceLength]byte
+	for _, b := range [][]byte{id[:], sec[:], salt[:], nonce[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return "", Token{}, fmt.Errorf("couldn't generate token: %w", err)
+		}
+	}
+	key := derive(sec[:], salt[:], "seal")
+	t := &apb.APIToken{
+		Name:             name,
+		CreatedUnixNanos: now.UnixNano(),
+		Prefix:           prefixes,
+		ReadOnly:         readOnly,
+		Salt:             salt[:],
+		Hash:             hash(sec[:], salt[:]),
+		SealedPassphrase: secretbox.Seal(nonce[:], []byte(passphrase), &nonce, &key),
+	}
+	tokID := base64.RawURLEncoding.EncodeToString(id[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[tokID]; ok {
+		// Overwhelmingly unlikely, but don't overwrite an existing token.
+		return "", Token{}, errors.New("couldn't generate token: duplicate ID")
+	}
+	s.tokens[tokID] = t
+	if err := s.write(); err != nil {
+		delete(s.tokens, tokID)
+		return "", Token{}, err
+	}
+	return tokID + "." + base64.RawURLEncoding.EncodeToString(sec[:]), token(tokID, t), nil
+}
+
+// Authenticate verifies the given token, as returned by Create, returning a
+// description of the token along with the passphrase it grants. It returns
+// ErrNoToken if the token is malformed, has been revoked, or has the wrong
+// secret.
+func (s *Store) Authenticate(tok string) (Token, string, error) {
+	parts := strings.SplitN(tok, ".", 2)
+	if len(parts) != 2 {
+		return Token{}, "", ErrNoToken
+	}
+	tokID := parts[0]
+	sec, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Token{}, "", ErrNoToken
+	}
+
+	s.mu.Lock()
+	t := s.tokens[tokID]
+	s.mu.Unlock()
+	if t == nil || !hmac.Equal(hash(sec, t.Salt), t.Hash) {
+		return Token{}, "", ErrNoToken
+	}
+	if len(t.SealedPassphrase) < nonceLength {
+		return Token{}, "", fmt.Errorf("couldn't open passphrase of token %q: sealed passphrase too short", tokID)
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], t.SealedPassphrase)
+	key := derive(sec, t.Salt, "seal")
+	passphrase, ok := secretbox.Open(nil, t.SealedPassphrase[nonceLength:], &nonce, &key)
+	if !ok {
+		return Token{}, "", fmt.Errorf("couldn't open passphrase of token %q", tokID)
+	}
+	return token(tokID, t), string(passphrase), nil
+}
+
+// Exists determines if a token with the given ID exists.
+func (s *Store) Exists(tokID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tokens[tokID]
+	return ok
+}
+
+// Revoke deletes the token with the given ID, so that it can no longer be
+// used, returning a description of the deleted token. It returns ErrNoToken if
+// there is no such token. The deletion is persisted to disk before Revoke
+// returns; if persisting fails, the token is not deleted.
+func (s *Store) Revoke(tokID string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[tokID]
+	if !ok {
+		return Token{}, ErrNoToken
+	}
+	delete(s.tokens, tokID)
+	if err := s.write(); err != nil {
+		s.tokens[tokID] = t
+		return Token{}, err
+	}
+	return token(tokID, t), nil
+}
+
+// write writes the current tokens to disk. s.mu must be held.
+func (s *Store) write() error {
+	tokBytes, err := proto.Marshal(&apb.APITokens{Token: s.tokens})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal tokens: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.filename), ".harp_apitoken_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	// Tokens hold the (sealed) passphrase, so keep them private to the server.
+	if err := os.Chmod(tempFilename, 0600); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(tokBytes); err != nil {
+		return fmt.Errorf("couldn't write tokens: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, s.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, s.filename, err)
+	}
+	return nil
+}
+
+func token(tokID string, t *apb.APIToken) Token {
+	return Token{
+		ID:        tokID,
+		Name:      t.Name,
+		CreatedAt: time.Unix(0, t.CreatedUnixNanos),
+		Prefixes:  append([]string(nil), t.Prefix...),
+		ReadOnly:  t.ReadOnly,
+	}
+}
+
+// hash returns the salted hash of a token's secret, used to verify the token.
+func hash(sec, salt []byte) []byte {
+	h := derive(sec, salt, "verify")
+	return h[:]
+}
+
+// derive derives a value for the given purpose from a token's secret & salt.
+// Secrets are random and as long as the derived value, so no key stretching
+// is needed.
+func derive(sec, salt []byte, purpose string) [32]byte {
+	m := hmac.New(sha256.New, sec)
+	m.Write(salt)
+	m.Write([]byte(purpose))
+	var v [32]byte
+	copy(v[:], m.Sum(nil))
+	return v
+}
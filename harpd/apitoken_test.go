@@ -0,0 +1,77 @@
+package apitoken
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_apitoken_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tokens")
+	s, err := NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	tok, info, err := s.Create("script", "passphrase", []string{"/work/"}, true, now)
+	if err != nil {
+		t.Fatalf("Could not create token: %v", err)
+	}
+	if info.Name != "script" || !info.CreatedAt.Equal(now) || len(info.Prefixes) != 1 || info.Prefixes[0] != "/work/" || !info.ReadOnly {
+		t.Errorf("Create returned token %+v, want matching token", info)
+	}
+	if strings.Contains(tok, "passphrase") {
+		t.Errorf("Token %q contains the passphrase", tok)
+	}
+
+	// The token, and only the token, authenticates.
+	got, passphrase, err := s.Authenticate(tok)
+	if err != nil || got.ID != info.ID || passphrase != "passphrase" {
+		t.Errorf("Authenticate = (%+v, %q, %v), want (%+v, %q, nil)", got, passphrase, err, info, "passphrase")
+	}
+	for _, bad := range []string{"", "garbage", info.ID, info.ID + ".", info.ID + ".AAAA", "nonexistent" + tok[strings.Index(tok, "."):]} {
+		if _, _, err := s.Authenticate(bad); !errors.Is(err, ErrNoToken) {
+			t.Errorf("Authenticate(%q) returned error %v, want %v", bad, err, ErrNoToken)
+		}
+	}
+
+	// A new store reading the same file sees the same tokens.
+	s, err = NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if toks := s.List(); len(toks) != 1 || toks[0].ID != info.ID || toks[0].Name != "script" {
+		t.Errorf("After reload, List = %+v, want [%+v]", toks, info)
+	}
+	if _, passphrase, err := s.Authenticate(tok); err != nil || passphrase != "passphrase" {
+		t.Errorf("After reload, Authenticate = (%q, %v), want (%q, nil)", passphrase, err, "passphrase")
+	}
+
+	// A revoked token no longer authenticates.
+	if got, err := s.Revoke(info.ID); err != nil {
+		t.Fatalf("Could not revoke token: %v", err)
+	} else if got.Name != "script" {
+		t.Errorf("Revoke returned token %+v, want %+v", got, info)
+	}
+	if _, _, err := s.Authenticate(tok); !errors.Is(err, ErrNoToken) {
+		t.Errorf("After revocation, Authenticate returned error %v, want %v", err, ErrNoToken)
+	}
+	if _, err := s.Revoke(info.ID); !errors.Is(err, ErrNoToken) {
+		t.Errorf("Second Revoke returned error %v, want %v", err, ErrNoToken)
+	}
+	if s.Exists(info.ID) {
+		t.Errorf("After revocation, token exists")
+	}
+}
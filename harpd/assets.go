@@ -1,10 +1,34 @@
+// Package assets provides the templates, pages & static files served by harpd,
+// embedded in the binary.
 package assets
 
-import "fmt"
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+)
 
+//go:embed assets/etc assets/pages assets/templates
+var embedded embed.FS
+
+// FS holds the assets, named by their path beneath harpd/assets, e.g.
+// "templates/entry-view.html" or "etc/style.css".
+var FS = func() fs.FS {
+	sub, err := fs.Sub(embedded, "assets")
+	if err != nil {
+		panic(fmt.Sprintf("Could not get assets: %v", err))
+	}
+	return sub
+}()
+
+// MustAsset returns the content of the named asset, panicking if it does not
+// exist. For compatibility, the name may include a "harpd/assets/" prefix.
+//
+// Deprecated: use fs.ReadFile(FS, name).
 func MustAsset(name string) []byte {
-	a, ok := Asset[name]
-	if !ok {
+	a, err := fs.ReadFile(FS, strings.TrimPrefix(name, "harpd/assets/"))
+	if err != nil {
 		panic(fmt.Sprintf("Asset %q does not exist", name))
 	}
 	return a
@@ -0,0 +1,39 @@
+// loadPreviews fills in the previews of the entries listed on the page. The
+// previews are fetched in batches, since the server decrypts a limited number
+// of entries per request.
+function loadPreviews() {
+  const listEl = document.querySelector("ul.entry-list[data-preview-batch]");
+  if (!listEl) {
+    return;
+  }
+  const batchSize = parseInt(listEl.getAttribute("data-preview-batch"));
+  const els = Array.from(listEl.querySelectorAll(".preview[data-entry]"));
+  for (let i = 0; i < els.length; i += batchSize) {
+    const batch = els.slice(i, i + batchSize);
+    const params = new URLSearchParams({previews: "", format: "json"});
+    for (const el of batch) {
+      params.append("entry", el.getAttribute("data-entry"));
+    }
+    fetch("?" + params.toString(), {credentials: "same-origin"})
+      .then(resp => {
+        if (!resp.ok) {
+          throw new Error("preview request failed: " + resp.status);
+        }
+        return resp.json();
+      })
+      .then(previews => {
+        const byPath = new Map(previews.map(p => [p.path, p.text]));
+        for (const el of batch) {
+          el.innerText = byPath.get(el.getAttribute("data-path")) || "";
+        }
+      })
+      .catch(err => {
+        console.log(err);
+        for (const el of batch) {
+          el.innerText = "[preview unavailable]";
+        }
+      });
+  }
+}
+
+window.onload = loadPreviews;
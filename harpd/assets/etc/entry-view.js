@@ -1,10 +1,18 @@
+// The path under which harpocrates is served, with a trailing slash. This
+// script is served from that path, so it can be determined from the script's
+// URL.
+const BASE_PATH = new URL(".", document.currentScript.src).pathname;
+
 function hidePasswordData() {
   // Only attempt to hide the password data if there is some.
   if (document.getElementById("passdata")) {
     // Remove content.
     window.getSelection().empty();
     document.getElementById("content-view").innerText = "[hidden]";
-    document.getElementById("content-edit").remove();
+    const editEl = document.getElementById("content-edit");
+    if (editEl) {
+      editEl.remove();
+    }
 
     // Make the edit link noninteractive since password data has been hidden.
     const el = document.getElementById("edit-link")
@@ -13,113 +21,231 @@ function hidePasswordData() {
   }
 }
 
+// entryField returns a promise of the value of the named field of the entry
+// being viewed. If the page includes the value, it is given as value;
+// otherwise (i.e. if the server masks the entry's fields), value is null, and
+// the field is fetched from the server.
+function entryField(name, value) {
+  if (value !== null) {
+    return Promise.resolve(value);
+  }
+  return fetch("?" + new URLSearchParams({field: name}).toString(), {credentials: "same-origin"})
+    .then(resp => {
+      if (!resp.ok) {
+        throw new Error("field request failed: " + resp.status);
+      }
+      return resp.text();
+    });
+}
+
+// rerollGeneratedPassword requests a new randomly-generated password from the
+// server, using the parameters currently selected in the UI.
 function rerollGeneratedPassword() {
   const len = parseInt(document.getElementById("pwgen-length").value);
-  const charset = document.getElementById("pwgen-cs").value;
-  if (isNaN(len) || charset.length === 0) {
+  let sets = "";
+  for (const el of document.getElementsByClassName("pwgen-cs")) {
+    if (el.checked) {
+      sets += el.getAttribute("data-set");
+    }
+  }
+  if (isNaN(len) || sets.length === 0) {
     document.getElementById("pwgen").innerText = "n/a";
     document.getElementById("pwgen-bits").innerText = "0";
     return;
   }
 
-  const securityBits = len * Math.log2(charset.length);
-  document.getElementById("pwgen").innerText = randomString(len, charset);
-  document.getElementById("pwgen-bits").innerText = securityBits.toFixed(1);
+  const params = new URLSearchParams({len: len, sets: sets});
+  if (document.getElementById("pwgen-noambig").checked) {
+    params.set("noambig", "1");
+  }
+  fetch(BASE_PATH + "generate?" + params.toString(), {credentials: "same-origin"})
+    .then(resp => {
+      if (!resp.ok) {
+        throw new Error("generate request failed: " + resp.status);
+      }
+      return resp.json();
+    })
+    .then(data => {
+      document.getElementById("pwgen").innerText = data.password;
+      document.getElementById("pwgen-bits").innerText = data.bits.toFixed(1);
+    })
+    .catch(err => {
+      console.error('Failed to generate password: ', err);
+      document.getElementById("pwgen").innerText = "n/a";
+      document.getElementById("pwgen-bits").innerText = "0";
+    });
 }
 
-// randomString returns a cryptographically-strong random string of the given
-// length, with characters taken from the given character set.
-function randomString(len, charset) {
-  let result = '';
-  const g = makeGenerator(charset.length);
-  while (len--) {
-    result += charset.charAt(g());
+// SESSION_WARNING_S is how long before session expiry the user is warned.
+const SESSION_WARNING_S = 60;
+
+// updateSessionExpiry updates the session-expiry warning based on the
+// session's expiration time, scheduling itself to run again. If the session
+// will expire at its absolute deadline, it can't be extended, so no keepalive
+// link is offered.
+function updateSessionExpiry() {
+  const el = document.getElementById("session-expiry");
+  const expiresAt = parseInt(el.getAttribute("data-expires-at"));
+  const deadlineAt = el.getAttribute("data-deadline-at");
+  const atDeadline = deadlineAt !== null && expiresAt >= parseInt(deadlineAt);
+  const remainingS = Math.round(expiresAt - Date.now() / 1000);
+  if (remainingS > SESSION_WARNING_S) {
+    el.style.display = 'none';
+  } else if (remainingS > 0) {
+    if (atDeadline) {
+      if (!document.getElementById("session-ending")) {
+        el.innerHTML = '<span id="session-ending">Your session will end in <span id="session-remaining"></span> seconds. Log in again to continue.</span>';
+      }
+    } else if (!document.getElementById("session-keepalive")) {
+      el.innerHTML = 'Your session will expire in <span id="session-remaining"></span> seconds. <a id="session-keepalive" href><span class="fa">&#xf021;</span> Stay logged in</a>';
+      document.getElementById("session-keepalive").onclick = function() {
+        keepSessionAlive();
+        return false;
+      }
+    }
+    document.getElementById("session-remaining").innerText = remainingS;
+    el.style.display = 'block';
+  } else {
+    el.innerText = "Your session has expired.";
+    el.style.display = 'block';
+    return;
   }
-  return result;
+  window.clearTimeout(updateSessionExpiry.timeoutID);
+  updateSessionExpiry.timeoutID = window.setTimeout(updateSessionExpiry, 1000);
 }
 
-// makeGenerator returns a generator function that returns values uniformly at
-// random in the range [0, k). k must be an unsigned 32-bit number, i.e. in
-// the range [0, 0xFFFFFFFF].
-function makeGenerator(k) {
-  const MAX_UINT32 = 0xFFFFFFFF;
-
-  // Let N = MAX_UINT32+1 = 0x100000000. Our basic randomness primitive is to
-  // generate a random number uniformly in the range [0, N). We want a number
-  // uniformly in the range [0, k). The first question is if we can do this
-  // without rejection sampling: we can do without rejection sampling iff N %
-  // k == 0, or equivalently, (N-1) % k == k - 1.
-
-  const r = MAX_UINT32 % k;
-  if (r === k-1) {
-    // The desired range [0, k) divides evenly into natural range [0, N). No
-    // need for rejection sampling, just use a modulus.
-    return () => nextUint32() % k;
-  } else {
-    // The desired range [0, k) does not divide evenly into natural range [0,
-    // N). We must use rejection sampling. Our basic strategy is still to use
-    // a modulus, but reject any samples from [0, N) that are in the final
-    // "partial" band of remainders to ensure uniformity in the eventual
-    // result. There are N % k == r + 1 elements in the partial band, so we
-    // want to reject any samples values that are greater than or equal to N -
-    // (N % k) == N - (r+1) == MAX_UINT32 - r.
-    const lim = MAX_UINT32 - r;
-    return () => {
-      let v;
-      do {
-        v = nextUint32();
-      } while (v >= lim);
-      return v % k;
-    };
+// csrfToken returns the CSRF token of the current session, which must
+// accompany state-changing requests.
+function csrfToken() {
+  return document.querySelector('meta[name="csrf-token"]').content;
+}
+
+// Descriptions of each password strength score, from 0 to 4.
+const STRENGTH_SCORES = ["very weak", "weak", "fair", "strong", "very strong"];
+
+// How long to wait after the content being edited changes before checking the
+// strength of its password, in milliseconds.
+const STRENGTH_CHECK_DELAY_MS = 300;
+
+let strengthCheckTimeout = null;
+
+// checkPasswordStrength asks the server for the strength of the password (the
+// first line) of the content being edited, and shows it beneath the editor.
+function checkPasswordStrength() {
+  const el = document.getElementById("password-strength");
+  const password = document.getElementById("content-edit-content").value.split("\n", 1)[0];
+  if (password === "") {
+    el.innerText = "";
+    return;
   }
+  fetch(BASE_PATH + "strength", {
+    method: "POST",
+    credentials: "same-origin",
+    headers: {"X-CSRF-Token": csrfToken()},
+    body: new URLSearchParams({password: password}),
+  })
+    .then(resp => {
+      if (!resp.ok) {
+        throw new Error("strength request failed: " + resp.status);
+      }
+      return resp.json();
+    })
+    .then(data => {
+      el.innerText = "Password strength: " + STRENGTH_SCORES[data.score] + " (could be guessed in " + data.crack_time + ")";
+      el.classList.toggle("warning", data.score <= 1);
+    })
+    .catch(err => console.log(err));
+}
+
+// keepSessionAlive extends the lifetime of the current session.
+function keepSessionAlive() {
+  fetch(BASE_PATH + "keepalive", {method: "POST", credentials: "same-origin", headers: {"X-CSRF-Token": csrfToken()}})
+    .then(resp => {
+      if (!resp.ok) {
+        throw new Error("keepalive request failed: " + resp.status);
+      }
+      return resp.json();
+    })
+    .then(data => {
+      const el = document.getElementById("session-expiry");
+      el.setAttribute("data-expires-at", Math.floor(Date.now() / 1000 + data.ttl_s));
+      if (data.deadline_ttl_s !== undefined) {
+        el.setAttribute("data-deadline-at", Math.floor(Date.now() / 1000 + data.deadline_ttl_s));
+      }
+      el.innerText = "";
+      updateSessionExpiry();
+  window.setTimeout(updateOTP, 1000);
+    })
+    .catch(err => console.error('Failed to keep session alive: ', err));
 }
 
-// nextUint32 returns a uniformly-chosen random uint32, i.e. in the range [0,
-// 0xFFFFFFFF].
-function nextUint32() {
-  const BUF_SZ = 256;
-  if (nextUint32.buf === undefined) {
-    nextUint32.buf = new Uint32Array(BUF_SZ);
-    nextUint32.next = BUF_SZ;
+// updateOTP counts down the time remaining for the displayed one-time code,
+// fetching a new code once the current one expires.
+function updateOTP() {
+  const remainingEl = document.getElementById("otp-remaining");
+  if (!remainingEl) {
+    return;
   }
-  if (nextUint32.next >= BUF_SZ) {
-    window.crypto.getRandomValues(nextUint32.buf);
-    nextUint32.next = 0;
+  const remaining = parseInt(remainingEl.getAttribute("data-expires-in")) - 1;
+  if (remaining > 0) {
+    remainingEl.setAttribute("data-expires-in", remaining);
+    remainingEl.innerText = remaining;
+    window.setTimeout(updateOTP, 1000);
+    return;
   }
-  return nextUint32.buf[nextUint32.next++];
-}
 
-const CS_ALPHANUM = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789";
-const CS_ALPHANUM_SPECIAL = CS_ALPHANUM + "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+  fetch(BASE_PATH + "api/p" + window.location.pathname.slice(BASE_PATH.length - 1) + "/otp", {credentials: "same-origin", headers: {"Accept": "application/json"}})
+    .then(resp => {
+      if (!resp.ok) {
+        throw new Error("OTP request failed: " + resp.status);
+      }
+      return resp.json();
+    })
+    .then(data => {
+      document.getElementById("otp-code").innerText = data.code;
+      remainingEl.setAttribute("data-expires-in", data.expires_in);
+      remainingEl.innerText = data.expires_in;
+      window.setTimeout(updateOTP, 1000);
+    })
+    .catch(err => console.error('Failed to refresh one-time code: ', err));
+}
 
 window.onload = function() {
   const hidePasswordDataTimeoutID = window.setTimeout(hidePasswordData, 60000);
+  updateSessionExpiry();
+  window.setTimeout(updateOTP, 1000);
 
-  // General UI elements.
+  // General UI elements. If the page leaves out the editor, the edit link
+  // instead loads the page again with the editor included.
   const editLink = document.getElementById("edit-link")
-  editLink.onclick = function() {
-    // Cancel the hide-password timer since we are now in edit mode.
-    window.clearTimeout(hidePasswordDataTimeoutID);
+  const contentEditEl = document.getElementById("content-edit");
+  if (contentEditEl) {
+    editLink.onclick = function() {
+      // Cancel the hide-password timer since we are now in edit mode.
+      window.clearTimeout(hidePasswordDataTimeoutID);
 
-    // Set up the generated-password UI elements.
-    document.getElementById("pwgen-cs").value = CS_ALPHANUM_SPECIAL;
-    rerollGeneratedPassword();
+      // Set up the generated-password UI elements, if a password is being suggested.
+      if (document.getElementById("pwgen")) {
+        rerollGeneratedPassword();
+      }
 
-    // Remove the view UI, make the edit UI visible.
-    document.getElementById("content-view").remove();
-    document.getElementById("content-edit").style.display = 'block';
+      // Remove the view UI, make the edit UI visible.
+      document.getElementById("content-view").remove();
+      document.getElementById("content-edit").style.display = 'block';
 
-    // Make the edit link noninteractive once it has been clicked.
-    editLink.removeAttribute("href");
-    editLink.onclick = null;
-    return false;
+      // Make the edit link noninteractive once it has been clicked.
+      editLink.removeAttribute("href");
+      editLink.onclick = null;
+      return false;
+    }
   }
 
   // Password view UI elements.
   let copyPasswordEl = document.getElementById("copy-password");
   if (copyPasswordEl) {
     copyPasswordEl.onclick = function() {
-      navigator.clipboard.writeText(document.getElementById("passdata").getAttribute("data-password"))
+      entryField("password", document.getElementById("passdata").getAttribute("data-password"))
+        .then(password => navigator.clipboard.writeText(password))
         .catch(err => console.error('Failed to write clipboard contents: ', err));
       return false;
     }
@@ -128,44 +254,93 @@ window.onload = function() {
   let showPasswordEl = document.getElementById("show-password");
   if (showPasswordEl) {
     showPasswordEl.onclick = function() {
-      const password = document.getElementById("passdata").getAttribute("data-password")
-      // This removes the controls, so user can't click this twice.
-      document.getElementById("pass-controls").innerText = password;
+      entryField("password", document.getElementById("passdata").getAttribute("data-password"))
+        .then(password => {
+          // This removes the controls, so user can't click this twice.
+          document.getElementById("pass-controls").innerText = password;
+        })
+        .catch(err => console.error('Failed to show password: ', err));
       return false;
     }
   }
 
-  // Password generator UI elements.
-  document.getElementById("pwgen-copy").onclick = function() {
-    const password = document.getElementById("pwgen").innerText;
-    if (password === "n/a") {
-      return;
+  let copyOTPEl = document.getElementById("copy-otp");
+  if (copyOTPEl) {
+    copyOTPEl.onclick = function() {
+      navigator.clipboard.writeText(document.getElementById("otp-code").innerText)
+        .catch(err => console.error('Failed to write clipboard contents: ', err));
+      return false;
     }
-    navigator.clipboard.writeText(password)
-      .catch(err => console.error('Failed to write clipboard contents: ', err));
-  }
-
-  document.getElementById("pwgen-reroll").onclick = rerollGeneratedPassword;
-  document.getElementById("pwgen-length").onchange = rerollGeneratedPassword;
-  document.getElementById("pwgen-cs").onchange = rerollGeneratedPassword;
-  
-  const pwgenCsEl = document.getElementById("pwgen-cs");
-  document.getElementById("pwgen-cs-lns").onclick = function() {
-    pwgenCsEl.disabled = true;
-    if (pwgenCsEl.value !== CS_ALPHANUM_SPECIAL) {
-      pwgenCsEl.value = CS_ALPHANUM_SPECIAL;
-      rerollGeneratedPassword();
+  }
+
+  for (const el of document.getElementsByClassName("copy-field")) {
+    el.onclick = function() {
+      entryField(el.getAttribute("data-field"), el.getAttribute("data-value"))
+        .then(value => navigator.clipboard.writeText(value))
+        .catch(err => console.error('Failed to write clipboard contents: ', err));
+      return false;
     }
   }
-  document.getElementById("pwgen-cs-ln").onclick = function() {
-    pwgenCsEl.disabled = true;
-    if (pwgenCsEl.value !== CS_ALPHANUM) {
-      pwgenCsEl.value = CS_ALPHANUM;
-      rerollGeneratedPassword();
+
+  // Notes are only shown on request if the server masks the entry's fields.
+  let showNotesEl = document.getElementById("show-notes");
+  if (showNotesEl) {
+    showNotesEl.onclick = function() {
+      entryField("notes", null)
+        .then(notes => {
+          // This removes the link, so user can't click this twice.
+          document.getElementById("notes").innerText = notes;
+        })
+        .catch(err => console.error('Failed to show notes: ', err));
+      return false;
     }
   }
-  document.getElementById("pwgen-cs-custom").onclick = function() {
-    pwgenCsEl.disabled = false;
-    pwgenCsEl.focus();
+
+  // Password generator UI elements, shown when creating a new entry or when a
+  // new password is requested.
+  const pwgenCopyEl = document.getElementById("pwgen-copy");
+  if (pwgenCopyEl) {
+    pwgenCopyEl.onclick = function() {
+      const password = document.getElementById("pwgen").innerText;
+      if (password === "n/a") {
+        return;
+      }
+      navigator.clipboard.writeText(password)
+        .catch(err => console.error('Failed to write clipboard contents: ', err));
+    }
+
+    document.getElementById("pwgen-reroll").onclick = rerollGeneratedPassword;
+    document.getElementById("pwgen-length").onchange = rerollGeneratedPassword;
+    document.getElementById("pwgen-noambig").onchange = rerollGeneratedPassword;
+    for (const el of document.getElementsByClassName("pwgen-cs")) {
+      el.onchange = rerollGeneratedPassword;
+    }
+  }
+
+  // Entry template UI elements, shown when creating a new entry. Choosing a
+  // template replaces the content being edited with the (already-expanded)
+  // template content.
+  const templateSelectEl = document.getElementById("template-select");
+  if (templateSelectEl) {
+    templateSelectEl.onchange = function() {
+      const opt = templateSelectEl.options[templateSelectEl.selectedIndex];
+      document.getElementById("content-edit-content").value = opt.getAttribute("data-content") || "";
+      checkPasswordStrength();
+    }
+  }
+
+  // Password strength feedback, updated shortly after the user stops typing.
+  const contentEditContentEl = document.getElementById("content-edit-content");
+  if (contentEditContentEl) {
+    contentEditContentEl.addEventListener("input", function() {
+      clearTimeout(strengthCheckTimeout);
+      strengthCheckTimeout = setTimeout(checkPasswordStrength, STRENGTH_CHECK_DELAY_MS);
+    });
+  }
+
+  // Start in edit mode if requested, e.g. when creating a new entry, or if
+  // submitted content could not be saved & is being shown again.
+  if (contentEditEl && (new URLSearchParams(window.location.search).has("edit") || contentEditEl.hasAttribute("data-draft"))) {
+    editLink.onclick();
   }
 }
@@ -1,4 +1,9 @@
-async function performRegistration(challenge) {
+// The path under which harpocrates is served, with a trailing slash. This
+// script is served from that path, so it can be determined from the script's
+// URL.
+const BASE_PATH = new URL(".", document.currentScript.src).pathname;
+
+async function performRegistration(challenge, label) {
   const el = document.getElementById("message");
 
   try {
@@ -22,16 +27,24 @@ async function performRegistration(challenge) {
       toSend.extensions = cred.extensions;
     }
 
-    const resp = await fetch('/register', {
+    const resp = await fetch(BASE_PATH + 'register?label=' + encodeURIComponent(label), {
       method: 'POST',
-      headers: {'Content-Type': 'application/json'},
+      headers: {
+        'Content-Type': 'application/json',
+        'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
+      },
       body: JSON.stringify(toSend),
     });
 
-    // Display the registration on the page.
-    if (resp.ok) {
-      const reg = await resp.text();
-      el.innerText = `Registration: ${reg}`;
+    // If the server keeps track of registered devices, show the new device in the list of devices.
+    // Otherwise, display the registration on the page, to be added to the config, and offer to
+    // continue: the device is usable until the server restarts.
+    if (resp.status === 204) {
+      window.location.reload();
+    } else if (resp.ok) {
+      document.getElementById("registration").innerText = await resp.text();
+      document.getElementById("registered").hidden = false;
+      el.innerText = "MFA device registered.";
     } else {
       const errorText = await resp.text();
       throw errorText
@@ -42,4 +55,6 @@ async function performRegistration(challenge) {
   }
 }
 
-performRegistration(document.getElementById("data").getAttribute("data-challenge"));
\ No newline at end of file
+document.getElementById("register").addEventListener("click", () => {
+  performRegistration(document.getElementById("data").getAttribute("data-challenge"), document.getElementById("label").value);
+});
\ No newline at end of file
@@ -0,0 +1,45 @@
+function decode(s) {
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+}
+
+function encode(buf) {
+  return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)));
+}
+
+// Logs in with a discoverable credential, POSTing the assertion along with the
+// output of the device's PRF extension, which unwraps the passphrase.
+async function performLogin() {
+  const el = document.getElementById("passwordless-message");
+  const form = document.getElementById("passwordless");
+
+  try {
+    const pubKeyCredOpts = JSON.parse(form.getAttribute("data-challenge"));
+    pubKeyCredOpts.challenge = decode(pubKeyCredOpts.challenge);
+    pubKeyCredOpts.extensions.prf.eval.first = decode(pubKeyCredOpts.extensions.prf.eval.first);
+    const resp = await navigator.credentials.get({publicKey: pubKeyCredOpts});
+    const prf = resp.getClientExtensionResults().prf;
+    if (!prf || !prf.results || !prf.results.first) {
+      el.innerText = "This MFA device can't log in in place of the passphrase; enter the passphrase instead.";
+      return;
+    }
+
+    document.getElementById("passwordless-response").value = JSON.stringify({
+      id: resp.id,
+      rawId: encode(resp.rawId),
+      response: {
+        authenticatorData: encode(resp.response.authenticatorData),
+        signature: encode(resp.response.signature),
+        clientDataJSON: encode(resp.response.clientDataJSON),
+        userHandle: resp.response.userHandle ? encode(resp.response.userHandle) : null,
+      },
+      type: resp.type
+    });
+    document.getElementById("passwordless-prf").value = encode(prf.results.first);
+    form.submit();
+  } catch(e) {
+    console.error(e);
+    el.innerText = `Authentication failure (see console for details); enter the passphrase instead.`;
+  }
+}
+
+document.getElementById("passwordless-login").addEventListener("click", performLogin);
@@ -0,0 +1,91 @@
+// The path under which harpocrates is served, with a trailing slash. This
+// script is served from that path, so it can be determined from the script's
+// URL.
+const BASE_PATH = new URL(".", document.currentScript.src).pathname;
+
+function decode(s) {
+  return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+}
+
+function encode(buf) {
+  return btoa(String.fromCharCode.apply(null, new Uint8Array(buf)));
+}
+
+// Registers a new MFA device with a discoverable credential, as /register does.
+async function registerDevice(challenge, label) {
+  const pubKeyCredOpts = JSON.parse(challenge);
+  pubKeyCredOpts.challenge = decode(pubKeyCredOpts.challenge);
+  pubKeyCredOpts.user.id = decode(pubKeyCredOpts.user.id);
+  if(pubKeyCredOpts.excludeCredentials) {
+    for (let i = 0; i < pubKeyCredOpts.excludeCredentials.length; i++) {
+      pubKeyCredOpts.excludeCredentials[i].id = decode(pubKeyCredOpts.excludeCredentials[i].id);
+    }
+  }
+  const cred = await navigator.credentials.create({publicKey: pubKeyCredOpts});
+
+  const toSend = {
+    id: cred.id,
+    type: cred.type,
+    rawId: encode(cred.rawId),
+    response: {
+      attestationObject: encode(cred.response.attestationObject),
+      clientDataJSON: encode(cred.response.clientDataJSON),
+    },
+  }
+  const resp = await fetch(BASE_PATH + 'register?label=' + encodeURIComponent(label), {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content,
+    },
+    body: JSON.stringify(toSend),
+  });
+  if (!resp.ok) {
+    throw await resp.text();
+  }
+}
+
+// Makes an assertion with a discoverable credential, then POSTs it along with
+// the output of the device's PRF extension, which wraps the passphrase.
+async function enable(register) {
+  const el = document.getElementById("message");
+  const data = document.getElementById("data");
+
+  try {
+    if (register) {
+      el.innerText = "Touch your MFA device to register it.";
+      await registerDevice(data.getAttribute("data-registration-challenge"), document.getElementById("label").value);
+      el.innerText = "MFA device registered. Touch it again to allow it to log in.";
+    }
+
+    const pubKeyCredOpts = JSON.parse(data.getAttribute("data-challenge"));
+    pubKeyCredOpts.challenge = decode(pubKeyCredOpts.challenge);
+    pubKeyCredOpts.extensions.prf.eval.first = decode(pubKeyCredOpts.extensions.prf.eval.first);
+    const resp = await navigator.credentials.get({publicKey: pubKeyCredOpts});
+    const prf = resp.getClientExtensionResults().prf;
+    if (!prf || !prf.results || !prf.results.first) {
+      el.innerText = "This MFA device can't log in in place of the passphrase.";
+      return;
+    }
+
+    document.getElementById("response").value = JSON.stringify({
+      id: resp.id,
+      rawId: encode(resp.rawId),
+      response: {
+        authenticatorData: encode(resp.response.authenticatorData),
+        signature: encode(resp.response.signature),
+        clientDataJSON: encode(resp.response.clientDataJSON),
+        userHandle: resp.response.userHandle ? encode(resp.response.userHandle) : null,
+      },
+      type: resp.type
+    });
+    document.getElementById("prf").value = encode(prf.results.first);
+    data.submit();
+  } catch(e) {
+    console.error(e);
+    el.innerText = `Failure (see console for details)`;
+  }
+}
+
+document.getElementById("register").addEventListener("click", () => enable(true));
+document.getElementById("enable").addEventListener("click", () => enable(false));
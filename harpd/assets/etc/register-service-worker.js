@@ -0,0 +1,9 @@
+// Registers the service worker, which allows harpocrates to be installed as
+// an app & caches static assets for use while offline.
+// The service worker is served alongside this script, from the path under
+// which harpocrates is served, and controls every page beneath that path.
+if ("serviceWorker" in navigator) {
+  const base = new URL(".", document.currentScript.src);
+  navigator.serviceWorker.register(new URL("service-worker.js", base), {scope: base.pathname})
+    .catch(err => console.error('Failed to register service worker: ', err));
+}
@@ -0,0 +1,87 @@
+// The harpocrates service worker. Only static assets are cached; everything
+// else (in particular, every page requiring authentication) always goes to
+// the network, and is never stored.
+
+const CACHE_NAME = "harpocrates-static";
+
+// The path under which harpocrates is served, with a trailing slash. The
+// service worker is served from that path.
+const BASE_PATH = new URL(".", self.location).pathname;
+
+// Paths of the static assets which may be cached. Requests for these paths
+// with a "v" query parameter name a specific, content-hashed version of the
+// asset, which never changes.
+const STATIC_PATHS = new Set([
+  "style.css",
+  "style-dark.css",
+  "favicon.ico",
+  "icon.svg",
+  "font-awesome.otf",
+  "entry-view.js",
+  "mfa-register.js",
+  "mfa-authenticate.js",
+  "register-service-worker.js",
+  "manifest.webmanifest",
+].map(p => BASE_PATH + p));
+
+self.addEventListener("install", event => {
+  self.skipWaiting();
+});
+
+self.addEventListener("activate", event => {
+  // Remove caches left behind by other versions of the service worker.
+  event.waitUntil(
+    caches.keys()
+      .then(names => Promise.all(names.filter(n => n !== CACHE_NAME).map(n => caches.delete(n))))
+      .then(() => self.clients.claim()));
+});
+
+self.addEventListener("fetch", event => {
+  const req = event.request;
+  const url = new URL(req.url);
+  if (req.method !== "GET" || url.origin !== self.location.origin || !STATIC_PATHS.has(url.pathname)) {
+    if (req.mode === "navigate") {
+      event.respondWith(fetch(req).catch(offlineResponse));
+    }
+    return;
+  }
+
+  if (url.searchParams.has("v")) {
+    // Content-hashed assets: serve from the cache if possible.
+    event.respondWith(caches.open(CACHE_NAME).then(cache => cache.match(req).then(cached => cached || fetchAndCache(cache, req))));
+  } else {
+    // Other assets: prefer the network, falling back to whichever version of
+    // the asset is cached while offline.
+    event.respondWith(caches.open(CACHE_NAME).then(cache => fetchAndCache(cache, req).catch(err => cache.match(req, {ignoreSearch: true}).then(cached => {
+      if (!cached) {
+        throw err;
+      }
+      return cached;
+    }))));
+  }
+});
+
+// fetchAndCache fetches the given request from the network, storing a
+// successful response in the cache in place of any other version of the same
+// asset.
+async function fetchAndCache(cache, req) {
+  const resp = await fetch(req);
+  if (resp.ok) {
+    const path = new URL(req.url).pathname;
+    for (const key of await cache.keys()) {
+      if (new URL(key.url).pathname === path) {
+        await cache.delete(key);
+      }
+    }
+    await cache.put(req, resp.clone());
+  }
+  return resp;
+}
+
+// offlineResponse is served in place of a page which could not be fetched.
+function offlineResponse() {
+  const body = '<html><head><meta name="viewport" content="width=device-width, initial-scale=0.5"><title>Offline</title>' +
+    '<link rel="stylesheet" type="text/css" href="' + BASE_PATH + 'style.css"></head><body><div class="content"><div class="header"><h1>Offline</h1></div>' +
+    '<div class="inner-content">Harpocrates can\'t be reached. Passwords are never stored on this device, so they are unavailable until you are back online.</div></div></body></html>';
+  return new Response(body, {status: 503, headers: {"Content-Type": "text/html; charset=utf-8", "Cache-Control": "no-store"}});
+}
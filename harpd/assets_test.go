@@ -0,0 +1,27 @@
+package assets
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+)
+
+func TestMustAsset(t *testing.T) {
+	t.Parallel()
+	want, err := fs.ReadFile(FS, "etc/robots.txt")
+	if err != nil {
+		t.Fatalf("Could not read asset: %v", err)
+	}
+	for _, name := range []string{"etc/robots.txt", "harpd/assets/etc/robots.txt"} {
+		if got := MustAsset(name); !bytes.Equal(got, want) {
+			t.Errorf("MustAsset(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustAsset of nonexistent asset did not panic")
+		}
+	}()
+	MustAsset("etc/nonexistent.txt")
+}
@@ -0,0 +1,198 @@
+// Package authlog provides a persistent record of login attempts, by client
+// IP address.
+package authlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	apb "github.com/BranLwyd/harpocrates/harpd/proto/authlog_go_proto"
+)
+
+// Client describes the recorded login attempts of a single client.
+type Client struct {
+	IP          string
+	Failures    int64     // total number of failed attempts
+	LastFailure time.Time // zero if there has been no failed attempt
+	LastSuccess time.Time // zero if there has been no successful attempt
+}
+
+// LastAttempt returns the time of the client's most recent login attempt.
+func (c Client) LastAttempt() time.Time {
+	if c.LastFailure.After(c.LastSuccess) {
+		return c.LastFailure
+	}
+	return c.LastSuccess
+}
+
+// Log stores login attempts, keyed by client IP, persisting them to a file on
+// disk. Clients which have made no attempts within the retention period are
+// forgotten. It is safe for concurrent use from multiple goroutines.
+type Log struct {
+	filename  string
+	retention time.Duration
+	window    time.Duration
+
+	mu      sync.Mutex               // protects clients, recent
+	clients map[string]*apb.Attempts // by client IP
+	recent  map[string][]time.Time   // times of failures within the window, by client IP, oldest first; not persisted
+}
+
+// New creates a new log persisted in the given file, remembering each client
+// for the given retention period after its last attempt. Recent failures are
+// those within the given window. If the file does not yet exist, the log
+// starts out empty; the file will be created on the first recorded attempt.
+func New(filename string, retention, window time.Duration) (*Log, error) {
+	if retention <= 0 {
+		return nil, fmt.Errorf("retention must be positive")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	l := &Log{
+		filename:  filename,
+		retention: retention,
+		window:    window,
+		clients:   map[string]*apb.Attempts{},
+		recent:    map[string][]time.Time{},
+	}
+	logBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	al := &apb.AuthLog{}
+	if err := proto.Unmarshal(logBytes, al); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for k, v := range al.Client {
+		l.clients[k] = v
+	}
+	return l, nil
+}
+
+// RecordFailure records a failed login attempt by the given client at time t,
+// returning the number of failed attempts made by the client within the log's
+// window, including this one. The update is persisted to disk before
+// RecordFailure returns; if persisting fails, an error is returned, though
+// the attempt is still counted as recent.
+//
+// On POSIX-compliant systems, the update to the file on disk is atomic.
+func (l *Log) RecordFailure(ip string, t time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rs := append(l.recent[ip], t)
+	for len(rs) > 0 && !rs[0].After(t.Add(-l.window)) {
+		rs = rs[1:]
+	}
+	l.recent[ip] = rs
+
+	old := l.clients[ip]
+	a := &apb.Attempts{}
+	if old != nil {
+		a = proto.Clone(old).(*apb.Attempts)
+	}
+	a.Failures++
+	a.LastFailureUnixNanos = t.UnixNano()
+	return len(rs), l.update(ip, old, a, t)
+}
+
+// RecordSuccess records a successful login by the given client at time t. As
+// with RecordFailure, the update is persisted to disk before RecordSuccess
+// returns.
+func (l *Log) RecordSuccess(ip string, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.clients[ip]
+	a := &apb.Attempts{}
+	if old != nil {
+		a = proto.Clone(old).(*apb.Attempts)
+	}
+	a.LastSuccessUnixNanos = t.UnixNano()
+	return l.update(ip, old, a, t)
+}
+
+// Clients returns the recorded clients, most recent attempt first.
+func (l *Log) Clients() []Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cs := make([]Client, 0, len(l.clients))
+	for ip, a := range l.clients {
+		c := Client{IP: ip, Failures: a.Failures}
+		if a.LastFailureUnixNanos != 0 {
+			c.LastFailure = time.Unix(0, a.LastFailureUnixNanos)
+		}
+		if a.LastSuccessUnixNanos != 0 {
+			c.LastSuccess = time.Unix(0, a.LastSuccessUnixNanos)
+		}
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].LastAttempt().After(cs[j].LastAttempt()) })
+	return cs
+}
+
+// update replaces the attempts recorded for ip (previously old, which may be
+// nil) with a, prunes clients outside of the retention period as of time now,
+// and writes the result to disk. If writing fails, the update is undone. l.mu
+// must be held.
+func (l *Log) update(ip string, old, a *apb.Attempts, now time.Time) error {
+	l.clients[ip] = a
+	pruned := map[string]*apb.Attempts{}
+	cutoff := now.Add(-l.retention).UnixNano()
+	for k, v := range l.clients {
+		if v.LastFailureUnixNanos < cutoff && v.LastSuccessUnixNanos < cutoff {
+			pruned[k] = v
+			delete(l.clients, k)
+			delete(l.recent, k)
+		}
+	}
+	if err := l.write(); err != nil {
+		for k, v := range pruned {
+			l.clients[k] = v
+		}
+		if old != nil {
+			l.clients[ip] = old
+		} else {
+			delete(l.clients, ip)
+		}
+		return err
+	}
+	return nil
+}
+
+// write writes the current attempts to disk. l.mu must be held.
+func (l *Log) write() error {
+	logBytes, err := proto.Marshal(&apb.AuthLog{Client: l.clients})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal auth log: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(l.filename), ".harp_authlog_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0660); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(logBytes); err != nil {
+		return fmt.Errorf("couldn't write auth log: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, l.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, l.filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package authlog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthLog(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_authlog_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "authlog")
+	l, err := New(filename, 24*time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Could not create auth log: %v", err)
+	}
+
+	// Failures are counted within the window.
+	base := time.Unix(1500000000, 0)
+	for i, test := range []struct {
+		offset     time.Duration
+		wantRecent int
+	}{
+		{0, 1},
+		{time.Minute, 2},
+		{9 * time.Minute, 3},
+		{11 * time.Minute, 2}, // the earliest failures are no longer within the window
+		{30 * time.Minute, 1},
+	} {
+		recent, err := l.RecordFailure("192.0.2.1", base.Add(test.offset))
+		if err != nil {
+			t.Fatalf("Could not record failure %d: %v", i, err)
+		}
+		if recent != test.wantRecent {
+			t.Errorf("RecordFailure %d returned %d recent failures, want %d", i, recent, test.wantRecent)
+		}
+	}
+	if err := l.RecordSuccess("192.0.2.2", base.Add(time.Hour)); err != nil {
+		t.Fatalf("Could not record success: %v", err)
+	}
+	want := []Client{
+		{IP: "192.0.2.2", LastSuccess: base.Add(time.Hour)},
+		{IP: "192.0.2.1", Failures: 5, LastFailure: base.Add(30 * time.Minute)},
+	}
+	if got := l.Clients(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Clients() = %v, want %v", got, want)
+	}
+
+	// Attempts are persisted.
+	l, err = New(filename, 24*time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Could not reopen auth log: %v", err)
+	}
+	if got := l.Clients(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("After reopening, Clients() = %v, want %v", got, want)
+	}
+
+	// Clients are pruned once outside of the retention period.
+	if err := l.RecordSuccess("192.0.2.2", base.Add(25*time.Hour)); err != nil {
+		t.Fatalf("Could not record success: %v", err)
+	}
+	want = []Client{{IP: "192.0.2.2", LastSuccess: base.Add(25 * time.Hour)}}
+	if got := l.Clients(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("After pruning, Clients() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+// Package certs provides a TLS certificate loaded from files on disk, which
+// can be reloaded without restarting the server.
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+)
+
+// Reloader serves a TLS certificate & key loaded from files on disk. When the
+// files change (e.g. because the certificate was renewed), Reload must be
+// called to begin serving the new certificate. It is safe for concurrent use
+// from multiple goroutines.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex // protects cert
+	cert *tls.Certificate
+}
+
+// NewReloader creates a new reloader serving the PEM-encoded certificate
+// chain & private key in the given files.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reloads the certificate & key from disk. If they can't be loaded, an
+// error is returned and the previously-loaded certificate continues to be
+// served.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load certificate from %q & %q: %w", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the currently-loaded certificate. It is suitable for
+// use as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
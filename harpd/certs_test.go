@@ -0,0 +1,111 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_certs_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := writeCert(certFile, keyFile, 1); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not create reloader: %v", err)
+	}
+	if got := serial(t, r); got != 1 {
+		t.Errorf("Got certificate with serial number %d, want 1", got)
+	}
+
+	// The certificate is not changed until it is reloaded.
+	if err := writeCert(certFile, keyFile, 2); err != nil {
+		t.Fatalf("Could not write certificate: %v", err)
+	}
+	if got := serial(t, r); got != 1 {
+		t.Errorf("Before reload, got certificate with serial number %d, want 1", got)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Could not reload: %v", err)
+	}
+	if got := serial(t, r); got != 2 {
+		t.Errorf("After reload, got certificate with serial number %d, want 2", got)
+	}
+
+	// If reloading fails, the previous certificate is kept.
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Errorf("Reload with invalid key unexpectedly succeeded")
+	}
+	if got := serial(t, r); got != 2 {
+		t.Errorf("After failed reload, got certificate with serial number %d, want 2", got)
+	}
+
+	// Missing files can't be loaded at all.
+	if _, err := NewReloader(filepath.Join(dir, "nonexistent"), keyFile); err == nil {
+		t.Errorf("NewReloader with nonexistent certificate unexpectedly succeeded")
+	}
+}
+
+// serial returns the serial number of the certificate served by r.
+func serial(t *testing.T, r *Reloader) int64 {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Could not get certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %v", err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+// writeCert writes a new self-signed certificate with the given serial
+// number, and its key, to the given files in PEM format.
+func writeCert(certFile, keyFile string, serial int64) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{Organization: []string{"Harpocrates"}},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
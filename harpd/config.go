@@ -0,0 +1,475 @@
+// Package config parses & validates harpd configuration files.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/BranLwyd/harpocrates/harpd/csp"
+	"github.com/BranLwyd/harpocrates/harpd/handler"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	cpb "github.com/BranLwyd/harpocrates/harpd/proto/config_go_proto"
+)
+
+// Parse parses a configuration, in either protobuf text format or (for
+// compatibility with older configurations) JSON. JSON configurations are
+// recognized by their first non-space character, "{".
+func Parse(data []byte) (*cpb.Config, error) {
+	cfg := &cpb.Config{}
+	if trimmed := bytes.TrimLeftFunc(data, unicode.IsSpace); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := jsonpb.Unmarshal(bytes.NewReader(data), cfg); err != nil {
+			return nil, fmt.Errorf("couldn't parse JSON: %w", err)
+		}
+		return cfg, nil
+	}
+	if err := proto.UnmarshalText(string(data), cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// SetDefaults fills in sensible defaults for unset fields of cfg.
+func SetDefaults(cfg *cpb.Config) {
+	if cfg.SessionDurationS == 0 {
+		cfg.SessionDurationS = 300
+	}
+	if cfg.NewSessionRate == 0 {
+		cfg.NewSessionRate = 1
+	}
+	if cfg.NewSessionBurst == 0 {
+		cfg.NewSessionBurst = 3
+	}
+	if cfg.StoreCacheMaxEntries == 0 {
+		cfg.StoreCacheMaxEntries = 100
+	}
+	if cfg.GitRemote == "" {
+		cfg.GitRemote = "origin"
+	}
+	if cfg.AccessLogMaxEntries == 0 {
+		cfg.AccessLogMaxEntries = 100
+	}
+	if cfg.ShutdownGracePeriodS == 0 {
+		cfg.ShutdownGracePeriodS = 10
+	}
+	if cfg.DirectoryPageSize == 0 {
+		cfg.DirectoryPageSize = 100
+	}
+	if cfg.ShareDurationS == 0 {
+		cfg.ShareDurationS = 600
+	}
+	if cfg.TrashRetentionS == 0 {
+		cfg.TrashRetentionS = 30 * 24 * 60 * 60
+	}
+	if cfg.AuthLogRetentionS == 0 {
+		cfg.AuthLogRetentionS = 30 * 24 * 60 * 60
+	}
+	if cfg.FailedLoginAlertThreshold == 0 {
+		cfg.FailedLoginAlertThreshold = 10
+	}
+	if cfg.FailedLoginAlertWindowS == 0 {
+		cfg.FailedLoginAlertWindowS = 60 * 60
+	}
+	if cfg.AttachmentMaxSize == 0 {
+		cfg.AttachmentMaxSize = handler.DefaultAttachmentMaxSize
+	}
+	if cfg.EntryMaxSize == 0 {
+		cfg.EntryMaxSize = handler.DefaultEntryMaxSize
+	}
+	if cfg.AlertWindowS == 0 {
+		cfg.AlertWindowS = 60
+	}
+	if cfg.AlertMaxPerWindow == 0 {
+		cfg.AlertMaxPerWindow = 10
+	}
+	if cfg.TrustedDeviceDays == 0 {
+		cfg.TrustedDeviceDays = 30
+	}
+	if t, ok := cfg.Tls.(*cpb.Config_PlainHttp); ok && t.PlainHttp.ListenAddr == "" {
+		t.PlainHttp.ListenAddr = "localhost:8080"
+	}
+}
+
+// Validate checks every field of cfg, which should already have had defaults
+// filled in by SetDefaults, returning each problem found. Files which harpd
+// reads at startup must exist.
+func Validate(cfg *cpb.Config) []error {
+	var v validator
+
+	// Serving.
+	switch {
+	case cfg.HostName == "":
+		v.errorf("host_name is required")
+	case !validHostName(cfg.HostName):
+		v.errorf("host_name %q is not a host name, optionally with a port (e.g. \"example.com\" or \"example.com:8443\")", cfg.HostName)
+	}
+	switch t := cfg.Tls.(type) {
+	case nil, *cpb.Config_Acme:
+		if cfg.Email == "" {
+			v.errorf("email is required when using ACME")
+		}
+		if cfg.CertDir == "" {
+			v.errorf("cert_dir is required when using ACME")
+		}
+	case *cpb.Config_Static:
+		if t.Static.CertFile == "" || t.Static.KeyFile == "" {
+			v.errorf("static requires cert_file and key_file")
+		}
+		v.fileExists("static.cert_file", t.Static.CertFile)
+		v.fileExists("static.key_file", t.Static.KeyFile)
+	case *cpb.Config_PlainHttp:
+		if _, _, err := net.SplitHostPort(t.PlainHttp.ListenAddr); err != nil {
+			v.errorf("plain_http.listen_addr %q is invalid: %v", t.PlainHttp.ListenAddr, err)
+		}
+		for _, c := range t.PlainHttp.TrustedProxyCidrs {
+			if _, _, err := net.ParseCIDR(c); err != nil {
+				v.errorf("plain_http.trusted_proxy_cidrs entry %q is invalid: %v", c, err)
+			}
+		}
+	}
+	if _, acme := cfg.Tls.(*cpb.Config_Acme); !acme && cfg.Tls != nil && (cfg.Email != "" || cfg.CertDir != "") {
+		v.errorf("email and cert_dir are only used with ACME, and may not be combined with static or plain_http")
+	}
+	if bp := strings.TrimSuffix(cfg.BasePath, "/"); bp != "" {
+		if err := handler.ValidateBasePath(bp); err != nil {
+			v.errorf("base_path is invalid: %v", err)
+		}
+	}
+	if cfg.SessionCookie != nil {
+		if _, err := SessionCookie(cfg.SessionCookie); err != nil {
+			v.errorf("session_cookie is invalid: %v", err)
+		}
+	}
+	if _, err := ContentSecurityPolicy(cfg.ContentSecurityPolicy); err != nil {
+		v.errorf("content_security_policy is invalid: %v", err)
+	}
+	if cfg.MetricsAddr != "" {
+		if err := CheckLoopbackAddr(cfg.MetricsAddr); err != nil {
+			v.errorf("metrics_addr is invalid: %v", err)
+		}
+	}
+	listenerNames := map[string]bool{}
+	for i, lc := range cfg.Listen {
+		if lc.Name == "" || lc.Addr == "" || lc.Tls == nil || lc.Origin == "" {
+			v.errorf("listen %d requires name, addr, origin, and static or unsafe_http", i)
+		}
+		if lc.Name != "" && !validListenerName(lc.Name) {
+			v.errorf("listen %q has invalid name; names may contain only letters, digits, \"-\" and \"_\"", lc.Name)
+		}
+		if listenerNames[lc.Name] {
+			v.errorf("listen %q has duplicate name", lc.Name)
+		}
+		listenerNames[lc.Name] = true
+		if lc.Addr != "" {
+			if _, _, err := net.SplitHostPort(lc.Addr); err != nil {
+				v.errorf("listen %q has invalid addr %q: %v", lc.Name, lc.Addr, err)
+			}
+		}
+		if lc.Origin != "" && cfg.HostName != "" {
+			if err := session.CheckOrigin("https://"+cfg.HostName, lc.Origin); err != nil {
+				v.errorf("listen %q has unusable origin: %v", lc.Name, err)
+			}
+		}
+		switch t := lc.Tls.(type) {
+		case *cpb.ListenerConfig_Static:
+			if t.Static.CertFile == "" || t.Static.KeyFile == "" {
+				v.errorf("listen %q: static requires cert_file and key_file", lc.Name)
+			}
+			v.fileExists(fmt.Sprintf("static.cert_file of listen %q", lc.Name), t.Static.CertFile)
+			v.fileExists(fmt.Sprintf("static.key_file of listen %q", lc.Name), t.Static.KeyFile)
+		case *cpb.ListenerConfig_UnsafeHttp:
+			if !t.UnsafeHttp.IUnderstandThisIsUnsafe {
+				v.errorf("listen %q: unsafe_http requires i_understand_this_is_unsafe: true", lc.Name)
+			}
+		}
+	}
+
+	// Vaults & users.
+	if len(cfg.Vaults) == 0 && len(cfg.Users) == 0 {
+		if cfg.PassLoc == "" {
+			v.errorf("pass_loc is required")
+		}
+		if cfg.KeyFile == "" {
+			v.errorf("key_file is required")
+		}
+		v.fileExists("key_file", cfg.KeyFile)
+	}
+	names, mounts := map[string]bool{}, map[string]bool{}
+	for i, vc := range cfg.Vaults {
+		if vc.Name == "" || vc.PassLoc == "" || vc.KeyFile == "" || vc.Mount == "" {
+			v.errorf("vault %d requires name, pass_loc, key_file, and mount", i)
+		}
+		if strings.Contains(vc.Mount, "/") || strings.HasPrefix(vc.Mount, ".") {
+			v.errorf("vault %q has invalid mount %q", vc.Name, vc.Mount)
+		}
+		if names[vc.Name] || mounts[vc.Mount] {
+			v.errorf("vault %q has duplicate name or mount", vc.Name)
+		}
+		names[vc.Name], mounts[vc.Mount] = true, true
+		v.fileExists(fmt.Sprintf("key_file of vault %q", vc.Name), vc.KeyFile)
+	}
+	if len(cfg.Users) > 0 {
+		if len(cfg.Vaults) > 0 {
+			v.errorf("users and vaults may not both be specified")
+		}
+		if cfg.ApiTokenFile != "" {
+			v.errorf("users and api_token_file may not both be specified")
+		}
+		if len(cfg.MfaReg) > 0 {
+			v.errorf("mfa_reg must be specified for each user, not at top level, when users are specified")
+		}
+	}
+	userNames := map[string]bool{}
+	for i, u := range cfg.Users {
+		if u.Name == "" || u.KeyFile == "" || u.PassLoc == "" {
+			v.errorf("user %d requires name, key_file, and pass_loc", i)
+		}
+		if userNames[u.Name] {
+			v.errorf("user %q has duplicate name", u.Name)
+		}
+		userNames[u.Name] = true
+		v.fileExists(fmt.Sprintf("key_file of user %q", u.Name), u.KeyFile)
+	}
+	if cfg.VerifyManifestOnLogin && !cfg.Manifest {
+		v.errorf("verify_manifest_on_login requires manifest")
+	}
+
+	// Files created if they do not exist must be in existing directories.
+	if cfg.CounterFile == "" {
+		v.errorf("counter_file is required")
+	}
+	for _, f := range []struct{ field, path string }{
+		{"counter_file", cfg.CounterFile},
+		{"mfa_credential_file", cfg.MfaCredentialFile},
+		{"api_token_file", cfg.ApiTokenFile},
+		{"access_log_file", cfg.AccessLogFile},
+		{"auth_log_file", cfg.AuthLogFile},
+		{"prefs_key_file", cfg.PrefsKeyFile},
+		{"trusted_device_file", cfg.TrustedDeviceFile},
+		{"passwordless_unlock_file", cfg.PasswordlessUnlockFile},
+	} {
+		if f.path != "" {
+			v.dirExists(f.field, filepath.Dir(f.path))
+		}
+	}
+	v.fileExists("hibp_dataset", cfg.HibpDataset)
+	v.dirExists("asset_override_dir", cfg.AssetOverrideDir)
+
+	// Ranges.
+	for _, f := range []struct {
+		field    string
+		value    float64
+		positive bool // if false, the value need only be nonnegative
+	}{
+		{"session_duration_s", cfg.SessionDurationS, true},
+		{"session_max_lifetime_s", cfg.SessionMaxLifetimeS, false},
+		{"new_session_rate", cfg.NewSessionRate, true},
+		{"new_session_burst", float64(cfg.NewSessionBurst), true},
+		{"store_cache_ttl_s", cfg.StoreCacheTtlS, false},
+		{"store_cache_max_entries", float64(cfg.StoreCacheMaxEntries), true},
+		{"keep_versions", float64(cfg.KeepVersions), false},
+		{"trash_retention_s", cfg.TrashRetentionS, false},
+		{"access_log_max_entries", float64(cfg.AccessLogMaxEntries), true},
+		{"auth_log_retention_s", cfg.AuthLogRetentionS, true},
+		{"failed_login_alert_threshold", float64(cfg.FailedLoginAlertThreshold), true},
+		{"failed_login_alert_window_s", cfg.FailedLoginAlertWindowS, true},
+		{"mfa_remember_s", cfg.MfaRememberS, false},
+		{"soft_lock_grace_s", cfg.SoftLockGraceS, false},
+		{"max_sessions", float64(cfg.MaxSessions), false},
+		{"max_mfa_failures", float64(cfg.MaxMfaFailures), false},
+		{"max_mfa_registration_failures", float64(cfg.MaxMfaRegistrationFailures), false},
+		{"attachment_max_size", float64(cfg.AttachmentMaxSize), true},
+		{"entry_max_size", float64(cfg.EntryMaxSize), true},
+		{"body_max_size", float64(cfg.BodyMaxSize), false},
+		{"expiry_window_s", cfg.ExpiryWindowS, false},
+		{"stale_after_s", cfg.StaleAfterS, false},
+		{"share_duration_s", cfg.ShareDurationS, true},
+		{"directory_page_size", float64(cfg.DirectoryPageSize), true},
+		{"shutdown_grace_period_s", cfg.ShutdownGracePeriodS, true},
+		{"alert_window_s", cfg.AlertWindowS, true},
+		{"alert_max_per_window", float64(cfg.AlertMaxPerWindow), true},
+		{"trusted_device_days", float64(cfg.TrustedDeviceDays), true},
+	} {
+		switch {
+		case f.positive && !(f.value > 0):
+			v.errorf("%s must be positive", f.field)
+		case !f.positive && !(f.value >= 0):
+			v.errorf("%s must be nonnegative", f.field)
+		}
+	}
+	for _, p := range cfg.AlwaysReauthPrefix {
+		if !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") {
+			v.errorf("always_reauth_prefix %q must begin and end with a slash", p)
+		}
+	}
+
+	// Alerts.
+	switch a := cfg.Alert.(type) {
+	case *cpb.Config_AlertSmtp:
+		if a.AlertSmtp.Addr == "" || a.AlertSmtp.From == "" || len(a.AlertSmtp.To) == 0 {
+			v.errorf("alert_smtp requires addr, from, and to")
+		}
+		if a.AlertSmtp.Addr != "" {
+			if _, _, err := net.SplitHostPort(a.AlertSmtp.Addr); err != nil {
+				v.errorf("alert_smtp.addr %q is invalid: %v", a.AlertSmtp.Addr, err)
+			}
+		}
+	case *cpb.Config_AlertWebhook:
+		switch u, err := url.Parse(a.AlertWebhook.Url); {
+		case a.AlertWebhook.Url == "":
+			v.errorf("alert_webhook requires url")
+		case err != nil:
+			v.errorf("alert_webhook.url is invalid: %v", err)
+		case (u.Scheme != "https" && u.Scheme != "http") || u.Host == "":
+			v.errorf("alert_webhook.url %q must be an absolute http or https URL", a.AlertWebhook.Url)
+		}
+	}
+
+	return v.errs
+}
+
+// SessionCookie converts a session cookie configuration to a
+// handler.SessionCookie, filling in defaults for unset fields.
+func SessionCookie(cfg *cpb.SessionCookieConfig) (handler.SessionCookie, error) {
+	sc := handler.DefaultSessionCookie
+	if cfg.Name != "" {
+		sc.Name = cfg.Name
+	}
+	if cfg.Path != "" {
+		sc.Path = cfg.Path
+	}
+	sc.Domain = cfg.Domain
+	switch cfg.SameSite {
+	case cpb.SessionCookieConfig_LAX:
+		sc.SameSite = http.SameSiteLaxMode
+	case cpb.SessionCookieConfig_NONE:
+		sc.SameSite = http.SameSiteNoneMode
+	}
+	if err := sc.Validate(); err != nil {
+		return handler.SessionCookie{}, err
+	}
+	return sc, nil
+}
+
+// Listener converts the configuration of an additional listener to the
+// listener served by its handler. Listeners serving plain HTTP are always
+// read-only, and need an MFA assertion for every request.
+func Listener(lc *cpb.ListenerConfig) handler.Listener {
+	_, unsafe := lc.Tls.(*cpb.ListenerConfig_UnsafeHttp)
+	return handler.Listener{
+		Name:            lc.Name,
+		ReadOnly:        lc.ReadOnly || unsafe,
+		MFAEveryRequest: lc.MfaEveryRequest || unsafe,
+		Insecure:        unsafe,
+		Origin:          lc.Origin,
+	}
+}
+
+// ContentSecurityPolicy converts a Content-Security-Policy configuration to
+// the policy served by harpd. A nil configuration gives the default policy.
+func ContentSecurityPolicy(cfg *cpb.ContentSecurityPolicyConfig) (csp.Policy, error) {
+	p := csp.Default().Extend(csp.Policy{
+		DefaultSrc: cfg.GetDefaultSrc(),
+		ScriptSrc:  cfg.GetScriptSrc(),
+		StyleSrc:   cfg.GetStyleSrc(),
+		ImgSrc:     cfg.GetImgSrc(),
+		FontSrc:    cfg.GetFontSrc(),
+		ConnectSrc: cfg.GetConnectSrc(),
+		WorkerSrc:  cfg.GetWorkerSrc(),
+	})
+	if err := p.Validate(); err != nil {
+		return csp.Policy{}, err
+	}
+	return p, nil
+}
+
+// validHostName determines if the given host_name is a host, optionally with
+// a port, and nothing else.
+func validHostName(hostName string) bool {
+	u, err := url.Parse("https://" + hostName)
+	if err != nil || u.Host != hostName || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	if p := u.Port(); p == "" && strings.HasSuffix(hostName, ":") {
+		return false
+	}
+	return true
+}
+
+// validListenerName determines if the given listener name contains only
+// letters, digits, "-" and "_", so that it can name a cookie.
+func validListenerName(name string) bool {
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLoopbackAddr checks that the given listener address is on a loopback
+// interface, so that unauthenticated content served there is not reachable
+// from other hosts.
+func CheckLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("couldn't parse address: %w", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%q is not a loopback address", host)
+	}
+	return nil
+}
+
+// validator accumulates the problems found while validating a config.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// fileExists checks that the file at the given path, if any, exists & is not
+// a directory.
+func (v *validator) fileExists(field, path string) {
+	if path == "" {
+		return
+	}
+	switch fi, err := os.Stat(path); {
+	case errors.Is(err, os.ErrNotExist):
+		v.errorf("%s %q does not exist", field, path)
+	case err != nil:
+		v.errorf("%s %q can't be read: %v", field, path, err)
+	case fi.IsDir():
+		v.errorf("%s %q is a directory", field, path)
+	}
+}
+
+// dirExists checks that the directory at the given path, if any, exists.
+func (v *validator) dirExists(field, path string) {
+	if path == "" {
+		return
+	}
+	switch fi, err := os.Stat(path); {
+	case errors.Is(err, os.ErrNotExist):
+		v.errorf("directory %q of %s does not exist", path, field)
+	case err != nil:
+		v.errorf("directory %q of %s can't be read: %v", path, field, err)
+	case !fi.IsDir():
+		v.errorf("%q of %s is not a directory", path, field)
+	}
+}
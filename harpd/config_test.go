@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/harpd/handler"
+	cpb "github.com/BranLwyd/harpocrates/harpd/proto/config_go_proto"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		desc, data string
+	}{
+		{"text", `host_name: "example.com" session_duration_s: 60 vaults { name: "a" mount: "a" }`},
+		{"JSON", `{"hostName": "example.com", "sessionDurationS": 60, "vaults": [{"name": "a", "mount": "a"}]}`},
+		{"JSON, leading space", "\n\t {\"host_name\": \"example.com\", \"session_duration_s\": 60, \"vaults\": [{\"name\": \"a\", \"mount\": \"a\"}]}"},
+	} {
+		cfg, err := Parse([]byte(test.data))
+		if err != nil {
+			t.Errorf("[%s] Could not parse: %v", test.desc, err)
+			continue
+		}
+		if cfg.HostName != "example.com" || cfg.SessionDurationS != 60 || len(cfg.Vaults) != 1 || cfg.Vaults[0].Mount != "a" {
+			t.Errorf("[%s] Parse got unexpected config %v", test.desc, cfg)
+		}
+	}
+
+	for _, data := range []string{`host_name: `, `{"host_name": }`, `{"unknown_field": 1}`} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", data)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "config_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatalf("Could not write key file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	// newConfig returns a valid config, modified by the given function.
+	newConfig := func(modify func(cfg *cpb.Config)) *cpb.Config {
+		cfg := &cpb.Config{
+			HostName:    "example.com",
+			Email:       "admin@example.com",
+			CertDir:     dir,
+			PassLoc:     dir,
+			KeyFile:     keyFile,
+			CounterFile: filepath.Join(dir, "counter"),
+		}
+		SetDefaults(cfg)
+		if modify != nil {
+			modify(cfg)
+		}
+		return cfg
+	}
+	plainHTTP := func(cfg *cpb.Config) *cpb.PlainHTTPConfig {
+		t := &cpb.PlainHTTPConfig{ListenAddr: "localhost:8080"}
+		cfg.Email, cfg.CertDir, cfg.Tls = "", "", &cpb.Config_PlainHttp{PlainHttp: t}
+		return t
+	}
+
+	for _, test := range []struct {
+		desc     string
+		modify   func(cfg *cpb.Config)
+		wantErrs []string
+	}{
+		{"valid", nil, nil},
+		{"valid, host with port", func(cfg *cpb.Config) { cfg.HostName = "example.com:8443" }, nil},
+		{"valid, plain HTTP", func(cfg *cpb.Config) { plainHTTP(cfg).TrustedProxyCidrs = []string{"127.0.0.1/32"} }, nil},
+		{"valid, vaults", func(cfg *cpb.Config) {
+			cfg.PassLoc, cfg.KeyFile = "", ""
+			cfg.Vaults = []*cpb.VaultConfig{{Name: "a", PassLoc: dir, KeyFile: keyFile, Mount: "a"}}
+		}, nil},
+
+		{"missing required fields", func(cfg *cpb.Config) {
+			cfg.HostName, cfg.Email, cfg.PassLoc, cfg.KeyFile, cfg.CounterFile = "", "", "", "", ""
+		}, []string{"host_name is required", "email is required", "pass_loc is required", "key_file is required", "counter_file is required"}},
+		{"host name with scheme", func(cfg *cpb.Config) { cfg.HostName = "https://example.com" }, []string{`host_name "https://example.com" is not a host name`}},
+		{"host name with path", func(cfg *cpb.Config) { cfg.HostName = "example.com/harp" }, []string{`host_name "example.com/harp" is not a host name`}},
+		{"host name with empty port", func(cfg *cpb.Config) { cfg.HostName = "example.com:" }, []string{"is not a host name"}},
+		{"missing key file", func(cfg *cpb.Config) { cfg.KeyFile = missing }, []string{fmt.Sprintf("key_file %q does not exist", missing)}},
+		{"key file is directory", func(cfg *cpb.Config) { cfg.KeyFile = dir }, []string{"is a directory"}},
+		{"missing counter directory", func(cfg *cpb.Config) { cfg.CounterFile = filepath.Join(missing, "counter") }, []string{fmt.Sprintf("directory %q of counter_file does not exist", missing)}},
+		{"missing static certificate", func(cfg *cpb.Config) {
+			cfg.Email, cfg.CertDir = "", ""
+			cfg.Tls = &cpb.Config_Static{Static: &cpb.StaticTLSConfig{CertFile: missing, KeyFile: keyFile}}
+		}, []string{"static.cert_file"}},
+		{"ACME options with static", func(cfg *cpb.Config) {
+			cfg.Tls = &cpb.Config_Static{Static: &cpb.StaticTLSConfig{CertFile: keyFile, KeyFile: keyFile}}
+		}, []string{"email and cert_dir are only used with ACME"}},
+		{"ACME options with plain HTTP", func(cfg *cpb.Config) {
+			plainHTTP(cfg)
+			cfg.CertDir = dir
+		}, []string{"email and cert_dir are only used with ACME"}},
+		{"bad listen address", func(cfg *cpb.Config) { plainHTTP(cfg).ListenAddr = "localhost" }, []string{"plain_http.listen_addr"}},
+		{"bad trusted proxy", func(cfg *cpb.Config) { plainHTTP(cfg).TrustedProxyCidrs = []string{"10.0.0.1"} }, []string{`trusted_proxy_cidrs entry "10.0.0.1"`}},
+		{"bad base path", func(cfg *cpb.Config) { cfg.BasePath = "harp" }, []string{"base_path is invalid"}},
+		{"bad session cookie", func(cfg *cpb.Config) {
+			cfg.SessionCookie = &cpb.SessionCookieConfig{Name: "__Host-harp", Domain: "example.com"}
+		}, []string{"session_cookie is invalid"}},
+		{"bad content security policy", func(cfg *cpb.Config) {
+			cfg.ContentSecurityPolicy = &cpb.ContentSecurityPolicyConfig{ImgSrc: []string{"data:; script-src *"}}
+		}, []string{"content_security_policy is invalid"}},
+		{"non-loopback metrics address", func(cfg *cpb.Config) { cfg.MetricsAddr = "0.0.0.0:9090" }, []string{"metrics_addr is invalid"}},
+		{"valid listeners", func(cfg *cpb.Config) {
+			cfg.Listen = []*cpb.ListenerConfig{
+				{Name: "lan", Addr: "192.168.1.2:8443", Tls: &cpb.ListenerConfig_Static{Static: &cpb.StaticTLSConfig{CertFile: keyFile, KeyFile: keyFile}}, ReadOnly: true, Origin: "https://harp.lan.example.com:8443"},
+				{Name: "tail_net-1", Addr: "localhost:8080", Tls: &cpb.ListenerConfig_UnsafeHttp{UnsafeHttp: &cpb.UnsafeHTTPConfig{IUnderstandThisIsUnsafe: true}}, Origin: "https://tail.example.com"},
+			}
+		}, nil},
+		{"bad listeners", func(cfg *cpb.Config) {
+			cfg.Listen = []*cpb.ListenerConfig{
+				{Name: "lan.1", Addr: "localhost"},
+				{Name: "http", Addr: ":8080", Tls: &cpb.ListenerConfig_UnsafeHttp{UnsafeHttp: &cpb.UnsafeHTTPConfig{}}, Origin: "http://harp.example.com:8080"},
+				{Name: "http", Addr: ":8443", Tls: &cpb.ListenerConfig_Static{Static: &cpb.StaticTLSConfig{CertFile: missing, KeyFile: keyFile}}, Origin: "https://harp.example.com:8443"},
+			}
+		}, []string{
+			"listen 0 requires name, addr, origin, and static or unsafe_http",
+			`listen "lan.1" has invalid name`,
+			`listen "lan.1" has invalid addr "localhost"`,
+			`listen "http" has unusable origin: origin "http://harp.example.com:8080" must use https`,
+			`listen "http": unsafe_http requires i_understand_this_is_unsafe: true`,
+			`listen "http" has duplicate name`,
+			`static.cert_file of listen "http"`,
+		}},
+		{"listener on another host", func(cfg *cpb.Config) {
+			cfg.Listen = []*cpb.ListenerConfig{
+				{Name: "onion", Addr: "localhost:8080", Tls: &cpb.ListenerConfig_UnsafeHttp{UnsafeHttp: &cpb.UnsafeHTTPConfig{IUnderstandThisIsUnsafe: true}}, Origin: "https://harpabcdef.onion"},
+			}
+		}, []string{`listen "onion" has unusable origin: origin "https://harpabcdef.onion" can't use MFA devices, which are registered for relying party ID "example.com"`}},
+		{"out of range", func(cfg *cpb.Config) {
+			cfg.SessionDurationS, cfg.KeepVersions, cfg.MaxSessions, cfg.EntryMaxSize = -1, -1, -1, -1
+		}, []string{"session_duration_s must be positive", "keep_versions must be nonnegative", "max_sessions must be nonnegative", "entry_max_size must be positive"}},
+		{"bad reauth prefix", func(cfg *cpb.Config) { cfg.AlwaysReauthPrefix = []string{"/a"} }, []string{`always_reauth_prefix "/a"`}},
+		{"duplicate vaults", func(cfg *cpb.Config) {
+			cfg.Vaults = []*cpb.VaultConfig{
+				{Name: "a", PassLoc: dir, KeyFile: keyFile, Mount: "a"},
+				{Name: "a", PassLoc: dir, KeyFile: missing, Mount: "b/c"},
+			}
+		}, []string{`vault "a" has invalid mount "b/c"`, `vault "a" has duplicate name or mount`, `key_file of vault "a"`}},
+		{"users with vaults", func(cfg *cpb.Config) {
+			cfg.Vaults = []*cpb.VaultConfig{{Name: "a", PassLoc: dir, KeyFile: keyFile, Mount: "a"}}
+			cfg.Users = []*cpb.UserConfig{{Name: "u", PassLoc: dir, KeyFile: keyFile}, {Name: "u"}}
+		}, []string{"users and vaults may not both be specified", "user 1 requires name, key_file, and pass_loc", `user "u" has duplicate name`}},
+		{"manifest verification without manifest", func(cfg *cpb.Config) { cfg.VerifyManifestOnLogin = true }, []string{"verify_manifest_on_login requires manifest"}},
+		{"incomplete SMTP alerts", func(cfg *cpb.Config) {
+			cfg.Alert = &cpb.Config_AlertSmtp{AlertSmtp: &cpb.SMTPAlertConfig{Addr: "mail.example.com"}}
+		}, []string{"alert_smtp requires addr, from, and to", `alert_smtp.addr "mail.example.com"`}},
+		{"relative webhook URL", func(cfg *cpb.Config) {
+			cfg.Alert = &cpb.Config_AlertWebhook{AlertWebhook: &cpb.WebhookAlertConfig{Url: "/hook"}}
+		}, []string{"must be an absolute http or https URL"}},
+		{"unparseable webhook URL", func(cfg *cpb.Config) {
+			cfg.Alert = &cpb.Config_AlertWebhook{AlertWebhook: &cpb.WebhookAlertConfig{Url: "https://exa mple.com/"}}
+		}, []string{"alert_webhook.url is invalid"}},
+	} {
+		errs := Validate(newConfig(test.modify))
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if len(got) != len(test.wantErrs) {
+			t.Errorf("[%s] Validate returned %d errors %q, want %d", test.desc, len(got), got, len(test.wantErrs))
+			continue
+		}
+		for i, want := range test.wantErrs {
+			if !strings.Contains(got[i], want) {
+				t.Errorf("[%s] Validate error %d is %q, want it to contain %q", test.desc, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		desc string
+		lc   *cpb.ListenerConfig
+		want handler.Listener
+	}{
+		{"static", &cpb.ListenerConfig{Name: "lan", Tls: &cpb.ListenerConfig_Static{Static: &cpb.StaticTLSConfig{}}}, handler.Listener{Name: "lan"}},
+		{"static, restricted", &cpb.ListenerConfig{Name: "lan", Tls: &cpb.ListenerConfig_Static{Static: &cpb.StaticTLSConfig{}}, ReadOnly: true, MfaEveryRequest: true}, handler.Listener{Name: "lan", ReadOnly: true, MFAEveryRequest: true}},
+		{"unsafe HTTP", &cpb.ListenerConfig{Name: "http", Tls: &cpb.ListenerConfig_UnsafeHttp{UnsafeHttp: &cpb.UnsafeHTTPConfig{IUnderstandThisIsUnsafe: true}}, Origin: "https://harp.example.com"}, handler.Listener{Name: "http", ReadOnly: true, MFAEveryRequest: true, Insecure: true, Origin: "https://harp.example.com"}},
+	} {
+		if got := Listener(test.lc); got != test.want {
+			t.Errorf("[%s] Listener() = %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
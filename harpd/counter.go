@@ -0,0 +1,283 @@
+// Package counter provides persistent storage for the signature counters of
+// MFA devices.
+package counter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	cpb "github.com/BranLwyd/harpocrates/harpd/proto/counter_go_proto"
+)
+
+const (
+	// minRetryDelay & maxRetryDelay bound the delay between attempts to
+	// persist the counters while the store is degraded. The delay doubles
+	// after each failed attempt.
+	minRetryDelay = time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// ErrNotPersisted is returned (wrapped) by Set when a counter value can't be
+// persisted to disk, and the store becomes degraded as a result. The value
+// is nevertheless set.
+var ErrNotPersisted = errors.New("counters not persisted")
+
+// RegressionError is returned by Advance if a counter value does not advance
+// the stored value for the same credential ID.
+type RegressionError struct {
+	Stored, Value uint32
+}
+
+func (e *RegressionError) Error() string {
+	return fmt.Sprintf("signature counter %d does not advance stored counter %d", e.Value, e.Stored)
+}
+
+// Advances determines if a signature counter of value is acceptable given the
+// stored counter for the same device: it must be greater. Devices that do not
+// implement signature counters always report 0.
+func Advances(stored, value uint32) bool {
+	return value > stored || (value == 0 && stored == 0)
+}
+
+// Store stores signature counters, keyed by credential ID, persisting them to
+// a file on disk. It is safe for concurrent use from multiple goroutines.
+//
+// If the counters can't be persisted, the store becomes degraded: values
+// continue to be set in memory, and persisting them is retried (with backoff)
+// until it succeeds.
+type Store struct {
+	filename string
+	fs       fileSystem
+
+	mu         sync.Mutex // protects all fields below
+	counters   map[string]uint32
+	dirty      bool          // if set, the store is degraded: counters have been set which are not yet persisted
+	retryDelay time.Duration // delay before the next attempt to persist the counters, if the store is degraded
+	retryTimer *time.Timer   // fires the next attempt to persist the counters, if the store is degraded
+}
+
+// NewStore creates a new counter store persisted in the given file. If the
+// file does not yet exist, the store starts out empty; the file will be
+// created on the first call to Set.
+func NewStore(filename string) (*Store, error) {
+	return newStore(filename, osFileSystem{})
+}
+
+func newStore(filename string, fs fileSystem) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		fs:       fs,
+		counters: map[string]uint32{},
+	}
+	cntrBytes, err := fs.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	cntrs := &cpb.Counters{}
+	if err := proto.Unmarshal(cntrBytes, cntrs); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for k, v := range cntrs.Counter {
+		s.counters[k] = v
+	}
+	return s, nil
+}
+
+// Get returns the counter value for the given credential ID, or 0 if no value
+// has been set.
+func (s *Store) Get(credID string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[credID]
+}
+
+// Set sets the counter value for the given credential ID. The update is
+// persisted to disk before Set returns, unless persisting fails: then the
+// value is set regardless, and the store is degraded until a later attempt
+// to persist the counters succeeds. Set returns an error wrapping
+// ErrNotPersisted only if the store was not already degraded, so that
+// callers can report degradation once.
+//
+// On POSIX-compliant systems, the update to the file on disk is atomic.
+func (s *Store) Set(credID string, value uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setLocked(credID, value)
+}
+
+// Advance sets the counter value for the given credential ID as Set does, but
+// only if the value advances the stored value (see Advances); otherwise, it
+// returns a *RegressionError, leaving the stored value unchanged. The check &
+// update are atomic, so that of concurrent calls with the same value, only
+// one succeeds, and a lower value never replaces a higher one.
+func (s *Store) Advance(credID string, value uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored := s.counters[credID]; !Advances(stored, value) {
+		return &RegressionError{Stored: stored, Value: value}
+	}
+	return s.setLocked(credID, value)
+}
+
+// setLocked implements Set. s.mu must be held.
+func (s *Store) setLocked(credID string, value uint32) error {
+	s.counters[credID] = value
+	wasDirty := s.dirty
+	if err := s.write(); err != nil {
+		s.dirty = true
+		if wasDirty {
+			// A retry is already scheduled.
+			return nil
+		}
+		s.retryDelay = minRetryDelay
+		s.retryTimer = time.AfterFunc(s.retryDelay, s.retry)
+		return fmt.Errorf("%w: %v", ErrNotPersisted, err)
+	}
+	s.clean()
+	return nil
+}
+
+// Healthy determines if every counter value set has been persisted to disk,
+// i.e. if the store is not degraded.
+func (s *Store) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.dirty
+}
+
+// retry attempts to persist the counters of a degraded store, scheduling
+// another attempt if it fails.
+func (s *Store) retry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.write(); err != nil {
+		if s.retryDelay *= 2; s.retryDelay > maxRetryDelay {
+			s.retryDelay = maxRetryDelay
+		}
+		log.Printf("Could not persist MFA signature counters (retrying in %v): %v", s.retryDelay, err)
+		s.retryTimer = time.AfterFunc(s.retryDelay, s.retry)
+		return
+	}
+	log.Printf("Persisted MFA signature counters after earlier failures")
+	s.clean()
+}
+
+// clean marks the counters as persisted, cancelling any scheduled attempt to
+// persist them. s.mu must be held.
+func (s *Store) clean() {
+	s.dirty = false
+	if s.retryTimer != nil {
+		s.retryTimer.Stop()
+		s.retryTimer = nil
+	}
+}
+
+// Check checks that the counters can be persisted, without changing the file
+// on disk: the current counters are written to a temporary file alongside it,
+// which is then removed.
+func (s *Store) Check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tempFilename, err := s.writeTemp()
+	if err != nil {
+		return err
+	}
+	if err := s.fs.Remove(tempFilename); err != nil {
+		return fmt.Errorf("couldn't remove %q: %w", tempFilename, err)
+	}
+	return nil
+}
+
+// write writes the current counters to disk. s.mu must be held.
+func (s *Store) write() error {
+	tempFilename, err := s.writeTemp()
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(tempFilename)
+	if err := s.fs.Rename(tempFilename, s.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, s.filename, err)
+	}
+	return nil
+}
+
+// writeTemp writes the current counters to a new temporary file in the same
+// directory as the store's file, returning its name. s.mu must be held.
+func (s *Store) writeTemp() (string, error) {
+	cntrBytes, err := proto.Marshal(&cpb.Counters{Counter: s.counters})
+	if err != nil {
+		return "", fmt.Errorf("couldn't marshal counters: %w", err)
+	}
+	return s.fs.WriteTemp(filepath.Dir(s.filename), ".harp_mfactr_", cntrBytes)
+}
+
+// fileSystem abstracts the file operations used by a Store, so that tests
+// can simulate failures.
+type fileSystem interface {
+	// ReadFile returns the content of the given file.
+	ReadFile(filename string) ([]byte, error)
+
+	// WriteTemp writes the given content to a new temporary file in the
+	// given directory, with a name beginning with the given prefix,
+	// returning the file's name.
+	WriteTemp(dir, prefix string, content []byte) (string, error)
+
+	// Rename renames a file, replacing any file with the new name.
+	Rename(oldFilename, newFilename string) error
+
+	// Remove removes a file.
+	Remove(filename string) error
+}
+
+// osFileSystem is a fileSystem backed by the operating system.
+type osFileSystem struct{}
+
+func (osFileSystem) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+func (osFileSystem) Rename(oldFilename, newFilename string) error {
+	return os.Rename(oldFilename, newFilename)
+}
+
+func (osFileSystem) Remove(filename string) error {
+	return os.Remove(filename)
+}
+
+func (osFileSystem) WriteTemp(dir, prefix string, content []byte) (_ string, retErr error) {
+	tempFile, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer func() {
+		if retErr != nil {
+			os.Remove(tempFilename)
+		}
+	}()
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0660); err != nil {
+		return "", fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		return "", fmt.Errorf("couldn't write counters: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	return tempFilename, nil
+}
@@ -0,0 +1,286 @@
+package counter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPersistence(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "counters")
+	s, err := NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+
+	// Unset counters read as zero; set counters read back as set.
+	if got := s.Get("cred"); got != 0 {
+		t.Errorf("Unset counter was %d, want 0", got)
+	}
+	if err := s.Set("cred", 42); err != nil {
+		t.Fatalf("Could not set counter: %v", err)
+	}
+	if got := s.Get("cred"); got != 42 {
+		t.Errorf("Counter was %d, want 42", got)
+	}
+
+	// A new store reading the same file sees the same counters.
+	s, err = NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if got := s.Get("cred"); got != 42 {
+		t.Errorf("Counter was %d after reload, want 42", got)
+	}
+	if got := s.Get("other cred"); got != 0 {
+		t.Errorf("Unset counter was %d after reload, want 0", got)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "counters"))
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+
+	for _, test := range []struct {
+		cred    string
+		value   uint32
+		wantErr bool
+		want    uint32
+	}{
+		{"no counter", 0, false, 0},
+		{"no counter", 0, false, 0},
+		{"cred", 5, false, 5},
+		{"cred", 5, true, 5},
+		{"cred", 3, true, 5},
+		{"cred", 0, true, 5},
+		{"cred", 6, false, 6},
+	} {
+		err := s.Advance(test.cred, test.value)
+		var re *RegressionError
+		if gotErr := errors.As(err, &re); gotErr != test.wantErr || (err != nil && !gotErr) {
+			t.Errorf("Advance(%q, %d) = %v, want regression error: %v", test.cred, test.value, err, test.wantErr)
+		}
+		if got := s.Get(test.cred); got != test.want {
+			t.Errorf("After Advance(%q, %d), counter was %d, want %d", test.cred, test.value, got, test.want)
+		}
+	}
+}
+
+func TestAdvanceConcurrent(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStore(filepath.Join(dir, "counters"))
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+
+	// advance calls Advance concurrently with each of the given values,
+	// returning the number of calls which succeeded.
+	advance := func(values []uint32) int {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for _, v := range values {
+			v := v
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := s.Advance("cred", v); err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return succeeded
+	}
+
+	// Of concurrent assertions presenting the same counter (e.g. from a
+	// cloned device), only one succeeds.
+	const n = 20
+	var same []uint32
+	for i := 0; i < n; i++ {
+		same = append(same, 10)
+	}
+	if got := advance(same); got != 1 {
+		t.Errorf("Concurrent Advance to 10 succeeded %d times, want once", got)
+	}
+
+	// Lower counters presented concurrently never replace a higher one.
+	var ascending []uint32
+	for i := uint32(1); i <= n; i++ {
+		ascending = append(ascending, i)
+	}
+	advance(ascending)
+	if got := s.Get("cred"); got != n {
+		t.Errorf("After concurrent Advance, counter was %d, want %d", got, n)
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "counters")
+	fs := &failingFileSystem{}
+	s, err := newStore(filename, fs)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	if err := s.Set("cred", 1); err != nil {
+		t.Fatalf("Could not set counter: %v", err)
+	}
+
+	// A failed write still sets the value, but degrades the store. Only the
+	// first failure is reported.
+	fs.setFailing(true)
+	if err := s.Set("cred", 42); !errors.Is(err, ErrNotPersisted) {
+		t.Errorf("Set with failing writes returned error %v, want %v", err, ErrNotPersisted)
+	}
+	if err := s.Set("cred", 43); err != nil {
+		t.Errorf("Second Set with failing writes returned error %v, want nil", err)
+	}
+	if got := s.Get("cred"); got != 43 {
+		t.Errorf("Counter was %d after failed set, want 43", got)
+	}
+	if s.Healthy() {
+		t.Errorf("Store was healthy after failed set")
+	}
+
+	// Once writes succeed, the scheduled retry persists the counters.
+	fs.setFailing(false)
+	for deadline := time.Now().Add(5 * time.Second); !s.Healthy(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Store was not healthy after writes started succeeding")
+		}
+	}
+	s, err = NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if got := s.Get("cred"); got != 43 {
+		t.Errorf("Counter was %d after reload, want 43", got)
+	}
+}
+
+func TestDegradedRecoversOnSet(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &failingFileSystem{}
+	s, err := newStore(filepath.Join(dir, "counters"), fs)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+
+	// A successful Set clears the degraded state, and a later failure is
+	// reported again.
+	fs.setFailing(true)
+	if err := s.Set("cred", 1); !errors.Is(err, ErrNotPersisted) {
+		t.Errorf("Set with failing writes returned error %v, want %v", err, ErrNotPersisted)
+	}
+	fs.setFailing(false)
+	if err := s.Set("cred", 2); err != nil {
+		t.Errorf("Set with succeeding writes returned error %v, want nil", err)
+	}
+	if !s.Healthy() {
+		t.Errorf("Store was not healthy after successful set")
+	}
+	fs.setFailing(true)
+	if err := s.Set("cred", 3); !errors.Is(err, ErrNotPersisted) {
+		t.Errorf("Set with failing writes after recovery returned error %v, want %v", err, ErrNotPersisted)
+	}
+}
+
+// failingFileSystem is a fileSystem whose writes can be made to fail, e.g.
+// as if the disk were full.
+type failingFileSystem struct {
+	osFileSystem
+
+	mu      sync.Mutex
+	failing bool
+}
+
+func (fs *failingFileSystem) setFailing(failing bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failing = failing
+}
+
+func (fs *failingFileSystem) WriteTemp(dir, prefix string, content []byte) (string, error) {
+	fs.mu.Lock()
+	failing := fs.failing
+	fs.mu.Unlock()
+	if failing {
+		return "", errors.New("no space left on device")
+	}
+	return fs.osFileSystem.WriteTemp(dir, prefix, content)
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_counter_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Checking a usable store succeeds, without writing anything.
+	s, err := NewStore(filepath.Join(dir, "counters"))
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	if err := s.Check(); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil {
+		t.Errorf("Could not read directory: %v", err)
+	} else if len(fis) != 0 {
+		t.Errorf("Check left %d files behind, want 0", len(fis))
+	}
+
+	// Checking a store which can't be written fails.
+	s, err = NewStore(filepath.Join(dir, "nonexistent", "counters"))
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	if err := s.Check(); err == nil {
+		t.Errorf("Check unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,138 @@
+// Package csp builds the Content-Security-Policy headers served by harpd, and
+// provides the per-request nonces which allow individual scripts to run.
+package csp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// nonceLength is the number of random bytes in a nonce.
+const nonceLength = 16
+
+// Policy is a Content-Security-Policy. Each field lists the sources allowed by
+// one fetch directive, e.g. "'self'" or "data:"; directives with no sources
+// are omitted from the header, so that default-src applies in their place.
+type Policy struct {
+	DefaultSrc []string
+	ScriptSrc  []string
+	StyleSrc   []string
+	ImgSrc     []string
+	FontSrc    []string
+	ConnectSrc []string
+	WorkerSrc  []string
+}
+
+// Default returns the policy served unless configured otherwise: every
+// resource, including the service worker, must come from harpd itself.
+func Default() Policy {
+	return Policy{
+		DefaultSrc: []string{"'self'"},
+		WorkerSrc:  []string{"'self'"},
+	}
+}
+
+// Extend returns a policy allowing the sources allowed by p, as well as those
+// allowed by extra. A directive which extra adds sources to, but which p
+// omits, starts out with p's default-src sources, since it replaces
+// default-src.
+func (p Policy) Extend(extra Policy) Policy {
+	ext := func(srcs, extraSrcs []string) []string {
+		if len(extraSrcs) == 0 {
+			return srcs
+		}
+		if len(srcs) == 0 {
+			srcs = p.DefaultSrc
+		}
+		return append(append([]string(nil), srcs...), extraSrcs...)
+	}
+	return Policy{
+		DefaultSrc: append(append([]string(nil), p.DefaultSrc...), extra.DefaultSrc...),
+		ScriptSrc:  ext(p.ScriptSrc, extra.ScriptSrc),
+		StyleSrc:   ext(p.StyleSrc, extra.StyleSrc),
+		ImgSrc:     ext(p.ImgSrc, extra.ImgSrc),
+		FontSrc:    ext(p.FontSrc, extra.FontSrc),
+		ConnectSrc: ext(p.ConnectSrc, extra.ConnectSrc),
+		WorkerSrc:  ext(p.WorkerSrc, extra.WorkerSrc),
+	}
+}
+
+// Validate determines if every source in the policy is well-formed, i.e. is
+// nonempty & can't end its directive early.
+func (p Policy) Validate() error {
+	for _, d := range p.directives() {
+		for _, src := range d.srcs {
+			if src == "" || strings.ContainsAny(src, " \t\r\n;,") {
+				return fmt.Errorf("invalid %s source %q", d.name, src)
+			}
+		}
+	}
+	return nil
+}
+
+// Header returns the value of the Content-Security-Policy header for the
+// policy. If nonce is nonempty, scripts carrying it are allowed in addition
+// to those allowed by the policy.
+func (p Policy) Header(nonce string) string {
+	if nonce != "" {
+		scriptSrc := p.ScriptSrc
+		if len(scriptSrc) == 0 {
+			// script-src replaces default-src for scripts, so it must
+			// repeat default-src's sources.
+			scriptSrc = p.DefaultSrc
+		}
+		p.ScriptSrc = append(append([]string(nil), scriptSrc...), fmt.Sprintf("'nonce-%s'", nonce))
+	}
+	var ds []string
+	for _, d := range p.directives() {
+		if len(d.srcs) > 0 {
+			ds = append(ds, d.name+" "+strings.Join(d.srcs, " "))
+		}
+	}
+	return strings.Join(ds, "; ")
+}
+
+type directive struct {
+	name string
+	srcs []string
+}
+
+func (p Policy) directives() []directive {
+	return []directive{
+		{"default-src", p.DefaultSrc},
+		{"script-src", p.ScriptSrc},
+		{"style-src", p.StyleSrc},
+		{"img-src", p.ImgSrc},
+		{"font-src", p.FontSrc},
+		{"connect-src", p.ConnectSrc},
+		{"worker-src", p.WorkerSrc},
+	}
+}
+
+// NewNonce returns a new, random nonce, suitable for a single response. It is
+// URL-safe base64 without padding, so that templates needn't escape it.
+func NewNonce() (string, error) {
+	var nonce [nonceLength]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", fmt.Errorf("couldn't generate randomness: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce[:]), nil
+}
+
+type nonceContextKey struct{}
+
+// NewContext returns a copy of ctx carrying the given nonce, which must be
+// allowed by the Content-Security-Policy of the response being served.
+func NewContext(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, nonceContextKey{}, nonce)
+}
+
+// Nonce returns the nonce carried by ctx, or the empty string if there is
+// none.
+func Nonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceContextKey{}).(string)
+	return nonce
+}
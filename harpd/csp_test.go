@@ -0,0 +1,73 @@
+package csp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		desc   string
+		policy Policy
+		nonce  string
+		want   string
+	}{
+		{"default", Default(), "", "default-src 'self'; worker-src 'self'"},
+		{"default with nonce", Default(), "abc", "default-src 'self'; script-src 'self' 'nonce-abc'; worker-src 'self'"},
+		{"explicit script-src with nonce", Policy{DefaultSrc: []string{"'none'"}, ScriptSrc: []string{"'self'"}}, "abc", "default-src 'none'; script-src 'self' 'nonce-abc'"},
+		{
+			"extended",
+			Default().Extend(Policy{ImgSrc: []string{"data:"}, FontSrc: []string{"https://fonts.example.com"}}),
+			"",
+			"default-src 'self'; img-src 'self' data:; font-src 'self' https://fonts.example.com; worker-src 'self'",
+		},
+		{"extended default-src", Default().Extend(Policy{DefaultSrc: []string{"https://cdn.example.com"}}), "", "default-src 'self' https://cdn.example.com; worker-src 'self'"},
+	} {
+		if got := test.policy.Header(test.nonce); got != test.want {
+			t.Errorf("[%s] Header(%q) = %q, want %q", test.desc, test.nonce, got, test.want)
+		}
+	}
+
+	// Extending a policy does not modify it.
+	p := Default()
+	p.Extend(Policy{WorkerSrc: []string{"blob:"}})
+	if got, want := p.Header(""), "default-src 'self'; worker-src 'self'"; got != want {
+		t.Errorf("After Extend, Header() = %q, want %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	if err := Default().Extend(Policy{ImgSrc: []string{"data:"}}).Validate(); err != nil {
+		t.Errorf("Validate returned error for valid policy: %v", err)
+	}
+	for _, src := range []string{"", "a b", "data:; script-src *", "a,b"} {
+		if err := Default().Extend(Policy{ImgSrc: []string{src}}).Validate(); err == nil {
+			t.Errorf("Validate succeeded for img-src source %q, want error", src)
+		}
+	}
+}
+
+func TestNonce(t *testing.T) {
+	t.Parallel()
+	n1, err := NewNonce()
+	if err != nil {
+		t.Fatalf("Could not generate nonce: %v", err)
+	}
+	n2, err := NewNonce()
+	if err != nil {
+		t.Fatalf("Could not generate nonce: %v", err)
+	}
+	if n1 == n2 {
+		t.Errorf("NewNonce returned %q twice", n1)
+	}
+
+	ctx := context.Background()
+	if got := Nonce(ctx); got != "" {
+		t.Errorf("Nonce(background context) = %q, want empty", got)
+	}
+	if got := Nonce(NewContext(ctx, n1)); got != n1 {
+		t.Errorf("Nonce(NewContext(%q)) = %q, want %q", n1, got, n1)
+	}
+}
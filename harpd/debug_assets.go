@@ -0,0 +1,56 @@
+// Package debug_assets provides the key & password stores used by
+// harpd_debug, embedded in the binary.
+package debug_assets
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Embedding a directory omits hidden files, so the hidden files & directories
+// of the password stores, and the hidden files within those directories, are
+// named explicitly.
+//
+//go:embed assets/debug
+//go:embed assets/debug/*/.* assets/debug/*/.*/.*
+var embedded embed.FS
+
+// FS holds the debug assets, named by their path beneath harpd/assets/debug,
+// e.g. "key.sbox" or "passwords.sbox/Alpha.harp".
+var FS = func() fs.FS {
+	sub, err := fs.Sub(embedded, "assets/debug")
+	if err != nil {
+		panic(fmt.Sprintf("Could not get debug assets: %v", err))
+	}
+	return sub
+}()
+
+// RestoreAssets writes the named asset, and everything beneath it if it is a
+// directory, beneath the directory dst; e.g. restoring "passwords.sbox" creates
+// dst/passwords.sbox.
+func RestoreAssets(dst, name string) error {
+	return fs.WalkDir(FS, name, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fn := filepath.Join(dst, filepath.FromSlash(name))
+		if d.IsDir() {
+			if err := os.MkdirAll(fn, 0755); err != nil {
+				return fmt.Errorf("couldn't create %q: %w", fn, err)
+			}
+			return nil
+		}
+		content, err := fs.ReadFile(FS, name)
+		if err != nil {
+			return fmt.Errorf("couldn't read %q: %w", name, err)
+		}
+		if err := ioutil.WriteFile(fn, content, 0644); err != nil {
+			return fmt.Errorf("couldn't write %q: %w", fn, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,36 @@
+package debug_assets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreAssets(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name  string
+		files []string
+	}{
+		{"passwords.pgp", []string{".gpg-id", "Alpha.gpg", "Directory/Nested Directory/Foo.gpg", ".Hidden Directory/Gamma.gpg", ".Hidden Directory/.Alpha.gpg"}},
+		{"passwords.sbox", []string{"Alpha.harp", "Directory/Nested Directory/Foo.harp", ".Hidden Directory/Gamma.harp", ".Hidden Directory/.Alpha.harp"}},
+	} {
+		dir, err := ioutil.TempDir("", "debug_assets_test_")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		if err := RestoreAssets(dir, test.name); err != nil {
+			t.Fatalf("Could not restore %q: %v", test.name, err)
+		}
+
+		// Hidden files & directories must be restored along with the rest.
+		for _, f := range test.files {
+			fn := filepath.Join(dir, test.name, filepath.FromSlash(f))
+			if fi, err := os.Stat(fn); err != nil || fi.Size() == 0 {
+				t.Errorf("Restoring %q did not restore %q (err = %v)", test.name, f, err)
+			}
+		}
+	}
+}
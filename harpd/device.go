@@ -0,0 +1,232 @@
+// Package device provides persistent storage for trusted devices, which allow
+// a browser to skip multi-factor authentication for pages which reveal only
+// entry names.
+package device
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dpb "github.com/BranLwyd/harpocrates/harpd/proto/device_go_proto"
+)
+
+const (
+	idLength     = 9
+	secretLength = 32
+)
+
+// ErrNoDevice is returned when a device does not exist, has expired, or is
+// presented with the wrong secret.
+var ErrNoDevice = errors.New("no such trusted device")
+
+// Device describes a trusted device. It never includes the device's secret.
+type Device struct {
+	ID        string    // identifies the device; it is not a credential
+	User      string    // name of the user who trusted the device; empty unless the server serves multiple users
+	Label     string    // human-readable label of the device
+	CreatedAt time.Time // time the device was trusted
+	ExpiresAt time.Time // time after which the device is no longer trusted
+}
+
+// Store stores trusted devices, keyed by device ID, persisting them to a file
+// on disk. Devices are trusted for a fixed lifetime, after which they are
+// forgotten. It is safe for concurrent use from multiple goroutines.
+//
+// A device presents a token of the form "<ID>.<secret>". The secret is never
+// stored: only a hash of it, used to verify the token.
+type Store struct {
+	filename string
+	lifetime time.Duration
+
+	mu      sync.Mutex // protects devices
+	devices map[string]*dpb.Device
+}
+
+// NewStore creates a new device store persisted in the given file, trusting
+// devices for the given lifetime. If the file does not yet exist, the store
+// starts out empty; the file will be created on the first call to Create.
+func NewStore(filename string, lifetime time.Duration) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		lifetime: lifetime,
+		devices:  map[string]*dpb.Device{},
+	}
+	devBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	devs := &dpb.Devices{}
+	if err := proto.Unmarshal(devBytes, devs); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for id, d := range devs.Device {
+		s.devices[id] = d
+	}
+	return s, nil
+}
+
+// Lifetime returns how long devices are trusted for.
+func (s *Store) Lifetime() time.Duration { return s.lifetime }
+
+// List returns a description of each device trusted as of the given time,
+// oldest first.
+func (s *Store) List(now time.Time) []Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var devs []Device
+	for id, d := range s.devices {
+		if dev := s.device(id, d); now.Before(dev.ExpiresAt) {
+			devs = append(devs, dev)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].CreatedAt.Before(devs[j].CreatedAt) })
+	return devs
+}
+
+// Create trusts a new device on behalf of the given user. It returns the token
+// to be presented by the device, along with a description of the device. The
+// token can't be recovered later. The new device is persisted to disk before
+// Create returns; devices which have expired are forgotten at the same time.
+func (s *Store) Create(user, label string, now time.Time) (string, Device, error) {
+	var id [idLength]byte
+	var sec [secretLength]byte
+	for _, b := range [][]byte{id[:], sec[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return "", Device{}, fmt.Errorf("couldn't generate token: %w", err)
+		}
+	}
+	h := sha256.Sum256(sec[:])
+	d := &dpb.Device{
+		User:             user,
+		Label:            label,
+		CreatedUnixNanos: now.UnixNano(),
+		Hash:             h[:],
+	}
+	devID := base64.RawURLEncoding.EncodeToString(id[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[devID]; ok {
+		// Overwhelmingly unlikely, but don't overwrite an existing device.
+		return "", Device{}, errors.New("couldn't generate token: duplicate ID")
+	}
+	expired := map[string]*dpb.Device{}
+	for id, d := range s.devices {
+		if !now.Before(s.device(id, d).ExpiresAt) {
+			expired[id] = d
+			delete(s.devices, id)
+		}
+	}
+	s.devices[devID] = d
+	if err := s.write(); err != nil {
+		delete(s.devices, devID)
+		for id, d := range expired {
+			s.devices[id] = d
+		}
+		return "", Device{}, err
+	}
+	return devID + "." + base64.RawURLEncoding.EncodeToString(sec[:]), s.device(devID, d), nil
+}
+
+// Authenticate verifies the given token, as returned by Create, returning a
+// description of the device. It returns ErrNoDevice if the token is
+// malformed, has the wrong secret, or belongs to a device which has been
+// revoked or is no longer trusted as of the given time.
+func (s *Store) Authenticate(tok string, now time.Time) (Device, error) {
+	parts := strings.SplitN(tok, ".", 2)
+	if len(parts) != 2 {
+		return Device{}, ErrNoDevice
+	}
+	devID := parts[0]
+	sec, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Device{}, ErrNoDevice
+	}
+
+	s.mu.Lock()
+	d := s.devices[devID]
+	s.mu.Unlock()
+	if d == nil {
+		return Device{}, ErrNoDevice
+	}
+	h := sha256.Sum256(sec)
+	dev := s.device(devID, d)
+	if subtle.ConstantTimeCompare(h[:], d.Hash) != 1 || !now.Before(dev.ExpiresAt) {
+		return Device{}, ErrNoDevice
+	}
+	return dev, nil
+}
+
+// Revoke deletes the device with the given ID, so that it is no longer
+// trusted, returning a description of the deleted device. It returns
+// ErrNoDevice if there is no such device. The deletion is persisted to disk
+// before Revoke returns; if persisting fails, the device is not deleted.
+func (s *Store) Revoke(devID string) (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[devID]
+	if !ok {
+		return Device{}, ErrNoDevice
+	}
+	delete(s.devices, devID)
+	if err := s.write(); err != nil {
+		s.devices[devID] = d
+		return Device{}, err
+	}
+	return s.device(devID, d), nil
+}
+
+// write writes the current devices to disk. s.mu must be held.
+func (s *Store) write() error {
+	devBytes, err := proto.Marshal(&dpb.Devices{Device: s.devices})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal devices: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.filename), ".harp_device_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0600); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(devBytes); err != nil {
+		return fmt.Errorf("couldn't write devices: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, s.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, s.filename, err)
+	}
+	return nil
+}
+
+func (s *Store) device(devID string, d *dpb.Device) Device {
+	createdAt := time.Unix(0, d.CreatedUnixNanos)
+	return Device{
+		ID:        devID,
+		User:      d.User,
+		Label:     d.Label,
+		CreatedAt: createdAt,
+		ExpiresAt: createdAt.Add(s.lifetime),
+	}
+}
@@ -0,0 +1,93 @@
+package device
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDevice(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_device_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices")
+	const lifetime = 24 * time.Hour
+	s, err := NewStore(filename, lifetime)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	tok, info, err := s.Create("alice", "Firefox on Linux", now)
+	if err != nil {
+		t.Fatalf("Could not create device: %v", err)
+	}
+	if info.User != "alice" || info.Label != "Firefox on Linux" || !info.CreatedAt.Equal(now) || !info.ExpiresAt.Equal(now.Add(lifetime)) {
+		t.Errorf("Create returned device %+v, want matching device", info)
+	}
+
+	// The token, and only the token, authenticates, until it expires.
+	if got, err := s.Authenticate(tok, now); err != nil || got.ID != info.ID {
+		t.Errorf("Authenticate = (%+v, %v), want (%+v, nil)", got, err, info)
+	}
+	for _, bad := range []string{"", "garbage", info.ID, info.ID + ".", info.ID + ".AAAA", "nonexistent" + tok[strings.Index(tok, "."):]} {
+		if _, err := s.Authenticate(bad, now); !errors.Is(err, ErrNoDevice) {
+			t.Errorf("Authenticate(%q) returned error %v, want %v", bad, err, ErrNoDevice)
+		}
+	}
+	if _, err := s.Authenticate(tok, now.Add(lifetime)); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Authenticate after expiry returned error %v, want %v", err, ErrNoDevice)
+	}
+
+	// A new store reading the same file sees the same devices.
+	s, err = NewStore(filename, lifetime)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if devs := s.List(now); len(devs) != 1 || devs[0].ID != info.ID || devs[0].Label != "Firefox on Linux" {
+		t.Errorf("After reload, List = %+v, want [%+v]", devs, info)
+	}
+	if _, err := s.Authenticate(tok, now); err != nil {
+		t.Errorf("After reload, Authenticate returned error %v, want nil", err)
+	}
+
+	// Expired devices are not listed, and are forgotten when another device
+	// is trusted.
+	later := now.Add(lifetime)
+	if devs := s.List(later); len(devs) != 0 {
+		t.Errorf("After expiry, List = %+v, want none", devs)
+	}
+	tok2, info2, err := s.Create("alice", "Chrome on Android", later)
+	if err != nil {
+		t.Fatalf("Could not create second device: %v", err)
+	}
+	if _, err := s.Revoke(info.ID); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Revoke of expired device returned error %v, want %v", err, ErrNoDevice)
+	}
+
+	// Revoked devices no longer authenticate.
+	if _, err := s.Revoke(info2.ID); err != nil {
+		t.Fatalf("Could not revoke device: %v", err)
+	}
+	if _, err := s.Authenticate(tok2, later); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Authenticate of revoked device returned error %v, want %v", err, ErrNoDevice)
+	}
+	if _, err := s.Revoke(info2.ID); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Second revoke returned error %v, want %v", err, ErrNoDevice)
+	}
+	s, err = NewStore(filename, lifetime)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if devs := s.List(later); len(devs) != 0 {
+		t.Errorf("After revocation & reload, List = %+v, want none", devs)
+	}
+}
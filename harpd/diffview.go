@@ -0,0 +1,183 @@
+// Package diffview computes line-based differences between two versions of
+// some text, for display to users.
+package diffview
+
+import "strings"
+
+// Op describes how a line differs between the old & new text.
+type Op int
+
+const (
+	Equal  Op = iota // the line is in both the old & new text
+	Delete           // the line is only in the old text
+	Insert           // the line is only in the new text
+)
+
+func (op Op) String() string {
+	switch op {
+	case Delete:
+		return "-"
+	case Insert:
+		return "+"
+	default:
+		return " "
+	}
+}
+
+// Line is a single line of a diff.
+type Line struct {
+	Op   Op
+	Text string // without a trailing newline
+}
+
+// Hunk is a group of changed lines, along with surrounding unchanged lines
+// for context, as in a unified diff.
+type Hunk struct {
+	OldStart, OldLines int // 1-based starting line & number of lines in the old text
+	NewStart, NewLines int // 1-based starting line & number of lines in the new text
+	Lines              []Line
+}
+
+// Diff computes a minimal line-based diff from a to b.
+func Diff(a, b string) []Line {
+	as, bs := splitLines(a), splitLines(b)
+
+	// Lines in common at the start & end of the text are trivially equal;
+	// only the lines between need to be compared.
+	pre := 0
+	for pre < len(as) && pre < len(bs) && as[pre] == bs[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(as)-pre && suf < len(bs)-pre && as[len(as)-1-suf] == bs[len(bs)-1-suf] {
+		suf++
+	}
+
+	var lines []Line
+	for _, l := range as[:pre] {
+		lines = append(lines, Line{Equal, l})
+	}
+	lines = append(lines, lcsDiff(as[pre:len(as)-suf], bs[pre:len(bs)-suf])...)
+	for _, l := range as[len(as)-suf:] {
+		lines = append(lines, Line{Equal, l})
+	}
+	return lines
+}
+
+// lcsDiff computes a minimal diff from a to b via their longest common
+// subsequence.
+func lcsDiff(a, b []string) []Line {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] & b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []Line
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, Line{Equal, a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, Line{Delete, a[i]})
+			i++
+		default:
+			lines = append(lines, Line{Insert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, Line{Delete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, Line{Insert, b[j]})
+	}
+	return lines
+}
+
+// Unified computes the diff from a to b, grouped into hunks with up to the
+// given number of unchanged lines of context around each change. It returns
+// nil if a & b have the same lines.
+func Unified(a, b string, context int) []Hunk {
+	lines := Diff(a, b)
+	var hunks []Hunk
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(lines); {
+		if lines[i].Op == Equal {
+			i, oldLine, newLine = i+1, oldLine+1, newLine+1
+			continue
+		}
+
+		// Start a hunk with preceding context, then extend it until there
+		// are more than 2*context unchanged lines before the next change.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		h := Hunk{OldStart: oldLine - (i - start), NewStart: newLine - (i - start)}
+		end := i
+		for end < len(lines) {
+			if lines[end].Op != Equal {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].Op == Equal {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				end += min(context, next-end)
+				break
+			}
+			end = next
+		}
+		h.Lines = lines[start:end]
+		for _, l := range h.Lines {
+			if l.Op != Insert {
+				h.OldLines++
+			}
+			if l.Op != Delete {
+				h.NewLines++
+			}
+		}
+		hunks = append(hunks, h)
+
+		for ; i < end; i++ {
+			if lines[i].Op != Insert {
+				oldLine++
+			}
+			if lines[i].Op != Delete {
+				newLine++
+			}
+		}
+	}
+	return hunks
+}
+
+// splitLines splits text into lines, ignoring a trailing newline.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
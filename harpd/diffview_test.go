@@ -0,0 +1,79 @@
+package diffview
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// format renders lines as in a unified diff, one per line.
+func format(lines []Line) string {
+	var sb strings.Builder
+	for _, l := range lines {
+		fmt.Fprintf(&sb, "%s%s\n", l.Op, l.Text)
+	}
+	return sb.String()
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb\n", " a\n b\n"},
+		{"", "new\n", "+new\n"},
+		{"old\n", "", "-old\n"},
+		{"pass\nUsername: bob\n", "pass2\nUsername: bob\n", "-pass\n+pass2\n Username: bob\n"},
+		{"a\nb\nc\nd\n", "a\nc\nd\ne\n", " a\n-b\n c\n d\n+e\n"},
+		{"a\nx\nb\n", "a\ny\nb", " a\n-x\n+y\n b\n"},
+	} {
+		if got := format(Diff(test.a, test.b)); got != test.want {
+			t.Errorf("Diff(%q, %q) =\n%s\nwant\n%s", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestUnified(t *testing.T) {
+	t.Parallel()
+
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("%d", i))
+	}
+	a := strings.Join(lines, "\n")
+	lines[2], lines[16] = "three", "seventeen"
+	b := strings.Join(lines, "\n")
+
+	hunks := Unified(a, b, 2)
+	if len(hunks) != 2 {
+		t.Fatalf("Unified returned %d hunks, want 2", len(hunks))
+	}
+	for i, want := range []struct {
+		oldStart, oldLines, newStart, newLines int
+		lines                                  string
+	}{
+		{1, 5, 1, 5, " 1\n 2\n-3\n+three\n 4\n 5\n"},
+		{15, 5, 15, 5, " 15\n 16\n-17\n+seventeen\n 18\n 19\n"},
+	} {
+		h := hunks[i]
+		if h.OldStart != want.oldStart || h.OldLines != want.oldLines || h.NewStart != want.newStart || h.NewLines != want.newLines {
+			t.Errorf("Hunk %d covers -%d,%d +%d,%d, want -%d,%d +%d,%d", i, h.OldStart, h.OldLines, h.NewStart, h.NewLines, want.oldStart, want.oldLines, want.newStart, want.newLines)
+		}
+		if got := format(h.Lines); got != want.lines {
+			t.Errorf("Hunk %d =\n%s\nwant\n%s", i, got, want.lines)
+		}
+	}
+
+	// Nearby changes share a hunk.
+	if hunks := Unified(a, b, 7); len(hunks) != 1 || hunks[0].OldStart != 1 || hunks[0].OldLines != 20 {
+		t.Errorf("Unified with large context returned %+v, want a single hunk covering every line", hunks)
+	}
+
+	// Identical text has no hunks.
+	if hunks := Unified(a, a, 2); hunks != nil {
+		t.Errorf("Unified of identical text = %+v, want nil", hunks)
+	}
+}
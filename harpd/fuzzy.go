@@ -0,0 +1,208 @@
+// Package fuzzy matches search queries against entry paths, scoring how well
+// each path matches so that results can be ranked.
+package fuzzy
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kind describes how a query matched a path. Kinds are ordered: a better kind
+// of match has a larger value.
+type Kind int
+
+const (
+	None         Kind = iota // the query did not match
+	Subsequence              // the query's characters appear in order in the path
+	WordBoundary             // the query appears in the path, starting at the start of a word
+	Prefix                   // the path's base name starts with the query
+	Exact                    // the path's base name is the query
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Subsequence:
+		return "subsequence"
+	case WordBoundary:
+		return "word boundary"
+	case Prefix:
+		return "prefix"
+	case Exact:
+		return "exact"
+	default:
+		return "none"
+	}
+}
+
+// Scoring of subsequence matches, after fzf: each matched character scores
+// points, with a bonus for characters at the start of a word & for runs of
+// consecutive characters, and a penalty for each gap between matched
+// characters.
+const (
+	scoreMatch       = 16
+	bonusBoundary    = 8
+	bonusConsecutive = 4
+	penaltyGapStart  = 3
+	penaltyGapExtend = 1
+	noScore          = -1 << 30
+	noPos            = -1
+)
+
+// Result describes how a query matched a path.
+type Result struct {
+	Kind      Kind
+	Score     int   // higher is better; only comparable between results of the same Kind
+	Positions []int // the indices of the matched runes of the path, in ascending order
+}
+
+// Match matches the given query against a slash-separated path, ignoring case.
+// It returns false if the query does not match.
+func Match(query, path string) (Result, bool) {
+	q, p := []rune(query), []rune(path)
+	if len(q) == 0 || len(q) > len(p) {
+		return Result{}, false
+	}
+	for i, r := range q {
+		q[i] = unicode.ToLower(r)
+	}
+	base := utf8.RuneCountInString(path[:strings.LastIndex(path, "/")+1])
+
+	switch {
+	case equalFold(q, p[base:]):
+		return Result{Kind: Exact, Positions: span(base, len(q))}, true
+	case len(q) <= len(p)-base && equalFold(q, p[base:base+len(q)]):
+		return Result{Kind: Prefix, Positions: span(base, len(q))}, true
+	}
+
+	// Prefer word-boundary matches nearer the end of the path, i.e. in the
+	// base name rather than in a directory name.
+	for i := len(p) - len(q); i >= 0; i-- {
+		if isBoundary(p, i) && equalFold(q, p[i:i+len(q)]) {
+			return Result{Kind: WordBoundary, Positions: span(i, len(q))}, true
+		}
+	}
+
+	if score, pos, ok := subsequence(q, p); ok {
+		return Result{Kind: Subsequence, Score: score, Positions: pos}, true
+	}
+	return Result{}, false
+}
+
+// subsequence finds the best-scoring match of the (lowercase) query q as a
+// subsequence of p.
+func subsequence(q, p []rune) (int, []int, bool) {
+	// best[i][j] is the best score of matching q[:i+1] with q[i] matched
+	// to p[j]; from[i][j] is the position of q[i-1] in that match.
+	best, from := make([][]int, len(q)), make([][]int, len(q))
+	for i := range q {
+		best[i], from[i] = make([]int, len(p)), make([]int, len(p))
+		// carry is the best score of a match of q[:i] ending at least
+		// two runes before j, less the penalty for the gap up to j.
+		carry, carryFrom := noScore, noPos
+		for j := range p {
+			if carry != noScore {
+				carry -= penaltyGapExtend
+			}
+			if i > 0 && j >= 2 && best[i-1][j-2] != noScore {
+				if s := best[i-1][j-2] - penaltyGapStart; s > carry {
+					carry, carryFrom = s, j-2
+				}
+			}
+
+			best[i][j], from[i][j] = noScore, noPos
+			if unicode.ToLower(p[j]) != q[i] {
+				continue
+			}
+			s := scoreMatch
+			if isBoundary(p, j) {
+				s += bonusBoundary
+			}
+			switch {
+			case i == 0:
+				best[i][j] = s
+			case j >= 1 && best[i-1][j-1] != noScore && best[i-1][j-1]+bonusConsecutive >= carry:
+				best[i][j], from[i][j] = s+best[i-1][j-1]+bonusConsecutive, j-1
+			case carry != noScore:
+				best[i][j], from[i][j] = s+carry, carryFrom
+			}
+		}
+	}
+
+	last := len(q) - 1
+	score, end := noScore, noPos
+	for j, s := range best[last] {
+		if s > score {
+			score, end = s, j
+		}
+	}
+	if end == noPos {
+		return 0, nil, false
+	}
+	pos := make([]int, len(q))
+	for i := last; i >= 0; i-- {
+		pos[i] = end
+		end = from[i][end]
+	}
+	return score, pos, true
+}
+
+// isBoundary determines if p[i] starts a word: it is the first rune, follows
+// a rune which is not a letter or digit (such as "/" or "-"), or is an
+// uppercase letter following a lowercase one.
+func isBoundary(p []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := p[i-1]
+	if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+		return true
+	}
+	return unicode.IsLower(prev) && unicode.IsUpper(p[i])
+}
+
+// equalFold determines if the (lowercase) query q is equal to p, ignoring case.
+func equalFold(q, p []rune) bool {
+	if len(q) != len(p) {
+		return false
+	}
+	for i := range q {
+		if unicode.ToLower(p[i]) != q[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func span(start, n int) []int {
+	pos := make([]int, n)
+	for i := range pos {
+		pos[i] = start + i
+	}
+	return pos
+}
+
+// Segment is a portion of a path, either entirely matched or entirely
+// unmatched by a query.
+type Segment struct {
+	Text    string
+	Matched bool
+}
+
+// Segments splits the given path into segments of matched & unmatched runes,
+// per the positions of a Result, so that matched runes can be highlighted.
+func Segments(path string, positions []int) []Segment {
+	var segs []Segment
+	matched := make(map[int]bool, len(positions))
+	for _, p := range positions {
+		matched[p] = true
+	}
+	for i, r := range []rune(path) {
+		if m := matched[i]; len(segs) > 0 && segs[len(segs)-1].Matched == m {
+			segs[len(segs)-1].Text += string(r)
+		} else {
+			segs = append(segs, Segment{Text: string(r), Matched: m})
+		}
+	}
+	return segs
+}
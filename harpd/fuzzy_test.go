@@ -0,0 +1,88 @@
+package fuzzy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// highlight renders the path with matched runes in brackets.
+func highlight(path string, positions []int) string {
+	var sb strings.Builder
+	for _, s := range Segments(path, positions) {
+		if s.Matched {
+			fmt.Fprintf(&sb, "[%s]", s.Text)
+		} else {
+			sb.WriteString(s.Text)
+		}
+	}
+	return sb.String()
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		query, path string
+		wantKind    Kind
+		want        string // the highlighted path
+	}{
+		// Kinds of match.
+		{"github", "dev/GitHub", Exact, "dev/[GitHub]"},
+		{"git", "dev/GitHub", Prefix, "dev/[Git]Hub"},
+		{"hub", "dev/GitHub", WordBoundary, "dev/Git[Hub]"},
+		{"mail", "google-mail", WordBoundary, "google-[mail]"},
+		{"dev", "dev/GitHub", WordBoundary, "[dev]/GitHub"},
+		{"gh", "dev/GitHub", Subsequence, "dev/[G]it[H]ub"},
+		{"ithu", "dev/GitHub", Subsequence, "dev/G[itHu]b"},
+		{"dgh", "dev/GitHub", Subsequence, "[d]ev/[G]it[H]ub"},
+		{"ÉCOLE", "sites/école", Exact, "sites/[école]"},
+
+		// Word-boundary matches prefer the base name.
+		{"bank", "bank/old-bank", WordBoundary, "bank/old-[bank]"},
+
+		// Subsequence matches prefer word starts & consecutive characters.
+		{"gm", "gaming/Google-Mail", Subsequence, "gaming/[G]oogle-[M]ail"},
+		{"abc", "axbxc-xabc", Subsequence, "axbxc-x[abc]"},
+
+		// Non-matches.
+		{"", "a", None, "a"},
+		{"hg", "dev/GitHub", None, "dev/GitHub"},
+		{"github2", "GitHub", None, "GitHub"},
+	} {
+		res, ok := Match(test.query, test.path)
+		if ok != (test.wantKind != None) || res.Kind != test.wantKind {
+			t.Errorf("Match(%q, %q) got kind %v (ok = %v), want %v", test.query, test.path, res.Kind, ok, test.wantKind)
+			continue
+		}
+		if got := highlight(test.path, res.Positions); got != test.want {
+			t.Errorf("Match(%q, %q) matched %q, want %q", test.query, test.path, got, test.want)
+		}
+	}
+}
+
+func TestSubsequenceScore(t *testing.T) {
+	t.Parallel()
+
+	// Each path matches the query better than the next.
+	for _, test := range []struct {
+		query string
+		paths []string
+	}{
+		{"gh", []string{"GitHub", "gitlab-home", "gash", "g-----------h"}},
+		{"abc", []string{"xabcx", "xaxbcx", "xaxbxcx", "xaxxbxxc"}},
+	} {
+		var prev int
+		for i, p := range test.paths {
+			res, ok := Match(test.query, p)
+			if !ok || res.Kind != Subsequence {
+				t.Errorf("Match(%q, %q) = (%v, %v), want subsequence match", test.query, p, res, ok)
+				continue
+			}
+			if i > 0 && res.Score >= prev {
+				t.Errorf("Match(%q, %q) scored %d, want less than %d (for %q)", test.query, p, res.Score, prev, test.paths[i-1])
+			}
+			prev = res.Score
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/e3b0c442/warp"
+
+	"github.com/BranLwyd/harpocrates/harpd/accesslog"
+	"github.com/BranLwyd/harpocrates/harpd/rate"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/harpd/totp"
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+const apiEntryPrefix = "/api/p"
+
+// apiHandler handles the JSON API. The API uses the same session cookie &
+// multi-factor authentication model as the HTML UI: a session is created by
+// logging in with the passphrase, after which each entry must be
+// multi-factor authenticated before it can be read or written.
+//
+// Endpoints:
+//
+//	POST   /api/login     {"passphrase": "...", "user": "..."} -- create a session; "user" is optional
+//	POST   /api/logout                          -- close the current session
+//	POST   /api/mfa       {"path": "...", "credential": {...}} -- complete an MFA challenge
+//	GET    /api/p                               -- list entries
+//	GET    /api/p/<path>                        -- get an entry
+//	GET    /api/p/<path>/otp                    -- get an entry's current one-time code
+//	GET    /api/p/<path>/log                    -- get an entry's recent accesses, most recent first
+//	PUT    /api/p/<path>  {"content": "..."}    -- create or update an entry
+//	DELETE /api/p/<path>                        -- delete an entry
+//
+// Responses getting an entry include an ETag header identifying its content.
+// A PUT request may include an If-Match header holding that ETag, so that the
+// entry is only updated if it has not changed since it was read, or an
+// "If-None-Match: *" header, so that the entry is only created if it does not
+// exist. If the condition fails, the response is 412.
+//
+// Requests lacking required multi-factor authentication receive a 403
+// response including an MFA challenge, which can be completed via /api/mfa.
+//
+// The response to /api/login includes the session's CSRF token in the
+// X-CSRF-Token header. Requests other than GET which use the session must
+// include the token in the same header, or receive a 403 response.
+//
+// Alternatively, if API tokens are enabled, a request may include an
+// "Authorization: Bearer <token>" header with an API token created at /tokens,
+// instead of a session cookie. Such requests need neither a CSRF token nor
+// multi-factor authentication, but can only access the entries allowed by
+// the token.
+type apiHandler struct {
+	sh           *session.Handler
+	al           *accesslog.Log // may be nil, in which case accesses are not logged
+	cookie       SessionCookie
+	entryMaxSize int   // maximum size of entry content, in bytes
+	bodyMaxSize  int64 // maximum size of request bodies other than entry updates, in bytes
+}
+
+func newAPI(sh *session.Handler, al *accesslog.Log, cookie SessionCookie, entryMaxSize int, bodyMaxSize int64) *apiHandler {
+	return &apiHandler{
+		sh:           sh,
+		al:           al,
+		cookie:       cookie,
+		entryMaxSize: entryMaxSize,
+		bodyMaxSize:  bodyMaxSize,
+	}
+}
+
+func (ah apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Don't allow caching of anything served by the API.
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !acceptsJSON(r) {
+		serveAPIError(w, http.StatusNotAcceptable, "responses are only available as application/json")
+		return
+	}
+
+	n := ah.bodyMaxSize
+	if strings.HasPrefix(r.URL.Path, apiEntryPrefix+"/") {
+		n = entryBodyMaxSize(ah.bodyMaxSize, ah.entryMaxSize)
+	}
+	limitBody(http.HandlerFunc(ah.serveEndpointHTTP), n).ServeHTTP(w, r)
+}
+
+func (ah apiHandler) serveEndpointHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case p == "/api/login":
+		ah.serveLoginHTTP(w, r)
+	case p == "/api/logout":
+		ah.serveLogoutHTTP(w, r)
+	case p == "/api/mfa":
+		ah.serveMFAHTTP(w, r)
+	case p == apiEntryPrefix:
+		ah.servePassListHTTP(w, r)
+	case strings.HasPrefix(p, apiEntryPrefix+"/"):
+		ah.servePassHTTP(w, r)
+	default:
+		serveAPIError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func (ah apiHandler) serveLoginHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	var req struct {
+		Passphrase     string `json:"passphrase"`
+		User           string `json:"user"`
+		ExternalSecret []byte `json:"external_secret"` // base64-encoded; only needed by some keys
+	}
+	if !parseAPIRequest(w, r, &req) {
+		return
+	}
+	sid, sess, err := ah.sh.CreateUserSessionWith(clientIP(r), r.UserAgent(), req.User, req.Passphrase, req.ExternalSecret)
+	switch {
+	case errors.Is(err, secret.ErrWrongPassphrase):
+		serveAPIError(w, http.StatusUnauthorized, "wrong passphrase")
+		return
+	case errors.Is(err, rate.ErrTooManyEvents):
+		serveAPIError(w, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+		return
+	case errors.Is(err, session.ErrTooManySessions):
+		serveAPIError(w, http.StatusServiceUnavailable, "too many sessions")
+		return
+	case err != nil:
+		logf(r, "Could not create session: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	ah.cookie.set(w, sid)
+	w.Header().Set(csrfHeader, sess.CSRFToken())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah apiHandler) serveLogoutHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	sess, ok := ah.session(w, r)
+	if !ok {
+		return
+	}
+	sess.Close()
+	ah.cookie.clear(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah apiHandler) serveMFAHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	sess, ok := ah.session(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Path       string                             `json:"path"`
+		Credential *warp.AssertionPublicKeyCredential `json:"credential"`
+	}
+	if !parseAPIRequest(w, r, &req) {
+		return
+	}
+	if req.Path == "" || req.Credential == nil {
+		serveAPIError(w, http.StatusBadRequest, "path and credential are required")
+		return
+	}
+	switch sid, err := sess.AuthenticateMFAResponse(req.Path, req.Credential); {
+	case err == nil:
+		ah.cookie.set(w, sid)
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, session.ErrNoChallenge):
+		serveAPIError(w, http.StatusBadRequest, "no current MFA challenge for path")
+	case errors.Is(err, session.ErrMFAAuthenticationFailed):
+		serveAPIError(w, http.StatusForbidden, "MFA authentication failed")
+	case errors.Is(err, session.ErrMFACounterRegression):
+		logf(r, "MFA signature counter regression; device may be cloned")
+		serveAPIError(w, http.StatusForbidden, "MFA authentication failed")
+	case errors.Is(err, session.ErrNoSession):
+		logf(r, "Session closed after too many failed MFA assertions")
+		serveAPIError(w, http.StatusUnauthorized, "session closed after too many failed MFA attempts")
+	default:
+		logf(r, "Could not authenticate MFA response: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+func (ah apiHandler) servePassListHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		serveAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	sess, ok := ah.session(w, r)
+	if !ok || !ah.requireMFA(w, sess, authAny) {
+		return
+	}
+	entries, err := sess.GetStore().List()
+	if err != nil {
+		logf(r, "Could not list entries in API handler: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if entries == nil {
+		entries = []string{}
+	}
+	serveAPIResponse(w, http.StatusOK, entries)
+}
+
+func (ah apiHandler) servePassHTTP(w http.ResponseWriter, r *http.Request) {
+	entryPath, isDir := parsePath(strings.TrimPrefix(r.URL.Path, apiEntryPrefix))
+	if isDir {
+		serveAPIError(w, http.StatusBadRequest, "path must name an entry, not a directory")
+		return
+	}
+	sess, ok := ah.session(w, r)
+	if !ok {
+		return
+	}
+
+	// GET /api/p/<path>/otp serves the current one-time code for the entry
+	// <path>, if that entry exists; otherwise, it names an entry like any
+	// other path.
+	if otpPath := strings.TrimSuffix(entryPath, "/otp"); r.Method == http.MethodGet && otpPath != entryPath {
+		if _, err := sess.GetStore().Get(otpPath); err == nil {
+			ah.serveOTPHTTP(w, sess, otpPath)
+			return
+		}
+	}
+
+	// Likewise, GET /api/p/<path>/log serves the recent accesses to the entry <path>.
+	if logPath := strings.TrimSuffix(entryPath, "/log"); r.Method == http.MethodGet && logPath != entryPath && ah.al != nil {
+		if _, err := sess.GetStore().Get(logPath); err == nil {
+			ah.serveAccessLogHTTP(w, sess, logPath)
+			return
+		}
+	}
+
+	if !ah.requireMFA(w, sess, entryPath) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		content, err := sess.GetStore().Get(entryPath)
+		if errors.Is(err, secret.ErrNoEntry) {
+			serveAPIError(w, http.StatusNotFound, "no such entry")
+			return
+		} else if err != nil {
+			logf(r, "Could not get entry %q in API handler: %v", entryPath, err)
+			serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		recordAccess(ah.al, r, entryPath, accesslog.View)
+		w.Header().Set("ETag", entryETag(content))
+		serveAPIResponse(w, http.StatusOK, struct {
+			Path    string `json:"path"`
+			Content string `json:"content"`
+		}{entryPath, content})
+
+	case http.MethodPut:
+		if secret.IsReadOnly(sess.GetStore(), entryPath) {
+			serveAPIError(w, http.StatusForbidden, "entry is read-only")
+			return
+		}
+		expectedHash, conditional, ok := putCondition(r)
+		if !ok {
+			serveAPIError(w, http.StatusBadRequest, "If-Match must hold a single entity tag, and If-None-Match may only be \"*\"")
+			return
+		}
+		var req struct {
+			Content *string `json:"content"`
+		}
+		if !parseAPIRequest(w, r, &req) {
+			return
+		}
+		if req.Content == nil {
+			serveAPIError(w, http.StatusBadRequest, "content is required")
+			return
+		}
+		if len(*req.Content) > ah.entryMaxSize {
+			serveAPIError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("content may be at most %d bytes", ah.entryMaxSize))
+			return
+		}
+		put := sess.GetStore().Put
+		if conditional {
+			put = func(entry, content string) error { return secret.PutIf(sess.GetStore(), entry, content, expectedHash) }
+		}
+		switch err := put(entryPath, *req.Content); {
+		case errors.Is(err, secret.ErrConflict):
+			serveAPIError(w, http.StatusPreconditionFailed, "entry has changed")
+			return
+		case errors.Is(err, secret.ErrReadOnly):
+			serveAPIError(w, http.StatusForbidden, "entry is read-only")
+			return
+		case errors.Is(err, secret.ErrEntryTooLarge):
+			serveAPIError(w, http.StatusRequestEntityTooLarge, "content is too large")
+			return
+		case err != nil:
+			logf(r, "Could not update entry %q in API handler: %v", entryPath, err)
+			serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		recordAccess(ah.al, r, entryPath, accesslog.Update)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if secret.IsReadOnly(sess.GetStore(), entryPath) {
+			serveAPIError(w, http.StatusForbidden, "entry is read-only")
+			return
+		}
+		if err := sess.GetStore().Delete(entryPath); errors.Is(err, secret.ErrNoEntry) {
+			serveAPIError(w, http.StatusNotFound, "no such entry")
+			return
+		} else if errors.Is(err, secret.ErrReadOnly) {
+			serveAPIError(w, http.StatusForbidden, "entry is read-only")
+			return
+		} else if err != nil {
+			logf(r, "Could not delete entry %q in API handler: %v", entryPath, err)
+			serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		recordAccess(ah.al, r, entryPath, accesslog.Delete)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		serveAPIError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+// entryETag returns the ETag identifying the given entry content.
+func entryETag(content string) string {
+	return `"` + secret.ContentHash(content) + `"`
+}
+
+// putCondition parses the conditional headers of a PUT request, returning the
+// hash of the content the entry must currently have for the PUT to succeed,
+// as used by secret.PutIf. If the request is not conditional, conditional is
+// false; if the headers can't be parsed, ok is false. Only a single strong
+// entity tag in If-Match, or "*" in If-None-Match, is supported.
+func putCondition(r *http.Request) (expectedHash string, conditional, ok bool) {
+	ifMatch, ifNoneMatch := strings.TrimSpace(r.Header.Get("If-Match")), strings.TrimSpace(r.Header.Get("If-None-Match"))
+	switch {
+	case ifMatch == "" && ifNoneMatch == "":
+		return "", false, true
+	case ifMatch != "" && ifNoneMatch != "":
+		return "", false, false
+	case ifNoneMatch != "":
+		return "", true, ifNoneMatch == "*"
+	}
+	if len(ifMatch) < 2 || !strings.HasPrefix(ifMatch, `"`) || !strings.HasSuffix(ifMatch, `"`) || strings.Contains(ifMatch[1:len(ifMatch)-1], `"`) {
+		return "", false, false
+	}
+	hash := ifMatch[1 : len(ifMatch)-1]
+	if hash == "" {
+		// An empty hash would otherwise require that the entry not exist.
+		return "", false, false
+	}
+	return hash, true, true
+}
+
+func (ah apiHandler) serveOTPHTTP(w http.ResponseWriter, sess *session.Session, entryPath string) {
+	if !ah.requireMFA(w, sess, entryPath) {
+		return
+	}
+	content, err := sess.GetStore().Get(entryPath)
+	if errors.Is(err, secret.ErrNoEntry) {
+		serveAPIError(w, http.StatusNotFound, "no such entry")
+		return
+	} else if err != nil {
+		log.Printf("Could not get entry %q in API handler: %v", entryPath, err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	seed := entry.Parse(content).OTP
+	if seed == "" {
+		serveAPIError(w, http.StatusNotFound, "entry has no OTP seed")
+		return
+	}
+	k, err := totp.Parse(seed)
+	if err != nil {
+		log.Printf("Could not parse OTP seed of entry %q in API handler: %v", entryPath, err)
+		serveAPIError(w, http.StatusUnprocessableEntity, "couldn't parse OTP seed")
+		return
+	}
+	code, expiresIn := k.Code(time.Now())
+	serveAPIResponse(w, http.StatusOK, otpCode{code, int(expiresIn.Round(time.Second) / time.Second)})
+}
+
+func (ah apiHandler) serveAccessLogHTTP(w http.ResponseWriter, sess *session.Session, entryPath string) {
+	if !ah.requireMFA(w, sess, entryPath) {
+		return
+	}
+	type access struct {
+		Time     time.Time `json:"time"`
+		ClientIP string    `json:"client_ip"`
+		Action   string    `json:"action"`
+	}
+	accesses := []access{}
+	for _, a := range ah.al.Recent(entryPath, math.MaxInt32) {
+		accesses = append(accesses, access{a.Time, a.ClientIP, a.Action.String()})
+	}
+	serveAPIResponse(w, http.StatusOK, accesses)
+}
+
+// session gets the session associated with the request. If there is no
+// session, or the request may change state but lacks the session's CSRF token,
+// it serves an error and returns false.
+func (ah apiHandler) session(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	if token, ok := bearerToken(r); ok {
+		return ah.tokenSession(w, r, token)
+	}
+	sid, err := ah.cookie.sessionID(r)
+	if err != nil {
+		logf(r, "Could not get session ID: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return nil, false
+	}
+	sess, err := ah.sh.GetSessionFor(sid, clientIP(r), r.UserAgent())
+	if errors.Is(err, session.ErrNoSession) {
+		serveAPIError(w, http.StatusUnauthorized, "not logged in")
+		return nil, false
+	} else if err != nil {
+		logf(r, "Could not get session: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return nil, false
+	}
+	if !checkCSRF(r, sess) {
+		serveAPIError(w, http.StatusForbidden, "missing or mismatched CSRF token")
+		return nil, false
+	}
+	return sess, true
+}
+
+// tokenSession gets the session for the given API token. If there is no such
+// session, it serves an error and returns false. Requests using API tokens are
+// not subject to CSRF, since browsers never send the token on their own.
+func (ah apiHandler) tokenSession(w http.ResponseWriter, r *http.Request, token string) (*session.Session, bool) {
+	sess, err := ah.sh.GetAPITokenSession(token, clientIP(r))
+	if errors.Is(err, session.ErrNoSession) {
+		serveAPIError(w, http.StatusUnauthorized, "invalid API token")
+		return nil, false
+	} else if err != nil {
+		logf(r, "Could not get API token session: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return nil, false
+	}
+	return sess, true
+}
+
+// bearerToken returns the token from the request's Authorization header, if
+// it uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// requireMFA determines if the session has been multi-factor authenticated
+// for the given path (which may be authAny). If not, it serves a 403 response
+// including an MFA challenge for the path, and returns false.
+func (ah apiHandler) requireMFA(w http.ResponseWriter, sess *session.Session, authPath string) bool {
+	if (authPath == authAny && sess.IsMFAAuthenticated()) || sess.IsMFAAuthenticatedFor(authPath) {
+		return true
+	}
+	if !sess.HasRegisteredMFADevice() {
+		serveAPIError(w, http.StatusForbidden, "MFA required, but no MFA device is registered")
+		return false
+	}
+	c, err := sess.GenerateMFAChallenge(authPath)
+	if err != nil {
+		log.Printf("Could not create MFA challenge: %v", err)
+		serveAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	serveAPIResponse(w, http.StatusForbidden, struct {
+		Error string      `json:"error"`
+		MFA   interface{} `json:"mfa"`
+	}{"MFA required", struct {
+		Path      string                                  `json:"path"`
+		Challenge *warp.PublicKeyCredentialRequestOptions `json:"challenge"`
+	}{authPath, c}})
+	return false
+}
+
+// acceptsJSON determines if the request's Accept header allows a JSON
+// response. A missing Accept header accepts any response type.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, a := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// parseAPIRequest parses the JSON body of the request into v. If the body
+// cannot be parsed, it serves an error and returns false.
+func parseAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		serveAPIError(w, http.StatusUnsupportedMediaType, "request body must be application/json")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		switch c := bodyErrorStatus(err); c {
+		case http.StatusBadRequest:
+			serveAPIError(w, c, "couldn't parse request body")
+		default:
+			serveAPIError(w, c, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+func serveAPIError(w http.ResponseWriter, code int, msg string) {
+	serveAPIResponse(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func serveAPIResponse(w http.ResponseWriter, code int, v interface{}) {
+	respBytes, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Could not marshal API response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}
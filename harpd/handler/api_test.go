@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestAPIUnauthenticated(t *testing.T) {
+	t.Parallel()
+	h := newTestAPI(t)
+
+	for _, test := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/api/p"},
+		{http.MethodGet, "/api/p/entry"},
+		{http.MethodPut, "/api/p/entry"},
+		{http.MethodDelete, "/api/p/entry"},
+		{http.MethodPost, "/api/logout"},
+	} {
+		resp := doAPIRequest(h, test.method, test.path, nil, `{"content": "x"}`)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, resp.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAPILogin(t *testing.T) {
+	t.Parallel()
+	h := newTestAPI(t)
+
+	// Wrong passphrase.
+	if resp := doAPIRequest(h, http.MethodPost, "/api/login", nil, `{"passphrase": "wrong"}`); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Login with wrong passphrase: got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+
+	// Right passphrase.
+	resp := doAPIRequest(h, http.MethodPost, "/api/login", nil, `{"passphrase": "password"}`)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Login: got status %d, want %d", resp.Code, http.StatusNoContent)
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultSessionCookie.Name {
+		t.Fatalf("Login did not set session cookie: %v", cookies)
+	}
+
+	// Logout.
+	hdr := http.Header{csrfHeader: {resp.Header().Get(csrfHeader)}}
+	if resp := doAPIRequestWithHeader(h, http.MethodPost, "/api/logout", cookies[0], "", hdr); resp.Code != http.StatusNoContent {
+		t.Errorf("Logout: got status %d, want %d", resp.Code, http.StatusNoContent)
+	}
+	if resp := doAPIRequest(h, http.MethodPost, "/api/logout", cookies[0], ""); resp.Code != http.StatusUnauthorized {
+		t.Errorf("Logout after logout: got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIRequiresMFA(t *testing.T) {
+	t.Parallel()
+	h := newTestAPI(t)
+	resp := doAPIRequest(h, http.MethodPost, "/api/login", nil, `{"passphrase": "password"}`)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Login: got status %d, want %d", resp.Code, http.StatusNoContent)
+	}
+	cookie := resp.Result().Cookies()[0]
+	hdr := http.Header{csrfHeader: {resp.Header().Get(csrfHeader)}}
+
+	for _, test := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/api/p"},
+		{http.MethodGet, "/api/p/entry"},
+		{http.MethodPut, "/api/p/entry"},
+		{http.MethodDelete, "/api/p/entry"},
+	} {
+		resp := doAPIRequestWithHeader(h, test.method, test.path, cookie, `{"content": "x"}`, hdr)
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, resp.Code, http.StatusForbidden)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("%s %s: response was not a JSON error (%v): %q", test.method, test.path, err, resp.Body.String())
+		}
+	}
+}
+
+func TestAPICSRF(t *testing.T) {
+	t.Parallel()
+	h := newTestAPI(t)
+	resp := doAPIRequest(h, http.MethodPost, "/api/login", nil, `{"passphrase": "password"}`)
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Login: got status %d, want %d", resp.Code, http.StatusNoContent)
+	}
+	cookie := resp.Result().Cookies()[0]
+	token := resp.Header().Get(csrfHeader)
+	if token == "" {
+		t.Fatalf("Login response did not include a CSRF token")
+	}
+
+	for _, test := range []struct {
+		desc, method, path, token string
+		wantCSRFError             bool
+	}{
+		{"GET without token", http.MethodGet, "/api/p/entry", "", false},
+		{"PUT without token", http.MethodPut, "/api/p/entry", "", true},
+		{"PUT with wrong token", http.MethodPut, "/api/p/entry", "wrong", true},
+		{"PUT with token", http.MethodPut, "/api/p/entry", token, false},
+		{"DELETE without token", http.MethodDelete, "/api/p/entry", "", true},
+		{"DELETE with token", http.MethodDelete, "/api/p/entry", token, false},
+	} {
+		var hdr http.Header
+		if test.token != "" {
+			hdr = http.Header{csrfHeader: {test.token}}
+		}
+		resp := doAPIRequestWithHeader(h, test.method, test.path, cookie, `{"content": "x"}`, hdr)
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: response was not JSON (%v): %q", test.desc, err, resp.Body.String())
+			continue
+		}
+		// Requests passing the CSRF check are rejected for lack of MFA instead.
+		wantErr := "MFA required"
+		if test.wantCSRFError {
+			wantErr = "missing or mismatched CSRF token"
+		}
+		if resp.Code != http.StatusForbidden || !strings.HasPrefix(body.Error, wantErr) {
+			t.Errorf("%s: got (%d, %q), want (%d, %q...)", test.desc, resp.Code, body.Error, http.StatusForbidden, wantErr)
+		}
+	}
+
+	// Logging out requires the token, too.
+	if resp := doAPIRequest(h, http.MethodPost, "/api/logout", cookie, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("Logout without token: got status %d, want %d", resp.Code, http.StatusForbidden)
+	}
+}
+
+func TestAPIContentNegotiation(t *testing.T) {
+	t.Parallel()
+	h := newTestAPI(t)
+
+	// Responses must be acceptable as JSON.
+	req := httptest.NewRequest(http.MethodGet, "/api/p", nil)
+	req.Header.Set("Accept", "text/html")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotAcceptable {
+		t.Errorf("Non-JSON Accept header: got status %d, want %d", resp.Code, http.StatusNotAcceptable)
+	}
+
+	// Request bodies must be JSON.
+	req = httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader("pass=password"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Non-JSON request body: got status %d, want %d", resp.Code, http.StatusUnsupportedMediaType)
+	}
+	if got := resp.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Error response had Content-Type %q, want %q", got, "application/json")
+	}
+}
+
+func TestAPIConditionalPut(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_api_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ts, err := apitoken.NewStore(filepath.Join(dir, "tokens"))
+	if err != nil {
+		t.Fatalf("Could not create token store: %v", err)
+	}
+	s := &memStore{entries: map[string]string{"/entry": "content"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithAPITokens(ts))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	token, _, err := sess.CreateAPIToken("script", "password", nil, false)
+	if err != nil {
+		t.Fatalf("Could not create API token: %v", err)
+	}
+	h := newAPI(sh, nil, DefaultSessionCookie, DefaultEntryMaxSize, DefaultBodyMaxSize)
+	put := func(entry, content string, hdr http.Header) int {
+		t.Helper()
+		if hdr == nil {
+			hdr = http.Header{}
+		}
+		hdr.Set("Authorization", "Bearer "+token)
+		return doAPIRequestWithHeader(h, http.MethodPut, "/api/p"+entry, nil, fmt.Sprintf(`{"content": %q}`, content), hdr).Code
+	}
+
+	// Getting an entry gives its ETag.
+	resp := doAPIRequestWithHeader(h, http.MethodGet, "/api/p/entry", nil, "", http.Header{"Authorization": {"Bearer " + token}})
+	etag := resp.Header().Get("ETag")
+	if resp.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: got status %d & ETag %q, want %d & an ETag", resp.Code, etag, http.StatusOK)
+	}
+
+	for _, test := range []struct {
+		desc        string
+		entry       string
+		hdr         http.Header
+		wantCode    int
+		wantContent string
+	}{
+		{"stale If-Match", "/entry", http.Header{"If-Match": {`"` + secret.ContentHash("other") + `"`}}, http.StatusPreconditionFailed, "content"},
+		{"weak If-Match", "/entry", http.Header{"If-Match": {"W/" + etag}}, http.StatusBadRequest, "content"},
+		{"multiple If-Match", "/entry", http.Header{"If-Match": {etag + ", " + etag}}, http.StatusBadRequest, "content"},
+		{"If-None-Match of existing entry", "/entry", http.Header{"If-None-Match": {"*"}}, http.StatusPreconditionFailed, "content"},
+		{"current If-Match", "/entry", http.Header{"If-Match": {etag}}, http.StatusNoContent, "new content"},
+		{"reused If-Match", "/entry", http.Header{"If-Match": {etag}}, http.StatusPreconditionFailed, "new content"},
+		{"If-Match of missing entry", "/other", http.Header{"If-Match": {etag}}, http.StatusPreconditionFailed, ""},
+		{"If-None-Match of missing entry", "/other", http.Header{"If-None-Match": {"*"}}, http.StatusNoContent, "new content"},
+		{"unconditional", "/entry", nil, http.StatusNoContent, "new content"},
+	} {
+		if got := put(test.entry, "new content", test.hdr); got != test.wantCode {
+			t.Errorf("PUT with %s: got status %d, want %d", test.desc, got, test.wantCode)
+		}
+		if got, _ := s.Get(test.entry); got != test.wantContent {
+			t.Errorf("After PUT with %s, entry content was %q, want %q", test.desc, got, test.wantContent)
+		}
+	}
+}
+
+func newTestAPI(t *testing.T) http.Handler {
+	t.Helper()
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	return newAPI(sh, nil, DefaultSessionCookie, DefaultEntryMaxSize, DefaultBodyMaxSize)
+}
+
+func doAPIRequest(h http.Handler, method, path string, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+	return doAPIRequestWithHeader(h, method, path, cookie, body, nil)
+}
+
+func doAPIRequestWithHeader(h http.Handler, method, path string, cookie *http.Cookie, body string, hdr http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, vs := range hdr {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+// memVault is an in-memory secret.Vault, unlocked with the passphrase "password".
+type memVault struct{ s *memStore }
+
+func (v memVault) Unlock(passphrase string) (secret.Store, error) {
+	if passphrase != "password" {
+		return nil, secret.ErrWrongPassphrase
+	}
+	return v.s, nil
+}
+
+// memStore is an in-memory secret.Store.
+type memStore struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func (s *memStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []string
+	for e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+func (s *memStore) Get(entry string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.entries[entry]
+	if !ok {
+		return "", secret.ErrNoEntry
+	}
+	return content, nil
+}
+
+func (s *memStore) Put(entry, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry] = content
+	return nil
+}
+
+func (s *memStore) Delete(entry string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[entry]; !ok {
+		return secret.ErrNoEntry
+	}
+	delete(s.entries, entry)
+	return nil
+}
+
+func (s *memStore) Move(oldEntry, newEntry string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.entries[oldEntry]
+	if !ok {
+		return secret.ErrNoEntry
+	}
+	if _, ok := s.entries[newEntry]; ok {
+		return secret.ErrEntryExists
+	}
+	s.entries[newEntry] = content
+	delete(s.entries, oldEntry)
+	return nil
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret/audit"
+)
+
+var (
+	auditTmpl      = newTemplate("audit", "templates/audit.html", entryTmplFuncs)
+	auditReuseTmpl = newTemplate("audit-reuse", "templates/audit-reuse.html")
+)
+
+// auditHandler audits the passwords in the store, reporting breached and
+// reused passwords, as well as stale entries.
+type auditHandler struct {
+	checker    audit.PasswordChecker // may be nil, in which case breaches are not checked
+	staleAfter time.Duration         // how long after its last change an entry is stale; zero if entries are never stale
+}
+
+func newAudit(checker audit.PasswordChecker, staleAfter time.Duration) *auditHandler {
+	return &auditHandler{checker: checker, staleAfter: staleAfter}
+}
+
+func (auditHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (ah auditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Auditing decrypts every entry, which may take a while for large
+	// stores, so the page is streamed as the audit progresses.
+	tmpl, err := requestTemplate(r, auditTmpl)
+	if err != nil {
+		logf(r, "Could not load %q template: %v", auditTmpl.name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+	execute := func(name string, data interface{}) {
+		if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+			logf(r, "Could not execute %q template: %v", name, err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	execute("start", nil)
+	rpt, err := audit.Run(sessionFrom(r).GetStore(), ah.checker, func(done, total int) {
+		// Report progress roughly every percent.
+		if step := total / 100; step == 0 || done%step == 0 || done == total {
+			execute("progress", struct{ Done, Total int }{done, total})
+		}
+	})
+	if err != nil {
+		logf(r, "Could not audit store: %v", err)
+		execute("error", nil)
+	} else {
+		// Changes are ordered from least recently changed, so the stale entries come first.
+		var stale []audit.Change
+		now := time.Now()
+		for _, c := range rpt.Changes {
+			if !isStale(c.Time, now, ah.staleAfter) {
+				break
+			}
+			stale = append(stale, c)
+		}
+		execute("report", struct {
+			*audit.Report
+			CheckedBreaches bool
+			CheckedStale    bool
+			Stale           []audit.Change
+		}{rpt, ah.checker != nil, ah.staleAfter > 0, stale})
+	}
+	execute("end", nil)
+}
+
+// reuseHandler lists the groups of entries which share a password. Unlike
+// auditHandler, it uses the session's memoized index of passwords, so it is
+// quick to serve after the first request.
+type reuseHandler struct{}
+
+func newReuse() *reuseHandler { return &reuseHandler{} }
+
+func (reuseHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (reuseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	reused, err := audit.ReusedPasswords(sessionFrom(r).GetStore())
+	if err != nil {
+		logf(r, "Could not find reused passwords: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	serveTemplate(w, r, auditReuseTmpl, reused)
+}
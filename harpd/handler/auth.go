@@ -4,14 +4,14 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/e3b0c442/warp"
 
-	"github.com/BranLwyd/harpocrates/harpd/assets"
 	"github.com/BranLwyd/harpocrates/harpd/rate"
 	"github.com/BranLwyd/harpocrates/harpd/session"
 	"github.com/BranLwyd/harpocrates/secret"
@@ -20,22 +20,43 @@ import (
 type sessionContextKey struct{}
 
 const (
-	sessionCookieName = "harp-sid"
-
 	authAny = "#_ANY_#"
+
+	// authBrowse is like authAny, but is also satisfied by a trusted device
+	// (see session.WithTrustedDevices). It is used by pages which reveal only
+	// entry names, such as directory listings & search results.
+	authBrowse = "#_BROWSE_#"
+
+	// deviceLabelMaxLength limits the length of the label given to a trusted
+	// device, which is taken from the user agent of its browser.
+	deviceLabelMaxLength = 200
+
+	// How long a login waits for the vault to be unlocked before showing a
+	// page which waits for the unlock to complete, & how often that page
+	// checks whether it has.
+	pendingLoginWait    = time.Second
+	pendingLoginRefresh = 1 // seconds
 )
 
 var (
-	loginPasswordHandler = must(newAsset("harpd/assets/pages/login-password.html", "text/html; charset=utf-8"))
-	loginMFAAuthTmpl     = template.Must(template.New("mfa-authenticate").Parse(string(assets.MustAsset("harpd/assets/templates/mfa-authenticate.html"))))
+	loginPasswordTmpl = newTemplate("login-password", "pages/login-password.html")
+	loginPendingTmpl  = newTemplate("login-pending", "templates/login-pending.html")
+	loginMFAAuthTmpl  = newTemplate("mfa-authenticate", "templates/mfa-authenticate.html")
 )
 
 // authHandler handles getting an authenticated session for the user session.
 // If the user is already logged in, it adds the authenticated session to the
 // request context and runs a wrapped handler.
 type authHandler struct {
-	ahh authenticatedHTTPHandler
-	sh  *session.Handler
+	ahh          authenticatedHTTPHandler
+	sh           *session.Handler
+	cookie       SessionCookie
+	deviceCookie SessionCookie // holds the token of a trusted device
+	bodyMaxSize  int64         // see bodyLimiter
+
+	readOnly        bool   // whether sessions are made read-only; see Listener.ReadOnly
+	mfaEveryRequest bool   // whether each request needs a new MFA assertion; see Listener.MFAEveryRequest
+	origin          string // origin at which sessions perform MFA; see Listener.Origin
 }
 
 type authenticatedHTTPHandler interface {
@@ -45,16 +66,37 @@ type authenticatedHTTPHandler interface {
 	http.Handler
 
 	// authPath returns the path that should be multi-factor authenticated for this request. It can
-	// also return the empty string if no MFA is required, or authAny if MFA of any path is sufficient
-	// to allow access to this page. A session.Session is guaranteed to be available from the passed
-	// http.Request.
+	// also return the empty string if no MFA is required, authAny if MFA of any path is sufficient
+	// to allow access to this page, or authBrowse if a trusted device is also sufficient. A
+	// session.Session is guaranteed to be available from the passed http.Request.
 	authPath(*http.Request) (string, error)
 }
 
-func newAuth(sh *session.Handler, ahh authenticatedHTTPHandler) *authHandler {
+// sessionExtender may optionally be implemented by an authenticatedHTTPHandler
+// to control whether a request extends the lifetime of the user's session. By
+// default, every request does.
+type sessionExtender interface {
+	extendsSession(*http.Request) bool
+}
+
+// bodyLimiter may optionally be implemented by an authenticatedHTTPHandler
+// which accepts request bodies larger than those accepted by the login &
+// multi-factor authentication flows. Requests from users without a session
+// are always limited to the smaller size, since the limit is chosen before
+// the body is read.
+type bodyLimiter interface {
+	// bodyMaxSize returns the maximum size of request bodies, given the
+	// maximum size of the bodies of other requests.
+	bodyMaxSize(base int64) int64
+}
+
+func newAuth(sh *session.Handler, cookie SessionCookie, ahh authenticatedHTTPHandler) *authHandler {
 	return &authHandler{
-		ahh: ahh,
-		sh:  sh,
+		ahh:          ahh,
+		sh:           sh,
+		cookie:       cookie,
+		deviceCookie: cookie.device(),
+		bodyMaxSize:  DefaultBodyMaxSize,
 	}
 }
 
@@ -64,28 +106,56 @@ func (lh authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Try to get an existing session with the session ID from the user's
 	// cookie; if it doesn't exist, start the password login flow.
-	sid, err := sessionIDFromRequest(r)
+	sid, err := lh.cookie.sessionID(r)
 	if err != nil {
-		log.Printf("Could not get session ID: %v", err)
+		logf(r, "Could not get session ID: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	sess, err := lh.sh.GetSession(sid)
+	sess, err := lh.sh.LookupSessionFor(sid, clientIP(r), r.UserAgent())
+	if err == nil && lh.extendsSession(r) {
+		err = sess.Touch()
+	}
 	if err != nil && err != session.ErrNoSession {
-		log.Printf("Could not get session: %v", err)
+		logf(r, "Could not get session: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	if sess == nil {
-		lh.servePasswordHTTP(w, r)
+	if errors.Is(err, session.ErrNoSession) {
+		limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { lh.servePasswordHTTP(w, r, sid) }), lh.bodyMaxSize).ServeHTTP(w, r)
 		return
 	}
+	if lh.readOnly {
+		sess.MakeReadOnly()
+	}
+	if lh.origin != "" {
+		if err := sess.SetOrigin(lh.origin); err != nil {
+			logf(r, "Could not set session's MFA origin: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
 	r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess))
+	n := lh.bodyMaxSize
+	if bl, ok := lh.ahh.(bodyLimiter); ok {
+		n = bl.bodyMaxSize(n)
+	}
+	limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { lh.serveSessionHTTP(w, r, sess) }), n).ServeHTTP(w, r)
+}
+
+// serveSessionHTTP serves a request from a user with a session, after their
+// password has been authenticated.
+func (lh authHandler) serveSessionHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	// The user has a session. Requests which may change state must come from a page served for this session.
+	if !checkCSRF(r, sess) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 
-	// The user has a session. If this page needs additional multi-factor authentication, prompt for it.
+	// If this page needs additional multi-factor authentication, prompt for it.
 	ap, err := lh.mfaPath(r, sess)
 	if err != nil {
-		log.Printf("Could not determine multi-factor authentication path: %v", err)
+		logf(r, "Could not determine multi-factor authentication path: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -99,46 +169,191 @@ func (lh authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lh.ahh.ServeHTTP(w, r)
 }
 
-func (lh authHandler) servePasswordHTTP(w http.ResponseWriter, r *http.Request) {
+func (lh authHandler) extendsSession(r *http.Request) bool {
+	if se, ok := lh.ahh.(sessionExtender); ok {
+		return se.extendsSession(r)
+	}
+	return true
+}
+
+func (lh authHandler) servePasswordHTTP(w http.ResponseWriter, r *http.Request, sid string) {
 	switch r.Method {
 	case http.MethodGet:
-		w.Header().Add("Link", "</font-awesome.otf>; rel=prefetch")
-		loginPasswordHandler.ServeHTTP(w, r)
+		// If the user's session is still being created, wait for it.
+		if p, err := lh.sh.LookupPendingSessionFor(sid, clientIP(r), r.UserAgent()); err == nil {
+			lh.servePendingHTTP(w, r, p)
+			return
+		}
+		w.Header().Add("Link", fmt.Sprintf("<%s/font-awesome.otf>; rel=prefetch", basePath(r)))
+		serveTemplate(w, r, loginPasswordTmpl, struct {
+			MultiUser    bool
+			Passwordless string
+		}{lh.sh.MultiUser(), lh.passwordlessChallenge(r)})
 
 	case http.MethodPost:
+		if r.FormValue("action") == "passwordless-login" && lh.sh.PasswordlessEnabled() {
+			lh.servePasswordlessLoginHTTP(w, r)
+			return
+		}
 		if r.FormValue("action") != "login" {
 			// User's session probably timed out. Forward to get standard login flow.
-			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			redirect(w, r, r.URL.RequestURI())
 			return
 		}
-		sid, _, err := lh.sh.CreateSession(clientIP(r), r.FormValue("pass"))
-		if err == secret.ErrWrongPassphrase {
-			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		// The vault is unlocked in the background, since slow key derivation could otherwise
+		// hold this request past the server's timeouts. The redirect leads to the session once
+		// it has been created, or to a page which waits for it.
+		// Clients able to supply an external secret, e.g. from an MFA device's hmac-secret
+		// extension, send it base64-encoded.
+		extra, err := base64.StdEncoding.DecodeString(r.FormValue("external-secret"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		if err == rate.ErrTooManyEvents {
+		sid, p, err := lh.sh.CreateUserSessionAsyncWith(clientIP(r), r.UserAgent(), r.FormValue("user"), r.FormValue("pass"), extra)
+		if errors.Is(err, rate.ErrTooManyEvents) {
 			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
 		if err != nil {
-			log.Printf("Could not create session: %v", err)
+			logf(r, "Could not create session: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		addSessionIDToRequest(w, sid)
-		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		lh.cookie.set(w, sid)
+		select {
+		case <-p.Done():
+		case <-time.After(pendingLoginWait):
+		}
+		redirect(w, r, r.URL.RequestURI())
 
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
+// passwordlessChallenge returns a passwordless login challenge, as JSON, for
+// the login page to offer passwordless login. It returns the empty string if
+// passwordless login is not enabled or a challenge can't be generated, in
+// which case the login page offers only the passphrase.
+func (lh authHandler) passwordlessChallenge(r *http.Request) string {
+	if !lh.sh.PasswordlessEnabled() {
+		return ""
+	}
+	c, err := lh.sh.GeneratePasswordlessChallenge()
+	if err != nil {
+		logf(r, "Could not create passwordless challenge: %v", err)
+		return ""
+	}
+	cBytes, err := json.Marshal(c)
+	if err != nil {
+		logf(r, "Could not marshal passwordless challenge: %v", err)
+		return ""
+	}
+	return string(cBytes)
+}
+
+// servePasswordlessLoginHTTP logs in with an MFA device in place of the
+// passphrase, as servePasswordHTTP logs in with the passphrase.
+func (lh authHandler) servePasswordlessLoginHTTP(w http.ResponseWriter, r *http.Request) {
+	cred := &warp.AssertionPublicKeyCredential{}
+	if err := json.Unmarshal([]byte(r.FormValue("response")), cred); err != nil {
+		logf(r, "Could not parse passwordless response: %v", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	prf, err := base64.StdEncoding.DecodeString(r.FormValue("prf"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	sid, p, err := lh.sh.CreatePasswordlessSessionAsync(clientIP(r), r.UserAgent(), lh.origin, cred, prf)
+	switch {
+	case errors.Is(err, rate.ErrTooManyEvents):
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, session.ErrMFACounterRegression):
+		logf(r, "MFA signature counter regression; device may be cloned")
+		redirect(w, r, r.URL.RequestURI())
+		return
+	case errors.Is(err, session.ErrMFAAuthenticationFailed), errors.Is(err, session.ErrNoChallenge):
+		// As for a wrong passphrase, the redirect leads back to the login page.
+		redirect(w, r, r.URL.RequestURI())
+		return
+	case err != nil:
+		logf(r, "Could not create session: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	lh.cookie.set(w, sid)
+	select {
+	case <-p.Done():
+	case <-time.After(pendingLoginWait):
+	}
+	redirect(w, r, r.URL.RequestURI())
+}
+
+// servePendingHTTP serves a page which waits for a pending session to be
+// created, refreshing until it has been. Once it has, the user is redirected
+// to the requested page, or back to the login page if the session could not be
+// created.
+func (lh authHandler) servePendingHTTP(w http.ResponseWriter, r *http.Request, p *session.PendingSession) {
+	select {
+	case <-p.Done():
+	default:
+		progress, ok := p.Progress()
+		w.Header().Set("Refresh", strconv.Itoa(pendingLoginRefresh))
+		serveTemplate(w, r, loginPendingTmpl, struct {
+			Percent     int
+			HasProgress bool
+		}{int(100 * progress), ok})
+		return
+	}
+
+	_, err := p.Result()
+	if errors.Is(err, session.ErrTooManySessions) {
+		http.Error(w, "Too many sessions are active; try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil && !errors.Is(err, secret.ErrWrongPassphrase) {
+		logf(r, "Could not create session: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	redirect(w, r, r.URL.RequestURI())
+}
+
+// mfaPath returns the path for which the request needs multi-factor
+// authentication, or the empty string if it needs none. If each request needs
+// a new assertion, a request found to need none has used up the session's
+// authentication.
 func (lh authHandler) mfaPath(r *http.Request, sess *session.Session) (string, error) {
 	ap, err := lh.ahh.authPath(r)
 	if err != nil {
 		return "", fmt.Errorf("couldn't get authentication path: %w", err)
 	}
 
+	if lh.mfaEveryRequest && ap != "" {
+		// Trusted devices don't suffice, and the authentication is used up
+		// by this request.
+		if ap == authBrowse {
+			ap = authAny
+		}
+		path := ap
+		if path == authAny {
+			path = ""
+		}
+		if sess.TakeMFAAuthentication(path) {
+			return "", nil
+		}
+		return ap, nil
+	}
+	if ap == authBrowse {
+		if sess.IsMFAAuthenticated() || sess.IsTrustedDevice(lh.deviceCookie.value(r)) {
+			return "", nil
+		}
+		ap = authAny
+	}
 	if ap == authAny && sess.IsMFAAuthenticated() {
 		return "", nil
 	}
@@ -153,77 +368,82 @@ func (lh authHandler) serveMFAHTTP(w http.ResponseWriter, r *http.Request, sess
 	case http.MethodGet:
 		// If the user has no MFA device registrations, send them to where they can register an MFA device.
 		if !sess.HasRegisteredMFADevice() {
-			http.Redirect(w, r, "/register", http.StatusSeeOther)
+			redirect(w, r, "/register")
 			return
 		}
 
 		c, err := sess.GenerateMFAChallenge(authPath)
 		if err != nil {
-			log.Printf("Could not create MFA challenge: %v", err)
+			logf(r, "Could not create MFA challenge: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 		cBytes, err := json.Marshal(c)
 		if err != nil {
-			log.Printf("Could not marshal MFA challenge: %v", err)
+			logf(r, "Could not marshal MFA challenge: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		serveTemplate(w, r, loginMFAAuthTmpl, string(cBytes))
+		var rememberDays int
+		if authPath == authAny && !lh.mfaEveryRequest {
+			// Devices are only useful for pages which accept authAny.
+			rememberDays = int(lh.sh.TrustedDeviceLifetime() / (24 * time.Hour))
+		}
+		serveTemplate(w, r, loginMFAAuthTmpl, struct {
+			Challenge    string
+			RememberDays int
+		}{string(cBytes), rememberDays})
 
 	case http.MethodPost:
 		if r.FormValue("action") != "mfa-auth" {
-			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			redirect(w, r, r.URL.RequestURI())
 			return
 		}
 		cred := &warp.AssertionPublicKeyCredential{}
 		if err := json.Unmarshal([]byte(r.FormValue("response")), &cred); err != nil {
-			log.Printf("Could not parse MFA response: %v", err)
+			logf(r, "Could not parse MFA response: %v", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		if err := sess.AuthenticateMFAResponse(authPath, cred); err != nil && err != session.ErrMFAAuthenticationFailed {
-			log.Printf("Could not authenticate MFA response: %v", err)
+		switch sid, err := sess.AuthenticateMFAResponse(authPath, cred); {
+		case err == nil:
+			lh.cookie.set(w, sid)
+			if r.FormValue("remember") != "" && lh.sh.TrustedDevicesEnabled() && !lh.mfaEveryRequest {
+				lh.trustDevice(w, r, sess)
+			}
+		case errors.Is(err, session.ErrMFAAuthenticationFailed):
+		case errors.Is(err, session.ErrMFACounterRegression):
+			logf(r, "MFA signature counter regression; device may be cloned")
+		case errors.Is(err, session.ErrNoSession):
+			// Too many failed assertions closed the session; the redirect
+			// leads back to the passphrase login.
+			logf(r, "Session closed after too many failed MFA assertions")
+		default:
+			logf(r, "Could not authenticate MFA response: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		redirect(w, r, r.URL.RequestURI())
 
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
-func addSessionIDToRequest(w http.ResponseWriter, sid string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
-		Value:    base64.RawURLEncoding.EncodeToString([]byte(sid)),
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-	})
-}
-
-func sessionIDFromRequest(r *http.Request) (string, error) {
-	c, err := r.Cookie(sessionCookieName)
-	if err != nil {
-		if err == http.ErrNoCookie {
-			return "", nil
-		} else {
-			return "", fmt.Errorf("couldn't get cookie: %w", err)
-		}
+// trustDevice trusts the user's browser, which has just completed multi-factor
+// authentication, setting a cookie holding the device's token. Failure to
+// trust the device is logged, but does not fail the request.
+func (lh authHandler) trustDevice(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	label := r.UserAgent()
+	if len(label) > deviceLabelMaxLength {
+		label = label[:deviceLabelMaxLength]
 	}
-
-	sid, err := base64.RawURLEncoding.DecodeString(c.Value)
+	tok, _, err := sess.TrustDevice(label)
 	if err != nil {
-		if _, ok := err.(base64.CorruptInputError); ok {
-			return "", nil
-		} else {
-			return "", fmt.Errorf("couldn't decode cookie value: %w", err)
-		}
+		logf(r, "Could not trust device: %v", err)
+		return
 	}
-	return string(sid), nil
+	http.SetCookie(w, lh.deviceCookie.cookie(tok, int(lh.sh.TrustedDeviceLifetime()/time.Second)))
 }
 
 func sessionFrom(r *http.Request) *session.Session {
@@ -2,38 +2,428 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/BranLwyd/harpocrates/harpd/accesslog"
+	"github.com/BranLwyd/harpocrates/harpd/authlog"
+	"github.com/BranLwyd/harpocrates/harpd/metrics"
 	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret/audit"
 )
 
-var (
-	contentStyleHandler           = must(newCacheableAsset("harpd/assets/etc/style.css", "text/css; charset=utf-8"))
-	contentRobotsHandler          = must(newCacheableAsset("harpd/assets/etc/robots.txt", "text/plain; charset=utf-8"))
-	contentFaviconHandler         = must(newCacheableAsset("harpd/assets/etc/favicon.ico", "image/x-icon"))
-	contentMFARegisterHandler     = must(newCacheableAsset("harpd/assets/etc/mfa-register.js", "application/javascript"))
-	contentMFAAuthenticateHandler = must(newCacheableAsset("harpd/assets/etc/mfa-authenticate.js", "application/javascript"))
-	contentEntryViewHandler       = must(newCacheableAsset("harpd/assets/etc/entry-view.js", "application/javascript"))
-	contentFontAwesomeHandler     = must(newCacheableAsset("harpd/assets/etc/font-awesome.otf", "application/font-sfnt"))
-)
+// contentAssets are the static assets served by NewContent, by path.
+//
+// The web app manifest & service worker allow harpocrates to be installed as
+// an app. The service worker caches only these assets, never pages served
+// to authenticated users; it must be served from the root so that its scope
+// covers the whole site.
+var contentAssets = map[string]*cacheableStaticHandler{
+	"/style.css":                  mustCacheableAsset("etc/style.css", "text/css; charset=utf-8"),
+	"/style-dark.css":             mustCacheableAsset("etc/style-dark.css", "text/css; charset=utf-8"),
+	"/robots.txt":                 mustCacheableAsset("etc/robots.txt", "text/plain; charset=utf-8"),
+	"/favicon.ico":                mustCacheableAsset("etc/favicon.ico", "image/x-icon"),
+	"/icon.svg":                   mustCacheableAsset("etc/icon.svg", "image/svg+xml"),
+	"/manifest.webmanifest":       mustCacheableAsset("etc/manifest.webmanifest", "application/manifest+json"),
+	"/service-worker.js":          mustCacheableAsset("etc/service-worker.js", "application/javascript"),
+	"/register-service-worker.js": mustCacheableAsset("etc/register-service-worker.js", "application/javascript"),
+	"/mfa-register.js":            mustCacheableAsset("etc/mfa-register.js", "application/javascript"),
+	"/mfa-authenticate.js":        mustCacheableAsset("etc/mfa-authenticate.js", "application/javascript"),
+	"/passwordless.js":            mustCacheableAsset("etc/passwordless.js", "application/javascript"),
+	"/passwordless-login.js":      mustCacheableAsset("etc/passwordless-login.js", "application/javascript"),
+	"/entry-view.js":              mustCacheableAsset("etc/entry-view.js", "application/javascript"),
+	"/directory-previews.js":      mustCacheableAsset("etc/directory-previews.js", "application/javascript"),
+	"/font-awesome.otf":           mustCacheableAsset("etc/font-awesome.otf", "application/font-sfnt"),
+}
+
+// DefaultAttachmentMaxSize is the default maximum size of an attachment
+// uploaded to an entry, in bytes.
+const DefaultAttachmentMaxSize = 1 << 20
+
+// DefaultBodyMaxSize is the default maximum size of a request body, in bytes,
+// for requests other than those updating entries or uploading attachments.
+const DefaultBodyMaxSize = 64 << 10
+
+// DefaultEntryMaxSize is the default maximum size of an entry's content, in
+// bytes.
+const DefaultEntryMaxSize = 64 << 10
 
-func NewContent(sh *session.Handler) http.Handler {
+// DefaultExpiryWindow is the default window within which an entry must expire
+// to be listed on the root directory view.
+const DefaultExpiryWindow = 30 * 24 * time.Hour
+
+// Option configures optional behavior of the handler created by NewContent.
+type Option func(*contentParams)
+
+// contentParams holds optional parameters used when creating the handler.
+type contentParams struct {
+	reg         *metrics.Registry
+	checker     audit.PasswordChecker
+	al          *accesslog.Log
+	authLog     *authlog.Log
+	dirPageSize int
+	cookie      SessionCookie
+	basePath    string
+	resolver    *resolver
+
+	attachmentMaxSize int64
+	entryMaxSize      int
+	bodyMaxSize       int64
+	confirmWrites     bool
+	fieldsOnly        bool
+	noPreviews        bool
+	expiryWindow      time.Duration
+	staleAfter        time.Duration
+	prefsKey          []byte
+	readinessChecks   map[string]ReadinessCheck
+	listener          *Listener
+}
+
+// WithMetrics causes the metrics in the given registry to be served at
+// /metrics to authenticated users.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(p *contentParams) {
+		p.reg = reg
+	}
+}
+
+// WithPasswordChecker causes the given checker to be used to check for
+// breached passwords when auditing the store.
+func WithPasswordChecker(checker audit.PasswordChecker) Option {
+	return func(p *contentParams) {
+		p.checker = checker
+	}
+}
+
+// WithAccessLog causes accesses to entries to be recorded in the given log,
+// and shown when viewing entries.
+func WithAccessLog(al *accesslog.Log) Option {
+	return func(p *contentParams) {
+		p.al = al
+	}
+}
+
+// WithAuthLog causes the login attempts recorded in the given log to be shown
+// at /status to authenticated users.
+func WithAuthLog(l *authlog.Log) Option {
+	return func(p *contentParams) {
+		p.authLog = l
+	}
+}
+
+// WithDirectoryPageSize causes directory views to be split into pages of at
+// most n entries & subdirectories each. By default, directory views are not
+// paginated.
+func WithDirectoryPageSize(n int) Option {
+	return func(p *contentParams) {
+		p.dirPageSize = n
+	}
+}
+
+// WithAttachmentMaxSize limits the size of attachments uploaded to entries to
+// n bytes. By default, attachments may be at most DefaultAttachmentMaxSize.
+func WithAttachmentMaxSize(n int64) Option {
+	return func(p *contentParams) {
+		p.attachmentMaxSize = n
+	}
+}
+
+// WithEntryMaxSize limits the size of entry content written via the web
+// interface or API to n bytes. By default, entries may be at most
+// DefaultEntryMaxSize.
+func WithEntryMaxSize(n int) Option {
+	return func(p *contentParams) {
+		p.entryMaxSize = n
+	}
+}
+
+// WithBodyMaxSize limits the size of request bodies to n bytes, except for
+// requests updating entries or uploading attachments, whose bodies may be
+// larger by the maximum size of an entry (as encoded) or attachment. Larger
+// bodies are refused with a 413 status. By default, bodies may be at most
+// DefaultBodyMaxSize.
+func WithBodyMaxSize(n int64) Option {
+	return func(p *contentParams) {
+		p.bodyMaxSize = n
+	}
+}
+
+// entryBodyMaxSize returns the maximum size of the body of a request updating
+// an entry, given the maximum size of other request bodies. Entry content may
+// grow up to six-fold when encoded, e.g. as JSON "\u00XX" escapes.
+func entryBodyMaxSize(base int64, entryMaxSize int) int64 {
+	return base + 6*int64(entryMaxSize)
+}
+
+// WithConfirmWrites causes updates to entries made via the web interface to
+// take two steps: the changes to be made are shown, and must be confirmed
+// before they are saved. By default, updates are saved immediately.
+func WithConfirmWrites() Option {
+	return func(p *contentParams) {
+		p.confirmWrites = true
+	}
+}
+
+// WithFieldsOnly causes entry views to mask secret fields, such as the
+// password, rather than including the entry's content in the page. A masked
+// field's value is fetched from the server only when it is copied or shown,
+// so that it is not left in the page for as long as the page is open. The
+// full content is still included when the entry is edited.
+func WithFieldsOnly() Option {
+	return func(p *contentParams) {
+		p.fieldsOnly = true
+	}
+}
+
+// WithoutEntryPreviews prevents directory views from offering previews of
+// their entries. By default, a directory view may show the second line of each
+// entry (e.g. its username), with the first line masked, once multi-factor
+// authentication is completed for the directory.
+func WithoutEntryPreviews() Option {
+	return func(p *contentParams) {
+		p.noPreviews = true
+	}
+}
+
+// WithExpiryWindow causes entries which have expired, or will expire within d,
+// to be listed on the root directory view. By default, the window is
+// DefaultExpiryWindow. Entries give their expiration date with an `expires:`
+// field.
+func WithExpiryWindow(d time.Duration) Option {
+	return func(p *contentParams) {
+		p.expiryWindow = d
+	}
+}
+
+// WithStaleAfter causes entries which have not been changed for at least d to
+// be marked stale in entry & directory views, and listed on the audit page. An
+// entry was last changed at the time given by its `changed:` field, or
+// otherwise when the file holding it was last modified. Once staleness is
+// tracked, the `changed:` field is maintained whenever an entry's content is
+// changed via the web interface. By default, entries are never marked stale.
+func WithStaleAfter(d time.Duration) Option {
+	return func(p *contentParams) {
+		p.staleAfter = d
+	}
+}
+
+// WithSessionCookie causes the given configuration to be used for the session
+// cookie, rather than DefaultSessionCookie.
+func WithSessionCookie(sc SessionCookie) Option {
+	return func(p *contentParams) {
+		p.cookie = sc
+	}
+}
+
+// WithPrefsKey causes the given key to be used to sign the cookie holding
+// each browser's display preferences (see the /prefs page). If no key is
+// specified, a random key is generated, so preferences are reset whenever
+// harpd restarts.
+func WithPrefsKey(key []byte) Option {
+	return func(p *contentParams) {
+		p.prefsKey = key
+	}
+}
+
+// WithBasePath causes the handler to be served under the given URL path
+// prefix, e.g. "/vault" when a reverse proxy forwards requests for /vault/ to
+// harpd. Requests for paths outside of the base path are not found. Links,
+// redirects & the session cookie's path all include the base path; see
+// SessionCookie.under. The base path must begin, but not end, with a slash.
+func WithBasePath(basePath string) Option {
+	return func(p *contentParams) {
+		p.basePath = basePath
+	}
+}
+
+// WithAssetOverrides causes templates & static assets to be served from files
+// in the given directory, when present, in preference to the embedded assets.
+// Files are named by their path under harpd/assets, e.g.
+// "templates/entry-view.html" or "etc/style.css". If reload is set, overrides
+// are re-read & re-parsed on every request, which is useful when developing
+// templates; otherwise they are cached until their modification time or size
+// changes. A broken override causes requests using it to fail, rather than
+// falling back to the embedded asset.
+func WithAssetOverrides(dir string, reload bool) Option {
+	return func(p *contentParams) {
+		p.resolver = newResolver(dir, reload)
+	}
+}
+
+// Listener describes one of several listeners serving harpd with the same
+// session handler, each with a handler created by NewContent (see
+// WithListener).
+type Listener struct {
+	// Name identifies the listener; it is empty for the main listener.
+	Name string
+
+	// ReadOnly causes the listener's sessions to be read-only (see
+	// session.Session.MakeReadOnly). Only the pages needed to read entries
+	// are served: the API, and the pages managing MFA devices, sessions, API
+	// tokens & passwordless login, are not.
+	ReadOnly bool
+
+	// MFAEveryRequest causes every request which needs multi-factor
+	// authentication to need a new assertion: authentication is never
+	// remembered, even for the request following it, and devices can't be
+	// trusted.
+	MFAEveryRequest bool
+
+	// Insecure indicates that the listener serves plain HTTP, so that its
+	// session cookie can't be Secure.
+	Insecure bool
+
+	// Origin is the origin at which browsers reach the listener, at which
+	// its sessions perform MFA. It must have been passed to
+	// session.WithOrigins. If empty, MFA is performed at the session
+	// handler's origin.
+	Origin string
+}
+
+// readOnlyListenerPages are the pages served by a read-only listener; see
+// Listener.ReadOnly.
+var readOnlyListenerPages = map[string]bool{
+	"/":            true,
+	"/audit":       true,
+	"/audit/reuse": true,
+	"/keepalive":   true,
+	"/lock":        true,
+	"/logout":      true,
+	"/prefs":       true,
+	"/search":      true,
+	"/share/":      true,
+	"/stats":       true,
+	"/strength":    true,
+}
+
+// WithListener causes the handler to serve the given listener. Sessions are
+// partitioned between listeners: each listener's session cookie has its own
+// name, and its value is authenticated with a key unique to the listener, so
+// that a session created via one listener can't be used via another. If any
+// handler serving a session handler is created with WithListener, all must be.
+func WithListener(l Listener) Option {
+	return func(p *contentParams) {
+		p.listener = &l
+	}
+}
+
+// ValidateBasePath checks that the given base path is usable with
+// WithBasePath. The empty string, meaning the root, is valid.
+func ValidateBasePath(basePath string) error {
+	if basePath == "" {
+		return nil
+	}
+	if !strings.HasPrefix(basePath, "/") || strings.HasSuffix(basePath, "/") {
+		return fmt.Errorf("base path %q must begin, but not end, with \"/\"", basePath)
+	}
+	if path.Clean(basePath) != basePath {
+		return fmt.Errorf("base path %q is not clean", basePath)
+	}
+	return nil
+}
+
+// NewContent creates the main harpocrates HTTP handler.
+func NewContent(sh *session.Handler, opts ...Option) http.Handler {
+	p := contentParams{cookie: DefaultSessionCookie, attachmentMaxSize: DefaultAttachmentMaxSize, entryMaxSize: DefaultEntryMaxSize, bodyMaxSize: DefaultBodyMaxSize, expiryWindow: DefaultExpiryWindow}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	p.cookie = p.cookie.under(p.basePath)
+	var l Listener
+	if p.listener != nil {
+		l = *p.listener
+		p.cookie = p.cookie.partition(l, newCookieKey())
+	}
+	if p.prefsKey == nil {
+		p.prefsKey = newPrefsKey()
+	}
+	ps, pc := prefsSigner{p.prefsKey}, prefsCookie.under(p.basePath)
 	mux := http.NewServeMux()
 
 	// Static content handlers.
-	mux.Handle("/style.css", contentStyleHandler)
-	mux.Handle("/robots.txt", contentRobotsHandler)
-	mux.Handle("/favicon.ico", contentFaviconHandler)
-	mux.Handle("/mfa-register.js", contentMFARegisterHandler)
-	mux.Handle("/mfa-authenticate.js", contentMFAAuthenticateHandler)
-	mux.Handle("/entry-view.js", contentEntryViewHandler)
-	mux.Handle("/font-awesome.otf", contentFontAwesomeHandler)
-
-	// Dynamic content handlers.
-	mux.Handle("/logout", newLogout(sh))
-	mux.Handle("/register", newAuth(sh, newRegister()))
-	mux.Handle("/search", newAuth(sh, newSearch()))
-	mux.Handle("/", newAuth(sh, newPassword()))
-
-	return mux
+	for ap, h := range contentAssets {
+		if p.resolver != nil {
+			mux.Handle(ap, p.resolver.assetHandler(ap))
+		} else {
+			mux.Handle(ap, h)
+		}
+	}
+
+	// Health & readiness probes, which do not require authentication.
+	checks := map[string]ReadinessCheck{"assets": checkAssets(p.resolver)}
+	for name, check := range p.readinessChecks {
+		checks[name] = check
+	}
+	mux.Handle("/healthz", newHealth())
+	mux.Handle("/readyz", newReady(checks))
+
+	// Dynamic content handlers. Handlers requiring authentication limit
+	// request bodies once they know whether the user has a session; others
+	// are limited here. Read-only listeners serve only some of them.
+	auth := func(ahh authenticatedHTTPHandler) http.Handler {
+		ah := newAuth(sh, p.cookie, ahh)
+		ah.bodyMaxSize = p.bodyMaxSize
+		ah.readOnly = l.ReadOnly
+		ah.mfaEveryRequest = l.MFAEveryRequest
+		ah.origin = l.Origin
+		return ah
+	}
+	pages := listenerMux{mux, l.ReadOnly}
+	pages.Handle("/api/", newAPI(sh, p.al, p.cookie, p.entryMaxSize, p.bodyMaxSize))
+	pages.Handle("/audit", auth(newAudit(p.checker, p.staleAfter)))
+	pages.Handle("/audit/reuse", auth(newReuse()))
+	pages.Handle("/generate", auth(newGenerate()))
+	pages.Handle("/keepalive", auth(newKeepalive()))
+	pages.Handle("/strength", auth(newStrength()))
+	pages.Handle("/logout", limitBody(newLogout(sh, p.cookie), p.bodyMaxSize))
+	pages.Handle("/logout-all", auth(newLogoutAll(sh, p.cookie)))
+	if sh.SoftLockEnabled() {
+		pages.Handle("/lock", limitBody(newLock(sh, p.cookie), p.bodyMaxSize))
+	}
+	if p.reg != nil {
+		pages.Handle("/metrics", auth(newMetrics(p.reg)))
+	}
+	if sh.PasswordlessEnabled() {
+		pages.Handle("/passwordless", auth(newPasswordless(sh)))
+	}
+	pages.Handle("/prefs", limitBody(newPrefs(ps, pc), p.bodyMaxSize))
+	pages.Handle("/register", auth(newRegister(sh)))
+	pages.Handle("/search", auth(newSearch()))
+	pages.Handle("/sessions", auth(newSessions(sh, p.cookie)))
+	pages.Handle("/stats", auth(newStats()))
+	pages.Handle("/share/", limitBody(newShare(sh), p.bodyMaxSize))
+	if p.authLog != nil {
+		pages.Handle("/status", auth(newStatus(p.authLog)))
+	}
+	if sh.APITokensEnabled() {
+		pages.Handle("/tokens", auth(newTokens(sh)))
+	}
+	pages.Handle("/", auth(newPassword(p.al, p.dirPageSize, p.attachmentMaxSize, p.entryMaxSize, p.confirmWrites, p.expiryWindow, p.fieldsOnly, !p.noPreviews, p.staleAfter)))
+
+	var h http.Handler = prefsContextHandler{ps, pc, mux}
+	if p.resolver != nil {
+		h = resolverHandler{p.resolver, h}
+	}
+	if p.basePath != "" {
+		return newBasePath(p.basePath, h)
+	}
+	return h
+}
+
+// listenerMux registers the pages served by a listener. Pages not served by a
+// read-only listener (see Listener.ReadOnly) are not found, rather than being
+// taken for entries.
+type listenerMux struct {
+	*http.ServeMux
+	readOnly bool
+}
+
+func (lm listenerMux) Handle(pattern string, h http.Handler) {
+	if lm.readOnly && !readOnlyListenerPages[pattern] {
+		h = http.NotFoundHandler()
+	}
+	lm.ServeMux.Handle(pattern, h)
 }
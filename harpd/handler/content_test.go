@@ -0,0 +1,501 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/csp"
+	"github.com/BranLwyd/harpocrates/harpd/device"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestAppAssets(t *testing.T) {
+	t.Parallel()
+	h := NewSecureHeader(csp.Default(), newTestContent(t))
+
+	for _, test := range []struct {
+		path, wantContentType string
+	}{
+		{"/manifest.webmanifest", "application/manifest+json"},
+		{"/service-worker.js", "application/javascript"},
+		{"/register-service-worker.js", "application/javascript"},
+		{"/icon.svg", "image/svg+xml"},
+	} {
+		resp := doAssetRequest(h, test.path, nil)
+		if resp.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", test.path, resp.Code, http.StatusOK)
+			continue
+		}
+		if got := resp.Header().Get("Content-Type"); got != test.wantContentType {
+			t.Errorf("GET %s: got Content-Type %q, want %q", test.path, got, test.wantContentType)
+		}
+		if got := resp.Header().Get("Content-Security-Policy"); !strings.Contains(got, "worker-src 'self'") {
+			t.Errorf("GET %s: got Content-Security-Policy %q, want worker-src 'self'", test.path, got)
+		}
+	}
+
+	// The manifest must be valid JSON, starting the app at the path it is
+	// served under.
+	var manifest struct {
+		StartURL string `json:"start_url"`
+		Display  string `json:"display"`
+	}
+	if err := json.Unmarshal(doAssetRequest(h, "/manifest.webmanifest", nil).Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("Could not parse manifest: %v", err)
+	}
+	if manifest.StartURL != "./" || manifest.Display != "standalone" {
+		t.Errorf("Manifest had start_url %q & display %q, want %q & %q", manifest.StartURL, manifest.Display, "./", "standalone")
+	}
+}
+
+func TestContentSecurityPolicyNonce(t *testing.T) {
+	t.Parallel()
+	h := NewSecureHeader(csp.Default(), newTestContent(t))
+	nonceRE := regexp.MustCompile(`'nonce-([^']+)'`)
+
+	nonces := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("GET /: got status %d, want %d", resp.Code, http.StatusOK)
+		}
+
+		// Apart from the nonce, the default policy allows only harpd itself.
+		hdr := resp.Header().Get("Content-Security-Policy")
+		m := nonceRE.FindStringSubmatch(hdr)
+		if m == nil {
+			t.Fatalf("GET /: got Content-Security-Policy %q, want a nonce", hdr)
+		}
+		nonce := m[1]
+		if want := fmt.Sprintf("default-src 'self'; script-src 'self' 'nonce-%s'; worker-src 'self'", nonce); hdr != want {
+			t.Errorf("GET /: got Content-Security-Policy %q, want %q", hdr, want)
+		}
+
+		// Each script in the page carries the nonce from the header.
+		body := resp.Body.String()
+		if scripts, withNonce := strings.Count(body, "<script "), strings.Count(body, fmt.Sprintf(`<script nonce="%s" `, nonce)); scripts == 0 || withNonce != scripts {
+			t.Errorf("GET /: %d of %d scripts carry nonce %q, want all", withNonce, scripts, nonce)
+		}
+		nonces[nonce] = true
+	}
+	if len(nonces) != 2 {
+		t.Errorf("Nonce was reused across responses")
+	}
+}
+
+func TestDynamicPagesNotStored(t *testing.T) {
+	t.Parallel()
+	h := newTestContent(t)
+
+	for _, p := range []string{"/", "/entry", "/dir/", "/search", "/audit"} {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, p, nil))
+		if got := resp.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("GET %s: got Cache-Control %q, want %q", p, got, "no-store")
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	t.Parallel()
+	h := newTestContent(t, WithBasePath("/vault"))
+	do := func(method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Only paths beneath the base path are served.
+	for _, test := range []struct {
+		target       string
+		wantCode     int
+		wantLocation string
+	}{
+		{"/vault/style.css", http.StatusOK, ""},
+		{"/vault", http.StatusMovedPermanently, "/vault/"},
+		{"/style.css", http.StatusNotFound, ""},
+		{"/vaultstyle.css", http.StatusNotFound, ""},
+	} {
+		resp := do(http.MethodGet, test.target, nil)
+		if resp.Code != test.wantCode || resp.Header().Get("Location") != test.wantLocation {
+			t.Errorf("GET %s: got status %d & location %q, want %d & %q", test.target, resp.Code, resp.Header().Get("Location"), test.wantCode, test.wantLocation)
+		}
+	}
+
+	// The login page links to assets beneath the base path.
+	resp := do(http.MethodGet, "/vault/entry", nil)
+	if body := resp.Body.String(); !strings.Contains(body, `href="/vault/style.css?v=`) {
+		t.Errorf("Login page does not link to style beneath base path: %q", body)
+	}
+	if got, want := resp.Header().Get("Link"), "</vault/font-awesome.otf>; rel=prefetch"; got != want {
+		t.Errorf("Login page had Link header %q, want %q", got, want)
+	}
+
+	// Logging in redirects beneath the base path, and sets a cookie scoped to it.
+	resp = do(http.MethodPost, "/vault/entry?edit", url.Values{"action": {"login"}, "pass": {"password"}})
+	if got, want := resp.Header().Get("Location"), "/vault/entry?edit"; resp.Code != http.StatusSeeOther || got != want {
+		t.Errorf("Login: got status %d & location %q, want %d & %q", resp.Code, got, http.StatusSeeOther, want)
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "__Secure-harp-sid" || cookies[0].Path != "/vault/" {
+		t.Fatalf("Login set cookies %v, want one named %q with path %q", cookies, "__Secure-harp-sid", "/vault/")
+	}
+
+	// Redirects from authenticated pages, & links within them, include the base path.
+	resp = do(http.MethodGet, "/vault/entry", nil, cookies[0])
+	if got, want := resp.Header().Get("Location"), "/vault/register"; resp.Code != http.StatusSeeOther || got != want {
+		t.Errorf("GET /vault/entry without MFA device: got status %d & location %q, want %d & %q", resp.Code, got, http.StatusSeeOther, want)
+	}
+	resp = do(http.MethodGet, "/vault/register", nil, cookies[0])
+	if body := resp.Body.String(); resp.Code != http.StatusOK || !strings.Contains(body, `href="/vault/logout"`) || !strings.Contains(body, `src="/vault/mfa-register.js?v=`) {
+		t.Errorf("GET /vault/register: got status %d & body without links beneath base path: %q", resp.Code, body)
+	}
+	resp = do(http.MethodGet, "/vault/logout", nil, cookies[0])
+	if got, want := resp.Header().Get("Location"), "/vault/"; resp.Code != http.StatusSeeOther || got != want {
+		t.Errorf("Logout: got status %d & location %q, want %d & %q", resp.Code, got, http.StatusSeeOther, want)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Parallel()
+	const remoteOrigin = "https://harp.lan.example.com:8443"
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{"/entry": "password"}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithOrigins(remoteOrigin))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	main := NewContent(sh, WithListener(Listener{}))
+	lan := NewContent(sh, WithListener(Listener{Name: "lan", ReadOnly: true, MFAEveryRequest: true, Insecure: true}))
+	remote := NewContent(sh, WithListener(Listener{Name: "remote", Origin: remoteOrigin}))
+	do := func(h http.Handler, method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+	login := func(h http.Handler) *http.Cookie {
+		t.Helper()
+		resp := do(h, http.MethodPost, "/entry", url.Values{"action": {"login"}, "pass": {"password"}})
+		cookies := resp.Result().Cookies()
+		if resp.Code != http.StatusSeeOther || len(cookies) != 1 {
+			t.Fatalf("Login: got status %d & cookies %v, want %d & one cookie", resp.Code, cookies, http.StatusSeeOther)
+		}
+		return cookies[0]
+	}
+	getSession := func(c *http.Cookie) *session.Session {
+		t.Helper()
+		sid, err := base64.RawURLEncoding.DecodeString(strings.Split(c.Value, ".")[0])
+		if err != nil {
+			t.Fatalf("Could not decode session ID: %v", err)
+		}
+		sess, err := sh.LookupSession(string(sid))
+		if err != nil {
+			t.Fatalf("Could not look up session: %v", err)
+		}
+		return sess
+	}
+
+	mainCookie, lanCookie := login(main), login(lan)
+	if mainCookie.Name != "__Host-harp-sid" || !mainCookie.Secure || lanCookie.Name != "harp-sid.lan" || lanCookie.Secure {
+		t.Errorf("Login set cookies %v & %v, want Secure %q & insecure %q", mainCookie, lanCookie, "__Host-harp-sid", "harp-sid.lan")
+	}
+
+	// Each listener accepts only its own session cookie, even if another
+	// listener's cookie is renamed to match. (Without an MFA device, a
+	// logged-in session is sent to register one.)
+	for _, test := range []struct {
+		desc     string
+		h        http.Handler
+		c        *http.Cookie
+		name     string
+		wantCode int
+	}{
+		{"main with own cookie", main, mainCookie, mainCookie.Name, http.StatusSeeOther},
+		{"lan with own cookie", lan, lanCookie, lanCookie.Name, http.StatusSeeOther},
+		{"main with lan cookie", main, lanCookie, mainCookie.Name, http.StatusOK},
+		{"lan with main cookie", lan, mainCookie, lanCookie.Name, http.StatusOK},
+	} {
+		c := *test.c
+		c.Name = test.name
+		resp := do(test.h, http.MethodGet, "/entry", nil, &c)
+		if resp.Code != test.wantCode {
+			t.Errorf("[%s] GET /entry: got status %d, want %d", test.desc, resp.Code, test.wantCode)
+		}
+		if test.wantCode == http.StatusOK && !strings.Contains(resp.Body.String(), `value="login"`) {
+			t.Errorf("[%s] GET /entry: got non-login page %q", test.desc, resp.Body.String())
+		}
+	}
+
+	// A read-only listener serves no pages which only modify the store or
+	// sessions.
+	for _, target := range []string{"/api/entries", "/generate", "/register", "/sessions"} {
+		if resp := do(lan, http.MethodGet, target, nil, lanCookie); resp.Code != http.StatusNotFound {
+			t.Errorf("GET %s via read-only listener: got status %d, want %d", target, resp.Code, http.StatusNotFound)
+		}
+	}
+	// Sessions perform MFA at the origin of the listener they are used via,
+	// for the relying party ID of the session handler.
+	remoteCookie := login(remote)
+	for _, test := range []struct {
+		desc       string
+		h          http.Handler
+		c          *http.Cookie
+		wantOrigin string
+	}{
+		{"main", main, mainCookie, "https://example.com"},
+		{"remote", remote, remoteCookie, remoteOrigin},
+	} {
+		resp := do(test.h, http.MethodGet, "/register", nil, test.c)
+		if body := resp.Body.String(); resp.Code != http.StatusOK || !strings.Contains(body, "<b>example.com</b>") || !strings.Contains(body, "<code>"+test.wantOrigin+"</code>") {
+			t.Errorf("[%s] GET /register: got status %d & body without origin %q: %q", test.desc, resp.Code, test.wantOrigin, body)
+		}
+		if got := getSession(test.c).Origin(); got != test.wantOrigin {
+			t.Errorf("[%s] Session origin = %q, want %q", test.desc, got, test.wantOrigin)
+		}
+	}
+
+	// Sessions used via a read-only listener can't modify the store, even
+	// if they could before; other sessions are unaffected.
+	if s := getSession(lanCookie).GetStore(); !secret.IsReadOnly(s, "/entry") {
+		t.Errorf("Session used via read-only listener can modify the store")
+	}
+	if s := getSession(mainCookie).GetStore(); secret.IsReadOnly(s, "/entry") {
+		t.Errorf("Session used via main listener can't modify the store")
+	}
+}
+
+func TestPendingLogin(t *testing.T) {
+	t.Parallel()
+	v := &blockingVault{memVault{&memStore{entries: map[string]string{"/entry": "password"}}}, make(chan struct{})}
+	sh, err := session.NewHandler(v, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithNewSessionBurst(2))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	h := NewContent(sh)
+	do := func(method string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/entry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, test := range []struct {
+		pass         string
+		wantLocation string // after the vault is unlocked
+	}{
+		{"password", "/register"},
+		{"wrong passphrase", "/entry"},
+	} {
+		// A login which takes too long redirects to a page which waits for it.
+		resp := do(http.MethodPost, url.Values{"action": {"login"}, "pass": {test.pass}})
+		if got := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || got != "/entry" {
+			t.Errorf("Login with %q: got status %d & location %q, want %d & %q", test.pass, resp.Code, got, http.StatusSeeOther, "/entry")
+		}
+		cookies := resp.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Login with %q set cookies %v, want one", test.pass, cookies)
+		}
+		resp = do(http.MethodGet, nil, cookies[0])
+		if resp.Code != http.StatusOK || resp.Header().Get("Refresh") == "" || !strings.Contains(resp.Body.String(), "Unlocking") {
+			t.Errorf("GET while unlocking with %q: got status %d, Refresh header %q & body %q, want waiting page", test.pass, resp.Code, resp.Header().Get("Refresh"), resp.Body.String())
+		}
+
+		// Once unlocked, the page leads to the session, or back to the login page.
+		v.release <- struct{}{}
+		for resp.Header().Get("Refresh") != "" {
+			time.Sleep(10 * time.Millisecond)
+			resp = do(http.MethodGet, nil, cookies[0])
+		}
+		if got := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || got != test.wantLocation {
+			t.Errorf("GET after unlocking with %q: got status %d & location %q, want %d & %q", test.pass, resp.Code, got, http.StatusSeeOther, test.wantLocation)
+		}
+	}
+}
+
+// blockingVault is a memVault whose Unlock blocks until a value is sent on
+// release.
+type blockingVault struct {
+	memVault
+	release chan struct{}
+}
+
+func (v *blockingVault) Unlock(passphrase string) (secret.Store, error) {
+	<-v.release
+	return v.memVault.Unlock(passphrase)
+}
+
+func TestValidateBasePath(t *testing.T) {
+	t.Parallel()
+
+	for _, bp := range []string{"", "/vault", "/a/b"} {
+		if err := ValidateBasePath(bp); err != nil {
+			t.Errorf("ValidateBasePath(%q) = %v, want nil", bp, err)
+		}
+	}
+	for _, bp := range []string{"/", "vault", "/vault/", "/a/../b", "/a//b"} {
+		if err := ValidateBasePath(bp); err == nil {
+			t.Errorf("ValidateBasePath(%q) unexpectedly succeeded", bp)
+		}
+	}
+}
+
+func newTestContent(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{"/entry": "password"}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	return NewContent(sh, opts...)
+}
+
+func TestBodyLimits(t *testing.T) {
+	t.Parallel()
+	const bodyMax, entryMax = 1 << 10, 1 << 10
+	h := newTestContent(t, WithBodyMaxSize(bodyMax), WithEntryMaxSize(entryMax), WithAttachmentMaxSize(bodyMax))
+	do := func(method, target, contentType, body, csrfToken string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", "application/json")
+		if csrfToken != "" {
+			req.Header.Set(csrfHeader, csrfToken)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+	form := func(k string, n int) string { return url.Values{k: {strings.Repeat("x", n)}}.Encode() }
+	jsonBody := func(k string, n int) string { return `{"` + k + `": "` + strings.Repeat("x", n) + `"}` }
+	const formType, jsonType = "application/x-www-form-urlencoded", "application/json"
+
+	// Requests without a session are limited to bodyMax, wherever they are sent.
+	for _, test := range []struct{ target, contentType, body string }{
+		{"/entry", formType, form("pass", bodyMax)},
+		{"/register", formType, form("pass", bodyMax)},
+		{"/api/login", jsonType, jsonBody("passphrase", bodyMax)},
+		{"/logout", formType, form("action", bodyMax)},
+		{"/share/token", formType, form("action", bodyMax)},
+	} {
+		if resp := do(http.MethodPost, test.target, test.contentType, test.body, ""); resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s with oversized body: got status %d, want %d", test.target, resp.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	// Requests with a session may update entries with bodies holding an
+	// entry, but are otherwise limited to bodyMax.
+	resp := do(http.MethodPost, "/api/login", jsonType, `{"passphrase": "password"}`, "")
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("Login: got status %d, want %d", resp.Code, http.StatusNoContent)
+	}
+	cookie := resp.Result().Cookies()[0]
+	csrfToken := resp.Header().Get(csrfHeader)
+	for _, test := range []struct {
+		target, contentType, body string
+		wantTooLarge              bool
+	}{
+		{"/entry", formType, form("content", 2*entryMax), false},
+		{"/entry", formType, form("content", 7*entryMax+bodyMax), true},
+		{"/register", jsonType, jsonBody("id", bodyMax), true},
+		{"/sessions", formType, form("session", bodyMax), true},
+		{"/logout-all", formType, form("action", bodyMax), true},
+	} {
+		resp := do(http.MethodPost, test.target, test.contentType, test.body, csrfToken, cookie)
+		if tooLarge := resp.Code == http.StatusRequestEntityTooLarge; tooLarge != test.wantTooLarge {
+			t.Errorf("POST %s with %d-byte body: got status %d, want too large = %v", test.target, len(test.body), resp.Code, test.wantTooLarge)
+		}
+	}
+}
+
+func TestTrustedDevice(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_handler_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := device.NewStore(filepath.Join(dir, "devices"), time.Hour)
+	if err != nil {
+		t.Fatalf("Could not create device store: %v", err)
+	}
+	token, _, err := ds.Create("", "laptop", time.Now())
+	if err != nil {
+		t.Fatalf("Could not trust device: %v", err)
+	}
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{"/entry": "password"}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithTrustedDevices(ds))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	h := NewContent(sh)
+	do := func(method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := do(http.MethodPost, "/", url.Values{"action": {"login"}, "pass": {"password"}})
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Login set cookies %v, want one", cookies)
+	}
+	sid := cookies[0]
+	trusted := &http.Cookie{Name: DefaultSessionCookie.device().Name, Value: token}
+	untrusted := &http.Cookie{Name: DefaultSessionCookie.device().Name, Value: token + "A"}
+
+	// A trusted device may list directories & search entry names, but
+	// nothing else, without multi-factor authentication.
+	for _, test := range []struct {
+		target  string
+		cookies []*http.Cookie
+		wantOK  bool
+	}{
+		{"/", []*http.Cookie{sid}, false},
+		{"/", []*http.Cookie{sid, untrusted}, false},
+		{"/", []*http.Cookie{sid, trusted}, true},
+		{"/search?q=zzz", []*http.Cookie{sid, trusted}, true},
+		{"/search?q=zzz&content=1", []*http.Cookie{sid, trusted}, false},
+		{"/entry", []*http.Cookie{sid, trusted}, false},
+		{"/sessions", []*http.Cookie{sid, trusted}, false},
+	} {
+		resp := do(http.MethodGet, test.target, nil, test.cookies...)
+		if gotOK := resp.Code == http.StatusOK; gotOK != test.wantOK {
+			t.Errorf("GET %s with %d cookies: got status %d, want OK = %v", test.target, len(test.cookies), resp.Code, test.wantOK)
+		}
+	}
+}
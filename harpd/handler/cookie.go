@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// hostPrefix is the cookie name prefix requiring that a cookie be secure, be
+// scoped to the root path, and not specify a domain. Browsers reject cookies
+// with this prefix which do not meet these requirements.
+const hostPrefix = "__Host-"
+
+// securePrefix is the cookie name prefix requiring only that a cookie be
+// secure.
+const securePrefix = "__Secure-"
+
+// SessionCookie configures the cookie holding a user's session ID. The cookie
+// is always HttpOnly, and is Secure unless served by an insecure listener (see
+// Listener.Insecure).
+type SessionCookie struct {
+	Name     string
+	Path     string
+	Domain   string // if empty, the cookie is only sent to the server's host
+	SameSite http.SameSite
+
+	insecure bool   // if set, the cookie is not Secure
+	key      []byte // if non-nil, the cookie's value carries a MAC under this key; see partition
+}
+
+// DefaultSessionCookie is the session cookie configuration used unless
+// another is specified with WithSessionCookie.
+var DefaultSessionCookie = SessionCookie{
+	Name:     hostPrefix + "harp-sid",
+	Path:     "/",
+	SameSite: http.SameSiteStrictMode,
+}
+
+// Validate checks that the session cookie configuration is usable.
+func (sc SessionCookie) Validate() error {
+	if sc.Name == "" {
+		return errors.New("cookie name is required")
+	}
+	if !strings.HasPrefix(sc.Path, "/") {
+		return fmt.Errorf("cookie path %q is not absolute", sc.Path)
+	}
+	if strings.HasPrefix(sc.Name, hostPrefix) && (sc.Domain != "" || sc.Path != "/") {
+		return fmt.Errorf("cookie names beginning with %q require path \"/\" and no domain", hostPrefix)
+	}
+	return nil
+}
+
+// under returns the configuration of the session cookie when harpd is served
+// under the given base path (see WithBasePath): the cookie's path is relative
+// to the base path. Since cookies with the "__Host-" prefix must be scoped to
+// the root path, that prefix is replaced with "__Secure-".
+func (sc SessionCookie) under(basePath string) SessionCookie {
+	if basePath == "" {
+		return sc
+	}
+	sc.Path = basePath + sc.Path
+	if strings.HasPrefix(sc.Name, hostPrefix) {
+		sc.Name = securePrefix + strings.TrimPrefix(sc.Name, hostPrefix)
+	}
+	return sc
+}
+
+// partition returns the configuration of the session cookie for the given
+// listener (see WithListener). The cookie is named for the listener, and its
+// value carries a MAC of the session ID under the given key, which must be
+// unique to the listener: a session ID set by one listener is not accepted by
+// another, even if the cookie is renamed. Since cookies with the "__Host-" &
+// "__Secure-" prefixes must be Secure, an insecure listener's cookie loses
+// them.
+func (sc SessionCookie) partition(l Listener, key []byte) SessionCookie {
+	if l.Name != "" {
+		sc.Name += "." + l.Name
+	}
+	if l.Insecure {
+		sc.Name = strings.TrimPrefix(strings.TrimPrefix(sc.Name, hostPrefix), securePrefix)
+		sc.insecure = true
+	}
+	sc.key = key
+	return sc
+}
+
+// newCookieKey returns a new, random key with which to partition the session
+// cookie. Sessions do not survive a restart, so neither need the key.
+func newCookieKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Could not generate session cookie key: %v", err))
+	}
+	return key
+}
+
+// mac returns the MAC of the given session ID carried by a partitioned
+// cookie's value.
+func (sc SessionCookie) mac(sid string) string {
+	h := hmac.New(sha256.New, sc.key)
+	h.Write([]byte(sid))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// device returns the configuration of the cookie holding the token of a
+// trusted device (see session.WithTrustedDevices), which is scoped as the
+// session cookie is.
+func (sc SessionCookie) device() SessionCookie {
+	sc.Name += "-device"
+	return sc
+}
+
+// cookie returns a session cookie with the given value & max age.
+func (sc SessionCookie) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sc.Name,
+		Value:    value,
+		Path:     sc.Path,
+		Domain:   sc.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !sc.insecure,
+		SameSite: sc.SameSite,
+	}
+}
+
+// set sets the session cookie to the given session ID.
+func (sc SessionCookie) set(w http.ResponseWriter, sid string) {
+	value := base64.RawURLEncoding.EncodeToString([]byte(sid))
+	if sc.key != nil {
+		value += "." + sc.mac(sid)
+	}
+	http.SetCookie(w, sc.cookie(value, 0))
+}
+
+// clear removes the session cookie.
+func (sc SessionCookie) clear(w http.ResponseWriter) {
+	http.SetCookie(w, sc.cookie("", -1))
+}
+
+// value gets the value of the request's cookie, or the empty string if the
+// request has no such cookie.
+func (sc SessionCookie) value(r *http.Request) string {
+	c, err := r.Cookie(sc.Name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// sessionID gets the session ID from the request's session cookie. It returns
+// the empty string if the request has no valid session cookie, including if a
+// partitioned cookie's MAC does not match.
+func (sc SessionCookie) sessionID(r *http.Request) (string, error) {
+	c, err := r.Cookie(sc.Name)
+	if err != nil {
+		if errors.Is(err, http.ErrNoCookie) {
+			return "", nil
+		} else {
+			return "", fmt.Errorf("couldn't get cookie: %w", err)
+		}
+	}
+
+	value, mac := c.Value, ""
+	if sc.key != nil {
+		i := strings.LastIndex(value, ".")
+		if i < 0 {
+			return "", nil
+		}
+		value, mac = value[:i], value[i+1:]
+	}
+	sid, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		if _, ok := err.(base64.CorruptInputError); ok {
+			return "", nil
+		} else {
+			return "", fmt.Errorf("couldn't decode cookie value: %w", err)
+		}
+	}
+	if sc.key != nil && !hmac.Equal([]byte(mac), []byte(sc.mac(string(sid)))) {
+		// The cookie was set by another listener, or forged.
+		return "", nil
+	}
+	return string(sid), nil
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionCookie(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc               string
+		sc                 SessionCookie
+		wantSet, wantClear string
+	}{
+		{
+			desc:      "default",
+			sc:        DefaultSessionCookie,
+			wantSet:   "__Host-harp-sid=c2lk; Path=/; HttpOnly; Secure; SameSite=Strict",
+			wantClear: "__Host-harp-sid=; Path=/; Max-Age=0; HttpOnly; Secure; SameSite=Strict",
+		},
+		{
+			desc:      "subpath",
+			sc:        SessionCookie{Name: "harp-sid", Path: "/harp/", SameSite: http.SameSiteLaxMode},
+			wantSet:   "harp-sid=c2lk; Path=/harp/; HttpOnly; Secure; SameSite=Lax",
+			wantClear: "harp-sid=; Path=/harp/; Max-Age=0; HttpOnly; Secure; SameSite=Lax",
+		},
+		{
+			desc:      "domain",
+			sc:        SessionCookie{Name: "__Secure-harp-sid", Path: "/", Domain: "example.com", SameSite: http.SameSiteNoneMode},
+			wantSet:   "__Secure-harp-sid=c2lk; Path=/; Domain=example.com; HttpOnly; Secure; SameSite=None",
+			wantClear: "__Secure-harp-sid=; Path=/; Domain=example.com; Max-Age=0; HttpOnly; Secure; SameSite=None",
+		},
+	} {
+		if err := test.sc.Validate(); err != nil {
+			t.Errorf("[%s] Validate() returned error: %v", test.desc, err)
+		}
+
+		w := httptest.NewRecorder()
+		test.sc.set(w, "sid")
+		if got := w.Header().Get("Set-Cookie"); got != test.wantSet {
+			t.Errorf("[%s] set: got Set-Cookie %q, want %q", test.desc, got, test.wantSet)
+		}
+
+		// The cookie which was set can be read back.
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(w.Result().Cookies()[0])
+		if sid, err := test.sc.sessionID(r); err != nil || sid != "sid" {
+			t.Errorf("[%s] sessionID() = (%q, %v), want (%q, nil)", test.desc, sid, err, "sid")
+		}
+
+		w = httptest.NewRecorder()
+		test.sc.clear(w)
+		if got := w.Header().Get("Set-Cookie"); got != test.wantClear {
+			t.Errorf("[%s] clear: got Set-Cookie %q, want %q", test.desc, got, test.wantClear)
+		}
+	}
+}
+
+func TestSessionCookieValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, sc := range []SessionCookie{
+		{Name: "", Path: "/"},
+		{Name: "harp-sid", Path: "harp/"},
+		{Name: "__Host-harp-sid", Path: "/harp/"},
+		{Name: "__Host-harp-sid", Path: "/", Domain: "example.com"},
+	} {
+		if err := sc.Validate(); err == nil {
+			t.Errorf("Validate() of %+v succeeded, want error", sc)
+		}
+	}
+}
+
+func TestSessionCookiePartition(t *testing.T) {
+	t.Parallel()
+	lan := DefaultSessionCookie.partition(Listener{Name: "lan"}, newCookieKey())
+	insecure := DefaultSessionCookie.partition(Listener{Name: "http", Insecure: true}, newCookieKey())
+	if lan.Name != "__Host-harp-sid.lan" || insecure.Name != "harp-sid.http" {
+		t.Errorf("Partitioned cookie names = %q & %q, want %q & %q", lan.Name, insecure.Name, "__Host-harp-sid.lan", "harp-sid.http")
+	}
+
+	set := func(sc SessionCookie) *http.Cookie {
+		w := httptest.NewRecorder()
+		sc.set(w, "sid")
+		return w.Result().Cookies()[0]
+	}
+	sessionID := func(sc SessionCookie, c *http.Cookie) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Name = sc.Name
+		r.AddCookie(c)
+		sid, err := sc.sessionID(r)
+		if err != nil {
+			t.Fatalf("Could not get session ID: %v", err)
+		}
+		return sid
+	}
+
+	// A partitioned cookie is accepted only by the listener which set it.
+	lanCookie, insecureCookie := set(lan), set(insecure)
+	if !lanCookie.Secure || insecureCookie.Secure {
+		t.Errorf("Partitioned cookies have Secure = %v & %v, want true & false", lanCookie.Secure, insecureCookie.Secure)
+	}
+	for _, test := range []struct {
+		desc string
+		sc   SessionCookie
+		c    *http.Cookie
+		want string
+	}{
+		{"own cookie", lan, lanCookie, "sid"},
+		{"other listener's cookie", lan, insecureCookie, ""},
+		{"unpartitioned cookie", lan, set(DefaultSessionCookie), ""},
+		{"partitioned cookie without partition", DefaultSessionCookie, set(lan), ""},
+		{"tampered cookie", lan, &http.Cookie{Value: "b3RoZXI." + lan.mac("sid")}, ""},
+	} {
+		if got := sessionID(test.sc, test.c); got != test.want {
+			t.Errorf("[%s] sessionID() = %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
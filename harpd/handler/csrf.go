@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+const (
+	// csrfFormField is the name of the form field holding the CSRF token in
+	// HTML form submissions.
+	csrfFormField = "csrf-token"
+
+	// csrfHeader is the name of the header holding the CSRF token in
+	// script-initiated & API requests.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// checkCSRF determines if the given request may be served for the given
+// session. Requests using methods which may change state must carry the
+// session's CSRF token, either in the X-CSRF-Token header or in the
+// "csrf-token" form field. Requests which are not allowed are logged.
+func checkCSRF(r *http.Request, sess *session.Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfFormField)
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken())) != 1 {
+		logf(r, "Rejected %s request to %q from %s: missing or mismatched CSRF token", r.Method, r.URL.Path, clientIP(r))
+		return false
+	}
+	return true
+}
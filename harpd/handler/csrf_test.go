@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestCSRFForm(t *testing.T) {
+	t.Parallel()
+
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	sid, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	fh := &formHandler{}
+	h := newAuth(sh, DefaultSessionCookie, fh)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/form", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		DefaultSessionCookie.set(w, sid)
+		req.AddCookie(w.Result().Cookies()[0])
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Rendered pages include the session's CSRF token.
+	resp := do(http.MethodGet, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	if want := `value="` + sess.CSRFToken() + `"`; !strings.Contains(resp.Body.String(), want) {
+		t.Errorf("GET: rendered page %q does not contain %q", resp.Body.String(), want)
+	}
+
+	// Posts must include the token.
+	for _, test := range []struct {
+		desc     string
+		form     url.Values
+		wantCode int
+	}{
+		{"no token", url.Values{"action": {"do"}}, http.StatusForbidden},
+		{"wrong token", url.Values{"action": {"do"}, csrfFormField: {"wrong"}}, http.StatusForbidden},
+		{"right token", url.Values{"action": {"do"}, csrfFormField: {sess.CSRFToken()}}, http.StatusOK},
+	} {
+		fh.posts = 0
+		resp := do(http.MethodPost, test.form)
+		if resp.Code != test.wantCode {
+			t.Errorf("POST with %s: got status %d, want %d", test.desc, resp.Code, test.wantCode)
+		}
+		if wantPosts := map[bool]int{true: 1, false: 0}[test.wantCode == http.StatusOK]; fh.posts != wantPosts {
+			t.Errorf("POST with %s: handler saw %d posts, want %d", test.desc, fh.posts, wantPosts)
+		}
+	}
+}
+
+var formTmpl = inlineTemplate("form", `<form method="POST"><input type="hidden" name="csrf-token" value="{{csrfToken}}" /></form>`)
+
+// formHandler serves a form requiring no MFA, counting posts.
+type formHandler struct {
+	posts int
+}
+
+func (*formHandler) authPath(*http.Request) (string, error) { return "", nil }
+
+func (fh *formHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		fh.posts++
+		return
+	}
+	serveTemplate(w, r, formTmpl, nil)
+}
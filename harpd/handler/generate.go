@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/harpd/random"
+)
+
+const (
+	minGeneratedLength = 4
+	maxGeneratedLength = 128
+)
+
+// generateHandler handles requests to generate random passwords, with
+// parameters taken from the query string:
+//
+//	len     -- password length
+//	sets    -- character sets to use: l (lowercase), u (uppercase), d (digits), s (symbols)
+//	noambig -- if set, exclude ambiguous characters
+//
+// It responds with the password & its approximate bits of security, as JSON.
+type generateHandler struct{}
+
+func newGenerate() *generateHandler {
+	return &generateHandler{}
+}
+
+func (gh generateHandler) authPath(r *http.Request) (string, error) {
+	return authAny, nil
+}
+
+func (gh generateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	length, err := strconv.Atoi(q.Get("len"))
+	if err != nil || length < minGeneratedLength || length > maxGeneratedLength {
+		http.Error(w, "len must be a number between 4 and 128", http.StatusBadRequest)
+		return
+	}
+	charsets, err := random.Charsets(q.Get("sets"), q.Get("noambig") != "")
+	if err != nil {
+		http.Error(w, "sets must contain only l, u, d, s", http.StatusBadRequest)
+		return
+	}
+	pw, err := random.Password(length, charsets)
+	if err != nil {
+		logf(r, "Could not generate password: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	respBytes, err := json.Marshal(struct {
+		Password string  `json:"password"`
+		Bits     float64 `json:"bits"`
+	}{pw, float64(length) * math.Log2(float64(len(strings.Join(charsets, ""))))})
+	if err != nil {
+		logf(r, "Could not marshal generated password: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	newStatic(respBytes, "application/json").ServeHTTP(w, r)
+}
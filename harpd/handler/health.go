@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readinessTimeout bounds the time spent running readiness checks for a
+// single request. Checks which have not completed by then are reported as
+// failed.
+const readinessTimeout = 2 * time.Second
+
+// ReadinessCheck checks that something the server depends on is usable, e.g.
+// that a file it must write is writable. Checks are run on every request to
+// /readyz, so they must be cheap; they must never touch decrypted secrets, and
+// should return promptly once ctx is done.
+type ReadinessCheck func(ctx context.Context) error
+
+// WithReadinessCheck adds a named check to those run by /readyz. Readiness
+// checks of the static assets are always run.
+func WithReadinessCheck(name string, check ReadinessCheck) Option {
+	return func(p *contentParams) {
+		if p.readinessChecks == nil {
+			p.readinessChecks = map[string]ReadinessCheck{}
+		}
+		p.readinessChecks[name] = check
+	}
+}
+
+// healthHandler serves /healthz, which reports that the server is up. It does
+// not require authentication.
+type healthHandler struct{}
+
+func newHealth() *healthHandler { return &healthHandler{} }
+
+func (healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	serveProbe(w, http.StatusOK, "ok\n")
+}
+
+// readyHandler serves /readyz, which reports whether each of a set of
+// readiness checks passes. It does not require authentication, so it reports
+// only which checks failed; the errors are logged.
+type readyHandler struct {
+	checks map[string]ReadinessCheck // by name
+}
+
+func newReady(checks map[string]ReadinessCheck) *readyHandler {
+	return &readyHandler{checks: checks}
+}
+
+func (rh readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Run the checks concurrently; a check which does not complete before
+	// the deadline is abandoned, and its result is discarded.
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(rh.checks))
+	status := make(map[string]string, len(rh.checks))
+	for name, check := range rh.checks {
+		name, check := name, check
+		status[name] = "timed out"
+		go func() { results <- result{name, check(ctx)} }()
+	}
+wait:
+	for range rh.checks {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				logf(r, "Readiness check %q failed: %v", res.name, res.err)
+				status[res.name] = "failed"
+				continue
+			}
+			status[res.name] = "ok"
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	code := http.StatusOK
+	var names []string
+	for name, s := range status {
+		names = append(names, name)
+		if s != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s: %s\n", name, status[name])
+	}
+	serveProbe(w, code, sb.String())
+}
+
+// serveProbe serves the plain-text response to a health or readiness probe.
+// Probe responses are never rendered as pages, so the Content-Security-Policy
+// header set by NewSecureHeader is dropped.
+func serveProbe(w http.ResponseWriter, code int, body string) {
+	w.Header().Del("Content-Security-Policy")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	fmt.Fprint(w, body)
+}
+
+// checkAssets returns a ReadinessCheck which checks that every template &
+// static asset served by NewContent parses, including any overrides. rs may
+// be nil, in which case only the embedded assets are checked.
+func checkAssets(rs *resolver) ReadinessCheck {
+	return func(context.Context) error {
+		for _, td := range templates {
+			if _, err := rs.template(td); err != nil {
+				return fmt.Errorf("couldn't parse template %q: %w", td.name, err)
+			}
+		}
+		for p := range contentAssets {
+			if _, err := rs.asset(p); err != nil {
+				return fmt.Errorf("couldn't load asset %q: %w", p, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/harpd/csp"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	fail := false
+	h := NewSecureHeader(csp.Default(), newTestContent(t,
+		WithReadinessCheck("ok", func(context.Context) error { return nil }),
+		WithReadinessCheck("maybe", func(context.Context) error {
+			if fail {
+				return errors.New("secret detail")
+			}
+			return nil
+		}),
+	))
+	do := func(target string) *httptest.ResponseRecorder {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		if got := resp.Header().Get("Content-Security-Policy"); got != "" {
+			t.Errorf("GET %s: got Content-Security-Policy %q, want none", target, got)
+		}
+		return resp
+	}
+
+	// Neither probe requires authentication.
+	if resp := do("/healthz"); resp.Code != http.StatusOK {
+		t.Errorf("GET /healthz: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	resp := do("/readyz")
+	if resp.Code != http.StatusOK {
+		t.Errorf("GET /readyz: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	if want := "assets: ok\nmaybe: ok\nok: ok\n"; resp.Body.String() != want {
+		t.Errorf("GET /readyz: got body %q, want %q", resp.Body.String(), want)
+	}
+
+	// A failing check makes the server unready, without revealing why.
+	fail = true
+	resp = do("/readyz")
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz with failing check: got status %d, want %d", resp.Code, http.StatusServiceUnavailable)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "maybe: failed\n") || strings.Contains(body, "secret detail") {
+		t.Errorf("GET /readyz with failing check: got body %q", body)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	t.Parallel()
+	block := make(chan struct{})
+	defer close(block)
+	h := newReady(map[string]ReadinessCheck{
+		"ok":   func(context.Context) error { return nil },
+		"slow": func(context.Context) error { <-block; return nil },
+	})
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req.WithContext(ctx))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d, want %d", resp.Code, http.StatusServiceUnavailable)
+	}
+	if want := "slow: timed out\n"; !strings.Contains(resp.Body.String(), want) {
+		t.Errorf("Got body %q, want it to contain %q", resp.Body.String(), want)
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+// keepaliveHandler handles requests to check or extend the lifetime of the
+// user's session. It assumes it can get an authenticated session from the
+// request.
+type keepaliveHandler struct{}
+
+func newKeepalive() *keepaliveHandler {
+	return &keepaliveHandler{}
+}
+
+func (kh keepaliveHandler) authPath(r *http.Request) (string, error) {
+	return authBrowse, nil
+}
+
+// extendsSession implements sessionExtender. Only POST requests extend the
+// session, so that the remaining lifetime can be checked without resetting it.
+func (kh keepaliveHandler) extendsSession(r *http.Request) bool { return false }
+
+func (kh keepaliveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	if sess == nil {
+		logf(r, "Could not get authenticated session in keepalive handler")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Nothing to do.
+
+	case http.MethodPost:
+		if err := sess.Touch(); errors.Is(err, session.ErrNoSession) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			logf(r, "Could not extend session: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ttl := time.Until(sess.ExpiresAt())
+	if ttl < 0 {
+		ttl = 0
+	}
+	var deadlineTTLSeconds *float64
+	if d := sess.AbsoluteDeadline(); !d.IsZero() {
+		s := time.Until(d).Seconds()
+		if s < 0 {
+			s = 0
+		}
+		deadlineTTLSeconds = &s
+	}
+	respBytes, err := json.Marshal(struct {
+		TTLSeconds         float64  `json:"ttl_s"`
+		DeadlineTTLSeconds *float64 `json:"deadline_ttl_s,omitempty"`
+	}{ttl.Seconds(), deadlineTTLSeconds})
+	if err != nil {
+		logf(r, "Could not marshal keepalive response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	newStatic(respBytes, "application/json").ServeHTTP(w, r)
+}
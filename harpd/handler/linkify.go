@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"mvdan.cc/xurls"
+)
+
+var urlRe = xurls.Strict()
+
+// linkify renders the given text as HTML, turning each absolute http or https
+// URL within it into a link which opens in a new tab. Everything else,
+// including URLs with other schemes (e.g. "javascript:"), is escaped as text.
+func linkify(content string) template.HTML {
+	var b strings.Builder
+	idx := 0
+	for _, m := range urlRe.FindAllStringIndex(content, -1) {
+		lo, hi := m[0], m[1]
+		hi = lo + len(trimURL(content[lo:hi]))
+		href, ok := linkTarget(content[lo:hi])
+		if !ok {
+			// Left to be escaped along with the surrounding text.
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(content[idx:lo]))
+		fmt.Fprintf(&b, `<a href="%s" target="_blank" rel="noopener noreferrer">%s</a>`, template.HTMLEscapeString(href), template.HTMLEscapeString(content[lo:hi]))
+		idx = hi
+	}
+	b.WriteString(template.HTMLEscapeString(content[idx:]))
+	return template.HTML(b.String())
+}
+
+// trimURL trims a URL found in text to exclude characters which are more
+// likely to belong to the surrounding text: anything from the first quote or
+// angle bracket (which commonly delimit URLs), & trailing sentence punctuation
+// or closing parentheses without a matching opening parenthesis.
+func trimURL(u string) string {
+	if i := strings.IndexAny(u, "\"'<>`"); i >= 0 {
+		u = u[:i]
+	}
+	for u != "" {
+		switch c := u[len(u)-1]; {
+		case strings.IndexByte(".,:;!?", c) >= 0:
+			u = u[:len(u)-1]
+		case c == ')' && strings.Count(u, "(") < strings.Count(u, ")"):
+			u = u[:len(u)-1]
+		default:
+			return u
+		}
+	}
+	return u
+}
+
+// linkTarget returns the target of a link to the given URL, as found in text
+// by linkify, or false if it should not be linked. Only absolute http & https
+// URLs are linked.
+func linkTarget(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
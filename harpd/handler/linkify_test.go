@@ -0,0 +1,40 @@
+package handler
+
+import "testing"
+
+func TestLinkify(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc, content string
+		want          string
+	}{
+		{"no URLs", "a <b> & c", "a &lt;b&gt; &amp; c"},
+		{"plain", "https://example.com/path?a=1&b=2",
+			`<a href="https://example.com/path?a=1&amp;b=2" target="_blank" rel="noopener noreferrer">https://example.com/path?a=1&amp;b=2</a>`},
+		{"surrounding text", "see http://example.com or <not>",
+			`see <a href="http://example.com" target="_blank" rel="noopener noreferrer">http://example.com</a> or &lt;not&gt;`},
+		{"several", "http://a.example.com, http://b.example.com",
+			`<a href="http://a.example.com" target="_blank" rel="noopener noreferrer">http://a.example.com</a>, <a href="http://b.example.com" target="_blank" rel="noopener noreferrer">http://b.example.com</a>`},
+		{"adjacent punctuation", "(https://example.com/a).",
+			`(<a href="https://example.com/a" target="_blank" rel="noopener noreferrer">https://example.com/a</a>).`},
+		{"parentheses in URL", "https://en.wikipedia.org/wiki/Go_(language)!",
+			`<a href="https://en.wikipedia.org/wiki/Go_(language)" target="_blank" rel="noopener noreferrer">https://en.wikipedia.org/wiki/Go_(language)</a>!`},
+		{"double quote", `x https://example.com/"onmouseover="alert(1) y`,
+			`x <a href="https://example.com/" target="_blank" rel="noopener noreferrer">https://example.com/</a>&#34;onmouseover=&#34;alert(1) y`},
+		{"single quote", `<a href='https://example.com/'onmouseover='alert(1)'>`,
+			`&lt;a href=&#39;<a href="https://example.com/" target="_blank" rel="noopener noreferrer">https://example.com/</a>&#39;onmouseover=&#39;alert(1)&#39;&gt;`},
+		{"angle brackets", "https://example.com/<script>",
+			`<a href="https://example.com/" target="_blank" rel="noopener noreferrer">https://example.com/</a>&lt;script&gt;`},
+		{"javascript", "javascript:alert(document.cookie)", "javascript:alert(document.cookie)"},
+		{"javascript, uppercase", "JAVASCRIPT://example.com/%0Aalert(1)", "JAVASCRIPT://example.com/%0Aalert(1)"},
+		{"data", "data:text/html,<script>alert(1)</script>", "data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"mailto", "mailto:alice@example.com", "mailto:alice@example.com"},
+		{"unicode", "https://例え.jp/パス",
+			`<a href="https://%E4%BE%8B%E3%81%88.jp/%E3%83%91%E3%82%B9" target="_blank" rel="noopener noreferrer">https://例え.jp/パス</a>`},
+	} {
+		if got := string(linkify(test.content)); got != test.want {
+			t.Errorf("[%s] linkify(%q) = %q, want %q", test.desc, test.content, got, test.want)
+		}
+	}
+}
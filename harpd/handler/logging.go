@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestIDLength is the length of request IDs, in bytes.
+const requestIDLength = 8
+
+// requestIDContextKey is the context key of the ID assigned to a request by
+// the logging handlers.
+type requestIDContextKey struct{}
+
+// loggingHandler is a wrapping handler that logs the IP of the requestor and the path of the request, as well as timing information.
+type loggingHandler struct {
+	h       http.Handler
+	logName string
+}
+
+// NewLogging wraps h so that each request is assigned a request ID and logged
+// as a single human-readable line.
+func NewLogging(logName string, h http.Handler) http.Handler {
+	return loggingHandler{
+		h:       h,
+		logName: logName,
+	}
+}
+
+func (lh loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = withRequestID(w, r)
+	lh.h.ServeHTTP(w, r)
+	logf(r, "[%s] %s requested %s [took %v]", lh.logName, clientIP(r), r.URL.RequestURI(), time.Since(start))
+}
+
+// structuredLoggingHandler is a wrapping handler that logs each request as a
+// JSON object.
+type structuredLoggingHandler struct {
+	h       http.Handler
+	logName string
+
+	mu  sync.Mutex // protects enc
+	enc *json.Encoder
+}
+
+// requestLogEntry is the JSON object written by structuredLoggingHandler for
+// each request.
+type requestLogEntry struct {
+	Time      time.Time `json:"time"`
+	Log       string    `json:"log"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// NewStructuredLogging wraps h so that each request is assigned a request ID
+// and logged to w as a single JSON object on its own line, including the
+// response's status code & size.
+func NewStructuredLogging(logName string, w io.Writer, h http.Handler) http.Handler {
+	return &structuredLoggingHandler{
+		h:       h,
+		logName: logName,
+		enc:     json.NewEncoder(w),
+	}
+}
+
+func (slh *structuredLoggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = withRequestID(w, r)
+	rr := &responseRecorder{ResponseWriter: w}
+	slh.h.ServeHTTP(rr, r)
+	status := rr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	slh.mu.Lock()
+	defer slh.mu.Unlock()
+	if err := slh.enc.Encode(requestLogEntry{
+		Time:      start.UTC(),
+		Log:       slh.logName,
+		RequestID: requestID(r),
+		ClientIP:  clientIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+		Bytes:     rr.size,
+	}); err != nil {
+		log.Printf("Could not write request log entry: %v", err)
+	}
+}
+
+// responseRecorder wraps an http.ResponseWriter, recording the status code &
+// size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int   // zero until the header is written
+	size   int64 // number of bytes of body written
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.status == 0 {
+		rr.status = statusCode
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, so that streamed responses are still
+// streamed when recorded. It does nothing if the wrapped ResponseWriter can't
+// be flushed.
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		if rr.status == 0 {
+			rr.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for use by http.ResponseController.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter { return rr.ResponseWriter }
+
+// withRequestID assigns a new random ID to the given request, returning the
+// request with the ID in its context. The ID is also returned to the client in
+// the X-Request-Id header, so that a failure seen by a user can be matched to
+// the server's logs.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	var idBytes [requestIDLength]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		log.Printf("Could not generate request ID: %v", err)
+		return r
+	}
+	id := hex.EncodeToString(idBytes[:])
+	w.Header().Set("X-Request-Id", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
+
+// requestID returns the ID assigned to the given request by the logging
+// handlers, or "" if none was assigned.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// logf logs in the manner of log.Printf, prefixing the message with the ID of
+// the given request, if it has one, so that messages logged while serving a
+// request can be matched to the request's entry in the request log.
+func logf(r *http.Request, format string, v ...interface{}) {
+	if id := requestID(r); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogging(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc       string
+		h          http.HandlerFunc
+		wantStatus int
+		wantBytes  int
+	}{
+		{
+			desc:       "explicit status",
+			h:          func(w http.ResponseWriter, r *http.Request) { http.Error(w, "I'm a teapot", http.StatusTeapot) },
+			wantStatus: http.StatusTeapot,
+			wantBytes:  len("I'm a teapot\n"),
+		},
+		{
+			desc:       "implicit status",
+			h:          func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("content")) },
+			wantStatus: http.StatusOK,
+			wantBytes:  len("content"),
+		},
+		{
+			desc:       "no content",
+			h:          func(w http.ResponseWriter, r *http.Request) {},
+			wantStatus: http.StatusOK,
+			wantBytes:  0,
+		},
+		{
+			desc: "status written twice",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantStatus: http.StatusNotFound,
+			wantBytes:  0,
+		},
+	} {
+		var buf bytes.Buffer
+		var handlerReqID string
+		h := NewStructuredLogging("test", &buf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerReqID = requestID(r)
+			test.h(w, r)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/path/to/entry?query=secret", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		// The response is passed through unchanged.
+		if w.Code != test.wantStatus || w.Body.Len() != test.wantBytes {
+			t.Errorf("%s: got response with status %d & %d bytes, want status %d & %d bytes", test.desc, w.Code, w.Body.Len(), test.wantStatus, test.wantBytes)
+		}
+
+		// Exactly one JSON object is logged, with the expected fields.
+		if strings.Count(buf.String(), "\n") != 1 {
+			t.Errorf("%s: got log %q, want a single line", test.desc, buf.String())
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+			t.Errorf("%s: could not parse log %q: %v", test.desc, buf.String(), err)
+			continue
+		}
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if got, want := strings.Join(keys, ","), "bytes,client_ip,latency_ms,log,method,path,request_id,status,time"; got != want {
+			t.Errorf("%s: got fields %s, want %s", test.desc, got, want)
+		}
+		var entry requestLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Errorf("%s: could not parse log %q: %v", test.desc, buf.String(), err)
+			continue
+		}
+		if entry.Status != test.wantStatus || entry.Bytes != int64(test.wantBytes) {
+			t.Errorf("%s: logged status %d & %d bytes, want status %d & %d bytes", test.desc, entry.Status, entry.Bytes, test.wantStatus, test.wantBytes)
+		}
+		if entry.Log != "test" || entry.ClientIP != "192.0.2.1" || entry.Method != http.MethodPost || entry.Path != "/path/to/entry" {
+			t.Errorf("%s: logged unexpected request details %+v", test.desc, entry)
+		}
+		if entry.Time.IsZero() || entry.LatencyMS < 0 {
+			t.Errorf("%s: logged unexpected timing %v, %vms", test.desc, entry.Time, entry.LatencyMS)
+		}
+
+		// The request ID is available to the wrapped handler, and to the client.
+		if entry.RequestID == "" || entry.RequestID != handlerReqID || entry.RequestID != w.Header().Get("X-Request-Id") {
+			t.Errorf("%s: logged request ID %q, but handler saw %q & client saw %q", test.desc, entry.RequestID, handlerReqID, w.Header().Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	t.Parallel()
+	seen := map[string]bool{}
+	h := NewLogging("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		if id == "" || seen[id] {
+			t.Errorf("Got empty or duplicate request ID %q", id)
+		}
+		seen[id] = true
+	}))
+	for i := 0; i < 100; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+}
@@ -1,43 +1,105 @@
 package handler
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/BranLwyd/harpocrates/harpd/session"
 )
 
-// logoutHandler handles requests to log out.
+var logoutAllTmpl = newTemplate("logout-all", "templates/logout-all.html")
+
+// logoutHandler handles requests to log out, or to lock the user's session.
 type logoutHandler struct {
-	sh *session.Handler
+	sh     *session.Handler
+	cookie SessionCookie
+	lock   bool // whether the session is locked (see session.Session.Lock) rather than closed
+}
+
+func newLogout(sh *session.Handler, cookie SessionCookie) *logoutHandler {
+	return &logoutHandler{
+		sh:     sh,
+		cookie: cookie,
+	}
 }
 
-func newLogout(sh *session.Handler) *logoutHandler {
+func newLock(sh *session.Handler, cookie SessionCookie) *logoutHandler {
 	return &logoutHandler{
-		sh: sh,
+		sh:     sh,
+		cookie: cookie,
+		lock:   true,
 	}
 }
 
 func (lh logoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Try to get an existing session with the session ID from the user's
 	// cookie; if it doesn't exist, we're already done.
-	sid, err := sessionIDFromRequest(r)
+	sid, err := lh.cookie.sessionID(r)
 	if err != nil {
-		log.Printf("Could not get session ID: %v", err)
+		logf(r, "Could not get session ID: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	sess, err := lh.sh.GetSession(sid)
+	sess, err := lh.sh.GetSessionFor(sid, clientIP(r), r.UserAgent())
 	if err != nil && err != session.ErrNoSession {
-		log.Printf("Could not get session: %v", err)
+		logf(r, "Could not get session: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	if sess == nil {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		redirect(w, r, "/")
 		return
 	}
 
-	sess.Close()
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	if lh.lock {
+		sess.Lock()
+	} else {
+		sess.Close()
+	}
+	redirect(w, r, "/")
+}
+
+// logoutAllHandler handles requests to log out all sessions.
+// It assumes it can get an authenticated session from the request.
+type logoutAllHandler struct {
+	sh     *session.Handler
+	cookie SessionCookie
+}
+
+func newLogoutAll(sh *session.Handler, cookie SessionCookie) *logoutAllHandler {
+	return &logoutAllHandler{
+		sh:     sh,
+		cookie: cookie,
+	}
+}
+
+func (lah logoutAllHandler) authPath(r *http.Request) (string, error) {
+	return authAny, nil
+}
+
+func (lah logoutAllHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	if sess == nil {
+		logf(r, "Could not get authenticated session in logout-all handler")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// If the server has multiple users, only the user's own sessions are closed.
+	switch r.Method {
+	case http.MethodGet:
+		serveTemplate(w, r, logoutAllTmpl, len(userSessions(lah.sh, sess)))
+
+	case http.MethodPost:
+		if r.FormValue("action") != "logout-all" {
+			redirect(w, r, r.URL.RequestURI())
+			return
+		}
+		n := lah.sh.CloseUserSessions(sess.User())
+		logf(r, "Closed all sessions (%d closed)", n)
+		lah.cookie.clear(w)
+		redirect(w, r, "/")
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
 }
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/harpd/metrics"
+)
+
+// metricsHandler serves metrics in the Prometheus text exposition format.
+type metricsHandler struct {
+	reg *metrics.Registry
+}
+
+func newMetrics(reg *metrics.Registry) *metricsHandler {
+	return &metricsHandler{reg: reg}
+}
+
+func (mh metricsHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (mh metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	mh.reg.Handler().ServeHTTP(w, r)
+}
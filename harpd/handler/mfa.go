@@ -2,27 +2,34 @@ package handler
 
 import (
 	"encoding/json"
-	"html/template"
-	"log"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/e3b0c442/warp"
 
-	"github.com/BranLwyd/harpocrates/harpd/assets"
 	"github.com/BranLwyd/harpocrates/harpd/session"
 )
 
-var mfaRegisterTmpl = template.Must(template.New("mfa-register").Parse(string(assets.MustAsset("harpd/assets/templates/mfa-register.html"))))
+var mfaRegisterTmpl = newTemplate("mfa-register", "templates/mfa-register.html")
 
-// registerHandler handles registering a new MFA token.
-// It assumes it can get an authenticated session from the request.
-type registerHandler struct{}
+// registerHandler handles registering a new MFA token, and lists & removes
+// registered MFA tokens. It assumes it can get an authenticated session from
+// the request.
+type registerHandler struct {
+	sh *session.Handler
+}
 
-func newRegister() *registerHandler {
-	return &registerHandler{}
+func newRegister(sh *session.Handler) *registerHandler {
+	return &registerHandler{sh: sh}
 }
 
 func (rh registerHandler) authPath(r *http.Request) (string, error) {
+	// Removing an MFA device requires a fresh MFA assertion, so that a stolen session can't remove
+	// the user's devices.
+	if r.FormValue("remove") != "" {
+		return session.CredentialsPath, nil
+	}
 	// The registration page is available without MFA if there are no MFA registrations.
 	if !sessionFrom(r).HasRegisteredMFADevice() {
 		return "", nil
@@ -33,48 +40,99 @@ func (rh registerHandler) authPath(r *http.Request) (string, error) {
 func (rh registerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sess := sessionFrom(r)
 	if sess == nil {
-		log.Printf("Could not get authenticated session in MFA registration handler")
+		logf(r, "Could not get authenticated session in MFA registration handler")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		c, err := sess.GenerateMFARegistrationChallenge()
-		if err != nil {
-			log.Printf("Could not create MFA registration challenge: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		cBytes, err := json.Marshal(c)
-		if err != nil {
-			log.Printf("Could not marshal MFA registration challenge: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		rh.serveRegisterHTTP(w, r, sess, r.FormValue("remove"))
+
+	case http.MethodPost:
+		if r.FormValue("action") == "remove-credential" {
+			if err := rh.sh.RemoveCredential(sess.User(), r.FormValue("remove")); err != nil && !errors.Is(err, session.ErrNoCredential) {
+				logf(r, "Could not remove MFA device: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			redirect(w, r, "/register")
 			return
 		}
-		serveTemplate(w, r, mfaRegisterTmpl, string(cBytes))
 
-	case http.MethodPost:
 		cred := &warp.AttestationPublicKeyCredential{}
 		if err := json.NewDecoder(r.Body).Decode(cred); err != nil {
-			log.Printf("Could not parse MFA registration response: %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			logf(r, "Could not parse MFA registration response: %v", err)
+			c := bodyErrorStatus(err)
+			http.Error(w, http.StatusText(c), c)
 			return
 		}
 
-		encodedCred, err := sess.CompleteMFARegistration(cred)
-		if err == session.ErrNoChallenge {
-			log.Printf("Got POST to /register without a challenge")
+		c, err := sess.CompleteMFARegistration(strings.TrimSpace(r.URL.Query().Get("label")), cred)
+		if errors.Is(err, session.ErrNoChallenge) {
+			logf(r, "Got POST to /register without a challenge")
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
+		} else if errors.Is(err, session.ErrNoSession) {
+			logf(r, "Session closed after too many failed MFA registrations")
+			http.Error(w, "Too many failed registrations; log in again.", http.StatusUnauthorized)
+			return
 		} else if err != nil {
-			log.Printf("Could not complete MFA registration: %v", err)
+			logf(r, "Could not complete MFA registration: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		newStatic([]byte(encodedCred), "text/plain; charset=utf-8").ServeHTTP(w, r)
+		if !rh.sh.ManagesCredentials() {
+			// The device is usable now, but must be added to the config by
+			// hand to remain registered after a restart.
+			newStatic([]byte(c.Registration), "text/plain; charset=utf-8").ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
+
+// serveRegisterHTTP serves the registration page, listing the user's MFA
+// devices. If removeID is nonempty, the page instead asks the user to confirm
+// removing the device with that ID.
+func (rh registerHandler) serveRegisterHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, removeID string) {
+	creds := rh.sh.Credentials(sess.User())
+	var remove *session.Credential
+	var challenge []byte
+	if removeID != "" {
+		for i := range creds {
+			if creds[i].ID == removeID {
+				remove = &creds[i]
+			}
+		}
+		if remove == nil {
+			redirect(w, r, "/register")
+			return
+		}
+	} else {
+		c, err := sess.GenerateMFARegistrationChallenge()
+		if err != nil {
+			logf(r, "Could not create MFA registration challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if challenge, err = json.Marshal(c); err != nil {
+			logf(r, "Could not marshal MFA registration challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	serveTemplate(w, r, mfaRegisterTmpl, struct {
+		Challenge    string
+		User         string
+		Credentials  []session.Credential
+		Managed      bool
+		Passwordless bool
+		Remove       *session.Credential
+		Origin       string
+		RPID         string
+	}{string(challenge), sess.User(), creds, rh.sh.ManagesCredentials(), rh.sh.PasswordlessEnabled(), remove, sess.Origin(), rh.sh.RelyingPartyID()})
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestRegisterCredentials(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_mfa_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A registration is an all-zero AAGUID, the length-prefixed credential ID, and the public key (here, an empty CBOR map).
+	reg := base64.RawURLEncoding.EncodeToString(append(append(make([]byte, 16), 0, 3), "key\xa0"...))
+	sh, err := session.NewHandler(memVault{&memStore{}}, "https://example.com", []string{reg}, nil, time.Minute, 1000, alert.NewLog(), session.WithCredentialFile(filepath.Join(dir, "credentials")))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	rh := newRegister(sh)
+	const id = "a2V5" // base64url("key")
+
+	newRequest := func(method, target string, form url.Values) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+	}
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		rh.ServeHTTP(resp, newRequest(method, target, form))
+		return resp
+	}
+
+	// Removing a device requires fresh MFA; viewing the devices does not.
+	for _, test := range []struct {
+		method, target string
+		form           url.Values
+		want           string
+	}{
+		{http.MethodGet, "/register", nil, authAny},
+		{http.MethodGet, "/register?remove=" + id, nil, session.CredentialsPath},
+		{http.MethodPost, "/register", url.Values{"action": {"remove-credential"}, "remove": {id}}, session.CredentialsPath},
+	} {
+		if got, err := rh.authPath(newRequest(test.method, test.target, test.form)); err != nil || got != test.want {
+			t.Errorf("authPath(%s %s %v) = %q (error %v), want %q", test.method, test.target, test.form, got, err, test.want)
+		}
+	}
+
+	// Registered devices are listed, and can be removed after confirmation.
+	if resp := do(http.MethodGet, "/register", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Imported from the config") || !strings.Contains(resp.Body.String(), `value="`+id+`"`) {
+		t.Errorf("GET /register: got status %d (%q), want %d listing the device", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if body := do(http.MethodGet, "/register", nil).Body.String(); !strings.Contains(body, "<b>example.com</b>") || !strings.Contains(body, "<code>https://example.com</code>") {
+		t.Errorf("GET /register did not show the relying party ID & origin: %q", body)
+	}
+	if resp := do(http.MethodGet, "/register?remove="+id, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "remove-credential") {
+		t.Errorf("GET /register?remove: got status %d (%q), want %d asking for confirmation", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if resp := do(http.MethodGet, "/register?remove=nope", nil); resp.Code != http.StatusSeeOther {
+		t.Errorf("GET /register?remove with unknown device: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if resp := do(http.MethodPost, "/register", url.Values{"action": {"remove-credential"}, "remove": {id}}); resp.Code != http.StatusSeeOther {
+		t.Errorf("Remove: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if creds := sh.Credentials(""); len(creds) != 0 {
+		t.Errorf("After remove, credentials = %+v, want none", creds)
+	}
+}
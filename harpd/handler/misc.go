@@ -2,35 +2,147 @@ package handler
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/BranLwyd/harpocrates/harpd/accesslog"
 	"github.com/BranLwyd/harpocrates/harpd/assets"
+	"github.com/BranLwyd/harpocrates/harpd/csp"
 )
 
-func serveTemplate(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data interface{}) {
+// templateFuncs must be included in the functions of any template rendered by
+// serveTemplate. The implementations here are placeholders; serveTemplate
+// provides implementations specific to the request being served.
+var templateFuncs = template.FuncMap{
+	"csrfToken": func() string { return "" },
+	"assetURL":  assetURL,
+	"url":       func(p string) string { return p },
+	"prefs":     func() prefs { return defaultPrefs },
+	"cspNonce":  func() string { return "" },
+}
+
+// serveTemplate renders the given template with the given data. Templates
+// rendered by serveTemplate must not be executed directly, and may use the
+// following additional functions:
+//
+//	csrfToken -- the CSRF token of the request's session
+//	assetURL  -- the content-hashed URL of a static asset, e.g. {{assetURL "/style.css"}}
+//	url       -- the URL of an absolute path served by NewContent, e.g. {{url "/logout"}}
+//	prefs     -- the display preferences of the browser, e.g. <body class="{{prefs.Class}}">
+//	cspNonce  -- the Content-Security-Policy nonce of the response, e.g. <script nonce="{{cspNonce}}" ...>
+//
+// Every absolute link in a template must use assetURL or url, so that it
+// includes the base path harpd is served under.
+func serveTemplate(w http.ResponseWriter, r *http.Request, td *templateDef, data interface{}) {
+	serveTemplateStatus(w, r, http.StatusOK, td, data)
+}
+
+// serveTemplateStatus is like serveTemplate, but responds with the given
+// status code.
+func serveTemplateStatus(w http.ResponseWriter, r *http.Request, code int, td *templateDef, data interface{}) {
+	tmpl, err := requestTemplate(r, td)
+	if err != nil {
+		logf(r, "Could not load %q template: %v", td.name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, data); err != nil {
-		log.Printf("Could not execute %q template: %v", tmpl.Name(), err)
+		logf(r, "Could not execute %q template: %v", tmpl.Name(), err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if code != http.StatusOK {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		w.Write(buf.Bytes())
+		return
+	}
 	newStatic(buf.Bytes(), "text/html; charset=utf-8").ServeHTTP(w, r)
 }
 
-func must(h http.Handler, err error) http.Handler {
+// wantsJSON determines if the given request asks for the data of a page as
+// JSON rather than HTML, either with a "format=json" query parameter or by
+// naming application/json (but not text/html) in its Accept header. Unlike
+// acceptsJSON, wildcards don't count, since browsers accept anything when
+// navigating.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	isJSON := false
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json":
+			isJSON = true
+		case "text/html":
+			return false
+		}
+	}
+	return isJSON
+}
+
+// serveJSON serves the given data as JSON, in place of a page, for requests
+// for which wantsJSON is true. Responses are never cached.
+func serveJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	respBytes, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
+		logf(r, "Could not marshal JSON response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(respBytes)
+}
+
+// requestTemplate returns the given template, resolved for the given request
+// (see resolverFrom) & cloned to provide request-specific functions.
+func requestTemplate(r *http.Request, td *templateDef) (*template.Template, error) {
+	rs := resolverFrom(r)
+	tmpl, err := rs.template(td)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl, err = tmpl.Clone(); err != nil {
+		return nil, fmt.Errorf("couldn't clone template: %w", err)
+	}
+	csrfToken := ""
+	if sess := sessionFrom(r); sess != nil {
+		csrfToken = sess.CSRFToken()
 	}
-	return h
+	base, p, nonce := basePath(r), prefsFrom(r), csp.Nonce(r.Context())
+	tmpl.Funcs(template.FuncMap{
+		"csrfToken": func() string { return csrfToken },
+		"assetURL": func(p string) (string, error) {
+			u, err := rs.assetURL(p)
+			return base + u, err
+		},
+		"url":      func(p string) string { return base + p },
+		"prefs":    func() prefs { return p },
+		"cspNonce": func() string { return nonce },
+	})
+	return tmpl, nil
 }
 
 // staticHandler serves static content from memory.
@@ -46,57 +158,184 @@ func newStatic(content []byte, contentType string) staticHandler {
 	}
 }
 
-func newAsset(name, contentType string) (staticHandler, error) {
-	asset, ok := assets.Asset[name]
-	if !ok {
-		return staticHandler{}, fmt.Errorf("no such asset %q", name)
-	}
-	return newStatic(asset, contentType), nil
-}
-
 func (sh staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", sh.contentType)
 	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(sh.content))
 }
 
+// cacheableStaticHandler serves a static asset from memory, with a strong
+// ETag & a precomputed gzip-compressed variant. Requests for the asset's
+// content-hashed URL (see assetURL) may be cached indefinitely; other
+// requests must be revalidated.
 type cacheableStaticHandler struct {
-	sh staticHandler
-
-	tagOnce sync.Once
-	tag     string
+	name        string // name of the asset
+	content     []byte
+	gzipContent []byte // nil if compression doesn't reduce the size of content
+	contentType string
+	hash        string // URL-safe hash of content
 }
 
 func newCacheableAsset(name, contentType string) (*cacheableStaticHandler, error) {
-	sh, err := newAsset(name, contentType)
+	asset, err := fs.ReadFile(assets.FS, name)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("couldn't read asset: %w", err)
+	}
+	return newCacheableStatic(name, asset, contentType)
+}
+
+// newCacheableStatic creates a handler serving the given content of the named
+// asset.
+func newCacheableStatic(name string, asset []byte, contentType string) (*cacheableStaticHandler, error) {
+	h := sha256.Sum256(asset)
+	csh := &cacheableStaticHandler{
+		name:        name,
+		content:     asset,
+		contentType: contentType,
+		hash:        base64.RawURLEncoding.EncodeToString(h[:]),
+	}
+
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create gzip writer: %w", err)
+	}
+	if _, err := gw.Write(asset); err != nil {
+		return nil, fmt.Errorf("couldn't compress %q: %w", name, err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("couldn't compress %q: %w", name, err)
+	}
+	if buf.Len() < len(asset) {
+		csh.gzipContent = buf.Bytes()
 	}
-	csh := &cacheableStaticHandler{sh: sh}
-	go csh.etag() // eagerly compute etag so that it will probably be available by the first request
 	return csh, nil
 }
 
-func (csh cacheableStaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("ETag", csh.etag())
-	csh.sh.ServeHTTP(w, r)
+func mustCacheableAsset(name, contentType string) *cacheableStaticHandler {
+	csh, err := newCacheableAsset(name, contentType)
+	if err != nil {
+		panic(err)
+	}
+	return csh
 }
 
-func (csh cacheableStaticHandler) etag() string {
-	csh.tagOnce.Do(func() {
-		h := sha256.Sum256(csh.sh.content)
-		csh.tag = fmt.Sprintf(`"%s"`, base64.RawURLEncoding.EncodeToString(h[:]))
-	})
-	return csh.tag
+func (csh *cacheableStaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("v") == csh.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", csh.contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// Each encoding is a different representation, so each gets its own
+	// strong ETag. http.ServeContent handles conditional requests.
+	content, etag := csh.content, fmt.Sprintf(`"%s"`, csh.hash)
+	if csh.gzipContent != nil && acceptsEncoding(r, "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		content, etag = csh.gzipContent, fmt.Sprintf(`"%s-gzip"`, csh.hash)
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// acceptsEncoding determines if the given request's Accept-Encoding header
+// accepts the given content coding, either by name or via "*".
+func acceptsEncoding(r *http.Request, coding string) bool {
+	wildcard := false // whether "*" is accepted
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, ae := range strings.Split(v, ",") {
+			name, params := ae, ""
+			if idx := strings.Index(ae, ";"); idx != -1 {
+				name, params = ae[:idx], ae[idx+1:]
+			}
+			name = strings.TrimSpace(name)
+			// A quality value of zero means "not acceptable".
+			ok := true
+			if q := strings.TrimSpace(params); strings.HasPrefix(q, "q=") {
+				if qv, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && qv == 0 {
+					ok = false
+				}
+			}
+			switch {
+			case strings.EqualFold(name, coding):
+				return ok
+			case name == "*":
+				wildcard = ok
+			}
+		}
+	}
+	return wildcard
+}
+
+// assetURL returns the content-hashed URL of the embedded static asset served
+// by NewContent at the given path. Since the URL changes whenever the asset's
+// content does, responses to it may be cached indefinitely.
+func assetURL(p string) (string, error) {
+	return (*resolver)(nil).assetURL(p)
 }
 
-// secureHeaderHandler adds a few security-oriented headers.
+// basePathContextKey is the context key of the base path under which the
+// request is being served, as configured with WithBasePath.
+type basePathContextKey struct{}
+
+// basePathHandler serves a handler under a base path, stripping the base path
+// from requests before they reach it.
+type basePathHandler struct {
+	basePath string
+	h        http.Handler
+}
+
+func newBasePath(basePath string, h http.Handler) http.Handler {
+	return basePathHandler{basePath, http.StripPrefix(basePath, h)}
+}
+
+func (bph basePathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == bph.basePath:
+		http.Redirect(w, r, bph.basePath+"/", http.StatusMovedPermanently)
+		return
+	case !strings.HasPrefix(r.URL.Path, bph.basePath+"/"):
+		// Don't serve e.g. /vaultx when the base path is /vault.
+		http.NotFound(w, r)
+		return
+	}
+	bph.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), basePathContextKey{}, bph.basePath)))
+}
+
+// basePath returns the base path under which the given request is being
+// served, without a trailing slash; it is empty if harpd is served at the
+// root.
+func basePath(r *http.Request) string {
+	bp, _ := r.Context().Value(basePathContextKey{}).(string)
+	return bp
+}
+
+// redirect redirects the request to the given absolute path served by
+// NewContent, which may include a query, under the request's base path.
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	http.Redirect(w, r, basePath(r)+target, http.StatusSeeOther)
+}
+
+// secureHeaderHandler adds a few security-oriented headers, including a
+// Content-Security-Policy allowing scripts carrying a nonce generated for each
+// request. The nonce is available to templates as cspNonce.
 type secureHeaderHandler struct {
-	h http.Handler
+	policy csp.Policy
+	h      http.Handler
 }
 
 func (shh secureHeaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nonce, err := csp.NewNonce()
+	if err != nil {
+		logf(r, "Could not generate Content-Security-Policy nonce: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	r = r.WithContext(csp.NewContext(r.Context(), nonce))
+
 	w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
-	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("Content-Security-Policy", shh.policy.Header(nonce))
 	w.Header().Set("X-Frame-Options", "DENY")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -105,8 +344,10 @@ func (shh secureHeaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	shh.h.ServeHTTP(w, r)
 }
 
-func NewSecureHeader(h http.Handler) http.Handler {
-	return secureHeaderHandler{h}
+// NewSecureHeader wraps h so that its responses carry security-oriented
+// headers, including the given Content-Security-Policy.
+func NewSecureHeader(policy csp.Policy, h http.Handler) http.Handler {
+	return secureHeaderHandler{policy, h}
 }
 
 // filteredHandler filters a handler to only serve one path; anything else is given a 404.
@@ -130,26 +371,217 @@ func (fh filteredHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// loggingHandler is a wrapping handler that logs the IP of the requestor and the path of the request, as well as timing information.
-type loggingHandler struct {
+// bodyReadTimeout bounds the time spent reading a request body limited by
+// limitBody. The server's read timeout, where set, also bounds this; the
+// deadline protects handlers from clients trickling a body slowly to hold a
+// connection open when it is not.
+const bodyReadTimeout = 30 * time.Second
+
+var (
+	// errBodyTooLarge is returned when reading a request body larger than
+	// allowed by limitBody.
+	errBodyTooLarge = errors.New("request body too large")
+
+	// errBodyTimeout is returned when reading a request body after its read
+	// deadline has passed.
+	errBodyTimeout = errors.New("request body read timed out")
+)
+
+// bodyLimitHandler limits the size of request bodies, & the time spent
+// reading them, before running a wrapped handler.
+type bodyLimitHandler struct {
+	h       http.Handler
+	n       int64
+	timeout time.Duration
+}
+
+// limitBody limits the size of request bodies served by the given handler to
+// n bytes, & the time spent reading them to bodyReadTimeout. Form bodies are
+// parsed before the wrapped handler runs, so that oversized or slow forms are
+// refused with a 413 or 408 rather than being seen as missing fields; other
+// bodies return errBodyTooLarge or errBodyTimeout when read (see
+// bodyErrorStatus).
+func limitBody(next http.Handler, n int64) http.Handler {
+	return bodyLimitHandler{next, n, bodyReadTimeout}
+}
+
+func (blh bodyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		blh.h.ServeHTTP(w, r)
+		return
+	}
+	lb := &limitedBody{r: http.MaxBytesReader(w, r.Body, blh.n), n: blh.n, deadline: time.Now().Add(blh.timeout)}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body = lb
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		blh.h.ServeHTTP(w, r2)
+		return
+	}
+	var err error
+	switch mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt {
+	case "application/x-www-form-urlencoded":
+		if r.ContentLength > blh.n {
+			err = errBodyTooLarge
+			break
+		}
+		err = r2.ParseForm()
+	case "multipart/form-data":
+		if r.ContentLength > blh.n {
+			err = errBodyTooLarge
+			break
+		}
+		err = r2.ParseMultipartForm(blh.n)
+	default:
+		blh.h.ServeHTTP(w, r2)
+		return
+	}
+	if err != nil {
+		if lb.err != nil {
+			err = lb.err
+		}
+		logf(r, "Could not parse request body: %v", err)
+		c := bodyErrorStatus(err)
+		http.Error(w, http.StatusText(c), c)
+		return
+	}
+	blh.h.ServeHTTP(w, r2)
+}
+
+// bodyErrorStatus returns the status code to serve for the given error
+// reading a request body: 413 or 408 if the body exceeded the limits set by
+// limitBody, otherwise 400.
+func bodyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errBodyTimeout):
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// limitedBody is a request body limited by limitBody.
+type limitedBody struct {
+	r        io.ReadCloser // body limited by http.MaxBytesReader
+	n        int64
+	deadline time.Time
+
+	read int64
+	err  error // errBodyTooLarge or errBodyTimeout, once either limit is exceeded
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.err != nil {
+		return 0, lb.err
+	}
+	if time.Now().After(lb.deadline) {
+		lb.err = errBodyTimeout
+		return 0, lb.err
+	}
+	n, err := lb.r.Read(p)
+	lb.read += int64(n)
+	if err != nil && err != io.EOF && lb.read >= lb.n {
+		// http.MaxBytesReader's error is not exported; it is the only
+		// error returned once the limit has been read.
+		lb.err = errBodyTooLarge
+		return n, lb.err
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error { return lb.r.Close() }
+
+// recordAccess records an access to the given entry in the given access log,
+// which may be nil. Failures are logged, but otherwise ignored.
+func recordAccess(al *accesslog.Log, r *http.Request, entryPath string, action accesslog.Action) {
+	if al == nil {
+		return
+	}
+	if err := al.Record(entryPath, accesslog.Access{Time: time.Now(), ClientIP: clientIP(r), Action: action}); err != nil {
+		logf(r, "Could not record %s of entry %q in access log: %v", action, entryPath, err)
+	}
+}
+
+// clientIPContextKey is the context key of the client IP determined by the
+// handler returned by NewTrustedProxies, for requests forwarded by a trusted
+// proxy.
+type clientIPContextKey struct{}
+
+// trustedProxyHandler determines the client IP of requests forwarded by
+// trusted reverse proxies.
+type trustedProxyHandler struct {
+	trusted []*net.IPNet
 	h       http.Handler
-	logName string
 }
 
-func NewLogging(logName string, h http.Handler) http.Handler {
-	return loggingHandler{
-		h:       h,
-		logName: logName,
+// NewTrustedProxies wraps h so that requests forwarded by the given trusted
+// reverse proxies are treated as coming from the client named by their
+// X-Forwarded-For header. The header of any other request is ignored, since
+// the client could have set it to anything.
+func NewTrustedProxies(trusted []*net.IPNet, h http.Handler) http.Handler {
+	return trustedProxyHandler{trusted, h}
+}
+
+func (tph trustedProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ip := forwardedClientIP(r, tph.trusted); ip != "" {
+		r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+	}
+	tph.h.ServeHTTP(w, r)
+}
+
+// forwardedClientIP returns the IP of the client which made the given request
+// via the given trusted proxies, according to the request's X-Forwarded-For
+// header. It returns "" if the request was not made by a trusted proxy, or the
+// header names no valid client.
+func forwardedClientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer := net.ParseIP(host); peer == nil || !containsIP(trusted, peer) {
+		return ""
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	// Each proxy appends the address it received the request from, so walk
+	// back from the nearest hop: each trusted proxy vouches for the hop
+	// before it, but anything before an untrusted hop may be forged.
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !containsIP(trusted, ip) {
+			break
+		}
 	}
+	return client
 }
 
-func (lh loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	lh.h.ServeHTTP(w, r)
-	log.Printf("[%s] %s requested %s [took %v]", lh.logName, clientIP(r), r.URL.RequestURI(), time.Since(start))
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+
 	// Strip port from remote address.
 	ra := r.RemoteAddr
 	idx := strings.LastIndex(ra, ":")
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheableAssetConditionalRequests(t *testing.T) {
+	t.Parallel()
+	h := contentAssets["/style.css"]
+
+	resp := doAssetRequest(h, "/style.css", nil)
+	if resp.Code != http.StatusOK || !bytes.Equal(resp.Body.Bytes(), h.content) {
+		t.Fatalf("GET: got status %d with %d bytes, want status %d with %d bytes", resp.Code, resp.Body.Len(), http.StatusOK, len(h.content))
+	}
+	etag := resp.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("GET: got ETag %q, want a strong ETag", etag)
+	}
+	if got := resp.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("GET: got Cache-Control %q, want %q", got, "no-cache")
+	}
+
+	// A matching ETag gets a 304; anything else gets the content.
+	for _, test := range []struct {
+		ifNoneMatch string
+		wantCode    int
+	}{
+		{etag, http.StatusNotModified},
+		{`"stale", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"stale"`, http.StatusOK},
+		{strings.TrimSuffix(etag, `"`) + `-gzip"`, http.StatusOK},
+	} {
+		resp := doAssetRequest(h, "/style.css", http.Header{"If-None-Match": {test.ifNoneMatch}})
+		if resp.Code != test.wantCode {
+			t.Errorf("GET with If-None-Match %q: got status %d, want %d", test.ifNoneMatch, resp.Code, test.wantCode)
+		}
+		if resp.Code == http.StatusNotModified && resp.Body.Len() != 0 {
+			t.Errorf("GET with If-None-Match %q: got %d bytes of content with 304 response", test.ifNoneMatch, resp.Body.Len())
+		}
+	}
+
+	// Content-hashed URLs may be cached indefinitely; stale hashes may not.
+	u, err := assetURL("/style.css")
+	if err != nil {
+		t.Fatalf("Could not get asset URL: %v", err)
+	}
+	if got := doAssetRequest(h, u, nil).Header().Get("Cache-Control"); !strings.Contains(got, "immutable") {
+		t.Errorf("GET %q: got Cache-Control %q, want immutable", u, got)
+	}
+	if got := doAssetRequest(h, "/style.css?v=stale", nil).Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("GET with stale hash: got Cache-Control %q, want %q", got, "no-cache")
+	}
+	if _, err := assetURL("/nonexistent.css"); err == nil {
+		t.Errorf("assetURL of nonexistent asset unexpectedly succeeded")
+	}
+}
+
+func TestCacheableAssetEncoding(t *testing.T) {
+	t.Parallel()
+	h := contentAssets["/style.css"]
+	if h.gzipContent == nil {
+		t.Fatalf("style.css has no compressed variant")
+	}
+
+	for _, test := range []struct {
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"gzip;q=0, *", false},
+	} {
+		resp := doAssetRequest(h, "/style.css", http.Header{"Accept-Encoding": {test.acceptEncoding}})
+		if resp.Code != http.StatusOK {
+			t.Errorf("GET with Accept-Encoding %q: got status %d, want %d", test.acceptEncoding, resp.Code, http.StatusOK)
+			continue
+		}
+		if got := resp.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("GET with Accept-Encoding %q: got Vary %q, want %q", test.acceptEncoding, got, "Accept-Encoding")
+		}
+		gotGzip := resp.Header().Get("Content-Encoding") == "gzip"
+		if gotGzip != test.wantGzip {
+			t.Errorf("GET with Accept-Encoding %q: got gzip = %v, want %v", test.acceptEncoding, gotGzip, test.wantGzip)
+			continue
+		}
+		body := resp.Body.Bytes()
+		if gotGzip {
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("Could not read compressed response: %v", err)
+			}
+			if body, err = ioutil.ReadAll(gr); err != nil {
+				t.Fatalf("Could not decompress response: %v", err)
+			}
+		}
+		if !bytes.Equal(body, h.content) {
+			t.Errorf("GET with Accept-Encoding %q: got unexpected content", test.acceptEncoding)
+		}
+	}
+
+	// The compressed variant has its own ETag, which is honored for conditional requests.
+	resp := doAssetRequest(h, "/style.css", http.Header{"Accept-Encoding": {"gzip"}})
+	etag := resp.Header().Get("ETag")
+	if plainETag := doAssetRequest(h, "/style.css", nil).Header().Get("ETag"); etag == plainETag {
+		t.Errorf("Compressed & uncompressed responses have the same ETag %q", etag)
+	}
+	if resp := doAssetRequest(h, "/style.css", http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}}); resp.Code != http.StatusNotModified {
+		t.Errorf("Conditional GET for compressed content: got status %d, want %d", resp.Code, http.StatusNotModified)
+	}
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	t.Parallel()
+	var trusted []*net.IPNet
+	for _, c := range []string{"10.0.0.0/8", "::1/128"} {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("Could not parse CIDR %q: %v", c, err)
+		}
+		trusted = append(trusted, n)
+	}
+
+	for _, test := range []struct {
+		desc          string
+		remoteAddr    string
+		forwardedFor  []string
+		wantForwarded string
+		wantClientIP  string
+	}{
+		{"direct request", "192.0.2.1:1234", nil, "", "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.7"}, "", "192.0.2.1"},
+		{"trusted peer without header", "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7", "198.51.100.7"},
+		{"trusted IPv6 peer", "[::1]:1234", []string{"2001:db8::7"}, "2001:db8::7", "2001:db8::7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.7, 10.0.0.2", "10.0.0.3"}, "198.51.100.7", "198.51.100.7"},
+		{"forged leftmost entry", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7", "198.51.100.7"},
+		{"forged trusted entry", "10.0.0.1:1234", []string{"10.0.0.5, 198.51.100.7"}, "198.51.100.7", "198.51.100.7"},
+		{"invalid hop", "10.0.0.1:1234", []string{"garbage, 198.51.100.7"}, "198.51.100.7", "198.51.100.7"},
+		{"invalid nearest hop", "10.0.0.1:1234", []string{"198.51.100.7, garbage"}, "", "10.0.0.1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, v := range test.forwardedFor {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := forwardedClientIP(req, trusted); got != test.wantForwarded {
+			t.Errorf("%s: forwardedClientIP got %q, want %q", test.desc, got, test.wantForwarded)
+		}
+
+		var got string
+		NewTrustedProxies(trusted, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got = clientIP(r)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		if got != test.wantClientIP {
+			t.Errorf("%s: clientIP got %q, want %q", test.desc, got, test.wantClientIP)
+		}
+	}
+}
+
+func doAssetRequest(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestLimitBody(t *testing.T) {
+	t.Parallel()
+	const n = 100
+	// The wrapped handler echoes the "v" form field, or the status for its error
+	// reading a non-form body.
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == "application/json" {
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				c := bodyErrorStatus(err)
+				http.Error(w, http.StatusText(c), c)
+				return
+			}
+		}
+		w.Write([]byte(r.FormValue("v")))
+	})
+	multipartBody := func(v string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("v", v)
+		mw.Close()
+		return buf.String(), mw.FormDataContentType()
+	}
+	small, smallType := multipartBody("small")
+	large, largeType := multipartBody(strings.Repeat("x", n+200))
+
+	for _, test := range []struct {
+		desc          string
+		h             http.Handler
+		contentType   string
+		body          string
+		contentLength int64 // if nonzero, overrides the body's length
+		wantCode      int
+		wantBody      string
+	}{
+		{"small form", limitBody(echo, n), "application/x-www-form-urlencoded", "v=small", 0, http.StatusOK, "small"},
+		{"large form", limitBody(echo, n), "application/x-www-form-urlencoded", "v=" + strings.Repeat("x", n), 0, http.StatusRequestEntityTooLarge, ""},
+		{"large form of unknown length", limitBody(echo, n), "application/x-www-form-urlencoded", "v=" + strings.Repeat("x", n), -1, http.StatusRequestEntityTooLarge, ""},
+		{"small multipart form", limitBody(echo, n+200), smallType, small, 0, http.StatusOK, "small"},
+		{"large multipart form", limitBody(echo, n+200), largeType, large, -1, http.StatusRequestEntityTooLarge, ""},
+		{"small JSON", limitBody(echo, n), "application/json", `{"v": "small"}`, 0, http.StatusOK, ""},
+		{"large JSON", limitBody(echo, n), "application/json", `{"v": "` + strings.Repeat("x", n) + `"}`, 0, http.StatusRequestEntityTooLarge, ""},
+		{"slow form", bodyLimitHandler{echo, n, -time.Second}, "application/x-www-form-urlencoded", "v=small", 0, http.StatusRequestTimeout, ""},
+		{"slow JSON", bodyLimitHandler{echo, n, -time.Second}, "application/json", `{"v": "small"}`, 0, http.StatusRequestTimeout, ""},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		if test.contentLength != 0 {
+			req.ContentLength = test.contentLength
+		}
+		resp := httptest.NewRecorder()
+		test.h.ServeHTTP(resp, req)
+		if resp.Code != test.wantCode {
+			t.Errorf("[%s] Got status %d, want %d", test.desc, resp.Code, test.wantCode)
+			continue
+		}
+		if test.wantCode == http.StatusOK && resp.Body.String() != test.wantBody {
+			t.Errorf("[%s] Got body %q, want %q", test.desc, resp.Body.String(), test.wantBody)
+		}
+	}
+}
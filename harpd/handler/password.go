@@ -1,30 +1,52 @@
 package handler
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"path"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/text/collate"
 	"golang.org/x/text/language"
-	"mvdan.cc/xurls"
 
-	"github.com/BranLwyd/harpocrates/harpd/assets"
+	"github.com/BranLwyd/harpocrates/harpd/accesslog"
+	"github.com/BranLwyd/harpocrates/harpd/diffview"
+	"github.com/BranLwyd/harpocrates/harpd/listing"
+	"github.com/BranLwyd/harpocrates/harpd/qr"
+	"github.com/BranLwyd/harpocrates/harpd/random"
 	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/harpd/strength"
+	"github.com/BranLwyd/harpocrates/harpd/totp"
 	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/audit"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+	"github.com/BranLwyd/harpocrates/secret/gitsync"
 )
 
 var (
-	urlRe  = xurls.Strict()
-	lineRe = regexp.MustCompile("^(?s)([^\r\n]*)(?:\r?\n(.*))?$") // two capture groups: first is first line, second is remainder (linebreak between first line & remainder is dropped)
+	// collators holds collators used to sort listings. A collate.Collator
+	// keeps internal buffers, so each may only be used by one goroutine at a
+	// time.
+	collators = sync.Pool{New: func() interface{} { return collate.New(language.English, collate.IgnoreCase) }}
 
 	entryTmplFuncs = map[string]interface{}{
-		"name": path.Base,
+		"add":      func(a, b int) int { return a + b },
+		"name":     path.Base,
+		"qrable":   qrable,
+		"size":     formatSize,
+		"age":      func(t time.Time) string { return formatAge(time.Since(t)) },
+		"strength": strength.Check,
 		"dir": func(entryPath string) string {
 			d := path.Dir(entryPath)
 			if d == "/" {
@@ -32,82 +54,127 @@ var (
 			}
 			return d + "/"
 		},
-		"linkify": func(content string) (template.HTML, error) {
-			var buf bytes.Buffer
-			idx := 0
-			for _, m := range urlRe.FindAllStringIndex(content, -1) {
-				lo, hi := m[0], m[1]
-				url := content[lo:hi]
-				if strings.Contains(url, `"`) {
-					// This URL would break out of the href attribute. Don't linkify.
-					if _, err := buf.WriteString(template.HTMLEscapeString(content[:hi])); err != nil {
-						return "", err
-					}
-					idx = hi
-					continue
-				}
+		"linkify":   linkify,
+		"parentDir": parentDir,
+	}
 
-				if _, err := fmt.Fprintf(&buf, `%s<a href="%s" target="_blank">%s</a>`, template.HTMLEscapeString(content[idx:lo]), url, template.HTMLEscapeString(url)); err != nil {
-					return "", err
-				}
-				idx = hi
-			}
-			if _, err := buf.WriteString(template.HTMLEscapeString(content[idx:])); err != nil {
-				return "", err
-			}
-			return template.HTML(buf.String()), nil
-		},
-		"firstLine": func(x string) string { return lineRe.FindStringSubmatch(x)[1] },
-		"restLines": func(x string) string { return lineRe.FindStringSubmatch(x)[2] },
-		"parentDir": func(dirPath string) string {
-			if dirPath == "/" {
+	entryViewTmpl = newTemplate("entry-view", "templates/entry-view.html", entryTmplFuncs)
+	dirViewTmpl   = newTemplate("directory-view", "templates/directory-view.html", entryTmplFuncs)
+	versionsTmpl  = newTemplate("entry-versions", "templates/entry-versions.html", entryTmplFuncs)
+	trashTmpl     = newTemplate("trash-view", "templates/trash-view.html", entryTmplFuncs)
+
+	treeConfirmTmpl = newTemplate("directory-confirm", "templates/directory-confirm.html", entryTmplFuncs)
+
+	entryConfirmTmpl = newTemplate("entry-confirm", "templates/entry-confirm.html", entryTmplFuncs, template.FuncMap{
+		"diffClass": func(op diffview.Op) string {
+			switch op {
+			case diffview.Insert:
+				return "diff-insert"
+			case diffview.Delete:
+				return "diff-delete"
+			default:
 				return ""
 			}
-			// Call path.Dir twice: the first call just removes the
-			// trailing slash.
-			pd := path.Dir(path.Dir(dirPath))
-			if pd == "/" {
-				return pd
-			}
-			return pd + "/"
 		},
-	}
+	})
+)
+
+const (
+	// trashPath is the path of the trash view, listing deleted entries.
+	trashPath = "/.trash/"
 
-	entryViewTmpl = template.Must(template.New("entry-view").Funcs(entryTmplFuncs).Parse(string(assets.MustAsset("harpd/assets/templates/entry-view.html"))))
-	dirViewTmpl   = template.Must(template.New("directory-view").Funcs(entryTmplFuncs).Parse(string(assets.MustAsset("harpd/assets/templates/directory-view.html"))))
+	// templatesPath is the directory holding entry templates, which are
+	// offered when creating a new entry. See expandTemplate.
+	templatesPath = "/.templates/"
+
+	// templatePasswordLength is the length of passwords generated for
+	// entry templates.
+	templatePasswordLength = 20
+
+	// entryViewAccesses is the number of recent accesses shown when viewing an entry.
+	entryViewAccesses = 10
 )
 
 // passwordHandler handles all password content (i.e. the main UI).
 // It assumes it can get an authenticated session from the request.
-type passwordHandler struct{}
+type passwordHandler struct {
+	al                *accesslog.Log // may be nil, in which case accesses are not logged
+	dirPageSize       int            // maximum entries & subdirectories per directory view page; zero for no pagination
+	attachmentMaxSize int64          // maximum size of an uploaded attachment, in bytes
+	entryMaxSize      int            // maximum size of entry content, in bytes
+	confirmWrites     bool           // whether updates to entries must be confirmed after reviewing the changes
+	expiryWindow      time.Duration  // how soon an entry must expire to be listed on the root directory view
+	fieldsOnly        bool           // whether entry views mask secret fields, fetching their values only when copied or shown
+	previews          bool           // whether directory views may preview the second line of each entry
+	staleAfter        time.Duration  // how long after its last change an entry is marked stale; zero if entries are never marked stale
+}
 
-func newPassword() *passwordHandler {
-	return &passwordHandler{}
+func newPassword(al *accesslog.Log, dirPageSize int, attachmentMaxSize int64, entryMaxSize int, confirmWrites bool, expiryWindow time.Duration, fieldsOnly, previews bool, staleAfter time.Duration) *passwordHandler {
+	return &passwordHandler{al: al, dirPageSize: dirPageSize, attachmentMaxSize: attachmentMaxSize, entryMaxSize: entryMaxSize, confirmWrites: confirmWrites, expiryWindow: expiryWindow, fieldsOnly: fieldsOnly, previews: previews, staleAfter: staleAfter}
+}
+
+// entryDraft holds entry content which was submitted but could not be saved,
+// so that the editor can be shown again without losing the user's changes.
+type entryDraft struct {
+	Content  string
+	Error    string
+	Conflict bool // whether the entry was changed elsewhere since editing began
+
+	baseHash string // hash of the content the draft was based on (see secret.ContentHash)
+	hasBase  bool   // whether baseHash is known; if not, the draft is based on the current content
 }
 
 func (ph passwordHandler) authPath(r *http.Request) (string, error) {
 	// If this is requesting an entry, require multi-factor authentication of this path specifically.
-	// If this is requesting a directory, only require that MFA has been done for some path.
+	// If this is requesting a directory, only require that MFA has been done for some path, or that
+	// the device is trusted.
+	// Deleting or moving a whole directory, or previewing its entries' content, requires multi-factor
+	// authentication of the directory itself.
 	path, isDir := parsePath(r.URL.Path)
+	if isDir && (treeOp(r) != "" || ph.wantsPreviews(r)) {
+		return path, nil
+	}
 	if isDir {
-		return authAny, nil
+		return authBrowse, nil
 	}
 	return path, nil
 }
 
+// bodyMaxSize allows bodies large enough to hold an entry's content or an
+// attachment.
+func (ph passwordHandler) bodyMaxSize(base int64) int64 {
+	n := entryBodyMaxSize(base, ph.entryMaxSize)
+	if a := base + ph.attachmentMaxSize; a > n {
+		n = a
+	}
+	return n
+}
+
 func (ph passwordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sess := sessionFrom(r)
 	if sess == nil {
-		log.Printf("Could not get authenticated session in password handler")
+		logf(r, "Could not get authenticated session in password handler")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	path, isDir := parsePath(r.URL.Path)
 	switch {
+	case path == trashPath:
+		ph.serveTrashHTTP(w, r, sess)
+
+	case isDir && treeOp(r) != "":
+		ph.serveTreeHTTP(w, r, sess, path)
+
+	case isDir && r.Method == http.MethodGet && ph.wantsPreviews(r) && wantsJSON(r):
+		ph.servePreviewsHTTP(w, r, sess, path)
+
 	case isDir && r.Method == http.MethodGet:
 		ph.serveDirectoryViewHTTP(w, r, sess, path)
 
+	case isDir && r.Method == http.MethodPost:
+		ph.serveDirectoryUpdateHTTP(w, r, sess, path)
+
 	case !isDir && r.Method == http.MethodGet:
 		ph.serveEntryViewHTTP(w, r, sess, path)
 
@@ -120,63 +187,1075 @@ func (ph passwordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ph passwordHandler) serveEntryViewHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	vs, hasVersions := secret.AsVersionedStore(sess.GetStore())
+	if _, ok := r.URL.Query()["versions"]; ok && hasVersions {
+		ph.serveEntryVersionsHTTP(w, r, vs, entryPath)
+		return
+	}
+	if _, ok := r.URL.Query()["qr"]; ok {
+		ph.serveEntryQRHTTP(w, r, sess, entryPath)
+		return
+	}
+	if _, ok := r.URL.Query()["attachment"]; ok {
+		ph.serveAttachmentHTTP(w, r, sess, entryPath)
+		return
+	}
+	if _, ok := r.URL.Query()["field"]; ok {
+		ph.serveEntryFieldHTTP(w, r, sess, entryPath)
+		return
+	}
+	ph.serveEntryHTTP(w, r, sess, entryPath, http.StatusOK, nil)
+}
+
+// serveEntryHTTP serves the view of an entry. If draft is non-nil, the editor
+// is shown holding the draft content rather than the entry's current content.
+func (ph passwordHandler) serveEntryHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string, code int, draft *entryDraft) {
 	// Get entry content & serve based on whether the entry exists or not.
 	content, err := sess.GetStore().Get(entryPath)
-	if err == secret.ErrNoEntry {
+	if errors.Is(err, secret.ErrNoEntry) {
 		content = ""
 	} else if err != nil {
-		log.Printf("Could not get entry %q in password handler: %v", entryPath, err)
+		logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// If the entry holds an OTP seed, generate the current code. The code is
+	// only rendered, never written back to the store.
+	e := entry.Parse(content)
+	var otp *otpCode
+	if e.OTP != "" {
+		k, err := totp.Parse(e.OTP)
+		if err != nil {
+			logf(r, "Could not parse OTP seed of entry %q in password handler: %v", entryPath, err)
+		} else {
+			code, expiresIn := k.Code(time.Now())
+			otp = &otpCode{code, int(expiresIn.Round(time.Second) / time.Second)}
+		}
+	}
+
+	// Show previous accesses, then log this one.
+	var accesses []accesslog.Access
+	if ph.al != nil && content != "" {
+		accesses = ph.al.Recent(entryPath, entryViewAccesses)
+		if draft == nil {
+			recordAccess(ph.al, r, entryPath, accesslog.View)
+		}
+	}
+
+	// If the entry was just saved with a password used by other entries, warn about it.
+	var reusedBy []string
+	if _, ok := r.URL.Query()["reused"]; ok && content != "" {
+		if reusedBy, err = audit.SharingPassword(sess.GetStore(), entryPath); err != nil {
+			logf(r, "Could not check for reuse of password of entry %q: %v", entryPath, err)
+		}
+	}
+	// Likewise if it was just saved with a weak password. (The template checks the password's
+	// strength again, describing how weak it is.)
+	_, weak := r.URL.Query()["weak"]
+	weak = weak && content != ""
+
+	// Entries may be pinned as favorites, if the store allows it.
+	var favorite bool
+	canFavorite := content != "" && !secret.IsReadOnly(sess.GetStore(), secret.FavoritesEntry)
+	if canFavorite {
+		if favorite, err = secret.IsFavorite(sess.GetStore(), entryPath); err != nil {
+			logf(r, "Could not check if entry %q is a favorite: %v", entryPath, err)
+		}
+	}
+
+	as, hasAttachments := secret.AsAttachmentStore(sess.GetStore())
+	var attachments []string
+	if hasAttachments && content != "" {
+		if attachments, err = as.ListAttachments(entryPath); err != nil {
+			logf(r, "Could not list attachments of entry %q in password handler: %v", entryPath, err)
+		}
+	}
+
+	// Offer templates when creating a new entry.
+	var templates []entryTemplate
+	if content == "" && !secret.IsReadOnly(sess.GetStore(), entryPath) {
+		if templates, err = entryTemplates(sess.GetStore(), entryPath); err != nil {
+			logf(r, "Could not get entry templates for entry %q in password handler: %v", entryPath, err)
+		}
+	}
+
+	// Suggest a generated password only when creating a new entry, or if asked, so that views of
+	// existing entries don't generate passwords which are never used.
+	_, suggest := r.URL.Query()["suggest"]
+	suggest = (suggest || content == "") && !secret.IsReadOnly(sess.GetStore(), entryPath)
+
+	var expiry string
+	if expires, ok := e.Expiration(); ok {
+		expiry = expiryStatus(expires, time.Now(), ph.expiryWindow)
+	}
+	var modTime time.Time
+	if ss, ok := secret.AsStatStore(sess.GetStore()); ok && content != "" {
+		if info, err := ss.Stat(entryPath); err != nil {
+			logf(r, "Could not stat entry %q in password handler: %v", entryPath, err)
+		} else {
+			modTime = info.ModTime
+		}
+	}
+	changed := e.LastChanged(modTime)
+
+	// The editor is based on the entry's current content, unless it holds a draft based on
+	// earlier content. The base is submitted with the editor's content, so that changes made
+	// elsewhere in the meantime are not silently overwritten.
+	baseHash := ""
+	if content != "" {
+		baseHash = secret.ContentHash(content)
+	}
+	conflict := draft != nil && draft.Conflict
+	if draft != nil && draft.hasBase && !conflict {
+		baseHash = draft.baseHash
+	}
+
+	// In fields-only mode, secret fields are masked, and the entry's content is left out of the
+	// page entirely, unless it is being edited. New entries have no content to leave out.
+	_, editing := r.URL.Query()["edit"]
+	fieldsOnly := ph.fieldsOnly && !editing && draft == nil && content != ""
+
+	_, hasVersions := secret.AsVersionedStore(sess.GetStore())
+	_, hasTrash := secret.AsTrashStore(sess.GetStore())
+	serveTemplateStatus(w, r, code, entryViewTmpl, struct {
+		Path              string
+		FieldsOnly        bool // whether secret fields are masked; if so, Content must not be rendered
+		Content           string
+		BaseHash          string
+		Draft             *entryDraft
+		Conflict          bool
+		Entry             entry.Entry
+		OTP               *otpCode
+		HasVersions       bool
+		HasTrash          bool
+		HasAttachments    bool
+		ReadOnly          bool
+		ReusedBy          []string
+		WeakPassword      bool
+		Favorite          bool
+		CanFavorite       bool
+		Notes             []noteLine
+		Attachments       []string
+		AttachmentMaxSize int64
+		Expiry            string    // see expiryStatus
+		Changed           time.Time // zero if unknown
+		Stale             bool      // see isStale
+		ExpiresAt         time.Time
+		Deadline          time.Time // zero if the session's lifetime is not limited
+		Accesses          []accesslog.Access
+		Templates         []entryTemplate
+		Suggest           bool // whether to show the password generator
+		CanLock           bool
+	}{entryPath, fieldsOnly, content, baseHash, draft, conflict, e, otp, hasVersions, hasTrash, hasAttachments, secret.IsReadOnly(sess.GetStore(), entryPath), reusedBy, weak, favorite, canFavorite, noteLines(content, e), attachments, ph.attachmentMaxSize, expiry, changed, isStale(changed, time.Now(), ph.staleAfter), sess.ExpiresAt(), sess.AbsoluteDeadline(), accesses, templates, suggest, sess.SoftLockable()})
+}
+
+// serveAttachmentHTTP serves the attachment of an entry named by the
+// "attachment" query parameter, as a download.
+func (ph passwordHandler) serveAttachmentHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	as, ok := secret.AsAttachmentStore(sess.GetStore())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	filename := r.URL.Query().Get("attachment")
+	content, err := as.GetAttachment(entryPath, filename)
+	if errors.Is(err, secret.ErrNoEntry) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "Could not get attachment %q of entry %q in password handler: %v", filename, entryPath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	recordAccess(ph.al, r, entryPath, accesslog.View)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(content)
+}
 
-	serveTemplate(w, r, entryViewTmpl, struct {
-		Path    string
-		Content string
-	}{entryPath, content})
+// entryFields are the fields of an entry which can be served by
+// serveEntryFieldHTTP, by name.
+var entryFields = map[string]func(entry.Entry) string{
+	"password": func(e entry.Entry) string { return e.Password },
+	"username": func(e entry.Entry) string { return e.Username },
+	"url":      func(e entry.Entry) string { return e.URL },
+	"otp":      func(e entry.Entry) string { return e.OTP },
+	"notes":    func(e entry.Entry) string { return e.Notes },
 }
 
-func (ph passwordHandler) serveEntryUpdateHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
-	// Check action type.
-	if r.FormValue("action") != "update-entry" {
-		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+// serveEntryFieldHTTP serves the value of the field of an entry named by the
+// "field" query parameter, as plain text. It allows the entry view to copy or
+// show a field without the field's value being part of the page.
+func (ph passwordHandler) serveEntryFieldHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	field, ok := entryFields[r.URL.Query().Get("field")]
+	if !ok {
+		http.Error(w, "Invalid field.", http.StatusBadRequest)
+		return
+	}
+	content, err := sess.GetStore().Get(entryPath)
+	if errors.Is(err, secret.ErrNoEntry) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	val := field(entry.Parse(content))
+	if val == "" {
+		http.NotFound(w, r)
+		return
+	}
+	recordAccess(ph.al, r, entryPath, accesslog.View)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.WriteString(w, val)
+}
+
+// formatSize formats a size in bytes for display, e.g. "1 MiB".
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		size int64
+		name string
+	}{{1 << 30, "GiB"}, {1 << 20, "MiB"}, {1 << 10, "KiB"}} {
+		if n >= u.size && n%u.size == 0 {
+			return fmt.Sprintf("%d %s", n/u.size, u.name)
+		}
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// formatAge formats a duration for display as an age, e.g. "3 days".
+func formatAge(d time.Duration) string {
+	for _, u := range []struct {
+		d    time.Duration
+		name string
+	}{{365 * 24 * time.Hour, "year"}, {24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}} {
+		if n := d / u.d; n == 1 {
+			return "1 " + u.name
+		} else if n > 1 {
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+	}
+	return "less than a minute"
+}
+
+// noteLine is a line of an entry's notes, as served to the user.
+type noteLine struct {
+	Text   string
+	QRLine int // line number of this line in the entry's content if it can be shown as a QR code, otherwise zero
+}
+
+// noteLines splits the notes of the given entry into lines, finding the line
+// numbers of those which can be shown as QR codes.
+func noteLines(content string, e entry.Entry) []noteLine {
+	if e.Notes == "" {
+		return nil
+	}
+	lines := contentLines(content)
+	var nls []noteLine
+	idx := 1 // notes never include the first line, which is the password
+	for _, n := range strings.Split(e.Notes, "\n") {
+		// Notes are in the same order as the content lines they come from.
+		for idx < len(lines) && lines[idx] != n {
+			idx++
+		}
+		nl := noteLine{Text: n}
+		if idx < len(lines) && qrable(n) {
+			nl.QRLine = idx + 1
+		}
+		nls = append(nls, nl)
+		idx++
+	}
+	return nls
+}
+
+// serveEntryQRHTTP serves a QR code of the line of an entry given by the
+// "line" query parameter, counting from one. If no line is given, the entry's
+// OTP seed is served, if it is an otpauth:// URI.
+func (ph passwordHandler) serveEntryQRHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	content, err := sess.GetStore().Get(entryPath)
+	if errors.Is(err, secret.ErrNoEntry) {
+		http.Error(w, fmt.Sprintf("No entry for %s.", entryPath), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var data string
+	if l := r.URL.Query().Get("line"); l != "" {
+		lines := contentLines(content)
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > len(lines) {
+			http.Error(w, "Invalid line.", http.StatusBadRequest)
+			return
+		}
+		data = lines[n-1]
+	} else if e := entry.Parse(content); strings.HasPrefix(e.OTP, "otpauth://") {
+		data = e.OTP
+	}
+	if data == "" {
+		http.Error(w, "Nothing to show as a QR code.", http.StatusNotFound)
+		return
+	}
+
+	code, err := qr.Encode(data)
+	if errors.Is(err, qr.ErrTooLong) {
+		http.Error(w, "Line is too long to show as a QR code.", http.StatusBadRequest)
 		return
 	}
+	if err != nil {
+		logf(r, "Could not encode QR code for entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	recordAccess(ph.al, r, entryPath, accesslog.View)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(code.SVG())
+}
+
+// contentLines splits entry content into lines, without line endings.
+func contentLines(content string) []string {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
+// qrable determines if the given line of entry content is worth offering to
+// show as a QR code, i.e. if it is an otpauth:// URI or Wi-Fi network
+// configuration.
+func qrable(line string) bool {
+	return strings.HasPrefix(line, "otpauth://") || strings.HasPrefix(line, "WIFI:")
+}
 
-	// Update entry content.
-	if content := r.FormValue("content"); content != "" {
-		if err := sess.GetStore().Put(entryPath, content); err != nil {
-			log.Printf("Could not update entry content: %v", err)
+// otpCode is a one-time password code, as served to the user.
+type otpCode struct {
+	Code      string `json:"code"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+func (ph passwordHandler) serveEntryVersionsHTTP(w http.ResponseWriter, r *http.Request, vs secret.VersionedStore, entryPath string) {
+	versions, err := vs.Versions(entryPath)
+	if err != nil {
+		logf(r, "Could not get versions of entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// If a specific version was requested, get its content.
+	var content string
+	id := r.URL.Query().Get("versions")
+	if id != "" {
+		content, err = vs.GetVersion(entryPath, id)
+		if errors.Is(err, secret.ErrNoEntry) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			logf(r, "Could not get version %q of entry %q in password handler: %v", id, entryPath, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-	} else {
-		if err := sess.GetStore().Delete(entryPath); err != nil && err != secret.ErrNoEntry {
-			log.Printf("Could not delete entry content: %v", err)
+	}
+
+	serveTemplate(w, r, versionsTmpl, struct {
+		Path     string
+		Versions []secret.Version
+		ID       string
+		Content  string
+	}{entryPath, versions, id, content})
+}
+
+func (ph passwordHandler) serveEntryUpdateHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	switch r.FormValue("action") {
+	case "update-entry":
+		if secret.IsReadOnly(sess.GetStore(), entryPath) {
+			http.Error(w, fmt.Sprintf("%s is read-only.", entryPath), http.StatusForbidden)
+			return
+		}
+
+		// Content which is too large is shown to the user again, rather than being discarded.
+		content := r.FormValue("content")
+		baseHash, hasBase := r.FormValue("base_hash"), r.Form["base_hash"] != nil
+		tooLarge := &entryDraft{Content: content, Error: fmt.Sprintf("Entries may be at most %s. Your changes have not been saved.", formatSize(int64(ph.entryMaxSize))), baseHash: baseHash, hasBase: hasBase}
+		if len(content) > ph.entryMaxSize {
+			ph.serveEntryHTTP(w, r, sess, entryPath, http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+
+		// If the entry has changed since the content was loaded into the editor, show both
+		// versions & let the user pick one, rather than silently overwriting the other change.
+		conflict := &entryDraft{Content: content, Error: fmt.Sprintf("%s was changed elsewhere since you started editing; its current content is shown above. Your changes have not been saved. Save them again to replace the current content, or keep it.", path.Base(entryPath)), Conflict: true}
+		if hasBase {
+			if err := secret.CheckContent(sess.GetStore(), entryPath, baseHash); errors.Is(err, secret.ErrConflict) {
+				ph.serveEntryHTTP(w, r, sess, entryPath, http.StatusConflict, conflict)
+				return
+			} else if err != nil {
+				logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// If writes must be confirmed, show the changes to be made instead, unless they have been
+		// confirmed against the entry's current content.
+		if ph.confirmWrites && !ph.confirmedUpdate(w, r, sess, entryPath, content, baseHash, hasBase) {
+			return
+		}
+
+		// Update entry content. If the content's base is known, it is checked again atomically
+		// with the write.
+		if content != "" {
+			// Keep the entry's changed field up to date, if it is maintained.
+			stamped, err := ph.stamp(sess, entryPath, content)
+			if err != nil {
+				logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			content = stamped
+			put := sess.GetStore().Put
+			if hasBase {
+				put = func(entry, content string) error { return secret.PutIf(sess.GetStore(), entry, content, baseHash) }
+			}
+			if err := put(entryPath, content); errors.Is(err, secret.ErrEntryTooLarge) {
+				ph.serveEntryHTTP(w, r, sess, entryPath, http.StatusRequestEntityTooLarge, tooLarge)
+				return
+			} else if errors.Is(err, secret.ErrConflict) {
+				ph.serveEntryHTTP(w, r, sess, entryPath, http.StatusConflict, conflict)
+				return
+			} else if err != nil {
+				logf(r, "Could not update entry content: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			recordAccess(ph.al, r, entryPath, accesslog.Update)
+
+			// Warn (without blocking the update) if the password is already used by another entry, or
+			// is weak.
+			var warnings []string
+			if others, err := audit.SharingPassword(sess.GetStore(), entryPath); err != nil {
+				logf(r, "Could not check for reuse of password of entry %q: %v", entryPath, err)
+			} else if len(others) > 0 {
+				warnings = append(warnings, "reused")
+			}
+			if pw := entry.Parse(content).Password; pw != "" && strength.Check(pw).Weak() {
+				warnings = append(warnings, "weak")
+			}
+			if len(warnings) > 0 {
+				redirect(w, r, (&url.URL{Path: r.URL.Path, RawQuery: strings.Join(warnings, "&")}).String())
+				return
+			}
+		} else {
+			// Empty content deletes the entry. (If the store has a trash, the entry is moved there, and
+			// can be restored from the trash view.)
+			switch err := sess.GetStore().Delete(entryPath); {
+			case err == nil:
+				recordAccess(ph.al, r, entryPath, accesslog.Delete)
+			case errors.Is(err, secret.ErrNoEntry):
+			default:
+				logf(r, "Could not delete entry content: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Display new content to user.
+		// (We redirect to an equivalent GET request rather than just rendering in this request to allow refreshes.
+		// The query is dropped, so that e.g. a new entry's edit view is not shown again.)
+		redirect(w, r, (&url.URL{Path: r.URL.Path}).String())
+
+	case "move-entry":
+		// Re-check the destination path the same way request paths are checked.
+		dst, isDir := parsePath(r.FormValue("destination"))
+		if isDir || !strings.HasPrefix(dst, "/") || dst == entryPath {
+			http.Error(w, "Invalid destination.", http.StatusBadRequest)
+			return
+		}
+		for _, p := range []string{entryPath, dst} {
+			if secret.IsReadOnly(sess.GetStore(), p) {
+				http.Error(w, fmt.Sprintf("%s is read-only.", p), http.StatusForbidden)
+				return
+			}
+		}
+
+		switch err := sess.GetStore().Move(entryPath, dst); {
+		case err == nil:
+			if ph.al != nil {
+				if err := ph.al.Move(entryPath, dst); err != nil {
+					logf(r, "Could not move access log of entry %q: %v", entryPath, err)
+				}
+			}
+			redirect(w, r, dst)
+		case errors.Is(err, secret.ErrNoEntry):
+			http.Error(w, fmt.Sprintf("No entry for %s.", entryPath), http.StatusNotFound)
+		case errors.Is(err, secret.ErrEntryExists):
+			http.Error(w, fmt.Sprintf("An entry already exists at %s.", dst), http.StatusConflict)
+		case errors.Is(err, secret.ErrCrossMount):
+			http.Error(w, "Entries can't be moved between vaults.", http.StatusBadRequest)
+		default:
+			logf(r, "Could not move entry: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+
+	case "put-attachment", "delete-attachment":
+		ph.serveAttachmentUpdateHTTP(w, r, sess, entryPath)
+
+	case "toggle-favorite":
+		// The desired state is posted, rather than toggling the current state, so that a resubmitted
+		// form has no further effect.
+		switch err := secret.SetFavorite(sess.GetStore(), entryPath, r.FormValue("favorite") == "1"); {
+		case err == nil:
+			redirect(w, r, r.URL.Path)
+		case errors.Is(err, secret.ErrReadOnly):
+			http.Error(w, "Favorites are read-only.", http.StatusForbidden)
+		default:
+			logf(r, "Could not update favorites: %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+
+	case "share-entry":
+		// The share link is rendered directly, rather than redirecting, so that it is shown only once.
+		token, expiresAt, err := sess.CreateShare(entryPath)
+		if errors.Is(err, secret.ErrNoEntry) {
+			http.Error(w, fmt.Sprintf("No entry for %s.", entryPath), http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			logf(r, "Could not create share of entry %q: %v", entryPath, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		serveTemplate(w, r, shareCreatedTmpl, struct {
+			Path      string
+			URL       string
+			ExpiresAt time.Time
+		}{entryPath, fmt.Sprintf("https://%s%s/share/%s", r.Host, basePath(r), token), expiresAt})
+
+	default:
+		redirect(w, r, r.URL.RequestURI())
+	}
+}
+
+// stamp returns the given content, to be saved to the given entry, with its
+// changed field updated if the content differs from the entry's current
+// content (see entry.Stamp). The field is maintained if staleness is tracked,
+// or if the current content already holds it.
+func (ph passwordHandler) stamp(sess *session.Session, entryPath, content string) (string, error) {
+	current, err := sess.GetStore().Get(entryPath)
+	if err != nil && !errors.Is(err, secret.ErrNoEntry) {
+		return "", err
+	}
+	if ph.staleAfter == 0 && entry.Parse(current).Changed == "" {
+		return content, nil
+	}
+	return entry.Stamp(current, content, time.Now()), nil
+}
+
+// serveAttachmentUpdateHTTP handles requests to add or remove attachments of
+// an entry.
+// diffContext is the number of unchanged lines shown around each change when
+// confirming an update to an entry.
+const diffContext = 3
+
+// confirmedUpdate determines if an update of the given entry to the given
+// content has been confirmed by the user, against the entry's current
+// content. If not, it serves a page showing the changes to be made, asking
+// the user to confirm them.
+func (ph passwordHandler) confirmedUpdate(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath, content, baseHash string, hasBase bool) bool {
+	current, err := sess.GetStore().Get(entryPath)
+	if err != nil && !errors.Is(err, secret.ErrNoEntry) {
+		logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	base := secret.ContentHash(current)
+	_, confirming := r.Form["confirm"]
+	if confirming && r.FormValue("base") == base {
+		return true
+	}
+
+	// If the changes were confirmed against content which has since changed, show the changes
+	// against the new content rather than silently overwriting it.
+	serveTemplate(w, r, entryConfirmTmpl, struct {
+		Path     string
+		Hunks    []diffview.Hunk
+		Content  string
+		Base     string
+		Changed  bool
+		BaseHash string
+		HasBase  bool
+	}{entryPath, diffview.Unified(current, content, diffContext), content, base, confirming, baseHash, hasBase})
+	return false
+}
+
+func (ph passwordHandler) serveAttachmentUpdateHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, entryPath string) {
+	as, ok := secret.AsAttachmentStore(sess.GetStore())
+	if !ok {
+		http.Error(w, "Attachments are not supported by this vault.", http.StatusBadRequest)
+		return
+	}
+	if secret.IsReadOnly(sess.GetStore(), entryPath) {
+		http.Error(w, fmt.Sprintf("%s is read-only.", entryPath), http.StatusForbidden)
+		return
 	}
 
-	// Display new content to user.
-	// (We redirect to an equivalent GET request rather than just rendering in this request to allow refreshes.)
-	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	var err error
+	if r.FormValue("action") == "put-attachment" {
+		f, fh, ferr := r.FormFile("attachment")
+		if ferr != nil {
+			http.Error(w, "Missing attachment.", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		// Browsers send only the base name of the file, but other clients might not.
+		filename := fh.Filename[strings.LastIndexAny(fh.Filename, `/\`)+1:]
+		if filename == "" || filename == "." || filename == ".." {
+			http.Error(w, "Invalid attachment filename.", http.StatusBadRequest)
+			return
+		}
+		if fh.Size > ph.attachmentMaxSize {
+			http.Error(w, fmt.Sprintf("Attachments may be at most %s.", formatSize(ph.attachmentMaxSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		content, rerr := ioutil.ReadAll(io.LimitReader(f, ph.attachmentMaxSize+1))
+		if rerr != nil {
+			logf(r, "Could not read uploaded attachment: %v", rerr)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if int64(len(content)) > ph.attachmentMaxSize {
+			http.Error(w, fmt.Sprintf("Attachments may be at most %s.", formatSize(ph.attachmentMaxSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = as.PutAttachment(entryPath, filename, content)
+	} else {
+		err = as.DeleteAttachment(entryPath, r.FormValue("filename"))
+	}
+	switch {
+	case err == nil:
+		recordAccess(ph.al, r, entryPath, accesslog.Update)
+		redirect(w, r, r.URL.RequestURI())
+	case errors.Is(err, secret.ErrNoEntry):
+		http.Error(w, fmt.Sprintf("No entry or attachment for %s.", entryPath), http.StatusNotFound)
+	default:
+		logf(r, "Could not update attachments of entry %q: %v", entryPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
 }
 
 func (ph passwordHandler) serveDirectoryViewHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, dirPath string) {
-	pathEntries, err := sess.GetStore().List()
+	entries, subdirs, err := listDir(sess.GetStore(), dirPath)
 	if err != nil {
-		log.Printf("Could not get entry list in password handler: %v", err)
+		logf(r, "Could not list directory %q in password handler: %v", dirPath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	sortListing(entries)
+	sortListing(subdirs)
 
-	// Find direct subdirectories and entries.
-	var entries []string
-	var subdirs []string
+	// If this directory is nonexistent, forward to the parent directory (assuming we aren't already at the root directory).
+	if dirPath != "/" && len(subdirs) == 0 && len(entries) == 0 {
+		exists, err := dirExists(sess.GetStore(), dirPath)
+		if err != nil {
+			logf(r, "Could not list parent of directory %q in password handler: %v", dirPath, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			if wantsJSON(r) {
+				http.NotFound(w, r)
+				return
+			}
+			redirect(w, r, parentDir(dirPath))
+			return
+		}
+	}
+
+	// Paginate, if requested. Subdirectories are listed before entries.
+	page, pageCount := 1, 1
+	if ph.dirPageSize > 0 {
+		if p := r.URL.Query().Get("page"); p != "" {
+			if page, err = strconv.Atoi(p); err != nil || page < 1 {
+				http.Error(w, "Invalid page.", http.StatusBadRequest)
+				return
+			}
+		}
+		if n := len(subdirs) + len(entries); n > ph.dirPageSize {
+			pageCount = (n + ph.dirPageSize - 1) / ph.dirPageSize
+		}
+		if page > pageCount {
+			page = pageCount
+		}
+		subdirs, entries = paginate(subdirs, entries, (page-1)*ph.dirPageSize, ph.dirPageSize)
+	}
+	if wantsJSON(r) {
+		subdirPaths := make([]string, 0, len(subdirs))
+		for _, sd := range subdirs {
+			subdirPaths = append(subdirPaths, sd+"/")
+		}
+		serveJSON(w, r, listing.Directory{
+			Path:           dirPath,
+			Subdirectories: subdirPaths,
+			Entries:        listingEntries(sess.GetStore(), entries),
+			Page:           page,
+			PageCount:      pageCount,
+		})
+		return
+	}
+
+	// Render entries/subdirectories.
+	_, canSync := syncStore(sess)
+	canSync = canSync && !secret.IsReadOnly(sess.GetStore(), "/")
+	_, hasTrash := secret.AsTrashStore(sess.GetStore())
+	_, hasEmptyDirs := secret.AsEmptyDirStore(sess.GetStore())
+	now := time.Now()
+	var favorites []string
+	var expiring []dirEntry
+	if dirPath == "/" {
+		if favorites, err = secret.Favorites(sess.GetStore()); err != nil {
+			logf(r, "Could not get favorites: %v", err)
+		}
+		exps, err := sess.ExpiringEntries(ph.expiryWindow)
+		if err != nil {
+			logf(r, "Could not get expiring entries: %v", err)
+		}
+		for _, e := range exps {
+			expiring = append(expiring, dirEntry{Path: e.Entry, Expires: e.Date, Expiry: expiryStatus(e.Date, now, ph.expiryWindow)})
+		}
+	}
+
+	// Mark entries which have expired, or will soon.
+	des := statEntries(sess.GetStore(), entries)
+	if len(des) > 0 {
+		exps, err := audit.Expirations(sess.GetStore())
+		if err != nil {
+			logf(r, "Could not get expiration dates: %v", err)
+		}
+		expires := map[string]time.Time{}
+		for _, e := range exps {
+			expires[e.Entry] = e.Date
+		}
+		changes, err := audit.ChangeTimes(sess.GetStore())
+		if err != nil {
+			logf(r, "Could not get change times: %v", err)
+		}
+		for i := range des {
+			des[i].Expires = expires[des[i].Path]
+			des[i].Expiry = expiryStatus(des[i].Expires, now, ph.expiryWindow)
+			if t, ok := changes[des[i].Path]; ok {
+				des[i].Changed = t
+			}
+			des[i].Stale = isStale(des[i].Changed, now, ph.staleAfter)
+		}
+	}
+	previewable := ph.previews && canPreview(sess.GetStore())
+	serveTemplate(w, r, dirViewTmpl, struct {
+		Path           string
+		Favorites      []string
+		Expiring       []dirEntry
+		Entries        []dirEntry
+		Subdirectories []string
+		CanSync        bool
+		CanCreate      bool
+		CanCreateDir   bool
+		CanManage      bool
+		HasTrash       bool
+		Page           int
+		PageCount      int
+		Vaults         []session.VaultStatus
+		CanLock        bool
+		CanPreview     bool
+		Previews       bool
+		PreviewBatch   int
+	}{dirPath, favorites, expiring, des, subdirs, canSync, !secret.IsReadOnly(sess.GetStore(), dirPath), hasEmptyDirs && !secret.IsReadOnly(sess.GetStore(), dirPath), dirPath != "/" && !secret.IsReadOnly(sess.GetStore(), dirPath), hasTrash, page, pageCount, sess.Vaults(), sess.SoftLockable(), previewable, previewable && ph.wantsPreviews(r), previewBatchSize})
+}
+
+// previewBatchSize is the maximum number of entries previewed by a single
+// request.
+const previewBatchSize = 20
+
+// previewMask stands in for the first line of an entry, which holds its
+// password, in previews. It doesn't depend on the line's length.
+const previewMask = "••••••••"
+
+// previewMaxLength is the maximum length, in runes, of the line of an entry
+// shown in its preview; longer lines are truncated.
+const previewMaxLength = 80
+
+// wantsPreviews determines if the given request asks to preview the content
+// of the entries in a directory, & previews are enabled.
+func (ph passwordHandler) wantsPreviews(r *http.Request) bool {
+	_, ok := r.URL.Query()["previews"]
+	return ok && ph.previews
+}
+
+// canPreview determines if entries of the given store can be previewed. Since
+// previewing an entry decrypts it, previews are only offered for stores which
+// can describe their entries without decrypting them (see secret.StatStore).
+func canPreview(s secret.Store) bool {
+	_, ok := secret.AsStatStore(s)
+	return ok
+}
+
+// servePreviewsHTTP serves previews of the entries of a directory named by
+// the "entry" query parameters, as JSON; at most previewBatchSize entries may
+// be named. Entries which don't exist are omitted.
+func (ph passwordHandler) servePreviewsHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, dirPath string) {
+	if !canPreview(sess.GetStore()) {
+		http.NotFound(w, r)
+		return
+	}
+	names := r.URL.Query()["entry"]
+	if len(names) > previewBatchSize {
+		http.Error(w, fmt.Sprintf("At most %d entries may be previewed at once.", previewBatchSize), http.StatusBadRequest)
+		return
+	}
+	previews := []listing.Preview{}
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "/") {
+			http.Error(w, "Invalid entry.", http.StatusBadRequest)
+			return
+		}
+		entryPath := dirPath + name
+		content, err := sess.GetStore().Get(entryPath)
+		if errors.Is(err, secret.ErrNoEntry) {
+			continue
+		}
+		if err != nil {
+			logf(r, "Could not get entry %q in password handler: %v", entryPath, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		previews = append(previews, listing.Preview{Path: entryPath, Text: entryPreview(content)})
+	}
+	serveJSON(w, r, previews)
+}
+
+// entryPreview returns a preview of an entry with the given content: its first
+// line, masked, followed by its second line. If the second line holds the
+// entry's OTP seed, it is masked too.
+func entryPreview(content string) string {
+	lines := strings.SplitN(content, "\n", 3)
+	if len(lines) < 2 {
+		return previewMask
+	}
+	second := strings.TrimSuffix(lines[1], "\r")
+	if second == "" {
+		return previewMask
+	}
+	if entry.Parse("\n"+second).OTP != "" {
+		second = previewMask
+	}
+	if rs := []rune(second); len(rs) > previewMaxLength {
+		second = string(rs[:previewMaxLength]) + "…"
+	}
+	return previewMask + " " + second
+}
+
+// dirExists determines if the given directory, which holds no entries or
+// subdirectories, exists; that is, if it is listed in its parent directory.
+func dirExists(s secret.Store, dirPath string) (bool, error) {
+	_, subdirs, err := listDir(s, parentDir(dirPath))
+	if err != nil {
+		return false, err
+	}
+	for _, sd := range subdirs {
+		if sd+"/" == dirPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parentDir returns the parent directory of the given directory, or the empty
+// string for the root directory.
+func parentDir(dirPath string) string {
+	if dirPath == "/" {
+		return ""
+	}
+	// Call path.Dir twice: the first call just removes the trailing slash.
+	pd := path.Dir(path.Dir(dirPath))
+	if pd == "/" {
+		return pd
+	}
+	return pd + "/"
+}
+
+// entryTemplate is an entry template, expanded for a new entry.
+type entryTemplate struct {
+	Name    string
+	Content string
+}
+
+// entryTemplates returns the templates stored in templatesPath, sorted by name
+// & expanded for the given new entry. Each template gets its own generated
+// password.
+func entryTemplates(s secret.Store, entryPath string) ([]entryTemplate, error) {
+	entries, _, err := listDir(s, templatesPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list templates: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	sortListing(entries)
+	charsets, err := random.Charsets("luds", false)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get character sets: %w", err)
+	}
+	var tmpls []entryTemplate
+	for _, e := range entries {
+		content, err := s.Get(e)
+		if errors.Is(err, secret.ErrNoEntry) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't get template %q: %w", e, err)
+		}
+		pw, err := random.Password(templatePasswordLength, charsets)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't generate password: %w", err)
+		}
+		tmpls = append(tmpls, entryTemplate{path.Base(e), expandTemplate(content, path.Base(entryPath), pw)})
+	}
+	return tmpls, nil
+}
+
+// expandTemplate expands the given entry template for a new entry with the
+// given base name & password, replacing each occurrence of "{{name}}" and
+// "{{password}}". Other text, including other braces, is left as is.
+func expandTemplate(tmpl, name, password string) string {
+	return strings.NewReplacer("{{name}}", name, "{{password}}", password).Replace(tmpl)
+}
+
+// dirEntry describes an entry in a directory listing.
+type dirEntry struct {
+	Path    string
+	ModTime time.Time // zero if unknown
+	Changed time.Time // time of the entry's last change, preferring its changed field to ModTime; zero if unknown
+	Stale   bool      // see isStale
+	Expires time.Time // zero if the entry doesn't expire
+	Expiry  string    // see expiryStatus
+}
+
+// expiryStatus describes an entry expiring at the given time: "expired" if it
+// has expired, "expiring" if it will expire within the given window of now, or
+// "" otherwise.
+func expiryStatus(expires, now time.Time, window time.Duration) string {
+	switch {
+	case expires.IsZero():
+		return ""
+	case !now.Before(expires):
+		return "expired"
+	case !now.Add(window).Before(expires):
+		return "expiring"
+	default:
+		return ""
+	}
+}
+
+// isStale determines if an entry last changed at the given time is stale, i.e.
+// has not been changed within staleAfter of now. Entries are never stale if
+// staleAfter is zero or the time of their last change is unknown.
+func isStale(changed, now time.Time, staleAfter time.Duration) bool {
+	return staleAfter > 0 && !changed.IsZero() && now.Sub(changed) >= staleAfter
+}
+
+// statEntries describes the given entries, including their modification times
+// if the store is a secret.StatStore.
+func statEntries(s secret.Store, entries []string) []dirEntry {
+	des := make([]dirEntry, len(entries))
+	ss, ok := secret.AsStatStore(s)
+	for i, e := range entries {
+		des[i].Path = e
+		if !ok {
+			continue
+		}
+		info, err := ss.Stat(e)
+		if err != nil {
+			log.Printf("Could not stat entry %q: %v", e, err)
+			continue
+		}
+		des[i].ModTime, des[i].Changed = info.ModTime, info.ModTime
+	}
+	return des
+}
+
+// listingEntries describes the given entries for a JSON listing, including
+// their modification times if the store is a secret.StatStore, and whether
+// each is a favorite.
+func listingEntries(s secret.Store, entries []string) []listing.Entry {
+	favorites, err := secret.Favorites(s)
+	if err != nil {
+		log.Printf("Could not get favorites: %v", err)
+	}
+	isFavorite := map[string]bool{}
+	for _, f := range favorites {
+		isFavorite[f] = true
+	}
+	les := make([]listing.Entry, len(entries))
+	for i, de := range statEntries(s, entries) {
+		les[i] = listing.Entry{Path: de.Path, Favorite: isFavorite[de.Path]}
+		if !de.ModTime.IsZero() {
+			modTime := de.ModTime
+			les[i].ModTime = &modTime
+		}
+	}
+	return les
+}
+
+// listDir returns the entries and subdirectories directly within the given
+// directory, omitting hidden entries & subdirectories. Stores implementing
+// secret.DirStore list only the given directory; otherwise, every entry in the
+// store is listed & filtered.
+func listDir(s secret.Store, dirPath string) (entries, subdirs []string, _ error) {
+	if ds, ok := secret.AsDirStore(s); ok {
+		es, sds, err := ds.ListDir(dirPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range es {
+			if e[len(dirPath)] != '.' {
+				entries = append(entries, e)
+			}
+		}
+		for _, sd := range sds {
+			if sd[len(dirPath)] != '.' {
+				subdirs = append(subdirs, sd)
+			}
+		}
+		return entries, subdirs, nil
+	}
+
+	pathEntries, err := s.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, subdirs = partitionListing(pathEntries, dirPath)
+	return entries, subdirs, nil
+}
+
+// partitionListing returns the entries and subdirectories directly within the
+// given directory, given a listing of entries which may include entries
+// anywhere in the store. Hidden entries & subdirectories are omitted. Each
+// subdirectory is returned once, regardless of the order of the listing.
+func partitionListing(pathEntries []string, dirPath string) (entries, subdirs []string) {
+	seenSubdirs := map[string]bool{}
 	for _, pe := range pathEntries {
 		// Ignore if not in the current directory.
-		if !strings.HasPrefix(pe, dirPath) {
+		if !strings.HasPrefix(pe, dirPath) || len(pe) == len(dirPath) {
 			continue
 		}
 
@@ -188,34 +1267,336 @@ func (ph passwordHandler) serveDirectoryViewHTTP(w http.ResponseWriter, r *http.
 		idx := strings.Index(pe[len(dirPath):], "/")
 		if idx == -1 {
 			entries = append(entries, pe)
-		} else {
-			// Only include directory entries if they're not already included.
-			pe = pe[:len(dirPath)+idx]
-			if len(subdirs) == 0 || subdirs[len(subdirs)-1] != pe {
-				subdirs = append(subdirs, pe)
+			continue
+		}
+		sd := pe[:len(dirPath)+idx]
+		if !seenSubdirs[sd] {
+			seenSubdirs[sd] = true
+			subdirs = append(subdirs, sd)
+		}
+	}
+	return entries, subdirs
+}
+
+// sortListing sorts the given entry or directory paths case-insensitively.
+func sortListing(ps []string) {
+	c := collators.Get().(*collate.Collator)
+	defer collators.Put(c)
+	c.SortStrings(ps)
+}
+
+// paginate returns the portion of the concatenation of subdirs and entries
+// starting at offset and containing at most n items, split back into
+// subdirectories and entries.
+func paginate(subdirs, entries []string, offset, n int) ([]string, []string) {
+	clamp := func(i, max int) int {
+		if i < 0 {
+			return 0
+		}
+		if i > max {
+			return max
+		}
+		return i
+	}
+	lo, hi := offset, offset+n
+	pageSubdirs := subdirs[clamp(lo, len(subdirs)):clamp(hi, len(subdirs))]
+	pageEntries := entries[clamp(lo-len(subdirs), len(entries)):clamp(hi-len(subdirs), len(entries))]
+	return pageSubdirs, pageEntries
+}
+
+func (ph passwordHandler) serveTrashHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	ts, ok := secret.AsTrashStore(sess.GetStore())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		trashed, err := ts.ListTrash()
+		if err != nil {
+			logf(r, "Could not list trash in password handler: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		entries, err := sess.GetStore().List()
+		if err != nil {
+			logf(r, "Could not get entry list in password handler: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the most recently deleted copy of an entry can be restored, and only if there is
+		// not currently an entry with the same name.
+		unrestorable := map[string]bool{}
+		for _, e := range entries {
+			unrestorable[e] = true
+		}
+		type trashedEntry struct {
+			secret.TrashedEntry
+			Restorable bool
+		}
+		var tes []trashedEntry
+		for _, te := range trashed {
+			tes = append(tes, trashedEntry{te, !unrestorable[te.Entry]})
+			unrestorable[te.Entry] = true
+		}
+		serveTemplate(w, r, trashTmpl, tes)
+
+	case http.MethodPost:
+		if r.FormValue("action") != "restore" {
+			redirect(w, r, trashPath)
+			return
+		}
+		entryPath := r.FormValue("entry")
+		if secret.IsReadOnly(sess.GetStore(), entryPath) {
+			http.Error(w, fmt.Sprintf("%s is read-only.", entryPath), http.StatusForbidden)
+			return
+		}
+		switch err := ts.Restore(entryPath); {
+		case err == nil:
+			// Restored content may have been cached as nonexistent.
+			if cs, ok := secret.AsCachingStore(sess.GetStore()); ok {
+				cs.Clear()
 			}
+			redirect(w, r, entryPath)
+		case errors.Is(err, secret.ErrNoEntry):
+			http.Error(w, fmt.Sprintf("No deleted entry for %s.", entryPath), http.StatusNotFound)
+		case errors.Is(err, secret.ErrEntryExists):
+			http.Error(w, fmt.Sprintf("An entry already exists at %s.", entryPath), http.StatusConflict)
+		default:
+			logf(r, "Could not restore entry: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
-	collate.New(language.English, collate.IgnoreCase).SortStrings(entries)
-	collate.New(language.English, collate.IgnoreCase).SortStrings(subdirs)
+}
 
-	// If this directory is nonexistent, forward to the parent directory (assuming we aren't already at the root directory).
-	if dirPath != "/" && len(subdirs) == 0 && len(entries) == 0 {
-		// Call path.Dir twice: the first call just removes the trailing slash.
-		parentPath := path.Dir(path.Dir(dirPath))
-		if !strings.HasSuffix(parentPath, "/") {
-			parentPath = parentPath + "/"
+func (ph passwordHandler) serveDirectoryUpdateHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, dirPath string) {
+	switch r.FormValue("action") {
+	case "sync":
+		gs, ok := syncStore(sess)
+		if !ok || secret.IsReadOnly(sess.GetStore(), "/") {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
 		}
-		http.Redirect(w, r, parentPath, http.StatusSeeOther)
+		if err := gs.Sync(); errors.Is(err, gitsync.ErrConflict) {
+			http.Error(w, "Sync failed: changes in the remote repository conflict with local changes. Resolve the conflict manually, then sync again.", http.StatusConflict)
+			return
+		} else if err != nil {
+			logf(r, "Could not sync store: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Synced content may differ from cached content.
+		if cs, ok := secret.AsCachingStore(sess.GetStore()); ok {
+			cs.Clear()
+		}
+		redirect(w, r, dirPath)
+
+	case "create-entry", "create-dir":
+		// Names are single path components; parsePath must leave the new path unchanged.
+		name := r.FormValue("name")
+		newPath, _ := parsePath(dirPath + name)
+		if !validName(name) || newPath != dirPath+name {
+			http.Error(w, "Invalid name.", http.StatusBadRequest)
+			return
+		}
+		if secret.IsReadOnly(sess.GetStore(), newPath) {
+			http.Error(w, fmt.Sprintf("%s is read-only.", newPath), http.StatusForbidden)
+			return
+		}
+
+		if r.FormValue("action") == "create-entry" {
+			// The entry is created when its content is first saved from the edit view.
+			switch _, err := sess.GetStore().Get(newPath); {
+			case errors.Is(err, secret.ErrNoEntry):
+				redirect(w, r, (&url.URL{Path: newPath, RawQuery: "edit"}).String())
+			case err == nil:
+				http.Error(w, fmt.Sprintf("An entry already exists at %s.", newPath), http.StatusConflict)
+			default:
+				logf(r, "Could not get entry %q in password handler: %v", newPath, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		eds, ok := secret.AsEmptyDirStore(sess.GetStore())
+		if !ok {
+			http.Error(w, "Empty folders are not supported by this vault.", http.StatusBadRequest)
+			return
+		}
+		if err := eds.EnsureDir(newPath + "/"); err != nil {
+			logf(r, "Could not create directory %q: %v", newPath, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		redirect(w, r, (&url.URL{Path: newPath + "/"}).String())
+
+	default:
+		redirect(w, r, dirPath)
+	}
+}
+
+// treeOp returns the operation on a whole directory requested by the query
+// of the given request, "delete-tree" or "move-tree", or the empty string if
+// there is none.
+func treeOp(r *http.Request) string {
+	q := r.URL.Query()
+	for _, op := range []string{"delete-tree", "move-tree"} {
+		if _, ok := q[op]; ok {
+			return op
+		}
+	}
+	return ""
+}
+
+// treeConfirm is the data of the page confirming an operation on a whole
+// directory.
+type treeConfirm struct {
+	Path        string
+	Op          string
+	Count       int      // number of entries within the directory
+	Destination string   // for moves, the destination directory
+	HasTrash    bool     // whether deleted entries are moved to the trash
+	Error       string   // why the operation was not carried out, if it was attempted
+	Done        []string // if the operation failed partway, the entries processed before the failure
+}
+
+// serveTreeHTTP serves requests to delete or move a whole directory. The
+// operation is carried out only once the user confirms it by typing the
+// directory's name.
+func (ph passwordHandler) serveTreeHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, dirPath string) {
+	if dirPath == "/" {
+		http.Error(w, "The root folder can't be deleted or moved.", http.StatusBadRequest)
+		return
+	}
+	entries, err := treeEntries(sess.GetStore(), dirPath)
+	if err != nil {
+		logf(r, "Could not list directory %q in password handler: %v", dirPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	_, hasTrash := secret.AsTrashStore(sess.GetStore())
+	tc := treeConfirm{Path: dirPath, Op: treeOp(r), Count: len(entries), Destination: dirPath, HasTrash: hasTrash}
+	if r.Method == http.MethodGet {
+		serveTemplate(w, r, treeConfirmTmpl, tc)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Render entries/subdirectories.
-	serveTemplate(w, r, dirViewTmpl, struct {
-		Path           string
-		Entries        []string
-		Subdirectories []string
-	}{dirPath, entries, subdirs})
+	fail := func(code int, msg string) {
+		tc.Error = msg
+		serveTemplateStatus(w, r, code, treeConfirmTmpl, tc)
+	}
+	if r.FormValue("confirm-name") != path.Base(dirPath) {
+		fail(http.StatusBadRequest, fmt.Sprintf("Type %q to confirm.", path.Base(dirPath)))
+		return
+	}
+	if secret.IsReadOnly(sess.GetStore(), dirPath) {
+		fail(http.StatusForbidden, fmt.Sprintf("%s is read-only.", dirPath))
+		return
+	}
+
+	var dst string
+	if tc.Op == "delete-tree" {
+		_, err = secret.DeleteTree(sess.GetStore(), dirPath)
+	} else {
+		// Re-check the destination path the same way request paths are checked.
+		dst = r.FormValue("destination")
+		tc.Destination = dst
+		if !strings.HasSuffix(dst, "/") {
+			dst += "/"
+		}
+		if p, _ := parsePath(dst); p != dst || secret.CheckTreeMove(dirPath, dst) != nil {
+			fail(http.StatusBadRequest, "Invalid destination.")
+			return
+		}
+		if secret.IsReadOnly(sess.GetStore(), dst) {
+			fail(http.StatusForbidden, fmt.Sprintf("%s is read-only.", dst))
+			return
+		}
+		_, err = secret.MoveTree(sess.GetStore(), dirPath, dst)
+	}
+
+	// Record the accesses of the entries which were processed, even if
+	// the operation failed partway.
+	var done []string
+	var te *secret.TreeError
+	switch {
+	case err == nil:
+		done = entries
+	case errors.As(err, &te):
+		done = te.Done
+	}
+	for _, e := range done {
+		if tc.Op == "delete-tree" {
+			recordAccess(ph.al, r, e, accesslog.Delete)
+		} else if ph.al != nil {
+			if err := ph.al.Move(e, dst+strings.TrimPrefix(e, dirPath)); err != nil {
+				logf(r, "Could not move access log of entry %q: %v", e, err)
+			}
+		}
+	}
+
+	switch {
+	case err == nil && tc.Op == "delete-tree":
+		redirect(w, r, parentDir(dirPath))
+	case err == nil:
+		redirect(w, r, (&url.URL{Path: dst}).String())
+	case errors.Is(err, secret.ErrNoEntry) && len(done) == 0:
+		http.Error(w, fmt.Sprintf("No entries in %s.", dirPath), http.StatusNotFound)
+	case errors.Is(err, secret.ErrEntryExists) && len(done) == 0:
+		fail(http.StatusConflict, fmt.Sprintf("Some entries already exist beneath %s; nothing was moved.", dst))
+	case errors.Is(err, secret.ErrCrossMount) && len(done) == 0:
+		fail(http.StatusBadRequest, "Folders can't be moved between vaults.")
+	case errors.Is(err, secret.ErrReadOnly):
+		tc.Done = done
+		fail(http.StatusForbidden, "Some entries are read-only.")
+	default:
+		logf(r, "Could not %s %q after processing %d entries: %v", strings.TrimSuffix(tc.Op, "-tree"), dirPath, len(done), err)
+		tc.Done = done
+		fail(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+// treeEntries returns the entries of s beneath the given directory.
+func treeEntries(s secret.Store, dirPath string) ([]string, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, e := range all {
+		if strings.HasPrefix(e, dirPath) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// validName determines if the given name is valid for a new entry or
+// directory: it must be a single, nonempty path component, and must not be
+// hidden (i.e. start with a dot), which also excludes "." and "..".
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\x00")
+}
+
+// syncStore finds the git-synchronized store underlying the session's store,
+// if any.
+func syncStore(sess *session.Session) (gitsync.Store, bool) {
+	gs, ok := secret.Find(sess.GetStore(), func(s secret.Store) bool {
+		_, ok := s.(gitsync.Store)
+		return ok
+	}).(gitsync.Store)
+	return gs, ok
 }
 
 func parsePath(p string) (cleanedPath string, isDir bool) {
@@ -0,0 +1,1132 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/listing"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+func TestListDirFallback(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/a":          "",
+		"/.hidden":    "",
+		"/dir/b":      "",
+		"/dir/sub/c":  "",
+		"/dir/sub/d":  "",
+		"/.hidden/e":  "",
+		"/other/f":    "",
+		"/dir/.g":     "",
+		"/dir/.sub/h": "",
+	}}
+
+	for _, test := range []struct {
+		dir                   string
+		wantEntries, wantDirs []string
+	}{
+		{"/", []string{"/a"}, []string{"/dir", "/other"}},
+		{"/dir/", []string{"/dir/b"}, []string{"/dir/sub"}},
+		{"/nonexistent/", nil, nil},
+	} {
+		entries, subdirs, err := listDir(s, test.dir)
+		if err != nil {
+			t.Errorf("Could not list %q: %v", test.dir, err)
+			continue
+		}
+		if fmt.Sprint(entries) != fmt.Sprint(test.wantEntries) || fmt.Sprint(subdirs) != fmt.Sprint(test.wantDirs) {
+			t.Errorf("listDir(%q) = (%q, %q), want (%q, %q)", test.dir, entries, subdirs, test.wantEntries, test.wantDirs)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+	subdirs := []string{"/d1", "/d2", "/d3"}
+	entries := []string{"/e1", "/e2", "/e3", "/e4"}
+
+	for _, test := range []struct {
+		offset, n             int
+		wantDirs, wantEntries []string
+	}{
+		{0, 2, []string{"/d1", "/d2"}, []string{}},
+		{2, 2, []string{"/d3"}, []string{"/e1"}},
+		{4, 2, []string{}, []string{"/e2", "/e3"}},
+		{6, 2, []string{}, []string{"/e4"}},
+		{0, 10, subdirs, entries},
+	} {
+		gotDirs, gotEntries := paginate(subdirs, entries, test.offset, test.n)
+		if fmt.Sprint(gotDirs) != fmt.Sprint(test.wantDirs) || fmt.Sprint(gotEntries) != fmt.Sprint(test.wantEntries) {
+			t.Errorf("paginate(%d, %d) = (%q, %q), want (%q, %q)", test.offset, test.n, gotDirs, gotEntries, test.wantDirs, test.wantEntries)
+		}
+	}
+}
+
+func TestPartitionListing(t *testing.T) {
+	t.Parallel()
+	// Entries in subdirectories are interleaved with other entries, as may
+	// happen depending on the order in which the store is walked.
+	listing := []string{"/dir/sub/a", "/dir/b", "/dir/sub/c", "/dir/other/d", "/dir/sub/e", "/dir/.hidden", "/dir/.sub/f", "/elsewhere/g"}
+	entries, subdirs := partitionListing(listing, "/dir/")
+	if want := []string{"/dir/b"}; fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("partitionListing returned entries %q, want %q", entries, want)
+	}
+	if want := []string{"/dir/sub", "/dir/other"}; fmt.Sprint(subdirs) != fmt.Sprint(want) {
+		t.Errorf("partitionListing returned subdirectories %q, want %q", subdirs, want)
+	}
+}
+
+func TestNoteLines(t *testing.T) {
+	t.Parallel()
+	content := "WIFI:password\r\nnote\r\nusername: alice\r\nWIFI:S:home;T:WPA;P:secret;;\r\notpauth://totp/a?secret=JBSWY3DP\r\notpauth://totp/b?secret=JBSWY3DP\r\n"
+	want := []noteLine{{"note", 0}, {"WIFI:S:home;T:WPA;P:secret;;", 4}, {"otpauth://totp/b?secret=JBSWY3DP", 6}}
+	if got := noteLines(content, entry.Parse(content)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("noteLines = %q, want %q", got, want)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"entry", true},
+		{"My Bank (old)", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"a/b", false},
+		{"../escape", false},
+		{"nul\x00", false},
+	} {
+		if got := validName(test.name); got != test.want {
+			t.Errorf("validName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 bytes"},
+		{1000, "1000 bytes"},
+		{1 << 10, "1 KiB"},
+		{1<<20 + 1, "1048577 bytes"},
+		{1 << 20, "1 MiB"},
+		{3 << 30, "3 GiB"},
+	} {
+		if got := formatSize(test.n); got != test.want {
+			t.Errorf("formatSize(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func BenchmarkSortListing(b *testing.B) {
+	listing := benchmarkListing(10000)
+	b.Run("NewCollator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ps := append([]string(nil), listing...)
+			collate.New(language.English, collate.IgnoreCase).SortStrings(ps)
+		}
+	})
+	b.Run("PooledCollator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ps := append([]string(nil), listing...)
+			sortListing(ps)
+		}
+	})
+}
+
+func BenchmarkPartitionListing(b *testing.B) {
+	listing := benchmarkListing(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		partitionListing(listing, "/")
+	}
+}
+
+// benchmarkListing returns a listing of n entries spread across a number of
+// directories, in no particular order.
+func benchmarkListing(n int) []string {
+	listing := make([]string, n)
+	for i := range listing {
+		listing[i] = fmt.Sprintf("/Dir%d/entry%d", (i*7919)%100, i)
+		if i%10 == 0 {
+			listing[i] = fmt.Sprintf("/Entry%d", i)
+		}
+	}
+	return listing
+}
+
+func TestFormatAge(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "less than a minute"},
+		{time.Minute, "1 minute"},
+		{90 * time.Minute, "1 hour"},
+		{49 * time.Hour, "2 days"},
+		{400 * 24 * time.Hour, "1 year"},
+		{3 * 365 * 24 * time.Hour, "3 years"},
+	} {
+		if got := formatAge(test.d); got != test.want {
+			t.Errorf("formatAge(%v) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		tmpl, want string
+	}{
+		{"", ""},
+		{"no placeholders", "no placeholders"},
+		{"{{password}}\nUsername: {{name}}", "hunter2\nUsername: My Bank"},
+		{"{{name}} {{name}}", "My Bank My Bank"},
+		{"{{ name }} {{other}} {name}", "{{ name }} {{other}} {name}"},
+		{"{{{{name}}}}", "{{My Bank}}"},
+	} {
+		if got := expandTemplate(test.tmpl, "My Bank", "hunter2"); got != test.want {
+			t.Errorf("expandTemplate(%q) = %q, want %q", test.tmpl, got, test.want)
+		}
+	}
+
+	// Placeholders in the substituted values are not expanded.
+	if got, want := expandTemplate("{{name}}: {{password}}", "{{password}}", "{{name}}"), "{{password}}: {{name}}"; got != want {
+		t.Errorf("expandTemplate with placeholders in values = %q, want %q", got, want)
+	}
+}
+
+func TestEntryTemplates(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/.templates/login":         "{{password}}\nUsername: {{name}}",
+		"/.templates/Bank":          "{{password}}\nSecurity question:",
+		"/.templates/sub/nested":    "not a template",
+		"/elsewhere/not-a-template": "",
+	}}
+	tmpls, err := entryTemplates(s, "/dir/example.com")
+	if err != nil {
+		t.Fatalf("Could not get entry templates: %v", err)
+	}
+	if len(tmpls) != 2 || tmpls[0].Name != "Bank" || tmpls[1].Name != "login" {
+		t.Fatalf("entryTemplates returned %q, want templates Bank & login", tmpls)
+	}
+	lines := strings.Split(tmpls[1].Content, "\n")
+	if len(lines) != 2 || len(lines[0]) != templatePasswordLength || lines[1] != "Username: example.com" {
+		t.Errorf("Template login expanded to %q, want generated password & username example.com", tmpls[1].Content)
+	}
+	if strings.SplitN(tmpls[0].Content, "\n", 2)[0] == lines[0] {
+		t.Errorf("Templates were expanded with the same password")
+	}
+
+	// Stores without templates get none.
+	if tmpls, err := entryTemplates(&memStore{entries: map[string]string{"/a": ""}}, "/b"); err != nil || tmpls != nil {
+		t.Errorf("entryTemplates without templates = (%q, %v), want (nil, nil)", tmpls, err)
+	}
+}
+
+func TestEntryMaxSize(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/entry": "old content"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, 16, false, DefaultExpiryWindow, false, false, 0)
+
+	update := func(content string) *httptest.ResponseRecorder {
+		form := url.Values{"action": {"update-entry"}, "content": {content}}
+		req := httptest.NewRequest(http.MethodPost, "/entry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Oversized content is refused, and shown again in the editor.
+	resp := update("<too much content>")
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized update: got status %d, want %d", resp.Code, http.StatusRequestEntityTooLarge)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "&lt;too much content&gt;</textarea>") || !strings.Contains(body, "data-draft") {
+		t.Errorf("Oversized update response did not preserve the submitted content: %q", body)
+	}
+	if content, _ := s.Get("/entry"); content != "old content" {
+		t.Errorf("After oversized update, entry content was %q, want %q", content, "old content")
+	}
+
+	// Content of the maximum size is accepted.
+	if resp := update("sixteen bytes!!!"); resp.Code != http.StatusSeeOther {
+		t.Errorf("Update: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if content, _ := s.Get("/entry"); content != "sixteen bytes!!!" {
+		t.Errorf("After update, entry content was %q, want %q", content, "sixteen bytes!!!")
+	}
+}
+
+func TestConfirmWrites(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/entry": "old content"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, true, DefaultExpiryWindow, false, false, 0)
+
+	update := func(form url.Values) *httptest.ResponseRecorder {
+		form.Set("action", "update-entry")
+		req := httptest.NewRequest(http.MethodPost, "/entry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// An unconfirmed update shows the changes, without saving them.
+	resp := update(url.Values{"content": {"new content"}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unconfirmed update: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	body := resp.Body.String()
+	if !strings.Contains(body, `<span class="diff-delete">-old content</span>`) || !strings.Contains(body, `<span class="diff-insert">&#43;new content</span>`) {
+		t.Errorf("Unconfirmed update response did not show the changes: %q", body)
+	}
+	if content, _ := s.Get("/entry"); content != "old content" {
+		t.Errorf("After unconfirmed update, entry content was %q, want %q", content, "old content")
+	}
+
+	// A confirmation against content which has since changed shows the changes again.
+	base := secret.ContentHash("old content")
+	s.Put("/entry", "other content")
+	resp = update(url.Values{"content": {"new content"}, "base": {base}, "confirm": {"1"}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Stale confirmed update: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "was changed elsewhere") || !strings.Contains(body, `<span class="diff-delete">-other content</span>`) {
+		t.Errorf("Stale confirmed update response did not show the changes against the new content: %q", body)
+	}
+	if content, _ := s.Get("/entry"); content != "other content" {
+		t.Errorf("After stale confirmed update, entry content was %q, want %q", content, "other content")
+	}
+
+	// A confirmation against the current content saves the changes.
+	resp = update(url.Values{"content": {"new content"}, "base": {secret.ContentHash("other content")}, "confirm": {"1"}})
+	if resp.Code != http.StatusSeeOther {
+		t.Errorf("Confirmed update: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if content, _ := s.Get("/entry"); content != "new content" {
+		t.Errorf("After confirmed update, entry content was %q, want %q", content, "new content")
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/entry": "old content"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/entry", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+	update := func(content, baseHash string) *httptest.ResponseRecorder {
+		return do(http.MethodPost, url.Values{"action": {"update-entry"}, "content": {content}, "base_hash": {baseHash}})
+	}
+	baseHashRE := regexp.MustCompile(`name="base_hash" value="([^"]*)"`)
+
+	// The editor is based on the content it was loaded with.
+	m := baseHashRE.FindStringSubmatch(do(http.MethodGet, nil).Body.String())
+	if m == nil || m[1] != secret.ContentHash("old content") {
+		t.Fatalf("Entry view had base_hash %q, want %q", m, secret.ContentHash("old content"))
+	}
+	base := m[1]
+
+	// An update based on content which has since changed shows both versions, without saving.
+	s.Put("/entry", "other content")
+	resp := update("my content", base)
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("Conflicting update: got status %d, want %d", resp.Code, http.StatusConflict)
+	}
+	body := resp.Body.String()
+	if !strings.Contains(body, "was changed elsewhere") || !strings.Contains(body, "other content") || !strings.Contains(body, "my content") {
+		t.Errorf("Conflicting update response did not show both versions: %q", body)
+	}
+	if content, _ := s.Get("/entry"); content != "other content" {
+		t.Errorf("After conflicting update, entry content was %q, want %q", content, "other content")
+	}
+
+	// Saving again from the conflict view picks the user's version.
+	m = baseHashRE.FindStringSubmatch(body)
+	if m == nil || m[1] != secret.ContentHash("other content") {
+		t.Fatalf("Conflict view had base_hash %q, want %q", m, secret.ContentHash("other content"))
+	}
+	if resp := update("my content", m[1]); resp.Code != http.StatusSeeOther {
+		t.Errorf("Resolving update: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if content, _ := s.Get("/entry"); content != "my content" {
+		t.Errorf("After resolving update, entry content was %q, want %q", content, "my content")
+	}
+
+	// An entry created elsewhere, or deleted elsewhere, also conflicts.
+	if resp := do(http.MethodPost, url.Values{"action": {"update-entry"}, "content": {"new content"}, "base_hash": {""}}); resp.Code != http.StatusConflict {
+		t.Errorf("Update of new entry which exists: got status %d, want %d", resp.Code, http.StatusConflict)
+	}
+	s.Delete("/entry")
+	if resp := update("new content", secret.ContentHash("my content")); resp.Code != http.StatusConflict {
+		t.Errorf("Update of deleted entry: got status %d, want %d", resp.Code, http.StatusConflict)
+	}
+	if _, err := s.Get("/entry"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("After update of deleted entry, Get returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+}
+
+func TestChangedField(t *testing.T) {
+	t.Parallel()
+	const old = "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes"
+	s := &memStore{entries: map[string]string{"/entry": old, "/untracked": "hunter2"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	do := func(ph *passwordHandler, method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+	update := func(ph *passwordHandler, target, content string) {
+		t.Helper()
+		if resp := do(ph, http.MethodPost, target, url.Values{"action": {"update-entry"}, "content": {content}}); resp.Code != http.StatusSeeOther {
+			t.Errorf("Update of %s: got status %d, want %d", target, resp.Code, http.StatusSeeOther)
+		}
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 24*time.Hour)
+
+	// An entry which has not been changed recently is marked stale.
+	if body := do(ph, http.MethodGet, "/entry", nil).Body.String(); !strings.Contains(body, "Last changed:") || !strings.Contains(body, "badge stale") {
+		t.Errorf("Entry view did not mark entry stale: %q", body)
+	}
+
+	// Saving the entry without changing it leaves its changed field alone.
+	update(ph, "/entry", old)
+	if content, _ := s.Get("/entry"); content != old {
+		t.Errorf("After unchanged update, entry content was %q, want %q", content, old)
+	}
+
+	// Changing it updates the field in place.
+	before := time.Now().Truncate(time.Second)
+	update(ph, "/entry", "swordfish\nchanged: 2024-01-01T00:00:00Z\nnotes")
+	content, _ := s.Get("/entry")
+	if changed := entry.Parse(content).LastChanged(time.Time{}); changed.Before(before) || !strings.HasPrefix(content, "swordfish\nchanged: ") || !strings.HasSuffix(content, "\nnotes") {
+		t.Errorf("After update, entry content was %q, want changed field updated to now", content)
+	}
+
+	// Unless staleness is tracked, the field is only maintained by entries which already hold it.
+	ph = newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	update(ph, "/untracked", "swordfish")
+	if content, _ := s.Get("/untracked"); content != "swordfish" {
+		t.Errorf("After update without staleness tracking, entry content was %q, want %q", content, "swordfish")
+	}
+}
+
+func TestWeakPasswordWarning(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/other": "hunter2"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+
+	serve := func(method, target, content string) *httptest.ResponseRecorder {
+		form := url.Values{"action": {"update-entry"}, "content": {content}}
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, test := range []struct {
+		content      string
+		wantLocation string
+	}{
+		{"xK9#mQ2$vL7p\nuser: alice", "/entry"},
+		{"password\nuser: alice", "/entry?weak"},
+		{"hunter2", "/entry?reused&weak"},
+	} {
+		resp := serve(http.MethodPost, "/entry", test.content)
+		if got := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || got != test.wantLocation {
+			t.Errorf("Update to %q: got (%d, %q), want (%d, %q)", test.content, resp.Code, got, http.StatusSeeOther, test.wantLocation)
+		}
+	}
+
+	// The warning is shown only for weak passwords, even if requested.
+	if body := serve(http.MethodGet, "/entry?weak", "").Body.String(); !strings.Contains(body, "This password is weak: it could be guessed in less than a second.") {
+		t.Errorf("Entry view did not warn of weak password: %q", body)
+	}
+	s.Put("/entry", "xK9#mQ2$vL7p")
+	if body := serve(http.MethodGet, "/entry?weak", "").Body.String(); strings.Contains(body, "This password is weak") {
+		t.Errorf("Entry view warned of strong password: %q", body)
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/dir/entry": "password", "/other": "password"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Pinning an entry lists it at the top of the root directory view, without listing the
+	// favorites file itself.
+	if body := serve(http.MethodGet, "/dir/entry", nil).Body.String(); !strings.Contains(body, `<input type="hidden" name="favorite" value="1" />`) {
+		t.Errorf("Entry view did not offer to pin entry: %q", body)
+	}
+	resp := serve(http.MethodPost, "/dir/entry", url.Values{"action": {"toggle-favorite"}, "favorite": {"1"}})
+	if got := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || got != "/dir/entry" {
+		t.Errorf("Pin: got status %d & location %q, want %d & %q", resp.Code, got, http.StatusSeeOther, "/dir/entry")
+	}
+	if body := serve(http.MethodGet, "/dir/entry", nil).Body.String(); !strings.Contains(body, `<input type="hidden" name="favorite" value="0" />`) {
+		t.Errorf("Entry view did not offer to unpin pinned entry: %q", body)
+	}
+	body := serve(http.MethodGet, "/", nil).Body.String()
+	if !strings.Contains(body, `<a href="/dir/entry">/dir/entry</a>`) {
+		t.Errorf("Root directory view did not list favorite: %q", body)
+	}
+	if strings.Contains(body, `href="/.favorites"`) {
+		t.Errorf("Root directory view listed favorites file: %q", body)
+	}
+
+	// Unpinning removes it.
+	serve(http.MethodPost, "/dir/entry", url.Values{"action": {"toggle-favorite"}, "favorite": {"0"}})
+	if body := serve(http.MethodGet, "/", nil).Body.String(); strings.Contains(body, `<a href="/dir/entry">`) {
+		t.Errorf("Root directory view listed unpinned entry: %q", body)
+	}
+}
+
+func TestPasswordSuggestion(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/entry":            "password",
+		"/.templates/login": "{{password}}\nUsername: {{name}}",
+	}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	serve := func(target string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", target, resp.Code, http.StatusOK)
+		}
+		return resp.Body.String()
+	}
+
+	// Views of existing entries contain no generated password, but offer to suggest one.
+	body := serve("/entry")
+	for _, unwanted := range []string{`id="pwgen"`, "template-select"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("View of existing entry contains %q: %q", unwanted, body)
+		}
+	}
+	if !strings.Contains(body, `href="?edit&amp;suggest"`) {
+		t.Errorf("View of existing entry does not offer to suggest a password: %q", body)
+	}
+
+	// New entries, and existing entries when asked, get a suggestion.
+	for _, target := range []string{"/new", "/entry?suggest", "/entry?edit&suggest"} {
+		if body := serve(target); !strings.Contains(body, `id="pwgen"`) {
+			t.Errorf("View of %s does not suggest a password: %q", target, body)
+		}
+	}
+}
+
+func TestFieldsOnly(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/entry": "s3cr3t-pa55\nusername: alice\nsecret-answer"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, true, false, 0)
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Secret fields are masked in the view, but not in the editor.
+	body := serve("/entry").Body.String()
+	for _, unwanted := range []string{"s3cr3t-pa55", "secret-answer", "content-edit-content"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Fields-only view contains %q: %q", unwanted, body)
+		}
+	}
+	if !strings.Contains(body, "alice") {
+		t.Errorf("Fields-only view does not contain username: %q", body)
+	}
+	if body := serve("/entry?edit").Body.String(); !strings.Contains(body, "s3cr3t-pa55") {
+		t.Errorf("Editor does not contain entry content: %q", body)
+	}
+
+	// Fields are served individually, & require MFA for the entry itself.
+	for _, test := range []struct {
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{"/entry?field=password", http.StatusOK, "s3cr3t-pa55"},
+		{"/entry?field=username", http.StatusOK, "alice"},
+		{"/entry?field=notes", http.StatusOK, "secret-answer"},
+		{"/entry?field=url", http.StatusNotFound, ""},
+		{"/entry?field=bogus", http.StatusBadRequest, ""},
+		{"/nonexistent?field=password", http.StatusNotFound, ""},
+	} {
+		resp := serve(test.target)
+		if resp.Code != test.wantCode {
+			t.Errorf("GET %s: got status %d, want %d", test.target, resp.Code, test.wantCode)
+			continue
+		}
+		if test.wantCode != http.StatusOK {
+			continue
+		}
+		if got := resp.Body.String(); got != test.wantBody {
+			t.Errorf("GET %s: got %q, want %q", test.target, got, test.wantBody)
+		}
+		if got := resp.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("GET %s: got Cache-Control %q, want %q", test.target, got, "no-store")
+		}
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if got, err := ph.authPath(req); err != nil || got != "/entry" {
+			t.Errorf("authPath(GET %s) = %q (error %v), want %q", test.target, got, err, "/entry")
+		}
+	}
+}
+
+func TestExpiringEntries(t *testing.T) {
+	t.Parallel()
+	date := func(days int) string { return time.Now().AddDate(0, 0, days).Format("2006-01-02") }
+	s := &memStore{entries: map[string]string{
+		"/dir/expired": "password\nexpires: " + date(-1),
+		"/dir/soon":    "password\nexpires: " + date(3),
+		"/dir/later":   "password\nexpires: " + date(365),
+		"/dir/never":   "password\nexpires: never",
+	}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	serve := func(target string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp.Body.String()
+	}
+
+	// The root directory view lists entries which have expired or will expire soon.
+	body := serve("/")
+	for _, want := range []string{
+		`<a href="/dir/expired">/dir/expired</a> <span class="badge expired">Expired ` + date(-1),
+		`<a href="/dir/soon">/dir/soon</a> <span class="badge expiring">Expires ` + date(3),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Root directory view does not contain %q: %q", want, body)
+		}
+	}
+	for _, unwanted := range []string{"/dir/later", "/dir/never"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Root directory view lists %q: %q", unwanted, body)
+		}
+	}
+
+	// Directory views mark them with a badge.
+	body = serve("/dir/")
+	if got := strings.Count(body, `class="badge `); got != 2 {
+		t.Errorf("Directory view has %d badges, want 2: %q", got, body)
+	}
+
+	// As do entry views.
+	if body := serve("/dir/soon"); !strings.Contains(body, "Expires: "+date(3)+` <span class="badge expiring">`) {
+		t.Errorf("Entry view does not mark expiring entry: %q", body)
+	}
+	if body := serve("/dir/never"); !strings.Contains(body, "Expires: never\n") {
+		t.Errorf("Entry view does not show invalid expiration date: %q", body)
+	}
+}
+
+func TestExpiryStatus(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2025, time.July, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		expires time.Time
+		want    string
+	}{
+		{time.Time{}, ""},
+		{now.AddDate(0, 0, -1), "expired"},
+		{now, "expired"},
+		{now.AddDate(0, 0, 7), "expiring"},
+		{now.AddDate(0, 0, 8), ""},
+	} {
+		if got := expiryStatus(test.expires, now, 7*24*time.Hour); got != test.want {
+			t.Errorf("expiryStatus(%v) = %q, want %q", test.expires, got, test.want)
+		}
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2025, time.July, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		changed    time.Time
+		staleAfter time.Duration
+		want       bool
+	}{
+		{time.Time{}, time.Hour, false},
+		{now.Add(-time.Hour), time.Hour, true},
+		{now.Add(-time.Minute), time.Hour, false},
+		{now.AddDate(-1, 0, 0), 0, false},
+	} {
+		if got := isStale(test.changed, now, test.staleAfter); got != test.want {
+			t.Errorf("isStale(%v, %v) = %v, want %v", test.changed, test.staleAfter, got, test.want)
+		}
+	}
+}
+
+func TestDirectoryJSON(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{"/dir/a": "pass", "/dir/b": "pass", "/dir/sub/c": "pass"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if err := secret.SetFavorite(sess.GetStore(), "/dir/b", true); err != nil {
+		t.Fatalf("Could not set favorite: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	serve := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// HTML is served by default, including to browsers which accept anything.
+	for _, accept := range []string{"", "text/html,application/xhtml+xml,*/*;q=0.8", "text/html, application/json"} {
+		if got := serve("/dir/", accept).Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+			t.Errorf("GET /dir/ (Accept %q): got Content-Type %q, want HTML", accept, got)
+		}
+	}
+
+	// JSON is served if requested.
+	for _, test := range []struct{ target, accept string }{
+		{"/dir/", "application/json"},
+		{"/dir/?format=json", ""},
+	} {
+		resp := serve(test.target, test.accept)
+		if got := resp.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("GET %s (Accept %q): got Content-Type %q, want %q", test.target, test.accept, got, "application/json")
+		}
+		if got := resp.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("GET %s (Accept %q): got Cache-Control %q, want %q", test.target, test.accept, got, "no-store")
+		}
+		var got listing.Directory
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Could not parse JSON response %q: %v", resp.Body.String(), err)
+		}
+		want := listing.Directory{
+			Path:           "/dir/",
+			Subdirectories: []string{"/dir/sub/"},
+			Entries:        []listing.Entry{{Path: "/dir/a"}, {Path: "/dir/b", Favorite: true}},
+			Page:           1,
+			PageCount:      1,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %s (Accept %q) = %+v, want %+v", test.target, test.accept, got, want)
+		}
+	}
+
+	// Nonexistent directories are not found, rather than redirected to their parent.
+	if resp := serve("/nonexistent/?format=json", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("GET /nonexistent/?format=json: got status %d, want %d", resp.Code, http.StatusNotFound)
+	}
+}
+
+func TestEntryPreview(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		content, want string
+	}{
+		{"", previewMask},
+		{"hunter2", previewMask},
+		{"hunter2\n", previewMask},
+		{"hunter2\nusername: alice\nurl: https://example.com", previewMask + " username: alice"},
+		{"hunter2\r\nurl: https://example.com\r\n", previewMask + " url: https://example.com"},
+		{"hunter2\notpauth://totp/x?secret=ABC", previewMask + " " + previewMask},
+		{"hunter2\notp: ABC", previewMask + " " + previewMask},
+		{"hunter2\n" + strings.Repeat("x", previewMaxLength+1), previewMask + " " + strings.Repeat("x", previewMaxLength) + "…"},
+	} {
+		if got := entryPreview(test.content); got != test.want {
+			t.Errorf("entryPreview(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestEntryPreviews(t *testing.T) {
+	t.Parallel()
+	entries := map[string]string{"/dir/other/c": "pass\nusername: carol"}
+	for i := 0; i <= previewBatchSize; i++ {
+		entries[fmt.Sprintf("/dir/%02d", i)] = fmt.Sprintf("pass%d\nusername: user%d", i, i)
+	}
+	s := &statMemStore{memStore: &memStore{entries: entries}}
+	sh, err := session.NewHandler(statMemVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	serve := func(ph *passwordHandler, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, true, 0)
+
+	// Previewing a directory's entries requires MFA of the directory itself, not just of any path.
+	for _, test := range []struct {
+		target, want string
+	}{
+		{"/dir/", authBrowse},
+		{"/dir/?previews", "/dir/"},
+		{"/dir/?previews&format=json&entry=00", "/dir/"},
+	} {
+		if got, err := ph.authPath(httptest.NewRequest(http.MethodGet, test.target, nil)); err != nil || got != test.want {
+			t.Errorf("authPath(%q) = (%q, %v), want %q", test.target, got, err, test.want)
+		}
+	}
+
+	// Previews are offered, & shown once requested.
+	if body := serve(ph, "/dir/").Body.String(); !strings.Contains(body, "Show previews") || strings.Contains(body, `class="preview"`) {
+		t.Errorf("GET /dir/ did not offer previews: %q", body)
+	}
+	if body := serve(ph, "/dir/?previews").Body.String(); !strings.Contains(body, `data-entry="00"`) || strings.Contains(body, "user0") {
+		t.Errorf("GET /dir/?previews did not include placeholders for previews, or included content: %q", body)
+	}
+
+	// A batch of previews masks each entry's first line, omitting nonexistent entries.
+	s.resetGets()
+	resp := serve(ph, "/dir/?previews&format=json&entry=00&entry=01&entry=nonexistent")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET previews: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	if got := resp.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("GET previews: got Cache-Control %q, want %q", got, "no-store")
+	}
+	var got []listing.Preview
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Could not parse JSON response %q: %v", resp.Body.String(), err)
+	}
+	want := []listing.Preview{
+		{Path: "/dir/00", Text: previewMask + " username: user0"},
+		{Path: "/dir/01", Text: previewMask + " username: user1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET previews = %+v, want %+v", got, want)
+	}
+	if strings.Contains(resp.Body.String(), "pass") {
+		t.Errorf("GET previews included a first line: %q", resp.Body.String())
+	}
+	if n := s.gets(); n != 3 {
+		t.Errorf("GET previews decrypted %d entries, want 3", n)
+	}
+
+	// Too many entries, or entries outside the directory, can't be previewed at once; nothing is
+	// decrypted.
+	s.resetGets()
+	tooMany := "/dir/?previews&format=json"
+	for i := 0; i <= previewBatchSize; i++ {
+		tooMany += fmt.Sprintf("&entry=%02d", i)
+	}
+	for _, target := range []string{tooMany, "/dir/?previews&format=json&entry=other/c", "/dir/?previews&format=json&entry="} {
+		if resp := serve(ph, target); resp.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %d, want %d", target, resp.Code, http.StatusBadRequest)
+		}
+	}
+	if n := s.gets(); n != 0 {
+		t.Errorf("Rejected preview requests decrypted %d entries, want 0", n)
+	}
+
+	// If previews are disabled, or the store can't describe entries without decrypting them,
+	// previews are neither offered nor served.
+	noPreviews := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	if got, err := noPreviews.authPath(httptest.NewRequest(http.MethodGet, "/dir/?previews", nil)); err != nil || got != authBrowse {
+		t.Errorf("With previews disabled, authPath(/dir/?previews) = (%q, %v), want %q", got, err, authBrowse)
+	}
+	if body := serve(noPreviews, "/dir/?previews").Body.String(); strings.Contains(body, "previews") {
+		t.Errorf("With previews disabled, GET /dir/?previews offered previews: %q", body)
+	}
+	if resp := serve(noPreviews, "/dir/?previews&format=json&entry=00"); strings.Contains(resp.Body.String(), "user0") {
+		t.Errorf("With previews disabled, GET previews served content: %q", resp.Body.String())
+	}
+	if !canPreview(s) || canPreview(s.memStore) {
+		t.Errorf("canPreview = (%v, %v) for stores with & without Stat, want (true, false)", canPreview(s), canPreview(s.memStore))
+	}
+}
+
+type statMemVault struct{ s *statMemStore }
+
+func (v statMemVault) Unlock(passphrase string) (secret.Store, error) {
+	if _, err := (memVault{v.s.memStore}).Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return v.s, nil
+}
+
+// statMemStore is an in-memory secret.StatStore, which counts the entries it
+// decrypts.
+type statMemStore struct {
+	*memStore
+
+	getMu    sync.Mutex
+	getCount int
+}
+
+func (s *statMemStore) Get(entry string) (string, error) {
+	s.getMu.Lock()
+	s.getCount++
+	s.getMu.Unlock()
+	return s.memStore.Get(entry)
+}
+
+func (s *statMemStore) Stat(entry string) (secret.EntryInfo, error) {
+	if _, err := s.memStore.Get(entry); err != nil {
+		return secret.EntryInfo{}, err
+	}
+	return secret.EntryInfo{}, nil
+}
+
+func (s *statMemStore) gets() int {
+	s.getMu.Lock()
+	defer s.getMu.Unlock()
+	return s.getCount
+}
+
+func (s *statMemStore) resetGets() {
+	s.getMu.Lock()
+	defer s.getMu.Unlock()
+	s.getCount = 0
+}
+
+func TestTreeOperations(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{}}
+	for _, e := range []string{"/dir/a", "/dir/sub/b", "/dirt/c", "/other/a", "/ro/dir/d", "/ro/dir/sub/e"} {
+		s.entries[e] = "content"
+	}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithReadOnly("/ro/dir/sub"))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, req)
+		return resp
+	}
+	list := func(want string) {
+		t.Helper()
+		if entries, _ := s.List(); fmt.Sprint(entries) != want {
+			t.Errorf("Entries are %q, want %s", entries, want)
+		}
+	}
+
+	// Operations on a whole directory require MFA of the directory itself.
+	for _, test := range []struct {
+		target, want string
+	}{
+		{"/dir/", authBrowse},
+		{"/dir/?delete-tree", "/dir/"},
+		{"/dir/?move-tree", "/dir/"},
+		{"/dir/a?delete-tree", "/dir/a"},
+	} {
+		if got, err := ph.authPath(httptest.NewRequest(http.MethodPost, test.target, nil)); err != nil || got != test.want {
+			t.Errorf("authPath(%q) = (%q, %v), want %q", test.target, got, err, test.want)
+		}
+	}
+
+	// The confirmation page counts the entries within the directory, not its siblings.
+	if body := do(http.MethodGet, "/dir/?delete-tree", nil).Body.String(); !strings.Contains(body, "the 2 entries within it") {
+		t.Errorf("Confirmation page did not count the entries: %q", body)
+	}
+
+	// Nothing happens unless the directory's name is typed.
+	for _, name := range []string{"", "dirt", "/dir/"} {
+		if resp := do(http.MethodPost, "/dir/?delete-tree", url.Values{"confirm-name": {name}}); resp.Code != http.StatusBadRequest {
+			t.Errorf("Delete with confirmation %q: got status %d, want %d", name, resp.Code, http.StatusBadRequest)
+		}
+	}
+	if resp := do(http.MethodPost, "/dir/", url.Values{"action": {"delete-tree"}, "confirm-name": {"dir"}}); resp.Code != http.StatusSeeOther {
+		t.Errorf("Delete without query: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	list("[/dir/a /dir/sub/b /dirt/c /other/a /ro/dir/d /ro/dir/sub/e]")
+
+	// A move onto existing entries, or into the directory itself, moves nothing.
+	for _, test := range []struct {
+		dst      string
+		wantCode int
+	}{
+		{"/other", http.StatusConflict},
+		{"/dir/sub/", http.StatusBadRequest},
+		{"/dir/", http.StatusBadRequest},
+		{"dirt/", http.StatusBadRequest},
+		{"/x/../../", http.StatusBadRequest},
+		{"/ro/dir/sub/", http.StatusForbidden},
+	} {
+		if resp := do(http.MethodPost, "/dir/?move-tree", url.Values{"confirm-name": {"dir"}, "destination": {test.dst}}); resp.Code != test.wantCode {
+			t.Errorf("Move to %q: got status %d, want %d", test.dst, resp.Code, test.wantCode)
+		}
+	}
+	list("[/dir/a /dir/sub/b /dirt/c /other/a /ro/dir/d /ro/dir/sub/e]")
+
+	// A confirmed move or delete processes the whole directory.
+	resp := do(http.MethodPost, "/dir/?move-tree", url.Values{"confirm-name": {"dir"}, "destination": {"/new/place"}})
+	if loc := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || loc != "/new/place/" {
+		t.Errorf("Move: got status %d & location %q, want %d & %q", resp.Code, loc, http.StatusSeeOther, "/new/place/")
+	}
+	list("[/dirt/c /new/place/a /new/place/sub/b /other/a /ro/dir/d /ro/dir/sub/e]")
+	resp = do(http.MethodPost, "/new/place/?delete-tree", url.Values{"confirm-name": {"place"}})
+	if loc := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || loc != "/new/" {
+		t.Errorf("Delete: got status %d & location %q, want %d & %q", resp.Code, loc, http.StatusSeeOther, "/new/")
+	}
+	list("[/dirt/c /other/a /ro/dir/d /ro/dir/sub/e]")
+
+	// A partial failure reports which entries were processed.
+	resp = do(http.MethodPost, "/ro/dir/?delete-tree", url.Values{"confirm-name": {"dir"}})
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Partial delete: got status %d, want %d", resp.Code, http.StatusForbidden)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "<li>/ro/dir/d</li>") || strings.Contains(body, "<li>/ro/dir/sub/e</li>") {
+		t.Errorf("Partial delete response did not list the deleted entries: %q", body)
+	}
+	list("[/dirt/c /other/a /ro/dir/sub/e]")
+
+	// The root directory can't be deleted.
+	if resp := do(http.MethodPost, "/?delete-tree", url.Values{"confirm-name": {"/"}}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Delete of root: got status %d, want %d", resp.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/e3b0c442/warp"
+
+	"github.com/BranLwyd/harpocrates/harpd/passwordless"
+	"github.com/BranLwyd/harpocrates/harpd/rate"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+var passwordlessTmpl = newTemplate("passwordless", "templates/passwordless.html")
+
+// passwordlessHandler lists the MFA devices allowed to log in in place of the
+// user's passphrase, allowing devices to be registered, allowed & disallowed.
+// It assumes it can get an authenticated session from the request.
+type passwordlessHandler struct {
+	sh *session.Handler
+}
+
+func newPasswordless(sh *session.Handler) *passwordlessHandler {
+	return &passwordlessHandler{sh: sh}
+}
+
+func (passwordlessHandler) authPath(r *http.Request) (string, error) {
+	// As for removing an MFA device, disabling passwordless login requires a
+	// fresh MFA assertion. Enabling it requires an assertion anyway.
+	if r.FormValue("disable") != "" {
+		return session.CredentialsPath, nil
+	}
+	return authAny, nil
+}
+
+func (ph passwordlessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	if sess == nil {
+		logf(r, "Could not get authenticated session in passwordless handler")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ph.servePasswordlessHTTP(w, r, sess, http.StatusOK, "")
+
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "enable":
+			ph.serveEnableHTTP(w, r, sess)
+
+		case "disable":
+			if err := ph.sh.DisablePasswordlessUnlock(sess.User(), r.FormValue("disable")); err != nil && !errors.Is(err, passwordless.ErrNoPassphrase) {
+				logf(r, "Could not disable passwordless login: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			redirect(w, r, "/passwordless")
+
+		default:
+			redirect(w, r, "/passwordless")
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (ph passwordlessHandler) serveEnableHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	cred := &warp.AssertionPublicKeyCredential{}
+	if err := json.Unmarshal([]byte(r.FormValue("response")), cred); err != nil {
+		logf(r, "Could not parse MFA response: %v", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	prf, err := base64.StdEncoding.DecodeString(r.FormValue("prf"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch err := sess.EnablePasswordlessUnlock(r.FormValue("pass"), cred, prf); {
+	case err == nil:
+		redirect(w, r, "/passwordless")
+	case errors.Is(err, session.ErrPRFUnsupported):
+		ph.servePasswordlessHTTP(w, r, sess, http.StatusBadRequest, "This MFA device can't log in in place of the passphrase.")
+	case errors.Is(err, secret.ErrWrongPassphrase):
+		ph.servePasswordlessHTTP(w, r, sess, http.StatusForbidden, "Wrong passphrase.")
+	case errors.Is(err, session.ErrMFACounterRegression):
+		logf(r, "MFA signature counter regression; device may be cloned")
+		ph.servePasswordlessHTTP(w, r, sess, http.StatusForbidden, "MFA authentication failed.")
+	case errors.Is(err, session.ErrMFAAuthenticationFailed), errors.Is(err, session.ErrNoChallenge):
+		ph.servePasswordlessHTTP(w, r, sess, http.StatusForbidden, "MFA authentication failed.")
+	case errors.Is(err, session.ErrNoSession):
+		// Too many failed assertions closed the session; the redirect leads
+		// back to the passphrase login.
+		logf(r, "Session closed after too many failed MFA assertions")
+		redirect(w, r, "/passwordless")
+	case errors.Is(err, rate.ErrTooManyEvents):
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	default:
+		logf(r, "Could not enable passwordless login: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// servePasswordlessHTTP serves the passwordless login page, listing the MFA
+// devices allowed to log in in place of the user's passphrase. If the request
+// names a device to disable, the page instead asks the user to confirm
+// disabling it.
+func (ph passwordlessHandler) servePasswordlessHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session, code int, errMsg string) {
+	devs := ph.sh.PasswordlessDevices(sess.User())
+	labels := map[string]string{}
+	for _, c := range ph.sh.Credentials(sess.User()) {
+		labels[c.ID] = c.Label
+	}
+	type device struct {
+		passwordless.Passphrase
+		Label string
+	}
+	var devices []device
+	for _, d := range devs {
+		devices = append(devices, device{d, labels[d.CredentialID]})
+	}
+	var disable *device
+	for i := range devices {
+		if devices[i].CredentialID == r.FormValue("disable") {
+			disable = &devices[i]
+		}
+	}
+	if r.FormValue("disable") != "" && disable == nil {
+		redirect(w, r, "/passwordless")
+		return
+	}
+
+	var regChallenge, challenge []byte
+	if disable == nil {
+		rc, err := sess.GeneratePasswordlessRegistrationChallenge()
+		if err != nil {
+			logf(r, "Could not create MFA registration challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		c, err := sess.GeneratePasswordlessEnrollmentChallenge()
+		if err != nil {
+			logf(r, "Could not create MFA challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if regChallenge, err = json.Marshal(rc); err != nil {
+			logf(r, "Could not marshal MFA registration challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if challenge, err = json.Marshal(c); err != nil {
+			logf(r, "Could not marshal MFA challenge: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	serveTemplateStatus(w, r, code, passwordlessTmpl, struct {
+		RegistrationChallenge string
+		Challenge             string
+		Devices               []device
+		Disable               *device
+		Error                 string
+	}{string(regChallenge), string(challenge), devices, disable, errMsg})
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/passwordless"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestPasswordless(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_passwordless_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A registration is an all-zero AAGUID, the length-prefixed credential ID, and the public key (here, an empty CBOR map).
+	reg := base64.RawURLEncoding.EncodeToString(append(append(make([]byte, 16), 0, 3), "key\xa0"...))
+	ps, err := passwordless.NewStore(filepath.Join(dir, "passwordless"))
+	if err != nil {
+		t.Fatalf("Could not create passwordless store: %v", err)
+	}
+	sh, err := session.NewHandler(memVault{&memStore{}}, "https://example.com", []string{reg}, nil, time.Minute, 1000, alert.NewLog(), session.WithCredentialFile(filepath.Join(dir, "credentials")), session.WithPasswordlessUnlock(ps))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	const id = "a2V5" // base64url("key")
+	if err := ps.Wrap(id, "", make([]byte, 32), "password", time.Now()); err != nil {
+		t.Fatalf("Could not wrap passphrase: %v", err)
+	}
+	ph := newPasswordless(sh)
+
+	newRequest := func(method, target string, form url.Values) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+	}
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		ph.ServeHTTP(resp, newRequest(method, target, form))
+		return resp
+	}
+
+	// Disabling a device requires fresh MFA; viewing & enabling devices does not.
+	for _, test := range []struct {
+		method, target string
+		form           url.Values
+		want           string
+	}{
+		{http.MethodGet, "/passwordless", nil, authAny},
+		{http.MethodPost, "/passwordless", url.Values{"action": {"enable"}}, authAny},
+		{http.MethodGet, "/passwordless?disable=" + id, nil, session.CredentialsPath},
+		{http.MethodPost, "/passwordless", url.Values{"action": {"disable"}, "disable": {id}}, session.CredentialsPath},
+	} {
+		if got, err := ph.authPath(newRequest(test.method, test.target, test.form)); err != nil || got != test.want {
+			t.Errorf("authPath(%s %s %v) = %q (error %v), want %q", test.method, test.target, test.form, got, err, test.want)
+		}
+	}
+
+	// Devices which can't supply a PRF output can't be enabled.
+	if resp := do(http.MethodPost, "/passwordless", url.Values{"action": {"enable"}, "response": {"{}"}, "pass": {"password"}}); resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "can&#39;t log in") {
+		t.Errorf("Enable without PRF output: got status %d (%q), want %d explaining why", resp.Code, resp.Body.String(), http.StatusBadRequest)
+	}
+
+	// Enabled devices are listed, and can be disabled after confirmation.
+	if resp := do(http.MethodGet, "/passwordless", nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `value="`+id+`"`) {
+		t.Errorf("GET /passwordless: got status %d (%q), want %d listing the device", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if resp := do(http.MethodGet, "/passwordless?disable="+id, nil); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `value="disable"`) {
+		t.Errorf("GET /passwordless?disable: got status %d (%q), want %d asking for confirmation", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if resp := do(http.MethodGet, "/passwordless?disable=nope", nil); resp.Code != http.StatusSeeOther {
+		t.Errorf("GET /passwordless?disable with unknown device: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if resp := do(http.MethodPost, "/passwordless", url.Values{"action": {"disable"}, "disable": {id}}); resp.Code != http.StatusSeeOther {
+		t.Errorf("Disable: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if devs := sh.PasswordlessDevices(""); len(devs) != 0 {
+		t.Errorf("After disable, devices = %+v, want none", devs)
+	}
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var prefsTmpl = newTemplate("prefs", "templates/prefs.html")
+
+// prefsCookieMaxAge is the max age of the preferences cookie, in seconds.
+const prefsCookieMaxAge = 365 * 24 * 60 * 60
+
+// prefsCookie configures the cookie holding a browser's preferences. Unlike
+// the session cookie, it is not sensitive: it is sent on top-level navigation
+// from other sites, so that pages render consistently.
+var prefsCookie = SessionCookie{
+	Name:     hostPrefix + "harp-prefs",
+	Path:     "/",
+	SameSite: http.SameSiteLaxMode,
+}
+
+// Allowed preference values. The first of each is the default.
+var (
+	prefsThemes    = []string{"auto", "light", "dark"}
+	prefsDensities = []string{"comfortable", "compact"}
+)
+
+// prefs are the display preferences of a browser, stored in a signed cookie
+// rather than with any account, so that they apply before logging in.
+type prefs struct {
+	Theme   string // one of prefsThemes
+	Density string // one of prefsDensities
+}
+
+var defaultPrefs = prefs{Theme: prefsThemes[0], Density: prefsDensities[0]}
+
+// Class returns the classes applied to the <body> of each page to select the
+// styles for the preferences, e.g. "theme-dark density-compact". Styles are
+// toggled by class, since the Content-Security-Policy forbids inline styles.
+func (p prefs) Class() string {
+	return fmt.Sprintf("theme-%s density-%s", p.Theme, p.Density)
+}
+
+// DarkMedia returns the media query under which the dark stylesheet applies,
+// or the empty string if it never does.
+func (p prefs) DarkMedia() string {
+	switch p.Theme {
+	case "dark":
+		return "all"
+	case "auto":
+		return "(prefers-color-scheme: dark)"
+	default:
+		return ""
+	}
+}
+
+// valid determines if each preference has an allowed value.
+func (p prefs) valid() bool {
+	return contains(prefsThemes, p.Theme) && contains(prefsDensities, p.Density)
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// prefsSigner serializes preferences to, and parses them from, cookie values
+// of the form "<theme>.<density>.<MAC>". The MAC keeps other sites (e.g. via a
+// sibling subdomain) from injecting values into the cookie; preferences are
+// still checked against the allowed values when parsed.
+type prefsSigner struct {
+	key []byte
+}
+
+func (ps prefsSigner) mac(data string) string {
+	h := hmac.New(sha256.New, ps.key)
+	h.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (ps prefsSigner) value(p prefs) string {
+	data := p.Theme + "." + p.Density
+	return data + "." + ps.mac(data)
+}
+
+// parse parses the preferences from the given cookie value. Values which are
+// malformed, fail authentication or hold disallowed preferences are ignored,
+// giving the default preferences.
+func (ps prefsSigner) parse(value string) prefs {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return defaultPrefs
+	}
+	data, mac := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(ps.mac(data))) {
+		return defaultPrefs
+	}
+	parts := strings.Split(data, ".")
+	if len(parts) != 2 {
+		return defaultPrefs
+	}
+	p := prefs{Theme: parts[0], Density: parts[1]}
+	if !p.valid() {
+		return defaultPrefs
+	}
+	return p
+}
+
+// newPrefsKey generates a random key for signing preferences cookies.
+func newPrefsKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Could not generate preferences key: %v", err))
+	}
+	return key
+}
+
+// prefsContextKey is the context key of the preferences of the browser making
+// the request.
+type prefsContextKey struct{}
+
+// prefsContextHandler parses the preferences cookie of each request, making
+// the preferences available via prefsFrom.
+type prefsContextHandler struct {
+	ps     prefsSigner
+	cookie SessionCookie
+	h      http.Handler
+}
+
+func (pch prefsContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := defaultPrefs
+	if c, err := r.Cookie(pch.cookie.Name); err == nil {
+		p = pch.ps.parse(c.Value)
+	}
+	pch.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), prefsContextKey{}, p)))
+}
+
+// prefsFrom returns the preferences of the browser making the given request,
+// or the default preferences if they are not known.
+func prefsFrom(r *http.Request) prefs {
+	if p, ok := r.Context().Value(prefsContextKey{}).(prefs); ok {
+		return p
+	}
+	return defaultPrefs
+}
+
+// prefsHandler allows the browser's display preferences to be viewed &
+// changed. It does not require authentication.
+type prefsHandler struct {
+	ps     prefsSigner
+	cookie SessionCookie
+}
+
+func newPrefs(ps prefsSigner, cookie SessionCookie) *prefsHandler {
+	return &prefsHandler{
+		ps:     ps,
+		cookie: cookie,
+	}
+}
+
+func (ph prefsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		serveTemplate(w, r, prefsTmpl, struct {
+			Prefs     prefs
+			Themes    []string
+			Densities []string
+		}{prefsFrom(r), prefsThemes, prefsDensities})
+
+	case http.MethodPost:
+		p := prefs{Theme: r.FormValue("theme"), Density: r.FormValue("density")}
+		if !p.valid() {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, ph.cookie.cookie(ph.ps.value(p), prefsCookieMaxAge))
+		redirect(w, r, "/prefs")
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
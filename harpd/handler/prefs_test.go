@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/harpd/csp"
+)
+
+func TestPrefs(t *testing.T) {
+	t.Parallel()
+	key := []byte("key")
+	h := NewSecureHeader(csp.Default(), newTestContent(t, WithPrefsKey(key)))
+	do := func(method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+	checkPage := func(desc string, resp *httptest.ResponseRecorder, wantClass, wantDarkMedia string) {
+		t.Helper()
+		if resp.Code != http.StatusOK {
+			t.Errorf("[%s] Got status %d, want %d", desc, resp.Code, http.StatusOK)
+			return
+		}
+		if got := resp.Header().Get("Content-Security-Policy"); !strings.Contains(got, "default-src 'self'") {
+			t.Errorf("[%s] Got Content-Security-Policy %q, want default-src 'self'", desc, got)
+		}
+		body := resp.Body.String()
+		if want := `<body class="` + wantClass + `">`; !strings.Contains(body, want) {
+			t.Errorf("[%s] Page does not contain %q: %q", desc, want, body)
+		}
+		hasDark := strings.Contains(body, "/style-dark.css")
+		switch {
+		case wantDarkMedia == "" && hasDark:
+			t.Errorf("[%s] Page unexpectedly links to dark style: %q", desc, body)
+		case wantDarkMedia != "" && !strings.Contains(body, `media="`+wantDarkMedia+`"`):
+			t.Errorf("[%s] Page does not link to dark style with media %q: %q", desc, wantDarkMedia, body)
+		}
+	}
+
+	// Without a cookie, the default preferences are used.
+	checkPage("login, no cookie", do(http.MethodGet, "/entry", nil), "theme-auto density-comfortable", "(prefers-color-scheme: dark)")
+	checkPage("prefs, no cookie", do(http.MethodGet, "/prefs", nil), "theme-auto density-comfortable", "(prefers-color-scheme: dark)")
+
+	// Saving preferences sets a cookie, which round-trips.
+	resp := do(http.MethodPost, "/prefs", url.Values{"theme": {"dark"}, "density": {"compact"}})
+	if got, want := resp.Header().Get("Location"), "/prefs"; resp.Code != http.StatusSeeOther || got != want {
+		t.Errorf("Save: got status %d & location %q, want %d & %q", resp.Code, got, http.StatusSeeOther, want)
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "__Host-harp-prefs" || !cookies[0].Secure || cookies[0].MaxAge <= 0 {
+		t.Fatalf("Save set cookies %v, want one persistent secure cookie named %q", cookies, "__Host-harp-prefs")
+	}
+	c := cookies[0]
+	checkPage("login, dark", do(http.MethodGet, "/entry", nil, c), "theme-dark density-compact", "all")
+	checkPage("prefs, dark", do(http.MethodGet, "/prefs", nil, c), "theme-dark density-compact", "all")
+	if body := do(http.MethodGet, "/prefs", nil, c).Body.String(); !strings.Contains(body, `<option value="dark" selected>`) {
+		t.Errorf("Prefs page does not select saved theme: %q", body)
+	}
+	resp = do(http.MethodPost, "/prefs", url.Values{"theme": {"light"}, "density": {"comfortable"}}, c)
+	checkPage("login, light", do(http.MethodGet, "/entry", nil, resp.Result().Cookies()...), "theme-light density-comfortable", "")
+
+	// Disallowed preferences are not saved.
+	for _, form := range []url.Values{
+		{"theme": {"dark\" onload=\"alert(1)"}, "density": {"compact"}},
+		{"theme": {"dark"}, "density": {"tiny"}},
+		{"theme": {"dark"}},
+	} {
+		resp := do(http.MethodPost, "/prefs", form)
+		if resp.Code != http.StatusBadRequest || len(resp.Result().Cookies()) != 0 {
+			t.Errorf("Save %v: got status %d & cookies %v, want %d & none", form, resp.Code, resp.Result().Cookies(), http.StatusBadRequest)
+		}
+	}
+
+	// Invalid or malicious cookies are ignored, without error.
+	ps := prefsSigner{key}
+	for _, test := range []struct {
+		desc, value string
+	}{
+		{"empty", ""},
+		{"garbage", "garbage"},
+		{"unsigned", "dark.compact"},
+		{"bad MAC", "dark.compact.AAAA"},
+		{"MAC for other preferences", "dark.compact." + ps.mac("light.compact")},
+		{"other key", prefsSigner{[]byte("other key")}.value(prefs{Theme: "dark", Density: "compact"})},
+		{"disallowed theme", ps.value(prefs{Theme: `dark"><script>alert(1)</script>`, Density: "compact"})},
+		{"too many parts", "dark.compact.x." + ps.mac("dark.compact.x")},
+	} {
+		c := &http.Cookie{Name: "__Host-harp-prefs", Value: test.value}
+		checkPage("login, "+test.desc, do(http.MethodGet, "/entry", nil, c), "theme-auto density-comfortable", "(prefers-color-scheme: dark)")
+		checkPage("prefs, "+test.desc, do(http.MethodGet, "/prefs", nil, c), "theme-auto density-comfortable", "(prefers-color-scheme: dark)")
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/assets"
+)
+
+// templates is the registry of templates rendered by serveTemplate, in the
+// order they were defined.
+var templates []*templateDef
+
+// templateDef defines a template parsed from an asset, which may be
+// overridden (see WithAssetOverrides). The template parsed from the embedded
+// asset is parsed the first time it is needed.
+type templateDef struct {
+	name  string
+	asset string
+	funcs []template.FuncMap // functions used by the template, in addition to templateFuncs
+
+	once     sync.Once
+	embedded *template.Template
+	err      error
+}
+
+// newTemplate defines a template with the given name, parsed from the given
+// asset, & registers it in templates.
+func newTemplate(name, asset string, funcs ...template.FuncMap) *templateDef {
+	td := &templateDef{name: name, asset: asset, funcs: funcs}
+	templates = append(templates, td)
+	return td
+}
+
+// parse parses the template from the given content.
+func (td *templateDef) parse(content []byte) (*template.Template, error) {
+	t := template.New(td.name).Funcs(templateFuncs)
+	for _, f := range td.funcs {
+		t = t.Funcs(f)
+	}
+	t, err := t.Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %q template: %w", td.name, err)
+	}
+	return t, nil
+}
+
+// embeddedTemplate returns the template parsed from the embedded asset.
+func (td *templateDef) embeddedTemplate() (*template.Template, error) {
+	td.once.Do(func() {
+		content, err := fs.ReadFile(assets.FS, td.asset)
+		if err != nil {
+			td.err = fmt.Errorf("couldn't read %q template: %w", td.name, err)
+			return
+		}
+		td.embedded, td.err = td.parse(content)
+	})
+	return td.embedded, td.err
+}
+
+// resolver finds the templates & static assets to serve, preferring files in
+// an override directory to the embedded assets. A nil *resolver always uses
+// the embedded assets.
+type resolver struct {
+	dir    string // override directory
+	reload bool   // whether overrides are re-read on every use, rather than cached until they change
+
+	mu        sync.Mutex           // protects overrides
+	overrides map[string]*override // cached overrides, by asset name
+}
+
+// override is the content of a file overriding an asset, along with the value
+// (a template or static handler) derived from it.
+type override struct {
+	modTime time.Time
+	size    int64
+	content []byte
+
+	once    sync.Once
+	derived interface{}
+	err     error
+}
+
+// derive returns the value derived from the override's content by f, which
+// is called at most once per override.
+func (o *override) derive(f func(content []byte) (interface{}, error)) (interface{}, error) {
+	o.once.Do(func() { o.derived, o.err = f(o.content) })
+	return o.derived, o.err
+}
+
+func newResolver(dir string, reload bool) *resolver {
+	return &resolver{dir: dir, reload: reload, overrides: map[string]*override{}}
+}
+
+// override returns the file overriding the given asset, or nil if it is not
+// overridden. Files in the override directory are named as in assets.FS.
+func (rs *resolver) override(name string) (*override, error) {
+	if rs == nil {
+		return nil, nil
+	}
+	filename := filepath.Join(rs.dir, filepath.FromSlash(name))
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't stat %q: %w", filename, err)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if o := rs.overrides[name]; !rs.reload && o != nil && o.modTime.Equal(fi.ModTime()) && o.size == fi.Size() {
+		return o, nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	o := &override{modTime: fi.ModTime(), size: fi.Size(), content: content}
+	if !rs.reload {
+		rs.overrides[name] = o
+	}
+	return o, nil
+}
+
+// template returns the given template, parsed from its override if it is
+// overridden.
+func (rs *resolver) template(td *templateDef) (*template.Template, error) {
+	o, err := rs.override(td.asset)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return td.embeddedTemplate()
+	}
+	t, err := o.derive(func(content []byte) (interface{}, error) { return td.parse(content) })
+	if err != nil {
+		return nil, err
+	}
+	return t.(*template.Template), nil
+}
+
+// asset returns the handler for the static asset served at the given path,
+// serving its override if it is overridden.
+func (rs *resolver) asset(p string) (*cacheableStaticHandler, error) {
+	csh, ok := contentAssets[p]
+	if !ok {
+		return nil, fmt.Errorf("no asset served at %q", p)
+	}
+	o, err := rs.override(csh.name)
+	if err != nil || o == nil {
+		return csh, err
+	}
+	h, err := o.derive(func(content []byte) (interface{}, error) {
+		return newCacheableStatic(csh.name, content, csh.contentType)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*cacheableStaticHandler), nil
+}
+
+// assetURL returns the content-hashed URL of the static asset served at the
+// given path; see the assetURL function.
+func (rs *resolver) assetURL(p string) (string, error) {
+	csh, err := rs.asset(p)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Path: p, RawQuery: url.Values{"v": {csh.hash}}.Encode()}).String(), nil
+}
+
+// assetHandler serves the static asset at the given path.
+func (rs *resolver) assetHandler(p string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		csh, err := rs.asset(p)
+		if err != nil {
+			logf(r, "Could not get asset: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		csh.ServeHTTP(w, r)
+	})
+}
+
+// resolverContextKey is the context key of the resolver used to serve the
+// request.
+type resolverContextKey struct{}
+
+// resolverHandler serves a handler, making the given resolver available to it
+// via resolverFrom.
+type resolverHandler struct {
+	rs *resolver
+	h  http.Handler
+}
+
+func (rh resolverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), resolverContextKey{}, rh.rs)))
+}
+
+// resolverFrom returns the resolver used to serve the given request, or nil if
+// assets are not overridden.
+func resolverFrom(r *http.Request) *resolver {
+	rs, _ := r.Context().Value(resolverContextKey{}).(*resolver)
+	return rs
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/assets"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestEmbeddedTemplates(t *testing.T) {
+	t.Parallel()
+	// Templates are parsed when first served, so a missing or broken template
+	// would otherwise go unnoticed until then.
+	for _, td := range templates {
+		if _, err := fs.Stat(assets.FS, td.asset); err != nil {
+			t.Errorf("Could not find %q template: %v", td.name, err)
+			continue
+		}
+		if _, err := td.embeddedTemplate(); err != nil {
+			t.Errorf("Could not parse %q template: %v", td.name, err)
+		}
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "resolver_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0700); err != nil {
+		t.Fatalf("Could not create templates directory: %v", err)
+	}
+	overrideFile := filepath.Join(dir, "templates", "entry-view.html")
+
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{"/entry": "password"}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	ph := newPassword(nil, 0, DefaultAttachmentMaxSize, DefaultEntryMaxSize, false, DefaultExpiryWindow, false, false, 0)
+
+	for _, reload := range []bool{false, true} {
+		rs := newResolver(dir, reload)
+		serve := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/entry", nil)
+			req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+			resp := httptest.NewRecorder()
+			resolverHandler{rs, ph}.ServeHTTP(resp, req)
+			return resp
+		}
+		write := func(content string, modTime time.Time) {
+			if err := ioutil.WriteFile(overrideFile, []byte(content), 0600); err != nil {
+				t.Fatalf("Could not write override: %v", err)
+			}
+			if err := os.Chtimes(overrideFile, modTime, modTime); err != nil {
+				t.Fatalf("Could not set override modification time: %v", err)
+			}
+		}
+		os.Remove(overrideFile)
+		now := time.Now()
+
+		// Without an override, the embedded template is used.
+		if resp := serve(); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "password") {
+			t.Errorf("[reload=%v] GET without override: got status %d & body %q, want %d & the entry", reload, resp.Code, resp.Body.String(), http.StatusOK)
+		}
+
+		// An override is used in preference to the embedded template, and
+		// picked up when it changes.
+		write(`<p>Overridden: {{.Content}} <a href="{{url "/"}}">up</a></p>`, now.Add(-time.Hour))
+		if resp := serve(); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "<p>Overridden: password") {
+			t.Errorf("[reload=%v] GET with override: got status %d & body %q, want %d & the overridden page", reload, resp.Code, resp.Body.String(), http.StatusOK)
+		}
+		write(`<p>Changed: {{.Content}}</p>`, now)
+		if resp := serve(); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "<p>Changed: password") {
+			t.Errorf("[reload=%v] GET with changed override: got status %d & body %q, want %d & the changed page", reload, resp.Code, resp.Body.String(), http.StatusOK)
+		}
+
+		// A broken override causes an error, rather than a panic or a
+		// fallback to the embedded template.
+		write(`<p>{{.Content</p>`, now.Add(time.Hour))
+		if resp := serve(); resp.Code != http.StatusInternalServerError {
+			t.Errorf("[reload=%v] GET with broken override: got status %d, want %d", reload, resp.Code, http.StatusInternalServerError)
+		}
+		if _, err := rs.template(entryViewTmpl); err == nil || !strings.Contains(err.Error(), "parse") {
+			t.Errorf("[reload=%v] Resolving broken override got error %v, want parse error", reload, err)
+		}
+	}
+}
+
+func TestAssetOverride(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "resolver_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "etc"), 0700); err != nil {
+		t.Fatalf("Could not create etc directory: %v", err)
+	}
+	const style = "body { color: red; }"
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc", "style.css"), []byte(style), 0600); err != nil {
+		t.Fatalf("Could not write override: %v", err)
+	}
+	h := newTestContent(t, WithAssetOverrides(dir, false))
+
+	// Overridden assets are served & linked with their own hash; others are
+	// served from the embedded assets.
+	if resp := doAssetRequest(h, "/style.css", nil); resp.Code != http.StatusOK || resp.Body.String() != style {
+		t.Errorf("GET /style.css: got status %d & body %q, want %d & %q", resp.Code, resp.Body.String(), http.StatusOK, style)
+	}
+	if resp := doAssetRequest(h, "/robots.txt", nil); resp.Code != http.StatusOK || resp.Body.String() != string(contentAssets["/robots.txt"].content) {
+		t.Errorf("GET /robots.txt: got status %d & body %q, want %d & the embedded asset", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	embeddedURL, err := assetURL("/style.css")
+	if err != nil {
+		t.Fatalf("Could not get asset URL: %v", err)
+	}
+	resp := doAssetRequest(h, "/entry", nil)
+	if body := resp.Body.String(); !strings.Contains(body, `href="/style.css?v=`) || strings.Contains(body, embeddedURL) {
+		t.Errorf("Login page does not link to overridden style: %q", body)
+	}
+}
+
+// inlineTemplate returns a template parsed from the given content, rather than
+// an asset. It is not registered in templates.
+func inlineTemplate(name, content string) *templateDef {
+	td := &templateDef{name: name}
+	td.once.Do(func() { td.embedded, td.err = td.parse([]byte(content)) })
+	if td.err != nil {
+		panic(td.err)
+	}
+	return td
+}
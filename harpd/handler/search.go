@@ -1,23 +1,37 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
-	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/text/collate"
 	"golang.org/x/text/language"
 	"golang.org/x/text/search"
 
-	"github.com/BranLwyd/harpocrates/harpd/assets"
+	"github.com/BranLwyd/harpocrates/harpd/fuzzy"
+	"github.com/BranLwyd/harpocrates/harpd/listing"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+const (
+	// contentQueryPrefix is the prefix of queries which search entry
+	// content, rather than entry names.
+	contentQueryPrefix = "c:"
+
+	// contentSearchLimit is the maximum number of entries whose content is
+	// searched per request. Further entries are searched by following the
+	// continuation link on the results page.
+	contentSearchLimit = 200
 )
 
 var (
-	searchTmpl = template.Must(template.New("search").Funcs(map[string]interface{}{
+	searchTmpl = newTemplate("search", "templates/search.html", map[string]interface{}{
 		"relative": func(entryPath string) string { return strings.TrimPrefix(entryPath, "/") },
-	}).Parse(string(assets.MustAsset("harpd/assets/templates/search.html"))))
+	})
 )
 
 // searchHandler handles searching & the search UI.
@@ -28,67 +42,236 @@ func newSearch() *searchHandler {
 }
 
 func (searchHandler) authPath(r *http.Request) (string, error) {
+	if _, ok := contentQuery(r); ok {
+		// Searching content decrypts every entry, so don't search
+		// until the user has authenticated.
+		return authAny, nil
+	}
 	matches, err := performSearch(r)
 	if err != nil {
 		return "", fmt.Errorf("couldn't perform search: %w", err)
 	}
-	if len(matches) == 1 {
+	if e, ok := searchRedirect(matches); ok {
 		// Authenticate against the page we'll be forwarding to,
 		// since we're about to forward to it.
-		return matches[0], nil
+		return e, nil
 	}
-	return authAny, nil
+	return authBrowse, nil
 }
 
 func (searchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	query := r.FormValue("q")
 	if query == "" {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		redirect(w, r, "/")
+		return
+	}
+	if cq, ok := contentQuery(r); ok {
+		serveContentSearch(w, r, cq)
 		return
 	}
 	matches, err := performSearch(r)
 	if err != nil {
-		log.Printf("Could not perform search: %v", err)
+		logf(r, "Could not perform search: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	if wantsJSON(r) {
+		entries := make([]string, len(matches))
+		for i, m := range matches {
+			entries[i] = m.Entry
+		}
+		res := listing.Search{Query: query, Matches: make([]listing.Match, len(matches))}
+		for i, e := range listingEntries(sessionFrom(r).GetStore(), entries) {
+			res.Matches[i].Entry = e
+		}
+		serveJSON(w, r, res)
+		return
+	}
+
 	// If there's only one result, redirect the user to it.
-	if len(matches) == 1 {
-		http.Redirect(w, r, matches[0], http.StatusSeeOther)
+	if e, ok := searchRedirect(matches); ok {
+		redirect(w, r, e)
 		return
 	}
 
-	// There are zero or multiple results. Show the results to the user.
-	serveTemplate(w, r, searchTmpl, struct {
-		Query   string
-		Matches []string
-	}{query, matches})
+	// There are zero or multiple results, or a single fuzzy result. Show
+	// the results to the user.
+	serveTemplate(w, r, searchTmpl, searchResults{Query: query, Matches: matches})
+}
+
+// searchResults is the data passed to searchTmpl.
+type searchResults struct {
+	Query          string
+	Matches        []searchMatch  // entries whose names match, best match first, for name searches
+	ContentSearch  bool           // whether entry content was searched
+	ContentMatches []contentMatch // entries whose content matches, for content searches
+	Next           int            // index of the entry to continue a content search from; zero if the search is complete
+}
+
+func serveContentSearch(w http.ResponseWriter, r *http.Request, query string) {
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	matches, next, err := performContentSearch(r, query, start)
+	if err != nil {
+		logf(r, "Could not perform content search: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(r) {
+		entries := make([]string, len(matches))
+		for i, m := range matches {
+			entries[i] = m.Entry
+		}
+		res := listing.Search{Query: query, Content: true, Matches: make([]listing.Match, len(matches)), Next: next}
+		for i, e := range listingEntries(sessionFrom(r).GetStore(), entries) {
+			res.Matches[i] = listing.Match{Entry: e, Line: &listing.Line{Before: matches[i].Before, Match: matches[i].Match, After: matches[i].After}}
+		}
+		serveJSON(w, r, res)
+		return
+	}
+	serveTemplate(w, r, searchTmpl, searchResults{Query: query, ContentSearch: true, ContentMatches: matches, Next: next})
 }
 
-func performSearch(r *http.Request) ([]string, error) {
+// contentQuery returns the query of a search of entry content, with any
+// prefix removed. It returns false if the request is not for a content
+// search, i.e. the query lacks the "c:" prefix and the "content" checkbox is
+// not set.
+func contentQuery(r *http.Request) (string, bool) {
 	query := r.FormValue("q")
+	if strings.HasPrefix(query, contentQueryPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(query, contentQueryPrefix)), true
+	}
+	return query, r.FormValue("content") != ""
+}
+
+// contentMatch is an entry whose content matched a content search. Line is
+// the first matching line, split around the match so that it can be
+// highlighted.
+type contentMatch struct {
+	Entry                string
+	Before, Match, After string
+}
+
+// performContentSearch searches the content of entries for the given query,
+// starting from the start'th entry (in listing order) and searching at most
+// contentSearchLimit entries. The first line of each entry, holding the
+// password, is never searched. It returns the matching entries, along with the
+// index of the entry to continue searching from, or zero if every entry has
+// been searched. Entries are read via the session's store, so cached content
+// is used if the store caches.
+func performContentSearch(r *http.Request, query string, start int) ([]contentMatch, int, error) {
 	if query == "" {
-		return nil, nil
+		return nil, 0, nil
 	}
 	pat := search.New(language.English, search.IgnoreCase).Compile([]byte(query))
 
+	store := sessionFrom(r).GetStore()
+	allEntries, err := store.List()
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	var entries []string
+	for _, e := range allEntries {
+		// Ignore hidden entries.
+		if strings.Index(e, "/.") == -1 {
+			entries = append(entries, e)
+		}
+	}
+	sortListing(entries)
+	if start < 0 || start >= len(entries) {
+		return nil, 0, nil
+	}
+	next := start + contentSearchLimit
+	if next >= len(entries) {
+		next = 0
+		entries = entries[start:]
+	} else {
+		entries = entries[start:next]
+	}
+
+	var matches []contentMatch
+	for _, e := range entries {
+		content, err := store.Get(e)
+		if errors.Is(err, secret.ErrNoEntry) {
+			// Deleted since the entries were listed.
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("couldn't get %q: %w", e, err)
+		}
+		lines := strings.Split(content, "\n")
+		for _, l := range lines[1:] {
+			if i, j := pat.IndexString(l); i != -1 {
+				matches = append(matches, contentMatch{Entry: e, Before: l[:i], Match: l[i:j], After: l[j:]})
+				break
+			}
+		}
+	}
+	return matches, next, nil
+}
+
+// searchMatch is an entry whose name matched a name search.
+type searchMatch struct {
+	Entry string
+	fuzzy.Result
+}
+
+// Segments returns the entry's path, relative to the root, split so that the
+// characters matching the query can be highlighted.
+func (m searchMatch) Segments() []fuzzy.Segment {
+	return fuzzy.Segments(strings.TrimPrefix(m.Entry, "/"), m.Positions)
+}
+
+// searchRedirect returns the entry to redirect to for the given name search
+// matches, if any. The user is only redirected to a sole match of the query
+// which is exact or a prefix, so that a fuzzy match doesn't send them
+// somewhere unexpected.
+func searchRedirect(matches []searchMatch) (string, bool) {
+	if len(matches) != 1 || matches[0].Kind < fuzzy.Prefix {
+		return "", false
+	}
+	return matches[0].Entry, true
+}
+
+// performSearch searches entry names for the query, returning matches ranked
+// from best to worst: by kind of match (exact base name, base name prefix,
+// word boundary, subsequence), then by score, then by depth, then by name.
+func performSearch(r *http.Request) ([]searchMatch, error) {
+	query := r.FormValue("q")
+	if query == "" {
+		return nil, nil
+	}
+
 	sess := sessionFrom(r)
 	allEntries, err := sess.GetStore().List()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't list entries: %w", err)
 	}
-	var matches []string
+	var matches []searchMatch
 	for _, e := range allEntries {
 		// Ignore hidden entries.
 		if strings.Index(e, "/.") != -1 {
 			continue
 		}
 
-		if i, _ := pat.IndexString(e); i != -1 {
-			matches = append(matches, e)
+		if res, ok := fuzzy.Match(query, strings.TrimPrefix(e, "/")); ok {
+			matches = append(matches, searchMatch{e, res})
 		}
 	}
-	collate.New(language.English, collate.IgnoreCase).SortStrings(matches)
+	c := collators.Get().(*collate.Collator)
+	defer collators.Put(c)
+	sort.Slice(matches, func(i, j int) bool {
+		mi, mj := matches[i], matches[j]
+		if mi.Kind != mj.Kind {
+			return mi.Kind > mj.Kind
+		}
+		if mi.Score != mj.Score {
+			return mi.Score > mj.Score
+		}
+		if di, dj := strings.Count(mi.Entry, "/"), strings.Count(mj.Entry, "/"); di != dj {
+			return di < dj
+		}
+		return c.CompareString(mi.Entry, mj.Entry) < 0
+	})
 	return matches, nil
 }
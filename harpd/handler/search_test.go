@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/listing"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/dev/GitHub":     "pass",
+		"/GitHub":         "pass",
+		"/github-old":     "pass",
+		"/mail":           "pass",
+		"/.hidden/github": "pass",
+	}}
+	search := newTestSearch(t, s)
+
+	// Results are ranked: exact matches (shallowest first), then prefix matches.
+	resp := search(url.Values{"q": {"github"}})
+	body := resp.Body.String()
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Search got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	want := []string{
+		`<a href="/GitHub"><b>GitHub</b></a>`,
+		`<a href="/dev/GitHub">dev/<b>GitHub</b></a>`,
+		`<a href="/github-old"><b>github</b>-old</a>`,
+	}
+	last := -1
+	for _, w := range want {
+		i := strings.Index(body, w)
+		if i == -1 {
+			t.Errorf("Search results do not contain %q: %q", w, body)
+		} else if i < last {
+			t.Errorf("Search results have %q out of order: %q", w, body)
+		}
+		last = i
+	}
+	if strings.Contains(body, ".hidden") {
+		t.Errorf("Search results contain hidden entry: %q", body)
+	}
+
+	// Fuzzy matches are found & highlighted.
+	if body := search(url.Values{"q": {"gh"}}).Body.String(); !strings.Contains(body, `<a href="/GitHub"><b>G</b>it<b>H</b>ub</a>`) {
+		t.Errorf("Fuzzy search results do not highlight match: %q", body)
+	}
+
+	// A sole exact or prefix match is redirected to; a sole fuzzy match is not.
+	for _, test := range []struct {
+		query        string
+		wantRedirect bool
+	}{
+		{"mail", true},
+		{"MA", true},
+		{"ml", false},
+	} {
+		resp := search(url.Values{"q": {test.query}})
+		if test.wantRedirect {
+			if got := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || got != "/mail" {
+				t.Errorf("Search for %q got status %d & location %q, want %d & %q", test.query, resp.Code, got, http.StatusSeeOther, "/mail")
+			}
+		} else if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `<a href="/mail"><b>m</b>ai<b>l</b></a>`) {
+			t.Errorf("Search for %q got status %d & body %q, want %d & results page", test.query, resp.Code, resp.Body.String(), http.StatusOK)
+		}
+	}
+}
+
+func TestContentSearch(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/bank":    "p4ss\nuser: Alice\nurl: https://bank.example.com",
+		"/mail":    "alicepass\nuser: bob",
+		"/.hidden": "pass\nuser: alice",
+		"/empty":   "",
+	}}
+	search := newTestSearch(t, s)
+
+	// Content searches require authentication, and don't search until then.
+	if ap, err := newSearch().authPath(httptest.NewRequest(http.MethodGet, "/search?q=c:alice", nil)); err != nil || ap != authAny {
+		t.Errorf("authPath for content search = (%q, %v), want (%q, nil)", ap, err, authAny)
+	}
+
+	// Matches are highlighted, and the password line is never matched.
+	for _, query := range []url.Values{{"q": {"c:alice"}}, {"q": {"alice"}, "content": {"1"}}} {
+		resp := search(query)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Search for %v: got status %d, want %d", query, resp.Code, http.StatusOK)
+		}
+		body := resp.Body.String()
+		if !strings.Contains(body, `<a href="/bank">bank</a><div class="content-match">user: <mark>Alice</mark></div>`) {
+			t.Errorf("Search for %v did not highlight match: %q", query, body)
+		}
+		for _, unwanted := range []string{"/mail", "/.hidden", "Search more entries"} {
+			if strings.Contains(body, unwanted) {
+				t.Errorf("Search for %v unexpectedly contains %q: %q", query, unwanted, body)
+			}
+		}
+	}
+	if body := search(url.Values{"q": {"c:p4ss"}}).Body.String(); !strings.Contains(body, "No results.") {
+		t.Errorf("Search for password did not return no results: %q", body)
+	}
+}
+
+func TestContentSearchContinuation(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{}}
+	for i := 0; i < contentSearchLimit+50; i++ {
+		s.entries[fmt.Sprintf("/entry%03d", i)] = "password\nfind me"
+	}
+	search := newTestSearch(t, s)
+
+	// Each request searches a limited number of entries, linking to the next.
+	body := search(url.Values{"q": {"c:find"}}).Body.String()
+	if got := strings.Count(body, "<mark>"); got != contentSearchLimit {
+		t.Errorf("First page had %d matches, want %d", got, contentSearchLimit)
+	}
+	if want := fmt.Sprintf(`href="/search?content=1&amp;q=find&amp;start=%d"`, contentSearchLimit); !strings.Contains(body, want) {
+		t.Errorf("First page did not link to next page (%s): %q", want, body)
+	}
+	body = search(url.Values{"q": {"find"}, "content": {"1"}, "start": {fmt.Sprint(contentSearchLimit)}}).Body.String()
+	if got := strings.Count(body, "<mark>"); got != 50 {
+		t.Errorf("Second page had %d matches, want 50", got)
+	}
+	if !strings.Contains(body, "entry249") || strings.Contains(body, "Search more entries") {
+		t.Errorf("Second page did not end the search: %q", body)
+	}
+}
+
+// newTestSearch returns a function which performs a search with the given
+// form values in a session whose store is s.
+func TestSearchJSON(t *testing.T) {
+	t.Parallel()
+	s := &memStore{entries: map[string]string{
+		"/mail":  "pass\nuser: alice",
+		"/mail2": "pass\nuser: bob",
+	}}
+	search := newTestSearch(t, s)
+
+	// Results are served as HTML by default, and as JSON if requested. A sole match is not
+	// redirected to.
+	if got := search(url.Values{"q": {"mai"}}).Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Search got Content-Type %q, want HTML", got)
+	}
+	for _, test := range []struct {
+		query string
+		want  listing.Search
+	}{
+		{"mai", listing.Search{Query: "mai", Matches: []listing.Match{{Entry: listing.Entry{Path: "/mail"}}, {Entry: listing.Entry{Path: "/mail2"}}}}},
+		{"mail2", listing.Search{Query: "mail2", Matches: []listing.Match{{Entry: listing.Entry{Path: "/mail2"}}}}},
+		{"c:bob", listing.Search{Query: "bob", Content: true, Matches: []listing.Match{{Entry: listing.Entry{Path: "/mail2"}, Line: &listing.Line{Before: "user: ", Match: "bob"}}}}},
+	} {
+		resp := search(url.Values{"q": {test.query}, "format": {"json"}})
+		if resp.Code != http.StatusOK {
+			t.Errorf("JSON search for %q got status %d, want %d", test.query, resp.Code, http.StatusOK)
+			continue
+		}
+		if got := resp.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("JSON search for %q got Cache-Control %q, want %q", test.query, got, "no-store")
+		}
+		var got listing.Search
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Could not parse JSON response %q: %v", resp.Body.String(), err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("JSON search for %q = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func newTestSearch(t *testing.T, s *memStore) func(url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	return func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+form.Encode(), nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		newSearch().ServeHTTP(resp, req)
+		return resp
+	}
+}
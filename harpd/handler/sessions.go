@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/harpd/device"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+var sessionsTmpl = newTemplate("sessions", "templates/sessions.html")
+
+// sessionsHandler lists the active sessions & trusted devices, allowing
+// individual sessions & devices to be revoked.
+// It assumes it can get an authenticated session from the request.
+type sessionsHandler struct {
+	sh     *session.Handler
+	cookie SessionCookie
+}
+
+func newSessions(sh *session.Handler, cookie SessionCookie) *sessionsHandler {
+	return &sessionsHandler{
+		sh:     sh,
+		cookie: cookie,
+	}
+}
+
+func (sessionsHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (sh sessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	if sess == nil {
+		logf(r, "Could not get authenticated session in sessions handler")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		serveTemplate(w, r, sessionsTmpl, struct {
+			Sessions       []session.SessionInfo
+			CurrentID      string
+			APITokens      bool
+			TrustedDevices bool
+			Devices        []device.Device
+		}{userSessions(sh.sh, sess), sess.PublicID(), sh.sh.APITokensEnabled(), sh.sh.TrustedDevicesEnabled(), sh.sh.TrustedDevices(sess.User())})
+
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "revoke-session":
+			sh.revokeSession(w, r, sess)
+		case "revoke-device":
+			// Users may only revoke their own devices.
+			if err := sh.sh.RevokeTrustedDevice(sess.User(), r.FormValue("device")); err != nil && !errors.Is(err, device.ErrNoDevice) {
+				logf(r, "Could not revoke device: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			redirect(w, r, r.URL.RequestURI())
+		default:
+			redirect(w, r, r.URL.RequestURI())
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (sh sessionsHandler) revokeSession(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	id := r.FormValue("session")
+	if !hasSession(userSessions(sh.sh, sess), id) {
+		// Users may only revoke their own sessions.
+		redirect(w, r, r.URL.RequestURI())
+		return
+	}
+	if err := sh.sh.CloseSessionByID(id); err != nil && !errors.Is(err, session.ErrNoSession) {
+		logf(r, "Could not revoke session: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if id == sess.PublicID() {
+		// The user revoked their own session; send them back to log in.
+		sh.cookie.clear(w)
+		redirect(w, r, "/")
+		return
+	}
+	redirect(w, r, r.URL.RequestURI())
+}
+
+// userSessions returns a description of each active session bound to the same
+// user as the given session, oldest first.
+func userSessions(sh *session.Handler, sess *session.Session) []session.SessionInfo {
+	var infos []session.SessionInfo
+	for _, info := range sh.Sessions() {
+		if info.User == sess.User() {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// hasSession determines if the given sessions include the session with the
+// given public identifier.
+func hasSession(infos []session.SessionInfo, publicID string) bool {
+	for _, info := range infos {
+		if info.ID == publicID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/device"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestSessionsRevoke(t *testing.T) {
+	t.Parallel()
+	sh, err := session.NewHandler(memVault{&memStore{entries: map[string]string{}}}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("1.2.3.4", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	_, other, err := sh.CreateSession("5.6.7.8", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	h := newSessions(sh, DefaultSessionCookie)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/sessions", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Every session is listed.
+	resp := do(http.MethodGet, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("GET: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "1.2.3.4 (this session)") || !strings.Contains(body, "5.6.7.8") || !strings.Contains(body, other.PublicID()) {
+		t.Errorf("GET: response did not list both sessions: %q", body)
+	}
+
+	// Revoking another session closes it, leaving this one.
+	resp = do(http.MethodPost, url.Values{"action": {"revoke-session"}, "session": {other.PublicID()}})
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/sessions" {
+		t.Errorf("Revoking other session: got status %d to %q, want %d to %q", resp.Code, resp.Header().Get("Location"), http.StatusSeeOther, "/sessions")
+	}
+	if infos := sh.Sessions(); len(infos) != 1 || infos[0].ID != sess.PublicID() {
+		t.Errorf("After revoking other session, sessions = %+v, want only this session", infos)
+	}
+
+	// Revoking this session clears the cookie & returns to the login page.
+	resp = do(http.MethodPost, url.Values{"action": {"revoke-session"}, "session": {sess.PublicID()}})
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/" {
+		t.Errorf("Revoking this session: got status %d to %q, want %d to %q", resp.Code, resp.Header().Get("Location"), http.StatusSeeOther, "/")
+	}
+	if cs := resp.Result().Cookies(); len(cs) != 1 || cs[0].Name != DefaultSessionCookie.Name || cs[0].MaxAge >= 0 {
+		t.Errorf("Revoking this session set cookies %v, want session cookie cleared", cs)
+	}
+	if n := sh.ActiveSessionCount(); n != 0 {
+		t.Errorf("After revoking this session, %d sessions are active, want 0", n)
+	}
+}
+
+func TestSessionsOtherUser(t *testing.T) {
+	t.Parallel()
+	sh, err := session.NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithUsers(
+		session.User{Name: "alice", Vault: memVault{&memStore{entries: map[string]string{}}}},
+		session.User{Name: "bob", Vault: memVault{&memStore{entries: map[string]string{}}}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateUserSession("1.2.3.4", "", "alice", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	_, other, err := sh.CreateUserSession("5.6.7.8", "", "bob", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	h := newSessions(sh, DefaultSessionCookie)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/sessions", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Only the user's own sessions are listed.
+	resp := do(http.MethodGet, nil)
+	if body := resp.Body.String(); resp.Code != http.StatusOK || !strings.Contains(body, sess.PublicID()) || strings.Contains(body, other.PublicID()) {
+		t.Errorf("GET: got status %d, want %d listing only this user's sessions: %q", resp.Code, http.StatusOK, body)
+	}
+
+	// Another user's session can't be revoked.
+	do(http.MethodPost, url.Values{"action": {"revoke-session"}, "session": {other.PublicID()}})
+	if n := sh.ActiveSessionCount(); n != 2 {
+		t.Errorf("After revoking another user's session, %d sessions are active, want 2", n)
+	}
+}
+
+func TestSessionsRevokeDevice(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_handler_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := device.NewStore(filepath.Join(dir, "devices"), time.Hour)
+	if err != nil {
+		t.Fatalf("Could not create device store: %v", err)
+	}
+	_, mine, err := ds.Create("alice", "alice's laptop", time.Now())
+	if err != nil {
+		t.Fatalf("Could not trust device: %v", err)
+	}
+	_, theirs, err := ds.Create("bob", "bob's laptop", time.Now())
+	if err != nil {
+		t.Fatalf("Could not trust device: %v", err)
+	}
+	sh, err := session.NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithTrustedDevices(ds), session.WithUsers(
+		session.User{Name: "alice", Vault: memVault{&memStore{entries: map[string]string{}}}},
+		session.User{Name: "bob", Vault: memVault{&memStore{entries: map[string]string{}}}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateUserSession("1.2.3.4", "", "alice", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	h := newSessions(sh, DefaultSessionCookie)
+
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/sessions", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Only the user's own devices are listed.
+	resp := do(http.MethodGet, nil)
+	if body := resp.Body.String(); resp.Code != http.StatusOK || !strings.Contains(body, "alice&#39;s laptop") || strings.Contains(body, "bob") {
+		t.Errorf("GET: got status %d, want %d listing only this user's devices: %q", resp.Code, http.StatusOK, body)
+	}
+
+	// Another user's device can't be revoked; the user's own can.
+	do(http.MethodPost, url.Values{"action": {"revoke-device"}, "device": {theirs.ID}})
+	if devs := sh.TrustedDevices("bob"); len(devs) != 1 {
+		t.Errorf("After revoking another user's device, that user has %d devices, want 1", len(devs))
+	}
+	resp = do(http.MethodPost, url.Values{"action": {"revoke-device"}, "device": {mine.ID}})
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/sessions" {
+		t.Errorf("Revoking device: got status %d to %q, want %d to %q", resp.Code, resp.Header().Get("Location"), http.StatusSeeOther, "/sessions")
+	}
+	if devs := sh.TrustedDevices("alice"); len(devs) != 0 {
+		t.Errorf("After revoking device, user has %d devices, want 0", len(devs))
+	}
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+var (
+	shareCreatedTmpl = newTemplate("share-created", "templates/share-created.html", entryTmplFuncs)
+	shareViewTmpl    = newTemplate("share-view", "templates/share-view.html", entryTmplFuncs)
+)
+
+// shareHandler handles redemption of share links, created from the entry
+// view. Share links do not require a session: possession of the share token
+// is sufficient to view the shared entry, once.
+type shareHandler struct {
+	sh *session.Handler
+}
+
+func newShare(sh *session.Handler) *shareHandler {
+	return &shareHandler{sh: sh}
+}
+
+func (sh shareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	token := strings.TrimPrefix(r.URL.Path, "/share/")
+	if token == "" || strings.Contains(token, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Don't redeem the token on GET: link previewers (e.g. in chat
+		// applications) may fetch the link before the recipient does.
+		serveTemplate(w, r, shareViewTmpl, struct{ Path, Content string }{})
+
+	case http.MethodPost:
+		if r.FormValue("action") != "reveal" {
+			redirect(w, r, r.URL.RequestURI())
+			return
+		}
+		entryPath, content, err := sh.sh.RedeemShare(token)
+		if errors.Is(err, session.ErrNoShare) {
+			http.Error(w, "This link is invalid, has expired, or has already been used.", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logf(r, "Could not redeem share: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		serveTemplate(w, r, shareViewTmpl, struct{ Path, Content string }{entryPath, content})
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
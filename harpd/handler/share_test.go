@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestShareSingleUse(t *testing.T) {
+	t.Parallel()
+	sh, sess := newTestShareSession(t, time.Minute)
+	h := newShare(sh)
+
+	token, _, err := sess.CreateShare("/entry")
+	if err != nil {
+		t.Fatalf("Could not create share: %v", err)
+	}
+
+	// Viewing the link doesn't redeem it.
+	if resp := doShareRequest(h, http.MethodGet, token); resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), "hunter2") {
+		t.Fatalf("GET: got status %d with body %q, want status %d without content", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+
+	// Of many concurrent redemption attempts, exactly one succeeds.
+	const attempts = 20
+	var wg sync.WaitGroup
+	codes := make(chan int, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := doShareRequest(h, http.MethodPost, token)
+			if resp.Code == http.StatusOK && !strings.Contains(resp.Body.String(), "hunter2") {
+				t.Errorf("Redeemed share %q does not contain entry content", resp.Body.String())
+			}
+			codes <- resp.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	successes := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			successes++
+		case http.StatusNotFound:
+		default:
+			t.Errorf("Redemption attempt got unexpected status %d", code)
+		}
+	}
+	if successes != 1 {
+		t.Errorf("Share was redeemed %d times, want 1", successes)
+	}
+
+	// Unknown tokens can't be redeemed.
+	if resp := doShareRequest(h, http.MethodPost, "bogus"); resp.Code != http.StatusNotFound {
+		t.Errorf("Redeeming unknown token: got status %d, want %d", resp.Code, http.StatusNotFound)
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	t.Parallel()
+	sh, sess := newTestShareSession(t, 50*time.Millisecond)
+	h := newShare(sh)
+
+	token, _, err := sess.CreateShare("/entry")
+	if err != nil {
+		t.Fatalf("Could not create share: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := doShareRequest(h, http.MethodPost, token); resp.Code != http.StatusNotFound {
+				t.Errorf("Redeeming expired share: got status %d, want %d", resp.Code, http.StatusNotFound)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestShareOutlivesSession(t *testing.T) {
+	t.Parallel()
+	sh, sess := newTestShareSession(t, time.Minute)
+
+	token, _, err := sess.CreateShare("/entry")
+	if err != nil {
+		t.Fatalf("Could not create share: %v", err)
+	}
+	sess.Close()
+	if resp := doShareRequest(newShare(sh), http.MethodPost, token); resp.Code != http.StatusOK {
+		t.Errorf("Redeeming share after session closed: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+}
+
+func newTestShareSession(t *testing.T, shareDuration time.Duration) (*session.Handler, *session.Session) {
+	t.Helper()
+	store := &memStore{entries: map[string]string{"/entry": "hunter2"}}
+	sh, err := session.NewHandler(memVault{store}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithShareDuration(shareDuration))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	return sh, sess
+}
+
+func doShareRequest(h http.Handler, method, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/share/"+token, strings.NewReader(url.Values{"action": {"reveal"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+var statsTmpl = newTemplate("stats", "templates/stats.html", template.FuncMap{"size": formatApproxSize})
+
+// statsHandler summarizes the entries of the store: how many there are, how
+// much space they take, and when they were changed. Stats are gathered from
+// the store's storage without decrypting any entries.
+type statsHandler struct{}
+
+func newStats() *statsHandler { return &statsHandler{} }
+
+func (statsHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ss, ok := secret.AsStatsStore(sessionFrom(r).GetStore())
+	if !ok {
+		serveTemplate(w, r, statsTmpl, struct {
+			Available bool
+			secret.StoreStats
+		}{})
+		return
+	}
+	st, err := ss.Stats()
+	if err != nil {
+		logf(r, "Could not get store stats: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	serveTemplate(w, r, statsTmpl, struct {
+		Available bool
+		secret.StoreStats
+	}{true, st})
+}
+
+// formatApproxSize formats a size in bytes for display, rounding to one
+// decimal place in the largest suitable unit, e.g. "1.5 MiB".
+func formatApproxSize(n int64) string {
+	for _, u := range []struct {
+		size int64
+		name string
+	}{{1 << 30, "GiB"}, {1 << 20, "MiB"}, {1 << 10, "KiB"}} {
+		if n >= u.size {
+			return fmt.Sprintf("%.1f %s", float64(n)/float64(u.size), u.name)
+		}
+	}
+	if n == 1 {
+		return "1 byte"
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	changed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		desc  string
+		store secret.Store
+		want  []string
+	}{
+		{"unsupported", &memStore{}, []string{"Statistics are not available"}},
+		{"empty", statsMemStore{&memStore{}, secret.StoreStats{}}, []string{"There are no entries."}},
+		{"entries", statsMemStore{&memStore{}, secret.StoreStats{
+			Entries:      2,
+			Size:         1536,
+			DeepestEntry: "/dir/entry",
+			Oldest:       changed,
+			Newest:       changed,
+			Dirs:         []secret.DirStats{{Dir: "/", Entries: 2, Size: 1536, Newest: changed}, {Dir: "/dir/", Entries: 1, Size: 1, Newest: changed}},
+			Orphans:      []string{"/dir/.gopass_tmp_123"},
+		}}, []string{
+			"2 entries, taking 1.5 KiB",
+			`<a href="/dir/entry">/dir/entry</a>`,
+			`<a href="/dir/">/dir/</a>: 1 entry, taking 1 byte; last changed at 2020-01-02 03:04:05 UTC`,
+			"<li>/dir/.gopass_tmp_123</li>",
+		}},
+	} {
+		sh, err := session.NewHandler(statsVault{test.store}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+		if err != nil {
+			t.Fatalf("Could not create session handler: %v", err)
+		}
+		_, sess, err := sh.CreateSession("client", "", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		newStats().ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", test.desc, resp.Code, http.StatusOK)
+			continue
+		}
+		for _, w := range test.want {
+			if body := resp.Body.String(); !strings.Contains(body, w) {
+				t.Errorf("%s: page does not contain %q: %q", test.desc, w, body)
+			}
+		}
+	}
+}
+
+// statsMemStore is a memStore which reports the given stats.
+type statsMemStore struct {
+	*memStore
+	stats secret.StoreStats
+}
+
+func (s statsMemStore) Stats() (secret.StoreStats, error) { return s.stats, nil }
+
+// statsVault is a secret.Vault which unlocks to the given store.
+type statsVault struct{ s secret.Store }
+
+func (v statsVault) Unlock(string) (secret.Store, error) { return v.s, nil }
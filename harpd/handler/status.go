@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/harpd/authlog"
+)
+
+var statusTmpl = newTemplate("status", "templates/status.html")
+
+// statusHandler shows the recorded login attempts of each client.
+type statusHandler struct {
+	al *authlog.Log
+}
+
+func newStatus(al *authlog.Log) *statusHandler { return &statusHandler{al} }
+
+func (statusHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (sh statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	serveTemplate(w, r, statusTmpl, sh.al.Clients())
+}
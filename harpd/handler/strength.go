@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/BranLwyd/harpocrates/harpd/strength"
+)
+
+// strengthHandler handles requests to estimate the strength of a password,
+// for live feedback while editing an entry. The password is taken from the
+// body of a POST request, so that it does not appear in URLs or logs. It
+// assumes it can get an authenticated session from the request.
+type strengthHandler struct{}
+
+func newStrength() *strengthHandler {
+	return &strengthHandler{}
+}
+
+func (strengthHandler) authPath(r *http.Request) (string, error) {
+	return authAny, nil
+}
+
+func (strengthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	e := strength.Check(r.PostFormValue("password"))
+	respBytes, err := json.Marshal(struct {
+		Score     int     `json:"score"`
+		Guesses   float64 `json:"guesses_log10"`
+		CrackTime string  `json:"crack_time"`
+	}{e.Score, e.Guesses, e.CrackTime()})
+	if err != nil {
+		logf(r, "Could not marshal strength response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	newStatic(respBytes, "application/json").ServeHTTP(w, r)
+}
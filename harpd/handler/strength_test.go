@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStrength(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		password  string
+		wantScore int
+	}{
+		{"password", 0},
+		{"xK9#mQ2$vL7p", 4},
+	} {
+		form := url.Values{"password": {test.password}}
+		req := httptest.NewRequest(http.MethodPost, "/strength", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		newStrength().ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("Strength of %q: got status %d, want %d", test.password, resp.Code, http.StatusOK)
+			continue
+		}
+		var got struct {
+			Score     int    `json:"score"`
+			CrackTime string `json:"crack_time"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Errorf("Could not parse strength response %q: %v", resp.Body.String(), err)
+			continue
+		}
+		if got.Score != test.wantScore || got.CrackTime == "" {
+			t.Errorf("Strength of %q = %+v, want score %d", test.password, got, test.wantScore)
+		}
+	}
+
+	// Passwords are never accepted in the URL.
+	resp := httptest.NewRecorder()
+	newStrength().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/strength?password=password", nil))
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET strength: got status %d, want %d", resp.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/rate"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+var tokensTmpl = newTemplate("tokens", "templates/tokens.html")
+
+// tokensHandler lists the API tokens, allowing tokens to be created & revoked.
+// It assumes it can get an authenticated session from the request.
+type tokensHandler struct {
+	sh *session.Handler
+}
+
+func newTokens(sh *session.Handler) *tokensHandler {
+	return &tokensHandler{sh: sh}
+}
+
+func (tokensHandler) authPath(*http.Request) (string, error) { return authAny, nil }
+
+func (th tokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	if sess == nil {
+		logf(r, "Could not get authenticated session in tokens handler")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		th.serveTokensHTTP(w, r, http.StatusOK, "", "")
+
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "create-token":
+			th.serveCreateTokenHTTP(w, r, sess)
+
+		case "revoke-token":
+			if err := th.sh.RevokeAPIToken(r.FormValue("token")); err != nil && !errors.Is(err, apitoken.ErrNoToken) {
+				logf(r, "Could not revoke API token: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			redirect(w, r, r.URL.RequestURI())
+
+		default:
+			redirect(w, r, r.URL.RequestURI())
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (th tokensHandler) serveCreateTokenHTTP(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		th.serveTokensHTTP(w, r, http.StatusBadRequest, "", "A name is required.")
+		return
+	}
+	prefixes := strings.Fields(strings.Replace(r.FormValue("prefixes"), ",", " ", -1))
+	for _, p := range prefixes {
+		if !strings.HasPrefix(p, "/") {
+			th.serveTokensHTTP(w, r, http.StatusBadRequest, "", "Directory prefixes must begin with /.")
+			return
+		}
+	}
+	tok, _, err := sess.CreateAPIToken(name, r.FormValue("pass"), prefixes, r.FormValue("read-only") != "")
+	switch {
+	case errors.Is(err, secret.ErrWrongPassphrase):
+		th.serveTokensHTTP(w, r, http.StatusForbidden, "", "Wrong passphrase.")
+	case errors.Is(err, rate.ErrTooManyEvents):
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	case err != nil:
+		logf(r, "Could not create API token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	default:
+		// Show the new token directly, rather than redirecting, since it can't be shown again.
+		th.serveTokensHTTP(w, r, http.StatusOK, tok, "")
+	}
+}
+
+func (th tokensHandler) serveTokensHTTP(w http.ResponseWriter, r *http.Request, code int, newToken, errMsg string) {
+	serveTemplateStatus(w, r, code, tokensTmpl, struct {
+		Tokens   []apitoken.Token
+		NewToken string
+		Error    string
+	}{th.sh.APITokens(), newToken, errMsg})
+}
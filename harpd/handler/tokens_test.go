@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/session"
+)
+
+func TestAPITokens(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_tokens_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ts, err := apitoken.NewStore(filepath.Join(dir, "tokens"))
+	if err != nil {
+		t.Fatalf("Could not create token store: %v", err)
+	}
+	s := &memStore{entries: map[string]string{"/work/entry": "work content", "/personal": "personal content"}}
+	sh, err := session.NewHandler(memVault{s}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), session.WithAPITokens(ts), session.WithNewSessionBurst(10))
+	if err != nil {
+		t.Fatalf("Could not create session handler: %v", err)
+	}
+	_, sess, err := sh.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	th := newTokens(sh)
+	api := newAPI(sh, nil, DefaultSessionCookie, DefaultEntryMaxSize, DefaultBodyMaxSize)
+
+	do := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+		resp := httptest.NewRecorder()
+		th.ServeHTTP(resp, req)
+		return resp
+	}
+	withToken := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+
+	// Creating a token requires the passphrase.
+	if resp := do(url.Values{"action": {"create-token"}, "name": {"script"}, "pass": {"wrong"}}); resp.Code != http.StatusForbidden {
+		t.Errorf("Create with wrong passphrase: got status %d, want %d", resp.Code, http.StatusForbidden)
+	}
+	if toks := sh.APITokens(); len(toks) != 0 {
+		t.Errorf("After create with wrong passphrase, tokens = %+v, want none", toks)
+	}
+
+	// The new token is shown once.
+	resp := do(url.Values{"action": {"create-token"}, "name": {"script"}, "prefixes": {"/work/"}, "read-only": {"1"}, "pass": {"password"}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Create: got status %d, want %d", resp.Code, http.StatusOK)
+	}
+	m := regexp.MustCompile(`<pre class="token">([^<]*)</pre>`).FindStringSubmatch(resp.Body.String())
+	if m == nil {
+		t.Fatalf("Create response did not show the new token: %q", resp.Body.String())
+	}
+	token := m[1]
+	req := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+	req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sess))
+	listResp := httptest.NewRecorder()
+	th.ServeHTTP(listResp, req)
+	if body := listResp.Body.String(); strings.Contains(body, token) || !strings.Contains(body, "script (read-only)") {
+		t.Errorf("Token list did not list the token without its secret: %q", body)
+	}
+
+	// The token allows read-only access beneath its prefixes, without a session cookie or MFA.
+	if resp := doAPIRequestWithHeader(api, http.MethodGet, "/api/p/work/entry", nil, "", withToken(token)); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "work content") {
+		t.Errorf("GET within prefix: got status %d (%q), want %d", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if resp := doAPIRequestWithHeader(api, http.MethodGet, "/api/p/personal", nil, "", withToken(token)); resp.Code != http.StatusNotFound {
+		t.Errorf("GET outside prefix: got status %d, want %d", resp.Code, http.StatusNotFound)
+	}
+	if resp := doAPIRequestWithHeader(api, http.MethodPut, "/api/p/work/entry", nil, `{"content": "new"}`, withToken(token)); resp.Code != http.StatusForbidden {
+		t.Errorf("PUT with read-only token: got status %d, want %d", resp.Code, http.StatusForbidden)
+	}
+	if resp := doAPIRequestWithHeader(api, http.MethodGet, "/api/p", nil, "", withToken(token)); resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), "personal") {
+		t.Errorf("List: got status %d (%q), want %d listing only entries within prefix", resp.Code, resp.Body.String(), http.StatusOK)
+	}
+	if resp := doAPIRequestWithHeader(api, http.MethodGet, "/api/p/work/entry", nil, "", withToken(token+"x")); resp.Code != http.StatusUnauthorized {
+		t.Errorf("GET with bad token: got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+
+	// A revoked token can no longer be used.
+	resp = do(url.Values{"action": {"revoke-token"}, "token": {sh.APITokens()[0].ID}})
+	if resp.Code != http.StatusSeeOther {
+		t.Errorf("Revoke: got status %d, want %d", resp.Code, http.StatusSeeOther)
+	}
+	if resp := doAPIRequestWithHeader(api, http.MethodGet, "/api/p/work/entry", nil, "", withToken(token)); resp.Code != http.StatusUnauthorized {
+		t.Errorf("GET with revoked token: got status %d, want %d", resp.Code, http.StatusUnauthorized)
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/BranLwyd/harpocrates/harpd/certs"
+	"github.com/BranLwyd/harpocrates/harpd/config"
+	"github.com/BranLwyd/harpocrates/harpd/counter"
 	"github.com/BranLwyd/harpocrates/harpd/handler"
 	"github.com/BranLwyd/harpocrates/harpd/server"
-	"github.com/golang/protobuf/proto"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 
@@ -21,93 +29,183 @@ import (
 )
 
 var (
-	configFile = flag.String("config", "", "The harpd configuration file to use.")
+	configFile  = flag.String("config", "", "The harpd configuration file to use.")
+	healthcheck = flag.Bool("healthcheck", false, "If set, rather than serving, check that the server configured by --config is up by requesting its /healthz page, exiting with status 0 if so & 1 otherwise. Suitable for use as a container HEALTHCHECK.")
 )
 
 // serv implements server.Server.
 type serv struct{}
 
-func (serv) ParseConfig() (_ *cpb.Config, _ *kpb.Key, _ error) {
+func (serv) ParseConfig() (_ *cpb.Config, _ *kpb.Key, _ *counter.Store, _ error) {
 	// Read & parse the config.
 	cfgBytes, err := ioutil.ReadFile(*configFile)
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't read config file: %w", err)
+		return nil, nil, nil, fmt.Errorf("couldn't read config file: %w", err)
 	}
-	cfg := &cpb.Config{}
-	if err := proto.UnmarshalText(string(cfgBytes), cfg); err != nil {
-		return nil, nil, fmt.Errorf("couldn't parse config file: %w", err)
-	}
-
-	// Fill in sesnsible defaults for some fields if needed.
-	if cfg.SessionDurationS == 0 {
-		cfg.SessionDurationS = 300
-	}
-	if cfg.NewSessionRate == 0 {
-		cfg.NewSessionRate = 1
-	}
-
-	// Sanity check config values.
-	if cfg.HostName == "" {
-		return nil, nil, errors.New("host_name is required in config")
-	}
-	if cfg.Email == "" {
-		return nil, nil, errors.New("email is required in config")
-	}
-	if cfg.CertDir == "" {
-		return nil, nil, errors.New("cert_dir is required in config")
-	}
-	if cfg.PassLoc == "" {
-		return nil, nil, errors.New("pass_loc is required in config")
-	}
-	if cfg.KeyFile == "" {
-		return nil, nil, errors.New("key_file is required in config")
+	cfg, err := config.Parse(cfgBytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse config file %q: %w", *configFile, err)
 	}
-	if cfg.SessionDurationS <= 0 {
-		return nil, nil, errors.New("session_duration_s must be positive")
+	config.SetDefaults(cfg)
+	if errs := config.Validate(cfg); len(errs) > 0 {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "config file %q has %d problem(s):", *configFile, len(errs))
+		for i, err := range errs {
+			fmt.Fprintf(&sb, "\n  %d. %v", i+1, err)
+		}
+		return nil, nil, nil, errors.New(sb.String())
 	}
-	if cfg.NewSessionRate <= 0 {
-		return nil, nil, errors.New("new_session_rate must be positive")
+	if cfg.Alert == nil {
+		log.Printf("No alert configuration specified, logging alerts")
 	}
 
-	if cfg.AlertCmd == "" {
-		log.Printf("No alert_cmd specified, logging alerts")
+	// Create key, counter store based on config. Keys for multiple vaults or
+	// users are read when the vaults are created.
+	var k *kpb.Key
+	if len(cfg.Vaults) == 0 && len(cfg.Users) == 0 {
+		if k, err = server.ReadKey(cfg.KeyFile); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	// Create key, counter store based on config.
-	keyBytes, err := ioutil.ReadFile(cfg.KeyFile)
+	cs, err := counter.NewStore(cfg.CounterFile)
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't read key file: %w", err)
-	}
-	k := &kpb.Key{}
-	if err := proto.Unmarshal(keyBytes, k); err != nil {
-		return nil, nil, fmt.Errorf("couldn't parse key: %w", err)
+		return nil, nil, nil, fmt.Errorf("couldn't create counter store: %w", err)
 	}
 
-	return cfg, k, nil
+	return cfg, k, cs, nil
 }
 
-func (serv) Serve(cfg *cpb.Config, h http.Handler) error {
-	certMgr := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(cfg.HostName),
-		Cache:      autocert.DirCache(cfg.CertDir),
-		Email:      cfg.Email,
+func (serv) HTTPServer(cfg *cpb.Config, h http.Handler) (*http.Server, error) {
+	policy, err := config.ContentSecurityPolicy(cfg.ContentSecurityPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create Content-Security-Policy: %w", err)
+	}
+	srv := &http.Server{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
 	}
-	server := &http.Server{
-		TLSConfig: &tls.Config{
+
+	switch t := cfg.Tls.(type) {
+	case nil, *cpb.Config_Acme:
+		certMgr := autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.HostName),
+			Cache:      autocert.DirCache(cfg.CertDir),
+			Email:      cfg.Email,
+		}
+		srv.TLSConfig = &tls.Config{
 			MinVersion:             tls.VersionTLS13,
 			SessionTicketsDisabled: true,
 			GetCertificate:         certMgr.GetCertificate,
 			NextProtos:             []string{"h2", acme.ALPNProto},
-		},
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      handler.NewLogging("https", handler.NewSecureHeader(h)),
+		}
+		srv.Handler = server.NewRequestLogging(cfg, "https", handler.NewSecureHeader(policy, h))
+
+	case *cpb.Config_Static:
+		r, err := certs.NewReloader(t.Static.CertFile, t.Static.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, syscall.SIGHUP)
+			for range ch {
+				if err := r.Reload(); err != nil {
+					log.Printf("Could not reload certificate: %v", err)
+					continue
+				}
+				log.Printf("Reloaded certificate")
+			}
+		}()
+		srv.TLSConfig = &tls.Config{
+			MinVersion:             tls.VersionTLS13,
+			SessionTicketsDisabled: true,
+			GetCertificate:         r.GetCertificate,
+			NextProtos:             []string{"h2"},
+		}
+		srv.Handler = server.NewRequestLogging(cfg, "https", handler.NewSecureHeader(policy, h))
+
+	case *cpb.Config_PlainHttp:
+		trusted, err := parseCIDRs(t.PlainHttp.TrustedProxyCidrs)
+		if err != nil {
+			return nil, err
+		}
+		srv.Addr = t.PlainHttp.ListenAddr
+		srv.Handler = handler.NewTrustedProxies(trusted, server.NewRequestLogging(cfg, "http", handler.NewSecureHeader(policy, h)))
+
+	default:
+		return nil, fmt.Errorf("unknown TLS configuration type %T", t)
 	}
 
 	log.Printf("Serving")
-	return server.ListenAndServeTLS("", "")
+	return srv, nil
+}
+
+// ReloadAssets is false: overridden assets are re-read only when they change.
+func (serv) ReloadAssets() bool { return false }
+
+// parseCIDRs parses the given address ranges, in CIDR notation.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse trusted_proxy_cidrs entry %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkHealth requests the /healthz page of the server configured by
+// --config, via the loopback interface.
+func checkHealth() error {
+	cfgBytes, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %w", err)
+	}
+	cfg, err := config.Parse(cfgBytes)
+	if err != nil {
+		return fmt.Errorf("couldn't parse config file %q: %w", *configFile, err)
+	}
+	config.SetDefaults(cfg)
+
+	// Servers using TLS always listen on the HTTPS port; the request is made
+	// to the configured host name so that its certificate can be verified,
+	// but is sent to the local server regardless of what the name resolves to.
+	u := fmt.Sprintf("https://%s%s/healthz", cfg.HostName, strings.TrimSuffix(cfg.BasePath, "/"))
+	addr := "localhost:443"
+	if t, ok := cfg.Tls.(*cpb.Config_PlainHttp); ok {
+		host, port, err := net.SplitHostPort(t.PlainHttp.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("couldn't parse plain_http.listen_addr: %w", err)
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		addr = net.JoinHostPort(host, port)
+		u = fmt.Sprintf("http://%s%s/healthz", addr, strings.TrimSuffix(cfg.BasePath, "/"))
+	}
+	var d net.Dialer
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", u, resp.StatusCode)
+	}
+	return nil
 }
 
 func main() {
@@ -115,5 +213,12 @@ func main() {
 	if *configFile == "" {
 		log.Fatalf("--config is required")
 	}
+	if *healthcheck {
+		if err := checkHealth(); err != nil {
+			log.Printf("Health check failed: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	server.Run(serv{})
 }
@@ -9,15 +9,18 @@ import (
 	"crypto/x509/pkix"
 	"flag"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/BranLwyd/harpocrates/harpd/counter"
+	"github.com/BranLwyd/harpocrates/harpd/csp"
 	"github.com/BranLwyd/harpocrates/harpd/debug_assets"
 	"github.com/BranLwyd/harpocrates/harpd/handler"
 	"github.com/BranLwyd/harpocrates/harpd/server"
@@ -31,52 +34,70 @@ var (
 	mfa        = flag.String("mfa", "", "If specified, the MFA key to use.")
 	hostname   = flag.String("hostname", "", "The hostname to serve with. Defaults to os.Hostname().")
 	encryption = flag.String("encryption", "sbox", "The type of encryption to use. Valid options include `sbox` and `pgp`.")
+	addr       = flag.String("addr", ":8080", "The address to serve on.")
+	assetDir   = flag.String("asset_override_dir", "", "If specified, a directory of templates & static assets to serve in preference to the embedded ones, re-read on every request.")
 )
 
 // serv implements server.Server.
 type serv struct{}
 
-func (serv) ParseConfig() (_ *cpb.Config, _ *pb.Key, _ error) {
-	keyBytes := mustAsset(fmt.Sprintf("harpd/assets/debug/key.%s", *encryption))
+func (serv) ParseConfig() (_ *cpb.Config, _ *pb.Key, _ *counter.Store, _ error) {
+	keyBytes, err := fs.ReadFile(debug_assets.FS, fmt.Sprintf("key.%s", *encryption))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't read key: %w", err)
+	}
 	k := &pb.Key{}
 	if err := proto.Unmarshal(keyBytes, k); err != nil {
-		return nil, nil, fmt.Errorf("couldn't parse key: %w", err)
+		return nil, nil, nil, fmt.Errorf("couldn't parse key: %w", err)
 	}
 
 	passDir, err := ioutil.TempDir("", "harpd_debug_")
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't create temporary directory: %w", err)
+		return nil, nil, nil, fmt.Errorf("couldn't create temporary directory: %w", err)
 	}
 	log.Printf("Debug mode: serving passwords from %q", passDir)
-	if err := restoreAssets(passDir, fmt.Sprintf("harpd/assets/debug/passwords.%s", *encryption)); err != nil {
-		return nil, nil, fmt.Errorf("couldn't prepare password directory: %w", err)
+	if err := debug_assets.RestoreAssets(passDir, fmt.Sprintf("passwords.%s", *encryption)); err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't prepare password directory: %w", err)
+	}
+	cs, err := counter.NewStore(filepath.Join(passDir, "mfa_counters"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't create counter store: %w", err)
+	}
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("couldn't parse --addr: %w", err)
 	}
 	var mfaRegs []string
 	if *mfa != "" {
 		mfaRegs = []string{*mfa}
 	} else {
-		log.Printf("No MFA registration specified. Navigate to https://%s:8080/register to register a token, then specify it via --mfa.", *hostname)
+		log.Printf("No MFA registration specified. Navigate to https://%s/register to register a token, then specify it via --mfa.", net.JoinHostPort(*hostname, port))
 	}
 	cfg := &cpb.Config{
-		HostName:         fmt.Sprintf("%s:8080", *hostname),
-		PassLoc:          filepath.Join(passDir, fmt.Sprintf("harpd/assets/debug/passwords.%s", *encryption)),
-		MfaReg:           mfaRegs,
-		SessionDurationS: 300,
-		NewSessionRate:   1,
+		HostName:             net.JoinHostPort(*hostname, port),
+		PassLoc:              filepath.Join(passDir, fmt.Sprintf("passwords.%s", *encryption)),
+		MfaReg:               mfaRegs,
+		SessionDurationS:     300,
+		NewSessionRate:       1,
+		NewSessionBurst:      3,
+		ShutdownGracePeriodS: 10,
+		ApiTokenFile:         filepath.Join(passDir, "api_tokens"),
+		AssetOverrideDir:     *assetDir,
+		DebugLog:             true,
 	}
-	return cfg, k, nil
+	return cfg, k, cs, nil
 }
 
-func (serv) Serve(_ *cpb.Config, h http.Handler) error {
+func (serv) HTTPServer(cfg *cpb.Config, h http.Handler) (*http.Server, error) {
 	// Generate a self-signed certificate with the appropriate hostname.
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return fmt.Errorf("couldn't generate key: %w", err)
+		return nil, fmt.Errorf("couldn't generate key: %w", err)
 	}
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
 	now := time.Now()
 	template := &x509.Certificate{
@@ -93,11 +114,11 @@ func (serv) Serve(_ *cpb.Config, h http.Handler) error {
 	}
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
 	if err != nil {
-		return fmt.Errorf("failed to create certificate: %w", err)
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 	cert, err := x509.ParseCertificate(certDER)
 	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
 	// Begin serving.
@@ -111,37 +132,16 @@ func (serv) Serve(_ *cpb.Config, h http.Handler) error {
 			MinVersion:             tls.VersionTLS13,
 			SessionTicketsDisabled: true,
 		},
-		Addr:    ":8080",
-		Handler: handler.NewLogging("debug", handler.NewSecureHeader(h)),
-	}
-	log.Printf(`Serving debug on https://%s:8080 [the password is "password"]`, *hostname)
-	return server.ListenAndServeTLS("", "")
-}
-
-func mustAsset(name string) []byte {
-	a, ok := debug_assets.Asset[name]
-	if !ok {
-		panic(fmt.Sprintf("Debug asset %q does not exist", name))
+		Addr:    *addr,
+		Handler: server.NewRequestLogging(cfg, "debug", handler.NewSecureHeader(csp.Default(), h)),
 	}
-	return a
+	log.Printf(`Serving debug on https://%s [the password is "password"]`, cfg.HostName)
+	return server, nil
 }
 
-func restoreAssets(dst, src string) error {
-	for name, val := range debug_assets.Asset {
-		if !strings.HasPrefix(name, src) {
-			continue
-		}
-		fn := filepath.Join(dst, name)
-		pth := filepath.Dir(fn)
-		if err := os.MkdirAll(pth, 0755); err != nil {
-			return fmt.Errorf("couldn't create %q: %w", pth, err)
-		}
-		if err := ioutil.WriteFile(fn, val, 0644); err != nil {
-			return fmt.Errorf("couldn't write %q: %w", fn, err)
-		}
-	}
-	return nil
-}
+// ReloadAssets is true, so that changes to overridden templates take effect
+// immediately.
+func (serv) ReloadAssets() bool { return true }
 
 func main() {
 	flag.Parse()
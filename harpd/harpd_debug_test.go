@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/server"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	// Pick an unused port to serve on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	*addr, *hostname = l.Addr().String(), "localhost"
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server.Run(serv{})
+		close(done)
+	}()
+
+	// Open a session, waiting for the server to start.
+	client := &http.Client{
+		Transport:     &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	var resp *http.Response
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err = client.PostForm("https://"+*addr+"/", url.Values{"action": {"login"}, "pass": {"password"}})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Could not log in: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp.Body.Close()
+	if cookies := resp.Cookies(); len(cookies) != 1 {
+		t.Fatalf("Login did not set session cookie: %v", cookies)
+	}
+
+	// The server shuts down cleanly on SIGTERM.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Could not send SIGTERM: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Server did not shut down after SIGTERM")
+	}
+	if _, err := client.Get("https://" + *addr + "/"); err == nil {
+		t.Errorf("Server still serving after shutdown")
+	}
+}
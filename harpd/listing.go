@@ -0,0 +1,60 @@
+// Package listing defines the JSON form of the directory listings & search
+// results served by the web interface, for clients which render them
+// themselves. Handlers serving listings elsewhere, such as the API, should use
+// the same types so that clients can share code.
+package listing
+
+import "time"
+
+// Entry describes an entry in a listing.
+type Entry struct {
+	Path     string     `json:"path"`               // absolute path of the entry, e.g. "/bank/checking"
+	ModTime  *time.Time `json:"mod_time,omitempty"` // time the entry was last modified; omitted if unknown
+	Favorite bool       `json:"favorite,omitempty"` // whether the entry is pinned as a favorite
+}
+
+// Directory is a listing of the entries & subdirectories directly within a
+// directory, excluding hidden ones. If the listing is paginated, it holds a
+// single page; subdirectories are listed before entries.
+type Directory struct {
+	Path           string   `json:"path"`           // absolute path of the directory, with a trailing slash
+	Subdirectories []string `json:"subdirectories"` // absolute paths, with trailing slashes
+	Entries        []Entry  `json:"entries"`
+	Page           int      `json:"page"`       // the page listed, counting from one
+	PageCount      int      `json:"page_count"` // one if the listing is not paginated
+}
+
+// Search is the result of searching entry names, or entry content.
+type Search struct {
+	Query   string  `json:"query"`
+	Content bool    `json:"content"` // whether entry content was searched, rather than entry names
+	Matches []Match `json:"matches"` // best match first for name searches; in listing order for content searches
+
+	// Next is the index of the entry from which a content search continues,
+	// passed as the "start" parameter. It is omitted once every entry has
+	// been searched, and for name searches.
+	Next int `json:"next,omitempty"`
+}
+
+// Match is an entry matched by a search.
+type Match struct {
+	Entry
+
+	// Line is the first line of the entry's content which matched a
+	// content search, split around the match. The first line of an entry,
+	// holding its password, is never searched.
+	Line *Line `json:"line,omitempty"`
+}
+
+// Line is a line of entry content matched by a search.
+type Line struct {
+	Before string `json:"before"`
+	Match  string `json:"match"`
+	After  string `json:"after"`
+}
+
+// Preview is a preview of an entry's content, shown in a directory listing.
+type Preview struct {
+	Path string `json:"path"` // absolute path of the entry
+	Text string `json:"text"` // the entry's first line (masked), followed by its second line
+}
@@ -0,0 +1,241 @@
+// Package metrics provides a minimal registry of counters, gauges, and
+// summaries, which can be exposed in the Prometheus text exposition format.
+//
+// Metric methods are safe to call on nil metrics, in which case they do
+// nothing; this allows instrumented code to run without a registry.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds a set of metrics. It is safe for concurrent use from
+// multiple goroutines.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family // by name
+}
+
+// family is a named metric, possibly with multiple labelled samples.
+type family struct {
+	help, typ string
+	samples   func() []sample
+}
+
+// sample is a single value of a metric.
+type sample struct {
+	suffix string // appended to the metric name, e.g. "_sum"
+	labels string // serialized labels, e.g. `{op="get"}`, or empty
+	value  float64
+}
+
+// NewRegistry creates a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]family{}}
+}
+
+func (r *Registry) register(name, help, typ string, samples func() []sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %q registered twice", name))
+	}
+	r.families[name] = family{help, typ, samples}
+}
+
+// NewCounter creates and registers a new counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", func() []sample {
+		return []sample{{value: float64(c.Value())}}
+	})
+	return c
+}
+
+// NewCounterVec creates and registers a new set of counters, distinguished by
+// the value of the given label.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	cv := &CounterVec{label: label, counters: map[string]*Counter{}}
+	r.register(name, help, "counter", func() []sample {
+		cv.mu.Lock()
+		defer cv.mu.Unlock()
+		var ss []sample
+		for v, c := range cv.counters {
+			ss = append(ss, sample{labels: labels(label, v), value: float64(c.Value())})
+		}
+		return ss
+	})
+	return cv
+}
+
+// NewGaugeFunc creates and registers a new gauge, whose value is determined
+// by calling f whenever metrics are collected.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, "gauge", func() []sample {
+		return []sample{{value: f()}}
+	})
+}
+
+// NewSummaryVec creates and registers a new set of summaries of durations,
+// distinguished by the value of the given label. Summaries report the count
+// and total duration (in seconds) of observations.
+func (r *Registry) NewSummaryVec(name, help, label string) *SummaryVec {
+	sv := &SummaryVec{label: label, summaries: map[string]*summary{}}
+	r.register(name, help, "summary", func() []sample {
+		sv.mu.Lock()
+		defer sv.mu.Unlock()
+		var ss []sample
+		for v, s := range sv.summaries {
+			ss = append(ss,
+				sample{suffix: "_sum", labels: labels(label, v), value: s.sum},
+				sample{suffix: "_count", labels: labels(label, v), value: float64(s.count)})
+		}
+		return ss
+	})
+	return sv
+}
+
+// Counter is a monotonically-increasing count.
+type Counter struct{ v uint64 }
+
+// Inc increments the counter.
+func (c *Counter) Inc() {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec is a set of counters, distinguished by the value of a label.
+type CounterVec struct {
+	label string
+
+	mu       sync.Mutex
+	counters map[string]*Counter // by label value
+}
+
+// With returns the counter with the given label value, creating it if needed.
+func (cv *CounterVec) With(labelValue string) *Counter {
+	if cv == nil {
+		return nil
+	}
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c := cv.counters[labelValue]
+	if c == nil {
+		c = &Counter{}
+		cv.counters[labelValue] = c
+	}
+	return c
+}
+
+// SummaryVec is a set of summaries of durations, distinguished by the value of
+// a label.
+type SummaryVec struct {
+	label string
+
+	mu        sync.Mutex // protects summaries, and all values of summaries
+	summaries map[string]*summary
+}
+
+type summary struct {
+	count uint64
+	sum   float64 // seconds
+}
+
+// Observe records an observation of the given duration, for the given label
+// value.
+func (sv *SummaryVec) Observe(labelValue string, d time.Duration) {
+	if sv == nil {
+		return
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	s := sv.summaries[labelValue]
+	if s == nil {
+		s = &summary{}
+		sv.summaries[labelValue] = s
+	}
+	s.count++
+	s.sum += d.Seconds()
+}
+
+// WriteText writes all metrics in the registry in the Prometheus text
+// exposition format, ordered by name.
+func (r *Registry) WriteText() []byte {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	fs := make(map[string]family, len(r.families))
+	for name, f := range r.families {
+		fs[name] = f
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := fs[name]
+		ss := f.samples()
+		sort.Slice(ss, func(i, j int) bool {
+			if ss[i].labels != ss[j].labels {
+				return ss[i].labels < ss[j].labels
+			}
+			return ss[i].suffix < ss[j].suffix
+		})
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeHelp(f.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range ss {
+			fmt.Fprintf(&buf, "%s%s%s %s\n", name, s.suffix, s.labels, formatValue(s.value))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Handler returns an HTTP handler serving the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(r.WriteText())
+	})
+}
+
+func labels(name, value string) string {
+	return fmt.Sprintf(`{%s="%s"}`, name, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteText(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	c := r.NewCounter("test_counter_total", "A counter.")
+	cv := r.NewCounterVec("test_vec_total", "A counter vec.", "kind")
+	sv := r.NewSummaryVec("test_duration_seconds", "A summary.", "op")
+	r.NewGaugeFunc("test_gauge", "A gauge\nwith newline.", func() float64 { return 2.5 })
+
+	c.Inc()
+	c.Inc()
+	cv.With("b").Inc()
+	cv.With(`a"\`).Inc()
+	sv.Observe("get", 500*time.Millisecond)
+	sv.Observe("get", time.Second)
+
+	want := `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total 2
+# HELP test_duration_seconds A summary.
+# TYPE test_duration_seconds summary
+test_duration_seconds_count{op="get"} 2
+test_duration_seconds_sum{op="get"} 1.5
+# HELP test_gauge A gauge\nwith newline.
+# TYPE test_gauge gauge
+test_gauge 2.5
+# HELP test_vec_total A counter vec.
+# TYPE test_vec_total counter
+test_vec_total{kind="a\"\\"} 1
+test_vec_total{kind="b"} 1
+`
+	if got := string(r.WriteText()); got != want {
+		t.Errorf("WriteText() = %q, want %q", got, want)
+	}
+
+	// The handler serves the same content.
+	resp := httptest.NewRecorder()
+	r.Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	if got := resp.Body.String(); got != want {
+		t.Errorf("Handler served %q, want %q", got, want)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	t.Parallel()
+
+	// Methods on nil metrics must not panic.
+	var c *Counter
+	var cv *CounterVec
+	var sv *SummaryVec
+	c.Inc()
+	cv.With("x").Inc()
+	sv.Observe("x", time.Second)
+	if got := c.Value(); got != 0 {
+		t.Errorf("Value() of nil counter = %d, want 0", got)
+	}
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	r.NewCounter("dup", "")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Duplicate registration did not panic")
+		}
+	}()
+	r.NewCounter("dup", "")
+}
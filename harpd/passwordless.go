@@ -0,0 +1,235 @@
+// Package passwordless provides persistent storage for passphrases wrapped by
+// MFA devices, which allow a user to unlock the store with a security key in
+// place of typing their passphrase.
+package passwordless
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	ppb "github.com/BranLwyd/harpocrates/harpd/proto/passwordless_go_proto"
+)
+
+const (
+	saltLength  = 32
+	nonceLength = 24
+	keyLength   = 32
+
+	// keyInfo binds keys derived from PRF outputs to this use.
+	keyInfo = "harpocrates passwordless unlock"
+)
+
+// ErrNoPassphrase is returned when no passphrase is wrapped by a credential,
+// or when the passphrase can't be unwrapped with the given PRF output.
+var ErrNoPassphrase = errors.New("no passphrase wrapped by credential")
+
+// Passphrase describes a wrapped passphrase. It never includes the passphrase.
+type Passphrase struct {
+	CredentialID string    // base64url-encoded ID of the MFA credential which wraps the passphrase
+	User         string    // name of the user whose passphrase it is; empty unless the server serves multiple users
+	CreatedAt    time.Time // time the passphrase was wrapped
+}
+
+// Store stores wrapped passphrases, keyed by credential ID, persisting them to
+// a file on disk. It is safe for concurrent use from multiple goroutines.
+//
+// A passphrase is encrypted with a key derived from the output of the
+// credential's PRF (hmac-secret) extension, which only the MFA device can
+// compute. Neither the key nor the PRF output is stored.
+type Store struct {
+	filename string
+
+	mu          sync.Mutex // protects passphrases
+	passphrases map[string]*ppb.WrappedPassphrase
+}
+
+// NewStore creates a new wrapped-passphrase store persisted in the given file.
+// If the file does not yet exist, the store starts out empty; the file will be
+// created on the first call to Wrap.
+func NewStore(filename string) (*Store, error) {
+	s := &Store{
+		filename:    filename,
+		passphrases: map[string]*ppb.WrappedPassphrase{},
+	}
+	wpBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	wps := &ppb.WrappedPassphrases{}
+	if err := proto.Unmarshal(wpBytes, wps); err != nil {
+		return nil, fmt.Errorf("couldn't parse %q: %w", filename, err)
+	}
+	for id, wp := range wps.WrappedPassphrase {
+		s.passphrases[id] = wp
+	}
+	return s, nil
+}
+
+// List returns a description of each wrapped passphrase, oldest first.
+func (s *Store) List() []Passphrase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ps []Passphrase
+	for id, wp := range s.passphrases {
+		ps = append(ps, passphrase(id, wp))
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].CreatedAt.Before(ps[j].CreatedAt) })
+	return ps
+}
+
+// Lookup returns a description of the passphrase wrapped by the given
+// credential, or ErrNoPassphrase if there is none.
+func (s *Store) Lookup(credID string) (Passphrase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wp, ok := s.passphrases[credID]
+	if !ok {
+		return Passphrase{}, ErrNoPassphrase
+	}
+	return passphrase(credID, wp), nil
+}
+
+// Wrap encrypts the given user's passphrase with a key derived from the given
+// PRF output of the given credential, replacing any passphrase the credential
+// already wraps. The passphrase is persisted to disk before Wrap returns.
+func (s *Store) Wrap(credID, user string, prfOutput []byte, pass string, now time.Time) error {
+	if len(prfOutput) == 0 {
+		return errors.New("empty PRF output")
+	}
+	var salt [saltLength]byte
+	var nonce [nonceLength]byte
+	for _, b := range [][]byte{salt[:], nonce[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("couldn't generate randomness: %w", err)
+		}
+	}
+	key, err := deriveKey(prfOutput, salt[:])
+	if err != nil {
+		return err
+	}
+	wp := &ppb.WrappedPassphrase{
+		User:             user,
+		CreatedUnixNanos: now.UnixNano(),
+		Salt:             salt[:],
+		Nonce:            nonce[:],
+		Ciphertext:       secretbox.Seal(nil, []byte(pass), &nonce, key),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, hadOld := s.passphrases[credID]
+	s.passphrases[credID] = wp
+	if err := s.write(); err != nil {
+		if hadOld {
+			s.passphrases[credID] = old
+		} else {
+			delete(s.passphrases, credID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unwrap decrypts the passphrase wrapped by the given credential using the
+// given PRF output, returning the name of the user whose passphrase it is
+// along with the passphrase. It returns ErrNoPassphrase if the credential
+// wraps no passphrase, or if the PRF output is wrong.
+func (s *Store) Unwrap(credID string, prfOutput []byte) (user, pass string, _ error) {
+	s.mu.Lock()
+	wp := s.passphrases[credID]
+	s.mu.Unlock()
+	if wp == nil || len(wp.Nonce) != nonceLength {
+		return "", "", ErrNoPassphrase
+	}
+	key, err := deriveKey(prfOutput, wp.Salt)
+	if err != nil {
+		return "", "", err
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], wp.Nonce)
+	passBytes, ok := secretbox.Open(nil, wp.Ciphertext, &nonce, key)
+	if !ok {
+		return "", "", ErrNoPassphrase
+	}
+	return wp.User, string(passBytes), nil
+}
+
+// Remove deletes the passphrase wrapped by the given credential, returning a
+// description of the deleted passphrase. It returns ErrNoPassphrase if there
+// is none. The deletion is persisted to disk before Remove returns; if
+// persisting fails, the passphrase is not deleted.
+func (s *Store) Remove(credID string) (Passphrase, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wp, ok := s.passphrases[credID]
+	if !ok {
+		return Passphrase{}, ErrNoPassphrase
+	}
+	delete(s.passphrases, credID)
+	if err := s.write(); err != nil {
+		s.passphrases[credID] = wp
+		return Passphrase{}, err
+	}
+	return passphrase(credID, wp), nil
+}
+
+// write writes the current passphrases to disk. s.mu must be held.
+func (s *Store) write() error {
+	wpBytes, err := proto.Marshal(&ppb.WrappedPassphrases{WrappedPassphrase: s.passphrases})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal passphrases: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.filename), ".harp_passwordless_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0600); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(wpBytes); err != nil {
+		return fmt.Errorf("couldn't write passphrases: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, s.filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, s.filename, err)
+	}
+	return nil
+}
+
+// deriveKey derives the key wrapping a passphrase from a PRF output & salt.
+func deriveKey(prfOutput, salt []byte) (*[keyLength]byte, error) {
+	var key [keyLength]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, prfOutput, salt, []byte(keyInfo)), key[:]); err != nil {
+		return nil, fmt.Errorf("couldn't derive key: %w", err)
+	}
+	return &key, nil
+}
+
+func passphrase(credID string, wp *ppb.WrappedPassphrase) Passphrase {
+	return Passphrase{
+		CredentialID: credID,
+		User:         wp.User,
+		CreatedAt:    time.Unix(0, wp.CreatedUnixNanos),
+	}
+}
@@ -0,0 +1,87 @@
+package passwordless
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPasswordless(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_passwordless_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "passwordless")
+	s, err := NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not create store: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	prf := []byte("0123456789abcdef0123456789abcdef")
+	if err := s.Wrap("cred", "alice", prf, "passphrase", now); err != nil {
+		t.Fatalf("Could not wrap passphrase: %v", err)
+	}
+	if err := s.Wrap("cred2", "alice", nil, "passphrase", now); err == nil {
+		t.Errorf("Wrap with empty PRF output succeeded, want error")
+	}
+
+	// Only the right PRF output unwraps the passphrase.
+	if user, pass, err := s.Unwrap("cred", prf); err != nil || user != "alice" || pass != "passphrase" {
+		t.Errorf("Unwrap = (%q, %q, %v), want (%q, %q, nil)", user, pass, err, "alice", "passphrase")
+	}
+	for _, test := range []struct {
+		credID string
+		prf    []byte
+	}{
+		{"cred", []byte("fedcba9876543210fedcba9876543210")},
+		{"cred", nil},
+		{"nonexistent", prf},
+	} {
+		if _, _, err := s.Unwrap(test.credID, test.prf); !errors.Is(err, ErrNoPassphrase) {
+			t.Errorf("Unwrap(%q, %q) returned error %v, want %v", test.credID, test.prf, err, ErrNoPassphrase)
+		}
+	}
+
+	// The passphrase itself is not stored in the clear.
+	wpBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Could not read store file: %v", err)
+	}
+	if bytes.Contains(wpBytes, []byte("passphrase")) {
+		t.Errorf("Store file contains passphrase in the clear")
+	}
+
+	// A new store reading the same file sees the same passphrases.
+	s, err = NewStore(filename)
+	if err != nil {
+		t.Fatalf("Could not recreate store: %v", err)
+	}
+	if ps := s.List(); len(ps) != 1 || ps[0].CredentialID != "cred" || ps[0].User != "alice" || !ps[0].CreatedAt.Equal(now) {
+		t.Errorf("After reload, List = %+v, want a single passphrase for %q", ps, "cred")
+	}
+	if _, pass, err := s.Unwrap("cred", prf); err != nil || pass != "passphrase" {
+		t.Errorf("After reload, Unwrap = (%q, %v), want (%q, nil)", pass, err, "passphrase")
+	}
+
+	// Removed passphrases can no longer be unwrapped.
+	if _, err := s.Remove("cred"); err != nil {
+		t.Fatalf("Could not remove passphrase: %v", err)
+	}
+	if _, err := s.Lookup("cred"); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("After removal, Lookup returned error %v, want %v", err, ErrNoPassphrase)
+	}
+	if _, _, err := s.Unwrap("cred", prf); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("After removal, Unwrap returned error %v, want %v", err, ErrNoPassphrase)
+	}
+	if _, err := s.Remove("cred"); !errors.Is(err, ErrNoPassphrase) {
+		t.Errorf("Second Remove returned error %v, want %v", err, ErrNoPassphrase)
+	}
+}
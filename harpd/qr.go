@@ -0,0 +1,528 @@
+// Package qr provides encoding of data as QR codes, as specified by ISO/IEC
+// 18004. Data is always encoded in byte mode at error correction level M,
+// using the smallest version able to hold it.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrTooLong is returned when data is too long to be encoded as a QR code.
+var ErrTooLong = errors.New("data too long to encode as QR code")
+
+const (
+	minVersion = 1
+	maxVersion = 40
+	quietZone  = 4 // width of the light border around a code, in modules
+)
+
+// Per-version error correction parameters for error correction level M,
+// indexed by version.
+var (
+	eccCodewordsPerBlock = [maxVersion + 1]int{-1,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	eccBlocks = [maxVersion + 1]int{-1,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	Size int // width & height of the code, in modules
+
+	modules  []bool // row-major; true for dark modules
+	function []bool // row-major; true for modules which are not part of the data area
+}
+
+// Encode encodes the given data as a QR code.
+func Encode(data string) (*Code, error) {
+	ver := minVersion
+	for ; ver <= maxVersion; ver++ {
+		if 4+charCountBits(ver)+8*len(data) <= 8*dataCodewords(ver) {
+			break
+		}
+	}
+	if ver > maxVersion {
+		return nil, ErrTooLong
+	}
+
+	// Build the data codewords: mode indicator, character count, data,
+	// terminator, then padding.
+	var bb bitBuffer
+	bb.append(0x4, 4) // byte mode
+	bb.append(uint32(len(data)), charCountBits(ver))
+	for i := 0; i < len(data); i++ {
+		bb.append(uint32(data[i]), 8)
+	}
+	capacity := 8 * dataCodewords(ver)
+	if n := capacity - bb.len; n < 4 {
+		bb.append(0, n)
+	} else {
+		bb.append(0, 4)
+	}
+	if n := bb.len % 8; n != 0 {
+		bb.append(0, 8-n)
+	}
+	for pad := uint32(0xec); bb.len < capacity; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	c := newCode(ver)
+	c.placeData(addECC(ver, bb.bytes()))
+
+	// Choose the mask with the lowest penalty.
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.placeFormat(mask)
+		if p := c.penalty(); bestPenalty == -1 || p < bestPenalty {
+			bestMask, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masking is its own inverse
+	}
+	c.applyMask(bestMask)
+	c.placeFormat(bestMask)
+	return c, nil
+}
+
+// Dark returns true if the module at column x, row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y*c.Size+x]
+}
+
+// SVG renders the code as an SVG image, including a quiet zone around the
+// code. Each module is one user unit; the image scales to fit its container.
+func (c *Code) SVG() []byte {
+	var buf bytes.Buffer
+	sz := c.Size + 2*quietZone
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, sz, sz)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, sz, sz)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// newCode creates a code of the given version with all function patterns
+// drawn, other than format information, which depends on the mask.
+func newCode(ver int) *Code {
+	size := 4*ver + 17
+	c := &Code{
+		Size:     size,
+		modules:  make([]bool, size*size),
+		function: make([]bool, size*size),
+	}
+
+	// Timing patterns.
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with their separators.
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	// Alignment patterns, other than those overlapping the finder patterns.
+	pos := alignmentPositions(ver)
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information areas, and draw the dark module.
+	c.placeFormat(0)
+
+	// Version information.
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := size-11+i%3, i/3
+			c.setFunction(a, b, dark)
+			c.setFunction(b, a, dark)
+		}
+	}
+	return c
+}
+
+// drawFinder draws a finder pattern centered at column x, row y, along with
+// the separator surrounding it.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// placeFormat draws the format information for error correction level M and
+// the given mask, as well as the dark module.
+func (c *Code) placeFormat(mask int) {
+	data := mask // level M is indicated by zero bits
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// Around the top-left finder pattern.
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	// Split between the top-right & bottom-left finder patterns.
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// placeData draws the given codewords into the data area, in the zigzag order
+// specified by the standard. Any remaining modules are left light.
+func (c *Code) placeData(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern.
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y*c.Size+x] || i >= 8*len(data) {
+					continue
+				}
+				c.modules[y*c.Size+x] = (data[i/8]>>uint(7-i%8))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the given mask pattern.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y*c.Size+x] {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores the code according to the mask evaluation rules of the
+// standard; lower scores are better.
+func (c *Code) penalty() int {
+	var p int
+	line := make([]bool, c.Size)
+	for _, horiz := range []bool{true, false} {
+		for i := 0; i < c.Size; i++ {
+			for j := 0; j < c.Size; j++ {
+				if horiz {
+					line[j] = c.Dark(j, i)
+				} else {
+					line[j] = c.Dark(i, j)
+				}
+			}
+			p += linePenalty(line)
+		}
+	}
+
+	// 2x2 blocks of a single color.
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+
+	// Imbalance of dark & light modules, in steps of 5% from 50%.
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	if k > 0 {
+		p += 10 * k
+	}
+	return p
+}
+
+// finderLike is the 1:1:3:1:1 dark-light pattern penalized when adjacent to
+// four light modules.
+var finderLike = []bool{true, false, true, true, true, false, true}
+
+// linePenalty scores a single row or column for runs of a single color and
+// for patterns resembling finder patterns.
+func linePenalty(line []bool) int {
+	var p int
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			p += run - 2
+		}
+		run = 1
+	}
+
+	light := func(i int) bool { return i < 0 || i >= len(line) || !line[i] }
+	for i := 0; i+len(finderLike) <= len(line); i++ {
+		match := true
+		for j, d := range finderLike {
+			if line[i+j] != d {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for j := 1; j <= 4; j++ {
+			before = before && light(i-j)
+			after = after && light(i+len(finderLike)-1+j)
+		}
+		if before {
+			p += 40
+		}
+		if after {
+			p += 40
+		}
+	}
+	return p
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+// addECC splits the given data codewords into blocks, computes error
+// correction codewords for each block, and returns the interleaved result.
+func addECC(ver int, data []byte) []byte {
+	numBlocks, eccLen := eccBlocks[ver], eccCodewordsPerBlock[ver]
+	raw := rawDataModules(ver) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	// Short blocks come first; long blocks hold one extra data codeword.
+	gen := rsGenerator(eccLen)
+	var blocks, eccs [][]byte
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		blocks = append(blocks, data[k:k+n])
+		eccs = append(eccs, rsRemainder(data[k:k+n], gen))
+		k += n
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen-eccLen; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for _, e := range eccs {
+			result = append(result, e[i])
+		}
+	}
+	return result
+}
+
+// rsGenerator returns the coefficients of the Reed-Solomon generator
+// polynomial of the given degree, from highest to lowest power, excluding the
+// leading coefficient (which is always 1).
+func rsGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of the given
+// data, for the given generator polynomial.
+func rsRemainder(data, gen []byte) []byte {
+	result := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, g := range gen {
+			result[i] ^= gfMul(g, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies two elements of GF(2^8), modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// alignmentPositions returns the row & column coordinates of the centers of
+// the alignment patterns for the given version.
+func alignmentPositions(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	num := ver/7 + 2
+	step := (ver*4 + num*2 + 1) / (num*2 - 2) * 2
+	if ver == 32 {
+		step = 26
+	}
+	result := make([]int, num)
+	result[0] = 6
+	for i, pos := num-1, 4*ver+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// rawDataModules returns the number of modules available for data & error
+// correction codewords, including remainder bits, in the given version.
+func rawDataModules(ver int) int {
+	result := (16*ver+128)*ver + 64
+	if ver >= 2 {
+		num := ver/7 + 2
+		result -= (25*num-10)*num - 55
+		if ver >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// dataCodewords returns the number of data codewords held by the given version.
+func dataCodewords(ver int) int {
+	return rawDataModules(ver)/8 - eccCodewordsPerBlock[ver]*eccBlocks[ver]
+}
+
+// charCountBits returns the width of the byte mode character count indicator
+// in the given version.
+func charCountBits(ver int) int {
+	if ver <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// bitBuffer is an append-only sequence of bits.
+type bitBuffer struct {
+	buf []byte
+	len int // in bits
+}
+
+// append appends the low n bits of v, most significant bit first.
+func (bb *bitBuffer) append(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bb.len%8 == 0 {
+			bb.buf = append(bb.buf, 0)
+		}
+		if (v>>uint(i))&1 != 0 {
+			bb.buf[bb.len/8] |= 0x80 >> uint(bb.len%8)
+		}
+		bb.len++
+	}
+}
+
+func (bb *bitBuffer) bytes() []byte { return bb.buf }
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
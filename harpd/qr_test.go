@@ -0,0 +1,113 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeVersion(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		dataLen  int
+		wantSize int
+	}{
+		{0, 21},
+		{14, 21}, // largest version 1 code
+		{15, 25},
+		{2331, 177}, // largest version 40 code
+	} {
+		c, err := Encode(strings.Repeat("a", test.dataLen))
+		if err != nil {
+			t.Errorf("Could not encode %d bytes: %v", test.dataLen, err)
+			continue
+		}
+		if c.Size != test.wantSize {
+			t.Errorf("Encoding %d bytes gave size %d, want %d", test.dataLen, c.Size, test.wantSize)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("a", 2332)); err != ErrTooLong {
+		t.Errorf("Encoding 2332 bytes gave error %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestRSRemainder(t *testing.T) {
+	t.Parallel()
+
+	// Data & error correction codewords for "HELLO WORLD", version 1-M.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsGenerator(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+func TestDataCodewords(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct{ ver, want int }{{1, 16}, {7, 124}, {10, 216}, {27, 1128}, {40, 2334}} {
+		if got := dataCodewords(test.ver); got != test.want {
+			t.Errorf("dataCodewords(%d) = %d, want %d", test.ver, got, test.want)
+		}
+	}
+}
+
+func TestFunctionPatterns(t *testing.T) {
+	t.Parallel()
+
+	c, err := Encode(strings.Repeat("a", 110)) // version 7, which has version information
+	if err != nil {
+		t.Fatalf("Could not encode: %v", err)
+	}
+	if c.Size != 45 {
+		t.Fatalf("Encoding gave size %d, want 45", c.Size)
+	}
+
+	// Finder pattern centers, and the dark module.
+	for _, p := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}, {8, c.Size - 8}} {
+		if !c.Dark(p[0], p[1]) {
+			t.Errorf("Module (%d, %d) is light, want dark", p[0], p[1])
+		}
+	}
+
+	// Version information, read from the area beside the top-right finder pattern.
+	var ver int
+	for i := 17; i >= 0; i-- {
+		ver <<= 1
+		if c.Dark(c.Size-11+i%3, i/3) {
+			ver |= 1
+		}
+	}
+	if want := 0x07c94; ver != want {
+		t.Errorf("Version information is %018b, want %018b", ver, want)
+	}
+
+	// Format information, read from beside the top-left finder pattern.
+	var format int
+	for _, p := range [][2]int{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+		format <<= 1
+		if c.Dark(p[0], p[1]) {
+			format |= 1
+		}
+	}
+	if format>>13 != 0x2 { // error correction level M, after XOR with the format mask
+		t.Errorf("Format information is %015b, want error correction level M", format)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	t.Parallel()
+
+	c, err := Encode("WIFI:S:example;T:WPA;P:password;;")
+	if err != nil {
+		t.Fatalf("Could not encode: %v", err)
+	}
+	svg := string(c.SVG())
+	for _, want := range []string{`viewBox="0 0 37 37"`, "M4 4h1v1h-1z"} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("SVG %q does not contain %q", svg, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package random provides generation of random passwords.
+package random
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Character sets which may be used to generate passwords.
+const (
+	Lowercase = "abcdefghijklmnopqrstuvwxyz"
+	Uppercase = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	Digits    = "0123456789"
+	Symbols   = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+	// Ambiguous holds characters which are easily confused with one another
+	// in many fonts.
+	Ambiguous = "Il1|O0o`'\""
+)
+
+// String returns a cryptographically-strong random string of length n, with
+// characters chosen uniformly from charset.
+func String(n int, charset string) (string, error) {
+	if charset == "" {
+		return "", errors.New("empty character set")
+	}
+	max := big.NewInt(int64(len(charset)))
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("couldn't generate random number: %w", err)
+		}
+		sb.WriteByte(charset[idx.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// Charsets returns the character sets named by sets, which is a string of
+// letters: 'l' for lowercase, 'u' for uppercase, 'd' for digits, and 's' for
+// symbols. If excludeAmbiguous is set, ambiguous characters are removed from
+// each set.
+func Charsets(sets string, excludeAmbiguous bool) ([]string, error) {
+	var charsets []string
+	seen := map[rune]bool{}
+	for _, s := range sets {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		var cs string
+		switch s {
+		case 'l':
+			cs = Lowercase
+		case 'u':
+			cs = Uppercase
+		case 'd':
+			cs = Digits
+		case 's':
+			cs = Symbols
+		default:
+			return nil, fmt.Errorf("unknown character set %q", s)
+		}
+		if excludeAmbiguous {
+			cs = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(Ambiguous, r) {
+					return -1
+				}
+				return r
+			}, cs)
+		}
+		charsets = append(charsets, cs)
+	}
+	if len(charsets) == 0 {
+		return nil, errors.New("no character sets")
+	}
+	return charsets, nil
+}
+
+// Password returns a random password of length n, with characters chosen from
+// the union of the given character sets. The password is guaranteed to
+// contain at least one character from each set.
+func Password(n int, charsets []string) (string, error) {
+	if n < len(charsets) {
+		return "", fmt.Errorf("length %d is too short to include all %d character sets", n, len(charsets))
+	}
+	charset := strings.Join(charsets, "")
+	for {
+		pw, err := String(n, charset)
+		if err != nil {
+			return "", err
+		}
+		if containsAll(pw, charsets) {
+			return pw, nil
+		}
+	}
+}
+
+func containsAll(s string, charsets []string) bool {
+	for _, cs := range charsets {
+		if !strings.ContainsAny(s, cs) {
+			return false
+		}
+	}
+	return true
+}
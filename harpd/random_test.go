@@ -0,0 +1,85 @@
+package random
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCharsets(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		sets             string
+		excludeAmbiguous bool
+		want             []string
+	}{
+		{"l", false, []string{Lowercase}},
+		{"luds", false, []string{Lowercase, Uppercase, Digits, Symbols}},
+		{"dd", false, []string{Digits}},
+		{"ld", true, []string{"abcdefghijkmnpqrstuvwxyz", "23456789"}},
+		{"u", true, []string{"ABCDEFGHJKLMNPQRSTUVWXYZ"}},
+	} {
+		got, err := Charsets(test.sets, test.excludeAmbiguous)
+		if err != nil {
+			t.Errorf("Charsets(%q, %v) returned error: %v", test.sets, test.excludeAmbiguous, err)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Charsets(%q, %v) = %q, want %q", test.sets, test.excludeAmbiguous, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "x", "lx"} {
+		if _, err := Charsets(bad, false); err == nil {
+			t.Errorf("Charsets(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestAmbiguityFilter(t *testing.T) {
+	t.Parallel()
+
+	charsets, err := Charsets("luds", true)
+	if err != nil {
+		t.Fatalf("Could not get charsets: %v", err)
+	}
+	for _, cs := range charsets {
+		if strings.ContainsAny(cs, Ambiguous) {
+			t.Errorf("Charset %q contains ambiguous characters", cs)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		pw, err := Password(40, charsets)
+		if err != nil {
+			t.Fatalf("Could not generate password: %v", err)
+		}
+		if strings.ContainsAny(pw, Ambiguous) {
+			t.Errorf("Password %q contains ambiguous characters", pw)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	t.Parallel()
+
+	charsets := []string{Lowercase, Uppercase, Digits, Symbols}
+	for i := 0; i < 100; i++ {
+		// Short passwords are likely to miss some set unless regenerated.
+		pw, err := Password(4, charsets)
+		if err != nil {
+			t.Fatalf("Could not generate password: %v", err)
+		}
+		if len(pw) != 4 {
+			t.Errorf("Password %q has length %d, want 4", pw, len(pw))
+		}
+		for _, cs := range charsets {
+			if !strings.ContainsAny(pw, cs) {
+				t.Errorf("Password %q contains no characters from %q", pw, cs)
+			}
+		}
+	}
+
+	if _, err := Password(3, charsets); err == nil {
+		t.Errorf("Password with length shorter than number of charsets succeeded, want error")
+	}
+}
@@ -9,6 +9,9 @@ import (
 
 var ErrTooManyEvents = errors.New("too many concurrent events")
 
+// ErrClosed is returned by Wait once the limiter has been closed.
+var ErrClosed = errors.New("limiter closed")
+
 // Limiter provides a per-client rate limiter, where clients are identified
 // by a unique ID.
 type Limiter interface {
@@ -16,6 +19,15 @@ type Limiter interface {
 	// the given ID, or returns an error if the operation should not be
 	// allowed (e.g. because there are too many concurrent waiters).
 	Wait(clientID string) error
+
+	// Penalize records a failed operation (e.g. a failed authentication)
+	// for the given ID. Limiters may use this to slow down further events
+	// for the ID.
+	Penalize(clientID string)
+
+	// Close cancels the limiter's outstanding timers. Operations waiting
+	// in Wait, and any later calls to Wait, return ErrClosed.
+	Close()
 }
 
 // NewLimiter creates a new rate limiter which allows rate events per second,
@@ -24,6 +36,7 @@ func NewLimiter(rate float64, maxWaiters int) Limiter {
 	return &limiter{
 		dur:        time.Duration(float64(time.Second) / rate),
 		maxWaiters: maxWaiters,
+		clock:      realClock{},
 		entries:    map[string]*entry{},
 	}
 }
@@ -31,52 +44,293 @@ func NewLimiter(rate float64, maxWaiters int) Limiter {
 type limiter struct {
 	dur        time.Duration // how long to wait between allowing events
 	maxWaiters int
+	clock      clock
 
-	mu      sync.Mutex // protects entries as well as all values of entries
+	mu      sync.Mutex // protects closed, entries, and all values of entries
+	closed  bool
 	entries map[string]*entry
 }
 
+// entry tracks the events of a single client. An entry exists exactly as long
+// as its timer is outstanding, so that a new entry is only created for a
+// client once the interval since its last allowed event has passed.
 type entry struct {
-	waiters int
-	waitCh  chan struct{}
+	timer   timer        // fires once the interval since the client's last allowed event has passed
+	waiters []chan error // waiting events, in order of arrival; each is sent nil once allowed
 }
 
+// Penalize is a no-op; limiters created by NewLimiter do not penalize
+// failures.
+func (l *limiter) Penalize(clientID string) {}
+
 func (l *limiter) Wait(clientID string) error {
-	// Get entry for client, creating if necessary.
 	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+
+	// If no event has been allowed for the client within the interval,
+	// allow this one immediately.
 	e := l.entries[clientID]
 	if e == nil {
 		e = &entry{}
+		e.timer = l.clock.AfterFunc(l.dur, func() { l.release(clientID, e) })
 		l.entries[clientID] = e
+		l.mu.Unlock()
+		return nil
+	}
+
+	// Otherwise, wait behind any other waiting events.
+	if len(e.waiters) >= l.maxWaiters {
+		l.mu.Unlock()
+		return ErrTooManyEvents
+	}
+	ch := make(chan error, 1)
+	e.waiters = append(e.waiters, ch)
+	l.mu.Unlock()
+	return <-ch
+}
+
+// release allows the first event waiting for the given client, if any, and
+// starts the interval before the next is allowed. If there is none, the
+// client's entry is removed.
+func (l *limiter) release(clientID string, e *entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
 	}
+	if len(e.waiters) == 0 {
+		delete(l.entries, clientID)
+		return
+	}
+	ch := e.waiters[0]
+	e.waiters = e.waiters[1:]
+	ch <- nil
+	e.timer = l.clock.AfterFunc(l.dur, func() { l.release(clientID, e) })
+}
 
-	// Get current wait channel, increment waiters if we're going to
-	// be waiting, and create the next wait channel.
-	waitCh := e.waitCh
-	if waitCh != nil {
-		if e.waiters == l.maxWaiters {
-			l.mu.Unlock()
-			return ErrTooManyEvents
+func (l *limiter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for clientID, e := range l.entries {
+		e.timer.Stop()
+		for _, ch := range e.waiters {
+			ch <- ErrClosed
 		}
-		e.waiters++
+		delete(l.entries, clientID)
+	}
+}
+
+// Option configures a limiter created by NewTokenBucketLimiter.
+type Option func(*tokenBucketLimiter)
+
+// WithPenalty causes each consecutive failure reported via Penalize to block
+// further events for the client, for an initial duration which doubles with
+// each consecutive failure up to max. A client's failures are forgotten once
+// it has gone without failure for as long as its current penalty after that
+// penalty expires.
+func WithPenalty(initial, max time.Duration) Option {
+	return func(l *tokenBucketLimiter) {
+		l.penalty = initial
+		l.maxPenalty = max
+	}
+}
+
+// NewTokenBucketLimiter creates a new rate limiter which allows rate events
+// per second, with bursts of up to burst events, and at most maxWaiters
+// waiters.
+func NewTokenBucketLimiter(rate float64, burst, maxWaiters int, opts ...Option) Limiter {
+	l := &tokenBucketLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxWaiters: maxWaiters,
+		clock:      realClock{},
+		buckets:    map[string]*bucket{},
+		waits:      map[chan error]timer{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// gcInterval is how often a tokenBucketLimiter removes the state of clients
+// which would be treated the same as new clients.
+const gcInterval = time.Minute
+
+type tokenBucketLimiter struct {
+	rate       float64 // tokens added per second
+	burst      float64 // maximum number of tokens
+	maxWaiters int
+	penalty    time.Duration // penalty for a single failure, or 0 if failures are not penalized
+	maxPenalty time.Duration
+	clock      clock
+
+	mu      sync.Mutex // protects closed, lastGC, buckets, waits, and all values of buckets
+	closed  bool
+	lastGC  time.Time
+	buckets map[string]*bucket
+	waits   map[chan error]timer // timers of waiting events, keyed by the channel each timer sends nil on
+}
+
+type bucket struct {
+	tokens       float64   // may be negative, if events are waiting on tokens
+	updated      time.Time // when tokens was last updated
+	waiters      int
+	failures     int       // consecutive failures reported by Penalize
+	blockedUntil time.Time // when the penalty for the last failure expires
+}
+
+func (l *tokenBucketLimiter) Wait(clientID string) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	now := l.clock.Now()
+	b := l.bucket(clientID, now)
+
+	// Reserve a token, determining when it will be available. Events are
+	// also held until any penalty has expired.
+	readyAt := now
+	if b.tokens < 1 {
+		readyAt = now.Add(time.Duration((1 - b.tokens) / l.rate * float64(time.Second)))
+	}
+	if b.blockedUntil.After(readyAt) {
+		readyAt = b.blockedUntil
+	}
+	wait := readyAt.Sub(now)
+	if wait <= 0 {
+		b.tokens--
+		l.mu.Unlock()
+		return nil
 	}
-	nextWaitCh := make(chan struct{})
-	e.waitCh = nextWaitCh
+	if b.waiters == l.maxWaiters {
+		l.mu.Unlock()
+		return ErrTooManyEvents
+	}
+	b.waiters++
+	b.tokens--
+	ch := make(chan error, 1)
+	l.waits[ch] = l.clock.AfterFunc(wait, func() { ch <- nil })
 	l.mu.Unlock()
 
-	// Wait if needed until we're ready to be released, then set up a timer
-	// to release the next in the queue or clean up if no one is enqueued.
-	if waitCh != nil {
-		<-waitCh
-	}
-	time.AfterFunc(l.dur, func() {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		close(nextWaitCh)
-		if e.waiters == 0 {
-			delete(l.entries, clientID)
+	err := <-ch
+	l.mu.Lock()
+	delete(l.waits, ch)
+	b.waiters--
+	l.mu.Unlock()
+	return err
+}
+
+func (l *tokenBucketLimiter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for ch, t := range l.waits {
+		if t.Stop() {
+			ch <- ErrClosed
 		}
-		e.waiters--
-	})
-	return nil
+	}
+}
+
+func (l *tokenBucketLimiter) Penalize(clientID string) {
+	if l.penalty <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	b := l.bucket(clientID, now)
+	b.failures++
+	if until := now.Add(l.penaltyFor(b.failures)); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// penaltyFor returns the penalty for the given number of consecutive failures.
+func (l *tokenBucketLimiter) penaltyFor(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	p := l.penalty
+	for i := 1; i < failures && p < l.maxPenalty; i++ {
+		p *= 2
+	}
+	if p > l.maxPenalty {
+		p = l.maxPenalty
+	}
+	return p
 }
+
+// bucket gets the up-to-date bucket for the given client, creating it if
+// necessary. It also garbage-collects expired buckets, if it has been long
+// enough since the last collection. l.mu must be held.
+func (l *tokenBucketLimiter) bucket(clientID string, now time.Time) *bucket {
+	if now.Sub(l.lastGC) >= gcInterval {
+		l.collectGarbage(now)
+	}
+
+	b := l.buckets[clientID]
+	if b == nil {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[clientID] = b
+	}
+	l.refill(b, now)
+	return b
+}
+
+// collectGarbage removes expired buckets. l.mu must be held.
+func (l *tokenBucketLimiter) collectGarbage(now time.Time) {
+	l.lastGC = now
+	for id, b := range l.buckets {
+		l.refill(b, now)
+		if l.expired(b, now) {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// refill adds the tokens accrued since the bucket was last updated. l.mu must
+// be held.
+func (l *tokenBucketLimiter) refill(b *bucket, now time.Time) {
+	if !now.After(b.updated) {
+		return
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+	if b.failures > 0 && !now.Before(b.blockedUntil.Add(l.penaltyFor(b.failures))) {
+		b.failures = 0
+	}
+}
+
+// expired determines if the given (up-to-date) bucket is indistinguishable
+// from a newly-created bucket, and may therefore be removed. l.mu must be
+// held.
+func (l *tokenBucketLimiter) expired(b *bucket, now time.Time) bool {
+	return b.waiters == 0 && b.tokens == l.burst && b.failures == 0 && !now.Before(b.blockedUntil)
+}
+
+// clock abstracts the passage of time, for testing.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a timer created by a clock.
+type timer interface {
+	// Stop prevents the timer from firing, returning false if it has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
@@ -0,0 +1,384 @@
+package rate
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+	l, c := newTestSimpleLimiter(1, 1)
+
+	// The first event is allowed immediately, & the next waits out the
+	// interval. Only maxWaiters events may wait.
+	if err := l.Wait("client"); err != nil {
+		t.Fatalf("First event returned error %v, want nil", err)
+	}
+	second := waitAsync(l, "client")
+	waitForWaiters(t, l, "client", 1)
+	if err := l.Wait("client"); err != ErrTooManyEvents {
+		t.Errorf("Event with too many waiters returned error %v, want %v", err, ErrTooManyEvents)
+	}
+	if err := l.Wait("other"); err != nil {
+		t.Errorf("Other client's event returned error %v, want nil", err)
+	}
+	c.Advance(time.Second)
+	if err := <-second; err != nil {
+		t.Errorf("Second event returned error %v, want nil", err)
+	}
+
+	// Once the head of the queue is allowed, another event may wait. The
+	// count of waiters never drifts, however many intervals pass.
+	for i := 0; i < 3; i++ {
+		next := waitAsync(l, "client")
+		waitForWaiters(t, l, "client", 1)
+		if err := l.Wait("client"); err != ErrTooManyEvents {
+			t.Errorf("Event %d with too many waiters returned error %v, want %v", i, err, ErrTooManyEvents)
+		}
+		c.Advance(time.Second)
+		if err := <-next; err != nil {
+			t.Errorf("Event %d returned error %v, want nil", i, err)
+		}
+	}
+
+	// The client's entry is kept until its timer fires with no one waiting,
+	// after which events are allowed immediately.
+	if got := entryCount(l); got != 1 {
+		t.Errorf("With a timer outstanding, limiter had %d entries, want 1", got)
+	}
+	c.Advance(time.Second)
+	if got := entryCount(l); got != 0 {
+		t.Errorf("After the interval, limiter had %d entries, want 0", got)
+	}
+	if got := c.Pending(); got != 0 {
+		t.Errorf("After the interval, clock had %d pending timers, want 0", got)
+	}
+	if err := l.Wait("client"); err != nil {
+		t.Errorf("Event after the interval returned error %v, want nil", err)
+	}
+}
+
+func TestLimiterClose(t *testing.T) {
+	t.Parallel()
+	l, c := newTestSimpleLimiter(1, 1)
+	if err := l.Wait("client"); err != nil {
+		t.Fatalf("First event returned error %v, want nil", err)
+	}
+	waiting := waitAsync(l, "client")
+	waitForWaiters(t, l, "client", 1)
+
+	// Closing the limiter releases waiting events & cancels timers.
+	l.Close()
+	if err := <-waiting; err != ErrClosed {
+		t.Errorf("Waiting event returned error %v, want %v", err, ErrClosed)
+	}
+	if got := c.Pending(); got != 0 {
+		t.Errorf("After Close, clock had %d pending timers, want 0", got)
+	}
+	if err := l.Wait("client"); err != ErrClosed {
+		t.Errorf("Event after Close returned error %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTokenBucketClose(t *testing.T) {
+	t.Parallel()
+	c := &manualClock{now: time.Unix(1e9, 0)}
+	l := NewTokenBucketLimiter(1, 1, 1).(*tokenBucketLimiter)
+	l.clock = c
+	l.lastGC = c.Now()
+	if err := l.Wait("client"); err != nil {
+		t.Fatalf("First event returned error %v, want nil", err)
+	}
+	waiting := waitAsync(l, "client")
+	for c.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	l.Close()
+	if err := <-waiting; err != ErrClosed {
+		t.Errorf("Waiting event returned error %v, want %v", err, ErrClosed)
+	}
+	if got := c.Pending(); got != 0 {
+		t.Errorf("After Close, clock had %d pending timers, want 0", got)
+	}
+	if err := l.Wait("client"); err != ErrClosed {
+		t.Errorf("Event after Close returned error %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	t.Parallel()
+	l, c := newTestLimiter(2, 3, 1)
+
+	// The first burst of events is allowed immediately; later events are limited to the rate.
+	for i, want := range []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond} {
+		if got := waitFor(t, l, c, "client"); got != want {
+			t.Errorf("Event %d waited %v, want %v", i, got, want)
+		}
+	}
+
+	// Other clients are unaffected.
+	if got := waitFor(t, l, c, "other"); got != 0 {
+		t.Errorf("Other client waited %v, want 0", got)
+	}
+
+	// Tokens are replenished over time, up to the burst size.
+	c.Advance(time.Hour)
+	for i, want := range []time.Duration{0, 0, 0, 500 * time.Millisecond} {
+		if got := waitFor(t, l, c, "client"); got != want {
+			t.Errorf("Event %d after replenishment waited %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestTokenBucketMaxWaiters(t *testing.T) {
+	t.Parallel()
+	l, c := newTestLimiter(1, 1, 0)
+	if got := waitFor(t, l, c, "client"); got != 0 {
+		t.Errorf("First event waited %v, want 0", got)
+	}
+	if err := l.Wait("client"); err != ErrTooManyEvents {
+		t.Errorf("Wait with too many waiters returned %v, want %v", err, ErrTooManyEvents)
+	}
+}
+
+func TestTokenBucketPenalty(t *testing.T) {
+	t.Parallel()
+	l, c := newTestLimiter(1000, 10, 1, WithPenalty(time.Second, 4*time.Second))
+
+	// Each consecutive failure doubles the penalty, up to the maximum.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		l.Penalize("client")
+		if got := waitFor(t, l, c, "client"); got != want {
+			t.Errorf("Event after failure %d waited %v, want %v", i+1, got, want)
+		}
+	}
+
+	// Other clients are unaffected.
+	if got := waitFor(t, l, c, "other"); got != 0 {
+		t.Errorf("Other client waited %v, want 0", got)
+	}
+
+	// Failures are forgotten after enough time without failure.
+	c.Advance(4 * time.Second)
+	l.Penalize("client")
+	if got, want := waitFor(t, l, c, "client"), time.Second; got != want {
+		t.Errorf("Event after forgiven failures waited %v, want %v", got, want)
+	}
+
+	// Without a penalty configured, Penalize does nothing.
+	l, c = newTestLimiter(1000, 10, 1)
+	l.Penalize("client")
+	if got := waitFor(t, l, c, "client"); got != 0 {
+		t.Errorf("Event after unpenalized failure waited %v, want 0", got)
+	}
+}
+
+func TestTokenBucketGC(t *testing.T) {
+	t.Parallel()
+	l, c := newTestLimiter(1.0/120, 1, 1, WithPenalty(90*time.Second, time.Hour))
+	waitFor(t, l, c, "client")
+	l.Penalize("penalized")
+
+	// Buckets are kept until they would be indistinguishable from new
+	// buckets: they are full, and any failures have been forgotten.
+	for _, test := range []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{60 * time.Second, 2},  // client's bucket is half full, penalized client is blocked
+		{120 * time.Second, 1}, // client's bucket is full, penalized client's failure is not yet forgotten
+		{180 * time.Second, 0}, // penalized client's failure is forgotten
+	} {
+		c.Advance(test.elapsed - c.Now().Sub(time.Unix(1e9, 0)))
+		l.mu.Lock()
+		l.collectGarbage(c.Now())
+		got := len(l.buckets)
+		l.mu.Unlock()
+		if got != test.want {
+			t.Errorf("After %v, limiter had %d buckets, want %d", test.elapsed, got, test.want)
+		}
+	}
+
+	// Garbage is collected as the limiter is used.
+	waitFor(t, l, c, "client")
+	c.Advance(gcInterval + 120*time.Second)
+	waitFor(t, l, c, "other")
+	if got := bucketCount(l); got != 1 {
+		t.Errorf("After use, limiter had %d buckets, want 1", got)
+	}
+}
+
+func newTestSimpleLimiter(rate float64, maxWaiters int) (*limiter, *manualClock) {
+	c := &manualClock{now: time.Unix(1e9, 0)}
+	l := NewLimiter(rate, maxWaiters).(*limiter)
+	l.clock = c
+	return l, c
+}
+
+// waitAsync waits for an event for the given client in a new goroutine,
+// returning a channel which receives the result.
+func waitAsync(l Limiter, clientID string) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- l.Wait(clientID) }()
+	return ch
+}
+
+// waitForWaiters blocks until the given number of events are waiting for the
+// given client.
+func waitForWaiters(t *testing.T, l *limiter, clientID string, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		var got int
+		if e := l.entries[clientID]; e != nil {
+			got = len(e.waiters)
+		}
+		l.mu.Unlock()
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events waiting for %q, want %d", got, clientID, want)
+		}
+	}
+}
+
+func entryCount(l *limiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+func newTestLimiter(rate float64, burst, maxWaiters int, opts ...Option) (*tokenBucketLimiter, *fakeClock) {
+	c := &fakeClock{now: time.Unix(1e9, 0)}
+	l := NewTokenBucketLimiter(rate, burst, maxWaiters, opts...).(*tokenBucketLimiter)
+	l.clock = c
+	l.lastGC = c.Now()
+	return l, c
+}
+
+// waitFor waits for an event for the given client, returning how long the
+// limiter waited (according to the fake clock).
+func waitFor(t *testing.T, l Limiter, c *fakeClock, clientID string) time.Duration {
+	t.Helper()
+	start := c.Now()
+	if err := l.Wait(clientID); err != nil {
+		t.Fatalf("Could not wait for %q: %v", clientID, err)
+	}
+	return c.Now().Sub(start)
+}
+
+func bucketCount(l *tokenBucketLimiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// fakeClock is a clock whose time only changes when advanced. Timers advance
+// the clock by their duration, then fire immediately.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.Advance(d)
+	f()
+	return firedTimer{}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// firedTimer is a timer which has already fired.
+type firedTimer struct{}
+
+func (firedTimer) Stop() bool { return false }
+
+// manualClock is a clock whose time only changes when advanced. Timers fire
+// when the clock is advanced past their deadline.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	c        *manualClock
+	deadline time.Time
+	f        func()
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{c, c.now.Add(d), f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance advances the clock, firing the timers whose deadlines pass in
+// order. Timers created by fired timers may also fire.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *manualTimer
+		for _, t := range c.timers {
+			if !t.deadline.After(end) && (next == nil || t.deadline.Before(next.deadline)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.removeLocked(next)
+		c.now = next.deadline
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Pending returns the number of timers which have not yet fired or been
+// stopped.
+func (c *manualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (c *manualClock) removeLocked(t *manualTimer) bool {
+	for i, ct := range c.timers {
+		if ct == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.removeLocked(t)
+}
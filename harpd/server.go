@@ -2,15 +2,36 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/BranLwyd/harpocrates/harpd/accesslog"
 	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/authlog"
+	"github.com/BranLwyd/harpocrates/harpd/certs"
+	"github.com/BranLwyd/harpocrates/harpd/config"
+	"github.com/BranLwyd/harpocrates/harpd/counter"
+	"github.com/BranLwyd/harpocrates/harpd/device"
 	"github.com/BranLwyd/harpocrates/harpd/handler"
+	"github.com/BranLwyd/harpocrates/harpd/metrics"
+	"github.com/BranLwyd/harpocrates/harpd/passwordless"
 	"github.com/BranLwyd/harpocrates/harpd/session"
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/audit"
+	"github.com/BranLwyd/harpocrates/secret/gitsync"
 	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/golang/protobuf/proto"
 
 	cpb "github.com/BranLwyd/harpocrates/harpd/proto/config_go_proto"
 	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
@@ -21,34 +42,475 @@ import (
 type Server interface {
 	// ParseConfig parses the server configuration, returning a Config struct, the key to use, and an
 	// MFA counter store.
-	ParseConfig() (_ *cpb.Config, _ *kpb.Key, _ error)
+	ParseConfig() (_ *cpb.Config, _ *kpb.Key, _ *counter.Store, _ error)
 
-	// Serve serves the given HTTP handler. It should not return.
-	Serve(*cpb.Config, http.Handler) error
+	// HTTPServer creates the HTTP server used to serve the given handler. If
+	// the returned server has a TLS config, Run starts the server with
+	// ListenAndServeTLS, so the config must provide a TLS certificate;
+	// otherwise, Run serves plain HTTP.
+	HTTPServer(*cpb.Config, http.Handler) (*http.Server, error)
+
+	// ReloadAssets determines if overridden templates & static assets (see
+	// asset_override_dir) are re-read on every request, rather than only when
+	// they change.
+	ReloadAssets() bool
 }
 
+// Run runs a harpocrates server until it receives SIGINT or SIGTERM, at which
+// point it stops accepting requests, waits for in-flight requests to finish,
+// closes all sessions, and returns.
 func Run(s Server) {
+	// Handle signals from the start, so that a signal received during
+	// startup also shuts down cleanly.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
 	// Parse config & prepare session handler.
-	cfg, k, err := s.ParseConfig()
+	cfg, k, cs, err := s.ParseConfig()
 	if err != nil {
 		log.Fatalf("Could not parse configuration: %v", err)
 	}
 	sessionDuration := time.Duration(cfg.SessionDurationS * float64(time.Second))
-	var alerter alert.Alerter
-	if cfg.AlertCmd != "" {
-		alerter = alert.NewCommand(cfg.AlertCmd)
+	alerter := newAlerter(cfg)
+	vaultOpts := []key.VaultOption{key.WithVersions(int(cfg.KeepVersions))}
+	if cfg.TrashRetentionS > 0 {
+		vaultOpts = append(vaultOpts, key.WithTrash(time.Duration(cfg.TrashRetentionS*float64(time.Second))))
+	}
+	if cfg.ResolveSymlinks {
+		vaultOpts = append(vaultOpts, key.WithResolveSymlinks())
+	}
+	if cfg.EntryMaxSize > 0 {
+		vaultOpts = append(vaultOpts, key.WithMaxEntrySize(int(cfg.EntryMaxSize)))
+	}
+	if cfg.Manifest {
+		vaultOpts = append(vaultOpts, key.WithManifest())
+	}
+	reg := metrics.NewRegistry()
+	opts := []session.Option{session.WithMetrics(reg), session.WithNewSessionBurst(int(cfg.NewSessionBurst))}
+	var vault secret.Vault
+	switch {
+	case len(cfg.Users) > 0:
+		var users []session.User
+		for _, uc := range cfg.Users {
+			uk, err := ReadKey(uc.KeyFile)
+			if err != nil {
+				log.Fatalf("Could not read key for user %q: %v", uc.Name, err)
+			}
+			v, err := newVault(cfg, uc.PassLoc, uk, vaultOpts)
+			if err != nil {
+				log.Fatalf("Could not create secret vault for user %q: %v", uc.Name, err)
+			}
+			users = append(users, session.User{Name: uc.Name, Vault: v, MFACredentials: uc.MfaReg})
+		}
+		opts = append(opts, session.WithUsers(users...))
+	case len(cfg.Vaults) == 0:
+		if vault, err = newVault(cfg, cfg.PassLoc, k, vaultOpts); err != nil {
+			log.Fatalf("Could not create secret vault: %v", err)
+		}
+	default:
+		var mounts []session.Mount
+		for _, vc := range cfg.Vaults {
+			vk, err := ReadKey(vc.KeyFile)
+			if err != nil {
+				log.Fatalf("Could not read key for vault %q: %v", vc.Name, err)
+			}
+			v, err := newVault(cfg, vc.PassLoc, vk, vaultOpts)
+			if err != nil {
+				log.Fatalf("Could not create secret vault %q: %v", vc.Name, err)
+			}
+			mounts = append(mounts, session.Mount{Name: vc.Name, Path: vc.Mount, Vault: v})
+		}
+		opts = append(opts, session.WithMounts(mounts...))
+	}
+	switch cfg.SessionBinding {
+	case cpb.Config_WARN:
+		opts = append(opts, session.WithBinding(session.BindingWarn))
+	case cpb.Config_ENFORCE:
+		opts = append(opts, session.WithBinding(session.BindingEnforce))
+	}
+	if cfg.MaxSessions > 0 {
+		policy := session.SessionLimitReject
+		if cfg.SessionLimitPolicy == cpb.Config_EVICT_UNAUTHENTICATED {
+			policy = session.SessionLimitEvict
+		}
+		opts = append(opts, session.WithMaxSessions(int(cfg.MaxSessions), policy))
+	}
+	if cfg.SessionMaxLifetimeS > 0 {
+		opts = append(opts, session.WithMaxLifetime(time.Duration(cfg.SessionMaxLifetimeS*float64(time.Second))))
+	}
+	if cfg.MfaRememberS > 0 {
+		opts = append(opts, session.WithMFARemember(time.Duration(cfg.MfaRememberS*float64(time.Second))))
+	}
+	if cfg.SoftLockGraceS > 0 {
+		opts = append(opts, session.WithSoftLock(time.Duration(cfg.SoftLockGraceS*float64(time.Second))))
+	}
+	if cfg.MaxMfaFailures > 0 {
+		opts = append(opts, session.WithMaxMFAFailures(int(cfg.MaxMfaFailures)))
+	}
+	if cfg.MaxMfaRegistrationFailures > 0 {
+		opts = append(opts, session.WithMaxMFARegistrationFailures(int(cfg.MaxMfaRegistrationFailures)))
+	}
+	if len(cfg.AlwaysReauthPrefix) > 0 {
+		opts = append(opts, session.WithAlwaysReauth(cfg.AlwaysReauthPrefix...))
+	}
+	if cfg.ShareDurationS > 0 {
+		opts = append(opts, session.WithShareDuration(time.Duration(cfg.ShareDurationS*float64(time.Second))))
+	}
+	if cfg.VerifyManifestOnLogin {
+		opts = append(opts, session.WithStoreVerification())
+	}
+	if cfg.ReadOnly {
+		opts = append(opts, session.WithReadOnly())
+	} else if len(cfg.ReadOnlyPrefix) > 0 {
+		opts = append(opts, session.WithReadOnly(cfg.ReadOnlyPrefix...))
+	}
+	var al *authlog.Log
+	if cfg.AuthLogFile != "" {
+		al, err = authlog.New(cfg.AuthLogFile, time.Duration(cfg.AuthLogRetentionS*float64(time.Second)), time.Duration(cfg.FailedLoginAlertWindowS*float64(time.Second)))
+		if err != nil {
+			log.Fatalf("Could not open auth log: %v", err)
+		}
+		opts = append(opts, session.WithAuthLog(al, int(cfg.FailedLoginAlertThreshold)))
+	}
+	if cfg.ApiTokenFile != "" {
+		ts, err := apitoken.NewStore(cfg.ApiTokenFile)
+		if err != nil {
+			log.Fatalf("Could not open API token store: %v", err)
+		}
+		opts = append(opts, session.WithAPITokens(ts))
+	}
+	if cfg.TrustedDeviceFile != "" {
+		ds, err := device.NewStore(cfg.TrustedDeviceFile, time.Duration(cfg.TrustedDeviceDays)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Could not open trusted device store: %v", err)
+		}
+		opts = append(opts, session.WithTrustedDevices(ds))
+	}
+	if cfg.PasswordlessUnlockFile != "" {
+		ps, err := passwordless.NewStore(cfg.PasswordlessUnlockFile)
+		if err != nil {
+			log.Fatalf("Could not open passwordless unlock store: %v", err)
+		}
+		opts = append(opts, session.WithPasswordlessUnlock(ps))
+	}
+	if cfg.MfaCredentialFile != "" {
+		opts = append(opts, session.WithCredentialFile(cfg.MfaCredentialFile))
+	}
+	if cfg.ExternalSecretFile != "" {
+		opts = append(opts, session.WithExternalSecret(func() ([]byte, error) { return ioutil.ReadFile(cfg.ExternalSecretFile) }))
+	}
+	if cfg.DebugLog {
+		opts = append(opts, session.WithDebugLog())
+	}
+	if len(cfg.Listen) > 0 {
+		var origins []string
+		for _, lc := range cfg.Listen {
+			origins = append(origins, lc.Origin)
+		}
+		opts = append(opts, session.WithOrigins(origins...))
+	}
+	if cfg.StoreCacheTtlS > 0 {
+		opts = append(opts, session.WithStoreCache(time.Duration(cfg.StoreCacheTtlS*float64(time.Second)), int(cfg.StoreCacheMaxEntries)))
+	}
+	sh, err := session.NewHandler(vault, fmt.Sprintf("https://%s", cfg.HostName), cfg.MfaReg, cs, sessionDuration, cfg.NewSessionRate, alerter, opts...)
+	if err != nil {
+		log.Fatalf("Could not create session handler: %v", err)
+	}
+	log.Printf("Serving MFA for origin %q (relying party ID %q)", sh.Origin(), sh.RelyingPartyID())
+
+	contentOpts := []handler.Option{handler.WithDirectoryPageSize(int(cfg.DirectoryPageSize))}
+	if cfg.AttachmentMaxSize > 0 {
+		contentOpts = append(contentOpts, handler.WithAttachmentMaxSize(cfg.AttachmentMaxSize))
+	}
+	if cfg.EntryMaxSize > 0 {
+		contentOpts = append(contentOpts, handler.WithEntryMaxSize(int(cfg.EntryMaxSize)))
+	}
+	if cfg.BodyMaxSize > 0 {
+		contentOpts = append(contentOpts, handler.WithBodyMaxSize(cfg.BodyMaxSize))
+	}
+	if cfg.ConfirmWrites {
+		contentOpts = append(contentOpts, handler.WithConfirmWrites())
+	}
+	if cfg.FieldsOnlyView {
+		contentOpts = append(contentOpts, handler.WithFieldsOnly())
+	}
+	if cfg.DisableEntryPreviews {
+		contentOpts = append(contentOpts, handler.WithoutEntryPreviews())
+	}
+	if cfg.ExpiryWindowS > 0 {
+		contentOpts = append(contentOpts, handler.WithExpiryWindow(time.Duration(cfg.ExpiryWindowS*float64(time.Second))))
+	}
+	if cfg.StaleAfterS > 0 {
+		contentOpts = append(contentOpts, handler.WithStaleAfter(time.Duration(cfg.StaleAfterS*float64(time.Second))))
+	}
+	if bp := strings.TrimSuffix(cfg.BasePath, "/"); bp != "" {
+		if err := handler.ValidateBasePath(bp); err != nil {
+			log.Fatalf("Invalid base_path: %v", err)
+		}
+		contentOpts = append(contentOpts, handler.WithBasePath(bp))
+	}
+	if cfg.AssetOverrideDir != "" {
+		contentOpts = append(contentOpts, handler.WithAssetOverrides(cfg.AssetOverrideDir, s.ReloadAssets()))
+	}
+	if cfg.SessionCookie != nil {
+		sc, err := config.SessionCookie(cfg.SessionCookie)
+		if err != nil {
+			log.Fatalf("Invalid session_cookie: %v", err)
+		}
+		contentOpts = append(contentOpts, handler.WithSessionCookie(sc))
+	}
+	if cfg.PrefsKeyFile != "" {
+		key, err := readOrCreatePrefsKey(cfg.PrefsKeyFile)
+		if err != nil {
+			log.Fatalf("Could not get preferences key: %v", err)
+		}
+		contentOpts = append(contentOpts, handler.WithPrefsKey(key))
+	}
+	if al != nil {
+		contentOpts = append(contentOpts, handler.WithAuthLog(al))
+	}
+	if cfg.HibpDataset != "" {
+		fr, err := audit.NewFileRanger(cfg.HibpDataset)
+		if err != nil {
+			log.Fatalf("Could not open breached password dataset: %v", err)
+		}
+		contentOpts = append(contentOpts, handler.WithPasswordChecker(audit.NewRangeChecker(fr)))
+	}
+	if cfg.AccessLogFile != "" {
+		al, err := accesslog.New(cfg.AccessLogFile, int(cfg.AccessLogMaxEntries))
+		if err != nil {
+			log.Fatalf("Could not open access log: %v", err)
+		}
+		contentOpts = append(contentOpts, handler.WithAccessLog(al))
+	}
+
+	contentOpts = append(contentOpts, handler.WithReadinessCheck("counters", func(context.Context) error { return cs.Check() }))
+	if cfg.CertDir != "" {
+		contentOpts = append(contentOpts, handler.WithReadinessCheck("cert_dir", func(context.Context) error { return checkWritableDir(cfg.CertDir) }))
+	}
+
+	// Serve metrics on a separate listener if requested; otherwise, serve them alongside other content.
+	var servers []*http.Server
+	serveErrs := make(chan error, 2+len(cfg.Listen))
+	if cfg.MetricsAddr != "" {
+		if err := config.CheckLoopbackAddr(cfg.MetricsAddr); err != nil {
+			log.Fatalf("Invalid metrics_addr: %v", err)
+		}
+		metricsServer := &http.Server{Addr: cfg.MetricsAddr, Handler: reg.Handler()}
+		servers = append(servers, metricsServer)
+		go func() { serveErrs <- fmt.Errorf("couldn't serve metrics: %w", metricsServer.ListenAndServe()) }()
 	} else {
-		alerter = alert.NewLog()
+		contentOpts = append(contentOpts, handler.WithMetrics(reg))
+	}
+
+	// Start serving. If there are additional listeners, each has its own
+	// handler, so that sessions are partitioned between them.
+	mainOpts := contentOpts
+	if len(cfg.Listen) > 0 {
+		mainOpts = append(append([]handler.Option(nil), contentOpts...), handler.WithListener(handler.Listener{}))
 	}
-	vault, err := key.NewVault(cfg.PassLoc, k)
+	server, err := s.HTTPServer(cfg, handler.NewContent(sh, mainOpts...))
 	if err != nil {
-		log.Fatalf("Could not create secret vault: %v", err)
+		log.Fatalf("Could not create HTTP server: %v", err)
+	}
+	servers = append(servers, server)
+	if server.TLSConfig != nil {
+		go func() { serveErrs <- server.ListenAndServeTLS("", "") }()
+	} else {
+		go func() { serveErrs <- server.ListenAndServe() }()
+	}
+	for _, lc := range cfg.Listen {
+		lc := lc
+		l := config.Listener(lc)
+		srv, err := listenerServer(cfg, lc, handler.NewContent(sh, append(append([]handler.Option(nil), contentOpts...), handler.WithListener(l))...))
+		if err != nil {
+			log.Fatalf("Could not create HTTP server for listener %q: %v", lc.Name, err)
+		}
+		servers = append(servers, srv)
+		if l.Insecure {
+			log.Printf("WARNING: listener %q serves plain HTTP on %s; it is read-only, and every request needs multi-factor authentication at origin %q", lc.Name, lc.Addr, lc.Origin)
+		} else {
+			log.Printf("Serving listener %q on %s, for origin %q", lc.Name, lc.Addr, lc.Origin)
+		}
+		serve := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		go func() { serveErrs <- fmt.Errorf("couldn't serve listener %q: %w", lc.Name, serve()) }()
 	}
-	sh, err := session.NewHandler(vault, fmt.Sprintf("https://%s", cfg.HostName), cfg.MfaReg, sessionDuration, cfg.NewSessionRate, alerter)
+
+	select {
+	case err := <-serveErrs:
+		log.Fatalf("Error while serving: %v", err)
+	case sig := <-sigs:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	// Stop accepting requests & wait for in-flight requests, then close sessions.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownGracePeriodS*float64(time.Second)))
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Could not shut down HTTP server gracefully: %v", err)
+		}
+	}
+	if err := sh.Shutdown(ctx); err != nil {
+		log.Printf("Could not shut down session handler gracefully: %v", err)
+	}
+	log.Printf("Shut down")
+}
+
+// listenerServer creates the HTTP server for the given additional listener,
+// serving the given handler. Certificates served from files are reloaded when
+// the server receives SIGHUP, as for the main listener.
+func listenerServer(cfg *cpb.Config, lc *cpb.ListenerConfig, h http.Handler) (*http.Server, error) {
+	policy, err := config.ContentSecurityPolicy(cfg.ContentSecurityPolicy)
 	if err != nil {
-		log.Fatalf("Could not create session handler: %v", err)
+		return nil, fmt.Errorf("couldn't create Content-Security-Policy: %w", err)
+	}
+	srv := &http.Server{
+		Addr:         lc.Addr,
+		Handler:      NewRequestLogging(cfg, lc.Name, handler.NewSecureHeader(policy, h)),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+
+	switch t := lc.Tls.(type) {
+	case *cpb.ListenerConfig_Static:
+		r, err := certs.NewReloader(t.Static.CertFile, t.Static.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			ch := make(chan os.Signal, 1)
+			signal.Notify(ch, syscall.SIGHUP)
+			for range ch {
+				if err := r.Reload(); err != nil {
+					log.Printf("Could not reload certificate of listener %q: %v", lc.Name, err)
+					continue
+				}
+				log.Printf("Reloaded certificate of listener %q", lc.Name)
+			}
+		}()
+		srv.TLSConfig = &tls.Config{
+			MinVersion:             tls.VersionTLS13,
+			SessionTicketsDisabled: true,
+			GetCertificate:         r.GetCertificate,
+			NextProtos:             []string{"h2"},
+		}
+
+	case *cpb.ListenerConfig_UnsafeHttp:
+		// Served as plain HTTP.
+
+	default:
+		return nil, fmt.Errorf("unknown TLS configuration type %T", t)
+	}
+	return srv, nil
+}
+
+// NewRequestLogging wraps h so that each request is logged under the given
+// log name, in the format chosen by the config.
+func NewRequestLogging(cfg *cpb.Config, logName string, h http.Handler) http.Handler {
+	if cfg.RequestLogFormat == cpb.Config_JSON {
+		return handler.NewStructuredLogging(logName, log.Writer(), h)
 	}
+	return handler.NewLogging(logName, h)
+}
 
-	// Start serving.
-	log.Fatalf("Error while serving: %v", s.Serve(cfg, handler.NewContent(sh)))
+// ReadKey reads a serialized key from the given file.
+func ReadKey(filename string) (*kpb.Key, error) {
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read key file: %w", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		return nil, fmt.Errorf("couldn't parse key: %w", err)
+	}
+	return k, nil
+}
+
+// prefsKeySize is the size of the key signing the preferences cookie, in bytes.
+const prefsKeySize = 32
+
+// readOrCreatePrefsKey reads the key signing the preferences cookie from the
+// given file, first creating the file with a random key if it does not exist.
+func readOrCreatePrefsKey(filename string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		key = make([]byte, prefsKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("couldn't generate key: %w", err)
+		}
+		if err := ioutil.WriteFile(filename, key, 0600); err != nil {
+			return nil, fmt.Errorf("couldn't write key file: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read key file: %w", err)
+	}
+	if len(key) < prefsKeySize {
+		return nil, fmt.Errorf("key file holds %d bytes, want at least %d", len(key), prefsKeySize)
+	}
+	return key, nil
+}
+
+// checkWritableDir checks that files can be created in the given directory,
+// by creating & removing a temporary file.
+func checkWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".harp_check_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// newVault creates a vault storing password data at passLoc, encrypted with
+// the given key, and synced with git if configured.
+func newVault(cfg *cpb.Config, passLoc string, k *kpb.Key, opts []key.VaultOption) (secret.Vault, error) {
+	vault, err := key.NewVault(passLoc, k, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.GitSync {
+		vault, err = gitsync.NewVault(vault, passLoc, cfg.GitRemote, cfg.GitAuthor)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create git-synced vault: %w", err)
+		}
+	}
+	return vault, nil
+}
+
+// newAlerter creates the alerter specified by the configuration. Alerts are
+// always logged, in addition to being sent by any configured alerter; alerts
+// sent by a configured alerter are deduplicated & rate limited as configured.
+func newAlerter(cfg *cpb.Config) alert.Alerter {
+	var a alert.Alerter
+	switch ac := cfg.Alert.(type) {
+	case *cpb.Config_AlertCmd:
+		a = alert.NewCommand(ac.AlertCmd)
+	case *cpb.Config_AlertSmtp:
+		a = alert.NewSMTP(alert.SMTPConfig{
+			Addr:     ac.AlertSmtp.Addr,
+			Username: ac.AlertSmtp.Username,
+			Password: ac.AlertSmtp.Password,
+			From:     ac.AlertSmtp.From,
+			To:       ac.AlertSmtp.To,
+		})
+	case *cpb.Config_AlertWebhook:
+		a = alert.NewWebhook(ac.AlertWebhook.Url, []byte(ac.AlertWebhook.HmacSecret))
+	default:
+		return alert.NewLog()
+	}
+	if cfg.AlertWindowS > 0 && cfg.AlertMaxPerWindow > 0 {
+		a = alert.NewDeduping(a, time.Duration(cfg.AlertWindowS*float64(time.Second)), int(cfg.AlertMaxPerWindow))
+	}
+	return alert.NewMulti(alert.NewLog(), a)
 }
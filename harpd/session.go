@@ -5,240 +5,2767 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/e3b0c442/warp"
+	"github.com/golang/protobuf/proto"
 
 	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/authlog"
+	"github.com/BranLwyd/harpocrates/harpd/counter"
+	"github.com/BranLwyd/harpocrates/harpd/device"
+	"github.com/BranLwyd/harpocrates/harpd/metrics"
+	"github.com/BranLwyd/harpocrates/harpd/passwordless"
 	"github.com/BranLwyd/harpocrates/harpd/rate"
 	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/audit"
+
+	crpb "github.com/BranLwyd/harpocrates/harpd/proto/credential_go_proto"
+)
+
+const (
+	sessionIDLength      = 32
+	publicIDLength       = 16
+	csrfTokenLength      = 32
+	shareTokenLength     = 32
+	defaultShareDuration = 10 * time.Minute
+	alertTimeLimit       = 10 * time.Second
+
+	// Each consecutive wrong passphrase from a client delays that client's
+	// next login attempt, starting at loginPenalty & doubling up to
+	// maxLoginPenalty.
+	loginPenalty    = 250 * time.Millisecond
+	maxLoginPenalty = time.Minute
+
+	// Default number of consecutive failed MFA assertions, or failed MFA
+	// registrations, after which a session is closed.
+	defaultMaxMFAFailures = 5
+
+	// How long a pending session which failed to be created is kept, so
+	// that the client which created it can learn why.
+	pendingResultDuration = time.Minute
+
+	// How often a session's index of entry expiration dates is rebuilt,
+	// to pick up entries modified other than via the session. Building
+	// the index decrypts every entry, so it is done lazily, when first
+	// needed after this long.
+	expiryIndexMaxAge = 24 * time.Hour
+
+	// How long a passwordless login challenge may be answered for, and how
+	// many may be outstanding at once. Challenges are handed out to clients
+	// without a session, so their number is bounded.
+	passwordlessChallengeDuration = 5 * time.Minute
+	maxPasswordlessChallenges     = 1024
+
+	// Length of the PRF output with which a passphrase is wrapped.
+	prfOutputLength = 32
+)
+
+// passwordlessPRFInput is the input to the PRF extension of the MFA devices
+// used for passwordless login. Passwordless challenges are answered without
+// knowing which device will answer, so the same input is used for every
+// device; the output nonetheless differs per device.
+var passwordlessPRFInput = sha256.Sum256([]byte("harpocrates passwordless unlock"))
+
+// ExpiryAlertWindow is how soon an entry must expire for ExpiringEntries to
+// fire an ENTRY_EXPIRING alert.
+const ExpiryAlertWindow = 7 * 24 * time.Hour
+
+var (
+	ErrNoSession               = errors.New("no such session")
+	ErrNoChallenge             = errors.New("no current challenge")
+	ErrMFAAuthenticationFailed = errors.New("MFA authentication failed")
+	ErrMFARegistrationFailed   = errors.New("MFA registration failed")
+	ErrMFACounterRegression    = errors.New("MFA signature counter regression")
+	ErrNoShare                 = errors.New("no such share")
+	ErrNoCredential            = errors.New("no such MFA credential")
+	ErrCredentialsNotPersisted = errors.New("MFA credentials are not persisted")
+	ErrTooManySessions         = errors.New("too many sessions")
+	ErrPRFUnsupported          = errors.New("MFA device does not support the PRF extension")
+)
+
+// Handler handles management of sessions, including creation, deletion, and
+// timeout. It is safe for concurrent use from multiple goroutines.
+type Handler struct {
+	mu          sync.RWMutex                      // protects sessions, pending, shares, apiSessions, challenges, tombstones, and the credentials of each account
+	sessions    map[string]*Session               // by session ID
+	pending     map[string]*PendingSession        // sessions still being created, by the session ID they will have
+	shares      map[string]*share                 // by share token
+	apiSessions map[string]*Session               // sessions created from API tokens, by token ID
+	challenges  map[string]*passwordlessChallenge // outstanding passwordless login challenges, by encoded challenge
+	tombstones  map[[sha256.Size]byte]*tombstone  // soft-locked sessions, by hash of their binding (see bindingHash)
+
+	accounts             []*account          // locked password data & registered MFA devices, by user
+	users                []User              // users, if serving multiple users
+	mounts               []Mount             // locked password data, if serving multiple vaults
+	sessionDuration      time.Duration       // how long sessions last without use
+	maxLifetime          time.Duration       // how long sessions last regardless of use; zero for no limit
+	softLockGrace        time.Duration       // how long a soft-locked session's MFA authentication can be restored; zero to disable soft locking
+	mfaRemember          time.Duration       // how long MFA authentication for a path lasts; zero for the life of the session
+	maxMFAFailures       int                 // consecutive failed MFA assertions after which a session is closed
+	maxMFARegFailures    int                 // consecutive failed MFA registrations after which a session is closed
+	alwaysReauthPrefixes []string            // path prefixes for which MFA authentication lasts only freshMFADuration
+	origin               string              // origin to use for MFA, in canonical form (e.g. "https://example.com:8080"); see parseOrigin
+	domain               string              // domain to use for MFA, i.e. the relying party ID (e.g. "example.com")
+	extraOrigins         []string            // additional origins passed to WithOrigins, as given
+	origins              map[string]bool     // additional origins at which MFA may be performed, in canonical form; see WithOrigins
+	counters             *counter.Store      // MFA device signature counters, keyed by encoded credential ID
+	credentialFile       string              // file in which registered MFA devices are persisted; empty if they are not persisted
+	rateLimiter          rate.Limiter        // rate limiter for creating new sessions
+	newSessionBurst      int                 // how many new sessions may be created in a burst by a single client
+	maxSessions          int                 // maximum number of concurrent sessions; zero for no limit
+	sessionLimitPolicy   SessionLimitPolicy  // what to do when creating a session while at maxSessions
+	alerter              alert.Alerter       // used to notify user of alerts
+	authLog              *authlog.Log        // records login attempts; may be nil
+	failedLoginThreshold int                 // number of recent failed logins from a client which fires an alert; zero to disable
+	storeCacheTTL        time.Duration       // how long to cache store content; zero to disable caching
+	storeCacheMaxEntries int                 // maximum number of entries to cache per session
+	shareDuration        time.Duration       // how long share tokens last before being redeemed
+	binding              Binding             // how sessions are bound to the client that created them
+	readOnly             bool                // whether session stores are wrapped with secret.NewReadOnlyStore
+	readOnlyPrefixes     []string            // directory prefixes which are read-only; if empty, the whole store is read-only
+	verifyStores         bool                // whether to verify session stores when sessions are created
+	apiTokens            *apitoken.Store     // API tokens; nil if API tokens are disabled
+	devices              *device.Store       // trusted devices; nil if trusted devices are disabled
+	passwordless         *passwordless.Store // passphrases wrapped by MFA devices; nil if passwordless login is disabled
+	externalSecret       ExternalSecretFunc  // source of the external secret used when a login supplies none; may be nil
+	pendingAlerts        sync.WaitGroup      // alerts which are still being sent
+	clock                Clock               // source of the current time & timers
+	debugLog             bool                // whether to log details useful for diagnosing failures
+	metrics              handlerMetrics      // metrics; all nil if metrics are not enabled
+}
+
+// handlerMetrics holds the metrics updated by a Handler.
+type handlerMetrics struct {
+	sessionsCreated  *metrics.Counter
+	wrongPassphrases *metrics.Counter
+	rateLimited      *metrics.Counter
+	mfaFailures      *metrics.CounterVec // by reason
+	storeOps         *metrics.SummaryVec // by operation
+	storeErrors      *metrics.CounterVec // by operation
+}
+
+// Option configures optional behavior of a Handler.
+type Option func(*Handler)
+
+// WithStoreCache causes each session's store to cache decrypted entry content
+// in memory for up to ttl, holding at most maxEntries entries. The cache is
+// dropped when the session is closed.
+func WithStoreCache(ttl time.Duration, maxEntries int) Option {
+	return func(h *Handler) {
+		h.storeCacheTTL = ttl
+		h.storeCacheMaxEntries = maxEntries
+	}
+}
+
+// WithClock causes the handler to use the given clock, rather than the system
+// clock, for session & share expiration. It is intended for testing.
+func WithClock(c Clock) Option {
+	return func(h *Handler) { h.clock = c }
+}
+
+// Clock provides the current time & timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in its
+	// own goroutine, as time.AfterFunc does.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer returned by Clock.AfterFunc. *time.Timer implements Timer.
+type Timer interface {
+	// Stop prevents the timer from firing, returning false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after duration d, returning true if
+	// the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                            { return time.Now() }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Mount describes a vault whose entries are served beneath a top-level
+// directory.
+type Mount struct {
+	Name  string // human-readable name of the vault
+	Path  string // top-level directory containing the vault's entries (e.g. "work"); must not contain slashes
+	Vault secret.Vault
+}
+
+// WithMounts causes the handler to serve several vaults, each beneath its own
+// top-level directory, rather than the vault passed to NewHandler. Creating a
+// session unlocks every vault that the given passphrase opens, and fails only
+// if no vault can be unlocked.
+func WithMounts(mounts ...Mount) Option {
+	return func(h *Handler) { h.mounts = mounts }
+}
+
+// User describes one of several users served by a handler, each with their
+// own vault & MFA devices.
+type User struct {
+	Name           string // name of the user, which may be given when creating a session; must be unique & nonempty
+	Vault          secret.Vault
+	MFACredentials []string // registered MFA device credentials, as returned by Session.CompleteMFARegistration
+}
+
+// WithUsers causes the handler to serve several users, rather than the vault &
+// MFA credentials passed to NewHandler. Each session is bound to a single
+// user: its store is that user's vault, and only that user's MFA devices can
+// authenticate it. It may not be combined with WithMounts or WithAPITokens.
+func WithUsers(users ...User) Option {
+	return func(h *Handler) { h.users = users }
+}
+
+// WithCredentialFile causes registered MFA devices to be persisted in the
+// given file, so that devices can be added & removed while the server runs
+// (see AddCredential & RemoveCredential). If the file exists, the devices it
+// lists replace the MFA credentials passed to NewHandler (or specified by each
+// User); otherwise, those credentials are imported into it when it is first
+// written. By default, registered MFA devices are not persisted: devices
+// registered while the server runs are only usable until it restarts, and
+// devices cannot be removed.
+func WithCredentialFile(filename string) Option {
+	return func(h *Handler) { h.credentialFile = filename }
+}
+
+// WithAuthLog causes login attempts to be recorded in the given log. If
+// alertThreshold is positive, a FAILED_LOGIN_BURST alert is fired when a
+// client makes alertThreshold failed attempts within the log's window.
+func WithAuthLog(l *authlog.Log, alertThreshold int) Option {
+	return func(h *Handler) {
+		h.authLog = l
+		h.failedLoginThreshold = alertThreshold
+	}
+}
+
+// WithNewSessionBurst allows each client to create up to n new sessions (or
+// make n login attempts) in a burst before being rate limited. By default, no
+// bursting is allowed.
+func WithNewSessionBurst(n int) Option {
+	return func(h *Handler) { h.newSessionBurst = n }
+}
+
+// WithReadOnly causes each session's store to be wrapped with
+// secret.NewReadOnlyStore, so that entries beneath the given directory
+// prefixes can't be modified. If no prefixes are given, no entries can be
+// modified.
+func WithReadOnly(prefixes ...string) Option {
+	return func(h *Handler) {
+		h.readOnly = true
+		h.readOnlyPrefixes = prefixes
+	}
+}
+
+// WithAPITokens allows sessions to be created from the API tokens in the given
+// store, via GetAPITokenSession, and allows users to create & revoke tokens.
+// By default, API tokens are disabled.
+func WithAPITokens(s *apitoken.Store) Option {
+	return func(h *Handler) { h.apiTokens = s }
+}
+
+// ExternalSecretFunc returns an external secret with which to unlock vaults.
+type ExternalSecretFunc func() ([]byte, error)
+
+// WithExternalSecret causes the external secret returned by the given function
+// to be used to unlock vaults whose keys require one (see
+// secret.ExternalSecretVault) when a login does not supply an external secret
+// itself. The function is called on each such login, so that e.g. a file on
+// removable media need only be present while logging in; if it fails, the
+// error is logged & the vault is unlocked without an external secret. By
+// default, only external secrets supplied by logins are used.
+func WithExternalSecret(f ExternalSecretFunc) Option {
+	return func(h *Handler) { h.externalSecret = f }
+}
+
+// WithTrustedDevices allows users to trust the browsers with which they have
+// completed multi-factor authentication, via Session.TrustDevice, persisting
+// trusted devices in the given store. By default, devices can't be trusted.
+func WithTrustedDevices(s *device.Store) Option {
+	return func(h *Handler) { h.devices = s }
+}
+
+// WithPasswordlessUnlock allows users to log in with an MFA device in place of
+// their passphrase, via CreatePasswordlessSessionAsync, persisting the
+// passphrases wrapped by their devices in the given store (see
+// Session.EnablePasswordlessUnlock). By default, logins require a passphrase.
+func WithPasswordlessUnlock(s *passwordless.Store) Option {
+	return func(h *Handler) { h.passwordless = s }
+}
+
+// SessionLimitPolicy determines what happens when a session is created while
+// the maximum number of sessions are already active.
+type SessionLimitPolicy int
+
+const (
+	// SessionLimitReject rejects the new session with ErrTooManySessions.
+	SessionLimitReject SessionLimitPolicy = iota
+	// SessionLimitEvict closes the oldest session which has not completed
+	// multi-factor authentication, firing a SESSION_EVICTED alert. If
+	// every session has completed multi-factor authentication, the new
+	// session is rejected with ErrTooManySessions.
+	SessionLimitEvict
 )
 
+func (p SessionLimitPolicy) String() string {
+	switch p {
+	case SessionLimitReject:
+		return "reject"
+	case SessionLimitEvict:
+		return "evict"
+	default:
+		return fmt.Sprintf("SessionLimitPolicy(%d)", int(p))
+	}
+}
+
+// WithMaxSessions limits the number of concurrent sessions to n, with policy
+// determining what happens when a session is created while n sessions are
+// active. By default, the number of sessions is not limited.
+func WithMaxSessions(n int, policy SessionLimitPolicy) Option {
+	return func(h *Handler) {
+		h.maxSessions = n
+		h.sessionLimitPolicy = policy
+	}
+}
+
+// WithMaxLifetime limits sessions to a lifetime of d from creation, after
+// which they expire even if they are still in use. By default, a session which
+// is used before its expiration timeout may last indefinitely.
+func WithMaxLifetime(d time.Duration) Option {
+	return func(h *Handler) { h.maxLifetime = d }
+}
+
+// WithSoftLock causes sessions which expire, or are locked with Session.Lock,
+// to be soft-locked for d. A soft-locked session is closed, dropping its store,
+// but the paths for which it completed multi-factor authentication are
+// remembered: if the same user logs in again with their passphrase from the
+// same client within d, the new session is multi-factor authenticated for the
+// same paths, as if the old session had continued. Only a hash of the
+// session's binding to its client is kept along with the paths, never any key
+// material. Sessions which reach the lifetime set by WithMaxLifetime are not
+// soft-locked. By default, sessions are simply closed.
+func WithSoftLock(d time.Duration) Option {
+	return func(h *Handler) { h.softLockGrace = d }
+}
+
+// freshMFADuration is how long multi-factor authentication lasts for paths
+// beneath the prefixes passed to WithAlwaysReauth. It is long enough to load
+// and act on the authenticated page, but no longer.
+const freshMFADuration = time.Minute
+
+// WithMFARemember causes multi-factor authentication for a path to be
+// remembered for d, after which the path requires a new assertion. The session
+// itself is unaffected. By default, authentication for a path is remembered
+// for the life of the session.
+func WithMFARemember(d time.Duration) Option {
+	return func(h *Handler) { h.mfaRemember = d }
+}
+
+// WithMaxMFAFailures causes a session to be closed, firing an MFA_LOCKOUT
+// alert, after n consecutive failed multi-factor authentication assertions.
+// The default is 5.
+func WithMaxMFAFailures(n int) Option {
+	return func(h *Handler) { h.maxMFAFailures = n }
+}
+
+// WithMaxMFARegistrationFailures causes a session to be closed, firing an
+// MFA_LOCKOUT alert, after n consecutive failed multi-factor authentication
+// device registrations. These are counted separately from failed assertions.
+// The default is 5.
+func WithMaxMFARegistrationFailures(n int) Option {
+	return func(h *Handler) { h.maxMFARegFailures = n }
+}
+
+// WithAlwaysReauth causes paths beneath the given prefixes (e.g. "/bank/") to
+// require a fresh multi-factor authentication assertion each time they are
+// visited, regardless of WithMFARemember: authentication for such paths is
+// remembered only briefly.
+func WithAlwaysReauth(prefixes ...string) Option {
+	return func(h *Handler) { h.alwaysReauthPrefixes = prefixes }
+}
+
+// WithOrigins allows MFA to be performed at the given origins, in addition to
+// the origin passed to NewHandler, e.g. by the browsers of sessions reaching
+// harpd via additional listeners (see Session.SetOrigin). Each origin must be
+// valid as that passed to NewHandler is, and usable with MFA devices
+// registered for its relying party ID (see CheckOrigin).
+func WithOrigins(origins ...string) Option {
+	return func(h *Handler) { h.extraOrigins = origins }
+}
+
+// Binding determines how strictly sessions are bound to the client that
+// created them, as identified by the client ID & fingerprint passed to
+// CreateSession.
+type Binding int
+
 const (
-	sessionIDLength = 32
-	alertTimeLimit  = 10 * time.Second
+	// BindingOff does not bind sessions to clients.
+	BindingOff Binding = iota
+	// BindingWarn fires an alert when a session is used by a client other
+	// than the one that created it, but allows the session to be used.
+	BindingWarn
+	// BindingEnforce fires an alert when a session is used by a client
+	// other than the one that created it, and treats the session as
+	// nonexistent for that client.
+	BindingEnforce
 )
 
-var (
-	ErrNoSession               = errors.New("no such session")
-	ErrNoChallenge             = errors.New("no current challenge")
-	ErrMFAAuthenticationFailed = errors.New("MFA authentication failed")
-	ErrMFARegistrationFailed   = errors.New("MFA registration failed")
-)
+// WithBinding causes sessions to be bound to the client that created them, as
+// specified by b. By default, sessions are not bound to clients.
+func WithBinding(b Binding) Option {
+	return func(h *Handler) {
+		h.binding = b
+	}
+}
+
+// WithShareDuration sets how long share tokens created by CreateShare remain
+// redeemable. By default, share tokens last 10 minutes.
+func WithShareDuration(d time.Duration) Option {
+	return func(h *Handler) {
+		h.shareDuration = d
+	}
+}
+
+// maxTamperProblems is the maximum number of problems described by a
+// STORE_TAMPER alert.
+const maxTamperProblems = 5
+
+// WithStoreVerification causes the store unlocked for each new session to be
+// verified, if it is a secret.VerifyStore, firing a STORE_TAMPER alert if any
+// problems are found. Sessions are created regardless.
+func WithStoreVerification() Option {
+	return func(h *Handler) {
+		h.verifyStores = true
+	}
+}
+
+// WithMetrics causes the handler to register metrics describing sessions,
+// authentication, and store operations in the given registry.
+func WithMetrics(r *metrics.Registry) Option {
+	return func(h *Handler) {
+		h.metrics = handlerMetrics{
+			sessionsCreated:  r.NewCounter("harpd_sessions_created_total", "Number of sessions created."),
+			wrongPassphrases: r.NewCounter("harpd_wrong_passphrases_total", "Number of login attempts with an incorrect passphrase."),
+			rateLimited:      r.NewCounter("harpd_rate_limit_rejections_total", "Number of login attempts rejected by the rate limiter."),
+			mfaFailures:      r.NewCounterVec("harpd_mfa_failures_total", "Number of failed multi-factor authentication attempts.", "reason"),
+			storeOps:         r.NewSummaryVec("harpd_store_operation_duration_seconds", "Duration of password store operations.", "op"),
+			storeErrors:      r.NewCounterVec("harpd_store_errors_total", "Number of failed password store operations.", "op"),
+		}
+		r.NewGaugeFunc("harpd_active_sessions", "Number of currently-active sessions.", func() float64 { return float64(h.ActiveSessionCount()) })
+	}
+}
+
+// WithDebugLog causes the handler to log details useful for diagnosing
+// failures, such as why an MFA assertion or registration was rejected (e.g. a
+// mismatched origin, or missing user verification). These details are only
+// logged, never shown to the user.
+func WithDebugLog() Option {
+	return func(h *Handler) {
+		h.debugLog = true
+	}
+}
+
+// Credential describes a registered MFA device.
+type Credential struct {
+	ID           string    // identifies the device; it is the base64url-encoded credential ID
+	Registration string    // registration blob, as passed to NewHandler
+	Label        string    // human-readable label given when the device was registered
+	RegisteredAt time.Time // time the device was registered; zero if it was imported from the config
+	AAGUID       string    // identifies the model of the device, formatted as a UUID; empty if the device did not report one
+}
+
+// account holds the vault & registered MFA devices of a user. A handler which
+// does not serve multiple users has a single, unnamed account.
+type account struct {
+	name  string         // name of the user; empty unless serving multiple users
+	vault secret.Vault   // locked password data; unused if the handler has mounts
+	creds *credentialSet // registered MFA devices; protected by h.mu
+}
+
+// newAccount creates an account with the given MFA device credentials, as
+// returned by Session.CompleteMFARegistration.
+func (h *Handler) newAccount(name string, vault secret.Vault, mfaCredentials []string) (*account, error) {
+	a := &account{name: name, vault: vault}
+	creds := make([]Credential, len(mfaCredentials))
+	for i, c := range mfaCredentials {
+		creds[i] = Credential{Registration: c}
+	}
+	cs, err := h.newCredentialSet(a, creds)
+	if err != nil {
+		return nil, err
+	}
+	a.creds = cs
+	return a, nil
+}
+
+// credentialSet is a set of registered MFA devices. It is never modified once
+// created: changing an account's devices replaces its set, so that a session
+// can use the set it started a challenge with without holding h.mu.
+type credentialSet struct {
+	list        []Credential                         // in registration order
+	byID        map[string]warp.Credential           // by encoded credential ID
+	descriptors []warp.PublicKeyCredentialDescriptor // in registration order
+}
+
+// newCredentialSet creates a set of the given account's MFA devices, parsing
+// each device's registration & filling in its ID.
+func (h *Handler) newCredentialSet(a *account, creds []Credential) (*credentialSet, error) {
+	cs := &credentialSet{byID: map[string]warp.Credential{}}
+	for i, c := range creds {
+		data, err := decodeCredential(c.Registration)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse registration %d: %w", i, err)
+		}
+		c.ID = base64.RawURLEncoding.EncodeToString(data.CredentialID)
+		if _, ok := cs.byID[c.ID]; ok {
+			return nil, fmt.Errorf("registration %d: MFA device %q is registered more than once", i, c.ID)
+		}
+		cs.list = append(cs.list, c)
+		cs.byID[c.ID] = credential{h, a, cs, data}
+		cs.descriptors = append(cs.descriptors, warp.PublicKeyCredentialDescriptor{
+			Type: warp.PublicKey,
+			ID:   data.CredentialID,
+		})
+	}
+	return cs, nil
+}
+
+// credentialsOf returns the current set of the given account's MFA devices.
+func (h *Handler) credentialsOf(a *account) *credentialSet {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return a.creds
+}
+
+type credential struct {
+	h   *Handler
+	a   *account
+	set *credentialSet // the set containing this credential
+	c   *warp.AttestedCredentialData
+}
+
+var _ warp.Credential = credential{}
+
+func (c credential) Owner() warp.User            { return user{c.a, c.set} }
+func (c credential) CredentialID() []byte        { return c.c.CredentialID }
+func (c credential) CredentialPublicKey() []byte { return c.c.CredentialPublicKey }
+func (c credential) CredentialSignCount() uint {
+	return uint(c.h.counters.Get(base64.RawURLEncoding.EncodeToString(c.c.CredentialID)))
+}
+
+// relyingParty is the relying party for MFA performed at the given origin,
+// which is the origin passed to NewHandler or one passed to WithOrigins.
+type relyingParty struct {
+	h      *Handler
+	origin string
+}
+
+var _ warp.RelyingParty = relyingParty{}
+
+func (rp relyingParty) EntityID() string   { return rp.h.domain }
+func (rp relyingParty) EntityName() string { return "Harpocrates" }
+func (rp relyingParty) EntityIcon() string { return fmt.Sprintf("%s/favicon.ico", rp.origin) }
+func (rp relyingParty) Origin() string     { return rp.origin }
+
+// parseOrigin checks that the given origin is one which browsers may use MFA
+// from, returning it in the canonical form in which browsers report it (with a
+// lowercase host name & no default port), along with its host name, which is
+// used as the relying party ID. The origin must be https, unless its host is
+// localhost, since browsers only allow MFA in secure contexts.
+func parseOrigin(origin string) (_, domain string, _ error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't parse origin: %w", err)
+	}
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	switch {
+	case host == "":
+		return "", "", fmt.Errorf("origin %q has no host", origin)
+	case strings.Contains(host, ":") && net.ParseIP(host) == nil:
+		return "", "", fmt.Errorf("origin %q has invalid host %q", origin, host)
+	case u.Scheme != "https" && !(u.Scheme == "http" && isLocalhost(host)):
+		return "", "", fmt.Errorf("origin %q must use https, unless its host is localhost", origin)
+	case !strings.EqualFold(origin, u.Scheme+"://"+u.Host):
+		return "", "", fmt.Errorf("origin %q may hold only a scheme, host & port (e.g. \"https://example.com:8443\")", origin)
+	case strings.HasSuffix(u.Host, ":"):
+		return "", "", fmt.Errorf("origin %q has an empty port", origin)
+	}
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return "", "", fmt.Errorf("origin %q has invalid port %q", origin, port)
+		}
+		if (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+			port = ""
+		}
+	}
+	canonical := host
+	if strings.Contains(host, ":") {
+		canonical = "[" + host + "]" // IPv6 literal
+	}
+	if port != "" {
+		canonical += ":" + port
+	}
+	return u.Scheme + "://" + canonical, host, nil
+}
+
+// isLocalhost determines if the given host name refers to the local machine.
+func isLocalhost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// CheckOrigin checks that MFA devices registered at mainOrigin, as passed to
+// NewHandler, can be used at the given origin, as WithOrigins requires.
+// Browsers only allow a device to be used at origins whose host is the
+// relying party ID for which it was registered (mainOrigin's host name), or
+// a subdomain of it.
+func CheckOrigin(mainOrigin, origin string) error {
+	_, domain, err := parseOrigin(mainOrigin)
+	if err != nil {
+		return err
+	}
+	_, err = checkOrigin(domain, origin)
+	return err
+}
+
+// checkOrigin implements CheckOrigin for the given relying party ID,
+// returning the origin in canonical form.
+func checkOrigin(domain, origin string) (string, error) {
+	canonical, host, err := parseOrigin(origin)
+	if err != nil {
+		return "", err
+	}
+	if host != domain && (net.ParseIP(domain) != nil || !strings.HasSuffix(host, "."+domain)) {
+		return "", fmt.Errorf("origin %q can't use MFA devices, which are registered for relying party ID %q: its host must be %q or a subdomain of it", origin, domain, domain)
+	}
+	return canonical, nil
+}
+
+// RelyingPartyID returns the relying party ID for which MFA devices are
+// registered: the host name of the origin passed to NewHandler.
+func (h *Handler) RelyingPartyID() string { return h.domain }
+
+// Origin returns the origin at which browsers must reach harpd for MFA to
+// succeed: the origin passed to NewHandler, in canonical form. (Sessions may
+// perform MFA at other origins; see Session.SetOrigin.)
+func (h *Handler) Origin() string { return h.origin }
+
+// mfaOrigin returns the given origin, which must be one passed to WithOrigins
+// or empty for the origin passed to NewHandler, in canonical form.
+func (h *Handler) mfaOrigin(origin string) (string, error) {
+	if origin == "" {
+		return h.origin, nil
+	}
+	canonical, _, err := parseOrigin(origin)
+	if err != nil {
+		return "", err
+	}
+	if canonical != h.origin && !h.origins[canonical] {
+		return "", fmt.Errorf("origin %q was not passed to WithOrigins", origin)
+	}
+	return canonical, nil
+}
+
+// debugf logs the given message if the handler was created WithDebugLog.
+func (h *Handler) debugf(format string, v ...interface{}) {
+	if h.debugLog {
+		log.Printf("[debug] "+format, v...)
+	}
+}
+
+// user is an account, along with the set of its MFA devices which may be used
+// for a registration or assertion.
+type user struct {
+	a     *account
+	creds *credentialSet
+}
+
+var _ warp.User = user{}
+
+func (u user) EntityName() string {
+	if u.a.name == "" {
+		return "Harpocrates User"
+	}
+	return u.a.name
+}
+func (u user) EntityIcon() string { return "" }
+func (u user) EntityID() []byte {
+	if u.a.name == "" {
+		return []byte{0}
+	}
+	id := sha256.Sum256([]byte(u.a.name))
+	return id[:]
+}
+func (u user) EntityDisplayName() string               { return u.EntityName() }
+func (u user) Credentials() map[string]warp.Credential { return u.creds.byID }
+
+// NewHandler creates a new session handler.
+func NewHandler(vault secret.Vault, origin string, mfaCredentials []string, counters *counter.Store, sessionDuration time.Duration, newSessionRate float64, alerter alert.Alerter, opts ...Option) (*Handler, error) {
+	if sessionDuration <= 0 {
+		return nil, errors.New("nonpositive session length")
+	}
+
+	origin, domain, err := parseOrigin(origin)
+	if err != nil {
+		return nil, err
+	}
+	if u, _ := url.Parse(origin); u.Port() != "" {
+		log.Printf("MFA origin %q includes a port: browsers must reach harpd at exactly this origin for MFA to succeed, and MFA devices are registered for relying party ID %q, regardless of port", origin, domain)
+	}
+
+	h := &Handler{
+		sessions:        map[string]*Session{},
+		pending:         map[string]*PendingSession{},
+		shares:          map[string]*share{},
+		apiSessions:     map[string]*Session{},
+		challenges:      map[string]*passwordlessChallenge{},
+		tombstones:      map[[sha256.Size]byte]*tombstone{},
+		sessionDuration: sessionDuration,
+		origin:          origin,
+		domain:          domain,
+		counters:        counters,
+		newSessionBurst: 1,
+		clock:           systemClock{},
+		alerter:         alerter,
+		shareDuration:   defaultShareDuration,
+
+		maxMFAFailures:    defaultMaxMFAFailures,
+		maxMFARegFailures: defaultMaxMFAFailures,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.origins = map[string]bool{}
+	for _, o := range h.extraOrigins {
+		canonical, err := checkOrigin(domain, o)
+		if err != nil {
+			return nil, err
+		}
+		h.origins[canonical] = true
+	}
+	if h.shareDuration <= 0 {
+		return nil, errors.New("nonpositive share duration")
+	}
+	if h.newSessionBurst <= 0 {
+		return nil, errors.New("nonpositive new session burst")
+	}
+	if h.maxSessions < 0 {
+		return nil, errors.New("negative maximum session count")
+	}
+	if h.maxMFAFailures <= 0 || h.maxMFARegFailures <= 0 {
+		return nil, errors.New("nonpositive maximum MFA failure count")
+	}
+	h.rateLimiter = rate.NewTokenBucketLimiter(newSessionRate, h.newSessionBurst, 1, rate.WithPenalty(loginPenalty, maxLoginPenalty))
+
+	if len(h.users) == 0 {
+		a, err := h.newAccount("", vault, mfaCredentials)
+		if err != nil {
+			return nil, err
+		}
+		h.accounts = []*account{a}
+		if err := h.loadCredentials(); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	if len(h.mounts) > 0 {
+		return nil, errors.New("users may not be combined with mounts")
+	}
+	if h.apiTokens != nil {
+		return nil, errors.New("users may not be combined with API tokens")
+	}
+	names := map[string]bool{}
+	for _, u := range h.users {
+		if u.Name == "" || names[u.Name] {
+			return nil, fmt.Errorf("empty or duplicate user name %q", u.Name)
+		}
+		names[u.Name] = true
+		a, err := h.newAccount(u.Name, u.Vault, u.MFACredentials)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Name, err)
+		}
+		h.accounts = append(h.accounts, a)
+	}
+	if err := h.loadCredentials(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// CreateSession attempts to create a new session, using the given passphrase.
+// It returns the new session's ID and the session, or
+// secret.ErrWrongPassphrase if an authentication error occurs, and other
+// errors if they occur. The client ID (e.g. IP address) and fingerprint (e.g.
+// user agent) identify the client creating the session; the session may be
+// bound to them, depending on the handler's Binding.
+func (h *Handler) CreateSession(clientID, fingerprint, passphrase string) (string, *Session, error) {
+	return h.CreateUserSession(clientID, fingerprint, "", passphrase)
+}
+
+// CreateUserSession is like CreateSession, but creates a session for the user
+// with the given name, if the handler serves multiple users (see WithUsers).
+// If userName is empty, each user's vault is tried in turn, and the session is
+// bound to the first user whose vault the passphrase unlocks. userName is
+// ignored if the handler does not serve multiple users.
+func (h *Handler) CreateUserSession(clientID, fingerprint, userName, passphrase string) (string, *Session, error) {
+	return h.CreateUserSessionWith(clientID, fingerprint, userName, passphrase, nil)
+}
+
+// CreateUserSessionWith is like CreateUserSession, but also unlocks vaults
+// with the given external secret (see secret.ExternalSecretVault), such as the
+// output of an MFA device's hmac-secret extension. If extra is empty, the
+// external secret configured by WithExternalSecret, if any, is used instead.
+func (h *Handler) CreateUserSessionWith(clientID, fingerprint, userName, passphrase string, extra []byte) (string, *Session, error) {
+	if err := h.waitForRateLimit(clientID); err != nil {
+		return "", nil, err
+	}
+	acct, store, unlocked, err := h.unlock(userName, passphrase, extra)
+	sess, err := h.unlockedSession(acct, store, unlocked, err, clientID, fingerprint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sessID, err := h.newSessionIDLocked()
+	if err != nil {
+		sess.release()
+		return "", nil, err
+	}
+	if err := h.addSessionLocked(sessID, sess); err != nil {
+		sess.release()
+		return "", nil, err
+	}
+	h.restoreLocked(sess)
+	return sessID, sess, nil
+}
+
+// CreateSessionAsync is like CreateSession, but unlocks the vault in the
+// background rather than blocking until the session is created, which may
+// take several seconds with expensive key derivation parameters. It returns
+// the ID the session will have, and a PendingSession tracking its creation.
+// Until then, the pending session can be found by passing the ID to
+// LookupPendingSessionFor; once created, the session can be found as usual.
+// Errors which occur before unlocking starts, such as rate.ErrTooManyEvents,
+// are returned directly.
+func (h *Handler) CreateSessionAsync(clientID, fingerprint, passphrase string) (string, *PendingSession, error) {
+	return h.CreateUserSessionAsync(clientID, fingerprint, "", passphrase)
+}
+
+// CreateUserSessionAsync is like CreateSessionAsync, but creates a session for
+// the user with the given name, as CreateUserSession does.
+func (h *Handler) CreateUserSessionAsync(clientID, fingerprint, userName, passphrase string) (string, *PendingSession, error) {
+	return h.CreateUserSessionAsyncWith(clientID, fingerprint, userName, passphrase, nil)
+}
+
+// CreateUserSessionAsyncWith is like CreateUserSessionAsync, but also unlocks
+// vaults with the given external secret, as CreateUserSessionWith does.
+func (h *Handler) CreateUserSessionAsyncWith(clientID, fingerprint, userName, passphrase string, extra []byte) (string, *PendingSession, error) {
+	if err := h.waitForRateLimit(clientID); err != nil {
+		return "", nil, err
+	}
+	return h.createSessionAsync(clientID, fingerprint, userName, passphrase, extra, true)
+}
+
+// createSessionAsync implements CreateUserSessionAsyncWith, once the client
+// has waited for the rate limiter. If restore is set, the session restores the
+// multi-factor authentication of the client's soft-locked session, if any.
+func (h *Handler) createSessionAsync(clientID, fingerprint, userName, passphrase string, extra []byte, restore bool) (string, *PendingSession, error) {
+	p := &PendingSession{clientID: clientID, fingerprint: fingerprint, restore: restore, done: make(chan struct{})}
+	h.mu.Lock()
+	sessID, err := h.newSessionIDLocked()
+	if err != nil {
+		h.mu.Unlock()
+		return "", nil, err
+	}
+	h.pending[sessID] = p
+	h.mu.Unlock()
+
+	// A single vault may be able to report its progress; mounted vaults, or
+	// the vaults of several users, are unlocked in turn, without reporting
+	// progress.
+	unlock := func() (*account, secret.Store, map[string]bool, error) { return h.unlock(userName, passphrase, extra) }
+	if accts := h.accountsFor(userName); len(h.mounts) == 0 && len(accts) == 1 {
+		acct := accts[0]
+		uh, err := secret.UnlockAsyncWith(acct.vault, passphrase, h.externalSecretFor(extra))
+		if err != nil {
+			h.mu.Lock()
+			delete(h.pending, sessID)
+			h.mu.Unlock()
+			return "", nil, fmt.Errorf("couldn't unlock vault: %w", err)
+		}
+		p.unlock = uh
+		unlock = func() (*account, secret.Store, map[string]bool, error) {
+			store, err := uh.Result()
+			return acct, store, nil, err
+		}
+	}
+
+	go func() {
+		acct, store, unlocked, err := unlock()
+		sess, err := h.unlockedSession(acct, store, unlocked, err, clientID, fingerprint)
+		h.finishPending(sessID, p, sess, err)
+	}()
+	return sessID, p, nil
+}
+
+// CreatePasswordlessSessionAsync is like CreateSessionAsync, but unlocks the
+// vault with the passphrase wrapped by the MFA device which made the given
+// assertion (see Session.EnablePasswordlessUnlock), in answer to a challenge
+// from GeneratePasswordlessChallenge, using the given output of the device's
+// PRF extension. Logins are rate limited as passphrase logins are. It returns
+// ErrNoChallenge if the assertion does not answer an outstanding challenge,
+// ErrMFACounterRegression if the device's signature counter did not increase,
+// and ErrMFAAuthenticationFailed if the assertion is not accepted or the PRF
+// output does not unwrap a passphrase; these count as failed logins. The
+// assertion must have been made at the given origin, which must be one passed
+// to WithOrigins, or empty for the origin passed to NewHandler.
+//
+// A device which holds the user's passphrase is a single factor, so the
+// session must still complete multi-factor authentication as usual, even if
+// the client has a soft-locked session (see WithSoftLock).
+func (h *Handler) CreatePasswordlessSessionAsync(clientID, fingerprint, origin string, cred *warp.AssertionPublicKeyCredential, prfOutput []byte) (string, *PendingSession, error) {
+	if h.passwordless == nil {
+		return "", nil, errors.New("passwordless login is not enabled")
+	}
+	origin, err := h.mfaOrigin(origin)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := h.waitForRateLimit(clientID); err != nil {
+		return "", nil, err
+	}
+	userName, passphrase, err := h.unwrapPassphrase(origin, cred, prfOutput)
+	if errors.Is(err, ErrMFAAuthenticationFailed) || errors.Is(err, ErrMFACounterRegression) {
+		h.rateLimiter.Penalize(clientID)
+		h.recordFailedLogin(clientID)
+		return "", nil, err
+	} else if err != nil {
+		return "", nil, err
+	}
+	return h.createSessionAsync(clientID, fingerprint, userName, passphrase, nil, false)
+}
+
+// unwrapPassphrase verifies an assertion answering a passwordless login
+// challenge at the given origin, returning the name of the user whose MFA
+// device made it & the passphrase wrapped by the device. The challenge can't
+// be answered again.
+func (h *Handler) unwrapPassphrase(origin string, cred *warp.AssertionPublicKeyCredential, prfOutput []byte) (string, string, error) {
+	opts, err := h.takePasswordlessChallenge(cred)
+	if err != nil {
+		return "", "", err
+	}
+	credID := base64.RawURLEncoding.EncodeToString(cred.RawID)
+	pp, err := h.passwordless.Lookup(credID)
+	if err != nil {
+		h.metrics.mfaFailures.With("failed").Inc()
+		return "", "", ErrMFAAuthenticationFailed
+	}
+	a := h.accountNamed(pp.User)
+	if a == nil {
+		h.metrics.mfaFailures.With("failed").Inc()
+		return "", "", ErrMFAAuthenticationFailed
+	}
+	if err := h.finishAuthentication(a, origin, h.credentialsOf(a), opts, cred); err != nil {
+		return "", "", err
+	}
+	userName, passphrase, err := h.passwordless.Unwrap(credID, prfOutput)
+	if errors.Is(err, passwordless.ErrNoPassphrase) {
+		h.metrics.mfaFailures.With("failed").Inc()
+		return "", "", ErrMFAAuthenticationFailed
+	} else if err != nil {
+		return "", "", fmt.Errorf("couldn't unwrap passphrase: %w", err)
+	}
+	return userName, passphrase, nil
+}
+
+// waitForRateLimit waits until the given client may attempt to create a
+// session, according to the new session rate limit.
+func (h *Handler) waitForRateLimit(clientID string) error {
+	if err := h.rateLimiter.Wait(clientID); err != nil {
+		if errors.Is(err, rate.ErrTooManyEvents) {
+			h.metrics.rateLimited.Inc()
+			return err
+		}
+		return fmt.Errorf("couldn't wait for rate limiter: %w", err)
+	}
+	return nil
+}
+
+// unlockedSession creates a new session for the given client from the result
+// of unlocking the given account's vault. The session has no ID, and its
+// expiration timer is not started.
+func (h *Handler) unlockedSession(acct *account, store secret.Store, unlocked map[string]bool, err error, clientID, fingerprint string) (*Session, error) {
+	if errors.Is(err, secret.ErrWrongPassphrase) {
+		h.rateLimiter.Penalize(clientID)
+		h.metrics.wrongPassphrases.Inc()
+		h.recordFailedLogin(clientID)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't unlock vault: %w", err)
+	}
+	if h.authLog != nil {
+		if err := h.authLog.RecordSuccess(clientID, h.clock.Now()); err != nil {
+			log.Printf("Could not record successful login: %v", err)
+		}
+	}
+	if h.verifyStores {
+		h.verifyStore(acct, store)
+	}
+	store, release := h.wrapStore(store)
+	sess, err := h.newSession(acct, store, release, unlocked, clientID, fingerprint)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// verifyStore verifies the store unlocked from the given account's vault, if
+// it is a secret.VerifyStore, firing a STORE_TAMPER alert if any problems are
+// found.
+func (h *Handler) verifyStore(acct *account, store secret.Store) {
+	vs, ok := secret.AsVerifyStore(store)
+	if !ok {
+		return
+	}
+	ps, err := vs.Verify()
+	if err != nil {
+		log.Printf("Could not verify password store: %v", err)
+		return
+	}
+	if len(ps) == 0 {
+		return
+	}
+	details := fmt.Sprintf("Password store failed verification with %d problems: %s", len(ps), strings.Join(ps, "; "))
+	if len(ps) > maxTamperProblems {
+		details = fmt.Sprintf("Password store failed verification with %d problems: %s; ...", len(ps), strings.Join(ps[:maxTamperProblems], "; "))
+	}
+	h.userAlert(acct.name, alert.STORE_TAMPER, details)
+}
+
+// addSessionLocked adds a session, as returned by newSession, to the handler
+// under the given ID, making room for it if necessary, and starts its
+// expiration timer. h.mu must be held.
+func (h *Handler) addSessionLocked(sessID string, sess *Session) error {
+	if err := h.makeRoomLocked(); err != nil {
+		return err
+	}
+	sess.id = sessID
+	h.startExpirationTimer(sess)
+	h.sessions[sessID] = sess
+	h.metrics.sessionsCreated.Inc()
+	return nil
+}
+
+// startExpirationTimer starts the expiration timer of a session which is being
+// added to the handler.
+func (h *Handler) startExpirationTimer(sess *Session) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.expirationTimer = h.clock.AfterFunc(sess.expiresAt.Sub(h.clock.Now()), func() { h.lockSession(sess) })
+}
+
+// finishPending completes the creation of a pending session, given the
+// session created (or the error which prevented its creation), adding the
+// session to the handler under its reserved ID.
+func (h *Handler) finishPending(sessID string, p *PendingSession, sess *Session, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer close(p.done)
+	if err == nil && h.pending[sessID] != p {
+		// The handler was shut down while the vault was being unlocked.
+		err = ErrNoSession
+	}
+	if err == nil {
+		err = h.addSessionLocked(sessID, sess)
+	}
+	if err != nil {
+		if sess != nil {
+			sess.release()
+		}
+		p.err = err
+		if h.pending[sessID] == p {
+			h.clock.AfterFunc(pendingResultDuration, func() {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				if h.pending[sessID] == p {
+					delete(h.pending, sessID)
+				}
+			})
+		}
+		return
+	}
+	delete(h.pending, sessID)
+	if p.restore {
+		h.restoreLocked(sess)
+	}
+	p.sess = sess
+}
+
+// LookupPendingSessionFor gets a pending session, as created by
+// CreateSessionAsync, by the ID it will have. It returns ErrNoSession if there
+// is no such pending session, or if the handler's Binding is enforced & the
+// pending session was created by a different client. A pending session whose
+// creation has failed is returned only once.
+func (h *Handler) LookupPendingSessionFor(sessionID, clientID, fingerprint string) (*PendingSession, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.pending[sessionID]
+	if p == nil || (h.binding == BindingEnforce && (p.clientID != clientID || p.fingerprint != fingerprint)) {
+		return nil, ErrNoSession
+	}
+	select {
+	case <-p.done:
+		delete(h.pending, sessionID)
+	default:
+	}
+	return p, nil
+}
+
+// wrapStore wraps a store unlocked for a new session as configured: with
+// instrumentation, caching, reuse & expiry tracking & read-only restrictions. It returns
+// the wrapped store, and a function which stops watching the store for changes
+// and wipes the unlocked store's key material, if it is a secret.WipeStore.
+func (h *Handler) wrapStore(store secret.Store) (secret.Store, func()) {
+	wipe := func() {}
+	if ws, ok := secret.AsWipeStore(store); ok {
+		wipe = ws.Wipe
+	}
+	if h.metrics.storeOps != nil {
+		store = instrumentedStore{store, h.metrics.storeOps, h.metrics.storeErrors}
+	}
+	stopWatch := func() {}
+	if h.storeCacheTTL > 0 {
+		cs := secret.NewCachingStore(store, h.storeCacheTTL, h.storeCacheMaxEntries)
+		stopWatch = invalidateOnChange(cs)
+		store = cs
+	}
+	release := func() {
+		stopWatch()
+		wipe()
+	}
+	store = audit.NewReuseTracker(store)
+	store = audit.NewExpiryTracker(store, expiryIndexMaxAge)
+	if h.readOnly {
+		store = secret.NewReadOnlyStore(store, h.readOnlyPrefixes...)
+	}
+	return store, release
+}
+
+// newSession creates a new session for the given account using the given
+// store, as returned by wrapStore. The session has no ID, and its expiration
+// timer is not started.
+func (h *Handler) newSession(acct *account, store secret.Store, release func(), unlocked map[string]bool, clientID, fingerprint string) (*Session, error) {
+	var csrfToken [csrfTokenLength]byte
+	if _, err := rand.Read(csrfToken[:]); err != nil {
+		return nil, fmt.Errorf("couldn't generate CSRF token: %w", err)
+	}
+	var publicID [publicIDLength]byte
+	if _, err := rand.Read(publicID[:]); err != nil {
+		return nil, fmt.Errorf("couldn't generate public session ID: %w", err)
+	}
+	now := h.clock.Now()
+	sess := &Session{
+		h:            h,
+		acct:         acct,
+		publicID:     base64.RawURLEncoding.EncodeToString(publicID[:]),
+		store:        store,
+		csrfToken:    base64.RawURLEncoding.EncodeToString(csrfToken[:]),
+		clientID:     clientID,
+		fingerprint:  fingerprint,
+		unlocked:     unlocked,
+		createdAt:    now,
+		lastActiveAt: now,
+		release:      release,
+		authedPaths:  map[string]time.Time{},
+	}
+	if h.maxLifetime > 0 {
+		sess.deadline = now.Add(h.maxLifetime)
+	}
+	sess.expiresAt = sess.nextExpiry(now)
+	return sess, nil
+}
+
+// SoftLockEnabled determines if sessions are soft-locked, via WithSoftLock.
+func (h *Handler) SoftLockEnabled() bool { return h.softLockGrace > 0 }
+
+// MultiUser determines if the handler serves multiple users, via WithUsers.
+func (h *Handler) MultiUser() bool { return len(h.users) > 0 }
+
+// APITokensEnabled determines if API tokens are enabled, via WithAPITokens.
+func (h *Handler) APITokensEnabled() bool { return h.apiTokens != nil }
+
+// APITokens returns a description of each API token, oldest first. It returns
+// nil if API tokens are not enabled.
+func (h *Handler) APITokens() []apitoken.Token {
+	if h.apiTokens == nil {
+		return nil
+	}
+	return h.apiTokens.List()
+}
+
+// GetAPITokenSession gets the session for the given API token, as created by
+// Session.CreateAPIToken, unlocking the vault with the passphrase granted by
+// the token if the token has no active session. The session's store is
+// restricted to the token's prefixes, and is read-only if the token is. The
+// session is considered multi-factor authenticated for every path, and
+// expires as other sessions do if it is not used. It returns ErrNoSession if
+// API tokens are not enabled, or if the token is invalid or has been revoked;
+// invalid tokens are recorded as failed logins by the given client.
+func (h *Handler) GetAPITokenSession(token, clientID string) (*Session, error) {
+	if h.apiTokens == nil {
+		return nil, ErrNoSession
+	}
+	tok, passphrase, err := h.apiTokens.Authenticate(token)
+	if errors.Is(err, apitoken.ErrNoToken) {
+		h.recordFailedLogin(clientID)
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't authenticate API token: %w", err)
+	}
+
+	h.mu.RLock()
+	sess := h.apiSessions[tok.ID]
+	h.mu.RUnlock()
+	if sess != nil && sess.Touch() == nil {
+		return sess, nil
+	}
+
+	// There is no active session for this token; create one.
+	acct, store, unlocked, err := h.unlock("", passphrase, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unlock vault with API token %q: %w", tok.Name, err)
+	}
+	store, release := h.wrapStore(store)
+	if len(tok.Prefixes) > 0 {
+		store = secret.NewPrefixStore(store, tok.Prefixes...)
+	}
+	if tok.ReadOnly {
+		store = secret.NewReadOnlyStore(store)
+	}
+	sess, err = h.newSession(acct, store, release, unlocked, clientID, "")
+	if err != nil {
+		release()
+		return nil, err
+	}
+	sess.apiTokenID = tok.ID
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.apiTokens.Exists(tok.ID) {
+		// The token was revoked while the vault was being unlocked.
+		release()
+		return nil, ErrNoSession
+	}
+	if old := h.apiSessions[tok.ID]; old != nil {
+		h.removeAPISessionLocked(old)
+	}
+	h.startExpirationTimer(sess)
+	h.apiSessions[tok.ID] = sess
+	return sess, nil
+}
+
+// RevokeAPIToken revokes the API token with the given ID, closing its session
+// if it has one, and fires an API_TOKEN_REVOKED alert. It returns
+// apitoken.ErrNoToken if there is no such token.
+func (h *Handler) RevokeAPIToken(id string) error {
+	if h.apiTokens == nil {
+		return apitoken.ErrNoToken
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tok, err := h.apiTokens.Revoke(id)
+	if err != nil {
+		return err
+	}
+	if sess := h.apiSessions[id]; sess != nil {
+		h.removeAPISessionLocked(sess)
+	}
+	h.alert(alert.API_TOKEN_REVOKED, fmt.Sprintf("API token %q revoked.", tok.Name))
+	return nil
+}
+
+// TrustedDevicesEnabled determines if devices can be trusted, via
+// WithTrustedDevices.
+func (h *Handler) TrustedDevicesEnabled() bool { return h.devices != nil }
+
+// TrustedDeviceLifetime returns how long devices are trusted for, or zero if
+// trusted devices are not enabled.
+func (h *Handler) TrustedDeviceLifetime() time.Duration {
+	if h.devices == nil {
+		return 0
+	}
+	return h.devices.Lifetime()
+}
+
+// TrustedDevices returns a description of each device trusted by the user
+// with the given name, oldest first. userName is ignored if the handler does
+// not serve multiple users. It returns nil if trusted devices are not enabled,
+// or if there is no such user.
+func (h *Handler) TrustedDevices(userName string) []device.Device {
+	a := h.accountNamed(userName)
+	if h.devices == nil || a == nil {
+		return nil
+	}
+	var devs []device.Device
+	for _, d := range h.devices.List(h.clock.Now()) {
+		if d.User == a.name {
+			devs = append(devs, d)
+		}
+	}
+	return devs
+}
+
+// RevokeTrustedDevice revokes the device with the given ID, trusted by the
+// user with the given name, and fires a DEVICE_REVOKED alert. Sessions from
+// the device must complete multi-factor authentication for any further pages
+// they visit. It returns device.ErrNoDevice if the user has trusted no such
+// device.
+func (h *Handler) RevokeTrustedDevice(userName, id string) error {
+	a := h.accountNamed(userName)
+	if h.devices == nil || a == nil {
+		return device.ErrNoDevice
+	}
+	// Users may only revoke their own devices.
+	owned := false
+	for _, d := range h.TrustedDevices(userName) {
+		if d.ID == id {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		return device.ErrNoDevice
+	}
+	d, err := h.devices.Revoke(id)
+	if err != nil {
+		return err
+	}
+	h.userAlert(a.name, alert.DEVICE_REVOKED, fmt.Sprintf("Trusted device %q revoked.", d.Label))
+	return nil
+}
+
+// PasswordlessEnabled determines if users can log in with an MFA device in
+// place of their passphrase, via WithPasswordlessUnlock.
+func (h *Handler) PasswordlessEnabled() bool { return h.passwordless != nil }
+
+// passwordlessChallenge is an outstanding passwordless login challenge.
+type passwordlessChallenge struct {
+	opts      *warp.PublicKeyCredentialRequestOptions
+	expiresAt time.Time
+}
+
+// GeneratePasswordlessChallenge generates a new challenge with which a client
+// without a session can log in via CreatePasswordlessSessionAsync. Any MFA
+// device holding a discoverable credential for this server can answer it; the
+// device must verify its user, and is asked for the output of its PRF
+// extension. Each challenge can be answered once, within a few minutes. It
+// returns ErrTooManySessions if too many challenges are outstanding.
+func (h *Handler) GeneratePasswordlessChallenge() (*warp.PublicKeyCredentialRequestOptions, error) {
+	if h.passwordless == nil {
+		return nil, errors.New("passwordless login is not enabled")
+	}
+	opts, err := warp.StartAuthentication(warp.RelyingPartyID(h.domain), warp.UserVerification(warp.VerificationRequired), warp.Extensions(prfEval))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate passwordless challenge: %w", err)
+	}
+	now := h.clock.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c, pc := range h.challenges {
+		if !now.Before(pc.expiresAt) {
+			delete(h.challenges, c)
+		}
+	}
+	if len(h.challenges) >= maxPasswordlessChallenges {
+		return nil, ErrTooManySessions
+	}
+	h.challenges[base64.RawURLEncoding.EncodeToString(opts.Challenge)] = &passwordlessChallenge{opts, now.Add(passwordlessChallengeDuration)}
+	return opts, nil
+}
+
+// takePasswordlessChallenge returns the outstanding passwordless login
+// challenge answered by the given assertion, so that it can't be answered
+// again. It returns ErrNoChallenge if there is no such challenge, or if the
+// challenge has expired.
+func (h *Handler) takePasswordlessChallenge(cred *warp.AssertionPublicKeyCredential) (*warp.PublicKeyCredentialRequestOptions, error) {
+	// The challenge is verified along with the rest of the assertion; it is
+	// only used here to find the options it was issued with.
+	var cd struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(cred.Response.ClientDataJSON, &cd); err != nil {
+		return nil, ErrNoChallenge
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pc, ok := h.challenges[strings.TrimRight(cd.Challenge, "=")]
+	if !ok {
+		return nil, ErrNoChallenge
+	}
+	delete(h.challenges, strings.TrimRight(cd.Challenge, "="))
+	if !h.clock.Now().Before(pc.expiresAt) {
+		return nil, ErrNoChallenge
+	}
+	return pc.opts, nil
+}
+
+// PasswordlessDevices returns a description of each passphrase wrapped by an
+// MFA device of the user with the given name, oldest first. userName is
+// ignored if the handler does not serve multiple users. It returns nil if
+// passwordless login is not enabled, or if there is no such user.
+func (h *Handler) PasswordlessDevices(userName string) []passwordless.Passphrase {
+	a := h.accountNamed(userName)
+	if h.passwordless == nil || a == nil {
+		return nil
+	}
+	var ps []passwordless.Passphrase
+	for _, p := range h.passwordless.List() {
+		if p.User == a.name {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// DisablePasswordlessUnlock forgets the passphrase wrapped by the MFA device
+// with the given ID, registered for the user with the given name, and fires a
+// PASSWORDLESS_DISABLED alert. The device remains registered, but can no
+// longer log in in place of the passphrase. It returns
+// passwordless.ErrNoPassphrase if the user's device wraps no passphrase.
+func (h *Handler) DisablePasswordlessUnlock(userName, id string) error {
+	a := h.accountNamed(userName)
+	if h.passwordless == nil || a == nil {
+		return passwordless.ErrNoPassphrase
+	}
+	// Users may only disable their own devices.
+	if p, err := h.passwordless.Lookup(id); err != nil || p.User != a.name {
+		return passwordless.ErrNoPassphrase
+	}
+	if _, err := h.passwordless.Remove(id); err != nil {
+		return err
+	}
+	h.userAlert(a.name, alert.PASSWORDLESS_DISABLED, fmt.Sprintf("Passwordless login disabled for MFA device %q.", h.credentialLabel(a, id)))
+	return nil
+}
+
+// credentialLabel returns the label of the given account's MFA device with
+// the given ID, or its ID if it has no label.
+func (h *Handler) credentialLabel(a *account, id string) string {
+	for _, c := range h.credentialsOf(a).list {
+		if c.ID == id && c.Label != "" {
+			return c.Label
+		}
+	}
+	return id
+}
+
+// ManagesCredentials determines if registered MFA devices are persisted, via
+// WithCredentialFile, so that they can be added & removed.
+func (h *Handler) ManagesCredentials() bool { return h.credentialFile != "" }
+
+// Credentials returns a description of each MFA device registered for the user
+// with the given name, in the order they were registered. userName is ignored
+// if the handler does not serve multiple users. It returns nil if there is no
+// such user.
+func (h *Handler) Credentials(userName string) []Credential {
+	a := h.accountNamed(userName)
+	if a == nil {
+		return nil
+	}
+	return append([]Credential(nil), h.credentialsOf(a).list...)
+}
+
+// AddCredential registers an MFA device, such as one given in a previous
+// version of the config, for the user with the given name, and fires an
+// MFA_DEVICE_ADDED alert. userName is ignored if the handler does not serve
+// multiple users. The device can be used to authenticate as soon as
+// AddCredential returns. It returns ErrCredentialsNotPersisted if
+// WithCredentialFile was not specified.
+func (h *Handler) AddCredential(userName string, c Credential) error {
+	if h.credentialFile == "" {
+		return ErrCredentialsNotPersisted
+	}
+	a := h.accountNamed(userName)
+	if a == nil {
+		return fmt.Errorf("no user %q", userName)
+	}
+	return h.addCredential(a, c)
+}
+
+// addCredential adds an MFA device to the given account's devices, persisting
+// it if WithCredentialFile was specified, and fires an MFA_DEVICE_ADDED alert.
+// The device is usable by challenges generated by any session once
+// addCredential returns.
+func (h *Handler) addCredential(a *account, c Credential) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	creds := append(append([]Credential(nil), a.creds.list...), c)
+	cs, err := h.newCredentialSet(a, creds)
+	if err != nil {
+		return err
+	}
+	if h.credentialFile == "" {
+		a.creds = cs
+	} else if err := h.setCredentialsLocked(a, cs); err != nil {
+		return err
+	}
+	h.userAlert(a.name, alert.MFA_DEVICE_ADDED, fmt.Sprintf("MFA device %q registered.", c.Label))
+	return nil
+}
+
+// RemoveCredential removes the registered MFA device with the given ID from
+// the user with the given name, and fires an MFA_DEVICE_REMOVED alert. userName
+// is ignored if the handler does not serve multiple users. The device can no
+// longer be used to authenticate once RemoveCredential returns, though
+// sessions it has already authenticated are unaffected. Any passphrase it
+// wraps for passwordless login is forgotten. It returns ErrNoCredential if
+// the user has no such device, and
+// ErrCredentialsNotPersisted if WithCredentialFile was not specified.
+func (h *Handler) RemoveCredential(userName, id string) error {
+	if h.credentialFile == "" {
+		return ErrCredentialsNotPersisted
+	}
+	a := h.accountNamed(userName)
+	if a == nil {
+		return ErrNoCredential
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var creds []Credential
+	var removed *Credential
+	for i, c := range a.creds.list {
+		if c.ID == id {
+			removed = &a.creds.list[i]
+			continue
+		}
+		creds = append(creds, c)
+	}
+	if removed == nil {
+		return ErrNoCredential
+	}
+	cs, err := h.newCredentialSet(a, creds)
+	if err != nil {
+		return err
+	}
+	// The device's wrapped passphrase is forgotten first, so that a failure
+	// can't leave a passphrase for a device which is no longer registered.
+	if h.passwordless != nil {
+		if _, err := h.passwordless.Remove(id); err != nil && !errors.Is(err, passwordless.ErrNoPassphrase) {
+			return fmt.Errorf("couldn't forget wrapped passphrase: %w", err)
+		}
+	}
+	if err := h.setCredentialsLocked(a, cs); err != nil {
+		return err
+	}
+	h.userAlert(a.name, alert.MFA_DEVICE_REMOVED, fmt.Sprintf("MFA device %q removed.", removed.Label))
+	return nil
+}
+
+// accountNamed returns the account of the user with the given name, or the
+// only account if the handler does not serve multiple users. It returns nil if
+// there is no such user.
+func (h *Handler) accountNamed(userName string) *account {
+	if len(h.users) == 0 {
+		return h.accounts[0]
+	}
+	for _, a := range h.accounts {
+		if a.name == userName {
+			return a
+		}
+	}
+	return nil
+}
+
+// setCredentialsLocked replaces the given account's MFA devices, persisting
+// every account's devices to the credential file. If persisting fails, the
+// account's devices are not changed. h.mu must be held.
+func (h *Handler) setCredentialsLocked(a *account, cs *credentialSet) error {
+	oldCreds := a.creds
+	a.creds = cs
+	if err := h.writeCredentialsLocked(); err != nil {
+		a.creds = oldCreds
+		return err
+	}
+	return nil
+}
+
+// loadCredentials replaces each account's MFA devices with those listed in the
+// credential file, if there is one & it exists.
+func (h *Handler) loadCredentials() error {
+	if h.credentialFile == "" {
+		return nil
+	}
+	credBytes, err := ioutil.ReadFile(h.credentialFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read %q: %w", h.credentialFile, err)
+	}
+	pbCreds := &crpb.MFACredentials{}
+	if err := proto.Unmarshal(credBytes, pbCreds); err != nil {
+		return fmt.Errorf("couldn't parse %q: %w", h.credentialFile, err)
+	}
+	creds := map[*account][]Credential{}
+	for _, c := range pbCreds.Credential {
+		a := h.accountNamed(c.User)
+		if a == nil || (len(h.users) == 0 && c.User != "") {
+			// The user may have been removed from the config.
+			log.Printf("Ignoring MFA device %q of unknown user %q in %q", c.Label, c.User, h.credentialFile)
+			continue
+		}
+		var registeredAt time.Time
+		if c.RegisteredUnixNanos != 0 {
+			registeredAt = time.Unix(0, c.RegisteredUnixNanos)
+		}
+		creds[a] = append(creds[a], Credential{
+			Registration: c.Registration,
+			Label:        c.Label,
+			RegisteredAt: registeredAt,
+			AAGUID:       c.Aaguid,
+		})
+	}
+	for _, a := range h.accounts {
+		cs, err := h.newCredentialSet(a, creds[a])
+		if err != nil {
+			if a.name != "" {
+				err = fmt.Errorf("user %q: %w", a.name, err)
+			}
+			return fmt.Errorf("couldn't load %q: %w", h.credentialFile, err)
+		}
+		a.creds = cs
+	}
+	return nil
+}
+
+// writeCredentialsLocked writes every account's MFA devices to the credential
+// file. h.mu must be held.
+//
+// On POSIX-compliant systems, the update to the file on disk is atomic.
+func (h *Handler) writeCredentialsLocked() error {
+	pbCreds := &crpb.MFACredentials{}
+	for _, a := range h.accounts {
+		for _, c := range a.creds.list {
+			pbc := &crpb.MFACredential{
+				User:         a.name,
+				Registration: c.Registration,
+				Label:        c.Label,
+				Aaguid:       c.AAGUID,
+			}
+			if !c.RegisteredAt.IsZero() {
+				pbc.RegisteredUnixNanos = c.RegisteredAt.UnixNano()
+			}
+			pbCreds.Credential = append(pbCreds.Credential, pbc)
+		}
+	}
+	credBytes, err := proto.Marshal(pbCreds)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal MFA credentials: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(h.credentialFile), ".harp_mfacred_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if err := os.Chmod(tempFilename, 0660); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if _, err := tempFile.Write(credBytes); err != nil {
+		return fmt.Errorf("couldn't write MFA credentials: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Rename(tempFilename, h.credentialFile); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, h.credentialFile, err)
+	}
+	return nil
+}
+
+// invalidateOnChange watches the store wrapped by cs, if it is a
+// secret.WatchStore, invalidating cached content whenever entries are changed
+// by other means (e.g. a git pull, or another server sharing the same
+// directory). It returns a function which stops watching.
+func invalidateOnChange(cs secret.CachingStore) func() {
+	ws, ok := secret.AsWatchStore(cs)
+	if !ok {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := ws.Watch(ctx)
+	if err != nil {
+		log.Printf("Could not watch password store for changes: %v", err)
+		return cancel
+	}
+	go func() {
+		for c := range changes {
+			cs.Invalidate(c.Entry)
+		}
+	}()
+	return cancel
+}
+
+// makeRoomLocked ensures that there is room for a new session under the
+// handler's session limit, evicting a session if permitted by the handler's
+// policy. It returns ErrTooManySessions if there is no room. h.mu must be held.
+func (h *Handler) makeRoomLocked() error {
+	if h.maxSessions == 0 || len(h.sessions) < h.maxSessions {
+		return nil
+	}
+
+	// Sessions which have expired, but whose expiration timers have not yet
+	// closed them, don't count towards the limit.
+	now := h.clock.Now()
+	for sessID, sess := range h.sessions {
+		if !now.Before(sess.ExpiresAt()) {
+			h.closeSessionLocked(sessID)
+		}
+	}
+	if len(h.sessions) < h.maxSessions {
+		return nil
+	}
+	if h.sessionLimitPolicy != SessionLimitEvict {
+		return ErrTooManySessions
+	}
+
+	var oldest *Session
+	for _, sess := range h.sessions {
+		if sess.IsMFAAuthenticated() {
+			continue
+		}
+		if oldest == nil || sess.createdAt.Before(oldest.createdAt) {
+			oldest = sess
+		}
+	}
+	if oldest == nil {
+		return ErrTooManySessions
+	}
+	h.removeSessionLocked(oldest.id)
+	h.userAlert(oldest.acct.name, alert.SESSION_EVICTED, fmt.Sprintf("Session created by client %s at %s closed without completing multi-factor authentication, to make room for a new session.", oldest.clientID, oldest.createdAt.Format(time.RFC3339)))
+	return nil
+}
+
+// recordFailedLogin records a failed login attempt by the given client,
+// alerting if the client has crossed the failed login threshold.
+func (h *Handler) recordFailedLogin(clientID string) {
+	if h.authLog == nil {
+		return
+	}
+	recent, err := h.authLog.RecordFailure(clientID, h.clock.Now())
+	if err != nil {
+		log.Printf("Could not record failed login: %v", err)
+	}
+	if h.failedLoginThreshold > 0 && recent == h.failedLoginThreshold {
+		h.alert(alert.FAILED_LOGIN_BURST, fmt.Sprintf("Client %s has made %d failed login attempts recently.", clientID, recent))
+	}
+}
+
+// unlock unlocks the vault of the user with the given name with the given
+// passphrase & external secret or, if userName is empty, the vault of each
+// user in turn until one is unlocked, as CreateUserSession describes. It
+// returns the account of the user whose vault was unlocked, the resulting
+// store, and the names of the mounted vaults which were unlocked.
+// secret.ErrWrongPassphrase is returned only if no vault could be unlocked.
+func (h *Handler) unlock(userName, passphrase string, extra []byte) (*account, secret.Store, map[string]bool, error) {
+	extra = h.externalSecretFor(extra)
+	if len(h.mounts) > 0 {
+		store, unlocked, err := h.unlockMounts(passphrase, extra)
+		return h.accounts[0], store, unlocked, err
+	}
+	accts := h.accountsFor(userName)
+	if len(accts) == 1 {
+		store, err := secret.UnlockWith(accts[0].vault, passphrase, extra)
+		return accts[0], store, nil, err
+	}
+
+	var firstErr error
+	for _, a := range accts {
+		store, err := secret.UnlockWith(a.vault, passphrase, extra)
+		switch {
+		case errors.Is(err, secret.ErrWrongPassphrase):
+		case err != nil:
+			// Don't prevent the other users from logging in.
+			log.Printf("Could not unlock vault of user %q: %v", a.name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("user %q: %w", a.name, err)
+			}
+		default:
+			return a, store, nil, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, nil, nil, firstErr
+	}
+	return nil, nil, nil, secret.ErrWrongPassphrase
+}
+
+// accountsFor returns the accounts whose vaults may be unlocked to create a
+// session for the user with the given name: the named user's account, if the
+// handler serves multiple users & userName is nonempty, and otherwise every
+// account. It returns nil if there is no such user.
+func (h *Handler) accountsFor(userName string) []*account {
+	if userName == "" || len(h.users) == 0 {
+		return h.accounts
+	}
+	for _, a := range h.accounts {
+		if a.name == userName {
+			return []*account{a}
+		}
+	}
+	return nil
+}
+
+// externalSecretFor returns the external secret with which to unlock vaults,
+// given the external secret supplied by a login: extra, if it is nonempty, and
+// otherwise the external secret configured by WithExternalSecret, if any.
+func (h *Handler) externalSecretFor(extra []byte) []byte {
+	if len(extra) > 0 || h.externalSecret == nil {
+		return extra
+	}
+	extra, err := h.externalSecret()
+	if err != nil {
+		log.Printf("Could not get external secret: %v", err)
+		return nil
+	}
+	return extra
+}
+
+// unlockMounts unlocks each of the handler's mounted vaults with the given
+// passphrase & external secret. It returns the resulting store along with the names of the
+// mounted vaults which were unlocked. secret.ErrWrongPassphrase is returned
+// only if no vault could be unlocked.
+func (h *Handler) unlockMounts(passphrase string, extra []byte) (secret.Store, map[string]bool, error) {
+	stores, unlocked := map[string]secret.Store{}, map[string]bool{}
+	var firstErr error
+	for _, m := range h.mounts {
+		store, err := secret.UnlockWith(m.Vault, passphrase, extra)
+		switch {
+		case errors.Is(err, secret.ErrWrongPassphrase):
+		case err != nil:
+			// Don't prevent access to the other vaults.
+			log.Printf("Could not unlock vault %q: %v", m.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("vault %q: %w", m.Name, err)
+			}
+		default:
+			stores[m.Path] = store
+			unlocked[m.Name] = true
+		}
+	}
+	if len(stores) == 0 {
+		if firstErr != nil {
+			return nil, nil, firstErr
+		}
+		return nil, nil, secret.ErrWrongPassphrase
+	}
+	return secret.NewMountStore(stores), unlocked, nil
+}
+
+// RotateSessionID re-keys the session with the given ID under a new, random
+// session ID, which is returned. The old session ID is invalidated
+// immediately. It returns ErrNoSession if the session does not exist.
+func (h *Handler) RotateSessionID(oldID string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sess := h.sessions[oldID]
+	if sess == nil {
+		return "", ErrNoSession
+	}
+	return h.rotateSessionIDLocked(sess)
+}
+
+// rotateSessionIDLocked re-keys the given session under a new session ID,
+// returning the new ID. h.mu must be held.
+func (h *Handler) rotateSessionIDLocked(sess *Session) (string, error) {
+	if h.sessions[sess.id] != sess {
+		return "", ErrNoSession
+	}
+	newID, err := h.newSessionIDLocked()
+	if err != nil {
+		return "", err
+	}
+	delete(h.sessions, sess.id)
+	sess.id = newID
+	h.sessions[newID] = sess
+	return newID, nil
+}
+
+// newSessionIDLocked generates a new random session ID, not used by any
+// existing or pending session. h.mu must be held.
+func (h *Handler) newSessionIDLocked() (string, error) {
+	var sID [sessionIDLength]byte
+	for {
+		// This loop body is overwhelmingly likely to run only once.
+		if _, err := rand.Read(sID[:]); err != nil {
+			return "", fmt.Errorf("couldn't generate session ID: %w", err)
+		}
+		if _, ok := h.sessions[string(sID[:])]; ok {
+			continue
+		}
+		if _, ok := h.pending[string(sID[:])]; !ok {
+			return string(sID[:]), nil
+		}
+	}
+}
+
+// GetSession gets an existing session if the session exists.  It returns
+// ErrNoSession if the session does not exist. If the session does exist and is
+// fully authenticated, its expiration timeout is reset.
+func (h *Handler) GetSession(sessionID string) (*Session, error) {
+	sess, err := h.LookupSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Touch(); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// GetSessionFor is like GetSession, but additionally checks that the session
+// is being used by the client that created it, according to the handler's
+// Binding. If the client does not match, an alert is fired, and if bindings
+// are enforced, ErrNoSession is returned.
+func (h *Handler) GetSessionFor(sessionID, clientID, fingerprint string) (*Session, error) {
+	sess, err := h.LookupSessionFor(sessionID, clientID, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if err := sess.Touch(); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// LookupSessionFor is like LookupSession, but additionally checks the
+// session's binding to its client, as GetSessionFor does.
+func (h *Handler) LookupSessionFor(sessionID, clientID, fingerprint string) (*Session, error) {
+	sess, err := h.LookupSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if h.binding == BindingOff || (sess.clientID == clientID && sess.fingerprint == fingerprint) {
+		return sess, nil
+	}
+
+	// Only alert once per session, since every subsequent request from the mismatched client would
+	// alert again.
+	sess.mu.Lock()
+	alerted := sess.bindingAlerted
+	sess.bindingAlerted = true
+	sess.mu.Unlock()
+	if !alerted {
+		h.userAlert(sess.acct.name, alert.SESSION_HIJACK_SUSPECTED, fmt.Sprintf("Session created by client %s (%q) used by client %s (%q).", sess.clientID, sess.fingerprint, clientID, fingerprint))
+	}
+	if h.binding == BindingEnforce {
+		return nil, ErrNoSession
+	}
+	return sess, nil
+}
+
+// LookupSession gets an existing session if the session exists, without
+// resetting its expiration timeout. It returns ErrNoSession if the session
+// does not exist or has expired.
+func (h *Handler) LookupSession(sessionID string) (*Session, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	// An expired session may not have been closed yet, if its expiration
+	// timer has fired but not yet run.
+	if sess := h.sessions[sessionID]; sess != nil && h.clock.Now().Before(sess.ExpiresAt()) {
+		return sess, nil
+	}
+	return nil, ErrNoSession
+}
+
+// SessionInfo describes an active session. It is a snapshot: it does not
+// change as the session is used.
+type SessionInfo struct {
+	ID               string    // public identifier of the session, as returned by Session.PublicID
+	User             string    // user the session is bound to, as returned by Session.User
+	ClientID         string    // client which created the session
+	Fingerprint      string    // fingerprint of the client which created the session
+	CreatedAt        time.Time // time the session was created
+	LastActiveAt     time.Time // time the session was most recently used
+	ExpiresAt        time.Time // time the session expires, unless it is used before then
+	MFAAuthenticated bool      // whether multi-factor authentication has been performed for any path
+}
+
+// Sessions returns a description of each active session, oldest first.
+// Sessions which have expired, but have not yet been closed, are omitted.
+func (h *Handler) Sessions() []SessionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	now := h.clock.Now()
+	var infos []SessionInfo
+	for _, sess := range h.sessions {
+		sess.mu.RLock()
+		info := SessionInfo{
+			ID:               sess.publicID,
+			User:             sess.acct.name,
+			ClientID:         sess.clientID,
+			Fingerprint:      sess.fingerprint,
+			CreatedAt:        sess.createdAt,
+			LastActiveAt:     sess.lastActiveAt,
+			ExpiresAt:        sess.expiresAt,
+			MFAAuthenticated: len(sess.authedPaths) > 0,
+		}
+		sess.mu.RUnlock()
+		if now.Before(info.ExpiresAt) {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos
+}
+
+// CloseSessionByID closes the active session with the given public
+// identifier, as returned by Session.PublicID, firing a SESSIONS_REVOKED
+// alert. It returns ErrNoSession if there is no such session.
+func (h *Handler) CloseSessionByID(publicID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sessID, sess := range h.sessions {
+		if sess.publicID != publicID {
+			continue
+		}
+		h.removeSessionLocked(sessID)
+		h.userAlert(sess.acct.name, alert.SESSIONS_REVOKED, fmt.Sprintf("Session created by client %s at %s revoked.", sess.clientID, sess.createdAt.Format(time.RFC3339)))
+		return nil
+	}
+	return ErrNoSession
+}
+
+// CloseAllSessions closes every active session, returning the number of
+// sessions closed.
+func (h *Handler) CloseAllSessions() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.sessions)
+	for sessID := range h.sessions {
+		h.closeSessionLocked(sessID)
+	}
+	for key := range h.tombstones {
+		h.removeTombstoneLocked(key)
+	}
+	h.alert(alert.SESSIONS_REVOKED, fmt.Sprintf("All sessions revoked (%d closed).", n))
+	return n
+}
+
+// CloseUserSessions closes every active session bound to the user with the
+// given name, as returned by Session.User, returning the number of sessions
+// closed. If the handler does not serve multiple users, every active session
+// is closed, as with CloseAllSessions.
+func (h *Handler) CloseUserSessions(userName string) int {
+	if len(h.users) == 0 {
+		return h.CloseAllSessions()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for sessID, sess := range h.sessions {
+		if sess.acct.name == userName {
+			h.closeSessionLocked(sessID)
+			n++
+		}
+	}
+	for key, t := range h.tombstones {
+		if t.acct.name == userName {
+			h.removeTombstoneLocked(key)
+		}
+	}
+	h.userAlert(userName, alert.SESSIONS_REVOKED, fmt.Sprintf("All sessions revoked (%d closed).", n))
+	return n
+}
+
+// Shutdown closes every active session & discards every share token, dropping
+// the sessions' references to their stores so that no decrypted key material
+// remains reachable, and releases any logins held by the rate limiter. It then
+// waits for any alerts which are still being sent, returning ctx.Err() if ctx
+// is done first. The handler must not be used after Shutdown is called.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	for sessID := range h.sessions {
+		sess := h.removeSessionLocked(sessID)
+		sess.mu.Lock()
+		sess.store = nil
+		sess.mu.Unlock()
+	}
+	for _, sess := range h.apiSessions {
+		h.removeAPISessionLocked(sess)
+		sess.mu.Lock()
+		sess.store = nil
+		sess.mu.Unlock()
+	}
+	for key := range h.tombstones {
+		h.removeTombstoneLocked(key)
+	}
+	for token, sh := range h.shares {
+		sh.expirationTimer.Stop()
+		delete(h.shares, token)
+	}
+	for sessID := range h.pending {
+		// Sessions still being created are discarded once their vaults are unlocked.
+		delete(h.pending, sessID)
+	}
+	h.mu.Unlock()
+	h.rateLimiter.Close()
+
+	done := make(chan struct{})
+	go func() {
+		h.pendingAlerts.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ActiveSessionCount returns the number of currently-active sessions.
+func (h *Handler) ActiveSessionCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.sessions)
+}
+
+// closeSession closes the given session, if it is still open. It is safe to
+// call more than once, and concurrently with the session's expiration timer.
+func (h *Handler) closeSession(sess *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sess.apiTokenID != "" {
+		if h.apiSessions[sess.apiTokenID] == sess {
+			h.removeAPISessionLocked(sess)
+		}
+		return
+	}
+	if h.sessions[sess.id] == sess {
+		h.closeSessionLocked(sess.id)
+	}
+}
+
+// lockSession soft-locks the given session, if it is still open: it is closed,
+// but if soft locking is enabled (see WithSoftLock) & the session completed
+// multi-factor authentication, a tombstone is left from which a new session
+// for the same user & client may restore that authentication. Sessions created
+// from API tokens, and sessions which reached their absolute deadline, are
+// closed without leaving a tombstone.
+func (h *Handler) lockSession(sess *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sess.apiTokenID != "" {
+		if h.apiSessions[sess.apiTokenID] == sess {
+			h.removeAPISessionLocked(sess)
+		}
+		return
+	}
+	if h.sessions[sess.id] != sess {
+		return
+	}
+	h.closeSessionLocked(sess.id)
+
+	now := h.clock.Now()
+	if h.softLockGrace <= 0 || (!sess.deadline.IsZero() && !now.Before(sess.deadline)) {
+		return
+	}
+	sess.mu.RLock()
+	authedPaths := make(map[string]time.Time, len(sess.authedPaths))
+	for p, at := range sess.authedPaths {
+		authedPaths[p] = at
+	}
+	sess.mu.RUnlock()
+	if len(authedPaths) == 0 {
+		return
+	}
+	key := bindingHash(sess.acct, sess.clientID, sess.fingerprint)
+	h.removeTombstoneLocked(key)
+	t := &tombstone{acct: sess.acct, authedPaths: authedPaths, expiresAt: now.Add(h.softLockGrace)}
+	t.timer = h.clock.AfterFunc(h.softLockGrace, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.tombstones[key] == t {
+			delete(h.tombstones, key)
+		}
+	})
+	h.tombstones[key] = t
+}
+
+// restoreLocked restores the multi-factor authentication of the soft-locked
+// session, if any, of the given new session's user & client, consuming the
+// soft-locked session's tombstone. h.mu must be held.
+func (h *Handler) restoreLocked(sess *Session) {
+	key := bindingHash(sess.acct, sess.clientID, sess.fingerprint)
+	t := h.tombstones[key]
+	if t == nil {
+		return
+	}
+	h.removeTombstoneLocked(key)
+	if !h.clock.Now().Before(t.expiresAt) {
+		// The tombstone's timer has fired, but has not yet removed it.
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for p, at := range t.authedPaths {
+		sess.authedPaths[p] = at
+	}
+}
+
+// removeTombstoneLocked removes the tombstone with the given key, if it
+// exists. h.mu must be held.
+func (h *Handler) removeTombstoneLocked(key [sha256.Size]byte) {
+	if t := h.tombstones[key]; t != nil {
+		t.timer.Stop()
+		delete(h.tombstones, key)
+	}
+}
+
+// tombstone records the multi-factor authentication of a soft-locked session
+// (see WithSoftLock). It holds no key material.
+type tombstone struct {
+	acct        *account             // user the session was bound to
+	authedPaths map[string]time.Time // time of most recent MFA authentication, by path
+	expiresAt   time.Time            // time after which the authentication can't be restored
+	timer       Timer                // removes the tombstone at expiresAt
+}
+
+// bindingHash hashes the binding of a session for the given account to the
+// given client, identifying the session's tombstone.
+func bindingHash(acct *account, clientID, fingerprint string) [sha256.Size]byte {
+	hash := sha256.New()
+	for _, s := range []string{acct.name, clientID, fingerprint} {
+		fmt.Fprintf(hash, "%d:%s", len(s), s)
+	}
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	return sum
+}
+
+// closeSessionLocked closes the given session, if it exists. h.mu must be held.
+func (h *Handler) closeSessionLocked(sessID string) {
+	if sess := h.removeSessionLocked(sessID); sess != nil && !sess.IsMFAAuthenticated() {
+		h.userAlert(sess.acct.name, alert.UNAUTHENTICATED_SESSION_CLOSED, "Session closed without completing multi-factor authentication.")
+	}
+}
+
+// removeSessionLocked closes the given session, if it exists, without firing
+// any alerts. It returns the closed session, or nil if there was no such
+// session. h.mu must be held.
+func (h *Handler) removeSessionLocked(sessID string) *Session {
+	sess := h.sessions[sessID]
+	if sess == nil {
+		return nil
+	}
+	sess.markClosed()
+	delete(h.sessions, sessID)
+	sess.releaseStore()
+	return sess
+}
+
+// removeAPISessionLocked closes the given session, which was created from an
+// API token. h.mu must be held.
+func (h *Handler) removeAPISessionLocked(sess *Session) {
+	sess.markClosed()
+	delete(h.apiSessions, sess.apiTokenID)
+	sess.releaseStore()
+}
+
+// lockOut closes the given session after too many consecutive failed
+// multi-factor authentication attempts, firing an MFA_LOCKOUT alert. The
+// session's challenges must already have been cleared.
+func (h *Handler) lockOut(sess *Session, failures int, what string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[sess.id] == sess {
+		h.removeSessionLocked(sess.id)
+	}
+	h.userAlert(sess.acct.name, alert.MFA_LOCKOUT, fmt.Sprintf("Session from %s closed after %d consecutive failed MFA %s.", sess.clientID, failures, what))
+}
+
+// RedeemShare redeems the given share token, returning the path and content
+// of the shared entry. Each share token can be redeemed only once; it returns
+// ErrNoShare if the token does not exist, has expired, or has already been
+// redeemed.
+func (h *Handler) RedeemShare(token string) (entry, content string, _ error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sh := h.shares[token]
+	if sh == nil {
+		return "", "", ErrNoShare
+	}
+	sh.expirationTimer.Stop()
+	delete(h.shares, token)
+	if h.clock.Now().After(sh.expiresAt) {
+		// The expiration timer fired, but has not yet removed the share.
+		return "", "", ErrNoShare
+	}
+	h.userAlert(sh.userName, alert.SHARE_REDEEMED, fmt.Sprintf("Share of entry %q redeemed.", sh.entry))
+	return sh.entry, sh.content, nil
+}
+
+// expireShare removes the given share, if it has not already been redeemed.
+func (h *Handler) expireShare(token string, sh *share) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shares[token] == sh {
+		delete(h.shares, token)
+	}
+}
+
+// share holds the content of an entry shared via a share token.
+type share struct {
+	entry           string
+	content         string
+	userName        string // user who created the share
+	expiresAt       time.Time
+	expirationTimer Timer
+}
+
+// userAlert fires an alert concerning the user with the given name, naming the
+// user in the alert's details if the handler serves multiple users.
+func (h *Handler) userAlert(userName string, code alert.Code, details string) {
+	if userName != "" {
+		details = fmt.Sprintf("User %q: %s", userName, details)
+	}
+	h.alert(code, details)
+}
+
+func (h *Handler) alert(code alert.Code, details string) {
+	h.pendingAlerts.Add(1)
+	go func() {
+		defer h.pendingAlerts.Done()
+		ctx, c := context.WithTimeout(context.Background(), alertTimeLimit)
+		defer c()
+		if err := h.alerter.Alert(ctx, code, details); err != nil {
+			log.Printf("Could not send alert (%s %q): %v", code, details, err)
+		}
+	}()
+}
+
+// PendingSession tracks the creation of a session whose vault is being
+// unlocked in the background, as started by CreateSessionAsync. It is safe for
+// concurrent use from multiple goroutines.
+type PendingSession struct {
+	clientID    string              // client which is creating the session
+	fingerprint string              // fingerprint of the client which is creating the session
+	unlock      secret.UnlockHandle // nil if the unlock's progress is not tracked
+	restore     bool                // whether the session restores the MFA authentication of a soft-locked session
+	done        chan struct{}       // closed once sess & err are set
+	sess        *Session
+	err         error
+}
 
-// Handler handles management of sessions, including creation, deletion, and
-// timeout. It is safe for concurrent use from multiple goroutines.
-type Handler struct {
-	mu       sync.RWMutex        // protects sessions
-	sessions map[string]*Session // by session ID
+// Done returns a channel which is closed once the session has been created,
+// or has failed to be created.
+func (p *PendingSession) Done() <-chan struct{} { return p.done }
 
-	vault                    secret.Vault                         // locked password data
-	sessionDuration          time.Duration                        // how long sessions last
-	origin                   string                               // origin to use for MFA. (e.g. "https://example.com:8080")
-	domain                   string                               // domain to use for MFA (e.g. "example.com")
-	mfaCredentials           map[string]warp.Credential           // registered MFA device credentials
-	mfaCredentialDescriptors []warp.PublicKeyCredentialDescriptor // registerd MFA device credential descriptors
-	rateLimiter              rate.Limiter                         // rate limiter for creating new sessions
-	alerter                  alert.Alerter                        // used to notify user of alerts
+// Result returns the created session, or the error which prevented its
+// creation, as CreateSession would. It blocks until creation completes.
+func (p *PendingSession) Result() (*Session, error) {
+	<-p.done
+	return p.sess, p.err
 }
 
-type credential struct {
-	h *Handler
-	c *warp.AttestedCredentialData
+// Progress returns an estimate of the fraction of the vault's unlock which is
+// complete, between 0 & 1. It returns false if no estimate is available.
+func (p *PendingSession) Progress() (float64, bool) {
+	if p.unlock == nil {
+		select {
+		case <-p.done:
+			return 1, true
+		default:
+			return 0, false
+		}
+	}
+	return p.unlock.Progress()
 }
 
-var _ warp.Credential = credential{}
+// Session stores all data associated with a given active user session.
+// It is safe for concurrent use from multiple goroutines.
+type Session struct {
+	id          string // protected by h.mu
+	publicID    string // identifies the session to users; unlike id, it is not a credential
+	h           *Handler
+	acct        *account // user the session is bound to
+	csrfToken   string
+	clientID    string          // client which created the session
+	fingerprint string          // fingerprint of the client which created the session
+	unlocked    map[string]bool // names of mounted vaults unlocked by this session
+	createdAt   time.Time
+	deadline    time.Time // time after which the session can't be extended; zero if there is no limit
+	release     func()    // stops watching the session's store for changes & wipes its key material
+	apiTokenID  string    // ID of the API token the session was created from; empty if it was created by logging in
 
-func (c credential) Owner() warp.User            { return user{c.h} }
-func (c credential) CredentialID() []byte        { return c.c.CredentialID }
-func (c credential) CredentialPublicKey() []byte { return c.c.CredentialPublicKey }
-func (c credential) CredentialSignCount() uint   { return 0 }
+	mu               sync.RWMutex // protects all fields below
+	store            secret.Store // nil after the handler is shut down
+	expiresAt        time.Time
+	expirationTimer  Timer
+	closed           bool      // whether the session has been closed; its expiration timer must not be restarted
+	lastActiveAt     time.Time // time of the most recent call to Touch, or creation
+	bindingAlerted   bool      // whether an alert has been fired for use of this session by another client
+	expiryAlerted    bool      // whether an alert has been fired for entries expiring soon
+	mfaRegChallenge  *warp.PublicKeyCredentialCreationOptions
+	authedPaths      map[string]time.Time // time of most recent MFA authentication, by path
+	mfaChallengePath string
+	mfaChallenge     *warp.PublicKeyCredentialRequestOptions
+	mfaFailures      int    // consecutive failed MFA assertions
+	mfaRegFailures   int    // consecutive failed MFA registrations
+	lockedOut        bool   // whether the session was closed due to too many MFA failures
+	readOnly         bool   // whether store has been wrapped by MakeReadOnly
+	mfaTaken         bool   // whether MFA authentication has been forgotten by TakeMFAAuthentication
+	origin           string // origin at which MFA is performed, set by SetOrigin; if empty, the handler's origin
+}
 
-type relyingParty struct{ h *Handler }
+// Close closes this existing session, freeing all resources used by the session.
+func (s *Session) Close() { s.h.closeSession(s) }
 
-var _ warp.RelyingParty = relyingParty{}
+// Lock closes this existing session as Close does, but soft-locks it if the
+// handler allows, so that logging in again with the passphrase restores its
+// multi-factor authentication (see WithSoftLock).
+func (s *Session) Lock() { s.h.lockSession(s) }
 
-func (rp relyingParty) EntityID() string   { return rp.h.domain }
-func (rp relyingParty) EntityName() string { return "Harpocrates" }
-func (rp relyingParty) EntityIcon() string { return fmt.Sprintf("%s/favicon.ico", rp.h.origin) }
-func (rp relyingParty) Origin() string     { return rp.h.origin }
+// SoftLockable determines if locking this session with Lock soft-locks it,
+// rather than simply closing it.
+func (s *Session) SoftLockable() bool { return s.h.SoftLockEnabled() && s.apiTokenID == "" }
 
-type user struct{ h *Handler }
+// markClosed marks this session as closed & stops its expiration timer. It is
+// called as the session is removed from the handler, so that a concurrent
+// Touch can't restart the timer of a session which is no longer open.
+func (s *Session) markClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.expirationTimer.Stop()
+}
 
-var _ warp.User = user{}
+// releaseStore clears any cached content of the session's store, stops
+// watching it for changes, and wipes its key material. Afterwards, the store
+// can no longer decrypt entries.
+func (s *Session) releaseStore() {
+	if cs, ok := secret.AsCachingStore(s.GetStore()); ok {
+		cs.Clear()
+	}
+	s.release()
+}
 
-func (u user) EntityName() string                      { return "Harpocrates User" }
-func (u user) EntityIcon() string                      { return "" }
-func (u user) EntityID() []byte                        { return []byte{0} }
-func (u user) EntityDisplayName() string               { return "Harpocrates User" }
-func (u user) Credentials() map[string]warp.Credential { return u.h.mfaCredentials }
+// GetStore returns the password store associated with this session.
+func (s *Session) GetStore() secret.Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store
+}
 
-// NewHandler creates a new session handler.
-func NewHandler(vault secret.Vault, origin string, mfaCredentials []string, sessionDuration time.Duration, newSessionRate float64, alerter alert.Alerter) (*Handler, error) {
-	if sessionDuration <= 0 {
-		return nil, errors.New("nonpositive session length")
+// MakeReadOnly wraps the session's store with secret.NewReadOnlyStore, as
+// WithReadOnly does for every session, so that no entries can be changed via
+// the session. The session remains read-only until it is closed.
+func (s *Session) MakeReadOnly() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly || s.store == nil {
+		return
 	}
+	s.store = secret.NewReadOnlyStore(s.store)
+	s.readOnly = true
+}
 
-	u, err := url.Parse(origin)
+// SetOrigin sets the origin at which the session's browser reaches harpd, and
+// so performs MFA, which must be one passed to WithOrigins, or empty for the
+// origin passed to NewHandler.
+func (s *Session) SetOrigin(origin string) error {
+	origin, err := s.h.mfaOrigin(origin)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse origin: %w", err)
+		return err
 	}
-	domain := u.Hostname()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.origin = origin
+	return nil
+}
 
-	h := &Handler{
-		sessions:        map[string]*Session{},
-		vault:           vault,
-		sessionDuration: sessionDuration,
-		origin:          origin,
-		domain:          domain,
-		mfaCredentials:  map[string]warp.Credential{},
-		rateLimiter:     rate.NewLimiter(newSessionRate, 1),
-		alerter:         alerter,
+// Origin returns the origin at which the session performs MFA; see SetOrigin.
+func (s *Session) Origin() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.originLocked()
+}
+
+// originLocked implements Origin. s.mu must be held.
+func (s *Session) originLocked() string {
+	if s.origin == "" {
+		return s.h.origin
 	}
+	return s.origin
+}
 
-	for i, c := range mfaCredentials {
-		cred, err := decodeCredential(c)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't parse registration %d: %w", i, err)
-		}
-		h.mfaCredentials[base64.RawURLEncoding.EncodeToString(cred.CredentialID)] = credential{h, cred}
-		h.mfaCredentialDescriptors = append(h.mfaCredentialDescriptors, warp.PublicKeyCredentialDescriptor{
-			Type: warp.PublicKey,
-			ID:   cred.CredentialID,
-		})
+// VaultStatus describes a vault mounted with WithMounts.
+type VaultStatus struct {
+	Name     string
+	Path     string
+	Unlocked bool // whether the vault was unlocked by the session's passphrase
+}
+
+// Vaults returns the status of each of the handler's mounted vaults, in the
+// order they were passed to WithMounts. It returns nil if the handler serves a
+// single vault.
+func (s *Session) Vaults() []VaultStatus {
+	var vs []VaultStatus
+	for _, m := range s.h.mounts {
+		vs = append(vs, VaultStatus{Name: m.Name, Path: m.Path, Unlocked: s.unlocked[m.Name]})
 	}
-	return h, nil
+	return vs
 }
 
-// CreateSession attempts to create a new session, using the given passphrase.
-// It returns the new session's ID and the session, or
-// secret.ErrWrongPassphrase if an authentication error occurs, and other
-// errors if they occur.
-func (h *Handler) CreateSession(clientID, passphrase string) (string, *Session, error) {
-	// Respect rate limit.
-	if err := h.rateLimiter.Wait(clientID); err != nil {
-		if err == rate.ErrTooManyEvents {
-			return "", nil, err
-		}
-		return "", nil, fmt.Errorf("couldn't wait for rate limiter: %w", err)
+// User returns the name of the user the session is bound to, or the empty
+// string if the handler does not serve multiple users (see WithUsers).
+func (s *Session) User() string { return s.acct.name }
+
+// PublicID returns an identifier for this session which may be shown to
+// users, e.g. to choose a session to close with Handler.CloseSessionByID.
+// Unlike the session ID, it can't be used to access the session.
+func (s *Session) PublicID() string { return s.publicID }
+
+// CreateAPIToken creates an API token with the given name, granting access to
+// the vault as unlocked by the given passphrase, restricted to the given
+// directory prefixes (if any) and optionally read-only. The passphrase is
+// rate limited as logins are, and must be given again since sessions don't
+// retain it; it returns secret.ErrWrongPassphrase if it unlocks no vault. On
+// success, an API_TOKEN_CREATED alert is fired, and the token is returned
+// along with its description. The token can't be recovered later.
+func (s *Session) CreateAPIToken(name, passphrase string, prefixes []string, readOnly bool) (string, apitoken.Token, error) {
+	h := s.h
+	if h.apiTokens == nil {
+		return "", apitoken.Token{}, errors.New("API tokens are not enabled")
+	}
+	if err := s.checkPassphrase(passphrase); err != nil {
+		return "", apitoken.Token{}, err
+	}
+	tok, info, err := h.apiTokens.Create(name, passphrase, prefixes, readOnly, h.clock.Now())
+	if err != nil {
+		return "", apitoken.Token{}, fmt.Errorf("couldn't create API token: %w", err)
 	}
+	h.alert(alert.API_TOKEN_CREATED, fmt.Sprintf("API token %q created by client %s.", name, s.clientID))
+	return tok, info, nil
+}
 
-	// Get a secret.Store using the supplied passphrase.
-	store, err := h.vault.Unlock(passphrase)
-	if err == secret.ErrWrongPassphrase {
-		return "", nil, err
+// checkPassphrase checks that the given passphrase unlocks the vault of the
+// session's user. Checks are rate limited as logins are. It returns
+// secret.ErrWrongPassphrase if the passphrase unlocks no vault.
+func (s *Session) checkPassphrase(passphrase string) error {
+	h := s.h
+	if err := h.rateLimiter.Wait(s.clientID); err != nil {
+		if errors.Is(err, rate.ErrTooManyEvents) {
+			return err
+		}
+		return fmt.Errorf("couldn't wait for rate limiter: %w", err)
+	}
+	if _, _, _, err := h.unlock(s.acct.name, passphrase, nil); errors.Is(err, secret.ErrWrongPassphrase) {
+		h.rateLimiter.Penalize(s.clientID)
+		return err
 	} else if err != nil {
-		return "", nil, fmt.Errorf("couldn't unlock vault: %w", err)
+		return fmt.Errorf("couldn't unlock vault: %w", err)
 	}
+	return nil
+}
 
-	// Generate session ID.
-	var sID [sessionIDLength]byte
-	if _, err := rand.Read(sID[:]); err != nil {
-		return "", nil, fmt.Errorf("couldn't generate session ID: %w", err)
+// TrustDevice trusts the browser using this session, which must have completed
+// multi-factor authentication, labelling it with the given label. It returns
+// the token to be presented by the browser in later sessions (see
+// IsTrustedDevice) along with a description of the device, and fires a
+// DEVICE_TRUSTED alert. The token can't be recovered later.
+func (s *Session) TrustDevice(label string) (string, device.Device, error) {
+	h := s.h
+	if h.devices == nil {
+		return "", device.Device{}, errors.New("trusted devices are not enabled")
 	}
-	sessID := string(sID[:])
-
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	for _, ok := h.sessions[sessID]; ok; _, ok = h.sessions[sessID] {
-		// This loop body is overwhelmingly likely to never run.
-		if _, err := rand.Read(sID[:]); err != nil {
-			return "", nil, fmt.Errorf("couldn't generate session ID: %w", err)
-		}
-		sessID = string(sID[:])
+	if !s.IsMFAAuthenticated() {
+		return "", device.Device{}, errors.New("session has not completed multi-factor authentication")
 	}
+	tok, info, err := h.devices.Create(s.acct.name, label, h.clock.Now())
+	if err != nil {
+		return "", device.Device{}, fmt.Errorf("couldn't trust device: %w", err)
+	}
+	h.userAlert(s.acct.name, alert.DEVICE_TRUSTED, fmt.Sprintf("Device %q trusted by client %s.", label, s.clientID))
+	return tok, info, nil
+}
 
-	// Start reaper timer and return.
-	sess := &Session{
-		h:           h,
-		id:          sessID,
-		store:       store,
-		authedPaths: map[string]struct{}{},
+// IsTrustedDevice determines if the given token, as returned by TrustDevice,
+// identifies a device trusted by the session's user which has been neither
+// revoked nor trusted for longer than the store's lifetime. Sessions from
+// trusted devices may skip multi-factor authentication for pages which reveal
+// only entry names, but entries themselves always require it.
+func (s *Session) IsTrustedDevice(token string) bool {
+	if s.h.devices == nil || token == "" {
+		return false
 	}
-	sess.expirationTimer = time.AfterFunc(h.sessionDuration, func() { h.closeSession(sessID) })
-	h.sessions[sessID] = sess
-	return sessID, sess, nil
+	d, err := s.h.devices.Authenticate(token, s.h.clock.Now())
+	return err == nil && d.User == s.acct.name
 }
 
-// GetSession gets an existing session if the session exists.  It returns
-// ErrNoSession if the session does not exist. If the session does exist and is
-// fully authenticated, its expiration timeout is reset.
-func (h *Handler) GetSession(sessionID string) (*Session, error) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	if sess := h.sessions[sessionID]; sess != nil {
-		sess.mu.RLock()
-		defer sess.mu.RUnlock()
+// CSRFToken returns a random token associated with this session, which must
+// accompany state-changing requests made with this session to demonstrate
+// that they originate from a page served to the session's user.
+func (s *Session) CSRFToken() string { return s.csrfToken }
 
-		// Only reset the timer if the user has completed MFA, to ensure that partially-authenticated
-		// users can't keep a session open indefinitely.
-		if len(sess.authedPaths) > 0 {
-			if !sess.expirationTimer.Stop() {
-				return nil, ErrNoSession
-			}
-			sess.expirationTimer.Reset(h.sessionDuration)
-		}
-		return sess, nil
+// CreateShare creates a share token for the given entry, returning the token
+// and the time at which it expires. The entry's current content is captured
+// and held in memory until the token is redeemed with Handler.RedeemShare or
+// expires; it is never written to disk. It returns secret.ErrNoEntry if the
+// entry does not exist.
+func (s *Session) CreateShare(entry string) (string, time.Time, error) {
+	content, err := s.GetStore().Get(entry)
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	return nil, ErrNoSession
-}
 
-func (h *Handler) closeSession(sessID string) {
+	var tok [shareTokenLength]byte
+	if _, err := rand.Read(tok[:]); err != nil {
+		return "", time.Time{}, fmt.Errorf("couldn't generate share token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(tok[:])
+
+	h := s.h
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if sess := h.sessions[sessID]; sess != nil {
-		sess.expirationTimer.Stop()
-		delete(h.sessions, sessID)
+	sh := &share{entry: entry, content: content, userName: s.acct.name, expiresAt: h.clock.Now().Add(h.shareDuration)}
+	sh.expirationTimer = h.clock.AfterFunc(h.shareDuration, func() { h.expireShare(token, sh) })
+	h.shares[token] = sh
+	h.userAlert(s.acct.name, alert.SHARE_CREATED, fmt.Sprintf("Share of entry %q created, expiring in %v.", entry, h.shareDuration))
+	return token, sh.expiresAt, nil
+}
 
-		if !sess.IsMFAAuthenticated() {
-			h.alert(alert.UNAUTHENTICATED_SESSION_CLOSED, "Session closed without completing multi-factor authentication.")
+// ExpiringEntries returns the entries in the session's store which have expired
+// or will expire within the given window, ordered by expiration date; see
+// audit.Expirations. The first time any entry expires within
+// ExpiryAlertWindow, an ENTRY_EXPIRING alert is fired; it is fired at most
+// once per session.
+func (s *Session) ExpiringEntries(window time.Duration) ([]audit.Expiration, error) {
+	exps, err := audit.Expirations(s.GetStore())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get expiration dates: %w", err)
+	}
+	now := s.h.clock.Now()
+	n := sort.Search(len(exps), func(i int) bool { return exps[i].Date.After(now.Add(window)) })
+	exps = exps[:n]
+	var alerting []string
+	for _, e := range exps {
+		if !e.Date.After(now.Add(ExpiryAlertWindow)) {
+			alerting = append(alerting, fmt.Sprintf("%s (%s)", e.Entry, e.Date.Format("2006-01-02")))
 		}
 	}
-}
 
-func (h *Handler) alert(code alert.Code, details string) {
-	go func() {
-		ctx, c := context.WithTimeout(context.Background(), alertTimeLimit)
-		defer c()
-		if err := h.alerter.Alert(ctx, code, details); err != nil {
-			log.Printf("Could not send alert (%s %q): %w", code, details, err)
+	if len(alerting) > 0 {
+		s.mu.Lock()
+		alerted := s.expiryAlerted
+		s.expiryAlerted = true
+		s.mu.Unlock()
+		if !alerted {
+			s.h.userAlert(s.acct.name, alert.ENTRY_EXPIRING, fmt.Sprintf("%d entries expired or expiring within %v: %s.", len(alerting), ExpiryAlertWindow, strings.Join(alerting, ", ")))
 		}
-	}()
+	}
+	return exps, nil
 }
 
-// Session stores all data associated with a given active user session.
-// It is safe for concurrent use from multiple goroutines.
-type Session struct {
-	id              string
-	h               *Handler
-	store           secret.Store
-	expirationTimer *time.Timer
+// Touch resets this session's expiration timeout. As with GetSession, the
+// timeout is only reset if the session is fully authenticated, to ensure that
+// partially-authenticated users can't keep a session open indefinitely. The
+// timeout is never extended past the session's absolute deadline. It returns
+// ErrNoSession if the session has already expired or been closed.
+func (s *Session) Touch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.h.clock.Now()
+	// The session may have expired without yet being closed, if its expiration
+	// timer has fired but not yet run.
+	if s.closed || !now.Before(s.expiresAt) {
+		return ErrNoSession
+	}
+	s.lastActiveAt = now
+	if len(s.authedPaths) == 0 && s.apiTokenID == "" {
+		return nil
+	}
+	if !s.expirationTimer.Stop() {
+		return ErrNoSession
+	}
+	s.expiresAt = s.nextExpiry(now)
+	s.expirationTimer.Reset(s.expiresAt.Sub(now))
+	return nil
+}
 
-	mu               sync.RWMutex // protects all fields below
-	mfaRegChallenge  *warp.PublicKeyCredentialCreationOptions
-	authedPaths      map[string]struct{}
-	mfaChallengePath string
-	mfaChallenge     *warp.PublicKeyCredentialRequestOptions
+// nextExpiry returns the time at which the session expires if its expiration
+// timeout is reset at time now.
+func (s *Session) nextExpiry(now time.Time) time.Time {
+	exp := now.Add(s.h.sessionDuration)
+	if !s.deadline.IsZero() && exp.After(s.deadline) {
+		return s.deadline
+	}
+	return exp
 }
 
-// Close closes this existing session, freeing all resources used by the session.
-func (s *Session) Close() { s.h.closeSession(s.id) }
+// ExpiresAt returns the time at which this session will expire, unless its
+// expiration timeout is reset before then.
+func (s *Session) ExpiresAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expiresAt
+}
 
-// GetStore returns the password store associated with this session.
-func (s *Session) GetStore() secret.Store { return s.store }
+// AbsoluteDeadline returns the time after which this session will expire
+// regardless of use, as configured by WithMaxLifetime. It returns the zero time
+// if the session's lifetime is not limited.
+func (s *Session) AbsoluteDeadline() time.Time { return s.deadline }
 
 // GenerateMFARegistrationChallenge generates a new multi-factor authentication registration
 // challenge. It replaces any previous registration challenge that may exist.
 func (s *Session) GenerateMFARegistrationChallenge() (*warp.PublicKeyCredentialCreationOptions, error) {
+	return s.generateMFARegistrationChallenge()
+}
+
+// GeneratePasswordlessRegistrationChallenge is like GenerateMFARegistrationChallenge, but the
+// challenge may only be answered by a device which stores a discoverable credential, verifies its
+// user, and supports the PRF extension, so that the device can later be used for passwordless
+// login (see EnablePasswordlessUnlock).
+func (s *Session) GeneratePasswordlessRegistrationChallenge() (*warp.PublicKeyCredentialCreationOptions, error) {
+	return s.generateMFARegistrationChallenge(
+		warp.AuthenticatorSelection(warp.AuthenticatorSelectionCriteria{RequireResidentKey: true, UserVerification: warp.VerificationRequired}),
+		warp.Extensions(prfEnable))
+}
+
+func (s *Session) generateMFARegistrationChallenge(extra ...warp.Option) (*warp.PublicKeyCredentialCreationOptions, error) {
+	creds := s.h.credentialsOf(s.acct)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	opts, err := warp.StartRegistration(relyingParty{s.h}, user{s.h})
+	opts, err := warp.StartRegistration(relyingParty{s.h, s.originLocked()}, user{s.acct, creds}, extra...)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't generate MFA registration challenge: %w", err)
 	}
@@ -260,54 +2787,197 @@ func (s *Session) GetMFARegistrationChallenge() (*warp.PublicKeyCredentialCreati
 // CompleteMFARegistration completes registration of a new multi-factor authentication device with
 // the given registration response. It returns ErrNoChallenge if there is no existing challenge for
 // the given path, and ErrMFARegistrationFailed if it was not possible to complete registration with
-// the given response. On success, a credential is returned as would be passed to NewHandler.
-func (s *Session) CompleteMFARegistration(cred *warp.AttestationPublicKeyCredential) (string, error) {
+// the given response. On success, the new device, labeled with the given label, is registered for
+// the session's user & returned; it can be used to authenticate in any session immediately. The
+// device is persisted if WithCredentialFile was specified. Otherwise, it is registered only until
+// the server restarts: its Registration is as would be passed to NewHandler, or as one of the MFA
+// credentials of the session's User, so that it can be added to the configuration.
+//
+// After too many consecutive failures (see WithMaxMFARegistrationFailures), the session is closed
+// and ErrNoSession is returned.
+func (s *Session) CompleteMFARegistration(label string, cred *warp.AttestationPublicKeyCredential) (Credential, error) {
+	c, err := s.completeMFARegistration(label, cred)
+	if err := s.recordMFAAttempt(err, true); err != nil {
+		return Credential{}, err
+	}
+	if err := s.h.addCredential(s.acct, c); err != nil {
+		return Credential{}, fmt.Errorf("couldn't register MFA device: %w", err)
+	}
+	return c, nil
+}
+
+func (s *Session) completeMFARegistration(label string, cred *warp.AttestationPublicKeyCredential) (Credential, error) {
+	creds := s.h.credentialsOf(s.acct)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.lockedOut {
+		return Credential{}, ErrNoSession
+	}
 	if s.mfaRegChallenge == nil {
-		return "", ErrNoChallenge
+		return Credential{}, ErrNoChallenge
 	}
-	att, err := warp.FinishRegistration(relyingParty{s.h}, func(credID []byte) (warp.Credential, error) {
-		c, ok := s.h.mfaCredentials[base64.RawURLEncoding.EncodeToString(credID)]
+	att, err := warp.FinishRegistration(relyingParty{s.h, s.originLocked()}, func(credID []byte) (warp.Credential, error) {
+		c, ok := creds.byID[base64.RawURLEncoding.EncodeToString(credID)]
 		if !ok {
 			return nil, errors.New("no credential")
 		}
 		return c, nil
 	}, s.mfaRegChallenge, cred)
 	if err != nil {
-		return "", ErrMFARegistrationFailed
+		s.h.debugf("MFA registration for user %q rejected: %v", s.acct.name, err)
+		return Credential{}, ErrMFARegistrationFailed
 	}
-	encodedCred, err := encodeCredential(&att.AuthData.AttestedCredentialData)
+	data := &att.AuthData.AttestedCredentialData
+	encodedCred, err := encodeCredential(data)
 	if err != nil {
-		return "", fmt.Errorf("couldn't encode credential: %w", err)
+		return Credential{}, fmt.Errorf("couldn't encode credential: %w", err)
+	}
+	s.mfaRegChallenge = nil
+	return Credential{
+		ID:           base64.RawURLEncoding.EncodeToString(data.CredentialID),
+		Registration: encodedCred,
+		Label:        label,
+		RegisteredAt: s.h.clock.Now(),
+		AAGUID:       formatAAGUID(data.AAGUID),
+	}, nil
+}
+
+// formatAAGUID formats an AAGUID as a UUID, or returns the empty string if it
+// is all zeroes, as reported by devices which don't identify their model.
+func formatAAGUID(aaguid [16]byte) string {
+	if aaguid == [16]byte{} {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", aaguid[0:4], aaguid[4:6], aaguid[6:8], aaguid[8:10], aaguid[10:16])
+}
+
+// recordMFAAttempt records the result of an MFA assertion, or of an MFA
+// registration if registration is set, given the error returned by the
+// attempt. Success resets the count of consecutive failures. Once the count
+// reaches its limit, the session's challenges are cleared, the session is
+// closed, and an MFA_LOCKOUT alert is fired, exactly once even if failures
+// race. It returns err, or ErrNoSession if the session has been locked out.
+func (s *Session) recordMFAAttempt(err error, registration bool) error {
+	failed := errors.Is(err, ErrMFAAuthenticationFailed) || errors.Is(err, ErrMFACounterRegression) || errors.Is(err, ErrMFARegistrationFailed)
+	s.mu.Lock()
+	failures, limit, what := &s.mfaFailures, s.h.maxMFAFailures, "assertions"
+	if registration {
+		failures, limit, what = &s.mfaRegFailures, s.h.maxMFARegFailures, "registrations"
+	}
+	if !failed {
+		if err == nil {
+			*failures = 0
+		}
+		s.mu.Unlock()
+		return err
 	}
+	*failures++
+	if *failures < limit {
+		s.mu.Unlock()
+		return err
+	}
+	if s.lockedOut {
+		// A concurrent failure already locked out the session.
+		s.mu.Unlock()
+		return ErrNoSession
+	}
+	s.lockedOut = true
 	s.mfaRegChallenge = nil
-	return encodedCred, nil
+	s.mfaChallengePath = ""
+	s.mfaChallenge = nil
+	n := *failures
+	s.mu.Unlock()
+
+	// h.mu must not be acquired while holding s.mu.
+	s.h.lockOut(s, n, what)
+	return ErrNoSession
 }
 
 // IsMFAAuthenticated determines if the user has performed multi-factor authentication for any
-// path.
+// path. Sessions created from API tokens are considered authenticated for every path, since the
+// token was created by a session which had completed multi-factor authentication.
 func (s *Session) IsMFAAuthenticated() bool {
+	if s.apiTokenID != "" {
+		return true
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return len(s.authedPaths) > 0
 }
 
 // IsMFAAuthenticatedFor determines if the user has performed multi-factor authentication for the
-// given path.
+// given path recently enough that it is still remembered; see WithMFARemember & WithAlwaysReauth.
 func (s *Session) IsMFAAuthenticatedFor(path string) bool {
+	if s.apiTokenID != "" {
+		return true
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	_, ok := s.authedPaths[path]
+	return s.isMFAAuthenticatedForLocked(path)
+}
+
+// isMFAAuthenticatedForLocked implements IsMFAAuthenticatedFor. s.mu must be held.
+func (s *Session) isMFAAuthenticatedForLocked(path string) bool {
+	authedAt, ok := s.authedPaths[path]
+	if !ok {
+		return false
+	}
+	remember := s.h.mfaRemember
+	if s.h.alwaysReauth(path) && (remember == 0 || remember > freshMFADuration) {
+		remember = freshMFADuration
+	}
+	return remember == 0 || s.h.clock.Now().Before(authedAt.Add(remember))
+}
+
+// TakeMFAAuthentication determines if the user has performed multi-factor authentication for the
+// given path as IsMFAAuthenticatedFor does, or for any path if path is empty. If so, the session's
+// authentication is forgotten for every path, so that each assertion authenticates a single
+// request.
+func (s *Session) TakeMFAAuthentication(path string) bool {
+	if s.apiTokenID != "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := len(s.authedPaths) > 0
+	if path != "" {
+		ok = s.isMFAAuthenticatedForLocked(path)
+	}
+	if ok {
+		s.authedPaths = map[string]time.Time{}
+		s.mfaTaken = true
+	}
 	return ok
 }
 
-// GenerateMFAChallenge generates a new multi-factor authentication challenge for the given path. It
-// replaces any previous MFA challenges that may exist for this or any other paths.
+// CredentialsPath is the path for which multi-factor authentication must be
+// performed before removing a registered MFA device. As for paths beneath the
+// prefixes passed to WithAlwaysReauth, authentication for it is remembered only
+// briefly. It is not a valid entry name.
+const CredentialsPath = "#_MFA_CREDENTIALS_#"
+
+// alwaysReauth determines if the given path is CredentialsPath, or is beneath
+// one of the prefixes passed to WithAlwaysReauth.
+func (h *Handler) alwaysReauth(path string) bool {
+	if path == CredentialsPath {
+		return true
+	}
+	for _, p := range h.alwaysReauthPrefixes {
+		if strings.HasPrefix(path+"/", p) {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateMFAChallenge generates a new multi-factor authentication challenge for the given path,
+// which only the MFA devices of the session's user can answer. It replaces any previous MFA
+// challenges that may exist for this or any other paths.
 func (s *Session) GenerateMFAChallenge(path string) (*warp.PublicKeyCredentialRequestOptions, error) {
+	creds := s.h.credentialsOf(s.acct)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	opts, err := warp.StartAuthentication(warp.AllowCredentials(s.h.mfaCredentialDescriptors), warp.RelyingPartyID(s.h.domain))
+	opts, err := warp.StartAuthentication(warp.AllowCredentials(creds.descriptors), warp.RelyingPartyID(s.h.domain))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't generate MFA challenge: %w", err)
 	}
@@ -329,30 +2999,248 @@ func (s *Session) GetMFAChallenge(path string) (*warp.PublicKeyCredentialRequest
 
 // AuthenticateMFAResponse authenticates the user for the given path with the given multi-factor
 // authentication signing response. It returns ErrNoChallenge if there is no existing challenge for
-// the given path, and ErrMFAAuthenticationFailed if it was not possible to authenticate the user
-// with the given MFA signing response.
-func (s *Session) AuthenticateMFAResponse(path string, cred *warp.AssertionPublicKeyCredential) error {
+// the given path, ErrMFACounterRegression if the MFA device's signature counter did not increase
+// (which may indicate a cloned device), and ErrMFAAuthenticationFailed if it was not possible to
+// authenticate the user with the given MFA signing response.
+//
+// On success, the session is re-keyed under a new session ID, which is
+// returned; the old session ID is no longer valid. This ensures that a session
+// ID observed before authentication completed can't be used afterwards.
+//
+// After too many consecutive failures (see WithMaxMFAFailures), the session is
+// closed and ErrNoSession is returned.
+func (s *Session) AuthenticateMFAResponse(path string, cred *warp.AssertionPublicKeyCredential) (string, error) {
+	if err := s.recordMFAAttempt(s.authenticateMFAResponse(path, cred), false); err != nil {
+		return "", err
+	}
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+	newID, err := s.h.rotateSessionIDLocked(s)
+	if err != nil {
+		return "", fmt.Errorf("couldn't rotate session ID: %w", err)
+	}
+	return newID, nil
+}
+
+func (s *Session) authenticateMFAResponse(path string, cred *warp.AssertionPublicKeyCredential) error {
+	creds := s.h.credentialsOf(s.acct)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.lockedOut {
+		return ErrNoSession
+	}
 	if s.mfaChallengePath != path || s.mfaChallenge == nil {
 		return ErrNoChallenge
 	}
-
-	if _, err := warp.FinishAuthentication(relyingParty{s.h}, func(_ []byte) (warp.User, error) { return user{s.h}, nil }, s.mfaChallenge, cred); err != nil {
-		return ErrMFAAuthenticationFailed
+	if err := s.h.finishAuthentication(s.acct, s.originLocked(), creds, s.mfaChallenge, cred); err != nil {
+		return err
 	}
 
-	if len(s.authedPaths) == 0 {
-		s.h.alert(alert.LOGIN, fmt.Sprintf("New session authenticated."))
+	if len(s.authedPaths) == 0 && !s.mfaTaken {
+		s.h.userAlert(s.acct.name, alert.LOGIN, fmt.Sprintf("New session authenticated."))
 	}
-	s.authedPaths[path] = struct{}{}
+	s.authedPaths[path] = s.h.clock.Now()
 	s.mfaChallengePath = ""
 	s.mfaChallenge = nil
 	return nil
 }
 
-// HasRegisteredMFADevice returns true if & only if there is at least one registered MFA deviec.
-func (s *Session) HasRegisteredMFADevice() bool { return len(s.h.mfaCredentials) > 0 }
+// finishAuthentication verifies an assertion made at the given origin by one of the given MFA
+// devices of the given account in answer to the given challenge, storing the device's new signature counter. It returns
+// ErrMFACounterRegression, and fires an MFA_COUNTER_REGRESSION alert, if the device's signature
+// counter did not increase, and ErrMFAAuthenticationFailed if the assertion is not accepted.
+func (h *Handler) finishAuthentication(a *account, origin string, creds *credentialSet, challenge *warp.PublicKeyCredentialRequestOptions, cred *warp.AssertionPublicKeyCredential) error {
+	credID := base64.RawURLEncoding.EncodeToString(cred.RawID)
+	storedCount := h.counters.Get(credID)
+	authData, err := warp.FinishAuthentication(relyingParty{h, origin}, func(_ []byte) (warp.User, error) { return user{a, creds}, nil }, challenge, cred)
+	if err != nil {
+		h.debugf("MFA assertion for user %q rejected: %v", a.name, err)
+		// The assertion may have been rejected due to its signature counter. Check the
+		// (unverified) counter in the response so that we can alert on likely cloned devices.
+		if signCount, ok := rawSignCount(cred.Response.AuthenticatorData); ok && checkSignCount(storedCount, signCount) != nil {
+			h.userAlert(a.name, alert.MFA_COUNTER_REGRESSION, fmt.Sprintf("MFA device presented signature counter %d, but the stored counter is %d. The device may have been cloned. (The assertion also failed verification.)", signCount, storedCount))
+			h.metrics.mfaFailures.With("counter_regression").Inc()
+			return ErrMFACounterRegression
+		}
+		h.metrics.mfaFailures.With("failed").Inc()
+		return ErrMFAAuthenticationFailed
+	}
+	// The counter is checked again as it is stored, since a concurrent assertion may have
+	// advanced it since it was read.
+	if err := h.counters.Advance(credID, authData.SignCount); err != nil {
+		var re *counter.RegressionError
+		if errors.As(err, &re) {
+			h.metrics.mfaFailures.With("counter_regression").Inc()
+			h.userAlert(a.name, alert.MFA_COUNTER_REGRESSION, fmt.Sprintf("MFA device presented signature counter %d, but the stored counter is %d. The device may have been cloned.", re.Value, re.Stored))
+			return ErrMFACounterRegression
+		}
+		if !errors.Is(err, counter.ErrNotPersisted) {
+			return fmt.Errorf("couldn't store MFA signature counter: %w", err)
+		}
+		// The counter is kept in memory until it can be persisted, so cloned
+		// devices are still detected unless harpd restarts in the meantime.
+		log.Printf("Could not persist MFA signature counter: %v", err)
+		h.alert(alert.COUNTER_PERSISTENCE_DEGRADED, fmt.Sprintf("MFA signature counters could not be written to disk (%v). Authentication continues, with counters kept in memory; writing them will be retried.", err))
+	}
+	return nil
+}
+
+// passwordlessPath is the path for which multi-factor authentication is performed when enabling
+// passwordless login. It is not a valid entry name.
+const passwordlessPath = "#_PASSWORDLESS_#"
+
+// GeneratePasswordlessEnrollmentChallenge generates a new multi-factor authentication challenge
+// with which to enable passwordless login via EnablePasswordlessUnlock. As for passwordless login,
+// no credentials are named, so only a discoverable credential can answer it; it must belong to one
+// of the MFA devices of the session's user, which may be registered after the challenge is
+// generated. The device must verify its user, and is asked for the output of its PRF extension. It
+// replaces any previous MFA challenges that may exist.
+func (s *Session) GeneratePasswordlessEnrollmentChallenge() (*warp.PublicKeyCredentialRequestOptions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts, err := warp.StartAuthentication(warp.RelyingPartyID(s.h.domain), warp.UserVerification(warp.VerificationRequired), warp.Extensions(prfEval))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate MFA challenge: %w", err)
+	}
+	s.mfaChallengePath = passwordlessPath
+	s.mfaChallenge = opts
+	return opts, nil
+}
+
+// EnablePasswordlessUnlock allows the MFA device which made the given assertion, in answer to a
+// challenge from GeneratePasswordlessEnrollmentChallenge, to log in in place of the given
+// passphrase (see Handler.CreatePasswordlessSessionAsync), and fires a PASSWORDLESS_ENABLED alert.
+// The passphrase is wrapped with a key derived from the given output of the device's PRF
+// extension, which the device can compute again but the server can't; only the device's
+// discoverable credentials can be used to log in. The passphrase is checked as CreateAPIToken
+// checks it.
+//
+// It returns ErrPRFUnsupported if no PRF output is given, since the device does not support the
+// extension; ErrNoChallenge, ErrMFACounterRegression, ErrMFAAuthenticationFailed & ErrNoSession as
+// AuthenticateMFAResponse does; and secret.ErrWrongPassphrase if the passphrase unlocks no vault.
+func (s *Session) EnablePasswordlessUnlock(passphrase string, cred *warp.AssertionPublicKeyCredential, prfOutput []byte) error {
+	h := s.h
+	if h.passwordless == nil {
+		return errors.New("passwordless login is not enabled")
+	}
+	if len(prfOutput) != prfOutputLength {
+		return ErrPRFUnsupported
+	}
+	if err := s.recordMFAAttempt(s.authenticateMFAResponse(passwordlessPath, cred), false); err != nil {
+		return err
+	}
+	if err := s.checkPassphrase(passphrase); err != nil {
+		return err
+	}
+	credID := base64.RawURLEncoding.EncodeToString(cred.RawID)
+	if err := h.passwordless.Wrap(credID, s.acct.name, prfOutput, passphrase, h.clock.Now()); err != nil {
+		return fmt.Errorf("couldn't wrap passphrase: %w", err)
+	}
+	h.userAlert(s.acct.name, alert.PASSWORDLESS_ENABLED, fmt.Sprintf("Passwordless login enabled for MFA device %q by client %s.", h.credentialLabel(s.acct, credID), s.clientID))
+	return nil
+}
+
+// prfEnable asks an MFA device being registered to enable its PRF extension.
+func prfEnable(in warp.AuthenticationExtensionsClientInputs) {
+	in["prf"] = map[string]interface{}{}
+}
+
+// prfEval asks an MFA device making an assertion for the output of its PRF
+// extension on passwordlessPRFInput.
+func prfEval(in warp.AuthenticationExtensionsClientInputs) {
+	in["prf"] = map[string]interface{}{
+		"eval": map[string][]byte{"first": passwordlessPRFInput[:]},
+	}
+}
+
+// instrumentedStore wraps a secret.Store, recording the duration and failures
+// of each operation.
+type instrumentedStore struct {
+	s      secret.Store
+	ops    *metrics.SummaryVec
+	errors *metrics.CounterVec
+}
+
+func (is instrumentedStore) Unwrap() secret.Store { return is.s }
+
+func (is instrumentedStore) List() ([]string, error) {
+	defer is.observe("list", time.Now())
+	entries, err := is.s.List()
+	is.checkErr("list", err)
+	return entries, err
+}
+
+func (is instrumentedStore) Get(entry string) (string, error) {
+	defer is.observe("get", time.Now())
+	content, err := is.s.Get(entry)
+	is.checkErr("get", err)
+	return content, err
+}
+
+func (is instrumentedStore) Put(entry, content string) error {
+	defer is.observe("put", time.Now())
+	err := is.s.Put(entry, content)
+	is.checkErr("put", err)
+	return err
+}
+
+func (is instrumentedStore) PutIf(entry, content, expectedHash string) error {
+	defer is.observe("put", time.Now())
+	err := secret.PutIf(is.s, entry, content, expectedHash)
+	is.checkErr("put", err)
+	return err
+}
+
+func (is instrumentedStore) Delete(entry string) error {
+	defer is.observe("delete", time.Now())
+	err := is.s.Delete(entry)
+	is.checkErr("delete", err)
+	return err
+}
+
+func (is instrumentedStore) Move(oldEntry, newEntry string) error {
+	defer is.observe("move", time.Now())
+	err := is.s.Move(oldEntry, newEntry)
+	is.checkErr("move", err)
+	return err
+}
+
+func (is instrumentedStore) observe(op string, start time.Time) {
+	is.ops.Observe(op, time.Since(start))
+}
+
+// checkErr counts err as a failure of the given operation, unless it is nil or
+// indicates an expected condition (such as a nonexistent entry).
+func (is instrumentedStore) checkErr(op string, err error) {
+	if err != nil && !errors.Is(err, secret.ErrNoEntry) && !errors.Is(err, secret.ErrEntryExists) && !errors.Is(err, secret.ErrConflict) {
+		is.errors.With(op).Inc()
+	}
+}
+
+// HasRegisteredMFADevice returns true if & only if the session's user has at least one registered
+// MFA device.
+func (s *Session) HasRegisteredMFADevice() bool { return len(s.h.credentialsOf(s.acct).list) > 0 }
+
+// checkSignCount returns ErrMFACounterRegression if a signature counter of
+// signCount is not acceptable given the stored counter for the same device.
+// Devices that do not implement signature counters always report 0.
+func checkSignCount(storedCount, signCount uint32) error {
+	if !counter.Advances(storedCount, signCount) {
+		return ErrMFACounterRegression
+	}
+	return nil
+}
+
+// rawSignCount extracts the signature counter from serialized authenticator
+// data, without verifying it in any way.
+func rawSignCount(authData []byte) (uint32, bool) {
+	// Authenticator data is a 32-byte RP ID hash, a 1-byte flags field, then a 4-byte big-endian
+	// signature counter.
+	if len(authData) < 37 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(authData[33:37]), true
+}
 
 func encodeCredential(cred *warp.AttestedCredentialData) (string, error) {
 	var buf bytes.Buffer
@@ -0,0 +1,2485 @@
+package session
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e3b0c442/warp"
+
+	"github.com/BranLwyd/harpocrates/harpd/alert"
+	"github.com/BranLwyd/harpocrates/harpd/apitoken"
+	"github.com/BranLwyd/harpocrates/harpd/authlog"
+	"github.com/BranLwyd/harpocrates/harpd/counter"
+	"github.com/BranLwyd/harpocrates/harpd/device"
+	"github.com/BranLwyd/harpocrates/harpd/metrics"
+	"github.com/BranLwyd/harpocrates/harpd/passwordless"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestCheckSignCount(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		storedCount, signCount uint32
+		wantErr                bool
+	}{
+		{0, 0, false}, // device doesn't implement counters
+		{0, 1, false},
+		{5, 6, false},
+		{5, 100, false},
+		{5, 5, true},
+		{5, 4, true},
+		{5, 0, true},
+	} {
+		if err := checkSignCount(test.storedCount, test.signCount); (err != nil) != test.wantErr {
+			t.Errorf("checkSignCount(%d, %d) = %v, want error: %v", test.storedCount, test.signCount, err, test.wantErr)
+		}
+	}
+}
+
+func TestSignCountPersistence(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	counterFile := filepath.Join(dir, "counters")
+	newCred := func() credential {
+		t.Helper()
+		cs, err := counter.NewStore(counterFile)
+		if err != nil {
+			t.Fatalf("Could not create counter store: %v", err)
+		}
+		h, err := NewHandler(nil, "https://example.com", nil, cs, time.Minute, 1, alert.NewLog())
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+		return credential{h: h, c: &warp.AttestedCredentialData{CredentialID: []byte("cred")}}
+	}
+
+	// Counters stored via one handler are visible to the credentials of a later handler.
+	cred := newCred()
+	if got := cred.CredentialSignCount(); got != 0 {
+		t.Errorf("Initial sign count was %d, want 0", got)
+	}
+	if err := cred.h.counters.Set("Y3JlZA", 17); err != nil { // base64url("cred")
+		t.Fatalf("Could not set counter: %v", err)
+	}
+	if got := newCred().CredentialSignCount(); got != 17 {
+		t.Errorf("Sign count after restart was %d, want 17", got)
+	}
+}
+
+func TestParseOrigin(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		origin, wantOrigin, wantDomain string
+	}{
+		{"https://example.com", "https://example.com", "example.com"},
+		{"https://example.com:8443", "https://example.com:8443", "example.com"},
+		{"https://Example.COM", "https://example.com", "example.com"},
+		{"HTTPS://example.com:443", "https://example.com", "example.com"},
+		{"http://localhost:8080", "http://localhost:8080", "localhost"},
+		{"http://127.0.0.1", "http://127.0.0.1", "127.0.0.1"},
+		{"http://[::1]:8080", "http://[::1]:8080", "::1"},
+	} {
+		gotOrigin, gotDomain, err := parseOrigin(test.origin)
+		if err != nil || gotOrigin != test.wantOrigin || gotDomain != test.wantDomain {
+			t.Errorf("parseOrigin(%q) = (%q, %q, %v), want (%q, %q, nil)", test.origin, gotOrigin, gotDomain, err, test.wantOrigin, test.wantDomain)
+		}
+	}
+
+	for _, origin := range []string{
+		"",
+		"example.com",
+		"http://example.com",
+		"ftp://example.com",
+		"https://",
+		"https://example.com/",
+		"https://example.com/harpd",
+		"https://example.com?q",
+		"https://user@example.com",
+		"https://example.com:",
+		"https://example.com:http",
+		"https://example.com:70000",
+		"https://example.com:8443:1",
+	} {
+		if got, _, err := parseOrigin(origin); err == nil {
+			t.Errorf("parseOrigin(%q) = %q, want error", origin, got)
+		}
+	}
+
+	// The handler uses the canonical origin, and its host as relying party ID.
+	if _, err := NewHandler(fakeVault{}, "https://example.com/", nil, nil, time.Minute, 1000, alert.NewLog()); err == nil {
+		t.Errorf("NewHandler with origin with path succeeded, want error")
+	}
+	h, err := NewHandler(fakeVault{}, "https://Example.com:8443", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if got, want := h.Origin(), "https://example.com:8443"; got != want {
+		t.Errorf("Origin() = %q, want %q", got, want)
+	}
+	if got, want := h.RelyingPartyID(), "example.com"; got != want {
+		t.Errorf("RelyingPartyID() = %q, want %q", got, want)
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		origin string
+		wantOK bool
+	}{
+		{"https://example.com", true},
+		{"https://example.com:8443", true},
+		{"https://lan.example.com:8443", true},
+		{"https://a.b.Example.com", true},
+		{"https://other.org", false},
+		{"https://harpabcdef.onion", false},
+		{"https://notexample.com", false},
+		{"http://lan.example.com", false},
+		{"https://lan.example.com/", false},
+	} {
+		if err := CheckOrigin("https://example.com", test.origin); (err == nil) != test.wantOK {
+			t.Errorf("CheckOrigin(%q) = %v, want ok = %v", test.origin, err, test.wantOK)
+		}
+		_, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithOrigins(test.origin))
+		if (err == nil) != test.wantOK {
+			t.Errorf("NewHandler(WithOrigins(%q)) returned error %v, want ok = %v", test.origin, err, test.wantOK)
+		}
+	}
+	// Devices registered for an IP address can't be used at any other host.
+	if err := CheckOrigin("http://127.0.0.1:8080", "http://localhost:8080"); err == nil {
+		t.Errorf("CheckOrigin with IP address relying party ID succeeded, want error")
+	}
+
+	// Sessions perform MFA at the handler's origin unless set otherwise.
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithOrigins("https://lan.example.com:8443"))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "agent", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if got, want := sess.Origin(), "https://example.com"; got != want {
+		t.Errorf("Origin() = %q, want %q", got, want)
+	}
+	if err := sess.SetOrigin("HTTPS://LAN.example.com:8443"); err != nil {
+		t.Fatalf("Could not set origin: %v", err)
+	}
+	if got, want := sess.Origin(), "https://lan.example.com:8443"; got != want {
+		t.Errorf("After SetOrigin, Origin() = %q, want %q", got, want)
+	}
+	if err := sess.SetOrigin("https://other.example.com"); err == nil {
+		t.Errorf("SetOrigin with origin not passed to WithOrigins succeeded, want error")
+	}
+	if got, want := sess.Origin(), "https://lan.example.com:8443"; got != want {
+		t.Errorf("After failed SetOrigin, Origin() = %q, want %q", got, want)
+	}
+	if err := sess.SetOrigin(""); err != nil {
+		t.Fatalf("Could not reset origin: %v", err)
+	}
+	if got, want := sess.Origin(), "https://example.com"; got != want {
+		t.Errorf("After resetting origin, Origin() = %q, want %q", got, want)
+	}
+}
+
+func TestCloseAllSessions(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	var sessIDs []string
+	for i := 0; i < 3; i++ {
+		sessID, _, err := h.CreateSession(fmt.Sprintf("client%d", i), "", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		sessIDs = append(sessIDs, sessID)
+	}
+	if got := h.ActiveSessionCount(); got != 3 {
+		t.Errorf("ActiveSessionCount = %d, want 3", got)
+	}
+
+	if got := h.CloseAllSessions(); got != 3 {
+		t.Errorf("CloseAllSessions = %d, want 3", got)
+	}
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("ActiveSessionCount after CloseAllSessions = %d, want 0", got)
+	}
+	for _, sessID := range sessIDs {
+		if _, err := h.GetSession(sessID); err != ErrNoSession {
+			t.Errorf("GetSession after CloseAllSessions returned error %v, want %v", err, ErrNoSession)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, first, err := h.CreateSession("client1", "agent1", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	created := c.Now()
+	c.Advance(10 * time.Second)
+	secondID, second, err := h.CreateSession("client2", "agent2", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	second.mu.Lock()
+	second.authedPaths["/"] = c.Now()
+	second.mu.Unlock()
+	c.Advance(10 * time.Second)
+	if err := second.Touch(); err != nil {
+		t.Fatalf("Could not touch session: %v", err)
+	}
+
+	infos := h.Sessions()
+	if len(infos) != 2 {
+		t.Fatalf("Sessions() returned %d sessions, want 2", len(infos))
+	}
+	if got, want := infos[0], (SessionInfo{ID: first.PublicID(), ClientID: "client1", Fingerprint: "agent1", CreatedAt: created, LastActiveAt: created, ExpiresAt: created.Add(time.Minute)}); got != want {
+		t.Errorf("Sessions()[0] = %+v, want %+v", got, want)
+	}
+	if got := infos[1]; got.ID != second.PublicID() || !got.MFAAuthenticated || !got.LastActiveAt.Equal(c.Now()) || !got.LastActiveAt.After(got.CreatedAt) {
+		t.Errorf("Sessions()[1] = %+v, want authenticated session %q last active at %v", got, second.PublicID(), c.Now())
+	}
+	if first.PublicID() == second.PublicID() || strings.Contains(secondID, second.PublicID()) {
+		t.Errorf("Public IDs %q & %q are not distinct from each other and from session IDs", first.PublicID(), second.PublicID())
+	}
+
+	// Sessions can be closed by public ID, but not by session ID.
+	if err := h.CloseSessionByID(secondID); err != ErrNoSession {
+		t.Errorf("CloseSessionByID(session ID) returned error %v, want %v", err, ErrNoSession)
+	}
+	if err := h.CloseSessionByID(first.PublicID()); err != nil {
+		t.Errorf("Could not close session by ID: %v", err)
+	}
+	if infos := h.Sessions(); len(infos) != 1 || infos[0].ID != second.PublicID() {
+		t.Errorf("After closing first session, Sessions() = %+v, want only the second session", infos)
+	}
+	if err := h.CloseSessionByID(first.PublicID()); err != ErrNoSession {
+		t.Errorf("CloseSessionByID of closed session returned error %v, want %v", err, ErrNoSession)
+	}
+	if got := ra.count(alert.SESSIONS_REVOKED); got != 1 {
+		t.Errorf("Got %d SESSIONS_REVOKED alerts, want 1", got)
+	}
+
+	// Expired sessions are omitted, even before their expiration timers run.
+	c.AdvanceWithoutFiring(time.Minute)
+	if infos := h.Sessions(); len(infos) != 0 {
+		t.Errorf("After expiration, Sessions() = %+v, want none", infos)
+	}
+}
+
+func TestSessionsRacesExpiration(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Second, 1e6, alert.NewLog(), WithClock(c), WithNewSessionBurst(1000))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	// Sessions are created, touched & expired while snapshots are taken.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			_, sess, err := h.CreateSession("client", "", "password")
+			if err != nil {
+				t.Errorf("Could not create session: %v", err)
+				return
+			}
+			sess.Touch()
+			c.Advance(100 * time.Millisecond)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, info := range h.Sessions() {
+					if info.ID == "" || info.CreatedAt.IsZero() {
+						t.Errorf("Sessions() returned incomplete snapshot %+v", info)
+					}
+					h.CloseSessionByID(info.ID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetSessionRacesClose(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Second, 1e6, alert.NewLog(), WithClock(c), WithNewSessionBurst(1000))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	// Each session is repeatedly fetched, extending its expiration timeout,
+	// while it is closed or expires.
+	for i := 0; i < 200; i++ {
+		id, sess, err := h.CreateSession("client", "", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		sess.mu.Lock()
+		sess.authedPaths["/"] = c.Now()
+		sess.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := h.GetSession(id); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		if i%2 == 0 {
+			sess.Close()
+		} else {
+			c.Advance(time.Second)
+		}
+		sess.Close()
+		wg.Wait()
+
+		if err := sess.Touch(); err != ErrNoSession {
+			t.Errorf("Touch on closed session returned error %v, want %v", err, ErrNoSession)
+		}
+	}
+
+	// No closed session has an expiration timer left running.
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("ActiveSessionCount() = %d, want 0", got)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tmr := range c.timers {
+		if tmr.active {
+			t.Fatalf("Expiration timer of closed session still active")
+		}
+	}
+}
+
+func TestTouch(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	partialID, partial, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.mu.Lock()
+	sess.authedPaths["/"] = c.Now()
+	sess.mu.Unlock()
+
+	// Partially-authenticated sessions are not extended.
+	exp := partial.ExpiresAt()
+	c.Advance(30 * time.Second)
+	if err := partial.Touch(); err != nil {
+		t.Fatalf("Could not touch session: %v", err)
+	}
+	if got := partial.ExpiresAt(); !got.Equal(exp) {
+		t.Errorf("Touch extended partially-authenticated session from %v to %v", exp, got)
+	}
+
+	// Fully-authenticated sessions are extended.
+	if err := sess.Touch(); err != nil {
+		t.Fatalf("Could not touch session: %v", err)
+	}
+	if got, want := sess.ExpiresAt(), exp.Add(30*time.Second); !got.Equal(want) {
+		t.Errorf("Touch set authenticated session's expiry to %v, want %v", got, want)
+	}
+	c.Advance(30 * time.Second)
+	if _, err := h.GetSession(partialID); err != ErrNoSession {
+		t.Errorf("GetSession for expired partially-authenticated session returned error %v, want %v", err, ErrNoSession)
+	}
+	if err := sess.Touch(); err != nil {
+		t.Errorf("Could not touch extended session: %v", err)
+	}
+
+	// Closed sessions cannot be extended.
+	sess.Close()
+	if err := sess.Touch(); err != ErrNoSession {
+		t.Errorf("Touch on closed session returned error %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c), WithMaxLifetime(150*time.Second))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	start := c.Now()
+	sid, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.mu.Lock()
+	sess.authedPaths["/"] = c.Now()
+	sess.mu.Unlock()
+	if got, want := sess.AbsoluteDeadline(), start.Add(150*time.Second); !got.Equal(want) {
+		t.Errorf("AbsoluteDeadline() = %v, want %v", got, want)
+	}
+
+	// Using the session extends it, but never past its deadline.
+	for _, test := range []struct {
+		at            time.Duration
+		wantExpiresAt time.Duration
+	}{
+		{50 * time.Second, 110 * time.Second},
+		{100 * time.Second, 150 * time.Second},
+		{149 * time.Second, 150 * time.Second},
+	} {
+		c.Advance(start.Add(test.at).Sub(c.Now()))
+		if _, err := h.GetSession(sid); err != nil {
+			t.Fatalf("Could not get session at %v: %v", test.at, err)
+		}
+		if got, want := sess.ExpiresAt(), start.Add(test.wantExpiresAt); !got.Equal(want) {
+			t.Errorf("At %v, ExpiresAt() = %v, want %v", test.at, got, want)
+		}
+	}
+
+	// Once the deadline is reached, the session is closed.
+	c.Advance(time.Second)
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("After deadline, ActiveSessionCount() = %d, want 0", got)
+	}
+	if _, err := h.GetSession(sid); err != ErrNoSession {
+		t.Errorf("GetSession after deadline returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// Without a maximum lifetime, sessions have no deadline.
+	h, err = NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if _, sess, err = h.CreateSession("client", "", "password"); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if got := sess.AbsoluteDeadline(); !got.IsZero() {
+		t.Errorf("Without a maximum lifetime, AbsoluteDeadline() = %v, want zero", got)
+	}
+}
+
+func TestMFARemember(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc     string
+		remember time.Duration
+		path     string
+		wantLast time.Duration // how long authentication for path is remembered; zero for the life of the session
+	}{
+		{"default", 0, "/email", 0},
+		{"remembered", 10 * time.Minute, "/email", 10 * time.Minute},
+		{"always reauth", 10 * time.Minute, "/bank/account", freshMFADuration},
+		{"always reauth, default", 0, "/bank/account", freshMFADuration},
+		{"always reauth, short remember", 30 * time.Second, "/bank/account", 30 * time.Second},
+		{"always reauth, directory", 0, "/bank/", freshMFADuration},
+		{"not beneath prefix", 0, "/bankrupt", 0},
+		{"credentials", 10 * time.Minute, CredentialsPath, freshMFADuration},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			c := newFakeClock()
+			h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Hour, 1000, alert.NewLog(), WithClock(c), WithMFARemember(test.remember), WithAlwaysReauth("/bank/"))
+			if err != nil {
+				t.Fatalf("Could not create handler: %v", err)
+			}
+			sid, sess, err := h.CreateSession("client", "", "password")
+			if err != nil {
+				t.Fatalf("Could not create session: %v", err)
+			}
+			if sess.IsMFAAuthenticatedFor(test.path) {
+				t.Fatalf("IsMFAAuthenticatedFor(%q) = true before authentication", test.path)
+			}
+			sess.mu.Lock()
+			sess.authedPaths[test.path] = c.Now()
+			sess.mu.Unlock()
+
+			last := test.wantLast
+			if last == 0 {
+				last = 59 * time.Minute // the life of the session
+			}
+			c.Advance(last - time.Nanosecond)
+			if !sess.IsMFAAuthenticatedFor(test.path) {
+				t.Errorf("IsMFAAuthenticatedFor(%q) = false after %v", test.path, last-time.Nanosecond)
+			}
+			c.Advance(time.Nanosecond)
+			if got, want := sess.IsMFAAuthenticatedFor(test.path), test.wantLast == 0; got != want {
+				t.Errorf("IsMFAAuthenticatedFor(%q) = %v after %v, want %v", test.path, got, last, want)
+			}
+
+			// The session itself remains authenticated.
+			if !sess.IsMFAAuthenticated() {
+				t.Errorf("IsMFAAuthenticated() = false after per-path authentication expired")
+			}
+			if _, err := h.GetSession(sid); err != nil {
+				t.Errorf("Could not get session after per-path authentication expired: %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		binding    Binding
+		wantErr    error
+		wantAlerts int
+	}{
+		{BindingOff, nil, 0},
+		{BindingWarn, nil, 1},
+		{BindingEnforce, ErrNoSession, 1},
+	} {
+		ra := &recordingAlerter{}
+		h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithBinding(test.binding))
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+		sid, sess, err := h.CreateSession("1.2.3.4", "browser", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+
+		// The creating client can always use the session.
+		if got, err := h.GetSessionFor(sid, "1.2.3.4", "browser"); err != nil || got != sess {
+			t.Errorf("[%v] GetSessionFor(creating client) = (%p, %v), want (%p, nil)", test.binding, got, err, sess)
+		}
+
+		// Other clients may or may not, depending on the binding.
+		for _, client := range [][2]string{{"5.6.7.8", "browser"}, {"1.2.3.4", "other browser"}} {
+			got, err := h.GetSessionFor(sid, client[0], client[1])
+			if err != test.wantErr || (err == nil && got != sess) {
+				t.Errorf("[%v] GetSessionFor(%q, %q) = (%p, %v), want error %v", test.binding, client[0], client[1], got, err, test.wantErr)
+			}
+		}
+		if got := ra.count(alert.SESSION_HIJACK_SUSPECTED); got != test.wantAlerts {
+			t.Errorf("[%v] Got %d SESSION_HIJACK_SUSPECTED alerts, want %d", test.binding, got, test.wantAlerts)
+		}
+	}
+}
+
+func TestRotateSessionID(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	oldID, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// Look up the session by its old ID concurrently with rotation. Each
+	// lookup must either find the session or fail with ErrNoSession.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if got, err := h.GetSession(oldID); err != nil && err != ErrNoSession {
+					t.Errorf("GetSession during rotation returned unexpected error: %v", err)
+					return
+				} else if err == nil && got != sess {
+					t.Errorf("GetSession during rotation returned a different session")
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	newID, err := h.RotateSessionID(oldID)
+	if err != nil {
+		t.Fatalf("Could not rotate session ID: %v", err)
+	}
+
+	// Immediately after rotation, the old ID is invalid and the new ID is valid.
+	if _, err := h.GetSession(oldID); err != ErrNoSession {
+		t.Errorf("GetSession(oldID) after rotation returned error %v, want %v", err, ErrNoSession)
+	}
+	close(stop)
+	wg.Wait()
+	if newID == oldID {
+		t.Errorf("Rotated session ID was unchanged")
+	}
+	if got, err := h.GetSession(newID); err != nil || got != sess {
+		t.Errorf("GetSession(newID) after rotation = (%p, %v), want (%p, nil)", got, err, sess)
+	}
+	if _, err := h.RotateSessionID(oldID); err != ErrNoSession {
+		t.Errorf("RotateSessionID(oldID) after rotation returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// A rotated session can still be closed.
+	sess.Close()
+	if _, err := h.GetSession(newID); err != ErrNoSession {
+		t.Errorf("GetSession after Close returned error %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestRotatedSessionExpires(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	oldID, _, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	newID, err := h.RotateSessionID(oldID)
+	if err != nil {
+		t.Fatalf("Could not rotate session ID: %v", err)
+	}
+	c.Advance(time.Minute)
+	if _, err := h.GetSession(newID); err != ErrNoSession {
+		t.Errorf("GetSession after expiration returned error %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestSessionCloseWipesStore(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	v := &wipingVault{}
+	h, err := NewHandler(v, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c), WithNewSessionBurst(3), WithStoreCache(time.Minute, 10))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	var sessions []*Session
+	for i := 0; i < 3; i++ {
+		_, sess, err := h.CreateSession("client", "", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		sessions = append(sessions, sess)
+		if i == 1 {
+			c.Advance(time.Second)
+		}
+	}
+	wipes := func() []int {
+		var ws []int
+		for _, s := range v.stores {
+			ws = append(ws, s.wipeCount())
+		}
+		return ws
+	}
+
+	// Each way of closing a session wipes its store, once.
+	sessions[0].Close()
+	sessions[0].Close()
+	if got, want := fmt.Sprint(wipes()), "[1 0 0]"; got != want {
+		t.Errorf("After Close, wipes = %s, want %s", got, want)
+	}
+	c.Advance(time.Minute - time.Second)
+	if got, want := fmt.Sprint(wipes()), "[1 1 0]"; got != want {
+		t.Errorf("After expiration, wipes = %s, want %s", got, want)
+	}
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Could not shut down: %v", err)
+	}
+	if got, want := fmt.Sprint(wipes()), "[1 1 1]"; got != want {
+		t.Errorf("After Shutdown, wipes = %s, want %s", got, want)
+	}
+}
+
+func TestCreateSessionAsync(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	v := &blockingVault{release: make(chan struct{})}
+	h, err := NewHandler(v, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c), WithNewSessionBurst(3), WithBinding(BindingEnforce))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	// While the vault is being unlocked, the session is pending, for the creating client only.
+	sid, p, err := h.CreateSessionAsync("client", "browser", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if got, err := h.LookupPendingSessionFor(sid, "client", "browser"); err != nil || got != p {
+		t.Errorf("LookupPendingSessionFor(creating client) = (%p, %v), want (%p, nil)", got, err, p)
+	}
+	if _, err := h.LookupPendingSessionFor(sid, "other client", "browser"); err != ErrNoSession {
+		t.Errorf("LookupPendingSessionFor(other client) returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := h.LookupSession(sid); err != ErrNoSession {
+		t.Errorf("LookupSession of pending session returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// Once unlocked, the session can be used under the returned ID.
+	v.release <- struct{}{}
+	sess, err := p.Result()
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if got, err := h.LookupSession(sid); err != nil || got != sess {
+		t.Errorf("LookupSession = (%p, %v), want (%p, nil)", got, err, sess)
+	}
+	if _, err := h.LookupPendingSessionFor(sid, "client", "browser"); err != ErrNoSession {
+		t.Errorf("LookupPendingSessionFor of created session returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// A failure is reported once, or discarded if never looked up.
+	for _, lookup := range []bool{true, false} {
+		sid, p, err := h.CreateSessionAsync("client", "browser", "wrong passphrase")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		v.release <- struct{}{}
+		if _, err := p.Result(); err != secret.ErrWrongPassphrase {
+			t.Errorf("Result with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+		}
+		if lookup {
+			if got, err := h.LookupPendingSessionFor(sid, "client", "browser"); err != nil || got != p {
+				t.Errorf("LookupPendingSessionFor of failed session = (%p, %v), want (%p, nil)", got, err, p)
+			}
+		} else {
+			c.Advance(pendingResultDuration)
+		}
+		if _, err := h.LookupPendingSessionFor(sid, "client", "browser"); err != ErrNoSession {
+			t.Errorf("Second LookupPendingSessionFor of failed session returned error %v, want %v", err, ErrNoSession)
+		}
+	}
+}
+
+func TestCreateSessionWithExternalSecret(t *testing.T) {
+	t.Parallel()
+
+	var configured []byte
+	v := externalSecretVault{extra: "external secret"}
+	h, err := NewHandler(v, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithNewSessionBurst(10), WithExternalSecret(func() ([]byte, error) {
+		if configured == nil {
+			return nil, errors.New("no external secret")
+		}
+		return configured, nil
+	}))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc              string
+		extra, configured string
+		wantErr           error
+	}{
+		{"no external secret", "", "", secret.ErrWrongPassphrase},
+		{"supplied by login", "external secret", "", nil},
+		{"configured", "", "external secret", nil},
+		{"login overrides configured", "wrong secret", "external secret", secret.ErrWrongPassphrase},
+	} {
+		configured = nil
+		if test.configured != "" {
+			configured = []byte(test.configured)
+		}
+		if _, _, err := h.CreateUserSessionWith("client", "browser", "", "password", []byte(test.extra)); err != test.wantErr {
+			t.Errorf("CreateUserSessionWith (%s) returned error %v, want %v", test.desc, err, test.wantErr)
+		}
+		_, p, err := h.CreateUserSessionAsyncWith("client", "browser", "", "password", []byte(test.extra))
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		if _, err := p.Result(); err != test.wantErr {
+			t.Errorf("CreateUserSessionAsyncWith (%s) returned error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestCreateSessionAsyncShutdown(t *testing.T) {
+	t.Parallel()
+
+	v := &blockingVault{release: make(chan struct{}), wv: &wipingVault{}}
+	h, err := NewHandler(v, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	sid, p, err := h.CreateSessionAsync("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Could not shut down: %v", err)
+	}
+
+	// A session unlocked after shutdown is discarded, & its store wiped.
+	v.release <- struct{}{}
+	if _, err := p.Result(); err != ErrNoSession {
+		t.Errorf("Result after shutdown returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := h.LookupSession(sid); err != ErrNoSession {
+		t.Errorf("LookupSession after shutdown returned error %v, want %v", err, ErrNoSession)
+	}
+	if got := v.wv.stores[0].wipeCount(); got != 1 {
+		t.Errorf("Store of discarded session was wiped %d times, want 1", got)
+	}
+}
+
+func TestSessionExpiration(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	sid, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// The session is usable until it expires.
+	c.Advance(time.Minute - time.Nanosecond)
+	if got, err := h.GetSession(sid); err != nil || got != sess {
+		t.Errorf("GetSession before expiration = (%p, %v), want (%p, nil)", got, err, sess)
+	}
+
+	// Once it expires, it is closed.
+	c.Advance(time.Nanosecond)
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("After expiration, ActiveSessionCount() = %d, want 0", got)
+	}
+	if _, err := h.GetSession(sid); err != ErrNoSession {
+		t.Errorf("GetSession after expiration returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// The session was never fully authenticated, so an alert is fired, but only once.
+	sess.Close()
+	if got := ra.count(alert.UNAUTHENTICATED_SESSION_CLOSED); got != 1 {
+		t.Errorf("Got %d UNAUTHENTICATED_SESSION_CLOSED alerts, want 1", got)
+	}
+}
+
+func TestSoftLock(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c), WithSoftLock(10*time.Minute), WithNewSessionBurst(1000))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	// newLockedSession creates a session authenticated for /entry, then expires it.
+	newLockedSession := func() {
+		t.Helper()
+		_, sess, err := h.CreateSession("client", "fingerprint", "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		sess.mu.Lock()
+		sess.authedPaths["/entry"] = c.Now()
+		sess.mu.Unlock()
+		c.Advance(time.Minute)
+		if _, err := h.LookupSession(sess.id); err != ErrNoSession {
+			t.Fatalf("LookupSession for expired session returned error %v, want %v", err, ErrNoSession)
+		}
+	}
+	restored := func(clientID, fingerprint string) bool {
+		t.Helper()
+		_, sess, err := h.CreateSession(clientID, fingerprint, "password")
+		if err != nil {
+			t.Fatalf("Could not create session: %v", err)
+		}
+		defer sess.Close()
+		return sess.IsMFAAuthenticatedFor("/entry")
+	}
+
+	// Logging in again from the same client restores MFA authentication, once.
+	newLockedSession()
+	if !restored("client", "fingerprint") {
+		t.Errorf("Session created after soft lock not authenticated for /entry")
+	}
+	if restored("client", "fingerprint") {
+		t.Errorf("Second session created after soft lock authenticated for /entry")
+	}
+
+	// Other clients can't restore authentication.
+	newLockedSession()
+	for _, test := range []struct{ clientID, fingerprint string }{
+		{"other-client", "fingerprint"},
+		{"client", "other-fingerprint"},
+	} {
+		if restored(test.clientID, test.fingerprint) {
+			t.Errorf("Session created by client (%q, %q) after soft lock authenticated for /entry", test.clientID, test.fingerprint)
+		}
+	}
+	if !restored("client", "fingerprint") {
+		t.Errorf("Session created after soft lock not authenticated for /entry")
+	}
+
+	// Authentication can't be restored after the grace period, even if the tombstone's
+	// timer has not yet run.
+	newLockedSession()
+	c.AdvanceWithoutFiring(10 * time.Minute)
+	if restored("client", "fingerprint") {
+		t.Errorf("Session created after grace period authenticated for /entry")
+	}
+	newLockedSession()
+	c.Advance(10 * time.Minute)
+	h.mu.RLock()
+	n := len(h.tombstones)
+	h.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("After grace period, got %d tombstones, want 0", n)
+	}
+
+	// Locking a session soft-locks it; closing it, or revoking all sessions, does not.
+	_, sess, err := h.CreateSession("client", "fingerprint", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.mu.Lock()
+	sess.authedPaths["/entry"] = c.Now()
+	sess.mu.Unlock()
+	sess.Lock()
+	if _, err := h.LookupSession(sess.id); err != ErrNoSession {
+		t.Errorf("LookupSession for locked session returned error %v, want %v", err, ErrNoSession)
+	}
+	if !restored("client", "fingerprint") {
+		t.Errorf("Session created after lock not authenticated for /entry")
+	}
+	newLockedSession()
+	h.CloseAllSessions()
+	if restored("client", "fingerprint") {
+		t.Errorf("Session created after revoking all sessions authenticated for /entry")
+	}
+}
+
+func TestExpiredSessionNotYetClosed(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	partialID, _, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sid, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.mu.Lock()
+	sess.authedPaths["/"] = c.Now()
+	sess.mu.Unlock()
+
+	// The sessions have expired, but their expiration timers have not yet run.
+	c.AdvanceWithoutFiring(time.Minute)
+	for _, id := range []string{partialID, sid} {
+		if _, err := h.GetSession(id); err != ErrNoSession {
+			t.Errorf("GetSession for expired session returned error %v, want %v", err, ErrNoSession)
+		}
+		if _, err := h.LookupSession(id); err != ErrNoSession {
+			t.Errorf("LookupSession for expired session returned error %v, want %v", err, ErrNoSession)
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		policy      SessionLimitPolicy
+		wantErr     error
+		wantEvicted bool
+	}{
+		{SessionLimitReject, ErrTooManySessions, false},
+		{SessionLimitEvict, nil, true},
+	} {
+		c := newFakeClock()
+		ra := &recordingAlerter{}
+		h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithMaxSessions(3, test.policy))
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+
+		// Fill up the sessions: the oldest is fully authenticated, so it is never evicted.
+		var ids []string
+		for i := 0; i < 3; i++ {
+			sid, sess, err := h.CreateSession("client", "", "password")
+			if err != nil {
+				t.Fatalf("[%v] Could not create session: %v", test.policy, err)
+			}
+			if i == 0 {
+				sess.mu.Lock()
+				sess.authedPaths["/"] = c.Now()
+				sess.mu.Unlock()
+			}
+			ids = append(ids, sid)
+			c.AdvanceWithoutFiring(time.Second)
+		}
+
+		_, _, err = h.CreateSession("client", "", "password")
+		if err != test.wantErr {
+			t.Errorf("[%v] CreateSession at capacity returned error %v, want %v", test.policy, err, test.wantErr)
+		}
+		if got := h.ActiveSessionCount(); got != 3 {
+			t.Errorf("[%v] ActiveSessionCount() = %d, want 3", test.policy, got)
+		}
+		for i, id := range ids {
+			_, err := h.LookupSession(id)
+			if wantGone := test.wantEvicted && i == 1; (err == ErrNoSession) != wantGone {
+				t.Errorf("[%v] LookupSession(session %d) returned error %v, want evicted = %v", test.policy, i, err, wantGone)
+			}
+		}
+		wantAlerts := 0
+		if test.wantEvicted {
+			wantAlerts = 1
+		}
+		if got := ra.count(alert.SESSION_EVICTED); got != wantAlerts {
+			t.Errorf("[%v] Got %d SESSION_EVICTED alerts, want %d", test.policy, got, wantAlerts)
+		}
+		if got := ra.count(alert.UNAUTHENTICATED_SESSION_CLOSED); got != 0 {
+			t.Errorf("[%v] Got %d UNAUTHENTICATED_SESSION_CLOSED alerts, want 0", test.policy, got)
+		}
+	}
+}
+
+func TestMaxSessionsFullyAuthenticated(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithMaxSessions(1, SessionLimitEvict))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.mu.Lock()
+	sess.authedPaths["/"] = time.Now()
+	sess.mu.Unlock()
+	if _, _, err := h.CreateSession("client", "", "password"); err != ErrTooManySessions {
+		t.Errorf("CreateSession with only fully-authenticated sessions returned error %v, want %v", err, ErrTooManySessions)
+	}
+}
+
+func TestEvictionRacesExpiration(t *testing.T) {
+	t.Parallel()
+
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithMaxSessions(2, SessionLimitEvict))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, first, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	c.AdvanceWithoutFiring(30 * time.Second)
+	if _, _, err := h.CreateSession("client", "", "password"); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// The first session has expired, but its expiration timer has not yet run. It is closed
+	// to make room, as if it had expired, rather than evicting the second session.
+	c.AdvanceWithoutFiring(30 * time.Second)
+	expire := first.expirationTimer.(*fakeTimer).f
+	if _, _, err := h.CreateSession("client", "", "password"); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// The expiration timer then runs late; it must not close any other session.
+	expire()
+	if got := h.ActiveSessionCount(); got != 2 {
+		t.Errorf("ActiveSessionCount() = %d, want 2", got)
+	}
+	if got := ra.count(alert.SESSION_EVICTED); got != 0 {
+		t.Errorf("Got %d SESSION_EVICTED alerts, want 0", got)
+	}
+	if got := ra.count(alert.UNAUTHENTICATED_SESSION_CLOSED); got != 1 {
+		t.Errorf("Got %d UNAUTHENTICATED_SESSION_CLOSED alerts, want 1", got)
+	}
+
+	// Likewise, a session which is evicted just as its expiration timer fires is closed only once.
+	c.AdvanceWithoutFiring(10 * time.Second)
+	h.mu.RLock()
+	var oldest *Session
+	for _, sess := range h.sessions {
+		if oldest == nil || sess.createdAt.Before(oldest.createdAt) {
+			oldest = sess
+		}
+	}
+	h.mu.RUnlock()
+	expire = oldest.expirationTimer.(*fakeTimer).f
+	if _, _, err := h.CreateSession("client", "", "password"); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	expire()
+	if got := h.ActiveSessionCount(); got != 2 {
+		t.Errorf("After eviction, ActiveSessionCount() = %d, want 2", got)
+	}
+	if got := ra.count(alert.SESSION_EVICTED); got != 1 {
+		t.Errorf("After eviction, got %d SESSION_EVICTED alerts, want 1", got)
+	}
+	if got := ra.count(alert.UNAUTHENTICATED_SESSION_CLOSED); got != 1 {
+		t.Errorf("After eviction, got %d UNAUTHENTICATED_SESSION_CLOSED alerts, want 1", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithMetrics(reg))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if _, _, err := h.CreateSession("client", "", "wrong"); err != secret.ErrWrongPassphrase {
+		t.Fatalf("CreateSession with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.GetStore().Get("/entry")
+	sess.GetStore().Delete("/entry")
+
+	got := string(reg.WriteText())
+	for _, want := range []string{
+		"harpd_sessions_created_total 1\n",
+		"harpd_wrong_passphrases_total 1\n",
+		"harpd_active_sessions 1\n",
+		`harpd_store_operation_duration_seconds_count{op="get"} 1` + "\n",
+		`harpd_store_operation_duration_seconds_count{op="delete"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Metrics did not contain %q; metrics were:\n%s", want, got)
+		}
+	}
+	// Expected errors (such as nonexistent entries) are not counted as failures.
+	if strings.Contains(got, "harpd_store_errors_total{") {
+		t.Errorf("Metrics unexpectedly counted store errors; metrics were:\n%s", got)
+	}
+}
+
+func TestRawSignCount(t *testing.T) {
+	t.Parallel()
+
+	authData := make([]byte, 37)
+	copy(authData[33:], []byte{0x00, 0x01, 0x02, 0x03})
+	if got, ok := rawSignCount(authData); !ok || got != 0x00010203 {
+		t.Errorf("rawSignCount = (%#x, %v), want (0x10203, true)", got, ok)
+	}
+	if _, ok := rawSignCount(authData[:36]); ok {
+		t.Errorf("rawSignCount succeeded on truncated data")
+	}
+}
+
+func TestMounts(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithMounts(
+		Mount{Name: "Personal", Path: "personal", Vault: fakeVault{}},
+		Mount{Name: "Work", Path: "work", Vault: fakeVault{passphrase: "work password"}},
+		Mount{Name: "Shared", Path: "shared", Vault: fakeVault{}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	// Only the vaults opened by the passphrase are unlocked.
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	want := []VaultStatus{{"Personal", "personal", true}, {"Work", "work", false}, {"Shared", "shared", true}}
+	if got := sess.Vaults(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Vaults() = %v, want %v", got, want)
+	}
+	if err := sess.GetStore().Put("/personal/entry", "content"); err != nil {
+		t.Errorf("Could not put to unlocked vault: %v", err)
+	}
+	if err := sess.GetStore().Put("/work/entry", "content"); err == nil {
+		t.Errorf("Put to locked vault succeeded")
+	}
+
+	// A passphrase opening no vault is wrong.
+	if _, _, err := h.CreateSession("client", "", "wrong"); err != secret.ErrWrongPassphrase {
+		t.Errorf("CreateSession with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	t.Parallel()
+
+	ra := &recordingAlerter{}
+	h, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, ra, WithUsers(
+		User{Name: "alice", Vault: namedVault{fakeVault{"alice password"}, "alice"}, MFACredentials: []string{testRegistration(t, "alice-key")}},
+		User{Name: "bob", Vault: namedVault{fakeVault{"bob password"}, "bob"}},
+		User{Name: "carol", Vault: namedVault{fakeVault{"alice password"}, "carol"}, MFACredentials: []string{testRegistration(t, "carol-key")}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	newSession := func(userName, passphrase string) *Session {
+		t.Helper()
+		_, sess, err := h.CreateUserSession("client", "", userName, passphrase)
+		if err != nil {
+			t.Fatalf("Could not create session (user %q): %v", userName, err)
+		}
+		return sess
+	}
+	checkUser := func(sess *Session, want string) {
+		t.Helper()
+		if got := sess.User(); got != want {
+			t.Errorf("User() = %q, want %q", got, want)
+		}
+		if entries, err := sess.GetStore().List(); err != nil || fmt.Sprint(entries) != fmt.Sprintf("[/%s]", want) {
+			t.Errorf("Store of %q session lists %v (error %v), want [/%s]", want, entries, err, want)
+		}
+	}
+
+	// Without a user name, the first user whose vault the passphrase opens is chosen.
+	bob, alice := newSession("", "bob password"), newSession("", "alice password")
+	checkUser(bob, "bob")
+	checkUser(alice, "alice")
+	carol := newSession("carol", "alice password")
+	checkUser(carol, "carol")
+
+	// A passphrase which doesn't open the named user's vault is wrong, as is an unknown user.
+	for _, test := range []struct{ user, passphrase string }{{"bob", "alice password"}, {"dave", "alice password"}, {"", "wrong"}} {
+		if _, _, err := h.CreateUserSession("client", "", test.user, test.passphrase); err != secret.ErrWrongPassphrase {
+			t.Errorf("CreateUserSession(%q, %q) returned error %v, want %v", test.user, test.passphrase, err, secret.ErrWrongPassphrase)
+		}
+	}
+
+	// Each session can authenticate only with its own user's MFA devices.
+	for _, test := range []struct {
+		sess     *Session
+		wantCred string
+	}{{alice, "alice-key"}, {bob, ""}, {carol, "carol-key"}} {
+		var creds, descs []string
+		cs := h.credentialsOf(test.sess.acct)
+		for _, c := range (user{test.sess.acct, cs}).Credentials() {
+			creds = append(creds, string(c.CredentialID()))
+		}
+		for _, d := range cs.descriptors {
+			descs = append(descs, string(d.ID))
+		}
+		want := "[]"
+		if test.wantCred != "" {
+			want = fmt.Sprintf("[%s]", test.wantCred)
+		}
+		if fmt.Sprint(creds) != want || fmt.Sprint(descs) != want {
+			t.Errorf("User %q has credentials %v & descriptors %v, want %s", test.sess.User(), creds, descs, want)
+		}
+		if got, want := test.sess.HasRegisteredMFADevice(), test.wantCred != ""; got != want {
+			t.Errorf("User %q: HasRegisteredMFADevice() = %v, want %v", test.sess.User(), got, want)
+		}
+	}
+
+	// Closing a user's sessions leaves other users' sessions, & names the user in the alert.
+	if n := h.CloseUserSessions("alice"); n != 1 {
+		t.Errorf("CloseUserSessions closed %d sessions, want 1", n)
+	}
+	var users []string
+	for _, info := range h.Sessions() {
+		users = append(users, info.User)
+	}
+	if want := "[bob carol]"; fmt.Sprint(users) != want {
+		t.Errorf("After closing alice's sessions, sessions belong to %v, want %v", users, want)
+	}
+	if ra.count(alert.SESSIONS_REVOKED) != 1 || !strings.Contains(ra.details[len(ra.details)-1], `User "alice"`) {
+		t.Errorf("Alerts fired with details %q, want a SESSIONS_REVOKED alert naming alice", ra.details)
+	}
+
+	// Users may not be combined with mounts, and must have unique names.
+	for _, opts := range [][]Option{
+		{WithUsers(User{Name: "alice", Vault: fakeVault{}}), WithMounts(Mount{Name: "Work", Path: "work", Vault: fakeVault{}})},
+		{WithUsers(User{Name: "alice", Vault: fakeVault{}}, User{Name: "alice", Vault: fakeVault{}})},
+		{WithUsers(User{Vault: fakeVault{}})},
+	} {
+		if _, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), opts...); err == nil {
+			t.Errorf("NewHandler with invalid users succeeded")
+		}
+	}
+}
+
+func TestCredentialFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	credFile := filepath.Join(dir, "credentials")
+	ra := &recordingAlerter{}
+	newHandler := func(mfaCredentials ...string) *Handler {
+		t.Helper()
+		h, err := NewHandler(fakeVault{}, "https://example.com", mfaCredentials, nil, time.Minute, 1000, ra, WithCredentialFile(credFile))
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+		return h
+	}
+	checkCredentials := func(h *Handler, want string) {
+		t.Helper()
+		var got []string
+		for _, c := range h.Credentials("") {
+			registered := "-"
+			if !c.RegisteredAt.IsZero() {
+				registered = c.RegisteredAt.UTC().Format(time.RFC3339)
+			}
+			got = append(got, fmt.Sprintf("%s:%s:%s:%s", c.ID, c.Label, registered, c.AAGUID))
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("Credentials() = %v, want %s", got, want)
+		}
+		var descs []string
+		for _, d := range h.credentialsOf(h.accounts[0]).descriptors {
+			descs = append(descs, string(d.ID))
+		}
+		if got := len(descs); got != len(h.Credentials("")) {
+			t.Errorf("Handler has %d credential descriptors (%v), want %d", got, descs, len(h.Credentials("")))
+		}
+	}
+
+	// Before the file exists, credentials passed to NewHandler are used.
+	h := newHandler(testRegistration(t, "boot"))
+	checkCredentials(h, "[Ym9vdA::-:]")
+
+	// Added credentials are persisted along with the imported credentials, and can be used immediately.
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	registered := time.Unix(1500000000, 0)
+	if err := h.AddCredential("", Credential{Registration: testRegistration(t, "key"), Label: "Security key", RegisteredAt: registered, AAGUID: "cb69481e-8ff7-4039-93ec-0a2729a154a8"}); err != nil {
+		t.Fatalf("Could not add credential: %v", err)
+	}
+	if _, ok := (user{sess.acct, h.credentialsOf(sess.acct)}).Credentials()["a2V5"]; !ok { // base64url("key")
+		t.Errorf("Added credential not usable by existing session")
+	}
+	if err := h.AddCredential("", Credential{Registration: testRegistration(t, "key")}); err == nil {
+		t.Errorf("Adding duplicate credential succeeded")
+	}
+	if got := ra.count(alert.MFA_DEVICE_ADDED); got != 1 {
+		t.Errorf("Got %d MFA_DEVICE_ADDED alerts, want 1", got)
+	}
+	const want = "[Ym9vdA::-: a2V5:Security key:2017-07-14T02:40:00Z:cb69481e-8ff7-4039-93ec-0a2729a154a8]"
+	checkCredentials(h, want)
+
+	// Once the file exists, credentials passed to NewHandler are ignored.
+	h = newHandler(testRegistration(t, "ignored"))
+	checkCredentials(h, want)
+
+	// Removed credentials are no longer usable, and stay removed.
+	if err := h.RemoveCredential("", "Ym9vdA"); err != nil {
+		t.Fatalf("Could not remove credential: %v", err)
+	}
+	if err := h.RemoveCredential("", "Ym9vdA"); err != ErrNoCredential {
+		t.Errorf("Removing missing credential returned error %v, want %v", err, ErrNoCredential)
+	}
+	if got := ra.count(alert.MFA_DEVICE_REMOVED); got != 1 {
+		t.Errorf("Got %d MFA_DEVICE_REMOVED alerts, want 1", got)
+	}
+	const wantRemoved = "[a2V5:Security key:2017-07-14T02:40:00Z:cb69481e-8ff7-4039-93ec-0a2729a154a8]"
+	checkCredentials(h, wantRemoved)
+	checkCredentials(newHandler(), wantRemoved)
+
+	// Without a credential file, credentials can't be changed.
+	h, err = NewHandler(fakeVault{}, "https://example.com", []string{testRegistration(t, "boot")}, nil, time.Minute, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if h.ManagesCredentials() {
+		t.Errorf("ManagesCredentials() = true without a credential file")
+	}
+	if err := h.AddCredential("", Credential{Registration: testRegistration(t, "key")}); err != ErrCredentialsNotPersisted {
+		t.Errorf("AddCredential without credential file returned error %v, want %v", err, ErrCredentialsNotPersisted)
+	}
+	if err := h.RemoveCredential("", "Ym9vdA"); err != ErrCredentialsNotPersisted {
+		t.Errorf("RemoveCredential without credential file returned error %v, want %v", err, ErrCredentialsNotPersisted)
+	}
+}
+
+func TestCredentialFileUsers(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	credFile := filepath.Join(dir, "credentials")
+	newHandler := func(users ...User) *Handler {
+		t.Helper()
+		h, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), WithCredentialFile(credFile), WithUsers(users...))
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+		return h
+	}
+	alice := User{Name: "alice", Vault: fakeVault{"alice password"}, MFACredentials: []string{testRegistration(t, "alice-key")}}
+	bob := User{Name: "bob", Vault: fakeVault{"bob password"}}
+
+	h := newHandler(alice, bob)
+	if err := h.AddCredential("bob", Credential{Registration: testRegistration(t, "bob-key")}); err != nil {
+		t.Fatalf("Could not add credential: %v", err)
+	}
+	if err := h.AddCredential("carol", Credential{Registration: testRegistration(t, "carol-key")}); err == nil {
+		t.Errorf("Adding credential for unknown user succeeded")
+	}
+	if err := h.RemoveCredential("bob", "YWxpY2Uta2V5"); err != ErrNoCredential { // base64url("alice-key")
+		t.Errorf("Removing another user's credential returned error %v, want %v", err, ErrNoCredential)
+	}
+
+	// Each user's credentials are persisted separately. Credentials of users no longer served are ignored.
+	h = newHandler(bob)
+	for _, test := range []struct{ user, want string }{{"bob", "[Ym9iLWtleQ]"}, {"alice", "[]"}} {
+		var ids []string
+		for _, c := range h.Credentials(test.user) {
+			ids = append(ids, c.ID)
+		}
+		if fmt.Sprint(ids) != test.want {
+			t.Errorf("Credentials(%q) = %v, want %s", test.user, ids, test.want)
+		}
+	}
+}
+
+func TestRegistrationWithoutCredentialFile(t *testing.T) {
+	t.Parallel()
+
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra)
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if sess.HasRegisteredMFADevice() {
+		t.Fatalf("Session has a registered MFA device before registration")
+	}
+
+	// A device registered via a session (as by CompleteMFARegistration) is usable immediately, by any session.
+	if err := h.addCredential(sess.acct, Credential{Registration: testRegistration(t, "key"), Label: "Security key"}); err != nil {
+		t.Fatalf("Could not register credential: %v", err)
+	}
+	_, other, err := h.CreateSession("other client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	for _, s := range []*Session{sess, other} {
+		if !s.HasRegisteredMFADevice() {
+			t.Errorf("Session has no registered MFA device after registration")
+		}
+		if _, ok := (user{s.acct, h.credentialsOf(s.acct)}).Credentials()["a2V5"]; !ok { // base64url("key")
+			t.Errorf("Registered credential not usable by session")
+		}
+	}
+	if got := len(h.credentialsOf(sess.acct).descriptors); got != 1 {
+		t.Errorf("Handler has %d credential descriptors, want 1", got)
+	}
+	if err := h.addCredential(sess.acct, Credential{Registration: testRegistration(t, "key")}); err == nil {
+		t.Errorf("Registering duplicate credential succeeded")
+	}
+	if got := ra.count(alert.MFA_DEVICE_ADDED); got != 1 {
+		t.Errorf("Got %d MFA_DEVICE_ADDED alerts, want 1", got)
+	}
+}
+
+func TestRegistrationRacesChallenge(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, opts := range [][]Option{nil, {WithCredentialFile(filepath.Join(dir, "credentials"))}} {
+		h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, alert.NewLog(), opts...)
+		if err != nil {
+			t.Fatalf("Could not create handler: %v", err)
+		}
+		const n = 20
+		sessions := make([]*Session, 2*n)
+		for i := range sessions {
+			if _, sessions[i], err = h.CreateSession(fmt.Sprintf("client %d", i), "", "password"); err != nil {
+				t.Fatalf("Could not create session: %v", err)
+			}
+		}
+
+		// Each registration races challenges generated by other sessions. Once a
+		// registration completes, challenges in any session allow its device.
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			id := fmt.Sprintf("key%d", i)
+			registering, challenging := sessions[i], sessions[n+i]
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := h.addCredential(registering.acct, Credential{Registration: testRegistration(t, id)}); err != nil {
+					t.Errorf("Could not register credential: %v", err)
+					return
+				}
+				if _, err := challenging.GenerateMFAChallenge("/entry"); err != nil {
+					t.Errorf("Could not generate MFA challenge: %v", err)
+				}
+				creds := h.credentialsOf(challenging.acct)
+				if _, ok := creds.byID[base64.RawURLEncoding.EncodeToString([]byte(id))]; !ok {
+					t.Errorf("Credential %q not allowed by challenge generated after its registration", id)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if _, err := challenging.GenerateMFAChallenge("/entry"); err != nil {
+						t.Errorf("Could not generate MFA challenge: %v", err)
+					}
+					if creds := h.credentialsOf(challenging.acct); len(creds.list) != len(creds.descriptors) {
+						t.Errorf("Credential set has %d credentials but %d descriptors", len(creds.list), len(creds.descriptors))
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if got := len(h.Credentials("")); got != n {
+			t.Errorf("Got %d credentials after registration, want %d", got, n)
+		}
+		h.Shutdown(context.Background())
+	}
+}
+
+func TestExpiringEntries(t *testing.T) {
+	t.Parallel()
+
+	// The fake clock starts at 2001-09-09.
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(entriesVault{entries: map[string]string{
+		"/expired":  "pw\nexpires: 2001-01-01",
+		"/soon":     "pw\nexpires: 2001-09-12",
+		"/later":    "pw\nexpires: Sep 30, 2001",
+		"/distant":  "pw\nexpires: 2002-01-01",
+		"/invalid":  "pw\nexpires: whenever",
+		"/.expired": "pw\nexpires: 2001-01-01",
+	}}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	for _, test := range []struct {
+		window time.Duration
+		want   []string
+	}{
+		{30 * 24 * time.Hour, []string{"/expired", "/soon", "/later"}},
+		{0, []string{"/expired"}},
+	} {
+		exps, err := sess.ExpiringEntries(test.window)
+		if err != nil {
+			t.Fatalf("Could not get expiring entries: %v", err)
+		}
+		var got []string
+		for _, e := range exps {
+			got = append(got, e.Entry)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ExpiringEntries(%v) = %q, want %q", test.window, got, test.want)
+		}
+	}
+
+	// The alert is fired only once per session.
+	if got := ra.count(alert.ENTRY_EXPIRING); got != 1 {
+		t.Errorf("Got %d ENTRY_EXPIRING alerts, want 1", got)
+	}
+}
+
+func TestStoreVerification(t *testing.T) {
+	t.Parallel()
+
+	var problems []string
+	for i := 0; i < 7; i++ {
+		problems = append(problems, fmt.Sprintf("e%d.harp: missing", i))
+	}
+	for _, test := range []struct {
+		desc     string
+		problems []string
+		opts     []Option
+		want     int
+	}{
+		{"verified store", nil, []Option{WithStoreVerification()}, 0},
+		{"tampered store", problems, []Option{WithStoreVerification()}, 1},
+		{"tampered store, without verification", problems, nil, 0},
+	} {
+		ra := &recordingAlerter{}
+		h, err := NewHandler(verifyVault{problems: test.problems}, "https://example.com", nil, nil, time.Minute, 1000, ra, test.opts...)
+		if err != nil {
+			t.Fatalf("[%s] Could not create handler: %v", test.desc, err)
+		}
+		if _, _, err := h.CreateSession("client", "", "password"); err != nil {
+			t.Fatalf("[%s] Could not create session: %v", test.desc, err)
+		}
+		if got := ra.count(alert.STORE_TAMPER); got != test.want {
+			t.Errorf("[%s] Got %d STORE_TAMPER alerts, want %d", test.desc, got, test.want)
+		}
+		if test.want > 0 {
+			ra.mu.Lock()
+			details := ra.details[0]
+			ra.mu.Unlock()
+			if want := "Password store failed verification with 7 problems: e0.harp: missing; e1.harp: missing; e2.harp: missing; e3.harp: missing; e4.harp: missing; ..."; details != want {
+				t.Errorf("[%s] Got alert details %q, want %q", test.desc, details, want)
+			}
+		}
+	}
+}
+
+func TestFailedLoginBurst(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	al, err := authlog.New(filepath.Join(dir, "authlog"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Could not create auth log: %v", err)
+	}
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithAuthLog(al, 3))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+
+	// The alert fires once, when the threshold is reached.
+	for i := 0; i < 5; i++ {
+		if _, _, err := h.CreateSession("1.2.3.4", "", "wrong"); err != secret.ErrWrongPassphrase {
+			t.Fatalf("CreateSession with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+		}
+		wantAlerts := 0
+		if i >= 2 {
+			wantAlerts = 1
+		}
+		if got := ra.count(alert.FAILED_LOGIN_BURST); got != wantAlerts {
+			t.Errorf("After %d failures, got %d FAILED_LOGIN_BURST alerts, want %d", i+1, got, wantAlerts)
+		}
+	}
+	if _, _, err := h.CreateSession("1.2.3.4", "", "password"); err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	cs := al.Clients()
+	if len(cs) != 1 || cs[0].IP != "1.2.3.4" || cs[0].Failures != 5 || cs[0].LastSuccess.IsZero() {
+		t.Errorf("Auth log clients = %v, want one client 1.2.3.4 with 5 failures and a success", cs)
+	}
+}
+
+func TestAPITokenSession(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ts, err := apitoken.NewStore(filepath.Join(dir, "tokens"))
+	if err != nil {
+		t.Fatalf("Could not create token store: %v", err)
+	}
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithAPITokens(ts), WithNewSessionBurst(10))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// Creating a token requires the passphrase.
+	if _, _, err := sess.CreateAPIToken("script", "wrong", nil, false); err != secret.ErrWrongPassphrase {
+		t.Errorf("CreateAPIToken with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	token, info, err := sess.CreateAPIToken("script", "password", []string{"/work/"}, true)
+	if err != nil {
+		t.Fatalf("Could not create API token: %v", err)
+	}
+	h.Shutdown(context.Background()) // wait for alerts
+	if got := ra.count(alert.API_TOKEN_CREATED); got != 1 {
+		t.Errorf("Got %d API_TOKEN_CREATED alerts, want 1", got)
+	}
+	if toks := h.APITokens(); len(toks) != 1 || toks[0].ID != info.ID {
+		t.Errorf("APITokens = %+v, want [%+v]", toks, info)
+	}
+
+	// The token gets a restricted, authenticated session, which is reused until it expires.
+	h, err = NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithAPITokens(ts))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if _, err := h.GetAPITokenSession("garbage", "client"); err != ErrNoSession {
+		t.Errorf("GetAPITokenSession with invalid token returned error %v, want %v", err, ErrNoSession)
+	}
+	tsess, err := h.GetAPITokenSession(token, "client")
+	if err != nil {
+		t.Fatalf("Could not get API token session: %v", err)
+	}
+	if !tsess.IsMFAAuthenticatedFor("/work/entry") {
+		t.Errorf("API token session is not MFA authenticated")
+	}
+	if !secret.IsReadOnly(tsess.GetStore(), "/work/entry") {
+		t.Errorf("API token session store is not read-only")
+	}
+	if _, err := tsess.GetStore().Get("/other"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Get outside token prefix returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("ActiveSessionCount = %d, want 0", got)
+	}
+	c.Advance(time.Minute - time.Nanosecond)
+	if got, err := h.GetAPITokenSession(token, "client"); err != nil || got != tsess {
+		t.Errorf("GetAPITokenSession before expiration = (%p, %v), want (%p, nil)", got, err, tsess)
+	}
+	c.Advance(time.Minute)
+	if got, err := h.GetAPITokenSession(token, "client"); err != nil || got == tsess {
+		t.Errorf("GetAPITokenSession after expiration = (%p, %v), want new session", got, err)
+	}
+
+	// A revoked token can no longer be used.
+	if err := h.RevokeAPIToken(info.ID); err != nil {
+		t.Fatalf("Could not revoke API token: %v", err)
+	}
+	if _, err := h.GetAPITokenSession(token, "client"); err != ErrNoSession {
+		t.Errorf("GetAPITokenSession after revocation returned error %v, want %v", err, ErrNoSession)
+	}
+	if err := h.RevokeAPIToken(info.ID); !errors.Is(err, apitoken.ErrNoToken) {
+		t.Errorf("Second RevokeAPIToken returned error %v, want %v", err, apitoken.ErrNoToken)
+	}
+	h.Shutdown(context.Background())
+	if got := ra.count(alert.API_TOKEN_REVOKED); got != 1 {
+		t.Errorf("Got %d API_TOKEN_REVOKED alerts, want 1", got)
+	}
+}
+
+func TestTrustedDevices(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := device.NewStore(filepath.Join(dir, "devices"), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Could not create device store: %v", err)
+	}
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithTrustedDevices(ds), WithUsers(
+		User{Name: "alice", Vault: namedVault{fakeVault{"alice password"}, "alice"}},
+		User{Name: "bob", Vault: namedVault{fakeVault{"bob password"}, "bob"}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	newSession := func(userName, passphrase string) *Session {
+		t.Helper()
+		_, sess, err := h.CreateUserSession("client", "", userName, passphrase)
+		if err != nil {
+			t.Fatalf("Could not create session (user %q): %v", userName, err)
+		}
+		return sess
+	}
+	alice, bob := newSession("alice", "alice password"), newSession("bob", "bob password")
+
+	// Only sessions which have completed MFA can trust their device.
+	if _, _, err := alice.TrustDevice("laptop"); err == nil {
+		t.Errorf("TrustDevice before MFA unexpectedly succeeded")
+	}
+	alice.authedPaths["/"] = c.Now()
+	token, info, err := alice.TrustDevice("laptop")
+	if err != nil {
+		t.Fatalf("Could not trust device: %v", err)
+	}
+	if devs := h.TrustedDevices("alice"); len(devs) != 1 || devs[0].ID != info.ID || devs[0].Label != "laptop" {
+		t.Errorf("TrustedDevices(alice) = %+v, want [%+v]", devs, info)
+	}
+	if devs := h.TrustedDevices("bob"); len(devs) != 0 {
+		t.Errorf("TrustedDevices(bob) = %+v, want none", devs)
+	}
+
+	// The device is trusted by later sessions of the same user only.
+	if later := newSession("alice", "alice password"); !later.IsTrustedDevice(token) || later.IsTrustedDevice("garbage") || later.IsTrustedDevice("") {
+		t.Errorf("Later session of alice does not trust exactly the trusted device")
+	}
+	if bob.IsTrustedDevice(token) {
+		t.Errorf("Session of bob trusts alice's device")
+	}
+
+	// Users may revoke only their own devices.
+	if err := h.RevokeTrustedDevice("bob", info.ID); !errors.Is(err, device.ErrNoDevice) {
+		t.Errorf("RevokeTrustedDevice(bob) returned error %v, want %v", err, device.ErrNoDevice)
+	}
+	if err := h.RevokeTrustedDevice("alice", info.ID); err != nil {
+		t.Fatalf("Could not revoke device: %v", err)
+	}
+	if alice.IsTrustedDevice(token) {
+		t.Errorf("Revoked device is still trusted")
+	}
+
+	// Devices are trusted only for the store's lifetime.
+	token, _, err = alice.TrustDevice("phone")
+	if err != nil {
+		t.Fatalf("Could not trust device: %v", err)
+	}
+	c.Advance(24 * time.Hour)
+	if alice.IsTrustedDevice(token) {
+		t.Errorf("Expired device is still trusted")
+	}
+	if devs := h.TrustedDevices("alice"); len(devs) != 0 {
+		t.Errorf("After expiry, TrustedDevices(alice) = %+v, want none", devs)
+	}
+
+	h.Shutdown(context.Background()) // wait for alerts
+	if got := ra.count(alert.DEVICE_TRUSTED); got != 2 {
+		t.Errorf("Got %d DEVICE_TRUSTED alerts, want 2", got)
+	}
+	if got := ra.count(alert.DEVICE_REVOKED); got != 1 {
+		t.Errorf("Got %d DEVICE_REVOKED alerts, want 1", got)
+	}
+}
+
+func TestPasswordlessUnlock(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_session_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ps, err := passwordless.NewStore(filepath.Join(dir, "passwordless"))
+	if err != nil {
+		t.Fatalf("Could not create passwordless store: %v", err)
+	}
+	c := newFakeClock()
+	ra := &recordingAlerter{}
+	h, err := NewHandler(nil, "https://example.com", nil, nil, time.Minute, 1000, ra, WithClock(c), WithNewSessionBurst(10), WithCredentialFile(filepath.Join(dir, "credentials")), WithPasswordlessUnlock(ps), WithUsers(
+		User{Name: "alice", Vault: fakeVault{"alice password"}, MFACredentials: []string{testRegistration(t, "alice-key"), testRegistration(t, "alice-key2")}},
+		User{Name: "bob", Vault: fakeVault{"bob password"}},
+	))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	if !h.PasswordlessEnabled() {
+		t.Errorf("PasswordlessEnabled() = false, want true")
+	}
+	const aliceKey, aliceKey2 = "YWxpY2Uta2V5", "YWxpY2Uta2V5Mg" // base64url("alice-key"), base64url("alice-key2")
+	prf := make([]byte, prfOutputLength)
+	for _, id := range []string{aliceKey, aliceKey2} {
+		if err := ps.Wrap(id, "alice", prf, "alice password", c.Now()); err != nil {
+			t.Fatalf("Could not wrap passphrase: %v", err)
+		}
+	}
+	if devs := h.PasswordlessDevices("alice"); len(devs) != 2 {
+		t.Errorf("PasswordlessDevices(alice) = %+v, want 2 devices", devs)
+	}
+	if devs := h.PasswordlessDevices("bob"); len(devs) != 0 {
+		t.Errorf("PasswordlessDevices(bob) = %+v, want none", devs)
+	}
+
+	// Assertions must answer an outstanding, unexpired challenge.
+	assertion := func(challenge []byte) *warp.AssertionPublicKeyCredential {
+		cred := &warp.AssertionPublicKeyCredential{}
+		cred.RawID = []byte("alice-key")
+		cred.Response.ClientDataJSON = []byte(fmt.Sprintf(`{"type":"webauthn.get","challenge":%q}`, base64.RawURLEncoding.EncodeToString(challenge)))
+		return cred
+	}
+	challenge := []byte("challenge")
+	h.challenges[base64.RawURLEncoding.EncodeToString(challenge)] = &passwordlessChallenge{&warp.PublicKeyCredentialRequestOptions{Challenge: challenge}, c.Now().Add(passwordlessChallengeDuration)}
+	c.Advance(passwordlessChallengeDuration)
+	for _, cred := range []*warp.AssertionPublicKeyCredential{assertion([]byte("unknown")), assertion(challenge)} {
+		if _, _, err := h.CreatePasswordlessSessionAsync("client", "", "", cred, prf); !errors.Is(err, ErrNoChallenge) {
+			t.Errorf("CreatePasswordlessSessionAsync returned error %v, want %v", err, ErrNoChallenge)
+		}
+	}
+	if len(h.challenges) != 0 {
+		t.Errorf("Expired challenge was not forgotten")
+	}
+
+	// Enabling passwordless login requires a PRF output.
+	_, alice, err := h.CreateUserSession("client", "", "alice", "alice password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if err := alice.EnablePasswordlessUnlock("alice password", assertion(challenge), nil); !errors.Is(err, ErrPRFUnsupported) {
+		t.Errorf("EnablePasswordlessUnlock without PRF output returned error %v, want %v", err, ErrPRFUnsupported)
+	}
+
+	// Users may disable only their own devices.
+	if err := h.DisablePasswordlessUnlock("bob", aliceKey); !errors.Is(err, passwordless.ErrNoPassphrase) {
+		t.Errorf("DisablePasswordlessUnlock(bob) returned error %v, want %v", err, passwordless.ErrNoPassphrase)
+	}
+	if err := h.DisablePasswordlessUnlock("alice", aliceKey); err != nil {
+		t.Fatalf("Could not disable passwordless login: %v", err)
+	}
+	if _, err := ps.Lookup(aliceKey); !errors.Is(err, passwordless.ErrNoPassphrase) {
+		t.Errorf("After disabling, Lookup returned error %v, want %v", err, passwordless.ErrNoPassphrase)
+	}
+
+	// Removing a device forgets its wrapped passphrase.
+	if err := h.RemoveCredential("alice", aliceKey2); err != nil {
+		t.Fatalf("Could not remove credential: %v", err)
+	}
+	if devs := h.PasswordlessDevices("alice"); len(devs) != 0 {
+		t.Errorf("After removing devices, PasswordlessDevices(alice) = %+v, want none", devs)
+	}
+
+	h.Shutdown(context.Background()) // wait for alerts
+	if got := ra.count(alert.PASSWORDLESS_DISABLED); got != 1 {
+		t.Errorf("Got %d PASSWORDLESS_DISABLED alerts, want 1", got)
+	}
+}
+
+func TestMFALockout(t *testing.T) {
+	t.Parallel()
+
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra, WithMaxMFAFailures(3), WithMaxMFARegistrationFailures(2), WithNewSessionBurst(10))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	sid, sess, err := h.CreateSession("1.2.3.4", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// Success resets the count of consecutive failures; registration failures are counted separately.
+	for i := 0; i < 2; i++ {
+		if err := sess.recordMFAAttempt(ErrMFAAuthenticationFailed, false); err != ErrMFAAuthenticationFailed {
+			t.Fatalf("Failure %d returned error %v, want %v", i, err, ErrMFAAuthenticationFailed)
+		}
+	}
+	if err := sess.recordMFAAttempt(nil, false); err != nil {
+		t.Fatalf("Success returned error %v", err)
+	}
+	if err := sess.recordMFAAttempt(ErrMFARegistrationFailed, true); err != ErrMFARegistrationFailed {
+		t.Fatalf("Registration failure returned error %v, want %v", err, ErrMFARegistrationFailed)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sess.recordMFAAttempt(ErrMFACounterRegression, false); err != ErrMFACounterRegression {
+			t.Fatalf("Failure %d after success returned error %v, want %v", i, err, ErrMFACounterRegression)
+		}
+	}
+	if err := sess.recordMFAAttempt(ErrNoChallenge, false); err != ErrNoChallenge {
+		t.Fatalf("Missing challenge returned error %v, want %v", err, ErrNoChallenge)
+	}
+	if _, err := h.GetSession(sid); err != nil {
+		t.Fatalf("Session closed before reaching failure limit: %v", err)
+	}
+
+	// Reaching the limit closes the session.
+	if _, err := sess.GenerateMFAChallenge("/entry"); err != nil {
+		t.Fatalf("Could not generate MFA challenge: %v", err)
+	}
+	if err := sess.recordMFAAttempt(ErrMFAAuthenticationFailed, false); err != ErrNoSession {
+		t.Errorf("Failure at limit returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := h.GetSession(sid); err != ErrNoSession {
+		t.Errorf("GetSession after lockout returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := sess.GetMFAChallenge("/entry"); err != ErrNoChallenge {
+		t.Errorf("GetMFAChallenge after lockout returned error %v, want %v", err, ErrNoChallenge)
+	}
+	if _, err := sess.AuthenticateMFAResponse("/entry", &warp.AssertionPublicKeyCredential{}); err != ErrNoSession {
+		t.Errorf("AuthenticateMFAResponse after lockout returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := sess.CompleteMFARegistration("", &warp.AttestationPublicKeyCredential{}); err != ErrNoSession {
+		t.Errorf("CompleteMFARegistration after lockout returned error %v, want %v", err, ErrNoSession)
+	}
+
+	// Registration failures lock out a session on their own.
+	sid, sess, err = h.CreateSession("1.2.3.4", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	sess.recordMFAAttempt(ErrMFARegistrationFailed, true)
+	if err := sess.recordMFAAttempt(ErrMFARegistrationFailed, true); err != ErrNoSession {
+		t.Errorf("Registration failure at limit returned error %v, want %v", err, ErrNoSession)
+	}
+	if _, err := h.GetSession(sid); err != ErrNoSession {
+		t.Errorf("GetSession after registration lockout returned error %v, want %v", err, ErrNoSession)
+	}
+
+	h.Shutdown(context.Background()) // wait for alerts
+	if got := ra.count(alert.MFA_LOCKOUT); got != 2 {
+		t.Errorf("Got %d MFA_LOCKOUT alerts, want 2", got)
+	}
+}
+
+func TestMFALockoutConcurrentFailures(t *testing.T) {
+	t.Parallel()
+
+	ra := &recordingAlerter{}
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Minute, 1000, ra)
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("1.2.3.4", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+
+	// Many more failures than the limit race; only one closes the session.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	lockedOut := 0
+	for i := 0; i < 10*defaultMaxMFAFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sess.recordMFAAttempt(ErrMFAAuthenticationFailed, false); err == ErrNoSession {
+				mu.Lock()
+				lockedOut++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if want := 9*defaultMaxMFAFailures + 1; lockedOut != want {
+		t.Errorf("%d failures returned %v, want %d", lockedOut, ErrNoSession, want)
+	}
+	if got := h.ActiveSessionCount(); got != 0 {
+		t.Errorf("ActiveSessionCount after lockout = %d, want 0", got)
+	}
+	h.Shutdown(context.Background())
+	if got := ra.count(alert.MFA_LOCKOUT); got != 1 {
+		t.Errorf("Got %d MFA_LOCKOUT alerts, want 1", got)
+	}
+	if got := ra.count(alert.UNAUTHENTICATED_SESSION_CLOSED); got != 0 {
+		t.Errorf("Got %d UNAUTHENTICATED_SESSION_CLOSED alerts, want 0", got)
+	}
+}
+
+// fakeVault is a secret.Vault which can be unlocked with the given passphrase
+// (by default, "password"), returning an empty store.
+// wipingVault is a secret.Vault whose stores are always-empty
+// secret.WipeStores, which record how many times they are wiped.
+type wipingVault struct {
+	mu     sync.Mutex
+	stores []*wipingStore
+}
+
+func (v *wipingVault) Unlock(passphrase string) (secret.Store, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ws := &wipingStore{}
+	v.stores = append(v.stores, ws)
+	return ws, nil
+}
+
+type wipingStore struct {
+	fakeStore
+	mu    sync.Mutex
+	wipes int
+}
+
+func (s *wipingStore) Wipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wipes++
+}
+
+func (s *wipingStore) wipeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wipes
+}
+
+// blockingVault is a fakeVault, or a wipingVault if wv is set, whose Unlock
+// blocks until a value is sent on release.
+type blockingVault struct {
+	release chan struct{}
+	wv      *wipingVault
+}
+
+func (v *blockingVault) Unlock(passphrase string) (secret.Store, error) {
+	<-v.release
+	if v.wv != nil {
+		return v.wv.Unlock(passphrase)
+	}
+	return fakeVault{}.Unlock(passphrase)
+}
+
+type fakeVault struct{ passphrase string }
+
+func (v fakeVault) Unlock(passphrase string) (secret.Store, error) {
+	want := v.passphrase
+	if want == "" {
+		want = "password"
+	}
+	if passphrase != want {
+		return nil, secret.ErrWrongPassphrase
+	}
+	return fakeStore{}, nil
+}
+
+// externalSecretVault is a fakeVault which also requires an external secret.
+type externalSecretVault struct {
+	fakeVault
+	extra string
+}
+
+func (v externalSecretVault) Unlock(passphrase string) (secret.Store, error) {
+	return v.UnlockWith(passphrase, nil)
+}
+
+func (v externalSecretVault) UnlockWith(passphrase string, extra []byte) (secret.Store, error) {
+	if string(extra) != v.extra {
+		return nil, secret.ErrWrongPassphrase
+	}
+	return v.fakeVault.Unlock(passphrase)
+}
+
+func (v externalSecretVault) UnlockAsyncWith(passphrase string, extra []byte) (secret.UnlockHandle, error) {
+	return secret.StartUnlock(func() (secret.Store, error) { return v.UnlockWith(passphrase, extra) }, nil), nil
+}
+
+// fakeStore is an always-empty secret.Store.
+// namedVault is a fakeVault whose store contains a single entry, named for
+// the vault.
+type namedVault struct {
+	fakeVault
+	name string
+}
+
+func (v namedVault) Unlock(passphrase string) (secret.Store, error) {
+	if _, err := v.fakeVault.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return namedStore{name: v.name}, nil
+}
+
+type namedStore struct {
+	fakeStore
+	name string
+}
+
+func (s namedStore) List() ([]string, error) { return []string{"/" + s.name}, nil }
+
+// entriesVault is a fakeVault whose store contains the given entries.
+type entriesVault struct {
+	fakeVault
+	entries map[string]string
+}
+
+func (v entriesVault) Unlock(passphrase string) (secret.Store, error) {
+	if _, err := v.fakeVault.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return entriesStore{entries: v.entries}, nil
+}
+
+// verifyVault is a fakeVault whose store is a secret.VerifyStore reporting the
+// given problems.
+type verifyVault struct {
+	fakeVault
+	problems []string
+}
+
+func (v verifyVault) Unlock(passphrase string) (secret.Store, error) {
+	if _, err := v.fakeVault.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return verifyStore{problems: v.problems}, nil
+}
+
+type verifyStore struct {
+	fakeStore
+	problems []string
+}
+
+func (s verifyStore) Verify() ([]string, error) { return s.problems, nil }
+
+type entriesStore struct {
+	fakeStore
+	entries map[string]string
+}
+
+func (s entriesStore) List() ([]string, error) {
+	var entries []string
+	for e := range s.entries {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s entriesStore) Get(entry string) (string, error) {
+	content, ok := s.entries[entry]
+	if !ok {
+		return "", secret.ErrNoEntry
+	}
+	return content, nil
+}
+
+type fakeStore struct{}
+
+func (fakeStore) List() ([]string, error)    { return nil, nil }
+func (fakeStore) Get(string) (string, error) { return "", secret.ErrNoEntry }
+func (fakeStore) Put(string, string) error   { return nil }
+func (fakeStore) Delete(string) error        { return secret.ErrNoEntry }
+func (fakeStore) Move(string, string) error  { return secret.ErrNoEntry }
+
+// fakeClock is a Clock whose time changes only when advanced. Timers fire
+// synchronously, when the clock is advanced past their deadline.
+type fakeClock struct {
+	mu     sync.Mutex // protects all fields, including those of timers
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Unix(1e9, 0)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance advances the clock, firing any timers which come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.at.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// AdvanceWithoutFiring advances the clock without firing any timers, as if
+// they were delayed in running.
+func (c *fakeClock) AdvanceWithoutFiring(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type fakeTimer struct {
+	c      *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.at, t.active = t.c.now.Add(d), true
+	return wasActive
+}
+
+// recordingAlerter is an alert.Alerter which records the codes of alerts fired.
+// testRegistration returns a registration blob, as returned by
+// Session.CompleteMFARegistration, for a device with the given credential ID.
+func testRegistration(t *testing.T, credID string) string {
+	t.Helper()
+	reg, err := encodeCredential(&warp.AttestedCredentialData{
+		CredentialID:        []byte(credID),
+		CredentialPublicKey: []byte{0xa0}, // an empty CBOR map
+	})
+	if err != nil {
+		t.Fatalf("Could not encode credential: %v", err)
+	}
+	return reg
+}
+
+type recordingAlerter struct {
+	mu      sync.Mutex
+	codes   []alert.Code
+	details []string
+}
+
+func (ra *recordingAlerter) Alert(ctx context.Context, code alert.Code, details string) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.codes = append(ra.codes, code)
+	ra.details = append(ra.details, details)
+	return nil
+}
+
+// count returns the number of alerts with the given code fired so far. Alerts
+// are fired asynchronously, so it waits briefly for outstanding alerts.
+func (ra *recordingAlerter) count(code alert.Code) int {
+	time.Sleep(50 * time.Millisecond)
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	n := 0
+	for _, c := range ra.codes {
+		if c == code {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTakeMFAAuthentication(t *testing.T) {
+	t.Parallel()
+	c := newFakeClock()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Hour, 1000, alert.NewLog(), WithClock(c))
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	authenticate := func(path string) {
+		sess.mu.Lock()
+		sess.authedPaths[path] = c.Now()
+		sess.mu.Unlock()
+	}
+
+	// Authentication for one path can't be taken for another, but can be
+	// taken once for any path.
+	if sess.TakeMFAAuthentication("") {
+		t.Errorf("TakeMFAAuthentication(%q) = true before authentication", "")
+	}
+	authenticate("/email")
+	if sess.TakeMFAAuthentication("/bank") {
+		t.Errorf("TakeMFAAuthentication(%q) = true after authentication for %q", "/bank", "/email")
+	}
+	if !sess.TakeMFAAuthentication("/email") {
+		t.Errorf("TakeMFAAuthentication(%q) = false after authentication", "/email")
+	}
+	if sess.TakeMFAAuthentication("/email") || sess.IsMFAAuthenticatedFor("/email") {
+		t.Errorf("Authentication for %q was not forgotten once taken", "/email")
+	}
+	authenticate("/email")
+	if !sess.TakeMFAAuthentication("") {
+		t.Errorf("TakeMFAAuthentication(%q) = false after authentication", "")
+	}
+	if sess.TakeMFAAuthentication("") {
+		t.Errorf("TakeMFAAuthentication(%q) = true once authentication was taken", "")
+	}
+}
+
+func TestMakeReadOnly(t *testing.T) {
+	t.Parallel()
+	h, err := NewHandler(fakeVault{}, "https://example.com", nil, nil, time.Hour, 1000, alert.NewLog())
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	_, sess, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	_, other, err := h.CreateSession("client", "", "password")
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	if secret.IsReadOnly(sess.GetStore(), "/entry") {
+		t.Fatalf("New session's store is read-only")
+	}
+	sess.MakeReadOnly()
+	sess.MakeReadOnly()
+	if !secret.IsReadOnly(sess.GetStore(), "/entry") {
+		t.Errorf("After MakeReadOnly, session's store is not read-only")
+	}
+	if secret.IsReadOnly(other.GetStore(), "/entry") {
+		t.Errorf("After MakeReadOnly, another session's store is read-only")
+	}
+}
@@ -0,0 +1,354 @@
+// Package strength estimates the strength of passwords, in the style of
+// zxcvbn. A password is split into the segments an attacker who knows common
+// patterns would guess most easily: common passwords (including
+// capitalized & "l33t" variants), runs of a repeated character, sequences
+// such as "abcd", "9876" or "qwerty", and recent years. Anything else must be
+// guessed by brute force, one character at a time, from the class of
+// characters (lowercase, uppercase, digits or symbols) it belongs to. The
+// password's strength is the number of guesses needed to guess every segment.
+package strength
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed" // for go:embed
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// maxLength is the number of characters of a password which are matched
+	// against patterns. Any further characters are assumed to be guessed by
+	// brute force, which keeps checking very long passwords cheap.
+	maxLength = 100
+
+	// minPatternLength is the length of the shortest segment matched against
+	// a pattern.
+	minPatternLength = 3
+
+	// Years in this range are guessed as a pattern.
+	minYear = 1900
+	maxYear = 2099
+
+	// GuessesPerSecond is the rate at which an attacker is assumed to guess
+	// passwords when estimating crack times: an offline attack against a
+	// slow password hash.
+	GuessesPerSecond = 1e4
+)
+
+// scoreGuesses are the (log10) numbers of guesses at or above which a
+// password gets each score above zero.
+var scoreGuesses = [...]float64{3, 6, 8, 10}
+
+// keyboardRows are sequences of adjacent keys, which may be typed in either
+// direction.
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// leet maps characters commonly substituted for letters to the letters they
+// replace.
+var leet = map[rune]rune{
+	'4': 'a', '@': 'a',
+	'8': 'b',
+	'3': 'e',
+	'6': 'g', '9': 'g',
+	'1': 'i', '!': 'i', '|': 'i',
+	'0': 'o',
+	'$': 's', '5': 's',
+	'7': 't', '+': 't',
+	'2': 'z',
+}
+
+// Estimate is an estimate of a password's strength.
+type Estimate struct {
+	// Score rates the password from 0 (too guessable) to 4 (very
+	// unguessable). Scores of 1 or less should be considered weak.
+	Score int
+	// Guesses is the log10 of the estimated number of guesses needed to
+	// guess the password.
+	Guesses float64
+}
+
+// Weak determines if the password should be considered weak, i.e. if its
+// score is 1 or less.
+func (e Estimate) Weak() bool {
+	return e.Score <= 1
+}
+
+// CrackTimeSeconds returns the estimated time to guess the password, in
+// seconds, at GuessesPerSecond.
+func (e Estimate) CrackTimeSeconds() float64 {
+	return math.Pow(10, e.Guesses) / GuessesPerSecond
+}
+
+// CrackTime returns a human-readable description of the estimated time to
+// guess the password, e.g. "3 hours".
+func (e Estimate) CrackTime() string {
+	s := e.CrackTimeSeconds()
+	if s < 1 {
+		return "less than a second"
+	}
+	for _, u := range []struct {
+		name    string
+		seconds float64
+	}{
+		{"century", 100 * 365.25 * 86400},
+		{"year", 365.25 * 86400},
+		{"month", 365.25 * 86400 / 12},
+		{"day", 86400},
+		{"hour", 3600},
+		{"minute", 60},
+		{"second", 1},
+	} {
+		if s < u.seconds {
+			continue
+		}
+		if u.name == "century" {
+			return "centuries"
+		}
+		n := int(math.Round(s / u.seconds))
+		if n == 1 {
+			return fmt.Sprintf("1 %s", u.name)
+		}
+		return fmt.Sprintf("%d %ss", n, u.name)
+	}
+	panic("unreachable")
+}
+
+// Check estimates the strength of the given password.
+func Check(password string) Estimate {
+	pw := []rune(password)
+	if len(pw) == 0 {
+		return Estimate{}
+	}
+	extra := 0.0
+	if len(pw) > maxLength {
+		for _, r := range pw[maxLength:] {
+			extra += charBits(r)
+		}
+		pw = pw[:maxLength]
+	}
+
+	// bits[i] is the minimum number of bits needed to guess pw[:i].
+	bits := make([]float64, len(pw)+1)
+	for i := 1; i <= len(pw); i++ {
+		bits[i] = bits[i-1] + charBits(pw[i-1])
+		for j := i - minPatternLength; j >= 0; j-- {
+			if b, ok := patternBits(pw[j:i]); ok && bits[j]+b < bits[i] {
+				bits[i] = bits[j] + b
+			}
+		}
+	}
+
+	guesses := (bits[len(pw)] + extra) * math.Log10(2)
+	score := 0
+	for score < len(scoreGuesses) && guesses >= scoreGuesses[score] {
+		score++
+	}
+	return Estimate{Score: score, Guesses: guesses}
+}
+
+// patternBits returns the number of bits needed to guess the given segment of
+// a password if it matches a pattern, or false if it matches no pattern. Each
+// pattern costs at least one bit, for the choice of pattern.
+func patternBits(seg []rune) (float64, bool) {
+	best, ok := math.Inf(1), false
+	consider := func(b float64) {
+		if b+1 < best {
+			best, ok = b+1, true
+		}
+	}
+	n := float64(len(seg))
+	if rank, b := dictionaryRank(seg); rank > 0 {
+		consider(math.Log2(float64(rank)) + b)
+	}
+	if isRepeat(seg) {
+		consider(charBits(seg[0]) + math.Log2(n))
+	}
+	if isYear(seg) {
+		consider(math.Log2(maxYear - minYear + 1))
+	}
+	if desc, isSeq := isSequence(seg); isSeq {
+		b := charBits(seg[0]) + math.Log2(n)
+		if desc {
+			b++
+		}
+		consider(b)
+	}
+	return best, ok
+}
+
+// dictionaryRank returns the rank of the given segment in the list of common
+// passwords (1 being the most common), and the number of bits needed to guess
+// how it varies from the listed password by capitalization & substitution of
+// characters. It returns a rank of zero if the segment is not a common
+// password.
+func dictionaryRank(seg []rune) (int, float64) {
+	lower := strings.ToLower(string(seg))
+	caseBits := capitalizationBits(seg)
+	if rank := commonPasswords()[lower]; rank > 0 {
+		return rank, caseBits
+	}
+	unleeted, subs := []rune(lower), 0
+	for i, r := range unleeted {
+		if l, ok := leet[r]; ok {
+			unleeted[i] = l
+			subs++
+		}
+	}
+	if rank := commonPasswords()[string(unleeted)]; subs > 0 && rank > 0 {
+		return rank, caseBits + float64(subs)
+	}
+	return 0, 0
+}
+
+// capitalizationBits returns the number of bits needed to guess which letters
+// of the given segment are uppercase. Common capitalizations (none, all, or
+// only the first letter) are cheap.
+func capitalizationBits(seg []rune) float64 {
+	letters, upper := 0, 0
+	for _, r := range seg {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case upper == letters, upper == 1 && unicode.IsUpper(seg[0]):
+		return 1
+	}
+	// Otherwise, any choice of at most as many uppercase letters is possible.
+	lower, choices := letters-upper, 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		choices += binomial(letters, k)
+	}
+	return math.Log2(choices)
+}
+
+// isRepeat determines if the given segment is a single repeated character.
+func isRepeat(seg []rune) bool {
+	for _, r := range seg[1:] {
+		if r != seg[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// isSequence determines if the given segment is a sequence of consecutive
+// characters (e.g. "abcd" or "4321") or of adjacent keys on a keyboard row,
+// and whether the sequence is descending.
+func isSequence(seg []rune) (desc, ok bool) {
+	delta := seg[1] - seg[0]
+	if delta == 1 || delta == -1 {
+		ok = true
+		for i := 2; i < len(seg); i++ {
+			if seg[i]-seg[i-1] != delta {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return delta == -1, true
+		}
+	}
+	lower := strings.ToLower(string(seg))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) {
+			return false, true
+		}
+		if strings.Contains(row, reverse(lower)) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// isYear determines if the given segment is a year between minYear & maxYear.
+func isYear(seg []rune) bool {
+	if len(seg) != 4 {
+		return false
+	}
+	y := 0
+	for _, r := range seg {
+		if r < '0' || r > '9' {
+			return false
+		}
+		y = 10*y + int(r-'0')
+	}
+	return y >= minYear && y <= maxYear
+}
+
+// charBits returns the number of bits needed to guess the given character by
+// brute force, given the class of characters it belongs to.
+func charBits(r rune) float64 {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return math.Log2(26)
+	case r >= '0' && r <= '9':
+		return math.Log2(10)
+	case r >= ' ' && r <= '~':
+		return math.Log2(33)
+	default:
+		return math.Log2(100)
+	}
+}
+
+// commonPasswordList is the list of common passwords, most common first. Blank
+// lines & lines starting with "#" are ignored.
+//
+//go:embed assets/strength/common-passwords.txt
+var commonPasswordList []byte
+
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswordRanks map[string]int
+)
+
+// commonPasswords returns the rank of each common password, 1 being the most
+// common, from the embedded list.
+func commonPasswords() map[string]int {
+	commonPasswordsOnce.Do(func() {
+		commonPasswordRanks = map[string]int{}
+		s := bufio.NewScanner(bytes.NewReader(commonPasswordList))
+		for s.Scan() {
+			pw := s.Text()
+			if pw == "" || strings.HasPrefix(pw, "#") {
+				continue
+			}
+			if _, ok := commonPasswordRanks[pw]; !ok {
+				commonPasswordRanks[pw] = len(commonPasswordRanks) + 1
+			}
+		}
+	})
+	return commonPasswordRanks
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func reverse(s string) string {
+	rs := []rune(s)
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+	return string(rs)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,99 @@
+package strength
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	// These scores pin the heuristics; if a change to the heuristics changes
+	// them, make sure the change is intended.
+	for _, test := range []struct {
+		password  string
+		wantScore int
+	}{
+		// Common passwords, & variants of them.
+		{"", 0},
+		{"password", 0},
+		{"Password", 0},
+		{"P@ssw0rd", 0},
+		{"p4ssw0rd!", 0},
+		{"iloveyou", 0},
+		{"dragon!", 0},
+		{"hunter2", 0},
+		{"letmein123", 1},
+		{"monkey2019", 1},
+
+		// Repeats & sequences.
+		{"123456", 0},
+		{"aaaaaaaa", 0},
+		{"abcdefgh", 0},
+		{"zyxwvu", 0},
+		{"qwertyuiop", 0},
+
+		// Random passwords; longer is stronger.
+		{"7Gh2kP", 2},
+		{"kx8qv2ms", 4},
+		{"xK9#mQ2$vL7p", 4},
+		{"correct horse battery staple", 4},
+	} {
+		if got := Check(test.password); got.Score != test.wantScore {
+			t.Errorf("Check(%q) = %+v, want score %d", test.password, got, test.wantScore)
+		}
+	}
+}
+
+func TestCheckPatternsWeakerThanRandom(t *testing.T) {
+	t.Parallel()
+
+	// Each password matching a pattern is weaker than a random password of
+	// the same length & character classes.
+	for _, test := range []struct{ pattern, random string }{
+		{"password", "pwqzmxkd"},
+		{"P4ssw0rd", "P4xqw9rm"},
+		{"aaaaaa", "akqmzd"},
+		{"abcdef", "afkbzq"},
+		{"asdfgh", "ahqzmx"},
+		{"1999", "4817"},
+	} {
+		if p, r := Check(test.pattern), Check(test.random); p.Guesses >= r.Guesses {
+			t.Errorf("Check(%q) = %+v, not weaker than Check(%q) = %+v", test.pattern, p, test.random, r)
+		}
+	}
+}
+
+func TestCheckLong(t *testing.T) {
+	t.Parallel()
+
+	// Characters beyond those matched against patterns are still counted.
+	short, long := Check(strings.Repeat("x9", maxLength/2)), Check(strings.Repeat("x9", maxLength))
+	if long.Guesses <= short.Guesses || math.IsInf(long.Guesses, 0) {
+		t.Errorf("Check of %d characters = %+v, want more guesses than %d characters (%+v)", 2*maxLength, long, maxLength, short)
+	}
+}
+
+func TestCrackTime(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		seconds float64
+		want    string
+	}{
+		{0.5, "less than a second"},
+		{1, "1 second"},
+		{59, "59 seconds"},
+		{3 * 3600, "3 hours"},
+		{2 * 86400, "2 days"},
+		{45 * 86400, "1 month"},
+		{3 * 365.25 * 86400, "3 years"},
+		{1e12, "centuries"},
+	} {
+		e := Estimate{Guesses: math.Log10(test.seconds * GuessesPerSecond)}
+		if got := e.CrackTime(); got != test.want {
+			t.Errorf("CrackTime for %v seconds = %q, want %q", test.seconds, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package totp provides generation of time-based one-time passwords, as
+// specified by RFC 6238.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDigits = 6
+	defaultPeriod = 30 * time.Second
+)
+
+// Key holds the parameters necessary to generate one-time passwords.
+type Key struct {
+	Secret    []byte
+	Digits    int
+	Period    time.Duration
+	Algorithm string // one of "SHA1", "SHA256", "SHA512"
+}
+
+// Parse parses a TOTP key. The key may be specified either as an otpauth://
+// URI (as used in QR codes), or as a bare base32-encoded secret, in which case
+// default parameters (6 digits, 30 second period, SHA1) are used.
+func Parse(s string) (*Key, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "otpauth://") {
+		secret, err := decodeSecret(s)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{Secret: secret, Digits: defaultDigits, Period: defaultPeriod, Algorithm: "SHA1"}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse URI: %w", err)
+	}
+	if u.Host != "totp" {
+		return nil, fmt.Errorf("unsupported OTP type %q", u.Host)
+	}
+	q := u.Query()
+	secret, err := decodeSecret(q.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+	k := &Key{Secret: secret, Digits: defaultDigits, Period: defaultPeriod, Algorithm: "SHA1"}
+	if d := q.Get("digits"); d != "" {
+		digits, err := strconv.Atoi(d)
+		if err != nil || digits < 6 || digits > 10 {
+			return nil, fmt.Errorf("invalid digits %q", d)
+		}
+		k.Digits = digits
+	}
+	if p := q.Get("period"); p != "" {
+		period, err := strconv.Atoi(p)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid period %q", p)
+		}
+		k.Period = time.Duration(period) * time.Second
+	}
+	if a := q.Get("algorithm"); a != "" {
+		k.Algorithm = strings.ToUpper(a)
+		if k.hash() == nil {
+			return nil, fmt.Errorf("unsupported algorithm %q", a)
+		}
+	}
+	return k, nil
+}
+
+// Code computes the one-time password for the given time, returning the code
+// and the duration until the code expires.
+func (k *Key) Code(t time.Time) (code string, expiresIn time.Duration) {
+	periodS := int64(k.Period / time.Second)
+	counter := t.Unix() / periodS
+	expiresIn = time.Unix((counter+1)*periodS, 0).Sub(t)
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(k.hash(), k.Secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, per RFC 4226 section 5.3.
+	offset := sum[len(sum)-1] & 0x0f
+	v := int64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+	mod := int64(1)
+	for i := 0; i < k.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", k.Digits, v%mod), expiresIn
+}
+
+func (k *Key) hash() func() hash.Hash {
+	switch k.Algorithm {
+	case "SHA1", "":
+		return sha1.New
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+func decodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(s))
+	if s == "" {
+		return nil, errors.New("missing secret")
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode secret: %w", err)
+	}
+	return secret, nil
+}
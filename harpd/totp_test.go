@@ -0,0 +1,73 @@
+package totp
+
+import (
+	"encoding/base32"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	t.Parallel()
+
+	// Test vectors from RFC 6238 appendix B.
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	for _, test := range []struct {
+		t    int64
+		alg  string
+		want string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	} {
+		uri := fmt.Sprintf("otpauth://totp/Example:alice?secret=%s&digits=8&algorithm=%s", base32.StdEncoding.EncodeToString([]byte(secrets[test.alg])), test.alg)
+		k, err := Parse(uri)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", uri, err)
+		}
+		if got, _ := k.Code(time.Unix(test.t, 0)); got != test.want {
+			t.Errorf("Code at %d with %s = %q, want %q", test.t, test.alg, got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	k, err := Parse("GEZD GNBV GY3T QOJQ")
+	if err != nil {
+		t.Fatalf("Could not parse bare secret: %v", err)
+	}
+	if string(k.Secret) != "1234567890" || k.Digits != 6 || k.Period != 30*time.Second || k.Algorithm != "SHA1" {
+		t.Errorf("Parse of bare secret = %+v", k)
+	}
+	code, expiresIn := k.Code(time.Unix(59, 0))
+	if len(code) != 6 || expiresIn != time.Second {
+		t.Errorf("Code = %q, %v; want 6-digit code expiring in 1s", code, expiresIn)
+	}
+
+	for _, bad := range []string{
+		"",
+		"not base32!",
+		"otpauth://hotp/Example?secret=GEZDGNBV&counter=1",
+		"otpauth://totp/Example",
+		"otpauth://totp/Example?secret=GEZDGNBV&digits=3",
+		"otpauth://totp/Example?secret=GEZDGNBV&period=0",
+		"otpauth://totp/Example?secret=GEZDGNBV&algorithm=MD5",
+	} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", bad)
+		}
+	}
+}
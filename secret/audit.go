@@ -0,0 +1,111 @@
+// Package audit provides checks of the passwords held in a secret.Store, such
+// as whether they appear in known data breaches or are reused across entries.
+package audit
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+// PasswordChecker checks passwords against a set of known-breached passwords.
+type PasswordChecker interface {
+	// Breaches returns the number of times the given password appears in
+	// known data breaches, or 0 if it does not appear.
+	Breaches(password string) (int, error)
+}
+
+// Breach describes an entry whose password appears in known data breaches.
+type Breach struct {
+	Entry string
+	Count int // number of times the password appears in known breaches
+}
+
+// Change describes when an entry was last changed.
+type Change struct {
+	Entry string
+	Time  time.Time // see entry.Entry.LastChanged
+}
+
+// Report is the result of auditing a store.
+type Report struct {
+	Entries  int        // number of entries with a password which were checked
+	Breached []Breach   // entries whose passwords appear in known breaches, ordered by entry
+	Reused   [][]string // groups of entries sharing a password, each ordered by entry
+	Changes  []Change   // when entries were last changed, ordered from least recently changed; entries for which this is unknown are omitted
+}
+
+// Run audits each entry in the given store, checking that the password (the
+// first line of the entry's content) does not appear in known breaches and is
+// not reused by another entry, and noting when each entry was last changed.
+// Hidden entries are skipped. If c is nil, only
+// reuse is checked. If non-nil, progress is called after each entry is
+// checked, with the number of entries checked so far and the total number of
+// entries to check.
+func Run(s secret.Store, c PasswordChecker, progress func(done, total int)) (*Report, error) {
+	allEntries, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	var entries []string
+	for _, e := range allEntries {
+		if !strings.Contains(e, "/.") {
+			entries = append(entries, e)
+		}
+	}
+	sort.Strings(entries)
+
+	ss, canStat := secret.AsStatStore(s)
+	rpt := &Report{}
+	byHash := map[[sha256.Size]byte][]string{}
+	for i, e := range entries {
+		content, err := s.Get(e)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get %q: %w", e, err)
+		}
+		ent := entry.Parse(content)
+		var modTime time.Time
+		if canStat {
+			info, err := ss.Stat(e)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't stat %q: %w", e, err)
+			}
+			modTime = info.ModTime
+		}
+		if t := ent.LastChanged(modTime); !t.IsZero() {
+			rpt.Changes = append(rpt.Changes, Change{Entry: e, Time: t})
+		}
+		if pw := ent.Password; pw != "" {
+			rpt.Entries++
+			// Only hashes of passwords are retained, to avoid holding plaintext longer than needed.
+			h := sha256.Sum256([]byte(pw))
+			byHash[h] = append(byHash[h], e)
+			if c != nil {
+				cnt, err := c.Breaches(pw)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't check password of %q: %w", e, err)
+				}
+				if cnt > 0 {
+					rpt.Breached = append(rpt.Breached, Breach{Entry: e, Count: cnt})
+				}
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(entries))
+		}
+	}
+
+	for _, es := range byHash {
+		if len(es) > 1 {
+			rpt.Reused = append(rpt.Reused, es)
+		}
+	}
+	sort.Slice(rpt.Reused, func(i, j int) bool { return rpt.Reused[i][0] < rpt.Reused[j][0] })
+	sort.SliceStable(rpt.Changes, func(i, j int) bool { return rpt.Changes[i].Time.Before(rpt.Changes[j].Time) })
+	return rpt, nil
+}
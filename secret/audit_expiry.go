@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+// Expiration is the date an entry expires, as given by its expires field.
+type Expiration struct {
+	Entry string
+	Date  time.Time // midnight UTC; see entry.ParseDate
+}
+
+// Expirations returns the expiration dates of the entries in the given store,
+// ordered by date & then by entry. Hidden entries & entries without a valid
+// expiration date are skipped. If s wraps a store returned by
+// NewExpiryTracker, the tracker's memoized index is used rather than reading
+// every entry.
+func Expirations(s secret.Store) ([]Expiration, error) {
+	var exps []Expiration
+	err := withDateIndex(s, func(idx expiryIndex) { exps = idx.expirations() })
+	return exps, err
+}
+
+// ChangeTimes returns the times at which the entries in the given store were
+// last changed, by entry, as given by their changed fields (see
+// entry.Entry.LastChanged). Hidden entries & entries without a valid changed
+// field are skipped. As for Expirations, the memoized index of a tracker
+// returned by NewExpiryTracker is used if possible.
+func ChangeTimes(s secret.Store) (map[string]time.Time, error) {
+	var changes map[string]time.Time
+	err := withDateIndex(s, func(idx expiryIndex) { changes = idx.changeTimes() })
+	return changes, err
+}
+
+// withDateIndex calls f with an index of the dates of the entries in the
+// given store, using the memoized index of the store's expiry tracker if
+// there is one. f must not retain or modify the index.
+func withDateIndex(s secret.Store, f func(expiryIndex)) error {
+	et, ok := secret.Find(s, func(s secret.Store) bool {
+		_, ok := s.(*expiryTracker)
+		return ok
+	}).(*expiryTracker)
+	if !ok {
+		idx, err := buildExpiryIndex(s)
+		if err != nil {
+			return err
+		}
+		f(idx)
+		return nil
+	}
+
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if now := time.Now(); et.idx == nil || now.Sub(et.builtAt) >= et.maxAge {
+		idx, err := buildExpiryIndex(et.s)
+		if err != nil {
+			return err
+		}
+		et.idx, et.builtAt = idx, now
+	}
+	f(et.idx)
+	return nil
+}
+
+// NewExpiryTracker wraps the given store, memoizing an index of entries'
+// expiration dates & changed fields for use by Expirations & ChangeTimes. The index is built when first
+// needed, then kept up to date as entries are modified via the returned store.
+// Since modifications made other than via the returned store are not
+// reflected in the index, it is rebuilt when next needed once it is older
+// than maxAge.
+func NewExpiryTracker(s secret.Store, maxAge time.Duration) secret.Store {
+	return &expiryTracker{s: s, maxAge: maxAge}
+}
+
+type expiryTracker struct {
+	s      secret.Store
+	maxAge time.Duration
+
+	mu      sync.Mutex  // protects idx & builtAt
+	idx     expiryIndex // nil until first needed
+	builtAt time.Time
+}
+
+func (et *expiryTracker) Unwrap() secret.Store             { return et.s }
+func (et *expiryTracker) List() ([]string, error)          { return et.s.List() }
+func (et *expiryTracker) Get(entry string) (string, error) { return et.s.Get(entry) }
+
+func (et *expiryTracker) Put(entry, content string) error {
+	return et.put(entry, content, et.s.Put)
+}
+
+func (et *expiryTracker) PutIf(entry, content, expectedHash string) error {
+	return et.put(entry, content, func(entry, content string) error {
+		return secret.PutIf(et.s, entry, content, expectedHash)
+	})
+}
+
+func (et *expiryTracker) put(entry, content string, put func(entry, content string) error) error {
+	if err := put(entry, content); err != nil {
+		return err
+	}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if et.idx != nil {
+		delete(et.idx, entry)
+		et.idx.add(entry, content)
+	}
+	return nil
+}
+
+func (et *expiryTracker) Delete(entry string) error {
+	if err := et.s.Delete(entry); err != nil {
+		return err
+	}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if et.idx != nil {
+		delete(et.idx, entry)
+	}
+	return nil
+}
+
+func (et *expiryTracker) Move(oldEntry, newEntry string) error {
+	if err := et.s.Move(oldEntry, newEntry); err != nil {
+		return err
+	}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	if et.idx != nil {
+		if d, ok := et.idx[oldEntry]; ok {
+			delete(et.idx, oldEntry)
+			if !strings.Contains(newEntry, "/.") {
+				et.idx[newEntry] = d
+			}
+		}
+	}
+	return nil
+}
+
+// expiryIndex holds the expiration dates & changed fields of entries, by
+// entry.
+type expiryIndex map[string]entryDates
+
+// entryDates are the dates given by an entry's fields. Either may be zero, if
+// the entry doesn't hold the field or it is invalid.
+type entryDates struct {
+	expires time.Time
+	changed time.Time
+}
+
+func buildExpiryIndex(s secret.Store) (expiryIndex, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	idx := expiryIndex{}
+	for _, e := range entries {
+		if strings.Contains(e, "/.") {
+			continue
+		}
+		content, err := s.Get(e)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get %q: %w", e, err)
+		}
+		idx.add(e, content)
+	}
+	return idx, nil
+}
+
+// add indexes an entry with the given content, unless the entry is hidden or
+// has neither a valid expiration date nor a valid changed field.
+func (idx expiryIndex) add(e, content string) {
+	if strings.Contains(e, "/.") {
+		return
+	}
+	ent := entry.Parse(content)
+	var ds entryDates
+	ds.expires, _ = ent.Expiration()
+	ds.changed = ent.LastChanged(time.Time{})
+	if !ds.expires.IsZero() || !ds.changed.IsZero() {
+		idx[e] = ds
+	}
+}
+
+func (idx expiryIndex) expirations() []Expiration {
+	exps := make([]Expiration, 0, len(idx))
+	for e, ds := range idx {
+		if !ds.expires.IsZero() {
+			exps = append(exps, Expiration{e, ds.expires})
+		}
+	}
+	sort.Slice(exps, func(i, j int) bool {
+		if !exps[i].Date.Equal(exps[j].Date) {
+			return exps[i].Date.Before(exps[j].Date)
+		}
+		return exps[i].Entry < exps[j].Entry
+	})
+	return exps
+}
+
+func (idx expiryIndex) changeTimes() map[string]time.Time {
+	changes := map[string]time.Time{}
+	for e, ds := range idx {
+		if !ds.changed.IsZero() {
+			changes[e] = ds.changed
+		}
+	}
+	return changes
+}
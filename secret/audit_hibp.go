@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// prefixLen is the length of the hex-encoded SHA-1 prefix used to select a
+// k-anonymity bucket.
+const prefixLen = 5
+
+// Ranger provides k-anonymity buckets of breached password hashes, in the
+// manner of the Have I Been Pwned "range" API.
+type Ranger interface {
+	// Range returns the bucket for the given prefix, which is the first
+	// five characters of an uppercase hex-encoded SHA-1 hash. The bucket
+	// maps the remaining characters of each known-breached password hash
+	// beginning with the prefix to the number of times the password
+	// appears in breaches.
+	Range(prefix string) (map[string]int, error)
+}
+
+// NewRangeChecker returns a PasswordChecker which checks passwords against the
+// buckets returned by r. Only the prefix of each password's hash is passed to
+// r.
+func NewRangeChecker(r Ranger) PasswordChecker {
+	return rangeChecker{r}
+}
+
+// rangeChecker implements PasswordChecker.
+type rangeChecker struct {
+	r Ranger
+}
+
+func (rc rangeChecker) Breaches(password string) (int, error) {
+	h := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(h[:]))
+	bucket, err := rc.r.Range(hash[:prefixLen])
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get range: %w", err)
+	}
+	return bucket[hash[prefixLen:]], nil
+}
+
+// FileRanger implements Ranger using a local copy of the Have I Been Pwned
+// password dataset. The dataset file holds one "HASH:COUNT" line per breached
+// password, where HASH is the hex-encoded SHA-1 hash of the password; lines
+// must be ordered by hash, as in the "ordered by hash" downloads. Nothing is
+// sent over the network.
+type FileRanger struct {
+	f    *os.File
+	size int64
+}
+
+var _ Ranger = (*FileRanger)(nil)
+
+// NewFileRanger creates a new FileRanger reading the dataset file at the
+// given location.
+func NewFileRanger(filename string) (*FileRanger, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %q: %w", filename, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("couldn't stat %q: %w", filename, err)
+	}
+	return &FileRanger{f: f, size: fi.Size()}, nil
+}
+
+// Close closes the dataset file.
+func (fr *FileRanger) Close() error { return fr.f.Close() }
+
+// Range helps to implement Ranger.
+func (fr *FileRanger) Range(prefix string) (map[string]int, error) {
+	prefix = strings.ToUpper(prefix)
+	if len(prefix) != prefixLen {
+		return nil, fmt.Errorf("prefix %q has wrong length", prefix)
+	}
+
+	// Binary search for the first line at or after the bucket's position.
+	lo, hi := int64(0), fr.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, line, err := fr.lineAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || len(line) < prefixLen || strings.ToUpper(line[:prefixLen]) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	start, _, err := fr.lineAt(lo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the lines in the bucket.
+	bucket := map[string]int{}
+	r := bufio.NewReader(io.NewSectionReader(fr.f, start, fr.size-start))
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("couldn't read dataset: %w", readErr)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < prefixLen || strings.ToUpper(line[:prefixLen]) != prefix {
+			return bucket, nil
+		}
+		suffix, count, err := parseLine(line[prefixLen:])
+		if err != nil {
+			return nil, err
+		}
+		bucket[suffix] = count
+		if readErr == io.EOF {
+			return bucket, nil
+		}
+	}
+}
+
+// lineAt returns the offset and content (without line ending) of the first
+// line in the dataset starting at or after the given offset. If there is no
+// such line, the returned line is empty.
+func (fr *FileRanger) lineAt(off int64) (int64, string, error) {
+	start := off
+	if off > 0 {
+		// Start reading at the byte before off, so that the remainder of
+		// the line containing that byte can be skipped.
+		start = off - 1
+	}
+	r := bufio.NewReader(io.NewSectionReader(fr.f, start, fr.size-start))
+	if off > 0 {
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return fr.size, "", nil
+		}
+		if err != nil {
+			return 0, "", fmt.Errorf("couldn't read dataset: %w", err)
+		}
+		start += int64(len(skipped))
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", fmt.Errorf("couldn't read dataset: %w", err)
+	}
+	return start, strings.TrimRight(line, "\r\n"), nil
+}
+
+// parseLine parses the remainder of a dataset line, after the prefix, into a
+// hash suffix and a count.
+func parseLine(rest string) (suffix string, count int, _ error) {
+	i := strings.IndexByte(rest, ':')
+	if i == -1 {
+		return "", 0, fmt.Errorf("malformed dataset line %q", rest)
+	}
+	count, err := strconv.Atoi(rest[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed count in dataset line %q: %w", rest, err)
+	}
+	return strings.ToUpper(rest[:i]), count, nil
+}
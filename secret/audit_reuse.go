@@ -0,0 +1,225 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+// ReusedPasswords returns the groups of entries in the given store which share
+// a password (the first line of the entry's content), each ordered by entry.
+// Hidden entries are skipped. If s wraps a store returned by NewReuseTracker,
+// the tracker's memoized index is used rather than reading every entry.
+func ReusedPasswords(s secret.Store) ([][]string, error) {
+	var reused [][]string
+	err := withReuseIndex(s, func(idx *reuseIndex) { reused = idx.reused() })
+	return reused, err
+}
+
+// SharingPassword returns the other entries in the given store which share the
+// password of the given entry, ordered by entry. As with ReusedPasswords, a
+// tracker's memoized index is used if available.
+func SharingPassword(s secret.Store, entry string) ([]string, error) {
+	var sharing []string
+	err := withReuseIndex(s, func(idx *reuseIndex) { sharing = idx.sharing(entry) })
+	return sharing, err
+}
+
+// NewReuseTracker wraps the given store, memoizing an index of which entries
+// share passwords for use by ReusedPasswords & SharingPassword. The index is
+// built when first needed, then kept up to date as entries are modified via
+// the returned store. Modifications made other than via the returned store are
+// not reflected in the index. Only hashes of passwords are retained.
+func NewReuseTracker(s secret.Store) secret.Store {
+	return &reuseTracker{s: s}
+}
+
+type reuseTracker struct {
+	s secret.Store
+
+	mu  sync.Mutex  // protects idx
+	idx *reuseIndex // nil until first needed
+}
+
+// withReuseIndex calls f with an index of the entries in s, using the index
+// memoized by a reuseTracker if possible.
+func withReuseIndex(s secret.Store, f func(*reuseIndex)) error {
+	rt, ok := secret.Find(s, func(s secret.Store) bool {
+		_, ok := s.(*reuseTracker)
+		return ok
+	}).(*reuseTracker)
+	if !ok {
+		idx, err := buildReuseIndex(s)
+		if err != nil {
+			return err
+		}
+		f(idx)
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.idx == nil {
+		idx, err := buildReuseIndex(rt.s)
+		if err != nil {
+			return err
+		}
+		rt.idx = idx
+	}
+	f(rt.idx)
+	return nil
+}
+
+func (rt *reuseTracker) Unwrap() secret.Store             { return rt.s }
+func (rt *reuseTracker) List() ([]string, error)          { return rt.s.List() }
+func (rt *reuseTracker) Get(entry string) (string, error) { return rt.s.Get(entry) }
+
+func (rt *reuseTracker) Put(entry, content string) error {
+	return rt.put(entry, content, rt.s.Put)
+}
+
+func (rt *reuseTracker) PutIf(entry, content, expectedHash string) error {
+	return rt.put(entry, content, func(entry, content string) error {
+		return secret.PutIf(rt.s, entry, content, expectedHash)
+	})
+}
+
+func (rt *reuseTracker) put(entry, content string, put func(entry, content string) error) error {
+	if err := put(entry, content); err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.idx != nil {
+		rt.idx.remove(entry)
+		rt.idx.add(entry, content)
+	}
+	return nil
+}
+
+func (rt *reuseTracker) Delete(entry string) error {
+	if err := rt.s.Delete(entry); err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.idx != nil {
+		rt.idx.remove(entry)
+	}
+	return nil
+}
+
+func (rt *reuseTracker) Move(oldEntry, newEntry string) error {
+	if err := rt.s.Move(oldEntry, newEntry); err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.idx != nil {
+		if h, ok := rt.idx.byEntry[oldEntry]; ok {
+			rt.idx.remove(oldEntry)
+			rt.idx.addHash(newEntry, h)
+		}
+	}
+	return nil
+}
+
+// reuseIndex indexes entries by the SHA-256 hash of their password.
+type reuseIndex struct {
+	byHash  map[[sha256.Size]byte]map[string]bool
+	byEntry map[string][sha256.Size]byte
+}
+
+func buildReuseIndex(s secret.Store) (*reuseIndex, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	idx := &reuseIndex{
+		byHash:  map[[sha256.Size]byte]map[string]bool{},
+		byEntry: map[string][sha256.Size]byte{},
+	}
+	for _, e := range entries {
+		if strings.Contains(e, "/.") {
+			continue
+		}
+		content, err := s.Get(e)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get %q: %w", e, err)
+		}
+		idx.add(e, content)
+	}
+	return idx, nil
+}
+
+// add indexes an entry with the given content. The entry must not already be
+// indexed.
+func (idx *reuseIndex) add(e, content string) {
+	if pw := entry.Parse(content).Password; pw != "" {
+		idx.addHash(e, sha256.Sum256([]byte(pw)))
+	}
+}
+
+// addHash indexes an entry whose password has the given hash, unless the entry
+// is hidden. The entry must not already be indexed.
+func (idx *reuseIndex) addHash(e string, h [sha256.Size]byte) {
+	if strings.Contains(e, "/.") {
+		return
+	}
+	if idx.byHash[h] == nil {
+		idx.byHash[h] = map[string]bool{}
+	}
+	idx.byHash[h][e] = true
+	idx.byEntry[e] = h
+}
+
+func (idx *reuseIndex) remove(e string) {
+	h, ok := idx.byEntry[e]
+	if !ok {
+		return
+	}
+	delete(idx.byEntry, e)
+	delete(idx.byHash[h], e)
+	if len(idx.byHash[h]) == 0 {
+		delete(idx.byHash, h)
+	}
+}
+
+func (idx *reuseIndex) reused() [][]string {
+	var reused [][]string
+	for _, es := range idx.byHash {
+		if len(es) > 1 {
+			reused = append(reused, sortedKeys(es))
+		}
+	}
+	sort.Slice(reused, func(i, j int) bool { return reused[i][0] < reused[j][0] })
+	return reused
+}
+
+func (idx *reuseIndex) sharing(e string) []string {
+	h, ok := idx.byEntry[e]
+	if !ok {
+		return nil
+	}
+	var sharing []string
+	for _, o := range sortedKeys(idx.byHash[h]) {
+		if o != e {
+			sharing = append(sharing, o)
+		}
+	}
+	return sharing
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
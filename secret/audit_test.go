@@ -0,0 +1,299 @@
+package audit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestFileRanger(t *testing.T) {
+	t.Parallel()
+
+	// Generate a dataset of many passwords, so that binary search is exercised.
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[fmt.Sprintf("password%d", i)] = i + 1
+	}
+	fr := newFileRanger(t, counts)
+	c := NewRangeChecker(fr)
+
+	for pw, want := range counts {
+		if got, err := c.Breaches(pw); err != nil || got != want {
+			t.Errorf("Breaches(%q) = (%d, %v), want (%d, nil)", pw, got, err, want)
+		}
+	}
+	for _, pw := range []string{"", "not breached", "password1000"} {
+		if got, err := c.Breaches(pw); err != nil || got != 0 {
+			t.Errorf("Breaches(%q) = (%d, %v), want (0, nil)", pw, got, err)
+		}
+	}
+
+	// Buckets hold every hash with the prefix, and nothing else.
+	h := sha1Hex("password0")
+	bucket, err := fr.Range(strings.ToLower(h[:prefixLen]))
+	if err != nil {
+		t.Fatalf("Could not get range: %v", err)
+	}
+	for suffix := range bucket {
+		if !inDataset(counts, h[:prefixLen]+suffix) {
+			t.Errorf("Range(%q) returned unexpected suffix %q", h[:prefixLen], suffix)
+		}
+	}
+	if _, ok := bucket[h[prefixLen:]]; !ok {
+		t.Errorf("Range(%q) did not return suffix %q", h[:prefixLen], h[prefixLen:])
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	s := memStore{
+		"/breached":       "hunter2\nusername: alice",
+		"/reused/a":       "correct horse battery staple",
+		"/reused/b":       "correct horse battery staple\nnotes",
+		"/unique":         "Tr0ub4dor&3\nchanged: 2024-01-02T03:04:05Z",
+		"/empty":          "",
+		"/.hidden/secret": "hunter2",
+	}
+	c := NewRangeChecker(newFileRanger(t, map[string]int{"hunter2": 17}))
+
+	var progress []string
+	rpt, err := Run(s, c, func(done, total int) { progress = append(progress, fmt.Sprintf("%d/%d", done, total)) })
+	if err != nil {
+		t.Fatalf("Could not run audit: %v", err)
+	}
+	want := &Report{
+		Entries:  4,
+		Breached: []Breach{{Entry: "/breached", Count: 17}},
+		Reused:   [][]string{{"/reused/a", "/reused/b"}},
+		Changes:  []Change{{Entry: "/unique", Time: time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)}},
+	}
+	if !reflect.DeepEqual(rpt, want) {
+		t.Errorf("Run() = %+v, want %+v", rpt, want)
+	}
+	if want := []string{"1/5", "2/5", "3/5", "4/5", "5/5"}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("Progress = %q, want %q", progress, want)
+	}
+
+	// Without a checker, only reuse is reported.
+	rpt, err = Run(s, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not run audit: %v", err)
+	}
+	if len(rpt.Breached) != 0 || len(rpt.Reused) != 1 {
+		t.Errorf("Run() without checker = %+v, want only reuse", rpt)
+	}
+}
+
+func TestReusedPasswords(t *testing.T) {
+	t.Parallel()
+
+	s := memStore{
+		"/a":       "shared\nusername: alice",
+		"/b":       "shared",
+		"/c":       "unique",
+		"/.hidden": "shared",
+	}
+	if got, err := ReusedPasswords(s); err != nil || !reflect.DeepEqual(got, [][]string{{"/a", "/b"}}) {
+		t.Errorf("ReusedPasswords() = (%q, %v), want ([[/a /b]], nil)", got, err)
+	}
+	if got, err := SharingPassword(s, "/a"); err != nil || !reflect.DeepEqual(got, []string{"/b"}) {
+		t.Errorf("SharingPassword(/a) = (%q, %v), want ([/b], nil)", got, err)
+	}
+	if got, err := SharingPassword(s, "/c"); err != nil || len(got) != 0 {
+		t.Errorf("SharingPassword(/c) = (%q, %v), want ([], nil)", got, err)
+	}
+}
+
+func TestReuseTracker(t *testing.T) {
+	t.Parallel()
+
+	cs := &countingStore{Store: memStore{
+		"/a": "shared",
+		"/b": "shared",
+		"/c": "unique",
+	}}
+	rt := NewReuseTracker(cs)
+	checkReused := func(desc string, want [][]string) {
+		t.Helper()
+		if got, err := ReusedPasswords(rt); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ReusedPasswords() = (%q, %v), want (%q, nil)", desc, got, err, want)
+		}
+	}
+
+	// The index is built once, then memoized.
+	checkReused("Initially", [][]string{{"/a", "/b"}})
+	checkReused("Memoized", [][]string{{"/a", "/b"}})
+	if cs.gets != 3 {
+		t.Errorf("Store was read %d times, want 3", cs.gets)
+	}
+
+	// Modifications via the tracker keep the index up to date without rereading the store.
+	if err := rt.Put("/c", "shared"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	checkReused("After Put", [][]string{{"/a", "/b", "/c"}})
+	if err := rt.Move("/a", "/d"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	checkReused("After Move", [][]string{{"/b", "/c", "/d"}})
+	if err := rt.Delete("/b"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if err := rt.Put("/c", "unique"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	checkReused("After Delete", nil)
+	if cs.gets != 3 {
+		t.Errorf("Store was read %d times, want 3", cs.gets)
+	}
+}
+
+func TestExpiryTracker(t *testing.T) {
+	t.Parallel()
+
+	cs := &countingStore{Store: memStore{
+		"/a":       "pw\nexpires: 2025-07-01",
+		"/b":       "pw\nexpiry: 1 Jan 2025",
+		"/c":       "pw\nexpires: someday\nchanged: 2024-05-06T07:08:09Z",
+		"/.hidden": "pw\nexpires: 2020-01-01",
+	}}
+	et := NewExpiryTracker(cs, time.Hour)
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	checkExpirations := func(desc string, want []Expiration) {
+		t.Helper()
+		if got, err := Expirations(et); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Expirations() = (%v, %v), want (%v, nil)", desc, got, err, want)
+		}
+	}
+
+	// The index is built once, then memoized.
+	checkExpirations("Initially", []Expiration{{"/b", date(2025, time.January, 1)}, {"/a", date(2025, time.July, 1)}})
+	checkExpirations("Memoized", []Expiration{{"/b", date(2025, time.January, 1)}, {"/a", date(2025, time.July, 1)}})
+	if got, err := ChangeTimes(et); err != nil || !reflect.DeepEqual(got, map[string]time.Time{"/c": time.Date(2024, time.May, 6, 7, 8, 9, 0, time.UTC)}) {
+		t.Errorf("ChangeTimes() = (%v, %v), want only /c", got, err)
+	}
+	if cs.gets != 3 {
+		t.Errorf("Store was read %d times, want 3", cs.gets)
+	}
+
+	// Modifications via the tracker keep the index up to date without rereading the store.
+	if err := et.Put("/c", "pw\nexpires: 2024/12/31"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := et.Move("/a", "/d"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if err := et.Delete("/b"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	checkExpirations("After modifications", []Expiration{{"/c", date(2024, time.December, 31)}, {"/d", date(2025, time.July, 1)}})
+	if got, err := ChangeTimes(et); err != nil || len(got) != 0 {
+		t.Errorf("After modifications, ChangeTimes() = (%v, %v), want none", got, err)
+	}
+	if cs.gets != 3 {
+		t.Errorf("Store was read %d times, want 3", cs.gets)
+	}
+
+	// Once the index is too old, it is rebuilt, picking up modifications made
+	// to the underlying store.
+	cs.Store.(memStore)["/e"] = "pw\nexpires: 2023-01-01"
+	tracker := et.(*expiryTracker)
+	tracker.mu.Lock()
+	tracker.builtAt = tracker.builtAt.Add(-time.Hour)
+	tracker.mu.Unlock()
+	checkExpirations("After rebuild", []Expiration{{"/e", date(2023, time.January, 1)}, {"/c", date(2024, time.December, 31)}, {"/d", date(2025, time.July, 1)}})
+}
+
+// newFileRanger creates a FileRanger over a dataset containing the given
+// passwords with the given counts.
+func newFileRanger(t *testing.T, counts map[string]int) *FileRanger {
+	t.Helper()
+	var lines []string
+	for pw, cnt := range counts {
+		lines = append(lines, fmt.Sprintf("%s:%d\r\n", sha1Hex(pw), cnt))
+	}
+	sort.Strings(lines)
+
+	dir, err := ioutil.TempDir("", "harp_audit_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "dataset.txt")
+	if err := ioutil.WriteFile(fn, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatalf("Could not write dataset: %v", err)
+	}
+	fr, err := NewFileRanger(fn)
+	if err != nil {
+		t.Fatalf("Could not create file ranger: %v", err)
+	}
+	t.Cleanup(func() { fr.Close() })
+	return fr
+}
+
+func sha1Hex(pw string) string {
+	h := sha1.Sum([]byte(pw))
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+func inDataset(counts map[string]int, hash string) bool {
+	for pw := range counts {
+		if sha1Hex(pw) == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// memStore is a simple in-memory secret.Store.
+type memStore map[string]string
+
+func (ms memStore) List() ([]string, error) {
+	var entries []string
+	for e := range ms {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (ms memStore) Get(entry string) (string, error) {
+	content, ok := ms[entry]
+	if !ok {
+		return "", secret.ErrNoEntry
+	}
+	return content, nil
+}
+
+func (ms memStore) Put(entry, content string) error { ms[entry] = content; return nil }
+func (ms memStore) Delete(entry string) error       { delete(ms, entry); return nil }
+func (ms memStore) Move(oldEntry, newEntry string) error {
+	content, ok := ms[oldEntry]
+	if !ok {
+		return secret.ErrNoEntry
+	}
+	delete(ms, oldEntry)
+	ms[newEntry] = content
+	return nil
+}
+
+// countingStore is a secret.Store which counts calls to Get.
+type countingStore struct {
+	secret.Store
+	gets int
+}
+
+func (cs *countingStore) Get(entry string) (string, error) {
+	cs.gets++
+	return cs.Store.Get(entry)
+}
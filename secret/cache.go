@@ -0,0 +1,190 @@
+package secret
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingStore is a Store which caches the results of List & Get in memory.
+// It is safe for concurrent access from multiple goroutines.
+type CachingStore interface {
+	Store
+
+	// Clear drops all cached content. The store remains usable
+	// afterwards, but will need to re-populate its cache.
+	Clear()
+
+	// Invalidate drops cached content for the given entries, e.g. because
+	// they were changed by other means than this store. An entry name
+	// ending with a slash names a directory, and drops cached content for
+	// every entry beneath it.
+	Invalidate(entries ...string)
+}
+
+// AsCachingStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements CachingStore.
+func AsCachingStore(s Store) (CachingStore, bool) {
+	cs, ok := Find(s, func(s Store) bool {
+		_, ok := s.(CachingStore)
+		return ok
+	}).(CachingStore)
+	return cs, ok
+}
+
+// NewCachingStore wraps the given Store with an in-memory cache. Entry content
+// & the entry list are cached for at most ttl, and at most maxEntries entries'
+// content will be cached at once. Cached content is invalidated on Put,
+// Delete, and Move operations made through the returned Store; changes made to
+// the underlying Store by other means will not be noticed until the cached
+// content expires, unless they are passed to Invalidate.
+func NewCachingStore(s Store, ttl time.Duration, maxEntries int) CachingStore {
+	return &cachingStore{
+		s:          s,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]cachedEntry{},
+	}
+}
+
+type cachingStore struct {
+	s          Store
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex // protects all fields below
+	gen     uint64     // incremented on every modification, to avoid caching stale results
+	entries map[string]cachedEntry
+	list    []string
+	listExp time.Time
+}
+
+type cachedEntry struct {
+	content string
+	exp     time.Time
+}
+
+func (cs *cachingStore) List() ([]string, error) {
+	cs.mu.Lock()
+	if cs.list != nil && time.Now().Before(cs.listExp) {
+		entries := append([]string(nil), cs.list...)
+		cs.mu.Unlock()
+		return entries, nil
+	}
+	gen := cs.gen
+	cs.mu.Unlock()
+
+	entries, err := cs.s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if gen == cs.gen {
+		cs.list = append([]string{}, entries...)
+		cs.listExp = time.Now().Add(cs.ttl)
+	}
+	return entries, nil
+}
+
+func (cs *cachingStore) Get(entry string) (string, error) {
+	cs.mu.Lock()
+	now := time.Now()
+	if ce, ok := cs.entries[entry]; ok {
+		if now.Before(ce.exp) {
+			cs.mu.Unlock()
+			return ce.content, nil
+		}
+		delete(cs.entries, entry)
+	}
+	gen := cs.gen
+	cs.mu.Unlock()
+
+	content, err := cs.s.Get(entry)
+	if err != nil {
+		return "", err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if gen == cs.gen && cs.maxEntries > 0 {
+		if len(cs.entries) >= cs.maxEntries {
+			cs.evict(now)
+		}
+		cs.entries[entry] = cachedEntry{content, now.Add(cs.ttl)}
+	}
+	return content, nil
+}
+
+func (cs *cachingStore) Put(entry, content string) error {
+	defer cs.invalidate(entry)
+	return cs.s.Put(entry, content)
+}
+
+func (cs *cachingStore) PutIf(entry, content, expectedHash string) error {
+	defer cs.invalidate(entry)
+	return PutIf(cs.s, entry, content, expectedHash)
+}
+
+func (cs *cachingStore) Delete(entry string) error {
+	defer cs.invalidate(entry)
+	return cs.s.Delete(entry)
+}
+
+func (cs *cachingStore) Move(oldEntry, newEntry string) error {
+	defer cs.invalidate(oldEntry, newEntry)
+	return cs.s.Move(oldEntry, newEntry)
+}
+
+func (cs *cachingStore) Invalidate(entries ...string) { cs.invalidate(entries...) }
+
+func (cs *cachingStore) Clear() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.gen++
+	cs.entries = map[string]cachedEntry{}
+	cs.list = nil
+}
+
+// Unwrap returns the Store wrapped by this caching store.
+func (cs *cachingStore) Unwrap() Store { return cs.s }
+
+// invalidate drops cached content for the given entries (or directories, if
+// ending with a slash), as well as the cached entry list.
+func (cs *cachingStore) invalidate(entries ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.gen++
+	for _, e := range entries {
+		if !strings.HasSuffix(e, "/") {
+			delete(cs.entries, e)
+			continue
+		}
+		for ce := range cs.entries {
+			if strings.HasPrefix(ce, e) {
+				delete(cs.entries, ce)
+			}
+		}
+	}
+	cs.list = nil
+}
+
+// evict drops expired entries from the cache; if none are expired, it drops
+// the entry closest to expiring. cs.mu must be held.
+func (cs *cachingStore) evict(now time.Time) {
+	var oldest string
+	var oldestExp time.Time
+	for e, ce := range cs.entries {
+		if !now.Before(ce.exp) {
+			delete(cs.entries, e)
+			continue
+		}
+		if oldestExp.IsZero() || ce.exp.Before(oldestExp) {
+			oldest, oldestExp = e, ce.exp
+		}
+	}
+	if len(cs.entries) >= cs.maxEntries {
+		delete(cs.entries, oldest)
+	}
+}
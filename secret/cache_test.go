@@ -0,0 +1,223 @@
+package secret_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestCachingStoreGet(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_cache_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := &countingCrypter{}
+	store := secret.NewCachingStore(file.NewStore(dir, ".foo", c), time.Hour, 10)
+	if err := store.Put("/alpha", "alpha content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Put("/beta", "beta content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Repeated reads only decrypt once.
+	for i := 0; i < 3; i++ {
+		mustGet(t, store, "/alpha", "alpha content")
+		mustGet(t, store, "/beta", "beta content")
+	}
+	if got := c.decrypts(); got != 2 {
+		t.Errorf("Got %d decryptions after repeated reads, want 2", got)
+	}
+
+	// Put invalidates only the touched entry.
+	if err := store.Put("/alpha", "new alpha content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	mustGet(t, store, "/alpha", "new alpha content")
+	mustGet(t, store, "/beta", "beta content")
+	if got := c.decrypts(); got != 3 {
+		t.Errorf("Got %d decryptions after put, want 3", got)
+	}
+
+	// Delete invalidates the deleted entry.
+	if err := store.Delete("/beta"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if content, err := store.Get("/beta"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Unexpected result getting deleted entry: %q, %v", content, err)
+	}
+
+	// Clear drops everything.
+	store.Clear()
+	mustGet(t, store, "/alpha", "new alpha content")
+	if got := c.decrypts(); got != 4 {
+		t.Errorf("Got %d decryptions after clear, want 4", got)
+	}
+}
+
+func TestCachingStoreList(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_cache_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := secret.NewCachingStore(file.NewStore(dir, ".foo", &countingCrypter{}), time.Hour, 10)
+	if err := store.Put("/alpha", "alpha content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	mustList(t, store, "/alpha")
+
+	// Modifications through the caching store are reflected in the list.
+	if err := store.Put("/beta", "beta content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	mustList(t, store, "/alpha", "/beta")
+	if err := store.Move("/beta", "/gamma"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	mustList(t, store, "/alpha", "/gamma")
+	if err := store.Delete("/alpha"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	mustList(t, store, "/gamma")
+}
+
+func TestCachingStoreInvalidate(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_cache_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := &countingCrypter{}
+	fs := file.NewStore(dir, ".foo", c)
+	store := secret.NewCachingStore(fs, time.Hour, 10)
+	for _, e := range []string{"/alpha", "/dir/beta", "/dir/gamma"} {
+		if err := store.Put(e, e+" content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+		mustGet(t, store, e, e+" content")
+	}
+	mustList(t, store, "/alpha", "/dir/beta", "/dir/gamma")
+
+	// Changes made directly to the underlying store are not noticed until
+	// they are invalidated.
+	if err := fs.Put("/alpha", "new alpha content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := fs.Delete("/dir/beta"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	mustGet(t, store, "/alpha", "/alpha content")
+	mustList(t, store, "/alpha", "/dir/beta", "/dir/gamma")
+	store.Invalidate("/alpha")
+	mustGet(t, store, "/alpha", "new alpha content")
+	mustList(t, store, "/alpha", "/dir/gamma")
+	mustGet(t, store, "/dir/beta", "/dir/beta content")
+	if got := c.decrypts(); got != 4 {
+		t.Errorf("Got %d decryptions after invalidating an entry, want 4", got)
+	}
+
+	// Invalidating a directory invalidates every entry beneath it.
+	store.Invalidate("/dir/")
+	if content, err := store.Get("/dir/beta"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Unexpected result getting deleted entry: %q, %v", content, err)
+	}
+	mustGet(t, store, "/dir/gamma", "/dir/gamma content")
+	mustGet(t, store, "/alpha", "new alpha content")
+	if got := c.decrypts(); got != 5 {
+		t.Errorf("Got %d decryptions after invalidating a directory, want 5", got)
+	}
+}
+
+func TestCachingStoreMaxEntries(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_cache_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := &countingCrypter{}
+	store := secret.NewCachingStore(file.NewStore(dir, ".foo", c), time.Hour, 1)
+	if err := store.Put("/alpha", "alpha content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Put("/beta", "beta content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Only one entry fits in the cache, so alternating reads always decrypt.
+	for i := 0; i < 2; i++ {
+		mustGet(t, store, "/alpha", "alpha content")
+		mustGet(t, store, "/beta", "beta content")
+	}
+	if got := c.decrypts(); got != 4 {
+		t.Errorf("Got %d decryptions, want 4", got)
+	}
+}
+
+func mustGet(t *testing.T, s secret.Store, entry, wantContent string) {
+	t.Helper()
+	content, err := s.Get(entry)
+	if err != nil {
+		t.Fatalf("Could not get %q: %v", entry, err)
+	}
+	if content != wantContent {
+		t.Fatalf("Content of %q was %q, want %q", entry, content, wantContent)
+	}
+}
+
+func mustList(t *testing.T, s secret.Store, wantEntries ...string) {
+	t.Helper()
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("Could not list: %v", err)
+	}
+	if strings.Join(entries, ",") != strings.Join(wantEntries, ",") {
+		t.Fatalf("List returned %q, want %q", entries, wantEntries)
+	}
+}
+
+// countingCrypter is a trivial file.Crypter that counts decryptions.
+type countingCrypter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (*countingCrypter) Encrypt(entryName, content string) ([]byte, error) {
+	return []byte("ENCRYPTED:" + content), nil
+}
+
+func (cc *countingCrypter) Decrypt(entryName string, ciphertext []byte) (string, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.n++
+	if !strings.HasPrefix(string(ciphertext), "ENCRYPTED:") {
+		return "", errors.New("not encrypted")
+	}
+	return strings.TrimPrefix(string(ciphertext), "ENCRYPTED:"), nil
+}
+
+func (cc *countingCrypter) decrypts() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.n
+}
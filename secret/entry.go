@@ -0,0 +1,292 @@
+// Package entry provides parsing of structured entry content.
+//
+// Entry content follows the loose conventions of pass: the first line is the
+// password, and following lines may hold `key: value` fields, such as
+// `username: alice` or `url: https://example.com`. A line holding an
+// `otpauth://` URI is treated as a one-time password seed. An `expires:` field
+// gives the date the entry's secret expires, such as `expires: 2025-07-01`.
+// A `changed:` field gives the time the entry was last changed, as an RFC 3339
+// timestamp, such as `changed: 2025-07-01T12:00:00Z`; see Stamp. Any other
+// lines are treated as free-form notes.
+package entry
+
+import (
+	"strings"
+	"time"
+)
+
+const otpURIPrefix = "otpauth://"
+
+// Entry is a parsed entry.
+type Entry struct {
+	Password string
+	Username string
+	URL      string
+	OTP      string // OTP seed, either an otpauth:// URI or a bare secret
+	Expires  string // expiration date, as written; see Expiration
+	Changed  string // time of the last change, as written; see LastChanged
+	Notes    string // all lines not parsed as a known field, in order
+
+	raw    string    // original content
+	nl     string    // line ending used by the original content
+	lines  []line    // original lines after the first, as parsed
+	parsed [7]string // field values as originally parsed, in the order returned by values
+}
+
+// kind identifies which field a line of content holds.
+type kind int
+
+const (
+	notes kind = iota
+	username
+	url
+	otp
+	expires
+	changed
+)
+
+// knownFields describes the known fields, in the order they are added to
+// content which did not originally hold them. Keys are matched
+// case-insensitively; the first key is used when adding a field.
+var knownFields = []struct {
+	k    kind
+	keys []string
+}{
+	{username, []string{"username", "user", "login"}},
+	{url, []string{"url", "website", "site"}},
+	{otp, []string{"otp", "totp"}},
+	{expires, []string{"expires", "expiry", "expiration"}},
+	{changed, []string{"changed"}},
+}
+
+// line is a single line of entry content, after the first.
+type line struct {
+	text   string // line text, without line ending
+	k      kind   // the field held by this line
+	prefix string // text preceding the value for known fields, e.g. "Username: "
+}
+
+// Parse parses entry content. Parsing never fails: content which does not
+// follow any convention is treated as a password followed by notes.
+func Parse(content string) Entry {
+	e := Entry{raw: content, nl: "\n"}
+	if strings.Contains(content, "\r\n") {
+		e.nl = "\r\n"
+	}
+
+	first, rest := content, ""
+	if idx := strings.IndexByte(content, '\n'); idx != -1 {
+		first, rest = content[:idx], content[idx+1:]
+	}
+	e.Password = strings.TrimSuffix(first, "\r")
+
+	var ns []string
+	for _, l := range strings.SplitAfter(rest, "\n") {
+		if l == "" {
+			continue
+		}
+		text := strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r")
+		k, prefix, value := e.parseLine(text)
+		if k == notes {
+			ns = append(ns, text)
+		} else {
+			*e.field(k) = value
+		}
+		e.lines = append(e.lines, line{text, k, prefix})
+	}
+	e.Notes = strings.Join(ns, "\n")
+	e.parsed = e.values()
+	return e
+}
+
+// parseLine determines which field the given line holds. Only the first
+// occurrence of each known field is parsed as that field; later occurrences
+// are treated as notes. For known fields, it also returns the text preceding
+// the field's value, and the value itself.
+func (e *Entry) parseLine(text string) (_ kind, prefix, value string) {
+	if strings.HasPrefix(text, otpURIPrefix) {
+		if e.OTP != "" {
+			return notes, "", ""
+		}
+		return otp, "", text
+	}
+
+	idx := strings.IndexByte(text, ':')
+	if idx == -1 {
+		return notes, "", ""
+	}
+	key := strings.ToLower(strings.TrimSpace(text[:idx]))
+	for _, f := range knownFields {
+		if !contains(f.keys, key) {
+			continue
+		}
+		if *e.field(f.k) != "" {
+			return notes, "", ""
+		}
+
+		// Values are separated from their key by a colon and optional whitespace.
+		vIdx := idx + 1
+		for vIdx < len(text) && (text[vIdx] == ' ' || text[vIdx] == '\t') {
+			vIdx++
+		}
+		if vIdx == len(text) {
+			// Keep empty fields as notes, so that they round-trip.
+			return notes, "", ""
+		}
+		return f.k, text[:vIdx], text[vIdx:]
+	}
+	return notes, "", ""
+}
+
+func (e *Entry) field(k kind) *string {
+	switch k {
+	case username:
+		return &e.Username
+	case url:
+		return &e.URL
+	case otp:
+		return &e.OTP
+	case expires:
+		return &e.Expires
+	case changed:
+		return &e.Changed
+	default:
+		return &e.Notes
+	}
+}
+
+func (e *Entry) values() [7]string {
+	return [7]string{e.Password, e.Username, e.URL, e.OTP, e.Expires, e.Changed, e.Notes}
+}
+
+// dateLayouts are the layouts accepted by ParseDate, in the order they are
+// tried. Numeric day-first & month-first dates are ambiguous, so only
+// year-first numeric dates are accepted.
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"2006.01.02",
+	"20060102",
+	time.RFC3339,
+	"2006-01-02 15:04",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Jan 2 2006",
+	"January 2 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+	"2006-01",
+	"Jan 2006",
+	"January 2006",
+}
+
+// ParseDate parses a date in one of several common formats, such as
+// "2025-07-01", "2025/07/01", "1 Jul 2025" or "July 1, 2025". Dates with only a
+// month, such as "2025-07", are taken to mean the first day of the month. The
+// date is returned as midnight UTC; any time of day is discarded. It returns
+// false if the date can't be parsed.
+func ParseDate(s string) (time.Time, bool) {
+	s = strings.Join(strings.Fields(s), " ")
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Expiration returns the date the entry expires, parsed from its Expires field
+// with ParseDate. It returns false if the entry has no valid expiration date.
+func (e Entry) Expiration() (time.Time, bool) {
+	if e.Expires == "" {
+		return time.Time{}, false
+	}
+	return ParseDate(e.Expires)
+}
+
+// LastChanged returns the time the entry was last changed. The entry's Changed
+// field is preferred, if it holds a valid RFC 3339 timestamp, since it is kept
+// with the content: unlike modTime, the modification time of the file holding
+// the entry, it is not reset when the file is copied or checked out. If
+// neither is known, the zero time is returned.
+func (e Entry) LastChanged(modTime time.Time) time.Time {
+	if e.Changed != "" {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(e.Changed)); err == nil {
+			return t
+		}
+	}
+	return modTime
+}
+
+// Stamp returns the given content, with its changed field set to now, for
+// saving in place of old content. If content differs from old only in its
+// changed field, or not at all, content is returned unmodified, so that saving
+// an entry without changing it does not count as a change.
+func Stamp(old, content string, now time.Time) string {
+	o, e := Parse(old), Parse(content)
+	o.Changed, e.Changed = "", ""
+	if o.String() == e.String() {
+		return content
+	}
+	e.Changed = now.UTC().Format(time.RFC3339)
+	return e.String()
+}
+
+// String serializes the entry. If no fields have been modified since the
+// entry was parsed, the original content is returned unchanged. Otherwise,
+// the original layout is kept as closely as possible: modified fields are
+// updated in place, fields which were not originally present are added after
+// the existing lines, and if notes were modified they are placed at the end.
+func (e Entry) String() string {
+	if e.values() == e.parsed {
+		return e.raw
+	}
+	if e.nl == "" {
+		e.nl = "\n"
+	}
+
+	lines := []string{e.Password}
+	present := map[kind]bool{}
+	notesChanged := e.Notes != e.parsed[6]
+	for _, l := range e.lines {
+		if l.k == notes {
+			if !notesChanged {
+				lines = append(lines, l.text)
+			}
+			continue
+		}
+		present[l.k] = true
+		if v := *e.field(l.k); v != "" {
+			lines = append(lines, l.prefix+v)
+		}
+	}
+	for _, f := range knownFields {
+		v := *e.field(f.k)
+		switch {
+		case present[f.k] || v == "":
+			continue
+		case f.k == otp && strings.HasPrefix(v, otpURIPrefix):
+			lines = append(lines, v)
+		default:
+			lines = append(lines, f.keys[0]+": "+v)
+		}
+	}
+	if notesChanged && e.Notes != "" {
+		lines = append(lines, strings.Split(strings.ReplaceAll(e.Notes, "\r\n", "\n"), "\n")...)
+	}
+
+	s := strings.Join(lines, e.nl)
+	if strings.HasSuffix(e.raw, "\n") {
+		s += e.nl
+	}
+	return s
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
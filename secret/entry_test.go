@@ -0,0 +1,183 @@
+package entry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		content string
+		want    Entry
+	}{
+		{"", Entry{}},
+		{"hunter2", Entry{Password: "hunter2"}},
+		{"hunter2\n", Entry{Password: "hunter2"}},
+		{
+			content: "hunter2\nUsername: alice\nurl:https://example.com\notpauth://totp/Example?secret=ABC\nSecurity question: blue\nnote\n",
+			want: Entry{
+				Password: "hunter2",
+				Username: "alice",
+				URL:      "https://example.com",
+				OTP:      "otpauth://totp/Example?secret=ABC",
+				Notes:    "Security question: blue\nnote",
+			},
+		},
+		{
+			content: "hunter2\nExpires: 2025-07-01\nexpiry: 2026-01-01\n",
+			want: Entry{
+				Password: "hunter2",
+				Expires:  "2025-07-01",
+				Notes:    "expiry: 2026-01-01",
+			},
+		},
+		{
+			content: "hunter2\nchanged: 2025-07-01T12:00:00Z\nChanged: yesterday\n",
+			want: Entry{
+				Password: "hunter2",
+				Changed:  "2025-07-01T12:00:00Z",
+				Notes:    "Changed: yesterday",
+			},
+		},
+		{
+			content: "hunter2\r\nlogin: alice\r\nuser: bob\r\nsite:\r\n",
+			want: Entry{
+				Password: "hunter2",
+				Username: "alice",
+				Notes:    "user: bob\nsite:",
+			},
+		},
+	} {
+		got := Parse(test.content)
+		if got.Password != test.want.Password || got.Username != test.want.Username || got.URL != test.want.URL || got.OTP != test.want.OTP || got.Expires != test.want.Expires || got.Changed != test.want.Changed || got.Notes != test.want.Notes {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.content, got, test.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, content := range []string{
+		"",
+		"\n",
+		"hunter2",
+		"hunter2\n\n\n",
+		"hunter2\r\nUsername:\talice\r\n\r\nnotes\r\n",
+		"hunter2\nurl: https://example.com\nURL: https://other.example.com\notpauth://totp/a\notpauth://totp/b",
+		"  spaces  \n  user : alice  \nmixed\r\nendings\n",
+	} {
+		if got := Parse(content).String(); got != content {
+			t.Errorf("Parse(%q).String() = %q", content, got)
+		}
+	}
+}
+
+func TestModify(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		content string
+		modify  func(*Entry)
+		want    string
+	}{
+		{"hunter2\nUser: alice\nnotes\n", func(e *Entry) { e.Password = "swordfish" }, "swordfish\nUser: alice\nnotes\n"},
+		{"hunter2\nUser: alice\nnotes\n", func(e *Entry) { e.Username = "bob" }, "hunter2\nUser: bob\nnotes\n"},
+		{"hunter2\nUser: alice\nnotes\n", func(e *Entry) { e.Username = "" }, "hunter2\nnotes\n"},
+		{"hunter2\nnotes\n", func(e *Entry) { e.URL = "https://example.com" }, "hunter2\nnotes\nurl: https://example.com\n"},
+		{"hunter2\nnotes\nUser: alice", func(e *Entry) { e.Notes = "new\nnotes" }, "hunter2\nUser: alice\nnew\nnotes"},
+		{"hunter2\r\n", func(e *Entry) { e.OTP = "otpauth://totp/a" }, "hunter2\r\notpauth://totp/a\r\n"},
+		{"", func(e *Entry) { e.Password, e.Username = "hunter2", "alice" }, "hunter2\nusername: alice"},
+	} {
+		e := Parse(test.content)
+		test.modify(&e)
+		if got := e.String(); got != test.want {
+			t.Errorf("Modified Parse(%q).String() = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	t.Parallel()
+	want := time.Date(2025, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, s := range []string{
+		"2025-07-01",
+		"2025/07/01",
+		"2025.07.01",
+		"20250701",
+		"2025-07-01T15:04:05-07:00",
+		"2025-07-01 23:59",
+		"1 Jul 2025",
+		"01 July 2025",
+		"Jul 1 2025",
+		"July 1, 2025",
+		"  July  1,   2025 ",
+		"2025-07",
+		"Jul 2025",
+	} {
+		if got, ok := ParseDate(s); !ok || !got.Equal(want) {
+			t.Errorf("ParseDate(%q) = (%v, %v), want (%v, true)", s, got, ok, want)
+		}
+	}
+	for _, s := range []string{"", "soon", "07/01/2025", "2025-13-01", "2025-02-30", "next July"} {
+		if got, ok := ParseDate(s); ok {
+			t.Errorf("ParseDate(%q) = (%v, true), want failure", s, got)
+		}
+	}
+
+	if got, ok := Parse("hunter2\nexpires: 1 Jul 2025").Expiration(); !ok || !got.Equal(want) {
+		t.Errorf("Expiration() = (%v, %v), want (%v, true)", got, ok, want)
+	}
+	if _, ok := Parse("hunter2\nexpires: never").Expiration(); ok {
+		t.Errorf("Expiration() of invalid date unexpectedly succeeded")
+	}
+}
+
+func TestLastChanged(t *testing.T) {
+	t.Parallel()
+	modTime := time.Date(2025, time.July, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		content string
+		modTime time.Time
+		want    time.Time
+	}{
+		// The changed field is preferred over the modification time.
+		{"hunter2\nchanged: 2024-01-02T03:04:05Z", modTime, time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)},
+		{"hunter2\nchanged: 2024-01-02T03:04:05+01:00", time.Time{}, time.Date(2024, time.January, 2, 2, 4, 5, 0, time.UTC)},
+		// Otherwise, the modification time is used, if known.
+		{"hunter2", modTime, modTime},
+		{"hunter2\nchanged: 2024-01-02", modTime, modTime},
+		{"hunter2\nchanged: recently", modTime, modTime},
+		{"hunter2", time.Time{}, time.Time{}},
+	} {
+		if got := Parse(test.content).LastChanged(test.modTime); !got.Equal(test.want) {
+			t.Errorf("Parse(%q).LastChanged(%v) = %v, want %v", test.content, test.modTime, got, test.want)
+		}
+	}
+}
+
+func TestStamp(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2025, time.July, 1, 14, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+
+	for _, test := range []struct {
+		desc         string
+		old, content string
+		want         string
+	}{
+		{"new entry", "", "hunter2\nuser: alice\n", "hunter2\nuser: alice\nchanged: 2025-07-01T12:00:00Z\n"},
+		{"changed field updated in place", "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes", "swordfish\nchanged: 2024-01-01T00:00:00Z\nnotes", "swordfish\nchanged: 2025-07-01T12:00:00Z\nnotes"},
+		{"unchanged", "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes", "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes", "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes"},
+		{"unchanged without changed field", "hunter2\nnotes", "hunter2\nnotes", "hunter2\nnotes"},
+		{"only changed field edited", "hunter2\nchanged: 2024-01-01T00:00:00Z", "hunter2\nchanged: 2023-06-01T00:00:00Z", "hunter2\nchanged: 2023-06-01T00:00:00Z"},
+		{"only changed field removed", "hunter2\nchanged: 2024-01-01T00:00:00Z\nnotes", "hunter2\nnotes", "hunter2\nnotes"},
+	} {
+		if got := Stamp(test.old, test.content, now); got != test.want {
+			t.Errorf("[%s] Stamp(%q, %q) = %q, want %q", test.desc, test.old, test.content, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FavoritesEntry is the hidden entry listing the entries a user has pinned as
+// favorites, one entry name per line, in the order they were pinned.
+const FavoritesEntry = "/.favorites"
+
+// Favorites returns the entries pinned as favorites in the given store, in the
+// order they were pinned. Favorites which no longer exist (e.g. because they
+// were deleted or moved) are omitted, and pruned from FavoritesEntry if the
+// store allows it.
+func Favorites(s Store) ([]string, error) {
+	favs, err := readFavorites(s)
+	if err != nil || len(favs) == 0 {
+		return nil, err
+	}
+	entries, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	exists := map[string]bool{}
+	for _, e := range entries {
+		exists[e] = true
+	}
+	var existing []string
+	for _, f := range favs {
+		if exists[f] {
+			existing = append(existing, f)
+		}
+	}
+	if len(existing) < len(favs) {
+		if err := writeFavorites(s, existing); err != nil && !errors.Is(err, ErrReadOnly) {
+			return nil, fmt.Errorf("couldn't prune favorites: %w", err)
+		}
+	}
+	return existing, nil
+}
+
+// SetFavorite pins the given entry as a favorite in the given store, or unpins
+// it if fav is false. Pinning an entry which is already pinned, or unpinning
+// one which is not, does nothing.
+func SetFavorite(s Store, entry string, fav bool) error {
+	favs, err := readFavorites(s)
+	if err != nil {
+		return err
+	}
+	newFavs := make([]string, 0, len(favs)+1)
+	for _, f := range favs {
+		if f != entry {
+			newFavs = append(newFavs, f)
+		}
+	}
+	if fav {
+		if len(newFavs) < len(favs) {
+			return nil
+		}
+		newFavs = append(newFavs, entry)
+	} else if len(newFavs) == len(favs) {
+		return nil
+	}
+	return writeFavorites(s, newFavs)
+}
+
+// IsFavorite determines if the given entry is pinned as a favorite in the
+// given store.
+func IsFavorite(s Store, entry string) (bool, error) {
+	favs, err := readFavorites(s)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range favs {
+		if f == entry {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readFavorites reads FavoritesEntry, without pruning entries which no longer
+// exist.
+func readFavorites(s Store) ([]string, error) {
+	content, err := s.Get(FavoritesEntry)
+	if errors.Is(err, ErrNoEntry) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get favorites: %w", err)
+	}
+	var favs []string
+	for _, f := range strings.Split(content, "\n") {
+		if f != "" {
+			favs = append(favs, f)
+		}
+	}
+	return favs, nil
+}
+
+// writeFavorites writes FavoritesEntry, deleting it if there are no favorites.
+func writeFavorites(s Store, favs []string) error {
+	if len(favs) == 0 {
+		if err := s.Delete(FavoritesEntry); err != nil && !errors.Is(err, ErrNoEntry) {
+			return fmt.Errorf("couldn't delete favorites: %w", err)
+		}
+		return nil
+	}
+	if err := s.Put(FavoritesEntry, strings.Join(favs, "\n")+"\n"); err != nil {
+		return fmt.Errorf("couldn't update favorites: %w", err)
+	}
+	return nil
+}
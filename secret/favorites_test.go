@@ -0,0 +1,103 @@
+package secret_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestFavorites(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_favorites_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := file.NewStore(dir, ".foo", &countingCrypter{})
+	for _, e := range []string{"/a", "/dir/b", "/c"} {
+		if err := s.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	favorites := func() string {
+		t.Helper()
+		favs, err := secret.Favorites(s)
+		if err != nil {
+			t.Fatalf("Could not get favorites: %v", err)
+		}
+		return fmt.Sprint(favs)
+	}
+	setFavorite := func(entry string, fav bool) {
+		t.Helper()
+		if err := secret.SetFavorite(s, entry, fav); err != nil {
+			t.Fatalf("Could not set favorite %q to %v: %v", entry, fav, err)
+		}
+	}
+
+	// Favorites are listed in the order they were pinned, once each.
+	if got := favorites(); got != "[]" {
+		t.Errorf("Initial favorites = %s, want []", got)
+	}
+	setFavorite("/dir/b", true)
+	setFavorite("/a", true)
+	setFavorite("/dir/b", true)
+	if got, want := favorites(), "[/dir/b /a]"; got != want {
+		t.Errorf("Favorites = %s, want %s", got, want)
+	}
+	if fav, err := secret.IsFavorite(s, "/a"); err != nil || !fav {
+		t.Errorf("IsFavorite(/a) = (%v, %v), want (true, nil)", fav, err)
+	}
+	if fav, err := secret.IsFavorite(s, "/c"); err != nil || fav {
+		t.Errorf("IsFavorite(/c) = (%v, %v), want (false, nil)", fav, err)
+	}
+
+	// Favorites which no longer exist are pruned.
+	if err := s.Move("/dir/b", "/b"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if got, want := favorites(), "[/a]"; got != want {
+		t.Errorf("Favorites after move = %s, want %s", got, want)
+	}
+	if content, err := s.Get(secret.FavoritesEntry); err != nil || content != "/a\n" {
+		t.Errorf("Favorites entry after pruning = (%q, %v), want (%q, nil)", content, err, "/a\n")
+	}
+
+	// Unpinning the last favorite removes the favorites entry.
+	setFavorite("/c", false)
+	setFavorite("/a", false)
+	if got := favorites(); got != "[]" {
+		t.Errorf("Favorites after unpinning = %s, want []", got)
+	}
+	if entries, err := s.List(); err != nil || fmt.Sprint(entries) != "[/a /b /c]" {
+		t.Errorf("List after unpinning = (%v, %v), want ([/a /b /c], nil)", entries, err)
+	}
+}
+
+func TestFavoritesReadOnly(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_favorites_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := file.NewStore(dir, ".foo", &countingCrypter{})
+	if err := s.Put(secret.FavoritesEntry, "/gone\n"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ros := secret.NewReadOnlyStore(s)
+
+	// Favorites of read-only stores are still pruned when listed, but not written.
+	if favs, err := secret.Favorites(ros); err != nil || len(favs) != 0 {
+		t.Errorf("Favorites of read-only store = (%v, %v), want ([], nil)", favs, err)
+	}
+	if err := secret.SetFavorite(ros, "/entry", true); err == nil {
+		t.Errorf("SetFavorite of read-only store unexpectedly succeeded")
+	}
+}
@@ -8,24 +8,60 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BranLwyd/harpocrates/secret"
 )
 
-func NewStore(baseDir, extension string, crypter Crypter) secret.Store {
+// NewStore creates a new secret.Store which stores each entry as a file
+// (named after the entry, with the given extension) beneath baseDir, with
+// content encrypted by crypter. If crypter is an AttachmentCrypter, the store
+// implements secret.AttachmentStore. The store implements
+// secret.ConditionalStore, secret.TreeStore & secret.BatchStore.
+func NewStore(baseDir, extension string, crypter Crypter, opts ...Option) secret.Store {
+	s := newStore(baseDir, extension, crypter, opts)
+	var ss secret.Store = s
+	if s.keepVersions > 0 {
+		ss = versionedStore{s}
+	}
+	if s.trashRetention > 0 {
+		if err := s.purgeTrash(s.trashRetention); err != nil {
+			log.Printf("Could not purge trash in %q: %v", s.baseDir, err)
+		}
+		ss = trashStore{ss, s}
+	}
+	if ac, ok := crypter.(AttachmentCrypter); ok {
+		ss = attachmentStore{ss, s, ac}
+	}
+	if s.keepsManifest() {
+		ss = manifestStore{ss, s}
+	}
+	return ss
+}
+
+func newStore(baseDir, extension string, crypter Crypter, opts []Option) *store {
 	if extension != "" && !strings.HasPrefix(extension, ".") {
 		extension = "." + extension
 	}
-	return &store{
+	s := &store{
 		baseDir:   filepath.Clean(baseDir),
 		extension: extension,
 		crypter:   crypter,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
+// Option configures optional behavior of a store created by NewStore.
+type Option func(*store)
+
 // Crypter is an interface used to determine how a file.store encrypts files on disk.
 type Crypter interface {
 	// Encrypt encrypts the given plaintext `entryContent` into
@@ -39,11 +75,65 @@ type Crypter interface {
 	Decrypt(entryName string, ciphertext []byte) (entryContent string, _ error)
 }
 
+// WipingCrypter is a Crypter which holds key material in memory, and can zero
+// it. Stores whose crypter is a WipingCrypter wipe it when the store is wiped.
+type WipingCrypter interface {
+	Crypter
+
+	// Wipe zeroes the crypter's key material. Afterwards, Encrypt &
+	// Decrypt return errors. Wipe may be called more than once.
+	Wipe()
+}
+
+// keepFile is the name of the empty marker file which keeps a directory from
+// being removed while it holds no entries.
+const keepFile = ".keep"
+
+// putMu serializes writes & moves of entries, so that the checks made by PutIf
+// & Move are atomic with their writes. Several stores (e.g. one per session)
+// may share a directory.
+var putMu sync.Mutex
+
 // store implements secret.Store.
 type store struct {
-	baseDir   string
-	extension string
-	crypter   Crypter
+	baseDir         string
+	extension       string
+	crypter         Crypter
+	keepVersions    int           // number of previous versions to keep for each entry
+	trashRetention  time.Duration // how long to keep deleted entries; zero to remove them immediately
+	resolveSymlinks bool          // whether to refuse access via symlinks leading outside baseDir
+	maxEntrySize    int           // maximum size of an entry's plaintext content, in bytes; zero for no limit
+	manifest        bool          // whether to keep a manifest of the store's files, if the crypter is a MACCrypter
+
+	commitHook func(change int) error // if non-nil, called before applying each change of a batch; an error interrupts the commit (for tests)
+}
+
+// WithResolveSymlinks, if resolve is true, causes the store to resolve
+// symbolic links when accessing entries & directories, refusing access (with
+// secret.ErrInvalidEntryName) if the resolved location is outside the base
+// directory. Otherwise, symbolic links within the base directory are followed
+// wherever they lead.
+func WithResolveSymlinks(resolve bool) Option {
+	return func(s *store) {
+		s.resolveSymlinks = resolve
+	}
+}
+
+// WithMaxEntrySize causes the store to refuse (with secret.ErrEntryTooLarge)
+// to put entries whose plaintext content is larger than n bytes. A
+// nonpositive n places no limit on entry size.
+func WithMaxEntrySize(n int) Option {
+	return func(s *store) {
+		s.maxEntrySize = n
+	}
+}
+
+// Wipe helps to implement secret.WipeStore. If the store's crypter is not a
+// WipingCrypter, it holds no key material, and Wipe does nothing.
+func (s *store) Wipe() {
+	if wc, ok := s.crypter.(WipingCrypter); ok {
+		wc.Wipe()
+	}
 }
 
 // List helps to implement secret.Store.
@@ -54,6 +144,9 @@ func (s *store) List() ([]string, error) {
 		case inErr != nil:
 			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
 
+		case info.IsDir() && s.inReservedDir(path):
+			return filepath.SkipDir
+
 		case !info.IsDir() && strings.HasSuffix(path, s.extension):
 			entry, err := filepath.Rel(s.baseDir, strings.TrimSuffix(path, s.extension))
 			if err != nil {
@@ -68,6 +161,64 @@ func (s *store) List() ([]string, error) {
 	return entries, nil
 }
 
+// ListDir helps to implement secret.DirStore. Unlike List, it reads only the
+// requested directory.
+func (s *store) ListDir(dir string) (entries, subdirs []string, _ error) {
+	dirname, err := s.getDirname(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	des, err := os.ReadDir(dirname)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read directory %q: %w", dirname, err)
+	}
+	for _, de := range des {
+		name := de.Name()
+		switch {
+		case de.IsDir() && dirname == s.baseDir && isReservedDir(name):
+			continue
+
+		case de.IsDir():
+			subdirs = append(subdirs, dir+name)
+
+		case strings.HasSuffix(name, s.extension):
+			entries = append(entries, dir+strings.TrimSuffix(name, s.extension))
+		}
+	}
+	return entries, subdirs, nil
+}
+
+// EnsureDir helps to implement secret.EmptyDirStore. The directory is kept by
+// placing an empty marker file in it, so that it is not removed when the last
+// entry within it is deleted.
+func (s *store) EnsureDir(dir string) error {
+	dirname, err := s.getDirname(dir)
+	if err != nil {
+		return err
+	}
+	if dirname == s.baseDir {
+		return nil
+	}
+	if s.inReservedDir(dirname) {
+		return fmt.Errorf("%w: directory %q", secret.ErrInvalidEntryName, dir)
+	}
+	if err := os.MkdirAll(dirname, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", dirname, err)
+	}
+	keepFilename := filepath.Join(dirname, keepFile)
+	f, err := os.OpenFile(keepFilename, os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return fmt.Errorf("couldn't create %q: %w", keepFilename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", keepFilename, err)
+	}
+	return nil
+}
+
 // Get helps to implement secret.Store.
 func (s *store) Get(entry string) (string, error) {
 	entryFilename, err := s.getEntryFilename(entry)
@@ -77,7 +228,7 @@ func (s *store) Get(entry string) (string, error) {
 	ciphertext, err := ioutil.ReadFile(entryFilename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", secret.ErrNoEntry
+			return "", fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
 		}
 		return "", fmt.Errorf("couldn't read %q: %w", entryFilename, err)
 	}
@@ -92,6 +243,22 @@ func (s *store) Get(entry string) (string, error) {
 //
 // On POSIX-compliant systems, the update is atomic.
 func (s *store) Put(entry, content string) error {
+	return s.put(entry, content, nil)
+}
+
+// PutIf helps to implement secret.ConditionalStore.
+func (s *store) PutIf(entry, content, expectedHash string) error {
+	return s.put(entry, content, func() error { return secret.CheckContent(s, entry, expectedHash) })
+}
+
+// put writes the given content to the given entry. If check is non-nil, it is
+// called before writing, atomically with the write with respect to other
+// writes via stores created by NewStore; an error from check prevents the
+// write.
+func (s *store) put(entry, content string, check func() error) error {
+	if s.maxEntrySize > 0 && len(content) > s.maxEntrySize {
+		return fmt.Errorf("%w: %q is %d bytes (maximum %d)", secret.ErrEntryTooLarge, entry, len(content), s.maxEntrySize)
+	}
 	ciphertext, err := s.crypter.Encrypt(entry, content)
 	if err != nil {
 		return fmt.Errorf("couldn't encrypt: %w", err)
@@ -101,11 +268,32 @@ func (s *store) Put(entry, content string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
 	}
+	putMu.Lock()
+	defer putMu.Unlock()
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
 	entryDir := filepath.Dir(entryFilename)
 	if err := os.MkdirAll(entryDir, 0770); err != nil {
 		return fmt.Errorf("couldn't create directory %q: %w", entryDir, err)
 	}
-	tempFile, err := ioutil.TempFile(entryDir, ".gopass_tmp_")
+	if s.keepVersions > 0 {
+		if err := s.saveVersion(entryFilename); err != nil {
+			return fmt.Errorf("couldn't save previous version of %q: %w", entry, err)
+		}
+	}
+	if err := writeFile(entryFilename, ciphertext); err != nil {
+		return err
+	}
+	return s.updateManifest(entryFilename)
+}
+
+// writeFile writes the given ciphertext to the given file, via a temporary
+// file in the same directory. On POSIX-compliant systems, the write is atomic.
+func writeFile(filename string, ciphertext []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".gopass_tmp_")
 	if err != nil {
 		return fmt.Errorf("couldn't create temporary file: %w", err)
 	}
@@ -121,8 +309,8 @@ func (s *store) Put(entry, content string) error {
 	if err := tempFile.Close(); err != nil {
 		return fmt.Errorf("couldn't close %q: %w", tempFile.Name(), err)
 	}
-	if err := os.Rename(tempFilename, entryFilename); err != nil {
-		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, entryFilename, err)
+	if err := os.Rename(tempFilename, filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, filename, err)
 	}
 	return nil
 }
@@ -133,19 +321,100 @@ func (s *store) Delete(entry string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
 	}
-	if err := os.Remove(entryFilename); err != nil {
+	if s.trashRetention > 0 {
+		if err := s.moveToTrash(entryFilename); err != nil {
+			if errors.Is(err, secret.ErrNoEntry) {
+				return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+			}
+			return err
+		}
+	} else {
+		if err := os.Remove(entryFilename); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+			}
+			return fmt.Errorf("couldn't delete %q: %w", entryFilename, err)
+		}
+		if err := removeIfExists(entryFilename + attachmentsSuffix); err != nil {
+			return err
+		}
+	}
+	if err := s.updateManifest(entryFilename, entryFilename+attachmentsSuffix); err != nil {
+		return err
+	}
+
+	// Clean up newly-empty directories.
+	if err := s.removeEmptyDirs(filepath.Dir(entryFilename)); err != nil {
+		return err
+	}
+	if err := s.deleteVersions(entryFilename); err != nil {
+		return fmt.Errorf("couldn't delete previous versions of %q: %w", entry, err)
+	}
+	return nil
+}
+
+// Move helps to implement secret.Store.
+//
+// On POSIX-compliant systems, the rename is atomic. The check that the new
+// entry does not already exist is atomic with the rename with respect to
+// writes via stores created by NewStore (see putMu), but not with respect to
+// other processes sharing the directory.
+func (s *store) Move(oldEntry, newEntry string) error {
+	oldFilename, err := s.getEntryFilename(oldEntry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", oldEntry, err)
+	}
+	newFilename, err := s.getEntryFilename(newEntry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", newEntry, err)
+	}
+	putMu.Lock()
+	defer putMu.Unlock()
+	if _, err := os.Stat(oldFilename); err != nil {
 		if os.IsNotExist(err) {
-			return secret.ErrNoEntry
+			return fmt.Errorf("%w: %q", secret.ErrNoEntry, oldEntry)
 		}
-		return fmt.Errorf("couldn't delete %q: %w", entryFilename, err)
+		return fmt.Errorf("couldn't stat %q: %w", oldFilename, err)
+	}
+	if _, err := os.Lstat(newFilename); err == nil {
+		return fmt.Errorf("%w: %q", secret.ErrEntryExists, newEntry)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't stat %q: %w", newFilename, err)
+	}
+
+	newDir := filepath.Dir(newFilename)
+	if err := os.MkdirAll(newDir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", newDir, err)
+	}
+	if err := os.Rename(oldFilename, newFilename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", oldFilename, newFilename, err)
+	}
+	if err := renameIfExists(oldFilename+attachmentsSuffix, newFilename+attachmentsSuffix); err != nil {
+		return err
+	}
+	if err := s.updateManifest(oldFilename, oldFilename+attachmentsSuffix, newFilename, newFilename+attachmentsSuffix); err != nil {
+		return err
+	}
+	if err := s.moveVersions(oldFilename, newFilename); err != nil {
+		return fmt.Errorf("couldn't move previous versions of %q: %w", oldEntry, err)
 	}
 
 	// Clean up newly-empty directories.
-	for entryDir := filepath.Dir(entryFilename); strings.HasPrefix(entryDir, s.baseDir); entryDir = filepath.Dir(entryDir) {
+	if err := s.removeEmptyDirs(filepath.Dir(oldFilename)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir if it is empty, then repeats the process with
+// its parent directories, stopping at the first non-empty directory or at the
+// base directory of the store.
+func (s *store) removeEmptyDirs(dir string) error {
+	for entryDir := dir; s.contains(entryDir); entryDir = filepath.Dir(entryDir) {
 		remove, err := func() (bool, error) {
 			dirFile, err := os.Open(entryDir)
 			if err != nil {
-				return false, fmt.Errorf("couldn't open directory %q: %w", err)
+				return false, fmt.Errorf("couldn't open directory %q: %w", entryDir, err)
 			}
 			defer dirFile.Close()
 			if _, err := dirFile.Readdir(1); err == io.EOF {
@@ -168,14 +437,128 @@ func (s *store) Delete(entry string) error {
 
 func (s *store) getEntryFilename(entry string) (string, error) {
 	if entry == "" {
-		return "", errors.New("missing entry")
+		return "", fmt.Errorf("%w: missing entry", secret.ErrInvalidEntryName)
+	}
+	if hasDotDot(entry) {
+		return "", fmt.Errorf("%w: %q", secret.ErrInvalidEntryName, entry)
 	}
 	entryFilename := filepath.Join(s.baseDir, entry+s.extension)
 
 	// Check that we haven't walked out of the base dir.
-	if !strings.HasPrefix(entryFilename, s.baseDir) {
-		return "", errors.New("invalid entry")
+	if !s.contains(entryFilename) || entryFilename == s.baseDir {
+		return "", fmt.Errorf("%w: %q", secret.ErrInvalidEntryName, entry)
+	}
+	if err := s.checkSymlinks(entryFilename); err != nil {
+		return "", fmt.Errorf("%w: %q: %v", secret.ErrInvalidEntryName, entry, err)
+	}
+
+	// Check that we aren't trying to access the reserved directories directly.
+	if s.inReservedDir(entryFilename) {
+		return "", fmt.Errorf("%w: %q", secret.ErrInvalidEntryName, entry)
 	}
 
 	return entryFilename, nil
 }
+
+// getDirname returns the name of the directory holding the given store
+// directory, which is an absolute slash-separated path ending with a slash.
+func (s *store) getDirname(dir string) (string, error) {
+	if !strings.HasPrefix(dir, "/") || !strings.HasSuffix(dir, "/") || hasDotDot(dir) {
+		return "", fmt.Errorf("%w: directory %q", secret.ErrInvalidEntryName, dir)
+	}
+	dirname := filepath.Join(s.baseDir, filepath.FromSlash(dir))
+	if !s.contains(dirname) {
+		return "", fmt.Errorf("%w: directory %q", secret.ErrInvalidEntryName, dir)
+	}
+	if err := s.checkSymlinks(dirname); err != nil {
+		return "", fmt.Errorf("%w: directory %q: %v", secret.ErrInvalidEntryName, dir, err)
+	}
+	return dirname, nil
+}
+
+// contains determines if the given filename, which must be clean, is the base
+// directory or is lexically beneath it. Unlike a string prefix check, this
+// does not mistake a sibling such as `/base-evil` for a descendant of `/base`.
+func (s *store) contains(filename string) bool {
+	rel, err := filepath.Rel(s.baseDir, filename)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// reservedDirs are the directories, relative to the base directory, which
+// hold the store's own data rather than entries.
+var reservedDirs = []string{versionsDir, trashDir, batchDir}
+
+// ReservedDirs returns the names of the directories within a store's base
+// directory which hold the store's own data (previous versions of entries,
+// trashed entries & pending batches) rather than entries.
+func ReservedDirs() []string {
+	return append([]string(nil), reservedDirs...)
+}
+
+// isReservedDir determines if the given name, relative to the base directory,
+// is one of reservedDirs.
+func isReservedDir(name string) bool {
+	for _, d := range reservedDirs {
+		if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+// inReservedDir determines if the given filename, which must be clean, is one
+// of reservedDirs or is beneath one.
+func (s *store) inReservedDir(filename string) bool {
+	rel, err := filepath.Rel(s.baseDir, filename)
+	if err != nil {
+		return false
+	}
+	return isReservedDir(strings.SplitN(rel, string(filepath.Separator), 2)[0])
+}
+
+// checkSymlinks checks that the given filename, which must be lexically
+// beneath the base directory, does not lead outside the base directory once
+// symbolic links are resolved. Since the file may not exist yet, its nearest
+// existing ancestor is checked instead. It does nothing unless the store was
+// created with WithResolveSymlinks.
+func (s *store) checkSymlinks(filename string) error {
+	if !s.resolveSymlinks {
+		return nil
+	}
+	base, err := filepath.EvalSymlinks(s.baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("couldn't resolve %q: %w", s.baseDir, err)
+	}
+	for fn := filename; ; fn = filepath.Dir(fn) {
+		resolved, err := filepath.EvalSymlinks(fn)
+		switch {
+		case err == nil:
+			rel, err := filepath.Rel(base, resolved)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("%q resolves to %q, outside of the store", fn, resolved)
+			}
+			return nil
+		case !os.IsNotExist(err):
+			return fmt.Errorf("couldn't resolve %q: %w", fn, err)
+		case fn == s.baseDir:
+			return nil
+		}
+	}
+}
+
+// hasDotDot determines if the given slash-separated path has any ".."
+// components, which could be used to escape the base directory.
+func hasDotDot(p string) bool {
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// attachmentsSuffix is appended to the name of an entry's file to get the name
+// of the file holding the entry's attachments, which are encrypted together.
+// Since entry files always end with the store's extension, an attachments file
+// is never mistaken for an entry.
+const attachmentsSuffix = ".attachments"
+
+// AttachmentCrypter is a Crypter which can also encrypt the attachments of an
+// entry. Stores created by NewStore with an AttachmentCrypter implement
+// secret.AttachmentStore.
+type AttachmentCrypter interface {
+	Crypter
+
+	// EncryptAttachments encrypts the given attachments, by filename, into
+	// `ciphertext`, which will then be written to a file on disk.
+	// `entryName` is the name of the entry the attachments belong to.
+	EncryptAttachments(entryName string, attachments map[string][]byte) (ciphertext []byte, _ error)
+
+	// DecryptAttachments attempts to decrypt the given `ciphertext` (read
+	// from disk) into attachments, by filename. `entryName` is the name
+	// of the entry the attachments belong to.
+	DecryptAttachments(entryName string, ciphertext []byte) (attachments map[string][]byte, _ error)
+}
+
+// attachmentStore implements secret.AttachmentStore, wrapping the store
+// returned by NewStore for stores whose crypter can encrypt attachments.
+type attachmentStore struct {
+	secret.Store
+	s *store
+	c AttachmentCrypter
+}
+
+var _ secret.AttachmentStore = attachmentStore{}
+
+func (as attachmentStore) Unwrap() secret.Store { return as.Store }
+
+// PutIf helps to implement secret.ConditionalStore.
+func (as attachmentStore) PutIf(entry, content, expectedHash string) error {
+	return as.s.PutIf(entry, content, expectedHash)
+}
+
+// DeleteTree helps to implement secret.TreeStore.
+func (as attachmentStore) DeleteTree(prefix string) (int, error) {
+	return as.s.DeleteTree(prefix)
+}
+
+// MoveTree helps to implement secret.TreeStore.
+func (as attachmentStore) MoveTree(oldPrefix, newPrefix string) (int, error) {
+	return as.s.MoveTree(oldPrefix, newPrefix)
+}
+
+// Batch helps to implement secret.BatchStore.
+func (as attachmentStore) Batch(f func(tx secret.Tx) error) error {
+	return as.s.Batch(f)
+}
+
+// ResumeBatch helps to implement secret.BatchStore.
+func (as attachmentStore) ResumeBatch() (int, error) {
+	return as.s.ResumeBatch()
+}
+
+// ListAttachments helps to implement secret.AttachmentStore.
+func (as attachmentStore) ListAttachments(entry string) ([]string, error) {
+	atts, err := as.readAttachments(entry)
+	if err != nil {
+		return nil, err
+	}
+	fns := make([]string, 0, len(atts))
+	for fn := range atts {
+		fns = append(fns, fn)
+	}
+	sort.Strings(fns)
+	return fns, nil
+}
+
+// GetAttachment helps to implement secret.AttachmentStore.
+func (as attachmentStore) GetAttachment(entry, filename string) ([]byte, error) {
+	atts, err := as.readAttachments(entry)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := atts[filename]
+	if !ok {
+		return nil, fmt.Errorf("%w: attachment %q of %q", secret.ErrNoEntry, filename, entry)
+	}
+	return content, nil
+}
+
+// PutAttachment helps to implement secret.AttachmentStore.
+//
+// On POSIX-compliant systems, the update is atomic.
+func (as attachmentStore) PutAttachment(entry, filename string, content []byte) error {
+	if err := checkAttachmentFilename(filename); err != nil {
+		return err
+	}
+	entryFilename, err := as.s.getEntryFilename(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	if _, err := os.Stat(entryFilename); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+		}
+		return fmt.Errorf("couldn't stat %q: %w", entryFilename, err)
+	}
+	atts, err := as.readAttachments(entry)
+	if err != nil {
+		return err
+	}
+	atts[filename] = content
+	return as.writeAttachments(entry, atts)
+}
+
+// DeleteAttachment helps to implement secret.AttachmentStore.
+func (as attachmentStore) DeleteAttachment(entry, filename string) error {
+	atts, err := as.readAttachments(entry)
+	if err != nil {
+		return err
+	}
+	if _, ok := atts[filename]; !ok {
+		return fmt.Errorf("%w: attachment %q of %q", secret.ErrNoEntry, filename, entry)
+	}
+	delete(atts, filename)
+	return as.writeAttachments(entry, atts)
+}
+
+// readAttachments reads the attachments of the given entry, by filename. An
+// entry with no attachments file has no attachments.
+func (as attachmentStore) readAttachments(entry string) (map[string][]byte, error) {
+	entryFilename, err := as.s.getEntryFilename(entry)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	fn := entryFilename + attachmentsSuffix
+	ciphertext, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]byte{}, nil
+		}
+		return nil, fmt.Errorf("couldn't read %q: %w", fn, err)
+	}
+	atts, err := as.c.DecryptAttachments(entry, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt attachments: %w", err)
+	}
+	if atts == nil {
+		atts = map[string][]byte{}
+	}
+	return atts, nil
+}
+
+// writeAttachments replaces the attachments of the given entry. If there are
+// no attachments, the entry's attachments file is removed.
+func (as attachmentStore) writeAttachments(entry string, atts map[string][]byte) error {
+	entryFilename, err := as.s.getEntryFilename(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	fn := entryFilename + attachmentsSuffix
+	if len(atts) == 0 {
+		if err := removeIfExists(fn); err != nil {
+			return err
+		}
+		return as.s.updateManifest(fn)
+	}
+	ciphertext, err := as.c.EncryptAttachments(entry, atts)
+	if err != nil {
+		return fmt.Errorf("couldn't encrypt attachments: %w", err)
+	}
+	if err := writeFile(fn, ciphertext); err != nil {
+		return err
+	}
+	return as.s.updateManifest(fn)
+}
+
+// checkAttachmentFilename checks that the given attachment filename is valid.
+func checkAttachmentFilename(filename string) error {
+	switch {
+	case filename == "":
+		return fmt.Errorf("%w: missing attachment filename", secret.ErrInvalidEntryName)
+	case strings.ContainsAny(filename, "/\\\x00"):
+		return fmt.Errorf("%w: attachment filename %q", secret.ErrInvalidEntryName, filename)
+	}
+	return nil
+}
+
+// renameIfExists renames oldFilename to newFilename, doing nothing if
+// oldFilename does not exist.
+func renameIfExists(oldFilename, newFilename string) error {
+	if err := os.Rename(oldFilename, newFilename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", oldFilename, newFilename, err)
+	}
+	return nil
+}
+
+// removeIfExists removes the given file, doing nothing if it does not exist.
+func removeIfExists(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't delete %q: %w", filename, err)
+	}
+	return nil
+}
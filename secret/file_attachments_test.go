@@ -0,0 +1,118 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := secret.AsAttachmentStore(NewStore(dir, ".foo", fakeAttachmentCrypter{}, WithTrash(time.Hour)))
+	if !ok {
+		t.Fatalf("Store with attachment crypter does not implement secret.AttachmentStore")
+	}
+	if _, ok := secret.AsAttachmentStore(NewStore(dir, ".foo", fakeCrypter{})); ok {
+		t.Errorf("Store without attachment crypter implements secret.AttachmentStore")
+	}
+
+	// Attachments can only be added to existing entries.
+	if err := store.PutAttachment("/entry", "codes.pdf", []byte("codes")); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("PutAttachment to nonexistent entry returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	for _, fn := range []string{"", "../escape", `dir\file`} {
+		if err := store.PutAttachment("/entry", fn, []byte("content")); err == nil {
+			t.Errorf("PutAttachment with filename %q unexpectedly succeeded", fn)
+		}
+	}
+
+	// Basic tests.
+	for _, fn := range []string{"key.bin", "codes.pdf"} {
+		if err := store.PutAttachment("/entry", fn, []byte(fn+" content\x00\xff")); err != nil {
+			t.Fatalf("Could not put attachment: %v", err)
+		}
+	}
+	if fns, err := store.ListAttachments("/entry"); err != nil || fmt.Sprint(fns) != "[codes.pdf key.bin]" {
+		t.Errorf("ListAttachments returned (%q, %v), want [codes.pdf key.bin]", fns, err)
+	}
+	if content, err := store.GetAttachment("/entry", "key.bin"); err != nil || !bytes.Equal(content, []byte("key.bin content\x00\xff")) {
+		t.Errorf("GetAttachment returned (%q, %v), want %q", content, err, "key.bin content\x00\xff")
+	}
+	if _, err := store.GetAttachment("/entry", "nonexistent"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("GetAttachment of nonexistent attachment returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+	if entries, err := store.List(); err != nil || fmt.Sprint(entries) != "[/entry]" {
+		t.Errorf("List returned (%q, %v), want [/entry]", entries, err)
+	}
+
+	// Attachments follow their entry when it is moved, deleted & restored.
+	if err := store.Move("/entry", "/moved"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if fns, err := store.ListAttachments("/moved"); err != nil || len(fns) != 2 {
+		t.Errorf("ListAttachments after move returned (%q, %v), want two attachments", fns, err)
+	}
+	if err := store.Delete("/moved"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if fns, err := store.ListAttachments("/moved"); err != nil || len(fns) != 0 {
+		t.Errorf("ListAttachments after delete returned (%q, %v), want no attachments", fns, err)
+	}
+	ts, _ := secret.AsTrashStore(store)
+	if err := ts.Restore("/moved"); err != nil {
+		t.Fatalf("Could not restore: %v", err)
+	}
+	if fns, err := store.ListAttachments("/moved"); err != nil || len(fns) != 2 {
+		t.Errorf("ListAttachments after restore returned (%q, %v), want two attachments", fns, err)
+	}
+
+	// Deleting the last attachment removes the attachments file.
+	for _, fn := range []string{"key.bin", "codes.pdf"} {
+		if err := store.DeleteAttachment("/moved", fn); err != nil {
+			t.Fatalf("Could not delete attachment: %v", err)
+		}
+	}
+	if err := store.DeleteAttachment("/moved", "key.bin"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("DeleteAttachment of nonexistent attachment returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+	if _, err := os.Stat(dir + "/moved.foo" + attachmentsSuffix); !os.IsNotExist(err) {
+		t.Errorf("Attachments file was not removed: %v", err)
+	}
+}
+
+type fakeAttachmentCrypter struct{ fakeCrypter }
+
+func (fakeAttachmentCrypter) EncryptAttachments(entryName string, attachments map[string][]byte) ([]byte, error) {
+	attBytes, err := json.Marshal(attachments)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("ENCRYPTED:"), attBytes...), nil
+}
+
+func (fakeAttachmentCrypter) DecryptAttachments(entryName string, ciphertext []byte) (map[string][]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte("ENCRYPTED:")) {
+		return nil, errors.New("not encrypted")
+	}
+	var atts map[string][]byte
+	if err := json.Unmarshal(bytes.TrimPrefix(ciphertext, []byte("ENCRYPTED:")), &atts); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
@@ -0,0 +1,221 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+const (
+	// batchDir is the directory, relative to the base directory, in which
+	// the changes of a batch are staged until they are committed.
+	batchDir = ".batch"
+
+	// batchJournal is the file, within batchDir, listing the changes of a
+	// batch being committed. It is written once every change has been
+	// staged, so its presence means the batch must be committed, by
+	// ResumeBatch if the commit is interrupted.
+	batchJournal = "journal"
+)
+
+// batchMu serializes batches, so that only one batch is staged in a store's
+// batch directory at a time.
+var batchMu sync.Mutex
+
+// batchChange is a change listed in a batch's journal.
+type batchChange struct {
+	Entry  string `json:"entry"`
+	Staged string `json:"staged,omitempty"` // file within batchDir holding the entry's new content; empty if the entry is deleted
+}
+
+// Batch helps to implement secret.BatchStore. Changes are staged in a
+// directory within the base directory, then committed by renaming staged
+// content into place & deleting entries, as by Delete. On POSIX-compliant
+// systems, each change is atomic, but the commit as a whole is not: readers
+// may see some changes before others. Each entry is changed at most once per
+// commit, so that changes can be reapplied safely by ResumeBatch.
+func (s *store) Batch(f func(tx secret.Tx) error) error {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	dir := filepath.Join(s.baseDir, batchDir)
+	if _, err := os.Stat(filepath.Join(dir, batchJournal)); err == nil {
+		return secret.ErrBatchPending
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't stat batch journal: %w", err)
+	}
+
+	// Changes left staged by an uncommitted batch are discarded.
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("couldn't remove %q: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", dir, err)
+	}
+	tx := &batchTx{s: s, dir: dir, changes: map[string]int{}}
+	if err := f(tx); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	journal, err := json.Marshal(tx.log)
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("couldn't marshal batch journal: %w", err)
+	}
+	if err := writeFile(filepath.Join(dir, batchJournal), journal); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("couldn't write batch journal: %w", err)
+	}
+	_, err = s.commitBatch(tx.log)
+	return err
+}
+
+// ResumeBatch helps to implement secret.BatchStore.
+func (s *store) ResumeBatch() (int, error) {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	dir := filepath.Join(s.baseDir, batchDir)
+	journal, err := ioutil.ReadFile(filepath.Join(dir, batchJournal))
+	if os.IsNotExist(err) {
+		if err := os.RemoveAll(dir); err != nil {
+			return 0, fmt.Errorf("couldn't remove %q: %w", dir, err)
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read batch journal: %w", err)
+	}
+	var log []batchChange
+	if err := json.Unmarshal(journal, &log); err != nil {
+		return 0, fmt.Errorf("couldn't parse batch journal: %w", err)
+	}
+	return s.commitBatch(log)
+}
+
+// commitBatch applies the given changes, listed in the batch journal, in
+// order, then removes the batch directory. Changes which were already applied
+// by an interrupted commit are applied again harmlessly. It returns the
+// number of changes in the batch.
+func (s *store) commitBatch(log []batchChange) (int, error) {
+	for i, c := range log {
+		if s.commitHook != nil {
+			if err := s.commitHook(i); err != nil {
+				return i, &secret.BatchError{Done: i, Total: len(log), Err: err}
+			}
+		}
+		if err := s.applyBatchChange(c); err != nil {
+			return i, &secret.BatchError{Done: i, Total: len(log), Err: err}
+		}
+	}
+
+	// The journal is removed first, so that the batch is not committed again.
+	dir := filepath.Join(s.baseDir, batchDir)
+	if err := os.Remove(filepath.Join(dir, batchJournal)); err != nil {
+		return len(log), fmt.Errorf("couldn't remove batch journal: %w", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return len(log), fmt.Errorf("couldn't remove %q: %w", dir, err)
+	}
+	return len(log), nil
+}
+
+// applyBatchChange applies a single change of a batch being committed. A put
+// whose staged content is missing has already been applied, as has a delete
+// of an entry which does not exist.
+func (s *store) applyBatchChange(c batchChange) error {
+	if c.Staged == "" {
+		if err := s.Delete(c.Entry); err != nil && !errors.Is(err, secret.ErrNoEntry) {
+			return err
+		}
+		return nil
+	}
+
+	entryFilename, err := s.getEntryFilename(c.Entry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", c.Entry, err)
+	}
+	staged := filepath.Join(s.baseDir, batchDir, c.Staged)
+	if _, err := os.Stat(staged); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't stat %q: %w", staged, err)
+	}
+	putMu.Lock()
+	defer putMu.Unlock()
+	entryDir := filepath.Dir(entryFilename)
+	if err := os.MkdirAll(entryDir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", entryDir, err)
+	}
+	if s.keepVersions > 0 {
+		if err := s.saveVersion(entryFilename); err != nil {
+			return fmt.Errorf("couldn't save previous version of %q: %w", c.Entry, err)
+		}
+	}
+	if err := os.Rename(staged, entryFilename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", staged, entryFilename, err)
+	}
+	return s.updateManifest(entryFilename)
+}
+
+// batchTx implements secret.Tx, staging changes in the batch directory.
+type batchTx struct {
+	s       *store
+	dir     string         // the batch directory
+	log     []batchChange  // staged changes, in the order their entries were first changed
+	changes map[string]int // index in log of the change to each entry
+}
+
+func (tx *batchTx) Put(entry, content string) error {
+	if tx.s.maxEntrySize > 0 && len(content) > tx.s.maxEntrySize {
+		return fmt.Errorf("%w: %q is %d bytes (maximum %d)", secret.ErrEntryTooLarge, entry, len(content), tx.s.maxEntrySize)
+	}
+	if _, err := tx.s.getEntryFilename(entry); err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	ciphertext, err := tx.s.crypter.Encrypt(entry, content)
+	if err != nil {
+		return fmt.Errorf("couldn't encrypt: %w", err)
+	}
+	i, ok := tx.changes[entry]
+	if !ok {
+		i = len(tx.log)
+		tx.log = append(tx.log, batchChange{Entry: entry})
+		tx.changes[entry] = i
+	}
+	staged := strconv.Itoa(i)
+	if err := writeFile(filepath.Join(tx.dir, staged), ciphertext); err != nil {
+		return fmt.Errorf("couldn't stage %q: %w", entry, err)
+	}
+	tx.log[i].Staged = staged
+	return nil
+}
+
+func (tx *batchTx) Delete(entry string) error {
+	entryFilename, err := tx.s.getEntryFilename(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	i, ok := tx.changes[entry]
+	switch {
+	case ok && tx.log[i].Staged == "":
+		return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+	case ok:
+		// The staged content is discarded along with the batch directory.
+		tx.log[i].Staged = ""
+		return nil
+	}
+	if _, err := os.Stat(entryFilename); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+	} else if err != nil {
+		return fmt.Errorf("couldn't stat %q: %w", entryFilename, err)
+	}
+	tx.changes[entry] = len(tx.log)
+	tx.log = append(tx.log, batchChange{Entry: entry})
+	return nil
+}
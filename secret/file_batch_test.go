@@ -0,0 +1,209 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStore(dir, ".foo", fakeCrypter{}, WithVersions(2))
+	for _, e := range []string{"/keep", "/old", "/replace"} {
+		if err := s.Put(e, "old content of "+e); err != nil {
+			t.Fatalf("Could not put %q: %v", e, err)
+		}
+	}
+	want := map[string]string{
+		"/keep":    "old content of /keep",
+		"/old":     "old content of /old",
+		"/replace": "old content of /replace",
+	}
+
+	// A batch whose function fails changes nothing.
+	errFail := errors.New("fail")
+	if err := secret.Batch(s, func(tx secret.Tx) error {
+		if err := tx.Put("/replace", "new content"); err != nil {
+			return err
+		}
+		if err := tx.Delete("/old"); err != nil {
+			return err
+		}
+		return errFail
+	}); !errors.Is(err, errFail) {
+		t.Errorf("Batch with failing function returned %v, want %v", err, errFail)
+	}
+	checkContents(t, s, want)
+	checkNoBatchDir(t, dir)
+
+	// A successful batch applies every change; changes are hidden until then.
+	if err := secret.Batch(s, func(tx secret.Tx) error {
+		for _, c := range []struct{ entry, content string }{
+			{"/new", "new content"},
+			{"/replace", "first new content"},
+			{"/replace", "new content"},
+			{"/transient", "transient content"},
+		} {
+			if err := tx.Put(c.entry, c.content); err != nil {
+				t.Errorf("Could not put %q: %v", c.entry, err)
+			}
+		}
+		for _, e := range []string{"/old", "/transient"} {
+			if err := tx.Delete(e); err != nil {
+				t.Errorf("Could not delete %q: %v", e, err)
+			}
+		}
+		for _, e := range []string{"/nonexistent", "/transient", "/old"} {
+			if err := tx.Delete(e); !errors.Is(err, secret.ErrNoEntry) {
+				t.Errorf("Delete(%q) returned %v, want %v", e, err, secret.ErrNoEntry)
+			}
+		}
+		if _, err := s.Get("/new"); !errors.Is(err, secret.ErrNoEntry) {
+			t.Errorf("Before commit, Get(%q) returned %v, want %v", "/new", err, secret.ErrNoEntry)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Could not commit batch: %v", err)
+	}
+	delete(want, "/old")
+	want["/new"] = "new content"
+	want["/replace"] = "new content"
+	checkContents(t, s, want)
+	checkNoBatchDir(t, dir)
+
+	// Replaced entries keep their previous versions.
+	vs, err := s.(secret.VersionedStore).Versions("/replace")
+	if err != nil {
+		t.Fatalf("Could not get versions of %q: %v", "/replace", err)
+	}
+	if len(vs) != 1 {
+		t.Errorf("Versions(%q) = %v, want one version", "/replace", vs)
+	}
+
+	if n, err := secret.ResumeBatch(s); err != nil || n != 0 {
+		t.Errorf("ResumeBatch with no batch pending = (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestBatchResume(t *testing.T) {
+	t.Parallel()
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := newStore(dir, ".foo", fakeCrypter{}, nil)
+	for _, e := range []string{"/b", "/d"} {
+		if err := s.Put(e, "old content of "+e); err != nil {
+			t.Fatalf("Could not put %q: %v", e, err)
+		}
+	}
+	batch := func(tx secret.Tx) error {
+		if err := tx.Put("/a", "content of /a"); err != nil {
+			return err
+		}
+		if err := tx.Delete("/b"); err != nil {
+			return err
+		}
+		if err := tx.Put("/c", "content of /c"); err != nil {
+			return err
+		}
+		return tx.Delete("/d")
+	}
+
+	// Simulate a crash partway through the commit.
+	errCrash := errors.New("crash")
+	crashAt := func(change int) func(int) error {
+		return func(i int) error {
+			if i == change {
+				return errCrash
+			}
+			return nil
+		}
+	}
+	s.commitHook = crashAt(3)
+	err = s.Batch(batch)
+	var be *secret.BatchError
+	if !errors.As(err, &be) || !errors.Is(err, errCrash) {
+		t.Fatalf("Interrupted Batch returned %v, want BatchError wrapping %v", err, errCrash)
+	}
+	if be.Done != 3 || be.Total != 4 {
+		t.Errorf("Interrupted Batch applied %d of %d changes, want 3 of 4", be.Done, be.Total)
+	}
+	checkContents(t, s, map[string]string{
+		"/a": "content of /a",
+		"/c": "content of /c",
+		"/d": "old content of /d",
+	})
+
+	// No further batch can start until the interrupted one is resumed.
+	if err := s.Batch(func(secret.Tx) error { return nil }); !errors.Is(err, secret.ErrBatchPending) {
+		t.Errorf("Batch with batch pending returned %v, want %v", err, secret.ErrBatchPending)
+	}
+
+	// Resuming reapplies the changes already applied harmlessly, even if it
+	// is itself interrupted.
+	s.commitHook = crashAt(0)
+	if _, err := s.ResumeBatch(); !errors.As(err, &be) || be.Done != 0 {
+		t.Errorf("Interrupted ResumeBatch returned %v, want BatchError with no changes done", err)
+	}
+	s.commitHook = nil
+	if n, err := s.ResumeBatch(); err != nil || n != 4 {
+		t.Errorf("ResumeBatch = (%d, %v), want (4, nil)", n, err)
+	}
+	want := map[string]string{
+		"/a": "content of /a",
+		"/c": "content of /c",
+	}
+	checkContents(t, s, want)
+	checkNoBatchDir(t, dir)
+
+	// Changes staged by a batch interrupted before its commit began are
+	// discarded.
+	if err := os.MkdirAll(filepath.Join(dir, batchDir), 0770); err != nil {
+		t.Fatalf("Could not create batch directory: %v", err)
+	}
+	if err := writeFile(filepath.Join(dir, batchDir, "0"), []byte("ENCRYPTED:staged content")); err != nil {
+		t.Fatalf("Could not write staged change: %v", err)
+	}
+	if n, err := s.ResumeBatch(); err != nil || n != 0 {
+		t.Errorf("ResumeBatch with uncommitted batch = (%d, %v), want (0, nil)", n, err)
+	}
+	checkContents(t, s, want)
+	checkNoBatchDir(t, dir)
+}
+
+func checkContents(t *testing.T, s secret.Store, want map[string]string) {
+	t.Helper()
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("Could not list entries: %v", err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		content, err := s.Get(e)
+		if err != nil {
+			t.Fatalf("Could not get %q: %v", e, err)
+		}
+		got[e] = content
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Store contents = %v, want %v", got, want)
+	}
+}
+
+func checkNoBatchDir(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(dir, batchDir)); !os.IsNotExist(err) {
+		t.Errorf("Batch directory exists (stat error %v), want removed", err)
+	}
+}
@@ -0,0 +1,131 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// TempFilePrefixes are the name prefixes of temporary files which are written
+// and then renamed into place. Any such file found on disk was orphaned by a
+// write which was interrupted, e.g. by a crash.
+var TempFilePrefixes = []string{".gopass_tmp_", ".harp_mfactr_", ".harp_accesslog_", ".harp_authlog_"}
+
+// entryExtensions are the extensions used by stores of any key type.
+var entryExtensions = []string{".gpg", ".harp"}
+
+// Problem describes a problem found while checking a store.
+type Problem struct {
+	Path   string // file or entry with the problem
+	Reason string
+}
+
+func (p Problem) String() string { return fmt.Sprintf("%s: %s", p.Path, p.Reason) }
+
+// FindTempFiles finds orphaned temporary files beneath dir, returning their
+// filenames. Orphaned temporary files are harmless, but may hold encrypted
+// entry content and can safely be removed.
+func FindTempFiles(dir string) ([]string, error) {
+	var fns []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, inErr error) error {
+		if inErr != nil {
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+		}
+		if info.Mode().IsRegular() && hasAnyPrefix(info.Name(), TempFilePrefixes) {
+			fns = append(fns, path)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return fns, nil
+}
+
+// FindEscapingSymlinks finds symlinks beneath baseDir whose targets are
+// outside of baseDir or do not exist. Entries reached through such symlinks
+// are stored outside of the store's directory.
+func FindEscapingSymlinks(baseDir string) ([]Problem, error) {
+	realBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resolve %q: %w", baseDir, err)
+	}
+	var ps []Problem
+	if err := filepath.Walk(baseDir, func(path string, info os.FileInfo, inErr error) error {
+		if inErr != nil {
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			ps = append(ps, Problem{path, "broken symlink"})
+			return nil
+		}
+		if rel, err := filepath.Rel(realBase, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			ps = append(ps, Problem{path, fmt.Sprintf("symlink to %q, outside of %q", target, baseDir)})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// FindForeignEntries finds files beneath baseDir which look like entries of a
+// store using an extension other than the given one, e.g. ".gpg" files in a
+// store using ".harp". Such files are ignored by the store.
+func FindForeignEntries(baseDir, extension string) ([]string, error) {
+	if extension != "" && !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+	var fns []string
+	if err := filepath.Walk(baseDir, func(path string, info os.FileInfo, inErr error) error {
+		if inErr != nil {
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, extension) {
+			return nil
+		}
+		for _, ext := range entryExtensions {
+			if strings.HasSuffix(path, ext) {
+				fns = append(fns, path)
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return fns, nil
+}
+
+// CheckEntries reads every entry of the given store, returning a problem for
+// each entry which cannot be read (e.g. because it cannot be decrypted).
+func CheckEntries(s secret.Store) ([]Problem, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	sort.Strings(entries)
+	var ps []Problem
+	for _, e := range entries {
+		if _, err := s.Get(e); err != nil {
+			ps = append(ps, Problem{e, err.Error()})
+		}
+	}
+	return ps, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
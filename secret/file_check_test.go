@@ -0,0 +1,87 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "harp_check_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	store := NewStore(dir, ".foo", fakeCrypter{})
+	for _, e := range []string{"/good", "/dir/good"} {
+		if err := store.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put %q: %v", e, err)
+		}
+	}
+	for fn, content := range map[string]string{
+		"corrupt.foo":                "garbage",
+		"dir/.gopass_tmp_123":        "ENCRYPTED:orphan",
+		".harp_mfactr_456":           "",
+		"dir/other.gpg":              "",
+		"dir/not-an-entry.txt":       "",
+		filepath.Join(outside, "ex"): "ENCRYPTED:outside",
+	} {
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(dir, fn)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatalf("Could not write %q: %v", fn, err)
+		}
+	}
+	for link, target := range map[string]string{
+		"inside.foo":  filepath.Join(dir, "good.foo"),
+		"escape.foo":  filepath.Join(outside, "ex"),
+		"dangling.fo": filepath.Join(dir, "nonexistent"),
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatalf("Could not create symlink %q: %v", link, err)
+		}
+	}
+
+	tfs, err := FindTempFiles(dir)
+	if err != nil {
+		t.Fatalf("Could not find temporary files: %v", err)
+	}
+	if want := []string{filepath.Join(dir, ".harp_mfactr_456"), filepath.Join(dir, "dir/.gopass_tmp_123")}; fmt.Sprint(tfs) != fmt.Sprint(want) {
+		t.Errorf("FindTempFiles = %q, want %q", tfs, want)
+	}
+
+	ps, err := FindEscapingSymlinks(dir)
+	if err != nil {
+		t.Fatalf("Could not find escaping symlinks: %v", err)
+	}
+	if len(ps) != 2 || ps[0].Path != filepath.Join(dir, "dangling.fo") || ps[1].Path != filepath.Join(dir, "escape.foo") {
+		t.Errorf("FindEscapingSymlinks = %v, want problems with dangling.fo & escape.foo", ps)
+	}
+
+	fes, err := FindForeignEntries(dir, "foo")
+	if err != nil {
+		t.Fatalf("Could not find foreign entries: %v", err)
+	}
+	if want := []string{filepath.Join(dir, "dir/other.gpg")}; fmt.Sprint(fes) != fmt.Sprint(want) {
+		t.Errorf("FindForeignEntries = %q, want %q", fes, want)
+	}
+
+	ps, err = CheckEntries(store)
+	if err != nil {
+		t.Fatalf("Could not check entries: %v", err)
+	}
+	if len(ps) != 1 || ps[0].Path != "/corrupt" {
+		t.Errorf("CheckEntries = %v, want a problem with /corrupt", ps)
+	}
+}
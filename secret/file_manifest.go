@@ -0,0 +1,339 @@
+package file
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// manifestFile is the name of the file, in the base directory, holding the
+// store's manifest.
+const manifestFile = ".manifest"
+
+// manifestMu serializes updates to manifests, which are read, modified &
+// rewritten. Several stores (e.g. one per session) may share a directory.
+var manifestMu sync.Mutex
+
+// MACCrypter is a Crypter which can also authenticate data. Stores created by
+// NewStore with a MACCrypter can keep a manifest of their files (see
+// WithManifest).
+type MACCrypter interface {
+	Crypter
+
+	// MAC returns a message authentication code for the given data,
+	// keyed with the crypter's key material. It returns nil if no MAC can
+	// be computed, e.g. because the crypter's key material has been wiped.
+	MAC(data []byte) []byte
+}
+
+// WithManifest, if manifest is true & the store's crypter is a MACCrypter,
+// causes the store to keep a manifest of its entry & attachment files, mapping
+// each file to the SHA-256 hash of its content, authenticated with the
+// crypter's MAC. The manifest is updated whenever the store changes a file.
+// Stores created with this option implement secret.VerifyStore.
+//
+// So as not to hide tampering, a store will neither create a manifest for a
+// directory already holding files, nor update a manifest which fails
+// authentication; either returns an error wrapping secret.ErrTampered. Use
+// RebuildManifest to start (or restart) keeping a manifest for such a
+// directory.
+func WithManifest(manifest bool) Option {
+	return func(s *store) {
+		s.manifest = manifest
+	}
+}
+
+// manifestContent is the serialized form of a manifest.
+type manifestContent struct {
+	Files map[string]string `json:"files"` // by slash-separated filename relative to the base directory: hex SHA-256 of content
+	MAC   string            `json:"mac"`   // hex MAC of Files, serialized as JSON
+}
+
+// manifestStore implements secret.VerifyStore, wrapping the store returned by
+// NewStore for stores that keep a manifest.
+type manifestStore struct {
+	secret.Store
+	s *store
+}
+
+var _ secret.VerifyStore = manifestStore{}
+
+func (ms manifestStore) Unwrap() secret.Store { return ms.Store }
+
+// PutIf helps to implement secret.ConditionalStore.
+func (ms manifestStore) PutIf(entry, content, expectedHash string) error {
+	return ms.s.PutIf(entry, content, expectedHash)
+}
+
+// DeleteTree helps to implement secret.TreeStore.
+func (ms manifestStore) DeleteTree(prefix string) (int, error) {
+	return ms.s.DeleteTree(prefix)
+}
+
+// MoveTree helps to implement secret.TreeStore.
+func (ms manifestStore) MoveTree(oldPrefix, newPrefix string) (int, error) {
+	return ms.s.MoveTree(oldPrefix, newPrefix)
+}
+
+// Batch helps to implement secret.BatchStore.
+func (ms manifestStore) Batch(f func(tx secret.Tx) error) error {
+	return ms.s.Batch(f)
+}
+
+// ResumeBatch helps to implement secret.BatchStore.
+func (ms manifestStore) ResumeBatch() (int, error) {
+	return ms.s.ResumeBatch()
+}
+
+// Verify helps to implement secret.VerifyStore.
+func (ms manifestStore) Verify() ([]string, error) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	files, err := ms.s.hashFiles()
+	if err != nil {
+		return nil, err
+	}
+	m, err := ms.s.readManifest()
+	switch {
+	case errors.Is(err, secret.ErrTampered):
+		return []string{err.Error()}, nil
+	case err != nil:
+		return nil, err
+	case m == nil && len(files) == 0:
+		return nil, nil
+	case m == nil:
+		return []string{fmt.Sprintf("%s: missing, but the store holds %d files", manifestFile, len(files))}, nil
+	}
+	return diffManifest(m, files), nil
+}
+
+// RebuildManifest replaces the manifest of the given store, which must have
+// been created with WithManifest, with one describing the store's files as
+// they are now. Any tampering with the files is accepted, so they should be
+// checked by other means (e.g. CheckEntries) first.
+func RebuildManifest(s secret.Store) error {
+	ms, ok := secret.Find(s, func(s secret.Store) bool {
+		_, ok := s.(manifestStore)
+		return ok
+	}).(manifestStore)
+	if !ok {
+		return errors.New("store does not keep a manifest")
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	files, err := ms.s.hashFiles()
+	if err != nil {
+		return err
+	}
+	return ms.s.writeManifest(files)
+}
+
+// diffManifest describes the differences between the files recorded in a
+// manifest & the files actually present, sorted by filename.
+func diffManifest(want, got map[string]string) []string {
+	var fns []string
+	for fn := range want {
+		fns = append(fns, fn)
+	}
+	for fn := range got {
+		if _, ok := want[fn]; !ok {
+			fns = append(fns, fn)
+		}
+	}
+	sort.Strings(fns)
+	var ps []string
+	for _, fn := range fns {
+		w, inWant := want[fn]
+		g, inGot := got[fn]
+		switch {
+		case !inGot:
+			ps = append(ps, fmt.Sprintf("%s: missing", fn))
+		case !inWant:
+			ps = append(ps, fmt.Sprintf("%s: not in manifest", fn))
+		case w != g:
+			ps = append(ps, fmt.Sprintf("%s: modified", fn))
+		}
+	}
+	return ps
+}
+
+// updateManifest records the current content of the given files, which may
+// no longer exist, in the store's manifest. It does nothing if the store does
+// not keep a manifest.
+func (s *store) updateManifest(filenames ...string) error {
+	if !s.keepsManifest() {
+		return nil
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		// Create a manifest only if the store held no files before
+		// this change; otherwise, the manifest may have been removed
+		// to hide tampering.
+		files, err := s.hashFiles()
+		if err != nil {
+			return err
+		}
+		changed := map[string]bool{}
+		for _, fn := range filenames {
+			changed[s.manifestName(fn)] = true
+		}
+		for fn := range files {
+			if !changed[fn] {
+				return fmt.Errorf("%w: %s is missing", secret.ErrTampered, manifestFile)
+			}
+		}
+		return s.writeManifest(files)
+	}
+
+	for _, fn := range filenames {
+		h, err := hashFile(fn)
+		if os.IsNotExist(err) {
+			delete(m, s.manifestName(fn))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m[s.manifestName(fn)] = h
+	}
+	return s.writeManifest(m)
+}
+
+func (s *store) keepsManifest() bool {
+	if !s.manifest {
+		return false
+	}
+	_, ok := s.crypter.(MACCrypter)
+	return ok
+}
+
+// readManifest reads & authenticates the store's manifest. It returns nil if
+// there is no manifest.
+func (s *store) readManifest() (map[string]string, error) {
+	fn := filepath.Join(s.baseDir, manifestFile)
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %q: %w", fn, err)
+	}
+	var mc manifestContent
+	if err := json.Unmarshal(data, &mc); err != nil {
+		return nil, fmt.Errorf("%w: couldn't parse %s: %v", secret.ErrTampered, manifestFile, err)
+	}
+	want, err := s.manifestMAC(mc.Files)
+	if err != nil {
+		return nil, err
+	}
+	if got, err := hex.DecodeString(mc.MAC); err != nil || !hmac.Equal(got, want) {
+		return nil, fmt.Errorf("%w: %s failed authentication", secret.ErrTampered, manifestFile)
+	}
+	if mc.Files == nil {
+		mc.Files = map[string]string{}
+	}
+	return mc.Files, nil
+}
+
+// writeManifest replaces the store's manifest with one recording the given
+// files.
+func (s *store) writeManifest(files map[string]string) error {
+	mac, err := s.manifestMAC(files)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifestContent{Files: files, MAC: hex.EncodeToString(mac)})
+	if err != nil {
+		return fmt.Errorf("couldn't marshal manifest: %w", err)
+	}
+	return writeFile(filepath.Join(s.baseDir, manifestFile), data)
+}
+
+// manifestMAC computes the MAC of a manifest recording the given files. Maps
+// are serialized as JSON with sorted keys, so the serialization is canonical.
+func (s *store) manifestMAC(files map[string]string) ([]byte, error) {
+	data, err := json.Marshal(files)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal manifest: %w", err)
+	}
+	mac := s.crypter.(MACCrypter).MAC(data)
+	if mac == nil {
+		return nil, errors.New("couldn't compute manifest MAC")
+	}
+	return mac, nil
+}
+
+// hashFiles hashes the content of each of the store's entry & attachment
+// files, by manifest name. Previous versions & the trash are not included.
+func (s *store) hashFiles() (map[string]string, error) {
+	files := map[string]string{}
+	if err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && path == s.baseDir && os.IsNotExist(inErr):
+			return nil
+
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+
+		case info.IsDir() && s.inReservedDir(path):
+			return filepath.SkipDir
+
+		case !info.Mode().IsRegular() || !(strings.HasSuffix(path, s.extension) || strings.HasSuffix(path, s.extension+attachmentsSuffix)):
+			return nil
+		}
+		h, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files[s.manifestName(path)] = h
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// manifestName returns the name of the given file in the store's manifest.
+func (s *store) manifestName(filename string) string {
+	rel, err := filepath.Rel(s.baseDir, filename)
+	if err != nil {
+		// Filenames are always beneath the base directory.
+		return filepath.ToSlash(filename)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// hashFile returns the hex SHA-256 hash of the content of the given file. If
+// the file does not exist, the returned error satisfies os.IsNotExist.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", err
+		}
+		return "", fmt.Errorf("couldn't open %q: %w", filename, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("couldn't read %q: %w", filename, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
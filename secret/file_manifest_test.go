@@ -0,0 +1,139 @@
+package file
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestManifest(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	newStore := func() (secret.AttachmentStore, secret.VerifyStore) {
+		s := NewStore(dir, ".foo", fakeMACCrypter{key: "key"}, WithTrash(time.Hour), WithManifest(true))
+		as, ok := secret.AsAttachmentStore(s)
+		if !ok {
+			t.Fatalf("Store with attachment crypter does not implement secret.AttachmentStore")
+		}
+		vs, ok := secret.AsVerifyStore(s)
+		if !ok {
+			t.Fatalf("Store with manifest does not implement secret.VerifyStore")
+		}
+		return as, vs
+	}
+	store, vs := newStore()
+	if _, ok := secret.AsVerifyStore(NewStore(dir, ".foo", fakeCrypter{}, WithManifest(true))); ok {
+		t.Errorf("Store without MAC crypter implements secret.VerifyStore")
+	}
+	if _, ok := secret.AsVerifyStore(NewStore(dir, ".foo", fakeMACCrypter{key: "key"})); ok {
+		t.Errorf("Store without manifest implements secret.VerifyStore")
+	}
+	verify := func(desc string, vs secret.VerifyStore, want string) {
+		t.Helper()
+		if ps, err := vs.Verify(); err != nil || fmt.Sprint(ps) != want {
+			t.Errorf("Verify %s returned (%q, %v), want %s", desc, ps, err, want)
+		}
+	}
+
+	// Changes via the store are recorded, including by other stores sharing the directory.
+	verify("of empty store", vs, "[]")
+	for _, e := range []string{"/a", "/b", "/dir/c", "/d"} {
+		if err := store.Put(e, e+" content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	if err := store.PutAttachment("/a", "file", []byte("attachment")); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+	if err := store.Move("/b", "/dir/b"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if err := store.Delete("/d"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	otherStore, otherVS := newStore()
+	if err := otherStore.Put("/e", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	verify("after changes", vs, "[]")
+	verify("after changes, via other store", otherVS, "[]")
+
+	// Tampering is detected.
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a.foo"))
+	if err != nil {
+		t.Fatalf("Could not read entry: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "e.foo")); err != nil {
+		t.Fatalf("Could not remove entry: %v", err)
+	}
+	for fn, c := range map[string]string{"dir/c.foo": "substituted", "f.foo": "extra", "g.bar": "ignored"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(c), 0660); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+	verify("after tampering", vs, "[dir/c.foo: modified e.foo: missing f.foo: not in manifest]")
+
+	// Changes via the store don't hide other tampering.
+	if err := store.Put("/a", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.foo"), content, 0660); err != nil {
+		t.Fatalf("Could not roll back entry: %v", err)
+	}
+	verify("after rollback", vs, "[a.foo: modified dir/c.foo: modified e.foo: missing f.foo: not in manifest]")
+
+	// A manifest authenticated with another key, or removed, is detected.
+	wrongKeyStore := NewStore(dir, ".foo", fakeMACCrypter{key: "other key"}, WithManifest(true))
+	wrongKeyVS, _ := secret.AsVerifyStore(wrongKeyStore)
+	verify("with other key", wrongKeyVS, "[password store has been tampered with: .manifest failed authentication]")
+	if err := wrongKeyStore.Put("/a", "content"); !errors.Is(err, secret.ErrTampered) {
+		t.Errorf("Put with other key returned error %v, want %v", err, secret.ErrTampered)
+	}
+	if err := os.Remove(filepath.Join(dir, manifestFile)); err != nil {
+		t.Fatalf("Could not remove manifest: %v", err)
+	}
+	verify("without manifest", vs, "[.manifest: missing, but the store holds 5 files]")
+	if err := store.Put("/a", "content"); !errors.Is(err, secret.ErrTampered) {
+		t.Errorf("Put without manifest returned error %v, want %v", err, secret.ErrTampered)
+	}
+
+	// Rebuilding the manifest accepts the store's files as they are.
+	if err := RebuildManifest(NewStore(dir, ".foo", fakeCrypter{})); err == nil {
+		t.Errorf("RebuildManifest of store without manifest unexpectedly succeeded")
+	}
+	if err := RebuildManifest(NewStore(dir, ".foo", fakeMACCrypter{key: "key"}, WithManifest(true))); err != nil {
+		t.Fatalf("Could not rebuild manifest: %v", err)
+	}
+	verify("after rebuild", vs, "[]")
+	if err := store.Put("/a", "content"); err != nil {
+		t.Errorf("Could not put after rebuild: %v", err)
+	}
+	verify("after put", vs, "[]")
+}
+
+// fakeMACCrypter is a fakeAttachmentCrypter which computes MACs with the given
+// key.
+type fakeMACCrypter struct {
+	fakeAttachmentCrypter
+	key string
+}
+
+func (c fakeMACCrypter) MAC(data []byte) []byte {
+	h := hmac.New(sha256.New, []byte(c.key))
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,231 @@
+package file
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the directories within a snapshot holding the store's files and
+// any extra files, respectively.
+const (
+	snapshotStoreDir = "store"
+	snapshotExtraDir = "extra"
+)
+
+// ErrNotEmpty is returned by RestoreSnapshot if the destination directory is
+// not empty and overwriting was not requested.
+var ErrNotEmpty = errors.New("destination is not empty")
+
+// SnapshotFile is a file stored in a snapshot alongside a store's files, such
+// as the MFA counter file.
+type SnapshotFile struct {
+	Name    string // a plain filename, without any directory
+	Content []byte
+}
+
+// Snapshot writes a tar archive of every file of the store in baseDir to w,
+// along with the given extra files. Entries are encrypted at rest, so the
+// snapshot can be taken without the passphrase; it is no more sensitive than
+// the files themselves. The archive is deterministic: snapshots of identical
+// stores are byte-for-byte identical. Orphaned temporary files are skipped,
+// and symlinks are rejected rather than followed.
+func Snapshot(w io.Writer, baseDir string, extra ...SnapshotFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range extra {
+		if f.Name == "" || strings.ContainsAny(f.Name, `/\`) || f.Name == "." || f.Name == ".." {
+			return fmt.Errorf("couldn't snapshot extra file %q: invalid name", f.Name)
+		}
+		if err := tw.WriteHeader(snapshotHeader(path.Join(snapshotExtraDir, f.Name), tar.TypeReg, int64(len(f.Content)))); err != nil {
+			return fmt.Errorf("couldn't write header for %q: %w", f.Name, err)
+		}
+		if _, err := tw.Write(f.Content); err != nil {
+			return fmt.Errorf("couldn't write %q: %w", f.Name, err)
+		}
+	}
+
+	// filepath.Walk visits files in lexical order, keeping the archive deterministic.
+	if err := filepath.Walk(baseDir, func(filename string, info os.FileInfo, inErr error) error {
+		if inErr != nil {
+			return fmt.Errorf("couldn't walk %q: %w", filename, inErr)
+		}
+		rel, err := filepath.Rel(baseDir, filename)
+		if err != nil {
+			return fmt.Errorf("couldn't get relative path of %q: %w", filename, err)
+		}
+		name := path.Join(snapshotStoreDir, filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			if err := tw.WriteHeader(snapshotHeader(name+"/", tar.TypeDir, 0)); err != nil {
+				return fmt.Errorf("couldn't write header for %q: %w", filename, err)
+			}
+			return nil
+
+		case info.Mode().IsRegular() && hasAnyPrefix(info.Name(), TempFilePrefixes):
+			return nil
+
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("couldn't snapshot %q: not a regular file or directory", filename)
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("couldn't open %q: %w", filename, err)
+		}
+		defer f.Close()
+		if err := tw.WriteHeader(snapshotHeader(name, tar.TypeReg, info.Size())); err != nil {
+			return fmt.Errorf("couldn't write header for %q: %w", filename, err)
+		}
+		// Copy exactly the size in the header, in case the file is being written.
+		if _, err := io.CopyN(tw, f, info.Size()); err != nil {
+			return fmt.Errorf("couldn't write %q: %w", filename, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("couldn't finish snapshot: %w", err)
+	}
+	return nil
+}
+
+// snapshotHeader returns a tar header for a file in a snapshot. Only the
+// name, type & size vary, so that snapshots are deterministic.
+func snapshotHeader(name string, typ byte, size int64) *tar.Header {
+	mode := int64(0660)
+	if typ == tar.TypeDir {
+		mode = 0770
+	}
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     name,
+		Size:     size,
+		Mode:     mode,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+}
+
+// RestoreSnapshot restores a snapshot written by Snapshot, read from r, into
+// the directory dest, creating it if needed. It returns the snapshot's extra
+// files, which are not written to disk. If check is non-nil, it is called with
+// the extra files before anything is written to disk; if it returns an error,
+// nothing is restored and the error is returned. If dest is not empty,
+// RestoreSnapshot returns ErrNotEmpty unless force is set, in which case files
+// in the snapshot replace any existing files of the same name.
+func RestoreSnapshot(r io.Reader, dest string, force bool, check func(extra []SnapshotFile) error) ([]SnapshotFile, error) {
+	if err := checkRestoreDest(dest, force); err != nil {
+		return nil, err
+	}
+
+	var extra []SnapshotFile
+	started := false // whether check has passed & dest has been created
+	start := func() error {
+		if started {
+			return nil
+		}
+		if check != nil {
+			if err := check(extra); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(dest, 0770); err != nil {
+			return fmt.Errorf("couldn't create %q: %w", dest, err)
+		}
+		started = true
+		return nil
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read snapshot: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || hasDotDot(name) {
+			return nil, fmt.Errorf("couldn't restore %q: invalid name", hdr.Name)
+		}
+		dir, rel := name, ""
+		if i := strings.Index(name, "/"); i != -1 {
+			dir, rel = name[:i], name[i+1:]
+		}
+
+		switch {
+		case dir == snapshotExtraDir && hdr.Typeflag == tar.TypeReg && rel != "" && !strings.Contains(rel, "/"):
+			// Snapshot writes extra files first, so they can all be
+			// checked before the store's files are restored.
+			if started {
+				return nil, fmt.Errorf("couldn't restore %q: extra file after store files", hdr.Name)
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read %q: %w", hdr.Name, err)
+			}
+			extra = append(extra, SnapshotFile{Name: rel, Content: content})
+
+		case dir == snapshotStoreDir && hdr.Typeflag == tar.TypeDir:
+			if err := start(); err != nil {
+				return nil, err
+			}
+			dirname := filepath.Join(dest, filepath.FromSlash(rel))
+			if err := os.MkdirAll(dirname, 0770); err != nil {
+				return nil, fmt.Errorf("couldn't create directory %q: %w", dirname, err)
+			}
+
+		case dir == snapshotStoreDir && hdr.Typeflag == tar.TypeReg && rel != "":
+			if err := start(); err != nil {
+				return nil, err
+			}
+			filename := filepath.Join(dest, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(filename), 0770); err != nil {
+				return nil, fmt.Errorf("couldn't create directory %q: %w", filepath.Dir(filename), err)
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read %q: %w", hdr.Name, err)
+			}
+			if err := writeFile(filename, content); err != nil {
+				return nil, fmt.Errorf("couldn't restore %q: %w", filename, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("couldn't restore %q: unexpected file in snapshot", hdr.Name)
+		}
+	}
+	if err := start(); err != nil {
+		return nil, err
+	}
+	return extra, nil
+}
+
+// checkRestoreDest ensures that dest is a directory which a snapshot may be
+// restored into, or does not exist.
+func checkRestoreDest(dest string, force bool) error {
+	d, err := os.Open(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't open %q: %w", dest, err)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("couldn't read %q: %w", dest, err)
+	}
+	if len(names) > 0 && !force {
+		return fmt.Errorf("%w: %q", ErrNotEmpty, dest)
+	}
+	return nil
+}
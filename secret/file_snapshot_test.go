@@ -0,0 +1,147 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := newStore(dir, ".foo", fakeCrypter{}, nil)
+	for e, content := range map[string]string{"/a": "alpha", "/dir/b": "beta", "/dir/sub/c": "gamma"} {
+		if err := store.Put(e, content); err != nil {
+			t.Fatalf("Could not put %q: %v", e, err)
+		}
+	}
+	if err := store.EnsureDir("/empty/"); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gopass_tmp_123"), []byte("orphan"), 0600); err != nil {
+		t.Fatalf("Could not write temporary file: %v", err)
+	}
+	counters := SnapshotFile{Name: "counters", Content: []byte("counter data")}
+
+	// Snapshots are deterministic.
+	var snap, again bytes.Buffer
+	if err := Snapshot(&snap, dir, counters); err != nil {
+		t.Fatalf("Could not snapshot: %v", err)
+	}
+	if err := Snapshot(&again, dir, counters); err != nil {
+		t.Fatalf("Could not snapshot again: %v", err)
+	}
+	if !bytes.Equal(snap.Bytes(), again.Bytes()) {
+		t.Errorf("Snapshots of unchanged store differ")
+	}
+	if bytes.Contains(snap.Bytes(), []byte("orphan")) {
+		t.Errorf("Snapshot contains orphaned temporary file")
+	}
+
+	// A restored snapshot holds the same entries & extra files.
+	dest, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dest)
+	extra, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), dest, false, nil)
+	if err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	if len(extra) != 1 || extra[0].Name != "counters" || string(extra[0].Content) != "counter data" {
+		t.Errorf("RestoreSnapshot returned extra files %+v, want [%+v]", extra, counters)
+	}
+	restored := newStore(dest, ".foo", fakeCrypter{}, nil)
+	if entries, err := restored.List(); err != nil || fmt.Sprint(entries) != "[/a /dir/b /dir/sub/c]" {
+		t.Errorf("List after restore = (%q, %v), want [/a /dir/b /dir/sub/c]", entries, err)
+	}
+	if content, err := restored.Get("/dir/sub/c"); err != nil || content != "gamma" {
+		t.Errorf("Get after restore = (%q, %v), want (%q, nil)", content, err, "gamma")
+	}
+	if _, subdirs, err := restored.ListDir("/"); err != nil || fmt.Sprint(subdirs) != "[/dir /empty]" {
+		t.Errorf("ListDir after restore returned subdirectories (%q, %v), want [/dir /empty]", subdirs, err)
+	}
+
+	// Restoring over a non-empty destination requires force.
+	if err := store.Put("/a", "changed"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if _, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), dir, false, nil); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("RestoreSnapshot to non-empty directory returned error %v, want %v", err, ErrNotEmpty)
+	}
+	if content, err := store.Get("/a"); err != nil || content != "changed" {
+		t.Errorf("Get after refused restore = (%q, %v), want (%q, nil)", content, err, "changed")
+	}
+	// A failed check restores nothing, even with force, and doesn't create
+	// a nonexistent destination.
+	errCheck := errors.New("check")
+	var checked []SnapshotFile
+	check := func(extra []SnapshotFile) error {
+		checked = extra
+		return errCheck
+	}
+	if _, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), dir, true, check); !errors.Is(err, errCheck) {
+		t.Errorf("RestoreSnapshot with failing check returned error %v, want %v", err, errCheck)
+	}
+	if len(checked) != 1 || checked[0].Name != "counters" {
+		t.Errorf("RestoreSnapshot checked extra files %+v, want [%+v]", checked, counters)
+	}
+	if content, err := store.Get("/a"); err != nil || content != "changed" {
+		t.Errorf("Get after failed check = (%q, %v), want (%q, nil)", content, err, "changed")
+	}
+	missing := filepath.Join(dest, "missing")
+	if _, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), missing, false, check); !errors.Is(err, errCheck) {
+		t.Errorf("RestoreSnapshot with failing check returned error %v, want %v", err, errCheck)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("RestoreSnapshot with failing check created destination (stat error %v)", err)
+	}
+
+	if _, err := RestoreSnapshot(bytes.NewReader(snap.Bytes()), dir, true, nil); err != nil {
+		t.Fatalf("Could not force restore: %v", err)
+	}
+	if content, err := store.Get("/a"); err != nil || content != "alpha" {
+		t.Errorf("Get after forced restore = (%q, %v), want (%q, nil)", content, err, "alpha")
+	}
+}
+
+func TestRestoreSnapshotInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"store/../escape.foo", "/abs.foo", "other/file", "extra/dir/file"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: 1, Mode: 0600}); err != nil {
+			t.Fatalf("Could not write header: %v", err)
+		}
+		if _, err := tw.Write([]byte("x")); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Could not close archive: %v", err)
+		}
+
+		dest, err := getDir()
+		if err != nil {
+			t.Fatalf("Could not get temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dest)
+		if _, err := RestoreSnapshot(&buf, dest, false, nil); err == nil {
+			t.Errorf("RestoreSnapshot of %q unexpectedly succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(dest), "escape.foo")); err == nil {
+			t.Errorf("RestoreSnapshot of %q wrote outside of the destination", name)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// storeFiles are the names of files which may appear anywhere in a store's
+// directory tree without being entries: the markers kept by EnsureDir, and
+// the recipient lists kept by `pass`.
+var storeFiles = []string{keepFile, ".gpg-id"}
+
+// Stats helps to implement secret.StatsStore. Only the metadata of the files
+// in the store's directory tree is read, so stats are cheap to gather even for
+// large stores. Previous versions & trashed entries are not counted, and a
+// git repository holding the store is ignored.
+func (s *store) Stats() (secret.StoreStats, error) {
+	var st secret.StoreStats
+	dirs := map[string]*secret.DirStats{}
+	deepest := -1
+	if err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && path == s.baseDir && os.IsNotExist(inErr):
+			return nil
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+		}
+		rel, err := filepath.Rel(s.baseDir, path)
+		if err != nil {
+			return fmt.Errorf("couldn't get relative path of %q: %w", path, err)
+		}
+		name := "/" + filepath.ToSlash(rel)
+
+		switch {
+		case info.IsDir():
+			if filepath.Dir(path) == s.baseDir && (isReservedDir(info.Name()) || info.Name() == ".git") {
+				return filepath.SkipDir
+			}
+
+		case strings.HasSuffix(path, s.extension):
+			entry := strings.TrimSuffix(name, s.extension)
+			st.Entries++
+			st.Size += info.Size()
+			if mt := info.ModTime(); st.Oldest.IsZero() || mt.Before(st.Oldest) {
+				st.Oldest = mt
+			}
+			if mt := info.ModTime(); mt.After(st.Newest) {
+				st.Newest = mt
+			}
+			if d := strings.Count(entry, "/"); d > deepest {
+				st.DeepestEntry, deepest = entry, d
+			}
+			for i := strings.Index(entry, "/"); i != -1; i = nextSlash(entry, i) {
+				dir := entry[:i+1]
+				ds, ok := dirs[dir]
+				if !ok {
+					ds = &secret.DirStats{Dir: dir}
+					dirs[dir] = ds
+				}
+				ds.Entries++
+				ds.Size += info.Size()
+				if mt := info.ModTime(); mt.After(ds.Newest) {
+					ds.Newest = mt
+				}
+			}
+
+		case !s.isStoreFile(path, info):
+			st.Orphans = append(st.Orphans, name)
+		}
+		return nil
+	}); err != nil {
+		return secret.StoreStats{}, err
+	}
+
+	for _, ds := range dirs {
+		st.Dirs = append(st.Dirs, *ds)
+	}
+	sort.Slice(st.Dirs, func(i, j int) bool { return st.Dirs[i].Dir < st.Dirs[j].Dir })
+	sort.Strings(st.Orphans)
+	return st, nil
+}
+
+// nextSlash returns the index of the first slash in s after index i, or -1 if
+// there is none.
+func nextSlash(s string, i int) int {
+	j := strings.Index(s[i+1:], "/")
+	if j == -1 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// isStoreFile determines if the given file, which is not an entry, is used by
+// the store (or by tools sharing its directory, such as `pass` & git).
+func (s *store) isStoreFile(path string, info os.FileInfo) bool {
+	name := info.Name()
+	for _, fn := range storeFiles {
+		if name == fn {
+			return true
+		}
+	}
+	if filepath.Dir(path) == s.baseDir && (name == manifestFile || strings.HasPrefix(name, ".git")) {
+		return true
+	}
+
+	// An entry's attachments are only orphaned once the entry is gone.
+	if strings.HasSuffix(name, s.extension+attachmentsSuffix) {
+		_, err := os.Lstat(strings.TrimSuffix(path, attachmentsSuffix))
+		return err == nil
+	}
+	return false
+}
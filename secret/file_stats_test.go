@@ -0,0 +1,90 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeCrypter{}, WithTrash(time.Hour), WithVersions(2))
+	ss, ok := secret.AsStatsStore(store)
+	if !ok {
+		t.Fatalf("Store does not implement secret.StatsStore")
+	}
+	if st, err := ss.Stats(); err != nil || st.Entries != 0 || len(st.Dirs) != 0 || len(st.Orphans) != 0 {
+		t.Errorf("Stats of empty store returned (%+v, %v), want no entries", st, err)
+	}
+
+	// Entries are counted, including their size & modification time;
+	// previous versions & trashed entries are not.
+	for _, e := range []string{"/a", "/dir/b", "/dir/sub/c", "/deleted"} {
+		if err := store.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put %q: %v", e, err)
+		}
+	}
+	if err := store.Put("/a", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Delete("/deleted"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	old, new := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	for fn, mt := range map[string]time.Time{"a.foo": old, "dir/b.foo": new, "dir/sub/c.foo": old} {
+		if err := os.Chtimes(filepath.Join(dir, fn), mt, mt); err != nil {
+			t.Fatalf("Could not set modification time: %v", err)
+		}
+	}
+
+	// Files which are not entries are orphans, unless used by the store.
+	eds, _ := secret.AsEmptyDirStore(store)
+	if err := eds.EnsureDir("/empty/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+	for _, fn := range []string{".gpg-id", "dir/.gopass_tmp_123", "dir/notes.txt", ".git/config"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, fn)), 0700); err != nil {
+			t.Fatalf("Could not create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0600); err != nil {
+			t.Fatalf("Could not write %q: %v", fn, err)
+		}
+	}
+
+	st, err := ss.Stats()
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	aSize, size := int64(len("ENCRYPTED:new content")), int64(len("ENCRYPTED:content"))
+	if st.Entries != 3 || st.Size != aSize+2*size {
+		t.Errorf("Stats reported %d entries of %d bytes, want 3 entries of %d bytes", st.Entries, st.Size, aSize+2*size)
+	}
+	if st.DeepestEntry != "/dir/sub/c" {
+		t.Errorf("Stats reported deepest entry %q, want %q", st.DeepestEntry, "/dir/sub/c")
+	}
+	if !st.Oldest.Equal(old) || !st.Newest.Equal(new) {
+		t.Errorf("Stats reported modification times from %v to %v, want %v to %v", st.Oldest, st.Newest, old, new)
+	}
+	var dirs []string
+	for _, ds := range st.Dirs {
+		dirs = append(dirs, fmt.Sprintf("%s:%d:%d", ds.Dir, ds.Entries, ds.Size))
+	}
+	if want := fmt.Sprintf("[/:3:%d /dir/:2:%d /dir/sub/:1:%d]", aSize+2*size, 2*size, size); fmt.Sprint(dirs) != want {
+		t.Errorf("Stats reported directories %v, want %v", dirs, want)
+	}
+	if want := "[/dir/.gopass_tmp_123 /dir/notes.txt]"; fmt.Sprint(st.Orphans) != want {
+		t.Errorf("Stats reported orphans %q, want %v", st.Orphans, want)
+	}
+}
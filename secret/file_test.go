@@ -7,7 +7,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
 )
 
 func TestGetPutDelete(t *testing.T) {
@@ -58,6 +62,601 @@ func TestGetPutDelete(t *testing.T) {
 	}
 }
 
+func TestPutIf(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := NewStore(dir, ".foo", fakeAttachmentCrypter{}, WithVersions(2)).(secret.ConditionalStore)
+	if !ok {
+		t.Fatalf("Store does not implement secret.ConditionalStore")
+	}
+	putIf := func(content, expectedHash, wantContent string, wantErr error) {
+		t.Helper()
+		if err := store.PutIf("/entry", content, expectedHash); !errors.Is(err, wantErr) {
+			t.Errorf("PutIf(%q, %q) returned error %v, want %v", content, expectedHash, err, wantErr)
+		}
+		if got, err := store.Get("/entry"); err != nil || got != wantContent {
+			t.Errorf("After PutIf(%q, %q), Get returned (%q, %v), want %q", content, expectedHash, got, err, wantContent)
+		}
+	}
+
+	// An empty hash requires that the entry not exist; otherwise, the hash must match.
+	putIf("content", "", "content", nil)
+	putIf("other content", "", "content", secret.ErrConflict)
+	putIf("other content", secret.ContentHash("stale content"), "content", secret.ErrConflict)
+	putIf("new content", secret.ContentHash("content"), "new content", nil)
+	if err := store.Delete("/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if err := store.PutIf("/entry", "content", secret.ContentHash("new content")); !errors.Is(err, secret.ErrConflict) {
+		t.Errorf("PutIf of deleted entry returned error %v, want %v", err, secret.ErrConflict)
+	}
+
+	// Of concurrent updates based on the same content, exactly one succeeds.
+	if err := store.Put("/entry", "base"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	const updates = 20
+	errs := make(chan error, updates)
+	for i := 0; i < updates; i++ {
+		go func(i int) { errs <- store.PutIf("/entry", fmt.Sprintf("update %d", i), secret.ContentHash("base")) }(i)
+	}
+	succeeded := 0
+	for i := 0; i < updates; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, secret.ErrConflict):
+			t.Errorf("Concurrent PutIf returned unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d concurrent updates succeeded, want 1", succeeded)
+	}
+}
+
+func TestMove(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeCrypter{})
+	if err := store.Put("/path/to/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Put("/other", "other content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Basic tests.
+	if err := store.Move("/path/to/entry", "/new/path/to/entry"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if content, err := store.Get("/path/to/entry"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Fatalf("Unexpected result getting moved entry: %q, %v", content, err)
+	}
+	content, err := store.Get("/new/path/to/entry")
+	if err != nil {
+		t.Fatalf("Could not get: %v", err)
+	}
+	if content != "content" {
+		t.Fatalf("Content was unexpected: %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "path")); !os.IsNotExist(err) {
+		t.Fatalf("Empty source directory was not cleaned up: %v", err)
+	}
+
+	// Error tests.
+	if err := store.Move("/nonexistent", "/somewhere"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Fatalf("Unexpected error moving nonexistent entry: %v", err)
+	}
+	if err := store.Move("/new/path/to/entry", "/other"); !errors.Is(err, secret.ErrEntryExists) {
+		t.Fatalf("Unexpected error moving onto existing entry: %v", err)
+	}
+	if content, err := store.Get("/other"); err != nil || content != "other content" {
+		t.Fatalf("Existing entry was modified: %q, %v", content, err)
+	}
+	if err := store.Move("/new/path/to/entry", "../outside"); err == nil {
+		t.Fatalf("Could move entry out of store")
+	}
+
+	// A move never replaces an entry written concurrently: an entry written
+	// while the move waits (as by a concurrent Put) is found by its check.
+	if err := store.Put("/race/src", "moved"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	dstFilename := filepath.Join(dir, "race", "dst.foo")
+	putMu.Lock()
+	moveErr := make(chan error, 1)
+	go func() { moveErr <- store.Move("/race/src", "/race/dst") }()
+	select {
+	case err := <-moveErr:
+		putMu.Unlock()
+		t.Fatalf("Move returned %v while entries were being written, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := writeFile(dstFilename, []byte("ENCRYPTED:put")); err != nil {
+		putMu.Unlock()
+		t.Fatalf("Could not write entry: %v", err)
+	}
+	putMu.Unlock()
+	if err := <-moveErr; !errors.Is(err, secret.ErrEntryExists) {
+		t.Errorf("Move onto concurrently-written entry returned error %v, want %v", err, secret.ErrEntryExists)
+	}
+	if content, err := store.Get("/race/dst"); err != nil || content != "put" {
+		t.Errorf("Concurrently-written entry was modified: %q, %v", content, err)
+	}
+}
+
+func TestListDir(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeCrypter{}, WithVersions(1), WithTrash(time.Hour))
+	ds, ok := secret.AsDirStore(store)
+	if !ok {
+		t.Fatalf("Store does not implement secret.DirStore")
+	}
+
+	// A nonexistent directory is empty.
+	if entries, subdirs, err := ds.ListDir("/"); err != nil || len(entries) != 0 || len(subdirs) != 0 {
+		t.Fatalf("ListDir of empty store = (%q, %q, %v), want no entries or subdirectories", entries, subdirs, err)
+	}
+
+	for _, e := range []string{"/a", "/b", "/dir/c", "/dir/sub/d", "/deleted"} {
+		if err := store.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	if err := store.Put("/a", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Delete("/deleted"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+
+	for _, test := range []struct {
+		dir                   string
+		wantEntries, wantDirs []string
+	}{
+		{"/", []string{"/a", "/b"}, []string{"/dir"}},
+		{"/dir/", []string{"/dir/c"}, []string{"/dir/sub"}},
+		{"/dir/sub/", []string{"/dir/sub/d"}, nil},
+		{"/nonexistent/", nil, nil},
+	} {
+		entries, subdirs, err := ds.ListDir(test.dir)
+		if err != nil {
+			t.Errorf("Could not list %q: %v", test.dir, err)
+			continue
+		}
+		if fmt.Sprint(entries) != fmt.Sprint(test.wantEntries) || fmt.Sprint(subdirs) != fmt.Sprint(test.wantDirs) {
+			t.Errorf("ListDir(%q) = (%q, %q), want (%q, %q)", test.dir, entries, subdirs, test.wantEntries, test.wantDirs)
+		}
+	}
+
+	// Paths outside of the store can't be listed.
+	for _, d := range []string{"/../", "dir/", "/dir"} {
+		if _, _, err := ds.ListDir(d); err == nil {
+			t.Errorf("ListDir(%q) unexpectedly succeeded", d)
+		}
+	}
+}
+
+func TestEnsureDir(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeCrypter{}, WithTrash(time.Hour))
+	eds, ok := secret.AsEmptyDirStore(store)
+	if !ok {
+		t.Fatalf("Store does not implement secret.EmptyDirStore")
+	}
+	ds, _ := secret.AsDirStore(store)
+
+	// An ensured directory is listed, and survives deletion of its last entry.
+	if err := eds.EnsureDir("/empty/sub/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+	if err := eds.EnsureDir("/empty/sub/"); err != nil {
+		t.Fatalf("Could not ensure existing directory: %v", err)
+	}
+	if err := store.Put("/empty/sub/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Delete("/empty/sub/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if _, subdirs, err := ds.ListDir("/empty/"); err != nil || fmt.Sprint(subdirs) != "[/empty/sub]" {
+		t.Errorf("ListDir(/empty/) returned (%q, %v), want subdirectory /empty/sub", subdirs, err)
+	}
+	if entries, subdirs, err := ds.ListDir("/empty/sub/"); err != nil || len(entries) != 0 || len(subdirs) != 0 {
+		t.Errorf("ListDir(/empty/sub/) returned (%q, %q, %v), want nothing", entries, subdirs, err)
+	}
+	if entries, err := store.List(); err != nil || len(entries) != 0 {
+		t.Errorf("List returned (%q, %v), want no entries", entries, err)
+	}
+
+	// Directories outside of the store, or in its internal directories, can't be created.
+	for _, d := range []string{"/../outside/", "/a/../../outside/", "/.trash/", "/.versions/x/", "dir/", "/dir"} {
+		if err := eds.EnsureDir(d); err == nil {
+			t.Errorf("EnsureDir(%q) unexpectedly succeeded", d)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "outside")); !os.IsNotExist(err) {
+		t.Errorf("EnsureDir created a directory outside of the store: %v", err)
+	}
+}
+
+func TestDeleteTree(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := NewStore(dir, ".foo", fakeAttachmentCrypter{}, WithVersions(1), WithTrash(time.Hour)).(secret.TreeStore)
+	if !ok {
+		t.Fatalf("Store does not implement secret.TreeStore")
+	}
+	for _, e := range []string{"/a", "/dir/b", "/dir/sub/c", "/dir/sub/deeper/d", "/dirt/e"} {
+		if err := store.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	if err := store.Put("/dir/b", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	as, _ := secret.AsAttachmentStore(store)
+	if err := as.PutAttachment("/dir/sub/c", "codes.txt", []byte("codes")); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+	eds, _ := secret.AsEmptyDirStore(store)
+	if err := eds.EnsureDir("/dir/empty/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+
+	// The whole subtree is deleted, but a sibling sharing its name as a prefix is not.
+	n, err := store.DeleteTree("/dir/")
+	if err != nil {
+		t.Fatalf("Could not delete tree: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("DeleteTree deleted %d entries, want 3", n)
+	}
+	if entries, err := store.List(); err != nil || fmt.Sprint(entries) != "[/a /dirt/e]" {
+		t.Errorf("List returned (%q, %v), want [/a /dirt/e]", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("Deleted directory was not removed: %v", err)
+	}
+
+	// Deleted entries are in the trash, and can be restored with their attachments.
+	ts, _ := secret.AsTrashStore(store)
+	trashed, err := ts.ListTrash()
+	if err != nil {
+		t.Fatalf("Could not list trash: %v", err)
+	}
+	if len(trashed) != 3 {
+		t.Errorf("ListTrash returned %d entries, want 3", len(trashed))
+	}
+	if err := ts.Restore("/dir/sub/c"); err != nil {
+		t.Fatalf("Could not restore: %v", err)
+	}
+	if atts, err := as.ListAttachments("/dir/sub/c"); err != nil || fmt.Sprint(atts) != "[codes.txt]" {
+		t.Errorf("ListAttachments of restored entry returned (%q, %v), want [codes.txt]", atts, err)
+	}
+
+	// Deleting a directory holding no entries, other than the root, succeeds.
+	if err := eds.EnsureDir("/empty/sub/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+	if n, err := store.DeleteTree("/empty/"); err != nil || n != 0 {
+		t.Errorf("DeleteTree of empty directory = (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty")); !os.IsNotExist(err) {
+		t.Errorf("Deleted empty directory was not removed: %v", err)
+	}
+
+	// Error tests.
+	for _, test := range []struct {
+		prefix  string
+		wantErr error
+	}{
+		{"/nonexistent/", secret.ErrNoEntry},
+		{"/dirt/e/", secret.ErrNoEntry},
+		{"/", secret.ErrInvalidEntryName},
+		{"/dirt", secret.ErrInvalidEntryName},
+		{"dirt/", secret.ErrInvalidEntryName},
+		{"/dirt/../", secret.ErrInvalidEntryName},
+		{"/../", secret.ErrInvalidEntryName},
+		{"/.trash/", secret.ErrInvalidEntryName},
+		{"/.versions/", secret.ErrInvalidEntryName},
+	} {
+		if n, err := store.DeleteTree(test.prefix); n != 0 || !errors.Is(err, test.wantErr) {
+			t.Errorf("DeleteTree(%q) = (%d, %v), want error %v", test.prefix, n, err, test.wantErr)
+		}
+	}
+	if entries, err := store.List(); err != nil || fmt.Sprint(entries) != "[/a /dir/sub/c /dirt/e]" {
+		t.Errorf("List returned (%q, %v), want [/a /dir/sub/c /dirt/e]", entries, err)
+	}
+}
+
+func TestMoveTree(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := NewStore(dir, ".foo", fakeAttachmentCrypter{}, WithVersions(1)).(secret.TreeStore)
+	if !ok {
+		t.Fatalf("Store does not implement secret.TreeStore")
+	}
+	for _, e := range []string{"/a", "/dir/b", "/dir/sub/c", "/dir/sub/deeper/d", "/dirt/e", "/other/sub/c"} {
+		if err := store.Put(e, "content of "+e); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	if err := store.Put("/dir/b", "new content of /dir/b"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	as, _ := secret.AsAttachmentStore(store)
+	if err := as.PutAttachment("/dir/sub/c", "codes.txt", []byte("codes")); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+	eds, _ := secret.AsEmptyDirStore(store)
+	if err := eds.EnsureDir("/dir/empty/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+	list := func(want string) {
+		t.Helper()
+		if entries, err := store.List(); err != nil || fmt.Sprint(entries) != want {
+			t.Errorf("List returned (%q, %v), want %s", entries, err, want)
+		}
+	}
+
+	// A collision at the destination prevents any entries from moving.
+	n, err := store.MoveTree("/dir/", "/other/")
+	if n != 0 || !errors.Is(err, secret.ErrEntryExists) {
+		t.Errorf("MoveTree onto existing entry = (%d, %v), want error %v", n, err, secret.ErrEntryExists)
+	}
+	if err != nil && !strings.Contains(err.Error(), "/other/sub/c") {
+		t.Errorf("MoveTree error %q does not name the colliding entry", err)
+	}
+	list("[/a /dir/b /dir/sub/c /dir/sub/deeper/d /dirt/e /other/sub/c]")
+
+	// The whole subtree moves, with attachments, previous versions & empty directories.
+	if n, err := store.MoveTree("/dir/", "/new/place/"); err != nil || n != 3 {
+		t.Fatalf("MoveTree = (%d, %v), want (3, nil)", n, err)
+	}
+	list("[/a /dirt/e /new/place/b /new/place/sub/c /new/place/sub/deeper/d /other/sub/c]")
+	if content, err := store.Get("/new/place/sub/deeper/d"); err != nil || content != "content of /dir/sub/deeper/d" {
+		t.Errorf("Get of moved entry returned (%q, %v)", content, err)
+	}
+	if atts, err := as.ListAttachments("/new/place/sub/c"); err != nil || fmt.Sprint(atts) != "[codes.txt]" {
+		t.Errorf("ListAttachments of moved entry returned (%q, %v), want [codes.txt]", atts, err)
+	}
+	vs, _ := secret.AsVersionedStore(store)
+	if versions, err := vs.Versions("/new/place/b"); err != nil || len(versions) != 1 {
+		t.Errorf("Versions of moved entry returned (%v, %v), want 1 version", versions, err)
+	}
+	ds, _ := secret.AsDirStore(store)
+	if _, subdirs, err := ds.ListDir("/new/place/"); err != nil || fmt.Sprint(subdirs) != "[/new/place/empty /new/place/sub]" {
+		t.Errorf("ListDir of moved directory returned (%q, %v), want [/new/place/empty /new/place/sub]", subdirs, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("Moved directory was not removed: %v", err)
+	}
+
+	// Entries may move up to an ancestor, including the root.
+	if n, err := store.MoveTree("/new/place/sub/", "/new/"); err != nil || n != 2 {
+		t.Errorf("MoveTree to ancestor = (%d, %v), want (2, nil)", n, err)
+	}
+	if n, err := store.MoveTree("/new/place/", "/"); err != nil || n != 1 {
+		t.Errorf("MoveTree to root = (%d, %v), want (1, nil)", n, err)
+	}
+	list("[/a /b /dirt/e /new/c /new/deeper/d /other/sub/c]")
+
+	// Error tests.
+	for _, test := range []struct {
+		oldPrefix, newPrefix string
+		wantErr              error
+	}{
+		{"/nonexistent/", "/x/", secret.ErrNoEntry},
+		{"/new/", "/new/", secret.ErrInvalidEntryName},
+		{"/new/", "/new/deeper/", secret.ErrInvalidEntryName},
+		{"/", "/x/", secret.ErrInvalidEntryName},
+		{"/new", "/x/", secret.ErrInvalidEntryName},
+		{"/new/", "/x", secret.ErrInvalidEntryName},
+		{"/new/", "/../x/", secret.ErrInvalidEntryName},
+		{"/new/", "/.trash/", secret.ErrInvalidEntryName},
+		{"/new/", "/.versions/x/", secret.ErrInvalidEntryName},
+	} {
+		if n, err := store.MoveTree(test.oldPrefix, test.newPrefix); n != 0 || !errors.Is(err, test.wantErr) {
+			t.Errorf("MoveTree(%q, %q) = (%d, %v), want error %v", test.oldPrefix, test.newPrefix, n, err, test.wantErr)
+		}
+	}
+
+	// A directory may move into a sibling sharing its name as a prefix.
+	if n, err := store.MoveTree("/new/", "/newer/"); err != nil || n != 2 {
+		t.Errorf("MoveTree to sibling = (%d, %v), want (2, nil)", n, err)
+	}
+	list("[/a /b /dirt/e /newer/c /newer/deeper/d /other/sub/c]")
+}
+
+func TestVersions(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewVersionedStore(dir, ".foo", fakeCrypter{}, 2)
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		if err := store.Put("/path/to/entry", content); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+
+	// Only the newest versions are kept, newest first.
+	versions, err := store.Versions("/path/to/entry")
+	if err != nil {
+		t.Fatalf("Could not get versions: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Got %d versions, want 2", len(versions))
+	}
+	for i, want := range []string{"v3", "v2"} {
+		content, err := store.GetVersion("/path/to/entry", versions[i].ID)
+		if err != nil {
+			t.Fatalf("Could not get version: %v", err)
+		}
+		if content != want {
+			t.Errorf("Version %d content was %q, want %q", i, content, want)
+		}
+	}
+	if content, err := store.GetVersion("/path/to/entry", "../../entry"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Unexpected result getting bogus version: %q, %v", content, err)
+	}
+
+	// Versions are not listed as entries.
+	entries, err := store.List()
+	if err != nil {
+		t.Fatalf("Could not list: %v", err)
+	}
+	if len(entries) != 1 || entries[0] != "/path/to/entry" {
+		t.Errorf("List returned %q, want [\"/path/to/entry\"]", entries)
+	}
+
+	// Versions follow moved entries, and are removed with deleted entries.
+	if err := store.Move("/path/to/entry", "/entry"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if versions, err := store.Versions("/entry"); err != nil || len(versions) != 2 {
+		t.Errorf("Unexpected versions after move: %v, %v", versions, err)
+	}
+	if err := store.Delete("/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, versionsDir)); !os.IsNotExist(err) {
+		t.Errorf("Version directory was not cleaned up: %v", err)
+	}
+
+	// Stores without versioning do not implement secret.VersionedStore.
+	if _, ok := NewStore(dir, ".foo", fakeCrypter{}).(secret.VersionedStore); ok {
+		t.Errorf("Unversioned store implements secret.VersionedStore")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := secret.AsTrashStore(NewStore(dir, ".foo", fakeCrypter{}, WithVersions(2), WithTrash(time.Hour)))
+	if !ok {
+		t.Fatalf("Store with trash does not implement secret.TrashStore")
+	}
+	if _, ok := secret.AsVersionedStore(store); !ok {
+		t.Errorf("Store with trash & versions does not implement secret.VersionedStore")
+	}
+
+	// Deleted entries are moved to the trash, and are not listed as entries.
+	for _, content := range []string{"v1", "v2"} {
+		if err := store.Put("/path/to/entry", content); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+		if err := store.Delete("/path/to/entry"); err != nil {
+			t.Fatalf("Could not delete: %v", err)
+		}
+	}
+	if entries, err := store.List(); err != nil || len(entries) != 0 {
+		t.Errorf("List after delete returned (%q, %v), want no entries", entries, err)
+	}
+	trashed, err := store.ListTrash()
+	if err != nil {
+		t.Fatalf("Could not list trash: %v", err)
+	}
+	if len(trashed) != 2 || trashed[0].Entry != "/path/to/entry" || trashed[1].Entry != "/path/to/entry" || trashed[0].Time.Before(trashed[1].Time) {
+		t.Errorf("ListTrash returned %v, want two copies of /path/to/entry, newest first", trashed)
+	}
+	if content, err := store.Get("/../.trash/path/to/entry.foo/" + trashed[0].Time.Format(versionTimeFormat)); err == nil {
+		t.Errorf("Could unexpectedly get trashed content directly: %q", content)
+	}
+
+	// Restoring an entry restores the most recently deleted copy.
+	if err := store.Restore("/path/to/entry"); err != nil {
+		t.Fatalf("Could not restore: %v", err)
+	}
+	if content, err := store.Get("/path/to/entry"); err != nil || content != "v2" {
+		t.Errorf("Get after restore returned (%q, %v), want %q", content, err, "v2")
+	}
+	if err := store.Restore("/path/to/entry"); !errors.Is(err, secret.ErrEntryExists) {
+		t.Errorf("Restore over existing entry returned error %v, want %v", err, secret.ErrEntryExists)
+	}
+	if err := store.Restore("/nonexistent"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Restore of nonexistent entry returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+
+	// Purging removes sufficiently old entries only.
+	if err := store.PurgeTrash(time.Hour); err != nil {
+		t.Fatalf("Could not purge trash: %v", err)
+	}
+	if trashed, err := store.ListTrash(); err != nil || len(trashed) != 1 {
+		t.Errorf("ListTrash after purging nothing returned (%v, %v), want one entry", trashed, err)
+	}
+	if err := store.PurgeTrash(0); err != nil {
+		t.Fatalf("Could not purge trash: %v", err)
+	}
+	if trashed, err := store.ListTrash(); err != nil || len(trashed) != 0 {
+		t.Errorf("ListTrash after purge returned (%v, %v), want no entries", trashed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, trashDir)); !os.IsNotExist(err) {
+		t.Errorf("Trash directory was not cleaned up: %v", err)
+	}
+
+	// Stores without a trash delete entries immediately.
+	plain := NewStore(dir, ".foo", fakeCrypter{})
+	if _, ok := secret.AsTrashStore(plain); ok {
+		t.Errorf("Store without trash implements secret.TrashStore")
+	}
+	if err := plain.Delete("/path/to/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, trashDir)); !os.IsNotExist(err) {
+		t.Errorf("Store without trash moved entry to trash: %v", err)
+	}
+}
+
 func TestDirectoryTraversal(t *testing.T) {
 	t.Parallel()
 
@@ -104,6 +703,12 @@ func TestDirectoryTraversal(t *testing.T) {
 	if _, err := innerStore.Get("../vault"); err == nil {
 		t.Fatalf("Could get content from outer with inner")
 	}
+	if err := outerStore.Put("/inner2/vault", "outer content in sibling of inner space"); err != nil {
+		t.Fatalf("Could not put content from outer to sibling of inner: %v", err)
+	}
+	if _, err := innerStore.Get("/../inner2/vault"); err == nil {
+		t.Fatalf("Could get content from sibling of inner with inner")
+	}
 
 	// Inner can delete inner but not outer; outer can delete both.
 	if err := innerStore.Delete("../vault"); err == nil {
@@ -118,6 +723,180 @@ func TestDirectoryTraversal(t *testing.T) {
 	if err := outerStore.Delete("/inner/vault2"); err != nil {
 		t.Fatalf("Could not delete content in inner from outer: %v", err)
 	}
+
+	// A sibling directory sharing the base directory's name as a prefix is
+	// not inside the store.
+	s := newStore(innerDir, ".foo", fakeCrypter{}, nil)
+	for _, test := range []struct {
+		filename string
+		want     bool
+	}{
+		{innerDir, true},
+		{filepath.Join(innerDir, "vault.foo"), true},
+		{filepath.Join(innerDir, "..vault.foo"), true},
+		{innerDir + "-evil", false},
+		{filepath.Join(innerDir+"-evil", "vault.foo"), false},
+		{dir, false},
+	} {
+		if got := s.contains(test.filename); got != test.want {
+			t.Errorf("contains(%q) = %v, want %v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestSymlinkTraversal(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	baseDir, outsideDir := filepath.Join(dir, "base"), filepath.Join(dir, "base-evil")
+	outsideStore := NewStore(outsideDir, ".foo", fakeCrypter{})
+	if err := outsideStore.Put("/vault", "outside content"); err != nil {
+		t.Fatalf("Could not put content outside of store: %v", err)
+	}
+	store := NewStore(baseDir, ".foo", fakeCrypter{})
+	if err := store.Put("/dir/vault", "inside content"); err != nil {
+		t.Fatalf("Could not put content in store: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(baseDir, "escape")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(baseDir, "dir"), filepath.Join(baseDir, "link")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outsideDir, "vault.foo"), filepath.Join(baseDir, "entry-link.foo")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+
+	// By default, symlinks are followed wherever they lead.
+	if _, err := store.Get("/escape/vault"); err != nil {
+		t.Errorf("Could not get content via symlink: %v", err)
+	}
+
+	// When resolving symlinks, only symlinks within the store are followed.
+	store = NewStore(baseDir, ".foo", fakeCrypter{}, WithResolveSymlinks(true))
+	if content, err := store.Get("/link/vault"); err != nil || content != "inside content" {
+		t.Errorf("Get via symlink within store returned (%q, %v), want %q", content, err, "inside content")
+	}
+	for _, e := range []string{"/escape/vault", "/entry-link"} {
+		if _, err := store.Get(e); !errors.Is(err, secret.ErrInvalidEntryName) {
+			t.Errorf("Get(%q) returned error %v, want %v", e, err, secret.ErrInvalidEntryName)
+		}
+	}
+	if err := store.Put("/escape/new/vault", "content"); !errors.Is(err, secret.ErrInvalidEntryName) {
+		t.Errorf("Put via escaping symlink returned error %v, want %v", err, secret.ErrInvalidEntryName)
+	}
+	if err := store.Delete("/escape/vault"); !errors.Is(err, secret.ErrInvalidEntryName) {
+		t.Errorf("Delete via escaping symlink returned error %v, want %v", err, secret.ErrInvalidEntryName)
+	}
+	if _, _, err := store.(secret.DirStore).ListDir("/escape/"); !errors.Is(err, secret.ErrInvalidEntryName) {
+		t.Errorf("ListDir via escaping symlink returned error %v, want %v", err, secret.ErrInvalidEntryName)
+	}
+	if content, err := outsideStore.Get("/vault"); err != nil || content != "outside content" {
+		t.Errorf("Content outside of store was modified: (%q, %v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(outsideDir, "new")); !os.IsNotExist(err) {
+		t.Errorf("Directory was created outside of store: %v", err)
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeCrypter{}, WithMaxEntrySize(8))
+
+	// The limit applies to plaintext: content of exactly the maximum size
+	// is accepted, even though its ciphertext is larger.
+	if err := store.Put("/entry", "12345678"); err != nil {
+		t.Fatalf("Could not put content of maximum size: %v", err)
+	}
+	if err := store.Put("/entry", "123456789"); !errors.Is(err, secret.ErrEntryTooLarge) {
+		t.Errorf("Put of oversized content: got %v, want %v", err, secret.ErrEntryTooLarge)
+	}
+	if content, err := store.Get("/entry"); err != nil || content != "12345678" {
+		t.Errorf("After oversized put, got (%q, %v), want (%q, nil)", content, err, "12345678")
+	}
+	if err := store.Put("/other", "123456789"); !errors.Is(err, secret.ErrEntryTooLarge) {
+		t.Errorf("Put of oversized new entry: got %v, want %v", err, secret.ErrEntryTooLarge)
+	}
+	if _, err := store.Get("/other"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Oversized new entry was created: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(dir, ".foo", fakeAttachmentCrypter{}, WithVersions(2), WithTrash(time.Hour))
+	vs, _ := secret.AsVersionedStore(store)
+	ts, _ := secret.AsTrashStore(store)
+	as, _ := secret.AsAttachmentStore(store)
+	eds, _ := secret.AsEmptyDirStore(store)
+	for _, e := range []string{"/entry", "/other"} {
+		if err := store.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		desc    string
+		f       func() error
+		wantErr error
+	}{
+		{"Get nonexistent", func() error { _, err := store.Get("/nonexistent"); return err }, secret.ErrNoEntry},
+		{"Get escaping", func() error { _, err := store.Get("/../escape"); return err }, secret.ErrInvalidEntryName},
+		{"Get empty", func() error { _, err := store.Get(""); return err }, secret.ErrInvalidEntryName},
+		{"Get trash", func() error { _, err := store.Get("/.trash/entry"); return err }, secret.ErrInvalidEntryName},
+		{"Put escaping", func() error { return store.Put("/../escape", "content") }, secret.ErrInvalidEntryName},
+		{"Delete nonexistent", func() error { return store.Delete("/nonexistent") }, secret.ErrNoEntry},
+		{"Delete escaping", func() error { return store.Delete("/../escape") }, secret.ErrInvalidEntryName},
+		{"Move nonexistent", func() error { return store.Move("/nonexistent", "/new") }, secret.ErrNoEntry},
+		{"Move onto existing", func() error { return store.Move("/entry", "/other") }, secret.ErrEntryExists},
+		{"Move escaping", func() error { return store.Move("/entry", "/../escape") }, secret.ErrInvalidEntryName},
+		{"GetVersion bad ID", func() error { _, err := vs.GetVersion("/entry", "../../entry"); return err }, secret.ErrNoEntry},
+		{"GetVersion nonexistent", func() error {
+			_, err := vs.GetVersion("/entry", time.Unix(0, 0).UTC().Format(versionTimeFormat))
+			return err
+		}, secret.ErrNoEntry},
+		{"Restore nonexistent", func() error { return ts.Restore("/nonexistent") }, secret.ErrNoEntry},
+		{"Restore escaping", func() error { return ts.Restore("/../escape") }, secret.ErrInvalidEntryName},
+		{"GetAttachment nonexistent", func() error { _, err := as.GetAttachment("/entry", "nonexistent"); return err }, secret.ErrNoEntry},
+		{"PutAttachment nonexistent entry", func() error { return as.PutAttachment("/nonexistent", "file", nil) }, secret.ErrNoEntry},
+		{"PutAttachment bad filename", func() error { return as.PutAttachment("/entry", "../file", nil) }, secret.ErrInvalidEntryName},
+		{"DeleteAttachment nonexistent", func() error { return as.DeleteAttachment("/entry", "nonexistent") }, secret.ErrNoEntry},
+		{"EnsureDir escaping", func() error { return eds.EnsureDir("/../escape/") }, secret.ErrInvalidEntryName},
+		{"EnsureDir trash", func() error { return eds.EnsureDir("/.trash/") }, secret.ErrInvalidEntryName},
+	} {
+		err := test.f()
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.desc, err, test.wantErr)
+		}
+		// Errors still match once wrapped further by callers.
+		if wrapped := fmt.Errorf("wrapped: %w", err); !errors.Is(wrapped, test.wantErr) {
+			t.Errorf("%s: wrapped error %v does not match %v", test.desc, wrapped, test.wantErr)
+		}
+	}
+
+	// Entries which were never stored successfully don't exist afterwards.
+	if entries, err := store.List(); err != nil || fmt.Sprint(entries) != "[/entry /other]" {
+		t.Errorf("List returned (%q, %v), want [/entry /other]", entries, err)
+	}
 }
 
 func getDir() (string, error) {
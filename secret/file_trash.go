@@ -0,0 +1,230 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// trashDir is the directory, relative to the base directory, holding deleted
+// entries. Each deleted entry is held in a directory named after the entry's
+// file, with one file per deletion named after the time of deletion, in the
+// same layout used for previous versions.
+const trashDir = ".trash"
+
+// WithTrash causes the store to move deleted entries to the trash rather than
+// removing them, keeping them for at least the given retention period. Trashed
+// entries older than the retention period are purged when the store is
+// created. Stores created with this option implement secret.TrashStore.
+func WithTrash(retention time.Duration) Option {
+	return func(s *store) {
+		s.trashRetention = retention
+	}
+}
+
+// trashStore implements secret.TrashStore, wrapping the store returned by
+// NewStore for stores that have a trash.
+type trashStore struct {
+	secret.Store
+	s *store
+}
+
+var _ secret.TrashStore = trashStore{}
+
+func (ts trashStore) Unwrap() secret.Store { return ts.Store }
+
+// PutIf helps to implement secret.ConditionalStore.
+func (ts trashStore) PutIf(entry, content, expectedHash string) error {
+	return ts.s.PutIf(entry, content, expectedHash)
+}
+
+// DeleteTree helps to implement secret.TreeStore.
+func (ts trashStore) DeleteTree(prefix string) (int, error) {
+	return ts.s.DeleteTree(prefix)
+}
+
+// MoveTree helps to implement secret.TreeStore.
+func (ts trashStore) MoveTree(oldPrefix, newPrefix string) (int, error) {
+	return ts.s.MoveTree(oldPrefix, newPrefix)
+}
+
+// Batch helps to implement secret.BatchStore.
+func (ts trashStore) Batch(f func(tx secret.Tx) error) error {
+	return ts.s.Batch(f)
+}
+
+// ResumeBatch helps to implement secret.BatchStore.
+func (ts trashStore) ResumeBatch() (int, error) {
+	return ts.s.ResumeBatch()
+}
+
+// ListTrash helps to implement secret.TrashStore.
+func (ts trashStore) ListTrash() ([]secret.TrashedEntry, error) {
+	var entries []secret.TrashedEntry
+	if err := ts.s.walkTrash(func(entry, fn string, t time.Time) error {
+		entries = append(entries, secret.TrashedEntry{Entry: entry, Time: t})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries, nil
+}
+
+// Restore helps to implement secret.TrashStore.
+func (ts trashStore) Restore(entry string) error {
+	entryFilename, err := ts.s.getEntryFilename(entry)
+	if err != nil {
+		return fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	tDir, err := ts.s.trashEntryDir(entryFilename)
+	if err != nil {
+		return err
+	}
+	ids, err := ts.s.versionIDs(tDir)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+	}
+	if _, err := os.Lstat(entryFilename); err == nil {
+		return fmt.Errorf("%w: %q", secret.ErrEntryExists, entry)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("couldn't stat %q: %w", entryFilename, err)
+	}
+
+	entryDir := filepath.Dir(entryFilename)
+	if err := os.MkdirAll(entryDir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", entryDir, err)
+	}
+	tFilename := filepath.Join(tDir, ids[len(ids)-1]+ts.s.extension)
+	if err := os.Rename(tFilename, entryFilename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tFilename, entryFilename, err)
+	}
+	if err := renameIfExists(tFilename+attachmentsSuffix, entryFilename+attachmentsSuffix); err != nil {
+		return err
+	}
+	if err := ts.s.updateManifest(entryFilename, entryFilename+attachmentsSuffix); err != nil {
+		return err
+	}
+	return ts.s.removeEmptyDirs(tDir)
+}
+
+// PurgeTrash helps to implement secret.TrashStore.
+func (ts trashStore) PurgeTrash(olderThan time.Duration) error {
+	return ts.s.purgeTrash(olderThan)
+}
+
+// trashEntryDir returns the directory holding deleted copies of the entry
+// stored in the given file.
+func (s *store) trashEntryDir(entryFilename string) (string, error) {
+	rel, err := filepath.Rel(s.baseDir, entryFilename)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get relative path of %q: %w", entryFilename, err)
+	}
+	return filepath.Join(s.baseDir, trashDir, rel), nil
+}
+
+// moveToTrash moves the entry stored in the given file to the trash. It
+// returns secret.ErrNoEntry if the entry does not exist.
+func (s *store) moveToTrash(entryFilename string) error {
+	if _, err := os.Lstat(entryFilename); err != nil {
+		if os.IsNotExist(err) {
+			return secret.ErrNoEntry
+		}
+		return fmt.Errorf("couldn't stat %q: %w", entryFilename, err)
+	}
+	tDir, err := s.trashEntryDir(entryFilename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tDir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", tDir, err)
+	}
+	// Ensure we do not clobber an existing deleted copy, in case of coarse clocks.
+	t := time.Now().UTC()
+	tFilename := filepath.Join(tDir, t.Format(versionTimeFormat)+s.extension)
+	for {
+		if _, err := os.Lstat(tFilename); os.IsNotExist(err) {
+			break
+		}
+		t = t.Add(time.Nanosecond)
+		tFilename = filepath.Join(tDir, t.Format(versionTimeFormat)+s.extension)
+	}
+	if err := os.Rename(entryFilename, tFilename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", entryFilename, tFilename, err)
+	}
+	return renameIfExists(entryFilename+attachmentsSuffix, tFilename+attachmentsSuffix)
+}
+
+// purgeTrash permanently removes entries which were moved to the trash longer
+// ago than the given duration.
+func (s *store) purgeTrash(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	return s.walkTrash(func(entry, fn string, t time.Time) error {
+		if !t.Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(fn); err != nil {
+			return fmt.Errorf("couldn't delete %q: %w", fn, err)
+		}
+		if err := removeIfExists(fn + attachmentsSuffix); err != nil {
+			return err
+		}
+		return s.removeEmptyDirs(filepath.Dir(fn))
+	})
+}
+
+// walkTrash calls f for each deleted copy of an entry in the trash, with the
+// entry's name, the name of the file holding the deleted copy, and the time of
+// deletion.
+func (s *store) walkTrash(f func(entry, filename string, t time.Time) error) error {
+	tBase := filepath.Join(s.baseDir, trashDir)
+	type deleted struct {
+		entry, fn string
+		t         time.Time
+	}
+	var ds []deleted
+	if err := filepath.Walk(tBase, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && os.IsNotExist(inErr) && path == tBase:
+			return filepath.SkipDir
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+		case info.IsDir() || !strings.HasSuffix(path, s.extension):
+			return nil
+		}
+
+		// Deleted copies are held in a directory named after the entry's file.
+		dir := filepath.Dir(path)
+		if !strings.HasSuffix(dir, s.extension) {
+			return nil
+		}
+		t, err := time.Parse(versionTimeFormat, strings.TrimSuffix(filepath.Base(path), s.extension))
+		if err != nil {
+			return nil
+		}
+		entry, err := filepath.Rel(tBase, strings.TrimSuffix(dir, s.extension))
+		if err != nil {
+			return fmt.Errorf("couldn't get relative path of %q: %w", path, err)
+		}
+		ds = append(ds, deleted{"/" + filepath.ToSlash(entry), path, t})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Call f after walking, since f may modify the trash.
+	for _, d := range ds {
+		if err := f(d.entry, d.fn, d.t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// DeleteTree helps to implement secret.TreeStore. Entries are deleted one at a
+// time, as by Delete, so that their attachments & previous versions are
+// deleted with them, and they are moved to the trash if the store has one.
+// Once its entries are deleted, the directory is removed, along with any empty
+// subdirectories kept by EnsureDir.
+func (s *store) DeleteTree(prefix string) (int, error) {
+	if err := secret.CheckTreePrefix(prefix); err != nil {
+		return 0, err
+	}
+	dirname, err := s.getTreeDirname(prefix)
+	if err != nil {
+		return 0, err
+	}
+	entries, err := s.treeEntries(prefix, dirname)
+	if err != nil {
+		return 0, err
+	}
+	var done []string
+	for _, e := range entries {
+		if err := s.Delete(e); err != nil {
+			return len(done), &secret.TreeError{Done: done, Err: err}
+		}
+		done = append(done, e)
+	}
+	if err := s.removeTree(dirname); err != nil {
+		return len(done), &secret.TreeError{Done: done, Err: err}
+	}
+	return len(done), nil
+}
+
+// MoveTree helps to implement secret.TreeStore. Entries are moved one at a
+// time, as by Move, after checking that none of the destination entries
+// exist. The check is not atomic with the moves, but each move refuses to
+// replace an entry written since, so MoveTree may stop partway through but
+// never overwrites an entry. Empty subdirectories kept by EnsureDir are kept
+// at their new location.
+func (s *store) MoveTree(oldPrefix, newPrefix string) (int, error) {
+	if err := secret.CheckTreeMove(oldPrefix, newPrefix); err != nil {
+		return 0, err
+	}
+	oldDirname, err := s.getTreeDirname(oldPrefix)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.getTreeDirname(newPrefix); err != nil && newPrefix != "/" {
+		return 0, err
+	}
+	entries, err := s.treeEntries(oldPrefix, oldDirname)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check every destination before moving anything, so that a collision
+	// does not leave the directory half-moved.
+	var collisions []string
+	for _, e := range entries {
+		ne := newPrefix + strings.TrimPrefix(e, oldPrefix)
+		fn, err := s.getEntryFilename(ne)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't get entry filename for %q: %w", ne, err)
+		}
+		if _, err := os.Lstat(fn); err == nil {
+			collisions = append(collisions, ne)
+		} else if !os.IsNotExist(err) {
+			return 0, fmt.Errorf("couldn't stat %q: %w", fn, err)
+		}
+	}
+	if len(collisions) > 0 {
+		return 0, fmt.Errorf("%w: %q", secret.ErrEntryExists, collisions)
+	}
+
+	var done []string
+	for _, e := range entries {
+		if err := s.Move(e, newPrefix+strings.TrimPrefix(e, oldPrefix)); err != nil {
+			return len(done), &secret.TreeError{Done: done, Err: err}
+		}
+		done = append(done, e)
+	}
+	if err := s.moveKeptDirs(oldDirname, newPrefix); err != nil {
+		return len(done), &secret.TreeError{Done: done, Err: err}
+	}
+	if err := s.removeTree(oldDirname); err != nil {
+		return len(done), &secret.TreeError{Done: done, Err: err}
+	}
+	return len(done), nil
+}
+
+// getTreeDirname returns the name of the directory holding the given store
+// directory, which must not be the base directory or lie within the
+// previous-versions or trash directories.
+func (s *store) getTreeDirname(dir string) (string, error) {
+	dirname, err := s.getDirname(dir)
+	if err != nil {
+		return "", err
+	}
+	if dirname == s.baseDir {
+		return "", fmt.Errorf("%w: directory %q", secret.ErrInvalidEntryName, dir)
+	}
+	if s.inReservedDir(dirname) {
+		return "", fmt.Errorf("%w: directory %q", secret.ErrInvalidEntryName, dir)
+	}
+	return dirname, nil
+}
+
+// treeEntries returns the entries beneath the given store directory, held in
+// the given directory, in sorted order. It returns secret.ErrNoEntry if the
+// directory does not exist.
+func (s *store) treeEntries(dir, dirname string) ([]string, error) {
+	if _, err := os.Stat(dirname); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: directory %q", secret.ErrNoEntry, dir)
+		}
+		return nil, fmt.Errorf("couldn't stat %q: %w", dirname, err)
+	}
+	var entries []string
+	if err := filepath.Walk(dirname, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+
+		case !info.IsDir() && strings.HasSuffix(path, s.extension):
+			rel, err := filepath.Rel(dirname, strings.TrimSuffix(path, s.extension))
+			if err != nil {
+				return fmt.Errorf("couldn't get relative path of %q: %w", path, err)
+			}
+			entries = append(entries, dir+filepath.ToSlash(rel))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// moveKeptDirs keeps (via EnsureDir) the counterpart beneath the store
+// directory newDir of each directory beneath dirname which is kept by
+// EnsureDir.
+func (s *store) moveKeptDirs(dirname, newDir string) error {
+	var dirs []string
+	if err := filepath.Walk(dirname, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && path == dirname && os.IsNotExist(inErr):
+			return nil
+
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+
+		case !info.IsDir() && info.Name() == keepFile:
+			rel, err := filepath.Rel(dirname, filepath.Dir(path))
+			if err != nil {
+				return fmt.Errorf("couldn't get relative path of %q: %w", path, err)
+			}
+			if rel == "." {
+				dirs = append(dirs, newDir)
+			} else {
+				dirs = append(dirs, newDir+filepath.ToSlash(rel)+"/")
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := s.EnsureDir(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTree removes the markers kept by EnsureDir beneath the given
+// directory, then removes it & each of its subdirectories which are empty,
+// as well as any parent directories left empty. Directories still holding
+// files are left in place.
+func (s *store) removeTree(dirname string) error {
+	var dirs []string
+	if err := filepath.Walk(dirname, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && path == dirname && os.IsNotExist(inErr):
+			return nil
+
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+
+		case info.IsDir():
+			dirs = append(dirs, path)
+
+		case info.Name() == keepFile:
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("couldn't delete %q: %w", path, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Walk visits parents before their children, so visit the directories
+	// in reverse to remove children first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if _, err := os.Stat(dirs[i]); os.IsNotExist(err) {
+			continue
+		}
+		if err := s.removeEmptyDirs(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
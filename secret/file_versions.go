@@ -0,0 +1,213 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+const (
+	// versionsDir is the directory, relative to the base directory, holding
+	// previous versions of entries. Each entry's previous versions are held
+	// in a directory named after the entry's file, with one file per
+	// version named after the time that version was replaced.
+	versionsDir       = ".versions"
+	versionTimeFormat = "20060102T150405.000000000Z"
+)
+
+// WithVersions causes the store to keep up to keep previous versions of each
+// entry, which are saved whenever an entry is updated via Put. Stores created
+// with this option implement secret.VersionedStore.
+func WithVersions(keep int) Option {
+	return func(s *store) {
+		s.keepVersions = keep
+	}
+}
+
+// NewVersionedStore creates a new secret.VersionedStore, which is a store as
+// created by NewStore that keeps up to keepVersions previous versions of each
+// entry.
+func NewVersionedStore(baseDir, extension string, crypter Crypter, keepVersions int) secret.VersionedStore {
+	return versionedStore{newStore(baseDir, extension, crypter, []Option{WithVersions(keepVersions)})}
+}
+
+// versionedStore implements secret.VersionedStore.
+type versionedStore struct {
+	*store
+}
+
+// Versions helps to implement secret.VersionedStore.
+func (vs versionedStore) Versions(entry string) ([]secret.Version, error) {
+	entryFilename, err := vs.getEntryFilename(entry)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	vDir, err := vs.versionDir(entryFilename)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := vs.versionIDs(vDir)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]secret.Version, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		t, err := time.Parse(versionTimeFormat, ids[i])
+		if err != nil {
+			continue
+		}
+		versions = append(versions, secret.Version{ID: ids[i], Time: t})
+	}
+	return versions, nil
+}
+
+// GetVersion helps to implement secret.VersionedStore.
+func (vs versionedStore) GetVersion(entry, id string) (string, error) {
+	if _, err := time.Parse(versionTimeFormat, id); err != nil {
+		return "", fmt.Errorf("%w: version %q of %q", secret.ErrNoEntry, id, entry)
+	}
+	entryFilename, err := vs.getEntryFilename(entry)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	vDir, err := vs.versionDir(entryFilename)
+	if err != nil {
+		return "", err
+	}
+	vFilename := filepath.Join(vDir, id+vs.extension)
+	ciphertext, err := ioutil.ReadFile(vFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: version %q of %q", secret.ErrNoEntry, id, entry)
+		}
+		return "", fmt.Errorf("couldn't read %q: %w", vFilename, err)
+	}
+	content, err := vs.crypter.Decrypt(entry, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt: %w", err)
+	}
+	return content, nil
+}
+
+// versionDir returns the directory holding previous versions of the entry
+// stored in the given file.
+func (s *store) versionDir(entryFilename string) (string, error) {
+	rel, err := filepath.Rel(s.baseDir, entryFilename)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get relative path of %q: %w", entryFilename, err)
+	}
+	return filepath.Join(s.baseDir, versionsDir, rel), nil
+}
+
+// versionIDs returns the IDs of the versions stored in the given version
+// directory, oldest first.
+func (s *store) versionIDs(vDir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(vDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't read directory %q: %w", vDir, err)
+	}
+	var ids []string
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), s.extension) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(fi.Name(), s.extension))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// saveVersion saves the current content of the entry stored in the given file
+// as a previous version, then prunes old versions. It does nothing if the
+// entry does not currently exist.
+func (s *store) saveVersion(entryFilename string) error {
+	ciphertext, err := ioutil.ReadFile(entryFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("couldn't read %q: %w", entryFilename, err)
+	}
+	vDir, err := s.versionDir(entryFilename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vDir, 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", vDir, err)
+	}
+	// Ensure we do not clobber an existing version, in case of coarse clocks.
+	t := time.Now().UTC()
+	vFilename := filepath.Join(vDir, t.Format(versionTimeFormat)+s.extension)
+	for {
+		if _, err := os.Lstat(vFilename); os.IsNotExist(err) {
+			break
+		}
+		t = t.Add(time.Nanosecond)
+		vFilename = filepath.Join(vDir, t.Format(versionTimeFormat)+s.extension)
+	}
+	if err := ioutil.WriteFile(vFilename, ciphertext, 0660); err != nil {
+		return fmt.Errorf("couldn't write %q: %w", vFilename, err)
+	}
+
+	// Prune versions beyond the number we are keeping.
+	ids, err := s.versionIDs(vDir)
+	if err != nil {
+		return err
+	}
+	for len(ids) > s.keepVersions {
+		fn := filepath.Join(vDir, ids[0]+s.extension)
+		if err := os.Remove(fn); err != nil {
+			return fmt.Errorf("couldn't delete %q: %w", fn, err)
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// deleteVersions deletes all previous versions of the entry stored in the
+// given file.
+func (s *store) deleteVersions(entryFilename string) error {
+	vDir, err := s.versionDir(entryFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(vDir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.RemoveAll(vDir); err != nil {
+		return fmt.Errorf("couldn't delete %q: %w", vDir, err)
+	}
+	return s.removeEmptyDirs(filepath.Dir(vDir))
+}
+
+// moveVersions moves all previous versions of the entry stored in the given
+// file so that they are associated with the entry stored in the new file.
+func (s *store) moveVersions(oldFilename, newFilename string) error {
+	oldVDir, err := s.versionDir(oldFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldVDir); os.IsNotExist(err) {
+		return nil
+	}
+	newVDir, err := s.versionDir(newFilename)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newVDir), 0770); err != nil {
+		return fmt.Errorf("couldn't create directory %q: %w", filepath.Dir(newVDir), err)
+	}
+	if err := os.Rename(oldVDir, newVDir); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", oldVDir, newVDir, err)
+	}
+	return s.removeEmptyDirs(filepath.Dir(oldVDir))
+}
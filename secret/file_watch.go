@@ -0,0 +1,182 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+// Stat helps to implement secret.StatStore. The modification time & size of
+// the entry's file are reported, so changes made by other tools are reflected.
+func (s *store) Stat(entry string) (secret.EntryInfo, error) {
+	entryFilename, err := s.getEntryFilename(entry)
+	if err != nil {
+		return secret.EntryInfo{}, fmt.Errorf("couldn't get entry filename for %q: %w", entry, err)
+	}
+	fi, err := os.Stat(entryFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secret.EntryInfo{}, fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+		}
+		return secret.EntryInfo{}, fmt.Errorf("couldn't stat %q: %w", entryFilename, err)
+	}
+	if fi.IsDir() {
+		return secret.EntryInfo{}, fmt.Errorf("%w: %q", secret.ErrNoEntry, entry)
+	}
+	return secret.EntryInfo{ModTime: fi.ModTime(), Size: fi.Size()}, nil
+}
+
+// Watch helps to implement secret.WatchStore. Changes are noticed via
+// filesystem notifications on every directory beneath the base directory;
+// directories created after Watch is called are watched as they appear, and
+// any entries already within them are reported as put.
+func (s *store) Watch(ctx context.Context) (<-chan secret.Change, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create watcher: %w", err)
+	}
+	if _, err := s.watchTree(w, s.baseDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	changes := make(chan secret.Change)
+	go func() {
+		defer close(changes)
+		defer w.Close()
+		for {
+			var cs []secret.Change
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				cs = s.changesFor(w, ev)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Could not watch %q: %v", s.baseDir, err)
+			}
+			for _, c := range cs {
+				select {
+				case changes <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// changesFor determines the changes to entries indicated by the given
+// filesystem event, updating the watched directories as needed.
+func (s *store) changesFor(w *fsnotify.Watcher, ev fsnotify.Event) []secret.Change {
+	if s.inReservedDir(ev.Name) {
+		return nil
+	}
+	isEntry := strings.HasSuffix(ev.Name, s.extension)
+	switch {
+	case ev.Has(fsnotify.Create):
+		fi, err := os.Lstat(ev.Name)
+		if err != nil {
+			// Already removed; its removal will be reported separately.
+			return nil
+		}
+		if fi.IsDir() {
+			entries, err := s.watchTree(w, ev.Name)
+			if err != nil {
+				log.Printf("Could not watch new directory %q: %v", ev.Name, err)
+			}
+			var cs []secret.Change
+			for _, e := range entries {
+				cs = append(cs, secret.Change{Entry: e, Op: secret.ChangePut})
+			}
+			return cs
+		}
+		if isEntry {
+			return []secret.Change{{Entry: s.entryName(ev.Name), Op: secret.ChangePut}}
+		}
+
+	case ev.Has(fsnotify.Write):
+		if isEntry {
+			return []secret.Change{{Entry: s.entryName(ev.Name), Op: secret.ChangePut}}
+		}
+
+	case ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename):
+		if isEntry {
+			return []secret.Change{{Entry: s.entryName(ev.Name), Op: secret.ChangeDelete}}
+		}
+		if s.unwatchTree(w, ev.Name) && ev.Name != s.baseDir {
+			return []secret.Change{{Entry: s.entryName(ev.Name) + "/", Op: secret.ChangeDelete}}
+		}
+	}
+	return nil
+}
+
+// watchTree watches dir and every directory beneath it, other than the
+// previous-versions & trash directories. It returns the names of the entries
+// found within the newly-watched directories.
+func (s *store) watchTree(w *fsnotify.Watcher, dir string) ([]string, error) {
+	var entries []string
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, inErr error) error {
+		switch {
+		case inErr != nil && os.IsNotExist(inErr) && path != dir:
+			// Removed while walking; its removal will be reported separately.
+			return nil
+		case inErr != nil:
+			return fmt.Errorf("couldn't walk %q: %w", path, inErr)
+
+		case info.IsDir() && s.inReservedDir(path):
+			return filepath.SkipDir
+
+		case info.IsDir():
+			if err := w.Add(path); err != nil {
+				return fmt.Errorf("couldn't watch %q: %w", path, err)
+			}
+
+		case strings.HasSuffix(path, s.extension):
+			entries = append(entries, s.entryName(path))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// unwatchTree stops watching dir and every directory beneath it, e.g. because
+// dir was removed or moved away. It returns true if dir was being watched.
+func (s *store) unwatchTree(w *fsnotify.Watcher, dir string) bool {
+	watched := false
+	for _, p := range w.WatchList() {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			watched = true
+			// The watch may already have been removed along with the directory.
+			w.Remove(p)
+		}
+	}
+	return watched
+}
+
+// entryName returns the name of the entry stored in the given file, which
+// must be beneath the base directory. Given a directory, it returns the name
+// of the directory, without a trailing slash.
+func (s *store) entryName(filename string) string {
+	rel, err := filepath.Rel(s.baseDir, strings.TrimSuffix(filename, s.extension))
+	if err != nil {
+		// Can't happen: every watched filename is beneath the base directory.
+		return filename
+	}
+	return "/" + filepath.ToSlash(rel)
+}
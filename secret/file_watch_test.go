@@ -0,0 +1,143 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestStat(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := secret.AsStatStore(NewStore(dir, ".foo", fakeCrypter{}, WithTrash(time.Hour)))
+	if !ok {
+		t.Fatalf("Store does not implement secret.StatStore")
+	}
+	if err := store.Put("/dir/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// The modification time & size of the entry's file are reported.
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "dir", "entry.foo"), modTime, modTime); err != nil {
+		t.Fatalf("Could not set modification time: %v", err)
+	}
+	if info, err := store.Stat("/dir/entry"); err != nil || !info.ModTime.Equal(modTime) || info.Size != int64(len("ENCRYPTED:content")) {
+		t.Errorf("Stat returned (%v, %v), want modification time %v & size %d", info, err, modTime, len("ENCRYPTED:content"))
+	}
+
+	// Nonexistent entries & directories are not entries.
+	for _, e := range []string{"/nonexistent", "/dir"} {
+		if _, err := store.Stat(e); !errors.Is(err, secret.ErrNoEntry) {
+			t.Errorf("Stat(%q) returned error %v, want %v", e, err, secret.ErrNoEntry)
+		}
+	}
+	if _, err := store.Stat("/../escape"); !errors.Is(err, secret.ErrInvalidEntryName) {
+		t.Errorf("Stat of escaping entry returned error %v, want %v", err, secret.ErrInvalidEntryName)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := getDir()
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, ok := secret.AsWatchStore(NewStore(dir, ".foo", fakeCrypter{}, WithTrash(time.Hour), WithVersions(1)))
+	if !ok {
+		t.Fatalf("Store does not implement secret.WatchStore")
+	}
+	if _, err := store.Watch(context.Background()); err == nil {
+		t.Errorf("Watch of nonexistent directory unexpectedly succeeded")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := store.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Could not watch: %v", err)
+	}
+
+	// Changes made through the store are reported.
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	waitForChange(t, changes, secret.Change{Entry: "/entry", Op: secret.ChangePut})
+
+	// Entries within directories created after Watch was called are
+	// reported, as are later changes within those directories.
+	if err := store.Put("/new/dir/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	waitForChange(t, changes, secret.Change{Entry: "/new/dir/entry", Op: secret.ChangePut})
+	if err := store.Put("/new/dir/other", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	waitForChange(t, changes, secret.Change{Entry: "/new/dir/other", Op: secret.ChangePut})
+	if err := store.Delete("/new/dir/other"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	waitForChange(t, changes, secret.Change{Entry: "/new/dir/other", Op: secret.ChangeDelete})
+
+	// Changes made by other means are reported too.
+	if err := ioutil.WriteFile(filepath.Join(dir, "external.foo"), []byte("ENCRYPTED:content"), 0600); err != nil {
+		t.Fatalf("Could not write entry: %v", err)
+	}
+	waitForChange(t, changes, secret.Change{Entry: "/external", Op: secret.ChangePut})
+	if err := os.Rename(filepath.Join(dir, "new"), dir+".moved"); err != nil {
+		t.Fatalf("Could not move directory: %v", err)
+	}
+	defer os.RemoveAll(dir + ".moved")
+	waitForChange(t, changes, secret.Change{Entry: "/new/", Op: secret.ChangeDelete})
+
+	// Canceling the watch closes the channel.
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Channel was not closed after canceling watch")
+		}
+	}
+}
+
+// waitForChange waits for the given change to be reported on changes, ignoring
+// any other changes reported first.
+func waitForChange(t *testing.T, changes <-chan secret.Change, want secret.Change) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				t.Fatalf("Channel closed while waiting for change %+v", want)
+			}
+			if c == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for change %+v", want)
+		}
+	}
+}
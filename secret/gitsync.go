@@ -0,0 +1,336 @@
+// Package gitsync provides a secret.Store wrapper which commits changes to a
+// git repository, compatible with pass's git integration.
+package gitsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+// ErrConflict is returned by Sync if local changes conflict with changes
+// pulled from the remote repository. The local repository is left as it was
+// before the sync was attempted.
+var ErrConflict = errors.New("conflicting changes in remote repository")
+
+const defaultAuthor = "Harpocrates <harpocrates@localhost>"
+
+// Store is a secret.Store which commits each change to a git repository, and
+// can be synchronized with a remote repository. Changes made via the
+// TrashStore, EmptyDirStore & AttachmentStore found beneath a Store by
+// secret.AsTrashStore and friends are committed, too.
+type Store interface {
+	secret.Store
+
+	// Sync pulls changes from the remote repository (rebasing local
+	// changes on top of them), then pushes local changes to the remote
+	// repository. If local changes conflict with remote changes,
+	// ErrConflict is returned.
+	Sync() error
+}
+
+// NewVault wraps the given vault, whose data is stored in dir, such that
+// stores opened from the vault commit each change to the git repository in
+// dir. Changes are committed with the given author (in "Name <email>" form;
+// if empty, a default author is used), and synced with the given remote. If
+// dir is not a git repository, stores are returned unwrapped.
+func NewVault(v secret.Vault, dir, remote, author string) (secret.Vault, error) {
+	if author == "" {
+		author = defaultAuthor
+	}
+	addr, err := mail.ParseAddress(author)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse author %q: %w", author, err)
+	}
+	return &vault{
+		v:           v,
+		dir:         filepath.Clean(dir),
+		remote:      remote,
+		authorName:  addr.Name,
+		authorEmail: addr.Address,
+	}, nil
+}
+
+// vault implements secret.ExternalSecretVault.
+type vault struct {
+	v                       secret.Vault
+	dir, remote             string
+	authorName, authorEmail string
+}
+
+var _ secret.ExternalSecretVault = (*vault)(nil)
+
+func (v *vault) Unlock(passphrase string) (secret.Store, error) {
+	return v.UnlockWith(passphrase, nil)
+}
+
+// UnlockWith helps to implement secret.ExternalSecretVault, passing the
+// external secret to the wrapped vault.
+func (v *vault) UnlockWith(passphrase string, extra []byte) (secret.Store, error) {
+	s, err := secret.UnlockWith(v.v, passphrase, extra)
+	if err != nil {
+		return nil, err
+	}
+	gs := &store{s: s, v: v}
+	if !gs.isRepo() {
+		log.Printf("%q is not a git repository; not committing changes", v.dir)
+		return s, nil
+	}
+	return gs, nil
+}
+
+// UnlockAsyncWith helps to implement secret.ExternalSecretVault.
+func (v *vault) UnlockAsyncWith(passphrase string, extra []byte) (secret.UnlockHandle, error) {
+	return secret.StartUnlock(func() (secret.Store, error) { return v.UnlockWith(passphrase, extra) }, nil), nil
+}
+
+// store implements Store.
+type store struct {
+	s secret.Store
+	v *vault
+
+	mu sync.Mutex // serializes modifications & git operations
+}
+
+func (gs *store) List() ([]string, error)          { return gs.s.List() }
+func (gs *store) Get(entry string) (string, error) { return gs.s.Get(entry) }
+func (gs *store) Unwrap() secret.Store             { return gs.s }
+
+func (gs *store) Put(entry, content string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := gs.s.Put(entry, content); err != nil {
+		return err
+	}
+	return gs.commit(fmt.Sprintf("Edit password for %s using harpocrates.", strings.TrimPrefix(entry, "/")))
+}
+
+func (gs *store) PutIf(entry, content, expectedHash string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := secret.PutIf(gs.s, entry, content, expectedHash); err != nil {
+		return err
+	}
+	return gs.commit(fmt.Sprintf("Edit password for %s using harpocrates.", strings.TrimPrefix(entry, "/")))
+}
+
+func (gs *store) Delete(entry string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := gs.s.Delete(entry); err != nil {
+		return err
+	}
+	return gs.commit(fmt.Sprintf("Remove %s from store.", strings.TrimPrefix(entry, "/")))
+}
+
+func (gs *store) Move(oldEntry, newEntry string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := gs.s.Move(oldEntry, newEntry); err != nil {
+		return err
+	}
+	return gs.commit(fmt.Sprintf("Rename %s to %s.", strings.TrimPrefix(oldEntry, "/"), strings.TrimPrefix(newEntry, "/")))
+}
+
+func (gs *store) WrapTrash(ts secret.TrashStore) secret.TrashStore {
+	return &trashStore{gs, ts}
+}
+
+func (gs *store) WrapEmptyDir(eds secret.EmptyDirStore) secret.EmptyDirStore {
+	return &emptyDirStore{gs, eds}
+}
+
+func (gs *store) WrapAttachments(as secret.AttachmentStore) secret.AttachmentStore {
+	return &attachmentStore{gs, as}
+}
+
+// trashStore commits entries restored from the trash. The trash itself is
+// not committed (see commit), so purging it needs no commit.
+type trashStore struct {
+	*store
+	ts secret.TrashStore
+}
+
+func (gts *trashStore) ListTrash() ([]secret.TrashedEntry, error) { return gts.ts.ListTrash() }
+
+func (gts *trashStore) Restore(entry string) error {
+	gts.mu.Lock()
+	defer gts.mu.Unlock()
+	if err := gts.ts.Restore(entry); err != nil {
+		return err
+	}
+	return gts.commit(fmt.Sprintf("Restore %s from trash.", strings.TrimPrefix(entry, "/")))
+}
+
+func (gts *trashStore) PurgeTrash(olderThan time.Duration) error {
+	return gts.ts.PurgeTrash(olderThan)
+}
+
+type emptyDirStore struct {
+	*store
+	eds secret.EmptyDirStore
+}
+
+func (geds *emptyDirStore) EnsureDir(dir string) error {
+	geds.mu.Lock()
+	defer geds.mu.Unlock()
+	if err := geds.eds.EnsureDir(dir); err != nil {
+		return err
+	}
+	return geds.commit(fmt.Sprintf("Create directory %s.", strings.Trim(dir, "/")))
+}
+
+type attachmentStore struct {
+	*store
+	as secret.AttachmentStore
+}
+
+func (gas *attachmentStore) ListAttachments(entry string) ([]string, error) {
+	return gas.as.ListAttachments(entry)
+}
+
+func (gas *attachmentStore) GetAttachment(entry, filename string) ([]byte, error) {
+	return gas.as.GetAttachment(entry, filename)
+}
+
+func (gas *attachmentStore) PutAttachment(entry, filename string, content []byte) error {
+	gas.mu.Lock()
+	defer gas.mu.Unlock()
+	if err := gas.as.PutAttachment(entry, filename, content); err != nil {
+		return err
+	}
+	return gas.commit(fmt.Sprintf("Add attachment %s to %s.", filename, strings.TrimPrefix(entry, "/")))
+}
+
+func (gas *attachmentStore) DeleteAttachment(entry, filename string) error {
+	gas.mu.Lock()
+	defer gas.mu.Unlock()
+	if err := gas.as.DeleteAttachment(entry, filename); err != nil {
+		return err
+	}
+	return gas.commit(fmt.Sprintf("Remove attachment %s from %s.", filename, strings.TrimPrefix(entry, "/")))
+}
+
+func (gs *store) Sync() error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	// Commit any stray changes first, so that the rebase starts from a
+	// clean working tree.
+	if err := gs.commit("Commit outstanding changes before sync."); err != nil {
+		return err
+	}
+	branch, err := gs.git("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return fmt.Errorf("couldn't determine current branch: %w", err)
+	}
+	// A remote without the branch (e.g. a new, empty repository) has
+	// nothing to pull.
+	remoteRef, err := gs.git("ls-remote", "--heads", gs.v.remote, branch)
+	if err != nil {
+		return fmt.Errorf("couldn't list remote branches: %w", err)
+	}
+	if remoteRef != "" {
+		if _, err := gs.git("pull", "--rebase", gs.v.remote, branch); err != nil {
+			// If the rebase stopped partway through, put things back the way they were.
+			if gs.rebaseInProgress() {
+				if _, abortErr := gs.git("rebase", "--abort"); abortErr != nil {
+					return fmt.Errorf("couldn't abort rebase after failed pull (%v): %w", err, abortErr)
+				}
+				return ErrConflict
+			}
+			return fmt.Errorf("couldn't pull: %w", err)
+		}
+	}
+	if _, err := gs.git("push", gs.v.remote, branch); err != nil {
+		return fmt.Errorf("couldn't push: %w", err)
+	}
+	return nil
+}
+
+// isRepo determines if the store's directory is the top level of a git
+// repository.
+func (gs *store) isRepo() bool {
+	top, err := gs.git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return false
+	}
+	top, err = filepath.EvalSymlinks(top)
+	if err != nil {
+		return false
+	}
+	dir, err := filepath.EvalSymlinks(gs.v.dir)
+	if err != nil {
+		return false
+	}
+	return top == dir
+}
+
+// rebaseInProgress determines if a rebase has been stopped partway through.
+func (gs *store) rebaseInProgress() bool {
+	for _, p := range []string{"rebase-merge", "rebase-apply"} {
+		fn, err := gs.git("rev-parse", "--git-path", p)
+		if err != nil {
+			continue
+		}
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(gs.v.dir, fn)
+		}
+		if _, err := os.Stat(fn); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// commit commits all changes in the repository (other than those in the
+// store's reserved directories, such as previous entry versions and trashed
+// entries) with the given message. If there are no changes, it does nothing.
+// gs.mu must be held.
+func (gs *store) commit(msg string) error {
+	args := []string{"add", "--all", "--", "."}
+	for _, d := range file.ReservedDirs() {
+		args = append(args, ":(exclude)"+d)
+	}
+	if _, err := gs.git(args...); err != nil {
+		return fmt.Errorf("couldn't add changes: %w", err)
+	}
+	if _, err := gs.git("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	if _, err := gs.git("commit", "--quiet", "-m", msg); err != nil {
+		return fmt.Errorf("couldn't commit: %w", err)
+	}
+	return nil
+}
+
+// git runs git with the given arguments in the repository directory,
+// returning its trimmed standard output.
+func (gs *store) git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = gs.v.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+gs.v.authorName,
+		"GIT_AUTHOR_EMAIL="+gs.v.authorEmail,
+		"GIT_COMMITTER_NAME="+gs.v.authorName,
+		"GIT_COMMITTER_EMAIL="+gs.v.authorEmail,
+		"GIT_TERMINAL_PROMPT=0",
+	)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w (%s)", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,254 @@
+package gitsync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestCommit(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	gitCmd(t, dir, "init", "--quiet")
+	store := unlock(t, dir)
+	if _, ok := store.(Store); !ok {
+		t.Fatalf("Store in git repository was not a git-synced store")
+	}
+
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Move("/entry", "/dir/entry"); err != nil {
+		t.Fatalf("Could not move: %v", err)
+	}
+	if err := store.Delete("/dir/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	got := gitCmd(t, dir, "log", "--format=%s")
+	want := "Remove dir/entry from store.\nRename entry to dir/entry.\nEdit password for entry using harpocrates."
+	if got != want {
+		t.Errorf("Commit log was %q, want %q", got, want)
+	}
+	if status := gitCmd(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("Working tree was not clean: %q", status)
+	}
+}
+
+func TestCommitOptionalChanges(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	gitCmd(t, dir, "init", "--quiet")
+	store := unlockStore(t, dir, file.NewStore(dir, ".foo", fakeAttachmentCrypter{}, file.WithTrash(time.Hour)))
+	ts, ok := secret.AsTrashStore(store)
+	if !ok {
+		t.Fatalf("Store is not a TrashStore")
+	}
+	as, ok := secret.AsAttachmentStore(store)
+	if !ok {
+		t.Fatalf("Store is not an AttachmentStore")
+	}
+	eds, ok := secret.AsEmptyDirStore(store)
+	if !ok {
+		t.Fatalf("Store is not an EmptyDirStore")
+	}
+
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := as.PutAttachment("/entry", "file", []byte("attachment")); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+	if err := as.DeleteAttachment("/entry", "file"); err != nil {
+		t.Fatalf("Could not delete attachment: %v", err)
+	}
+	if err := store.Delete("/entry"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	if err := ts.Restore("/entry"); err != nil {
+		t.Fatalf("Could not restore: %v", err)
+	}
+	if err := eds.EnsureDir("/dir/"); err != nil {
+		t.Fatalf("Could not ensure directory: %v", err)
+	}
+	if err := ts.PurgeTrash(0); err != nil {
+		t.Fatalf("Could not purge trash: %v", err)
+	}
+	got := gitCmd(t, dir, "log", "--format=%s")
+	want := "Create directory dir.\nRestore entry from trash.\nRemove entry from store.\nRemove attachment file from entry.\nAdd attachment file to entry.\nEdit password for entry using harpocrates."
+	if got != want {
+		t.Errorf("Commit log was %q, want %q", got, want)
+	}
+	if status := gitCmd(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("Working tree was not clean: %q", status)
+	}
+}
+
+func TestCommitExcludesReservedDirs(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	gitCmd(t, dir, "init", "--quiet")
+	store := unlock(t, dir)
+	for _, d := range file.ReservedDirs() {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatalf("Could not create %q: %v", d, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, d, "file"), []byte("content"), 0600); err != nil {
+			t.Fatalf("Could not write file in %q: %v", d, err)
+		}
+	}
+
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if got, want := gitCmd(t, dir, "ls-files"), "entry.foo"; got != want {
+		t.Errorf("Committed files were %q, want %q", got, want)
+	}
+}
+
+func TestNotRepo(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, ok := unlock(t, dir).(Store); ok {
+		t.Errorf("Store outside of git repository was unexpectedly a git-synced store")
+	}
+}
+
+func TestSyncConflict(t *testing.T) {
+	t.Parallel()
+	requireGit(t)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	remote, local, other := filepath.Join(dir, "remote"), filepath.Join(dir, "local"), filepath.Join(dir, "other")
+	gitCmd(t, dir, "init", "--quiet", "--bare", remote)
+	gitCmd(t, dir, "clone", "--quiet", remote, local)
+
+	// Populate the remote from the local store.
+	store := unlock(t, local).(Store)
+	if err := store.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Could not sync: %v", err)
+	}
+
+	// Make conflicting changes in another clone & the local store.
+	gitCmd(t, dir, "clone", "--quiet", remote, other)
+	otherStore := unlock(t, other).(Store)
+	if err := otherStore.Put("/entry", "other content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	if err := otherStore.Sync(); err != nil {
+		t.Fatalf("Could not sync other store: %v", err)
+	}
+	if err := store.Put("/entry", "local content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	head := gitCmd(t, local, "rev-parse", "HEAD")
+
+	if err := store.Sync(); err != ErrConflict {
+		t.Fatalf("Sync returned %v, want %v", err, ErrConflict)
+	}
+	if got := gitCmd(t, local, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD after failed sync was %q, want %q", got, head)
+	}
+	if status := gitCmd(t, local, "status", "--porcelain"); status != "" {
+		t.Errorf("Working tree was not clean: %q", status)
+	}
+	if content, err := store.Get("/entry"); err != nil || content != "local content" {
+		t.Errorf("Get after failed sync returned (%q, %v), want %q", content, err, "local content")
+	}
+}
+
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "harpocrates_gitsync_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	return dir
+}
+
+func unlock(t *testing.T, dir string) secret.Store {
+	t.Helper()
+	return unlockStore(t, dir, file.NewStore(dir, ".foo", fakeCrypter{}))
+}
+
+// unlockStore returns the given store, stored in dir, wrapped as by a vault
+// from NewVault.
+func unlockStore(t *testing.T, dir string, s secret.Store) secret.Store {
+	t.Helper()
+	v, err := NewVault(fakeVault{s}, dir, "origin", "")
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	gs, err := v.Unlock("")
+	if err != nil {
+		t.Fatalf("Could not unlock: %v", err)
+	}
+	return gs
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Could not run git %s: %v (%s)", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+type fakeVault struct{ s secret.Store }
+
+func (v fakeVault) Unlock(string) (secret.Store, error) { return v.s, nil }
+
+type fakeCrypter struct{}
+
+func (fakeCrypter) Encrypt(entryName, content string) ([]byte, error) { return []byte(content), nil }
+func (fakeCrypter) Decrypt(entryName string, ciphertext []byte) (string, error) {
+	return string(ciphertext), nil
+}
+
+type fakeAttachmentCrypter struct{ fakeCrypter }
+
+func (fakeAttachmentCrypter) EncryptAttachments(entryName string, attachments map[string][]byte) ([]byte, error) {
+	return json.Marshal(attachments)
+}
+
+func (fakeAttachmentCrypter) DecryptAttachments(entryName string, ciphertext []byte) (map[string][]byte, error) {
+	var atts map[string][]byte
+	if err := json.Unmarshal(ciphertext, &atts); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
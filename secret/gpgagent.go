@@ -0,0 +1,207 @@
+// Package gpgagent provides a vault which delegates encryption & decryption to
+// gpg, so that the private key may be held by gpg-agent (and possibly a
+// hardware token, such as a smartcard) rather than by harpocrates. Entries are
+// stored in the same format as the pgp package, compatible with `pass`.
+package gpgagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+	"github.com/BranLwyd/harpocrates/secret/key_private"
+
+	pb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+// challenge is encrypted & decrypted when unlocking a vault, to check that the
+// agent can service the key.
+const challenge = "harpocrates gpg-agent challenge"
+
+// passphraseErrors are substrings of gpg error output indicating that the key
+// could not be used because the user failed to provide a passphrase or PIN,
+// e.g. because pinentry was cancelled.
+var passphraseErrors = []string{
+	"Bad passphrase",
+	"Bad PIN",
+	"Operation cancelled",
+	"No pinentry",
+	"Timeout",
+}
+
+func init() {
+	key_private.RegisterVaultFromKeyFunc(func(location string, key *pb.Key, params key_private.VaultParams) (secret.Vault, error) {
+		if k := key.GetGpgAgentKey(); k != nil {
+			return newVault(location, k, params)
+		}
+		return nil, nil
+	})
+	key_private.RegisterRewrapFunc(func(key *pb.Key, _, _ string, _ key_private.RewrapParams) (*pb.Key, error) {
+		if key.GetGpgAgentKey() != nil {
+			return nil, errors.New("gpg-agent keys cannot be rewrapped; change the passphrase of the key with gpg instead")
+		}
+		return nil, nil
+	})
+	key_private.RegisterFingerprintFunc(func(key *pb.Key, _ string, _ []byte) (string, string, error) {
+		if k := key.GetGpgAgentKey(); k != nil {
+			if k.GetFingerprint() == "" {
+				return "", "", errors.New("gpg-agent key has no fingerprint")
+			}
+			return keyType, fingerprint(k.GetFingerprint()), nil
+		}
+		return "", "", nil
+	})
+}
+
+// keyType identifies gpg-agent keys in vault markers.
+const keyType = "gpg-agent"
+
+// fingerprint returns the vault marker fingerprint of the key with the given
+// PGP fingerprint.
+func fingerprint(pgpFingerprint string) string {
+	h := sha256.Sum256([]byte(strings.ToUpper(pgpFingerprint)))
+	return hex.EncodeToString(h[:])
+}
+
+func newVault(baseDir string, k *pb.GpgAgentKey, params key_private.VaultParams) (secret.Vault, error) {
+	if params.Manifest {
+		return nil, errors.New("gpg-agent vaults do not support manifests")
+	}
+	if k.GetFingerprint() == "" {
+		return nil, errors.New("gpg-agent key has no fingerprint")
+	}
+	bin := k.GetGpgBinary()
+	if bin == "" {
+		bin = "gpg"
+	}
+	return &vault{
+		baseDir:         filepath.Clean(baseDir),
+		gpg:             gpg{bin: bin, home: k.GetHome(), fingerprint: k.GetFingerprint()},
+		keepVersions:    params.KeepVersions,
+		trashRetention:  params.TrashRetention,
+		resolveSymlinks: params.ResolveSymlinks,
+		maxEntrySize:    params.MaxEntrySize,
+	}, nil
+}
+
+// vault implements secret.Vault.
+type vault struct {
+	baseDir         string        // base directory containing password entries
+	gpg             gpg           // used to encrypt/decrypt password entries
+	keepVersions    int           // number of previous versions of each entry to keep
+	trashRetention  time.Duration // how long to keep deleted entries in the trash
+	resolveSymlinks bool          // whether to refuse access via symlinks leading outside baseDir
+	maxEntrySize    int           // maximum size of an entry's plaintext content; zero for no limit
+}
+
+// Unlock checks that gpg can decrypt content encrypted to the vault's key. If
+// the passphrase is nonempty, it is given to gpg via loopback pinentry;
+// otherwise, gpg-agent is responsible for gaining access to the key, e.g. by
+// prompting for a PIN via its configured pinentry.
+func (v *vault) Unlock(passphrase string) (secret.Store, error) {
+	g := v.gpg
+	g.passphrase = passphrase
+	ciphertext, err := g.encrypt(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encrypt challenge: %w", err)
+	}
+	switch content, err := g.decrypt(ciphertext); {
+	case errors.Is(err, secret.ErrWrongPassphrase):
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("couldn't decrypt challenge: %w", err)
+	case content != challenge:
+		return nil, errors.New("decrypted challenge does not match")
+	}
+	if err := key_private.CheckMarker(v.baseDir, keyType, fingerprint(g.fingerprint)); err != nil {
+		return nil, err
+	}
+	return file.NewStore(v.baseDir, ".gpg", crypter{g}, file.WithVersions(v.keepVersions), file.WithTrash(v.trashRetention), file.WithResolveSymlinks(v.resolveSymlinks), file.WithMaxEntrySize(v.maxEntrySize)), nil
+}
+
+// crypter implements file.Crypter.
+type crypter struct {
+	g gpg
+}
+
+func (c crypter) Encrypt(entry, content string) (ciphertext []byte, _ error) {
+	return c.g.encrypt(content)
+}
+
+func (c crypter) Decrypt(entry string, ciphertext []byte) (content string, _ error) {
+	return c.g.decrypt(ciphertext)
+}
+
+// gpg runs a gpg binary to encrypt & decrypt content.
+type gpg struct {
+	bin         string // gpg binary
+	home        string // GnuPG home directory; empty for the default
+	fingerprint string // fingerprint of the key to use
+
+	passphrase string // if nonempty, passed to gpg via loopback pinentry
+}
+
+func (g gpg) encrypt(content string) ([]byte, error) {
+	return g.run([]string{"--encrypt", "--recipient", g.fingerprint, "--trust-model", "always"}, []byte(content))
+}
+
+func (g gpg) decrypt(ciphertext []byte) (string, error) {
+	content, err := g.run([]string{"--decrypt"}, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// run runs gpg with the given arguments, writing stdin to its standard input
+// and returning its standard output.
+func (g gpg) run(args []string, stdin []byte) ([]byte, error) {
+	args = append([]string{"--batch", "--no-tty", "--yes", "--output", "-"}, args...)
+	var extraFiles []*os.File
+	if g.passphrase != "" {
+		// Pass the passphrase on a pipe, rather than on the command line where other users could see it.
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create pipe: %w", err)
+		}
+		defer r.Close()
+		go func() {
+			defer w.Close()
+			w.Write([]byte(g.passphrase))
+		}()
+		extraFiles = append(extraFiles, r)
+		args = append([]string{"--pinentry-mode", "loopback", "--passphrase-fd", "3"}, args...)
+	}
+	if g.home != "" {
+		args = append([]string{"--homedir", g.home}, args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(g.bin, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.ExtraFiles = extraFiles
+	if err := cmd.Run(); err != nil {
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) {
+			return nil, fmt.Errorf("couldn't run gpg: %w", err)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		for _, pe := range passphraseErrors {
+			if strings.Contains(msg, pe) {
+				return nil, secret.ErrWrongPassphrase
+			}
+		}
+		return nil, fmt.Errorf("gpg failed (%v): %q", err, msg)
+	}
+	return stdout.Bytes(), nil
+}
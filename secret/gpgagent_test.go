@@ -0,0 +1,101 @@
+package gpgagent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key_private"
+
+	pb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+func TestVault(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skipf("gpg not available: %v", err)
+	}
+
+	// Generate a passphrase-protected key in a fresh GnuPG home directory.
+	home, err := ioutil.TempDir("", "harp_gpg_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	if out, err := exec.Command("gpg", "--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", "passphrase", "--quick-gen-key", "Test <test@example.com>", "future-default", "default", "never").CombinedOutput(); err != nil {
+		t.Fatalf("Could not generate key: %v (%s)", err, out)
+	}
+	out, err := exec.Command("gpg", "--homedir", home, "--list-keys", "--with-colons").Output()
+	if err != nil {
+		t.Fatalf("Could not list keys: %v", err)
+	}
+	var fpr string
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(l, "fpr:") {
+			fpr = strings.Trim(l[len("fpr:"):], ":")
+			break
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "harp_gpgagent_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := newVault(dir, &pb.GpgAgentKey{Fingerprint: fpr, Home: home}, key_private.VaultParams{})
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+
+	// Check the wrong passphrase before the right one, since gpg-agent caches passphrases.
+	if _, err := v.Unlock("wrong"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock with wrong passphrase gave error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	s, err := v.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	if err := s.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ciphertext, err := ioutil.ReadFile(filepath.Join(dir, "entry.gpg"))
+	if err != nil {
+		t.Fatalf("Could not read entry file: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("content")) {
+		t.Errorf("Entry file holds plaintext content")
+	}
+	if content, err := s.Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
+
+func TestPinentryCancelled(t *testing.T) {
+	t.Parallel()
+
+	// A fake gpg which "encrypts" by copying its input, and fails to decrypt as if pinentry were cancelled.
+	dir, err := ioutil.TempDir("", "harp_gpgagent_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "gpg")
+	script := "#!/bin/sh\ncase \"$*\" in\n*--decrypt*)\n\techo 'gpg: public key decryption failed: Operation cancelled' >&2\n\texit 2;;\nesac\ncat\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatalf("Could not write fake gpg: %v", err)
+	}
+
+	v, err := newVault(dir, &pb.GpgAgentKey{Fingerprint: "0123456789ABCDEF", GpgBinary: bin}, key_private.VaultParams{})
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	if _, err := v.Unlock(""); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock gave error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+}
@@ -0,0 +1,104 @@
+// Package kdf helps to choose parameters for deriving key-encryption keys
+// from passphrases.
+package kdf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// WeakDuration is the derivation time below which a key's parameters
+	// are considered weak: an attacker guessing passphrases can try many
+	// guesses per second on similar hardware.
+	WeakDuration = 50 * time.Millisecond
+
+	// Bounds on the scrypt N value chosen by Calibrate. Memory use is
+	// 128 * N * r bytes, so the maximum uses 1 GiB with the default r.
+	minScryptN = 1 << 10
+	maxScryptN = 1 << 20
+)
+
+// Params holds scrypt parameters.
+type Params struct {
+	N, R, P int
+}
+
+// DefaultParams are the scrypt parameters used if none are specified.
+var DefaultParams = Params{N: 32768, R: 8, P: 1}
+
+func (p Params) String() string { return fmt.Sprintf("N=%d, r=%d, p=%d", p.N, p.R, p.P) }
+
+// Calibrate benchmarks scrypt on the local machine, returning parameters
+// using the largest N (a power of two) for which key derivation takes at most
+// the given target time. Parameters other than N are taken from
+// DefaultParams. An error is returned if even the smallest N considered
+// takes longer than the target.
+func Calibrate(target time.Duration) (Params, error) {
+	return calibrate(target, measure)
+}
+
+// calibrate implements Calibrate, using the given function to determine how
+// long derivation takes with a given set of parameters.
+func calibrate(target time.Duration, measure func(Params) (time.Duration, error)) (Params, error) {
+	p := DefaultParams
+	p.N = minScryptN
+	d, err := measure(p)
+	if err != nil {
+		return Params{}, err
+	}
+	if d > target {
+		return Params{}, fmt.Errorf("derivation with %v takes %v, longer than the target of %v", p, d, target)
+	}
+	for p.N < maxScryptN {
+		next := p
+		next.N *= 2
+		d, err := measure(next)
+		if err != nil {
+			return Params{}, err
+		}
+		if d > target {
+			break
+		}
+		p = next
+	}
+	return p, nil
+}
+
+// measure determines how long scrypt key derivation takes with the given
+// parameters on the local machine.
+func measure(p Params) (time.Duration, error) {
+	start := time.Now()
+	if _, err := scrypt.Key([]byte("passphrase"), []byte("harpocrates_calibration_"), p.N, p.R, p.P, 32); err != nil {
+		return 0, fmt.Errorf("couldn't derive key with %v: %w", p, err)
+	}
+	return time.Since(start), nil
+}
+
+// externalSecretInfo is the HKDF info used by CombineExternalSecret.
+const externalSecretInfo = "harpocrates_external_secret_kek"
+
+// CombineExternalSecret derives a key-encryption key from one derived from a
+// passphrase, kek, and an external secret (e.g. the hmac-secret output of a
+// hardware token), via HKDF-SHA256 with the given salt. The result is as long
+// as kek. Neither the passphrase nor the external secret alone suffices to
+// derive it.
+func CombineExternalSecret(kek, salt, external []byte) ([]byte, error) {
+	ikm := make([]byte, 0, len(kek)+len(external))
+	ikm = append(append(ikm, kek...), external...)
+	defer func() {
+		for i := range ikm {
+			ikm[i] = 0
+		}
+	}()
+	combined := make([]byte, len(kek))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte(externalSecretInfo)), combined); err != nil {
+		return nil, fmt.Errorf("couldn't combine external secret: %w", err)
+	}
+	return combined, nil
+}
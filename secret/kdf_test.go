@@ -0,0 +1,99 @@
+package kdf
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeMeasure returns a measurement function under which derivation takes
+// the given time per unit of N, recording the N values measured.
+func fakeMeasure(perN time.Duration, measured *[]int) func(Params) (time.Duration, error) {
+	return func(p Params) (time.Duration, error) {
+		*measured = append(*measured, p.N)
+		return time.Duration(p.N) * perN, nil
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc   string
+		perN   time.Duration
+		target time.Duration
+		wantN  int
+	}{
+		{"exact fit", time.Microsecond, 32768 * time.Microsecond, 32768},
+		{"between powers of two", time.Microsecond, 50000 * time.Microsecond, 32768},
+		{"minimum", time.Microsecond, 1024 * time.Microsecond, 1024},
+		{"capped at maximum", time.Nanosecond, time.Hour, maxScryptN},
+	} {
+		var measured []int
+		p, err := calibrate(test.target, fakeMeasure(test.perN, &measured))
+		if err != nil {
+			t.Errorf("%s: could not calibrate: %v", test.desc, err)
+			continue
+		}
+		if want := (Params{N: test.wantN, R: DefaultParams.R, P: DefaultParams.P}); p != want {
+			t.Errorf("%s: got %v, want %v", test.desc, p, want)
+		}
+		for i, n := range measured {
+			if n != minScryptN<<uint(i) {
+				t.Errorf("%s: measured N values %v, want successive powers of two from %d", test.desc, measured, minScryptN)
+				break
+			}
+		}
+	}
+
+	// Too slow even at the minimum.
+	var measured []int
+	if p, err := calibrate(time.Millisecond, fakeMeasure(time.Millisecond, &measured)); err == nil {
+		t.Errorf("Calibrating on slow machine: got %v, want error", p)
+	}
+
+	// Measurement errors are returned.
+	wantErr := errors.New("measurement failed")
+	if _, err := calibrate(time.Second, func(Params) (time.Duration, error) { return 0, wantErr }); !errors.Is(err, wantErr) {
+		t.Errorf("Calibrating with failing measurement: got %v, want %v", err, wantErr)
+	}
+}
+
+func TestCombineExternalSecret(t *testing.T) {
+	t.Parallel()
+
+	kek, salt := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	combined, err := CombineExternalSecret(kek, salt, []byte("external"))
+	if err != nil {
+		t.Fatalf("Could not combine external secret: %v", err)
+	}
+	if len(combined) != len(kek) {
+		t.Errorf("Combined key has length %d, want %d", len(combined), len(kek))
+	}
+	if bytes.Equal(combined, kek) {
+		t.Errorf("Combined key is the passphrase-derived key")
+	}
+
+	// Any change to the inputs changes the result.
+	for _, test := range []struct {
+		desc                string
+		kek, salt, external []byte
+	}{
+		{"different external secret", kek, salt, []byte("external2")},
+		{"different salt", kek, bytes.Repeat([]byte{3}, 16), []byte("external")},
+		{"different key", bytes.Repeat([]byte{4}, 32), salt, []byte("external")},
+	} {
+		got, err := CombineExternalSecret(test.kek, test.salt, test.external)
+		if err != nil {
+			t.Errorf("%s: could not combine external secret: %v", test.desc, err)
+			continue
+		}
+		if bytes.Equal(got, combined) {
+			t.Errorf("%s: got same combined key", test.desc)
+		}
+	}
+	if again, err := CombineExternalSecret(kek, salt, []byte("external")); err != nil || !bytes.Equal(again, combined) {
+		t.Errorf("Combining again = (%x, %v), want (%x, nil)", again, err, combined)
+	}
+}
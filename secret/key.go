@@ -2,7 +2,12 @@
 package key
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/BranLwyd/harpocrates/secret"
+	_ "github.com/BranLwyd/harpocrates/secret/gpgagent"
 	"github.com/BranLwyd/harpocrates/secret/key_private"
 	_ "github.com/BranLwyd/harpocrates/secret/pgp"
 	_ "github.com/BranLwyd/harpocrates/secret/secretbox"
@@ -12,6 +17,116 @@ import (
 
 // NewVault creates a new vault from the given key, reading encrypted data from
 // the given location (which has a key-type specific meaning).
-func NewVault(location string, key *pb.Key) (secret.Vault, error) {
-	return key_private.VaultFromKey(location, key)
+func NewVault(location string, key *pb.Key, opts ...VaultOption) (secret.Vault, error) {
+	var params key_private.VaultParams
+	for _, opt := range opts {
+		opt(&params)
+	}
+	return key_private.VaultFromKey(location, key, params)
+}
+
+// VaultOption configures optional behavior of a vault created by NewVault.
+type VaultOption func(*key_private.VaultParams)
+
+// WithVersions causes stores opened from the vault to keep up to keep
+// previous versions of each entry. Such stores implement
+// secret.VersionedStore.
+func WithVersions(keep int) VaultOption {
+	return func(params *key_private.VaultParams) {
+		params.KeepVersions = keep
+	}
+}
+
+// WithTrash causes stores opened from the vault to move deleted entries to
+// the trash, keeping them for at least the given retention period. Such stores
+// implement secret.TrashStore.
+func WithTrash(retention time.Duration) VaultOption {
+	return func(params *key_private.VaultParams) {
+		params.TrashRetention = retention
+	}
+}
+
+// WithResolveSymlinks causes stores opened from the vault to refuse access to
+// entries via symbolic links which lead outside of the vault's directory.
+func WithResolveSymlinks() VaultOption {
+	return func(params *key_private.VaultParams) {
+		params.ResolveSymlinks = true
+	}
+}
+
+// WithMaxEntrySize causes stores opened from the vault to refuse (with
+// secret.ErrEntryTooLarge) to write entries whose plaintext content is larger
+// than n bytes.
+func WithMaxEntrySize(n int) VaultOption {
+	return func(params *key_private.VaultParams) {
+		params.MaxEntrySize = n
+	}
+}
+
+// WithManifest causes stores opened from the vault to keep a manifest of the
+// vault's files, authenticated with a key derived from the vault's key, and to
+// update it whenever they change the vault. Such stores implement
+// secret.VerifyStore, detecting files which are removed, added or modified
+// other than via a store; this includes external edits, e.g. by `pass`. Only
+// secretbox keys support manifests.
+func WithManifest() VaultOption {
+	return func(params *key_private.VaultParams) {
+		params.Manifest = true
+	}
+}
+
+// RewrapOption configures optional behavior of Rewrap.
+type RewrapOption func(*key_private.RewrapParams)
+
+// WithScryptParams causes Rewrap to derive the new key-encryption key using
+// the given scrypt parameters, rather than keeping the existing parameters.
+func WithScryptParams(n, r, p int) RewrapOption {
+	return func(params *key_private.RewrapParams) {
+		params.ScryptN, params.ScryptR, params.ScryptP = n, r, p
+	}
+}
+
+// WithExternalSecret supplies the external secret required by the key being
+// rewrapped (see secret.ExternalSecretVault). The rewrapped key requires the
+// same external secret.
+func WithExternalSecret(extra []byte) RewrapOption {
+	return func(params *key_private.RewrapParams) {
+		params.ExternalSecret = extra
+	}
+}
+
+// Rewrap re-encrypts the secret material of the given key under a new
+// passphrase, returning the updated key. The encrypted data in the vault
+// protected by the key does not need to change. If the old passphrase is
+// incorrect, secret.ErrWrongPassphrase is returned. Not all key types can be
+// rewrapped.
+func Rewrap(key *pb.Key, oldPassphrase, newPassphrase string, opts ...RewrapOption) (*pb.Key, error) {
+	var params key_private.RewrapParams
+	for _, opt := range opts {
+		opt(&params)
+	}
+	return key_private.Rewrap(key, oldPassphrase, newPassphrase, params)
+}
+
+// InitVault initializes a new vault for the given key at the given location,
+// creating its directory if needed & recording the key's type & fingerprint in
+// a marker file. Vaults refuse to unlock with a different key than the one
+// recorded in their marker, returning secret.ErrWrongKey. Some key types are
+// fingerprinted using their secret material, requiring the passphrase. It
+// fails if the vault has already been initialized.
+func InitVault(location string, key *pb.Key, passphrase string) error {
+	return InitVaultWith(location, key, passphrase, nil)
+}
+
+// InitVaultWith is like InitVault, but also supplies the external secret
+// required by the key, if any (see secret.ExternalSecretVault).
+func InitVaultWith(location string, key *pb.Key, passphrase string, extra []byte) error {
+	m, err := key_private.Fingerprint(key, passphrase, extra)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(location, 0700); err != nil {
+		return fmt.Errorf("couldn't create vault directory: %w", err)
+	}
+	return key_private.WriteMarker(location, m)
 }
@@ -3,7 +3,15 @@
 package key_private
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BranLwyd/harpocrates/secret"
 
@@ -12,13 +20,39 @@ import (
 
 var (
 	vaultFromKeyFuncs []VaultFromKeyFunc
+	rewrapFuncs       []RewrapFunc
+	fingerprintFuncs  []FingerprintFunc
 )
 
+// VaultParams holds optional parameters used when creating a vault.
+type VaultParams struct {
+	// Number of previous versions of each entry to keep. Zero indicates
+	// that previous versions should not be kept.
+	KeepVersions int
+
+	// How long to keep deleted entries in the trash. Zero indicates that
+	// deleted entries should be removed immediately.
+	TrashRetention time.Duration
+
+	// Whether to refuse access to entries via symbolic links which lead
+	// outside of the vault's directory.
+	ResolveSymlinks bool
+
+	// Maximum size of an entry's plaintext content, in bytes. Zero
+	// indicates no limit.
+	MaxEntrySize int
+
+	// Whether to keep an authenticated manifest of the vault's files,
+	// allowing tampering to be detected. Not all key types support
+	// manifests.
+	Manifest bool
+}
+
 // VaultFromKeyFunc is a function that may be able to generate a vault from a
 // key. It should return the vault if it can. It should return (nil, nil) if
 // it does not recognize the key. It should return an error if it recognizes
 // the key but the key is invalid in some way.
-type VaultFromKeyFunc func(location string, _ *pb.Key) (secret.Vault, error)
+type VaultFromKeyFunc func(location string, _ *pb.Key, _ VaultParams) (secret.Vault, error)
 
 // RegisterVaultFromKeyFunc registers a VaultFromKeyFunc for handling keys. It
 // should be called only from init().
@@ -27,9 +61,9 @@ func RegisterVaultFromKeyFunc(f VaultFromKeyFunc) {
 }
 
 // VaultFromKey attempts to create a Vault from a given key.
-func VaultFromKey(location string, key *pb.Key) (secret.Vault, error) {
+func VaultFromKey(location string, key *pb.Key, params VaultParams) (secret.Vault, error) {
 	for _, f := range vaultFromKeyFuncs {
-		v, err := f(location, key)
+		v, err := f(location, key, params)
 		if err != nil {
 			return nil, err
 		}
@@ -39,3 +73,152 @@ func VaultFromKey(location string, key *pb.Key) (secret.Vault, error) {
 	}
 	return nil, errors.New("unrecognized key type")
 }
+
+// RewrapParams holds optional parameters used when rewrapping a key.
+type RewrapParams struct {
+	// Scrypt parameters to use to derive the new key-encryption key. Zero
+	// values indicate that the existing parameters should be kept.
+	ScryptN, ScryptR, ScryptP int
+
+	// The external secret required by the key, if any (see
+	// secret.ExternalSecretVault). It is required by the rewrapped key too.
+	ExternalSecret []byte
+}
+
+// RewrapFunc is a function that may be able to rewrap a key, i.e. re-encrypt
+// the key's secret material under a new passphrase. It should return the
+// rewrapped key if it can. It should return (nil, nil) if it does not
+// recognize the key. It should return an error if it recognizes the key but
+// cannot rewrap it. If the old passphrase is incorrect, it should return
+// secret.ErrWrongPassphrase.
+type RewrapFunc func(key *pb.Key, oldPassphrase, newPassphrase string, params RewrapParams) (*pb.Key, error)
+
+// RegisterRewrapFunc registers a RewrapFunc for handling keys. It should be
+// called only from init().
+func RegisterRewrapFunc(f RewrapFunc) {
+	rewrapFuncs = append(rewrapFuncs, f)
+}
+
+// Rewrap attempts to rewrap a given key.
+func Rewrap(key *pb.Key, oldPassphrase, newPassphrase string, params RewrapParams) (*pb.Key, error) {
+	for _, f := range rewrapFuncs {
+		k, err := f(key, oldPassphrase, newPassphrase, params)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil {
+			return k, nil
+		}
+	}
+	return nil, errors.New("unrecognized key type")
+}
+
+// FingerprintFunc is a function that may be able to fingerprint a key, i.e.
+// compute a value identifying the key which is stable across rewrapping & does
+// not reveal its secret material. It should return the key's type & its
+// fingerprint if it can. It should return empty strings if it does not
+// recognize the key. Keys whose fingerprint is derived from secret material
+// require the passphrase, and the external secret if the key requires one; if
+// either is incorrect, it should return secret.ErrWrongPassphrase.
+type FingerprintFunc func(key *pb.Key, passphrase string, extra []byte) (keyType, fingerprint string, _ error)
+
+// RegisterFingerprintFunc registers a FingerprintFunc for handling keys. It
+// should be called only from init().
+func RegisterFingerprintFunc(f FingerprintFunc) {
+	fingerprintFuncs = append(fingerprintFuncs, f)
+}
+
+// Fingerprint attempts to fingerprint a given key.
+func Fingerprint(key *pb.Key, passphrase string, extra []byte) (Marker, error) {
+	for _, f := range fingerprintFuncs {
+		kt, fp, err := f(key, passphrase, extra)
+		if err != nil {
+			return Marker{}, err
+		}
+		if kt != "" {
+			return Marker{KeyType: kt, Fingerprint: fp}, nil
+		}
+	}
+	return Marker{}, errors.New("unrecognized key type")
+}
+
+// MarkerFile is the name of the file, in the root of a vault's directory,
+// recording the key the vault was initialized for.
+const MarkerFile = ".harp-vault"
+
+// Marker identifies the key a vault was initialized for.
+type Marker struct {
+	KeyType     string // e.g. "secretbox"
+	Fingerprint string // see FingerprintFunc
+}
+
+// ReadMarker reads the marker of the vault in the given directory. It
+// returns nil if the vault has no marker.
+func ReadMarker(dir string) (*Marker, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, MarkerFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read vault marker: %w", err)
+	}
+	m := &Marker{}
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("couldn't parse vault marker line %q", l)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "key_type":
+			m.KeyType = strings.TrimSpace(kv[1])
+		case "fingerprint":
+			m.Fingerprint = strings.TrimSpace(kv[1])
+		}
+	}
+	if m.KeyType == "" || m.Fingerprint == "" {
+		return nil, errors.New("vault marker requires key_type and fingerprint")
+	}
+	return m, nil
+}
+
+// WriteMarker writes the marker of the vault in the given directory. It fails
+// if the vault already has a marker.
+func WriteMarker(dir string, m Marker) error {
+	f, err := os.OpenFile(filepath.Join(dir, MarkerFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't create vault marker: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "# Written by init_vault. This vault may only be unlocked with the key described here.\nkey_type: %s\nfingerprint: %s\n", m.KeyType, m.Fingerprint); err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't write vault marker: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("couldn't write vault marker: %w", err)
+	}
+	return nil
+}
+
+// CheckMarker checks that the vault in the given directory, if it has a
+// marker, was initialized for the key with the given type & fingerprint. If
+// not, it returns an error wrapping secret.ErrWrongKey.
+func CheckMarker(dir, keyType, fingerprint string) error {
+	m, err := ReadMarker(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	if m.KeyType != keyType {
+		return fmt.Errorf("%w: %q was initialized for a %s key, not a %s key", secret.ErrWrongKey, dir, m.KeyType, keyType)
+	}
+	if m.Fingerprint != fingerprint {
+		return fmt.Errorf("%w: %q was initialized for the %s key with fingerprint %s, not %s", secret.ErrWrongKey, dir, m.KeyType, m.Fingerprint, fingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+	"github.com/BranLwyd/harpocrates/secret/kdf"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	pb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+func TestRewrapSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "old passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := mustUnlock(t, dir, k, "old passphrase").Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Rewrapping with the wrong passphrase fails.
+	if _, err := Rewrap(k, "wrong passphrase", "new passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Rewrap with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+
+	// After rewrapping, only the new passphrase works, and existing content is still readable.
+	newKey, err := Rewrap(k, "old passphrase", "new passphrase", WithScryptParams(4, 0, 0))
+	if err != nil {
+		t.Fatalf("Could not rewrap: %v", err)
+	}
+	if got := newKey.GetSecretboxKey().N; got != 4 {
+		t.Errorf("Rewrapped key has N = %d, want 4", got)
+	}
+	if got := newKey.GetSecretboxKey().R; got != 1 {
+		t.Errorf("Rewrapped key has r = %d, want 1 (unchanged)", got)
+	}
+	v, err := NewVault(dir, newKey)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	if _, err := v.Unlock("old passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock with old passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	if content, err := mustUnlock(t, dir, newKey, "new passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after rewrap = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
+
+func TestSnapshotSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := mustUnlock(t, dir, k, "passphrase").Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Entries restored from a snapshot decrypt with the original key.
+	var snap bytes.Buffer
+	if err := file.Snapshot(&snap, dir); err != nil {
+		t.Fatalf("Could not snapshot: %v", err)
+	}
+	if bytes.Contains(snap.Bytes(), []byte("content")) {
+		t.Errorf("Snapshot contains plaintext content")
+	}
+	dest, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dest)
+	if _, err := file.RestoreSnapshot(&snap, dest, false, nil); err != nil {
+		t.Fatalf("Could not restore snapshot: %v", err)
+	}
+	if content, err := mustUnlock(t, dest, k, "passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after restore = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
+
+func TestArgon2Secretbox(t *testing.T) {
+	t.Parallel()
+
+	k := argon2SecretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := mustUnlock(t, dir, k, "passphrase").Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	v, err := NewVault(dir, k)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	if _, err := v.Unlock("wrong passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+
+	// Rewrapping keeps the KDF, unless new scrypt parameters are requested.
+	newKey, err := Rewrap(k, "passphrase", "new passphrase")
+	if err != nil {
+		t.Fatalf("Could not rewrap: %v", err)
+	}
+	if a := newKey.GetSecretboxKey().Argon2; a == nil || a.Iterations != 1 || string(a.Salt) == string(k.GetSecretboxKey().Argon2.Salt) {
+		t.Errorf("Rewrapped key has Argon2 parameters %v, want same parameters with a fresh salt", a)
+	}
+	if content, err := mustUnlock(t, dir, newKey, "new passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after rewrap = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+	scryptKey, err := Rewrap(newKey, "new passphrase", "scrypt passphrase", WithScryptParams(4, 1, 1))
+	if err != nil {
+		t.Fatalf("Could not rewrap: %v", err)
+	}
+	if sk := scryptKey.GetSecretboxKey(); sk.Argon2 != nil || sk.N != 4 {
+		t.Errorf("Rewrapped key with scrypt parameters has N = %d, Argon2 parameters %v; want N = 4, no Argon2 parameters", sk.N, sk.Argon2)
+	}
+	if content, err := mustUnlock(t, dir, scryptKey, "scrypt passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after rewrap = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
+
+func TestInvalidArgon2Params(t *testing.T) {
+	t.Parallel()
+
+	k := argon2SecretboxKey(t, "passphrase")
+	k.GetSecretboxKey().Argon2.Parallelism = 0
+	if _, err := NewVault("", k); err == nil {
+		t.Errorf("NewVault with zero Argon2 parallelism unexpectedly succeeded")
+	}
+}
+
+func TestSecretboxAttachments(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	as, ok := secret.AsAttachmentStore(mustUnlock(t, dir, k, "passphrase"))
+	if !ok {
+		t.Fatalf("Secretbox store does not implement secret.AttachmentStore")
+	}
+	if err := as.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	want := []byte("recovery codes\x00\xff")
+	if err := as.PutAttachment("/entry", "codes.txt", want); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+	if got, err := as.GetAttachment("/entry", "codes.txt"); err != nil || string(got) != string(want) {
+		t.Errorf("GetAttachment = (%q, %v), want (%q, nil)", got, err, want)
+	}
+}
+
+func TestWipeSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := mustUnlock(t, dir, k, "passphrase")
+	if err := s.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ws, ok := secret.AsWipeStore(s)
+	if !ok {
+		t.Fatalf("Secretbox store does not implement secret.WipeStore")
+	}
+
+	// After wiping, the store refuses to decrypt or encrypt; wiping again is safe.
+	ws.Wipe()
+	ws.Wipe()
+	if content, err := s.Get("/entry"); err == nil {
+		t.Errorf("Get after Wipe = (%q, nil), want error", content)
+	}
+	if err := s.Put("/other", "content"); err == nil {
+		t.Errorf("Put after Wipe unexpectedly succeeded")
+	}
+
+	// Other stores unlocked from the same vault are unaffected.
+	if content, err := mustUnlock(t, dir, k, "passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get from new store = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
+
+func TestRewrapPGP(t *testing.T) {
+	t.Parallel()
+
+	k := &pb.Key{Key: &pb.Key_PgpKey{PgpKey: &pb.PGPKey{}}}
+	if _, err := Rewrap(k, "old passphrase", "new passphrase"); err == nil {
+		t.Errorf("Rewrap of PGP key unexpectedly succeeded")
+	}
+}
+
+func TestInitVaultSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	otherKey := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "vault")
+
+	if err := InitVault(location, k, "wrong passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("InitVault with wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	if err := InitVault(location, k, "passphrase"); err != nil {
+		t.Fatalf("Could not initialize vault: %v", err)
+	}
+	if err := InitVault(location, k, "passphrase"); err == nil {
+		t.Errorf("InitVault of initialized vault unexpectedly succeeded")
+	}
+
+	// The vault unlocks with its own key, even after rewrapping, but not with another key.
+	if err := mustUnlock(t, location, k, "passphrase").Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	newKey, err := Rewrap(k, "passphrase", "new passphrase")
+	if err != nil {
+		t.Fatalf("Could not rewrap: %v", err)
+	}
+	if content, err := mustUnlock(t, location, newKey, "new passphrase").Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after rewrap = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+	v, err := NewVault(location, otherKey)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	if _, err := v.Unlock("passphrase"); !errors.Is(err, secret.ErrWrongKey) {
+		t.Errorf("Unlock with other key returned error %v, want %v", err, secret.ErrWrongKey)
+	}
+	if _, err := v.Unlock("wrong passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock with other key & wrong passphrase returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+
+	// A vault without a marker unlocks with any key.
+	mustUnlock(t, dir, otherKey, "passphrase")
+}
+
+func TestManifestSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := NewVault(dir, k, WithManifest())
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	s, err := v.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	if err := s.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	vs, ok := secret.AsVerifyStore(s)
+	if !ok {
+		t.Fatalf("Store does not implement secret.VerifyStore")
+	}
+	if ps, err := vs.Verify(); err != nil || len(ps) != 0 {
+		t.Errorf("Verify returned (%q, %v), want no problems", ps, err)
+	}
+
+	// The manifest is authenticated with a key derived from the EK, so it
+	// can't be verified with another key.
+	otherVault, err := NewVault(dir, secretboxKey(t, "passphrase"), WithManifest())
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	otherStore, err := otherVault.Unlock("passphrase")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	if err := otherStore.Put("/other", "content"); !errors.Is(err, secret.ErrTampered) {
+		t.Errorf("Put with other key returned error %v, want %v", err, secret.ErrTampered)
+	}
+
+	// PGP vaults don't support manifests.
+	if _, err := NewVault(dir, &pb.Key{Key: &pb.Key_PgpKey{PgpKey: &pb.PGPKey{}}}, WithManifest()); err == nil {
+		t.Errorf("NewVault of PGP key with manifest unexpectedly succeeded")
+	}
+}
+
+func mustUnlock(t *testing.T, location string, k *pb.Key, passphrase string) secret.Store {
+	t.Helper()
+	v, err := NewVault(location, k)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	s, err := v.Unlock(passphrase)
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	return s
+}
+
+// secretboxKey generates a secretbox key with cheap scrypt parameters.
+func secretboxKey(t *testing.T, passphrase string) *pb.Key {
+	t.Helper()
+	var ek [32]byte
+	var nonce [24]byte
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{ek[:], nonce[:], salt} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("Could not generate random bytes: %v", err)
+		}
+	}
+	kekBuf, err := scrypt.Key([]byte(passphrase), salt, 2, 1, 1, 32)
+	if err != nil {
+		t.Fatalf("Could not derive KEK: %v", err)
+	}
+	var kek [32]byte
+	copy(kek[:], kekBuf)
+	return &pb.Key{Key: &pb.Key_SecretboxKey{SecretboxKey: &pb.SecretboxKey{
+		EncryptedKey:      secretbox.Seal(nil, ek[:], &nonce, &kek),
+		EncryptedKeyNonce: nonce[:],
+		Salt:              salt,
+		N:                 2,
+		R:                 1,
+		P:                 1,
+	}}}
+}
+
+// externalSecretboxKey generates a secretbox key with cheap scrypt parameters,
+// requiring the given external secret.
+func externalSecretboxKey(t *testing.T, passphrase string, extra []byte) *pb.Key {
+	t.Helper()
+	var ek [32]byte
+	var nonce [24]byte
+	salt, externalSalt := make([]byte, 16), make([]byte, 16)
+	for _, b := range [][]byte{ek[:], nonce[:], salt, externalSalt} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("Could not generate random bytes: %v", err)
+		}
+	}
+	kekBuf, err := scrypt.Key([]byte(passphrase), salt, 2, 1, 1, 32)
+	if err != nil {
+		t.Fatalf("Could not derive KEK: %v", err)
+	}
+	if kekBuf, err = kdf.CombineExternalSecret(kekBuf, externalSalt, extra); err != nil {
+		t.Fatalf("Could not combine external secret: %v", err)
+	}
+	var kek [32]byte
+	copy(kek[:], kekBuf)
+	return &pb.Key{Key: &pb.Key_SecretboxKey{SecretboxKey: &pb.SecretboxKey{
+		EncryptedKey:           secretbox.Seal(nil, ek[:], &nonce, &kek),
+		EncryptedKeyNonce:      nonce[:],
+		Salt:                   salt,
+		N:                      2,
+		R:                      1,
+		P:                      1,
+		RequiresExternalSecret: true,
+		ExternalSalt:           externalSalt,
+	}}}
+}
+
+// argon2SecretboxKey generates a secretbox key with cheap Argon2id parameters.
+func argon2SecretboxKey(t *testing.T, passphrase string) *pb.Key {
+	t.Helper()
+	var ek [32]byte
+	var nonce [24]byte
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{ek[:], nonce[:], salt} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("Could not generate random bytes: %v", err)
+		}
+	}
+	var kek [32]byte
+	copy(kek[:], argon2.IDKey([]byte(passphrase), salt, 1, 64, 1, 32))
+	return &pb.Key{Key: &pb.Key_SecretboxKey{SecretboxKey: &pb.SecretboxKey{
+		EncryptedKey:      secretbox.Seal(nil, ek[:], &nonce, &kek),
+		EncryptedKeyNonce: nonce[:],
+		Argon2: &pb.Argon2Params{
+			Salt:        salt,
+			Memory:      64,
+			Iterations:  1,
+			Parallelism: 1,
+		},
+	}}}
+}
+
+func TestUnlockAsyncSecretbox(t *testing.T) {
+	t.Parallel()
+
+	k := secretboxKey(t, "passphrase")
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := NewVault(dir, k)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+
+	for _, test := range []struct {
+		passphrase string
+		wantErr    error
+	}{
+		{"passphrase", nil},
+		{"wrong passphrase", secret.ErrWrongPassphrase},
+	} {
+		h, err := secret.UnlockAsync(v, test.passphrase)
+		if err != nil {
+			t.Fatalf("Could not start unlock: %v", err)
+		}
+		if _, err := h.Result(); err != test.wantErr {
+			t.Errorf("Result of unlock with %q returned error %v, want %v", test.passphrase, err, test.wantErr)
+		}
+		if p, ok := h.Progress(); !ok || p != 1 {
+			t.Errorf("Progress of completed unlock = (%v, %v), want (1, true)", p, ok)
+		}
+	}
+
+	// Once a key has been derived, progress of later unlocks is estimated.
+	av, ok := v.(secret.AsyncVault)
+	if !ok {
+		t.Fatalf("Secretbox vault does not implement secret.AsyncVault")
+	}
+	h, err := av.UnlockAsync("passphrase")
+	if err != nil {
+		t.Fatalf("Could not start unlock: %v", err)
+	}
+	if p, ok := h.Progress(); !ok || p < 0 || p > 1 {
+		t.Errorf("Progress of unlock = (%v, %v), want estimate between 0 & 1", p, ok)
+	}
+	<-h.Done()
+}
+
+func TestExternalSecretSecretbox(t *testing.T) {
+	t.Parallel()
+
+	extra := []byte("external secret")
+	k := externalSecretboxKey(t, "passphrase", extra)
+	dir, err := ioutil.TempDir("", "harp_key_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := NewVault(dir, k)
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+
+	// Both the passphrase & the external secret are required.
+	for _, test := range []struct {
+		desc       string
+		passphrase string
+		extra      []byte
+	}{
+		{"no external secret", "passphrase", nil},
+		{"wrong external secret", "passphrase", []byte("wrong secret")},
+		{"wrong passphrase", "wrong passphrase", extra},
+	} {
+		if _, err := secret.UnlockWith(v, test.passphrase, test.extra); err != secret.ErrWrongPassphrase {
+			t.Errorf("UnlockWith (%s) returned error %v, want %v", test.desc, err, secret.ErrWrongPassphrase)
+		}
+	}
+	if _, err := v.Unlock("passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	s, err := secret.UnlockWith(v, "passphrase", extra)
+	if err != nil {
+		t.Fatalf("Could not unlock vault with external secret: %v", err)
+	}
+	if err := s.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	h, err := secret.UnlockAsyncWith(v, "passphrase", extra)
+	if err != nil {
+		t.Fatalf("Could not start unlock: %v", err)
+	}
+	if _, err := h.Result(); err != nil {
+		t.Errorf("Could not unlock vault asynchronously with external secret: %v", err)
+	}
+
+	// A rewrapped key still requires the external secret.
+	if _, err := Rewrap(k, "passphrase", "new passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Rewrap without external secret returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	newKey, err := Rewrap(k, "passphrase", "new passphrase", WithExternalSecret(extra))
+	if err != nil {
+		t.Fatalf("Could not rewrap: %v", err)
+	}
+	if sk := newKey.GetSecretboxKey(); !sk.RequiresExternalSecret || bytes.Equal(sk.ExternalSalt, k.GetSecretboxKey().ExternalSalt) {
+		t.Errorf("Rewrapped key has (RequiresExternalSecret, ExternalSalt) = (%v, %x), want (true, fresh salt)", sk.RequiresExternalSecret, sk.ExternalSalt)
+	}
+	if v, err = NewVault(dir, newKey); err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	if _, err := v.Unlock("new passphrase"); err != secret.ErrWrongPassphrase {
+		t.Errorf("Unlock of rewrapped key returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	s, err = secret.UnlockWith(v, "new passphrase", extra)
+	if err != nil {
+		t.Fatalf("Could not unlock rewrapped vault with external secret: %v", err)
+	}
+	if content, err := s.Get("/entry"); err != nil || content != "content" {
+		t.Errorf("Get after rewrap = (%q, %v), want (%q, nil)", content, err, "content")
+	}
+}
@@ -0,0 +1,254 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMountStore combines several Stores into one, with each Store's entries
+// appearing beneath a top-level directory named for its mount point. For
+// example, the entry `/bank` in the Store mounted at "personal" is named
+// `/personal/bank`. Mount points must be nonempty and must not contain
+// slashes. Entries can't be moved between Stores; Move returns ErrCrossMount.
+func NewMountStore(mounts map[string]Store) Store {
+	ms := &mountStore{mounts: map[string]Store{}}
+	for m, s := range mounts {
+		ms.mounts[m] = s
+	}
+	return ms
+}
+
+type mountStore struct {
+	mounts map[string]Store // by mount point
+}
+
+var (
+	_ StatStore   = (*mountStore)(nil)
+	_ WatchStore  = (*mountStore)(nil)
+	_ WipeStore   = (*mountStore)(nil)
+	_ VerifyStore = (*mountStore)(nil)
+	_ StatsStore  = (*mountStore)(nil)
+)
+
+// route determines which Store holds the given entry, returning the Store and
+// the entry's name within that Store. It returns a nil Store if no Store is
+// mounted at the entry's top-level directory.
+func (ms *mountStore) route(entry string) (Store, string) {
+	e := strings.TrimPrefix(entry, "/")
+	i := strings.Index(e, "/")
+	if i == -1 {
+		return nil, ""
+	}
+	s, ok := ms.mounts[e[:i]]
+	if !ok {
+		return nil, ""
+	}
+	return s, e[i:]
+}
+
+func (ms *mountStore) List() ([]string, error) {
+	var mounts []string
+	for m := range ms.mounts {
+		mounts = append(mounts, m)
+	}
+	sort.Strings(mounts)
+
+	var entries []string
+	for _, m := range mounts {
+		es, err := ms.mounts[m].List()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list %q: %w", m, err)
+		}
+		for _, e := range es {
+			entries = append(entries, "/"+m+e)
+		}
+	}
+	return entries, nil
+}
+
+func (ms *mountStore) Get(entry string) (string, error) {
+	s, e := ms.route(entry)
+	if s == nil {
+		return "", ErrNoEntry
+	}
+	return s.Get(e)
+}
+
+func (ms *mountStore) Put(entry, content string) error {
+	s, e := ms.route(entry)
+	if s == nil {
+		return fmt.Errorf("no store mounted for %q", entry)
+	}
+	return s.Put(e, content)
+}
+
+func (ms *mountStore) PutIf(entry, content, expectedHash string) error {
+	s, e := ms.route(entry)
+	if s == nil {
+		return fmt.Errorf("no store mounted for %q", entry)
+	}
+	return PutIf(s, e, content, expectedHash)
+}
+
+func (ms *mountStore) Delete(entry string) error {
+	s, e := ms.route(entry)
+	if s == nil {
+		return ErrNoEntry
+	}
+	return s.Delete(e)
+}
+
+func (ms *mountStore) Move(oldEntry, newEntry string) error {
+	oldS, oldE := ms.route(oldEntry)
+	if oldS == nil {
+		return ErrNoEntry
+	}
+	newS, newE := ms.route(newEntry)
+	if newS != oldS {
+		return ErrCrossMount
+	}
+	return oldS.Move(oldE, newE)
+}
+
+// Stat implements StatStore. Entries of mounted Stores which don't implement
+// StatStore are described by a zero EntryInfo, without checking that they
+// exist, since doing so would require decrypting them.
+func (ms *mountStore) Stat(entry string) (EntryInfo, error) {
+	s, e := ms.route(entry)
+	if s == nil {
+		return EntryInfo{}, ErrNoEntry
+	}
+	ss, ok := AsStatStore(s)
+	if !ok {
+		return EntryInfo{}, nil
+	}
+	return ss.Stat(e)
+}
+
+// Watch implements WatchStore, reporting changes from each mounted Store which
+// implements WatchStore. Changes to other mounted Stores are not reported.
+func (ms *mountStore) Watch(ctx context.Context) (<-chan Change, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	changes := make(chan Change)
+	var wg sync.WaitGroup
+	for m, s := range ms.mounts {
+		ws, ok := AsWatchStore(s)
+		if !ok {
+			continue
+		}
+		mch, err := ws.Watch(ctx)
+		if err != nil {
+			cancel()
+			wg.Wait()
+			return nil, fmt.Errorf("couldn't watch %q: %w", m, err)
+		}
+		wg.Add(1)
+		go func(m string) {
+			defer wg.Done()
+			for c := range mch {
+				c.Entry = "/" + m + c.Entry
+				select {
+				case changes <- c:
+				case <-ctx.Done():
+				}
+			}
+		}(m)
+	}
+	go func() {
+		defer cancel()
+		<-ctx.Done()
+		wg.Wait()
+		close(changes)
+	}()
+	return changes, nil
+}
+
+// Wipe helps to implement WipeStore, wiping each mounted Store which
+// implements WipeStore.
+func (ms *mountStore) Wipe() {
+	for _, s := range ms.mounts {
+		if ws, ok := AsWipeStore(s); ok {
+			ws.Wipe()
+		}
+	}
+}
+
+// Verify implements VerifyStore, verifying each mounted Store which implements
+// VerifyStore. Problems are prefixed with the mount point of their Store.
+func (ms *mountStore) Verify() ([]string, error) {
+	var mounts []string
+	for m := range ms.mounts {
+		mounts = append(mounts, m)
+	}
+	sort.Strings(mounts)
+	var ps []string
+	for _, m := range mounts {
+		vs, ok := AsVerifyStore(ms.mounts[m])
+		if !ok {
+			continue
+		}
+		mps, err := vs.Verify()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't verify %q: %w", m, err)
+		}
+		for _, p := range mps {
+			ps = append(ps, fmt.Sprintf("%s: %s", m, p))
+		}
+	}
+	return ps, nil
+}
+
+// Stats implements StatsStore, summarizing the entries of each mounted Store
+// which implements StatsStore. Entries of other mounted Stores are not
+// counted.
+func (ms *mountStore) Stats() (StoreStats, error) {
+	var mounts []string
+	for m := range ms.mounts {
+		mounts = append(mounts, m)
+	}
+	sort.Strings(mounts)
+	st := StoreStats{Dirs: []DirStats{{Dir: "/"}}}
+	deepest := -1
+	for _, m := range mounts {
+		ss, ok := AsStatsStore(ms.mounts[m])
+		if !ok {
+			continue
+		}
+		mst, err := ss.Stats()
+		if err != nil {
+			return StoreStats{}, fmt.Errorf("couldn't get stats of %q: %w", m, err)
+		}
+		if mst.Entries == 0 && len(mst.Orphans) == 0 {
+			continue
+		}
+		st.Entries += mst.Entries
+		st.Size += mst.Size
+		if d := strings.Count(mst.DeepestEntry, "/"); mst.DeepestEntry != "" && d > deepest {
+			st.DeepestEntry, deepest = "/"+m+mst.DeepestEntry, d
+		}
+		if !mst.Oldest.IsZero() && (st.Oldest.IsZero() || mst.Oldest.Before(st.Oldest)) {
+			st.Oldest = mst.Oldest
+		}
+		if mst.Newest.After(st.Newest) {
+			st.Newest = mst.Newest
+		}
+		for _, ds := range mst.Dirs {
+			ds.Dir = "/" + m + ds.Dir
+			st.Dirs = append(st.Dirs, ds)
+		}
+		for _, o := range mst.Orphans {
+			st.Orphans = append(st.Orphans, "/"+m+o)
+		}
+	}
+	if st.Entries == 0 {
+		st.Dirs = nil
+	} else {
+		st.Dirs[0].Entries, st.Dirs[0].Size, st.Dirs[0].Newest = st.Entries, st.Size, st.Newest
+	}
+	sort.Slice(st.Dirs, func(i, j int) bool { return st.Dirs[i].Dir < st.Dirs[j].Dir })
+	sort.Strings(st.Orphans)
+	return st, nil
+}
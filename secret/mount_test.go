@@ -0,0 +1,194 @@
+package secret_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestMountStore(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_mount_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	personal := file.NewStore(filepath.Join(dir, "personal"), ".foo", &countingCrypter{})
+	work := file.NewStore(filepath.Join(dir, "work"), ".foo", &countingCrypter{})
+	if err := personal.Put("/bank", "personal content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ms := secret.NewMountStore(map[string]secret.Store{"personal": personal, "work": work})
+
+	// Entries are routed to the store for their mount point.
+	if err := ms.Put("/work/dir/vpn", "work content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	mustGet(t, work, "/dir/vpn", "work content")
+	mustGet(t, ms, "/personal/bank", "personal content")
+	mustGet(t, ms, "/work/dir/vpn", "work content")
+	for _, e := range []string{"/bank", "/other/bank", "/work/bank"} {
+		if _, err := ms.Get(e); !errors.Is(err, secret.ErrNoEntry) {
+			t.Errorf("Get(%q) returned error %v, want %v", e, err, secret.ErrNoEntry)
+		}
+	}
+	if err := ms.Put("/other/entry", "content"); err == nil {
+		t.Errorf("Put to unmounted directory succeeded")
+	}
+
+	// Listing aggregates every store.
+	entries, err := ms.List()
+	if err != nil {
+		t.Fatalf("Could not list: %v", err)
+	}
+	if got, want := fmt.Sprint(entries), fmt.Sprint([]string{"/personal/bank", "/work/dir/vpn"}); got != want {
+		t.Errorf("List() = %s, want %s", got, want)
+	}
+
+	// Entries can be moved within, but not between, stores.
+	if err := ms.Move("/work/dir/vpn", "/work/vpn"); err != nil {
+		t.Errorf("Could not move within store: %v", err)
+	}
+	mustGet(t, work, "/vpn", "work content")
+	if err := ms.Move("/personal/bank", "/work/bank"); err != secret.ErrCrossMount {
+		t.Errorf("Move between stores returned error %v, want %v", err, secret.ErrCrossMount)
+	}
+	mustGet(t, ms, "/personal/bank", "personal content")
+
+	if err := ms.Delete("/personal/bank"); err != nil {
+		t.Errorf("Could not delete: %v", err)
+	}
+	if _, err := personal.Get("/bank"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Get after delete returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+}
+
+func TestMountStoreWatch(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_mount_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	personal := file.NewStore(filepath.Join(dir, "personal"), ".foo", &countingCrypter{})
+	if err := personal.Put("/bank", "personal content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ms := secret.NewMountStore(map[string]secret.Store{"personal": personal})
+	ws, ok := secret.AsWatchStore(ms)
+	if !ok {
+		t.Fatalf("Mount store does not implement secret.WatchStore")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := ws.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Could not watch: %v", err)
+	}
+
+	// Changes are reported with their mount point.
+	if err := personal.Put("/bank", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	select {
+	case c := <-changes:
+		if want := (secret.Change{Entry: "/personal/bank", Op: secret.ChangePut}); c != want {
+			t.Errorf("Got change %+v, want %+v", c, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timed out waiting for change")
+	}
+
+	// Entries are described by their mounted store.
+	ss, _ := secret.AsStatStore(ms)
+	if info, err := ss.Stat("/personal/bank"); err != nil || info.ModTime.IsZero() {
+		t.Errorf("Stat returned (%v, %v), want nonzero modification time", info, err)
+	}
+	if _, err := ss.Stat("/other/bank"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Stat of unmounted entry returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+}
+
+func TestMountStoreVerify(t *testing.T) {
+	t.Parallel()
+
+	// Stores are not accessed, so needn't exist.
+	newStore := func() secret.Store { return file.NewStore("nonexistent", ".foo", &countingCrypter{}) }
+	personal := verifyStore{Store: newStore(), problems: []string{"b.foo: missing", "a.foo: modified"}}
+	work := verifyStore{Store: newStore()}
+	ms := secret.NewMountStore(map[string]secret.Store{"work": work, "personal": personal, "other": newStore()})
+	vs, ok := secret.AsVerifyStore(ms)
+	if !ok {
+		t.Fatalf("Mount store does not implement secret.VerifyStore")
+	}
+	if ps, err := vs.Verify(); err != nil || fmt.Sprint(ps) != "[personal: b.foo: missing personal: a.foo: modified]" {
+		t.Errorf("Verify returned (%q, %v), want problems of personal store", ps, err)
+	}
+}
+
+// verifyStore is a secret.VerifyStore which reports the given problems.
+type verifyStore struct {
+	secret.Store
+	problems []string
+}
+
+func (vs verifyStore) Verify() ([]string, error) { return vs.problems, nil }
+
+func TestMountStoreStats(t *testing.T) {
+	t.Parallel()
+
+	// Stores are not accessed, so needn't exist.
+	newStore := func() secret.Store { return file.NewStore("nonexistent", ".foo", &countingCrypter{}) }
+	old, new := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	personal := statsStore{Store: newStore(), stats: secret.StoreStats{
+		Entries: 2, Size: 30, DeepestEntry: "/dir/b", Oldest: old, Newest: old,
+		Dirs:    []secret.DirStats{{Dir: "/", Entries: 2, Size: 30, Newest: old}, {Dir: "/dir/", Entries: 1, Size: 20, Newest: old}},
+		Orphans: []string{"/tmp"},
+	}}
+	work := statsStore{Store: newStore(), stats: secret.StoreStats{
+		Entries: 1, Size: 5, DeepestEntry: "/a", Oldest: new, Newest: new,
+		Dirs: []secret.DirStats{{Dir: "/", Entries: 1, Size: 5, Newest: new}},
+	}}
+	ms := secret.NewMountStore(map[string]secret.Store{"work": work, "personal": personal, "other": newStore()})
+	ss, ok := secret.AsStatsStore(ms)
+	if !ok {
+		t.Fatalf("Mount store does not implement secret.StatsStore")
+	}
+	st, err := ss.Stats()
+	if err != nil {
+		t.Fatalf("Could not get stats: %v", err)
+	}
+	if st.Entries != 3 || st.Size != 35 || st.DeepestEntry != "/personal/dir/b" || !st.Oldest.Equal(old) || !st.Newest.Equal(new) {
+		t.Errorf("Stats returned %+v, want combined stats of mounted stores", st)
+	}
+	var dirs []string
+	for _, ds := range st.Dirs {
+		dirs = append(dirs, fmt.Sprintf("%s:%d:%d", ds.Dir, ds.Entries, ds.Size))
+	}
+	if want := "[/:3:35 /personal/:2:30 /personal/dir/:1:20 /work/:1:5]"; fmt.Sprint(dirs) != want {
+		t.Errorf("Stats reported directories %v, want %v", dirs, want)
+	}
+	if fmt.Sprint(st.Orphans) != "[/personal/tmp]" {
+		t.Errorf("Stats reported orphans %q, want [/personal/tmp]", st.Orphans)
+	}
+}
+
+// statsStore is a secret.StatsStore which reports the given stats.
+type statsStore struct {
+	secret.Store
+	stats secret.StoreStats
+}
+
+func (ss statsStore) Stats() (secret.StoreStats, error) { return ss.stats, nil }
@@ -6,16 +6,26 @@ package pgp
 
 import (
 	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BranLwyd/harpocrates/secret"
 	"github.com/BranLwyd/harpocrates/secret/file"
 	"github.com/BranLwyd/harpocrates/secret/key_private"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/elgamal"
 	"golang.org/x/crypto/openpgp/packet"
 
 	pb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
@@ -24,27 +34,82 @@ import (
 )
 
 func init() {
-	key_private.RegisterVaultFromKeyFunc(func(location string, key *pb.Key) (secret.Vault, error) {
+	key_private.RegisterVaultFromKeyFunc(func(location string, key *pb.Key, params key_private.VaultParams) (secret.Vault, error) {
 		if k := key.GetPgpKey(); k != nil {
-			return newVault(location, string(k.GetSerializedEntity()))
+			return newVault(location, k, params)
 		}
 		return nil, nil
 	})
+	key_private.RegisterRewrapFunc(func(key *pb.Key, _, _ string, _ key_private.RewrapParams) (*pb.Key, error) {
+		if key.GetPgpKey() != nil {
+			return nil, errors.New("PGP keys cannot be rewrapped; change the passphrase of the PGP entity with standard PGP tools and regenerate the key instead")
+		}
+		return nil, nil
+	})
+	key_private.RegisterFingerprintFunc(func(key *pb.Key, _ string, _ []byte) (string, string, error) {
+		if k := key.GetPgpKey(); k != nil {
+			entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(k.GetSerializedEntity())))
+			if err != nil {
+				return "", "", fmt.Errorf("couldn't read entity: %w", err)
+			}
+			fp, err := fingerprint(entity)
+			if err != nil {
+				return "", "", err
+			}
+			return keyType, fp, nil
+		}
+		return "", "", nil
+	})
+}
+
+// keyType identifies PGP keys in vault markers.
+const keyType = "pgp"
+
+// fingerprint returns the fingerprint of the given entity: the SHA-256 hash of
+// its serialized public primary key.
+func fingerprint(entity *openpgp.Entity) (string, error) {
+	h := sha256.New()
+	if err := entity.PrimaryKey.Serialize(h); err != nil {
+		return "", fmt.Errorf("couldn't serialize public key: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // NewVault creates a new vault using data in an existing directory `baseDir`
-// encrypted with the private key serialized in `serializedEntity`.
-func newVault(baseDir, serializedEntity string) (secret.Vault, error) {
+// encrypted with the private key serialized in `k`. New content is also
+// encrypted to any additional recipients specified by `k`.
+func newVault(baseDir string, k *pb.PGPKey, params key_private.VaultParams) (secret.Vault, error) {
+	if params.Manifest {
+		return nil, errors.New("PGP vaults do not support manifests")
+	}
+	var recipients []*openpgp.Entity
+	for i, se := range k.GetAdditionalRecipients() {
+		r, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(se)))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read additional recipient %d: %w", i, err)
+		}
+		recipients = append(recipients, r)
+	}
 	return &vault{
 		baseDir:          filepath.Clean(baseDir),
-		serializedEntity: serializedEntity,
+		serializedEntity: string(k.GetSerializedEntity()),
+		recipients:       recipients,
+		keepVersions:     params.KeepVersions,
+		trashRetention:   params.TrashRetention,
+		resolveSymlinks:  params.ResolveSymlinks,
+		maxEntrySize:     params.MaxEntrySize,
 	}, nil
 }
 
 // vault implements secret.Vault.
 type vault struct {
-	baseDir          string // base directory containing password entries
-	serializedEntity string // entity used to encrypt/decrypt password entries
+	baseDir          string            // base directory containing password entries
+	serializedEntity string            // entity used to encrypt/decrypt password entries
+	recipients       []*openpgp.Entity // additional entities used to encrypt password entries
+	keepVersions     int               // number of previous versions of each entry to keep
+	trashRetention   time.Duration     // how long to keep deleted entries in the trash
+	resolveSymlinks  bool              // whether to refuse access via symlinks leading outside baseDir
+	maxEntrySize     int               // maximum size of an entry's plaintext content; zero for no limit
 }
 
 func (v *vault) Unlock(passphrase string) (secret.Store, error) {
@@ -62,18 +127,59 @@ func (v *vault) Unlock(passphrase string) (secret.Store, error) {
 			return nil, secret.ErrWrongPassphrase
 		}
 	}
+	c := &crypter{entity: entity, recipients: v.recipients}
+	fp, err := fingerprint(entity)
+	if err != nil {
+		c.Wipe()
+		return nil, err
+	}
+	if err := key_private.CheckMarker(v.baseDir, keyType, fp); err != nil {
+		c.Wipe()
+		return nil, err
+	}
 
-	return file.NewStore(v.baseDir, ".gpg", crypter{entity}), nil
+	return file.NewStore(v.baseDir, ".gpg", c, file.WithVersions(v.keepVersions), file.WithTrash(v.trashRetention), file.WithResolveSymlinks(v.resolveSymlinks), file.WithMaxEntrySize(v.maxEntrySize)), nil
 }
 
-// crypter implements file.Crypter.
+// crypter implements file.WipingCrypter.
 type crypter struct {
-	entity *openpgp.Entity
+	entity     *openpgp.Entity   // entity used to sign, encrypt & decrypt
+	recipients []*openpgp.Entity // additional entities to encrypt to
+
+	mu    sync.RWMutex // protects entity's private keys & wiped
+	wiped bool
 }
 
-func (c crypter) Encrypt(entry, content string) (ciphertext []byte, _ error) {
+var _ file.WipingCrypter = (*crypter)(nil)
+
+// errWiped is returned when using a crypter whose private keys have been wiped.
+var errWiped = errors.New("private key has been wiped")
+
+// Wipe zeroes the entity's decrypted private keys, as far as possible; the
+// openpgp package may retain copies (e.g. precomputed values) which can't be
+// reached.
+func (c *crypter) Wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wiped {
+		return
+	}
+	c.wiped = true
+	wipePrivateKey(c.entity.PrivateKey)
+	for _, sk := range c.entity.Subkeys {
+		wipePrivateKey(sk.PrivateKey)
+	}
+}
+
+func (c *crypter) Encrypt(entry, content string) (ciphertext []byte, _ error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.wiped {
+		return nil, errWiped
+	}
 	var buf bytes.Buffer
-	w, err := openpgp.Encrypt(&buf, []*openpgp.Entity{c.entity}, c.entity, nil, nil)
+	to := append([]*openpgp.Entity{c.entity}, c.recipients...)
+	w, err := openpgp.Encrypt(&buf, to, c.entity, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't start encrypting password content: %w", err)
 	}
@@ -86,8 +192,14 @@ func (c crypter) Encrypt(entry, content string) (ciphertext []byte, _ error) {
 	return buf.Bytes(), nil
 }
 
-func (c crypter) Decrypt(entry string, ciphertext []byte) (content string, _ error) {
-	md, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), openpgp.EntityList{c.entity}, nil, nil)
+func (c *crypter) Decrypt(entry string, ciphertext []byte) (content string, _ error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.wiped {
+		return "", errWiped
+	}
+	keyring := append(openpgp.EntityList{c.entity}, c.recipients...)
+	md, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), keyring, nil, nil)
 	if err != nil {
 		return "", fmt.Errorf("couldn't read PGP message: %w", err)
 	}
@@ -100,3 +212,46 @@ func (c crypter) Decrypt(entry string, ciphertext []byte) (content string, _ err
 	}
 	return string(contentBytes), nil
 }
+
+// wipePrivateKey zeroes the secret values of the given decrypted private key,
+// and marks it encrypted so that it is not used again.
+func wipePrivateKey(pk *packet.PrivateKey) {
+	if pk == nil || pk.Encrypted {
+		return
+	}
+	switch k := pk.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		wipeInt(k.D)
+		for _, p := range k.Primes {
+			wipeInt(p)
+		}
+		wipeInt(k.Precomputed.Dp)
+		wipeInt(k.Precomputed.Dq)
+		wipeInt(k.Precomputed.Qinv)
+		for _, crt := range k.Precomputed.CRTValues {
+			wipeInt(crt.Exp)
+			wipeInt(crt.Coeff)
+			wipeInt(crt.R)
+		}
+	case *dsa.PrivateKey:
+		wipeInt(k.X)
+	case *elgamal.PrivateKey:
+		wipeInt(k.X)
+	case *ecdsa.PrivateKey:
+		wipeInt(k.D)
+	}
+	pk.PrivateKey = nil
+	pk.Encrypted = true
+}
+
+// wipeInt zeroes the words holding the value of x.
+func wipeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	ws := x.Bits()
+	for i := range ws {
+		ws[i] = 0
+	}
+	x.SetInt64(0)
+}
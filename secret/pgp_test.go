@@ -0,0 +1,194 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key_private"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	pb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+func TestAdditionalRecipients(t *testing.T) {
+	t.Parallel()
+
+	alice, bob := newEntity(t, "alice"), newEntity(t, "bob")
+	dir, err := ioutil.TempDir("", "harp_pgp_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write content as alice, with bob as an additional recipient.
+	aliceKey := &pb.PGPKey{
+		SerializedEntity:     serializePrivate(t, alice),
+		AdditionalRecipients: [][]byte{serializePublic(t, bob)},
+	}
+	aliceVault, err := newVault(dir, aliceKey, key_private.VaultParams{})
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	aliceStore, err := aliceVault.Unlock("")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	if err := aliceStore.Put("/entry", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+
+	// Either private key can decrypt the content.
+	for _, e := range []*openpgp.Entity{alice, bob} {
+		k := &pb.PGPKey{SerializedEntity: serializePrivate(t, e)}
+		v, err := newVault(dir, k, key_private.VaultParams{})
+		if err != nil {
+			t.Fatalf("Could not create vault: %v", err)
+		}
+		s, err := v.Unlock("")
+		if err != nil {
+			t.Fatalf("Could not unlock vault: %v", err)
+		}
+		if content, err := s.Get("/entry"); err != nil || content != "content" {
+			t.Errorf("Get as %s = (%q, %v), want (%q, nil)", name(e), content, err, "content")
+		}
+	}
+
+	// Content written without additional recipients can only be decrypted by its author.
+	soloVault, err := newVault(dir, &pb.PGPKey{SerializedEntity: serializePrivate(t, alice)}, key_private.VaultParams{})
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	soloStore, err := soloVault.Unlock("")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	if err := soloStore.Put("/solo", "content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	ciphertext, err := ioutil.ReadFile(filepath.Join(dir, "solo.gpg"))
+	if err != nil {
+		t.Fatalf("Could not read entry file: %v", err)
+	}
+	if _, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), openpgp.EntityList{bob}, nil, nil); err == nil {
+		t.Errorf("Non-recipient could read message")
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "harp_pgp_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := newVault(dir, &pb.PGPKey{SerializedEntity: serializePrivate(t, newEntity(t, "alice"))}, key_private.VaultParams{})
+	if err != nil {
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	s, err := v.Unlock("")
+	if err != nil {
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+
+	// Errors are reported the same way as for any other file-based store.
+	for _, test := range []struct {
+		desc    string
+		f       func() error
+		wantErr error
+	}{
+		{"Get nonexistent", func() error { _, err := s.Get("/nonexistent"); return err }, secret.ErrNoEntry},
+		{"Delete nonexistent", func() error { return s.Delete("/nonexistent") }, secret.ErrNoEntry},
+		{"Get escaping", func() error { _, err := s.Get("/../escape"); return err }, secret.ErrInvalidEntryName},
+		{"Put escaping", func() error { return s.Put("/../escape", "content") }, secret.ErrInvalidEntryName},
+		{"Delete escaping", func() error { return s.Delete("/../escape") }, secret.ErrInvalidEntryName},
+	} {
+		if err := test.f(); !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestWipe(t *testing.T) {
+	t.Parallel()
+
+	alice := newEntity(t, "alice")
+	c := &crypter{entity: alice}
+	ciphertext, err := c.Encrypt("/entry", "content")
+	if err != nil {
+		t.Fatalf("Could not encrypt: %v", err)
+	}
+	d := alice.PrivateKey.PrivateKey.(*rsa.PrivateKey).D
+
+	// After wiping, private key material is zeroed and the crypter refuses to
+	// decrypt; wiping again is safe.
+	c.Wipe()
+	c.Wipe()
+	if d.Sign() != 0 {
+		t.Errorf("Private exponent was not zeroed")
+	}
+	if alice.PrivateKey.PrivateKey != nil || !alice.PrivateKey.Encrypted {
+		t.Errorf("Private key was not discarded")
+	}
+	for _, sk := range alice.Subkeys {
+		if sk.PrivateKey.PrivateKey != nil {
+			t.Errorf("Subkey private key was not discarded")
+		}
+	}
+	if content, err := c.Decrypt("/entry", ciphertext); err == nil {
+		t.Errorf("Decrypt after Wipe = (%q, nil), want error", content)
+	}
+}
+
+func TestBadAdditionalRecipient(t *testing.T) {
+	t.Parallel()
+
+	k := &pb.PGPKey{
+		SerializedEntity:     serializePrivate(t, newEntity(t, "alice")),
+		AdditionalRecipients: [][]byte{[]byte("garbage")},
+	}
+	if _, err := newVault("", k, key_private.VaultParams{}); err == nil {
+		t.Errorf("newVault with invalid additional recipient succeeded")
+	}
+}
+
+func newEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("Could not create entity: %v", err)
+	}
+	return e
+}
+
+func serializePrivate(t *testing.T, e *openpgp.Entity) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := e.SerializePrivate(&buf, nil); err != nil {
+		t.Fatalf("Could not serialize private entity: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func serializePublic(t *testing.T, e *openpgp.Entity) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		t.Fatalf("Could not serialize public entity: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func name(e *openpgp.Entity) string {
+	for n := range e.Identities {
+		return n
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package secret
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewPrefixStore wraps the given Store so that only entries beneath the given
+// directory prefixes (e.g. `/path/to/`) can be accessed. Other entries are
+// omitted from List; Get and Delete return ErrNoEntry for them, and Put
+// returns ErrReadOnly. Move returns ErrNoEntry if the old entry can't be
+// accessed, and ErrReadOnly if the new entry can't be.
+//
+// The returned Store deliberately does not wrap s: the optional interfaces of
+// the stores beneath it (e.g. VersionedStore) can't be found through it, since
+// they would allow access to entries outside the prefixes.
+func NewPrefixStore(s Store, prefixes ...string) Store {
+	ps := &prefixStore{s: s}
+	for _, p := range prefixes {
+		ps.prefixes = append(ps.prefixes, strings.TrimSuffix(p, "/")+"/")
+	}
+	return ps
+}
+
+type prefixStore struct {
+	s        Store
+	prefixes []string
+}
+
+func (ps *prefixStore) allowed(entry string) bool {
+	if hasDotDot(entry) {
+		return false
+	}
+	for _, p := range ps.prefixes {
+		if strings.HasPrefix(entry, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps *prefixStore) List() ([]string, error) {
+	entries, err := ps.s.List()
+	if err != nil {
+		return nil, err
+	}
+	var allowed []string
+	for _, e := range entries {
+		if ps.allowed(e) {
+			allowed = append(allowed, e)
+		}
+	}
+	return allowed, nil
+}
+
+func (ps *prefixStore) Get(entry string) (string, error) {
+	if !ps.allowed(entry) {
+		return "", fmt.Errorf("%w: %q", ErrNoEntry, entry)
+	}
+	return ps.s.Get(entry)
+}
+
+func (ps *prefixStore) Put(entry, content string) error {
+	if !ps.allowed(entry) {
+		return ErrReadOnly
+	}
+	return ps.s.Put(entry, content)
+}
+
+func (ps *prefixStore) PutIf(entry, content, expectedHash string) error {
+	if !ps.allowed(entry) {
+		return ErrReadOnly
+	}
+	return PutIf(ps.s, entry, content, expectedHash)
+}
+
+func (ps *prefixStore) Delete(entry string) error {
+	if !ps.allowed(entry) {
+		return fmt.Errorf("%w: %q", ErrNoEntry, entry)
+	}
+	return ps.s.Delete(entry)
+}
+
+func (ps *prefixStore) Move(oldEntry, newEntry string) error {
+	if !ps.allowed(oldEntry) {
+		return fmt.Errorf("%w: %q", ErrNoEntry, oldEntry)
+	}
+	if !ps.allowed(newEntry) {
+		return ErrReadOnly
+	}
+	return ps.s.Move(oldEntry, newEntry)
+}
+
+// hasDotDot determines if the given entry name has a ".." path element, which
+// could otherwise be used to escape a prefix.
+func hasDotDot(entry string) bool {
+	for _, e := range strings.Split(entry, "/") {
+		if e == ".." {
+			return true
+		}
+	}
+	return false
+}
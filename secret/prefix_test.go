@@ -0,0 +1,66 @@
+package secret_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestPrefixStore(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_prefix_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := file.NewStore(dir, ".foo", &countingCrypter{})
+	for _, e := range []string{"/entry", "/work/entry", "/workshop"} {
+		if err := s.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	ps := secret.NewPrefixStore(s, "/work")
+
+	// Only entries beneath the prefix are visible.
+	mustList(t, ps, "/work/entry")
+	mustGet(t, ps, "/work/entry", "content")
+	for _, test := range []struct {
+		desc    string
+		f       func() error
+		wantErr error
+	}{
+		{"Get outside prefix", func() error { _, err := ps.Get("/entry"); return err }, secret.ErrNoEntry},
+		{"Get sharing prefix", func() error { _, err := ps.Get("/workshop"); return err }, secret.ErrNoEntry},
+		{"Get escaping prefix", func() error { _, err := ps.Get("/work/../entry"); return err }, secret.ErrNoEntry},
+		{"Put outside prefix", func() error { return ps.Put("/new", "content") }, secret.ErrReadOnly},
+		{"Delete outside prefix", func() error { return ps.Delete("/entry") }, secret.ErrNoEntry},
+		{"Move from outside prefix", func() error { return ps.Move("/entry", "/work/moved") }, secret.ErrNoEntry},
+		{"Move out of prefix", func() error { return ps.Move("/work/entry", "/moved") }, secret.ErrReadOnly},
+	} {
+		if err := test.f(); !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+	mustGet(t, s, "/entry", "content")
+
+	// Entries beneath the prefix can be modified as usual.
+	if err := ps.Put("/work/new", "new content"); err != nil {
+		t.Fatalf("Could not put: %v", err)
+	}
+	mustGet(t, s, "/work/new", "new content")
+	if err := ps.Delete("/work/new"); err != nil {
+		t.Fatalf("Could not delete: %v", err)
+	}
+	mustList(t, ps, "/work/entry")
+
+	// The underlying store's optional interfaces can't be reached.
+	if _, ok := secret.AsVersionedStore(ps); ok {
+		t.Errorf("AsVersionedStore of prefix store succeeded")
+	}
+}
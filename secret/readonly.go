@@ -0,0 +1,162 @@
+package secret
+
+import (
+	"strings"
+	"time"
+)
+
+// NewReadOnlyStore wraps the given Store so that entries can't be modified.
+// If no prefixes are given, no entries can be modified; otherwise, only
+// entries beneath the given directory prefixes (e.g. `/path/to/`) can't be
+// modified. Put, Delete, and Move return ErrReadOnly for read-only entries, as
+// do changes made via the TrashStore, EmptyDirStore & AttachmentStore found
+// beneath the returned Store by AsTrashStore and friends.
+func NewReadOnlyStore(s Store, prefixes ...string) Store {
+	ros := &readOnlyStore{s: s}
+	for _, p := range prefixes {
+		ros.prefixes = append(ros.prefixes, strings.TrimSuffix(p, "/")+"/")
+	}
+	return ros
+}
+
+// IsReadOnly determines if the given entry can't be modified because it is
+// read-only in some Store in the chain of stores wrapped by s (including s
+// itself).
+func IsReadOnly(s Store, entry string) bool {
+	ro, ok := Find(s, func(s Store) bool {
+		_, ok := s.(*readOnlyStore)
+		return ok
+	}).(*readOnlyStore)
+	return ok && ro.readOnly(entry)
+}
+
+type readOnlyStore struct {
+	s        Store
+	prefixes []string // if empty, the entire store is read-only
+}
+
+func (ros *readOnlyStore) readOnly(entry string) bool {
+	if len(ros.prefixes) == 0 {
+		return true
+	}
+	for _, p := range ros.prefixes {
+		if strings.HasPrefix(entry+"/", p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ros *readOnlyStore) Unwrap() Store                    { return ros.s }
+func (ros *readOnlyStore) List() ([]string, error)          { return ros.s.List() }
+func (ros *readOnlyStore) Get(entry string) (string, error) { return ros.s.Get(entry) }
+
+func (ros *readOnlyStore) Put(entry, content string) error {
+	if ros.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return ros.s.Put(entry, content)
+}
+
+func (ros *readOnlyStore) PutIf(entry, content, expectedHash string) error {
+	if ros.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return PutIf(ros.s, entry, content, expectedHash)
+}
+
+func (ros *readOnlyStore) Delete(entry string) error {
+	if ros.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return ros.s.Delete(entry)
+}
+
+func (ros *readOnlyStore) Move(oldEntry, newEntry string) error {
+	if ros.readOnly(oldEntry) || ros.readOnly(newEntry) {
+		return ErrReadOnly
+	}
+	return ros.s.Move(oldEntry, newEntry)
+}
+
+func (ros *readOnlyStore) WrapTrash(ts TrashStore) TrashStore {
+	return &readOnlyTrashStore{ros, ts}
+}
+
+func (ros *readOnlyStore) WrapEmptyDir(eds EmptyDirStore) EmptyDirStore {
+	return &readOnlyEmptyDirStore{ros, eds}
+}
+
+func (ros *readOnlyStore) WrapAttachments(as AttachmentStore) AttachmentStore {
+	return &readOnlyAttachmentStore{ros, as}
+}
+
+type readOnlyTrashStore struct {
+	*readOnlyStore
+	ts TrashStore
+}
+
+func (rots *readOnlyTrashStore) ListTrash() ([]TrashedEntry, error) { return rots.ts.ListTrash() }
+
+func (rots *readOnlyTrashStore) Restore(entry string) error {
+	if rots.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return rots.ts.Restore(entry)
+}
+
+// PurgeTrash returns ErrReadOnly if any entry in the trash is read-only.
+func (rots *readOnlyTrashStore) PurgeTrash(olderThan time.Duration) error {
+	if len(rots.prefixes) == 0 {
+		return ErrReadOnly
+	}
+	trashed, err := rots.ts.ListTrash()
+	if err != nil {
+		return err
+	}
+	for _, te := range trashed {
+		if rots.readOnly(te.Entry) {
+			return ErrReadOnly
+		}
+	}
+	return rots.ts.PurgeTrash(olderThan)
+}
+
+type readOnlyEmptyDirStore struct {
+	*readOnlyStore
+	eds EmptyDirStore
+}
+
+func (roeds *readOnlyEmptyDirStore) EnsureDir(dir string) error {
+	if roeds.readOnly(strings.TrimSuffix(dir, "/")) {
+		return ErrReadOnly
+	}
+	return roeds.eds.EnsureDir(dir)
+}
+
+type readOnlyAttachmentStore struct {
+	*readOnlyStore
+	as AttachmentStore
+}
+
+func (roas *readOnlyAttachmentStore) ListAttachments(entry string) ([]string, error) {
+	return roas.as.ListAttachments(entry)
+}
+
+func (roas *readOnlyAttachmentStore) GetAttachment(entry, filename string) ([]byte, error) {
+	return roas.as.GetAttachment(entry, filename)
+}
+
+func (roas *readOnlyAttachmentStore) PutAttachment(entry, filename string, content []byte) error {
+	if roas.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return roas.as.PutAttachment(entry, filename, content)
+}
+
+func (roas *readOnlyAttachmentStore) DeleteAttachment(entry, filename string) error {
+	if roas.readOnly(entry) {
+		return ErrReadOnly
+	}
+	return roas.as.DeleteAttachment(entry, filename)
+}
@@ -0,0 +1,172 @@
+package secret_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestReadOnlyStore(t *testing.T) {
+	t.Parallel()
+
+	// Initialization.
+	dir, err := ioutil.TempDir("", "harp_readonly_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := file.NewStore(dir, ".foo", &attachmentCrypter{}, file.WithTrash(time.Hour))
+	for _, e := range []string{"/entry", "/work/entry", "/workshop", "/trashed", "/work/trashed"} {
+		if err := s.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	for _, e := range []string{"/trashed", "/work/trashed"} {
+		if err := s.Delete(e); err != nil {
+			t.Fatalf("Could not delete: %v", err)
+		}
+	}
+	as, ok := secret.AsAttachmentStore(s)
+	if !ok {
+		t.Fatalf("File store is not an AttachmentStore")
+	}
+	if err := as.PutAttachment("/entry", "file", []byte("attachment")); err != nil {
+		t.Fatalf("Could not put attachment: %v", err)
+	}
+
+	// A store without prefixes is entirely read-only.
+	ros := secret.NewReadOnlyStore(s)
+	mustGet(t, ros, "/entry", "content")
+	if err := ros.Put("/entry", "new content"); err != secret.ErrReadOnly {
+		t.Errorf("Put returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := ros.Put("/new", "content"); err != secret.ErrReadOnly {
+		t.Errorf("Put of new entry returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := secret.PutIf(ros, "/entry", "new content", secret.ContentHash("content")); err != secret.ErrReadOnly {
+		t.Errorf("PutIf returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := ros.Delete("/entry"); err != secret.ErrReadOnly {
+		t.Errorf("Delete returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := ros.Move("/entry", "/moved"); err != secret.ErrReadOnly {
+		t.Errorf("Move returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	mustGet(t, ros, "/entry", "content")
+
+	// Changes can't be made via the optional interfaces of wrapped stores,
+	// either.
+	ts, ok := secret.AsTrashStore(ros)
+	if !ok {
+		t.Fatalf("Read-only store is not a TrashStore")
+	}
+	if err := ts.Restore("/trashed"); err != secret.ErrReadOnly {
+		t.Errorf("Restore returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := ts.PurgeTrash(0); err != secret.ErrReadOnly {
+		t.Errorf("PurgeTrash returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := ts.Put("/entry", "new content"); err != secret.ErrReadOnly {
+		t.Errorf("Put via TrashStore returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if trashed, err := ts.ListTrash(); err != nil || len(trashed) != 2 {
+		t.Errorf("ListTrash = (%v, %v), want 2 entries", trashed, err)
+	}
+	if as, ok = secret.AsAttachmentStore(ros); !ok {
+		t.Fatalf("Read-only store is not an AttachmentStore")
+	}
+	if err := as.PutAttachment("/entry", "other", []byte("attachment")); err != secret.ErrReadOnly {
+		t.Errorf("PutAttachment returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if err := as.DeleteAttachment("/entry", "file"); err != secret.ErrReadOnly {
+		t.Errorf("DeleteAttachment returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if got, err := as.GetAttachment("/entry", "file"); err != nil || string(got) != "attachment" {
+		t.Errorf("GetAttachment = (%q, %v), want (%q, nil)", got, err, "attachment")
+	}
+	eds, ok := secret.AsEmptyDirStore(ros)
+	if !ok {
+		t.Fatalf("Read-only store is not an EmptyDirStore")
+	}
+	if err := eds.EnsureDir("/dir/"); err != secret.ErrReadOnly {
+		t.Errorf("EnsureDir returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("EnsureDir via read-only store created directory (stat error %v)", err)
+	}
+
+	// A store with prefixes is read-only only beneath those prefixes.
+	ros = secret.NewReadOnlyStore(secret.NewCachingStore(s, 0, 0), "/work")
+	for _, test := range []struct {
+		entry        string
+		wantReadOnly bool
+	}{
+		{"/entry", false},
+		{"/work/entry", true},
+		{"/work/sub/entry", true},
+		{"/workshop", false},
+	} {
+		if got := secret.IsReadOnly(ros, test.entry); got != test.wantReadOnly {
+			t.Errorf("IsReadOnly(%q) = %v, want %v", test.entry, got, test.wantReadOnly)
+		}
+		wantErr := error(nil)
+		if test.wantReadOnly {
+			wantErr = secret.ErrReadOnly
+		}
+		if err := ros.Put(test.entry, "new content"); err != wantErr {
+			t.Errorf("Put(%q) returned error %v, want %v", test.entry, err, wantErr)
+		}
+		if err := secret.PutIf(ros, test.entry, "newer content", secret.ContentHash("new content")); !errors.Is(err, wantErr) {
+			t.Errorf("PutIf(%q) returned error %v, want %v", test.entry, err, wantErr)
+		}
+	}
+	if err := ros.Move("/entry", "/work/entry2"); err != secret.ErrReadOnly {
+		t.Errorf("Move into read-only prefix returned error %v, want %v", err, secret.ErrReadOnly)
+	}
+	ts, _ = secret.AsTrashStore(ros)
+	as, _ = secret.AsAttachmentStore(ros)
+	eds, _ = secret.AsEmptyDirStore(ros)
+	for _, test := range []struct {
+		desc    string
+		f       func() error
+		wantErr error
+	}{
+		{"Restore beneath prefix", func() error { return ts.Restore("/work/trashed") }, secret.ErrReadOnly},
+		{"PurgeTrash with entry beneath prefix", func() error { return ts.PurgeTrash(0) }, secret.ErrReadOnly},
+		{"PutAttachment beneath prefix", func() error { return as.PutAttachment("/work/entry", "file", nil) }, secret.ErrReadOnly},
+		{"EnsureDir beneath prefix", func() error { return eds.EnsureDir("/work/sub/") }, secret.ErrReadOnly},
+		{"Restore", func() error { return ts.Restore("/trashed") }, nil},
+		{"PutAttachment", func() error { return as.PutAttachment("/workshop", "file", nil) }, nil},
+		{"DeleteAttachment", func() error { return as.DeleteAttachment("/entry", "file") }, nil},
+		{"EnsureDir", func() error { return eds.EnsureDir("/dir/") }, nil},
+	} {
+		if err := test.f(); err != test.wantErr {
+			t.Errorf("[%s] got error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+	if secret.IsReadOnly(s, "/work/entry") {
+		t.Errorf("IsReadOnly of unwrapped store = true, want false")
+	}
+}
+
+// attachmentCrypter is a trivial file.AttachmentCrypter.
+type attachmentCrypter struct{ countingCrypter }
+
+func (*attachmentCrypter) EncryptAttachments(entryName string, attachments map[string][]byte) ([]byte, error) {
+	return json.Marshal(attachments)
+}
+
+func (*attachmentCrypter) DecryptAttachments(entryName string, ciphertext []byte) (map[string][]byte, error) {
+	var atts map[string][]byte
+	if err := json.Unmarshal(ciphertext, &atts); err != nil {
+		return nil, err
+	}
+	return atts, nil
+}
@@ -3,12 +3,51 @@
 package secret
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Errors returned by Vault and Store implementations. Implementations may wrap
+// these errors with additional context, so they should be checked with
+// errors.Is rather than compared directly.
 var (
 	ErrWrongPassphrase = errors.New("wrong passphrase")
 	ErrNoEntry         = errors.New("no such password store entry")
+	ErrEntryExists     = errors.New("password store entry already exists")
+	ErrReadOnly        = errors.New("password store entry is read-only")
+	ErrCrossMount      = errors.New("password store entries can't be moved between mounts")
+
+	// ErrInvalidEntryName is returned when an entry or directory name is
+	// malformed, e.g. because it would escape the store.
+	ErrInvalidEntryName = errors.New("invalid password store entry name")
+
+	// ErrEntryTooLarge is returned when the content being written to an
+	// entry exceeds the store's configured maximum entry size.
+	ErrEntryTooLarge = errors.New("password store entry is too large")
+
+	// ErrWrongKey is returned when unlocking a vault whose directory was
+	// initialized (see key.InitVault) for a different key.
+	ErrWrongKey = errors.New("password store was initialized for a different key")
+
+	// ErrTampered is returned when a store's storage has been modified
+	// other than via the store, such that it can no longer be verified
+	// (see VerifyStore).
+	ErrTampered = errors.New("password store has been tampered with")
+
+	// ErrConflict is returned by PutIf when an entry's current content is
+	// not the content the caller based its change on, e.g. because the
+	// entry was changed concurrently.
+	ErrConflict = errors.New("password store entry was changed concurrently")
+
+	// ErrBatchPending is returned by Batch when the commit of an earlier
+	// batch was interrupted, and must be completed with ResumeBatch first.
+	ErrBatchPending = errors.New("password store has an interrupted batch")
 )
 
 // Vault represents a passphrase-locked "vault" of secret
@@ -54,4 +93,672 @@ type Store interface {
 	// the format returned by List(). If there is no entry with the given
 	// name, ErrNoEntry is returned.
 	Delete(entry string) error
+
+	// Move renames an entry. The entry names should conform to the format
+	// returned by List(). If there is no entry with the old name,
+	// ErrNoEntry is returned; if there is already an entry with the new
+	// name, ErrEntryExists is returned.
+	Move(oldEntry, newEntry string) error
+}
+
+// Version describes a previous version of an entry's content.
+type Version struct {
+	ID   string    // opaque identifier, used to retrieve the version's content
+	Time time.Time // time at which this version was replaced
+}
+
+// VersionedStore is a Store which retains previous versions of entries when
+// they are updated.
+type VersionedStore interface {
+	Store
+
+	// Versions returns the previous versions of an entry, newest first.
+	// An entry with no previous versions returns an empty list.
+	Versions(entry string) ([]Version, error)
+
+	// GetVersion gets the content of a previous version of an entry,
+	// given the version's ID as returned by Versions. If there is no such
+	// version, ErrNoEntry is returned.
+	GetVersion(entry, id string) (content string, _ error)
+}
+
+// TrashedEntry describes an entry which has been deleted, but not yet purged
+// from the trash.
+type TrashedEntry struct {
+	Entry string    // name of the deleted entry
+	Time  time.Time // time at which the entry was deleted
+}
+
+// TrashStore is a Store which moves deleted entries to a trash, from which
+// they can be restored, rather than removing them immediately.
+type TrashStore interface {
+	Store
+
+	// ListTrash returns the entries in the trash, most recently deleted
+	// first. An entry deleted more than once appears once per deletion.
+	ListTrash() ([]TrashedEntry, error)
+
+	// Restore restores the most recently deleted copy of an entry from the
+	// trash. If there is no such entry in the trash, ErrNoEntry is
+	// returned; if an entry with the same name currently exists,
+	// ErrEntryExists is returned.
+	Restore(entry string) error
+
+	// PurgeTrash permanently removes entries which were deleted longer ago
+	// than the given duration.
+	PurgeTrash(olderThan time.Duration) error
+}
+
+// DirStore is a Store which can list the contents of a single directory
+// without listing every entry in the store.
+type DirStore interface {
+	Store
+
+	// ListDir returns the entries and subdirectories directly within the
+	// given directory, which is an absolute slash-separated path ending
+	// with a slash (e.g. `/path/to/`). Names are returned as absolute
+	// paths, without trailing slashes. A nonexistent directory has no
+	// entries or subdirectories.
+	ListDir(dir string) (entries, subdirs []string, _ error)
+}
+
+// EmptyDirStore is a Store which can hold directories containing no entries.
+type EmptyDirStore interface {
+	Store
+
+	// EnsureDir creates the given directory, which is an absolute
+	// slash-separated path ending with a slash (e.g. `/path/to/`), if it
+	// does not already exist. The directory is kept, and listed by
+	// ListDir if the store is a DirStore, even while it holds no entries.
+	EnsureDir(dir string) error
+}
+
+// AttachmentStore is a Store which can hold files, such as recovery codes or
+// key files, alongside entries. Attachments are named by a filename, which
+// must be nonempty and must not contain slashes; their content may be
+// arbitrary bytes. Attachments are kept with their entry when it is moved or
+// deleted, but are not included in previous versions of the entry.
+type AttachmentStore interface {
+	Store
+
+	// ListAttachments returns the filenames of the attachments of an
+	// entry, sorted. An entry with no attachments returns an empty list.
+	ListAttachments(entry string) (filenames []string, _ error)
+
+	// GetAttachment gets the content of an attachment of an entry. If
+	// there is no such attachment, ErrNoEntry is returned.
+	GetAttachment(entry, filename string) (content []byte, _ error)
+
+	// PutAttachment adds an attachment to an entry, replacing any existing
+	// attachment with the same filename. If there is no such entry,
+	// ErrNoEntry is returned.
+	PutAttachment(entry, filename string, content []byte) error
+
+	// DeleteAttachment removes an attachment from an entry. If there is no
+	// such attachment, ErrNoEntry is returned.
+	DeleteAttachment(entry, filename string) error
+}
+
+// EntryInfo describes an entry, without its content.
+type EntryInfo struct {
+	ModTime time.Time // time at which the entry's content was last changed; zero if unknown
+	Size    int64     // size of the entry's stored (encrypted) content, in bytes; zero if unknown
+}
+
+// StatStore is a Store which can describe an entry without decrypting it.
+type StatStore interface {
+	Store
+
+	// Stat returns information about an entry. If there is no such entry,
+	// ErrNoEntry is returned.
+	Stat(entry string) (EntryInfo, error)
+}
+
+// StoreStats summarizes a store's entries, as described by their storage
+// alone.
+type StoreStats struct {
+	Entries        int       // number of entries
+	Size           int64     // total size of the entries' stored (encrypted) content, in bytes
+	DeepestEntry   string    // the entry nested within the most directories; empty if there are no entries
+	Oldest, Newest time.Time // modification times of the least & most recently changed entries; zero if there are no entries
+
+	// Dirs summarizes the entries beneath each directory holding any
+	// entries, including those in its subdirectories, sorted by directory.
+	Dirs []DirStats
+
+	// Orphans are the files in the store's storage which are neither
+	// entries nor used by the store, such as temporary files left by
+	// interrupted writes or files written by other tools, as paths
+	// relative to the store's root (e.g. `/dir/file`), in sorted order.
+	Orphans []string
+}
+
+// DirStats summarizes the entries beneath a directory.
+type DirStats struct {
+	Dir     string    // the directory, ending with a slash (e.g. `/path/to/`)
+	Entries int       // number of entries beneath the directory
+	Size    int64     // total size of the entries' stored content, in bytes
+	Newest  time.Time // modification time of the most recently changed entry
+}
+
+// StatsStore is a Store which can summarize its entries without decrypting
+// them.
+type StatsStore interface {
+	Store
+
+	// Stats summarizes the store's entries.
+	Stats() (StoreStats, error)
+}
+
+// ChangeOp describes the kind of change made to an entry.
+type ChangeOp int
+
+// Kinds of change reported by WatchStore.
+const (
+	ChangePut    ChangeOp = iota // the entry was created or its content was updated
+	ChangeDelete                 // the entry was removed (or moved away)
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Change describes a change made to a Store's entries.
+type Change struct {
+	// Entry is the name of the changed entry. If a whole directory was
+	// removed, Entry is the name of the directory, ending with a slash
+	// (e.g. `/path/to/`), and every entry beneath it should be considered
+	// deleted.
+	Entry string
+	Op    ChangeOp
+}
+
+// WatchStore is a Store which can report changes to its entries, including
+// changes made by other means than the Store itself (for example, by another
+// process sharing the same storage).
+type WatchStore interface {
+	Store
+
+	// Watch begins watching for changes, which are sent on the returned
+	// channel until ctx is canceled, at which point the channel is closed.
+	// Changes may be coalesced or reported more than once; callers should
+	// treat a Change as a hint to re-read the named entry. The channel must
+	// be drained promptly, or the watch may fall behind.
+	Watch(ctx context.Context) (<-chan Change, error)
+}
+
+// WipeStore is a Store which holds decrypted key material in memory, and can
+// zero it once the Store is no longer needed.
+type WipeStore interface {
+	Store
+
+	// Wipe zeroes any key material held by the Store. Afterwards, entries
+	// can no longer be decrypted or encrypted via the Store. Wipe may be
+	// called more than once.
+	Wipe()
+}
+
+// VerifyStore is a Store which can detect tampering with its storage, such as
+// the removal, substitution or rollback of entries by someone with direct
+// access to it.
+type VerifyStore interface {
+	Store
+
+	// Verify checks the store's storage against the changes made via the
+	// store, returning a description of each problem found (e.g. a
+	// missing, unexpected or modified entry). If no problems are found,
+	// the storage has not been tampered with.
+	Verify() (problems []string, _ error)
+}
+
+// ConditionalStore is a Store which can check an entry's current content
+// before replacing it, atomically with the write.
+type ConditionalStore interface {
+	Store
+
+	// PutIf is like Put, but only replaces the entry if its current
+	// content has the given hash (see ContentHash); if expectedHash is
+	// empty, the entry must not exist. Otherwise, the entry is unchanged
+	// & ErrConflict is returned.
+	PutIf(entry, content, expectedHash string) error
+}
+
+// ContentHash returns the hash of an entry's content used by PutIf: the hex
+// SHA-256 of the content.
+func ContentHash(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(h[:])
+}
+
+// PutIf puts the given content to the given entry of s, but only if the
+// entry's current content has the given hash (see ConditionalStore). If s is
+// not a ConditionalStore, the content is checked via Get before the Put, so
+// a concurrent change between the two is not detected.
+func PutIf(s Store, entry, content, expectedHash string) error {
+	if cs, ok := s.(ConditionalStore); ok {
+		return cs.PutIf(entry, content, expectedHash)
+	}
+	if err := CheckContent(s, entry, expectedHash); err != nil {
+		return err
+	}
+	return s.Put(entry, content)
+}
+
+// CheckContent returns an error wrapping ErrConflict unless the current
+// content of the given entry of s has the given hash, or, if expectedHash is
+// empty, the entry does not exist. It helps to implement ConditionalStore.
+func CheckContent(s Store, entry, expectedHash string) error {
+	content, err := s.Get(entry)
+	switch {
+	case errors.Is(err, ErrNoEntry):
+		if expectedHash != "" {
+			return fmt.Errorf("%w: %q no longer exists", ErrConflict, entry)
+		}
+		return nil
+	case err != nil:
+		return err
+	case expectedHash == "":
+		return fmt.Errorf("%w: %q already exists", ErrConflict, entry)
+	case ContentHash(content) != expectedHash:
+		return fmt.Errorf("%w: %q", ErrConflict, entry)
+	}
+	return nil
+}
+
+// TreeStore is a Store which can delete or move every entry beneath a
+// directory in a single operation.
+type TreeStore interface {
+	Store
+
+	// DeleteTree deletes every entry beneath the given directory, which
+	// is an absolute slash-separated path ending with a slash (e.g.
+	// `/path/to/`), along with the directory itself. It returns the number
+	// of entries deleted. If the operation fails partway, the error is a
+	// *TreeError describing which entries were deleted.
+	DeleteTree(prefix string) (int, error)
+
+	// MoveTree moves every entry beneath the directory oldPrefix to the
+	// same relative name beneath the directory newPrefix, returning the
+	// number of entries moved. Neither directory may contain the other,
+	// except that newPrefix may be an ancestor of oldPrefix. If any
+	// destination entry already exists, no entries are moved and
+	// ErrEntryExists is returned. If the operation fails partway, the
+	// error is a *TreeError describing which entries were moved.
+	MoveTree(oldPrefix, newPrefix string) (int, error)
+}
+
+// TreeError is returned by DeleteTree & MoveTree when an operation on a
+// directory fails after some of its entries have been processed. Repeating
+// the operation processes the remaining entries.
+type TreeError struct {
+	Done []string // the (original) names of the entries processed before the failure
+	Err  error    // the error which stopped the operation
+}
+
+func (te *TreeError) Error() string {
+	return fmt.Sprintf("failed after processing %d entries: %v", len(te.Done), te.Err)
+}
+
+func (te *TreeError) Unwrap() error { return te.Err }
+
+// DeleteTree deletes every entry of s beneath the given directory (see
+// TreeStore). If s is not a TreeStore, the entries are listed & deleted one at
+// a time via s.
+func DeleteTree(s Store, prefix string) (int, error) {
+	if ts, ok := s.(TreeStore); ok {
+		return ts.DeleteTree(prefix)
+	}
+	if err := CheckTreePrefix(prefix); err != nil {
+		return 0, err
+	}
+	entries, err := treeEntries(s, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var done []string
+	for _, e := range entries {
+		if err := s.Delete(e); err != nil {
+			return len(done), &TreeError{Done: done, Err: err}
+		}
+		done = append(done, e)
+	}
+	return len(done), nil
+}
+
+// MoveTree moves every entry of s beneath the directory oldPrefix to beneath
+// the directory newPrefix (see TreeStore). If s is not a TreeStore, the
+// entries are listed & moved one at a time via s; the check that no
+// destination entry exists is not atomic with the moves.
+func MoveTree(s Store, oldPrefix, newPrefix string) (int, error) {
+	if ts, ok := s.(TreeStore); ok {
+		return ts.MoveTree(oldPrefix, newPrefix)
+	}
+	if err := CheckTreeMove(oldPrefix, newPrefix); err != nil {
+		return 0, err
+	}
+	all, err := s.List()
+	if err != nil {
+		return 0, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	exists := make(map[string]bool, len(all))
+	for _, e := range all {
+		exists[e] = true
+	}
+	entries, err := treeEntries(s, oldPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var collisions []string
+	for _, e := range entries {
+		if ne := newPrefix + strings.TrimPrefix(e, oldPrefix); exists[ne] {
+			collisions = append(collisions, ne)
+		}
+	}
+	if len(collisions) > 0 {
+		return 0, fmt.Errorf("%w: %q", ErrEntryExists, collisions)
+	}
+	var done []string
+	for _, e := range entries {
+		if err := s.Move(e, newPrefix+strings.TrimPrefix(e, oldPrefix)); err != nil {
+			return len(done), &TreeError{Done: done, Err: err}
+		}
+		done = append(done, e)
+	}
+	return len(done), nil
+}
+
+// Tx stages changes to the entries of a BatchStore. Staged changes are not
+// visible via the store until they are committed.
+type Tx interface {
+	// Put stages setting the content of an entry, as by Store.Put.
+	Put(entry, content string) error
+
+	// Delete stages deleting an entry, as by Store.Delete. If there is
+	// no such entry, and none has been staged, ErrNoEntry is returned.
+	Delete(entry string) error
+}
+
+// BatchStore is a Store which can commit changes to many entries together.
+type BatchStore interface {
+	Store
+
+	// Batch calls f with a Tx staging changes to the store. If f returns
+	// nil, the staged changes are committed; otherwise, they are
+	// discarded & f's error is returned. Committing is atomic only on a
+	// best-effort basis: the staged changes are recorded in a journal,
+	// then applied one at a time. If the commit is interrupted, e.g. by a
+	// crash, some changes may have been applied; the error is a
+	// *BatchError, and ResumeBatch applies the rest. Until then, Batch
+	// returns ErrBatchPending.
+	Batch(f func(tx Tx) error) error
+
+	// ResumeBatch applies the remaining changes of a batch whose commit
+	// was interrupted, returning the number of changes in the batch. If no
+	// commit was interrupted, it does nothing, & staged changes left
+	// behind by an uncommitted batch are discarded.
+	ResumeBatch() (int, error)
+}
+
+// BatchError is returned by Batch when a commit fails after some of its
+// changes have been applied. ResumeBatch applies the remaining changes.
+type BatchError struct {
+	Done  int   // number of changes applied before the failure
+	Total int   // number of changes in the batch
+	Err   error // the error which stopped the commit
+}
+
+func (be *BatchError) Error() string {
+	return fmt.Sprintf("batch interrupted after applying %d of %d changes (resume to apply the rest): %v", be.Done, be.Total, be.Err)
+}
+
+func (be *BatchError) Unwrap() error { return be.Err }
+
+// Batch commits the changes staged by f to s together (see BatchStore). If s
+// is not a BatchStore, changes are applied directly to s as they are staged,
+// so an error from f does not discard changes staged before it.
+func Batch(s Store, f func(tx Tx) error) error {
+	if bs, ok := s.(BatchStore); ok {
+		return bs.Batch(f)
+	}
+	return f(s)
+}
+
+// ResumeBatch applies the remaining changes of an interrupted batch of s (see
+// BatchStore). If s is not a BatchStore, it has no batches to resume, and
+// ResumeBatch does nothing.
+func ResumeBatch(s Store) (int, error) {
+	if bs, ok := s.(BatchStore); ok {
+		return bs.ResumeBatch()
+	}
+	return 0, nil
+}
+
+// treeEntries returns the entries of s beneath the given directory, in sorted
+// order. It returns ErrNoEntry if there are none.
+func treeEntries(s Store, prefix string) ([]string, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list entries: %w", err)
+	}
+	var entries []string
+	for _, e := range all {
+		if strings.HasPrefix(e, prefix) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: directory %q", ErrNoEntry, prefix)
+	}
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// CheckTreePrefix returns an error wrapping ErrInvalidEntryName unless prefix
+// names a directory which DeleteTree & MoveTree may operate on: an absolute
+// slash-separated path ending with a slash, other than the root directory.
+// It helps to implement TreeStore.
+func CheckTreePrefix(prefix string) error {
+	if prefix == "/" || !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "//") {
+		return fmt.Errorf("%w: directory %q", ErrInvalidEntryName, prefix)
+	}
+	for _, c := range strings.Split(prefix, "/") {
+		if c == "." || c == ".." {
+			return fmt.Errorf("%w: directory %q", ErrInvalidEntryName, prefix)
+		}
+	}
+	return nil
+}
+
+// CheckTreeMove returns an error wrapping ErrInvalidEntryName unless the
+// entries beneath oldPrefix may be moved beneath newPrefix by MoveTree. The
+// new directory may be the root directory, or any other ancestor of the old
+// directory, but not the old directory itself or one of its descendants. It
+// helps to implement TreeStore.
+func CheckTreeMove(oldPrefix, newPrefix string) error {
+	if err := CheckTreePrefix(oldPrefix); err != nil {
+		return err
+	}
+	if newPrefix != "/" {
+		if err := CheckTreePrefix(newPrefix); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(newPrefix, oldPrefix) {
+		return fmt.Errorf("%w: can't move directory %q into itself (%q)", ErrInvalidEntryName, oldPrefix, newPrefix)
+	}
+	return nil
+}
+
+// Unwrap returns the Store wrapped by s, if s wraps another Store by
+// implementing an `Unwrap() Store` method; otherwise, it returns nil.
+func Unwrap(s Store) Store {
+	u, ok := s.(interface{ Unwrap() Store })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// Find returns the first Store in the chain of stores wrapped by s (including
+// s itself) for which match returns true, or nil if there is no such Store.
+func Find(s Store, match func(Store) bool) Store {
+	for ; s != nil; s = Unwrap(s) {
+		if match(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// TrashWrapper is implemented by Stores which wrap another Store (see Unwrap),
+// and which must handle changes made via a TrashStore beneath them, e.g. to
+// refuse or record them.
+type TrashWrapper interface {
+	// WrapTrash returns a TrashStore which makes changes to ts as if they
+	// were made via the wrapping Store.
+	WrapTrash(ts TrashStore) TrashStore
+}
+
+// EmptyDirWrapper is like TrashWrapper, for EmptyDirStores.
+type EmptyDirWrapper interface {
+	WrapEmptyDir(eds EmptyDirStore) EmptyDirStore
+}
+
+// AttachmentWrapper is like TrashWrapper, for AttachmentStores.
+type AttachmentWrapper interface {
+	WrapAttachments(as AttachmentStore) AttachmentStore
+}
+
+// AsTrashStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements TrashStore. The TrashStore is wrapped
+// by each TrashWrapper above it in the chain.
+func AsTrashStore(s Store) (TrashStore, bool) {
+	var ws []TrashWrapper
+	for ; s != nil; s = Unwrap(s) {
+		if ts, ok := s.(TrashStore); ok {
+			for i := len(ws) - 1; i >= 0; i-- {
+				ts = ws[i].WrapTrash(ts)
+			}
+			return ts, true
+		}
+		if w, ok := s.(TrashWrapper); ok {
+			ws = append(ws, w)
+		}
+	}
+	return nil, false
+}
+
+// AsVersionedStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements VersionedStore.
+func AsVersionedStore(s Store) (VersionedStore, bool) {
+	vs, ok := Find(s, func(s Store) bool {
+		_, ok := s.(VersionedStore)
+		return ok
+	}).(VersionedStore)
+	return vs, ok
+}
+
+// AsDirStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements DirStore.
+func AsDirStore(s Store) (DirStore, bool) {
+	ds, ok := Find(s, func(s Store) bool {
+		_, ok := s.(DirStore)
+		return ok
+	}).(DirStore)
+	return ds, ok
+}
+
+// AsEmptyDirStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements EmptyDirStore. The EmptyDirStore is
+// wrapped by each EmptyDirWrapper above it in the chain.
+func AsEmptyDirStore(s Store) (EmptyDirStore, bool) {
+	var ws []EmptyDirWrapper
+	for ; s != nil; s = Unwrap(s) {
+		if eds, ok := s.(EmptyDirStore); ok {
+			for i := len(ws) - 1; i >= 0; i-- {
+				eds = ws[i].WrapEmptyDir(eds)
+			}
+			return eds, true
+		}
+		if w, ok := s.(EmptyDirWrapper); ok {
+			ws = append(ws, w)
+		}
+	}
+	return nil, false
+}
+
+// AsAttachmentStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements AttachmentStore. The AttachmentStore
+// is wrapped by each AttachmentWrapper above it in the chain.
+func AsAttachmentStore(s Store) (AttachmentStore, bool) {
+	var ws []AttachmentWrapper
+	for ; s != nil; s = Unwrap(s) {
+		if as, ok := s.(AttachmentStore); ok {
+			for i := len(ws) - 1; i >= 0; i-- {
+				as = ws[i].WrapAttachments(as)
+			}
+			return as, true
+		}
+		if w, ok := s.(AttachmentWrapper); ok {
+			ws = append(ws, w)
+		}
+	}
+	return nil, false
+}
+
+// AsStatStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements StatStore.
+func AsStatStore(s Store) (StatStore, bool) {
+	ss, ok := Find(s, func(s Store) bool {
+		_, ok := s.(StatStore)
+		return ok
+	}).(StatStore)
+	return ss, ok
+}
+
+// AsStatsStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements StatsStore.
+func AsStatsStore(s Store) (StatsStore, bool) {
+	ss, ok := Find(s, func(s Store) bool {
+		_, ok := s.(StatsStore)
+		return ok
+	}).(StatsStore)
+	return ss, ok
+}
+
+// AsWatchStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements WatchStore.
+func AsWatchStore(s Store) (WatchStore, bool) {
+	ws, ok := Find(s, func(s Store) bool {
+		_, ok := s.(WatchStore)
+		return ok
+	}).(WatchStore)
+	return ws, ok
+}
+
+// AsWipeStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements WipeStore.
+func AsWipeStore(s Store) (WipeStore, bool) {
+	ws, ok := Find(s, func(s Store) bool {
+		_, ok := s.(WipeStore)
+		return ok
+	}).(WipeStore)
+	return ws, ok
+}
+
+// AsVerifyStore finds the first Store in the chain of stores wrapped by s
+// (including s itself) which implements VerifyStore.
+func AsVerifyStore(s Store) (VerifyStore, bool) {
+	vs, ok := Find(s, func(s Store) bool {
+		_, ok := s.(VerifyStore)
+		return ok
+	}).(VerifyStore)
+	return vs, ok
 }
@@ -0,0 +1,95 @@
+package secret_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+)
+
+func TestTreeFallback(t *testing.T) {
+	t.Parallel()
+
+	// Initialization. A caching store is not a TreeStore, so entries are
+	// processed one at a time through it.
+	dir, err := ioutil.TempDir("", "harp_tree_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := file.NewStore(dir, ".foo", &countingCrypter{})
+	for _, e := range []string{"/dir/a", "/dir/sub/b", "/dir/sub/ro/c", "/dirt/d", "/other/a"} {
+		if err := fs.Put(e, "content"); err != nil {
+			t.Fatalf("Could not put: %v", err)
+		}
+	}
+	s := secret.NewReadOnlyStore(secret.NewCachingStore(fs, 0, 0), "/dir/sub/ro")
+	if _, ok := s.(secret.TreeStore); ok {
+		t.Fatalf("Store unexpectedly implements secret.TreeStore")
+	}
+	list := func(want string) {
+		t.Helper()
+		if entries, err := s.List(); err != nil || fmt.Sprint(entries) != want {
+			t.Errorf("List returned (%q, %v), want %s", entries, err, want)
+		}
+	}
+
+	// A collision at the destination prevents any entries from moving.
+	if n, err := secret.MoveTree(s, "/dir/", "/other/"); n != 0 || !errors.Is(err, secret.ErrEntryExists) {
+		t.Errorf("MoveTree onto existing entry = (%d, %v), want error %v", n, err, secret.ErrEntryExists)
+	}
+
+	// A partial failure reports the entries processed before it.
+	n, err := secret.MoveTree(s, "/dir/", "/moved/")
+	var te *secret.TreeError
+	if !errors.As(err, &te) || !errors.Is(err, secret.ErrReadOnly) {
+		t.Fatalf("MoveTree of read-only entry returned error %v, want a TreeError wrapping %v", err, secret.ErrReadOnly)
+	}
+	if n != 2 || fmt.Sprint(te.Done) != "[/dir/a /dir/sub/b]" {
+		t.Errorf("MoveTree = (%d, %q), want (2, [/dir/a /dir/sub/b])", n, te.Done)
+	}
+	list("[/dir/sub/ro/c /dirt/d /moved/a /moved/sub/b /other/a]")
+
+	n, err = secret.DeleteTree(s, "/dir/")
+	if !errors.As(err, &te) || !errors.Is(err, secret.ErrReadOnly) || n != 0 || len(te.Done) != 0 {
+		t.Errorf("DeleteTree of read-only entry = (%d, %v), want a TreeError wrapping %v with no entries done", n, err, secret.ErrReadOnly)
+	}
+
+	// Successful operations.
+	if n, err := secret.MoveTree(s, "/moved/sub/", "/"); err != nil || n != 1 {
+		t.Errorf("MoveTree to root = (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := secret.DeleteTree(s, "/moved/"); err != nil || n != 1 {
+		t.Errorf("DeleteTree = (%d, %v), want (1, nil)", n, err)
+	}
+	list("[/b /dir/sub/ro/c /dirt/d /other/a]")
+
+	// Error tests.
+	for _, test := range []struct {
+		oldPrefix, newPrefix string
+		wantErr              error
+	}{
+		{"/nonexistent/", "/x/", secret.ErrNoEntry},
+		{"/dirt/", "/dirt/", secret.ErrInvalidEntryName},
+		{"/dirt/", "/dirt/sub/", secret.ErrInvalidEntryName},
+		{"/", "/x/", secret.ErrInvalidEntryName},
+		{"/dirt", "/x/", secret.ErrInvalidEntryName},
+		{"/dirt/", "x/", secret.ErrInvalidEntryName},
+		{"/dirt/", "/a//b/", secret.ErrInvalidEntryName},
+		{"/dirt/", "/a/../b/", secret.ErrInvalidEntryName},
+	} {
+		if n, err := secret.MoveTree(s, test.oldPrefix, test.newPrefix); n != 0 || !errors.Is(err, test.wantErr) {
+			t.Errorf("MoveTree(%q, %q) = (%d, %v), want error %v", test.oldPrefix, test.newPrefix, n, err, test.wantErr)
+		}
+	}
+	for _, prefix := range []string{"/", "/dirt", "/../"} {
+		if n, err := secret.DeleteTree(s, prefix); n != 0 || !errors.Is(err, secret.ErrInvalidEntryName) {
+			t.Errorf("DeleteTree(%q) = (%d, %v), want error %v", prefix, n, err, secret.ErrInvalidEntryName)
+		}
+	}
+	list("[/b /dir/sub/ro/c /dirt/d /other/a]")
+}
@@ -6,24 +6,32 @@
 package secretbox
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/BranLwyd/harpocrates/secret"
 	"github.com/BranLwyd/harpocrates/secret/file"
 	"github.com/BranLwyd/harpocrates/secret/key_private"
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/scrypt"
 
+	kdfpkg "github.com/BranLwyd/harpocrates/secret/kdf"
 	epb "github.com/BranLwyd/harpocrates/secret/proto/entry_go_proto"
 	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
 )
 
 func init() {
-	key_private.RegisterVaultFromKeyFunc(func(location string, key *kpb.Key) (secret.Vault, error) {
+	key_private.RegisterVaultFromKeyFunc(func(location string, key *kpb.Key, params key_private.VaultParams) (secret.Vault, error) {
 		if k := key.GetSecretboxKey(); k != nil {
 			switch {
 			case len(k.EncryptedKey) != keySize+secretbox.Overhead:
@@ -32,12 +40,20 @@ func init() {
 				return nil, errors.New("unexpected size for encrypted_key_nonce")
 			}
 
+			d, err := kdfFromKey(k)
+			if err != nil {
+				return nil, err
+			}
+
 			v := &vault{
 				baseDir: filepath.Clean(location),
-				salt:    k.Salt,
-				n:       int(k.N),
-				r:       int(k.R),
-				p:       int(k.P),
+				kdf:     d,
+
+				keepVersions:    params.KeepVersions,
+				trashRetention:  params.TrashRetention,
+				resolveSymlinks: params.ResolveSymlinks,
+				maxEntrySize:    params.MaxEntrySize,
+				manifest:        params.Manifest,
 			}
 			copy(v.encryptedEK[:], k.EncryptedKey)
 			copy(v.eekNonce[:], k.EncryptedKeyNonce)
@@ -45,11 +61,206 @@ func init() {
 		}
 		return nil, nil
 	})
+	key_private.RegisterRewrapFunc(func(key *kpb.Key, oldPassphrase, newPassphrase string, params key_private.RewrapParams) (*kpb.Key, error) {
+		if k := key.GetSecretboxKey(); k != nil {
+			return rewrap(k, oldPassphrase, newPassphrase, params)
+		}
+		return nil, nil
+	})
+	key_private.RegisterFingerprintFunc(func(key *kpb.Key, passphrase string, extra []byte) (string, string, error) {
+		if k := key.GetSecretboxKey(); k != nil {
+			ek, _, err := openEK(k, passphrase, extra)
+			if err != nil {
+				return "", "", err
+			}
+			defer wipe(ek)
+			return keyType, fingerprint(ek), nil
+		}
+		return "", "", nil
+	})
+}
+
+// keyType identifies secretbox keys in vault markers.
+const keyType = "secretbox"
+
+// fingerprint returns the fingerprint of the given EK. The key's other
+// parameters all change when it is rewrapped, so the fingerprint is derived
+// from the EK itself, via a one-way function.
+func fingerprint(ek []byte) string {
+	h := sha256.New()
+	h.Write([]byte("harpocrates_vault_fingerprint_"))
+	h.Write(ek)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// openEK decrypts the EK of the given key using the KEK derived from the
+// given passphrase & external secret, also returning the KEK's derivation
+// parameters.
+func openEK(k *kpb.SecretboxKey, passphrase string, extra []byte) ([]byte, kdf, error) {
+	switch {
+	case len(k.EncryptedKey) != keySize+secretbox.Overhead:
+		return nil, kdf{}, errors.New("unexpected size for encrypted_key")
+	case len(k.EncryptedKeyNonce) != nonceSize:
+		return nil, kdf{}, errors.New("unexpected size for encrypted_key_nonce")
+	}
+
+	d, err := kdfFromKey(k)
+	if err != nil {
+		return nil, kdf{}, err
+	}
+	kek, err := d.deriveKEK(passphrase, extra)
+	if err != nil {
+		return nil, kdf{}, err
+	}
+	defer wipe(kek[:])
+	var eekNonce [nonceSize]byte
+	copy(eekNonce[:], k.EncryptedKeyNonce)
+	ek, ok := secretbox.Open(nil, k.EncryptedKey, &eekNonce, &kek)
+	if !ok {
+		return nil, kdf{}, secret.ErrWrongPassphrase
+	}
+	return ek, d, nil
+}
+
+// rewrap re-encrypts the EK of the given key with a KEK derived from a new
+// passphrase, using a fresh salt & nonce. A key requiring an external secret
+// still requires it once rewrapped.
+func rewrap(k *kpb.SecretboxKey, oldPassphrase, newPassphrase string, params key_private.RewrapParams) (*kpb.Key, error) {
+	// Decrypt the EK using the KEK derived from the old passphrase.
+	ek, oldKDF, err := openEK(k, oldPassphrase, params.ExternalSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive a new KEK from the new passphrase & a fresh salt, and re-encrypt the EK. The existing
+	// KDF is kept, unless new scrypt parameters are requested.
+	salt := []byte("harpocrates_key_        ")
+	if _, err := rand.Read(salt[len("harpocrates_key_"):]); err != nil {
+		return nil, fmt.Errorf("couldn't generate salt: %w", err)
+	}
+	newKDF := oldKDF
+	if params.ScryptN != 0 || params.ScryptR != 0 || params.ScryptP != 0 {
+		if newKDF.argon2 != nil {
+			newKDF = kdf{n: defaultScryptN, r: defaultScryptR, p: defaultScryptP}
+		}
+		if params.ScryptN != 0 {
+			newKDF.n = params.ScryptN
+		}
+		if params.ScryptR != 0 {
+			newKDF.r = params.ScryptR
+		}
+		if params.ScryptP != 0 {
+			newKDF.p = params.ScryptP
+		}
+	}
+	if newKDF.argon2 != nil {
+		a := newKDF.argon2
+		newKDF.argon2 = &kpb.Argon2Params{
+			Salt:        salt,
+			Memory:      a.Memory,
+			Iterations:  a.Iterations,
+			Parallelism: a.Parallelism,
+		}
+	} else {
+		newKDF.salt = salt
+	}
+	if newKDF.external {
+		newKDF.externalSalt = make([]byte, externalSaltSize)
+		if _, err := rand.Read(newKDF.externalSalt); err != nil {
+			return nil, fmt.Errorf("couldn't generate salt: %w", err)
+		}
+	}
+	newKEK, err := newKDF.deriveKEK(newPassphrase, params.ExternalSecret)
+	if err != nil {
+		return nil, err
+	}
+	var eekNonce [nonceSize]byte
+	if _, err := rand.Read(eekNonce[:]); err != nil {
+		return nil, fmt.Errorf("couldn't generate nonce: %w", err)
+	}
+
+	newKey := &kpb.SecretboxKey{
+		EncryptedKey:      secretbox.Seal(nil, ek, &eekNonce, &newKEK),
+		EncryptedKeyNonce: eekNonce[:],
+	}
+	if newKDF.argon2 != nil {
+		newKey.Argon2 = newKDF.argon2
+	} else {
+		newKey.Salt, newKey.N, newKey.R, newKey.P = newKDF.salt, int32(newKDF.n), int32(newKDF.r), int32(newKDF.p)
+	}
+	newKey.RequiresExternalSecret, newKey.ExternalSalt = newKDF.external, newKDF.externalSalt
+	return &kpb.Key{Key: &kpb.Key_SecretboxKey{SecretboxKey: newKey}}, nil
+}
+
+// kdf describes how a key-encryption key (KEK) is derived from a passphrase:
+// via Argon2id if argon2 is set, or via scrypt otherwise. If external is set,
+// the result is combined with an external secret (see
+// kdfpkg.CombineExternalSecret).
+type kdf struct {
+	salt         []byte // scrypt salt
+	n, r, p      int    // scrypt parameters
+	argon2       *kpb.Argon2Params
+	external     bool   // whether an external secret is required
+	externalSalt []byte // salt used to combine the external secret
+}
+
+// kdfFromKey gets the KEK derivation parameters of the given key.
+func kdfFromKey(k *kpb.SecretboxKey) (kdf, error) {
+	if a := k.Argon2; a != nil {
+		if a.Iterations == 0 || a.Parallelism == 0 || a.Parallelism > 255 {
+			return kdf{}, errors.New("invalid argon2 parameters")
+		}
+		return kdf{argon2: a, external: k.RequiresExternalSecret, externalSalt: k.ExternalSalt}, nil
+	}
+	return kdf{salt: k.Salt, n: int(k.N), r: int(k.R), p: int(k.P), external: k.RequiresExternalSecret, externalSalt: k.ExternalSalt}, nil
+}
+
+// deriveKEK derives a key-encryption key (KEK) from the given passphrase &, if
+// the key requires one, external secret. If a required external secret is
+// missing, secret.ErrWrongPassphrase is returned.
+func (d kdf) deriveKEK(passphrase string, extra []byte) ([keySize]byte, error) {
+	var kek [keySize]byte
+	if d.external && len(extra) == 0 {
+		return kek, secret.ErrWrongPassphrase
+	}
+	var kekBuf []byte
+	if a := d.argon2; a != nil {
+		kekBuf = argon2.IDKey([]byte(passphrase), a.Salt, a.Iterations, a.Memory, uint8(a.Parallelism), keySize)
+	} else {
+		var err error
+		if kekBuf, err = scrypt.Key([]byte(passphrase), d.salt, d.n, d.r, d.p, keySize); err != nil {
+			return kek, fmt.Errorf("couldn't derive key-encryption key: %w", err)
+		}
+	}
+	defer wipe(kekBuf)
+	if d.external {
+		combined, err := kdfpkg.CombineExternalSecret(kekBuf, d.externalSalt, extra)
+		if err != nil {
+			return kek, err
+		}
+		defer wipe(combined)
+		kekBuf = combined
+	}
+	copy(kek[:], kekBuf)
+	return kek, nil
 }
 
 const (
 	keySize   = 32
 	nonceSize = 24
+
+	// The size of the salt used to combine the KEK with an external secret.
+	externalSaltSize = 16
+
+	// Scrypt parameters used when rewrapping an Argon2id-based key with new scrypt parameters, for
+	// any parameters which are not specified.
+	defaultScryptN = 32768
+	defaultScryptR = 8
+	defaultScryptP = 1
+
+	// The largest estimated progress reported by an unlock which has not yet
+	// completed.
+	maxEstimatedProgress = 0.95
 )
 
 type vault struct {
@@ -59,40 +270,182 @@ type vault struct {
 	encryptedEK [keySize + secretbox.Overhead]byte
 	eekNonce    [nonceSize]byte
 
-	// Scrypt parameters for the key-encryption key (KEK).
-	salt    []byte
-	n, r, p int
+	// Derivation parameters for the key-encryption key (KEK).
+	kdf kdf
+
+	// Used to warn, once, if the KEK derivation parameters are weak.
+	weakKDFOnce sync.Once
+
+	// How long the most recent KEK derivation took, used to estimate the
+	// progress of asynchronous unlocks; zero if no derivation has completed.
+	derivationMu   sync.Mutex
+	derivationTime time.Duration
+
+	keepVersions    int           // number of previous versions of each entry to keep
+	trashRetention  time.Duration // how long to keep deleted entries in the trash
+	resolveSymlinks bool          // whether to refuse access via symlinks leading outside baseDir
+	maxEntrySize    int           // maximum size of an entry's plaintext content; zero for no limit
+	manifest        bool          // whether to keep an authenticated manifest of the vault's files
 }
 
 func (v *vault) Unlock(passphrase string) (secret.Store, error) {
+	return v.UnlockWith(passphrase, nil)
+}
+
+// UnlockWith implements secret.ExternalSecretVault.
+func (v *vault) UnlockWith(passphrase string, extra []byte) (secret.Store, error) {
 	// Derive the KEK from the passphrase and the given paramemters.
-	var kek [keySize]byte
-	kekBuf, err := scrypt.Key([]byte(passphrase), v.salt, v.n, v.r, v.p, keySize)
+	start := time.Now()
+	kek, err := v.kdf.deriveKEK(passphrase, extra)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't derive key-encryption key: %w", err)
+		return nil, err
 	}
-	copy(kek[:], kekBuf)
+	derivationTime := time.Since(start)
+	v.derivationMu.Lock()
+	v.derivationTime = derivationTime
+	v.derivationMu.Unlock()
 
 	// Decrypt the EK using the derived KEK.
-	var ek [keySize]byte
 	ekBuf, ok := secretbox.Open(nil, v.encryptedEK[:], &v.eekNonce, &kek)
+	wipe(kek[:])
 	if !ok {
 		return nil, secret.ErrWrongPassphrase
 	}
-	copy(ek[:], ekBuf)
+	fp := fingerprint(ekBuf)
+	c := &crypter{}
+	copy(c.key[:], ekBuf)
+	wipe(ekBuf)
+	if err := key_private.CheckMarker(v.baseDir, keyType, fp); err != nil {
+		c.Wipe()
+		return nil, err
+	}
+	if derivationTime < kdfpkg.WeakDuration {
+		v.weakKDFOnce.Do(func() {
+			log.Printf("Key-encryption key for %q was derived in %v; its parameters may be weak. Consider choosing new parameters with gen_sbox_key --calibrate.", v.baseDir, derivationTime)
+		})
+	}
+
+	return file.NewStore(v.baseDir, ".harp", c, file.WithVersions(v.keepVersions), file.WithTrash(v.trashRetention), file.WithResolveSymlinks(v.resolveSymlinks), file.WithMaxEntrySize(v.maxEntrySize), file.WithManifest(v.manifest)), nil
+}
+
+// UnlockAsync implements secret.AsyncVault. Progress is estimated from how
+// long the previous KEK derivation took, since derivation dominates the time
+// taken to unlock; no progress is reported until one derivation has completed.
+func (v *vault) UnlockAsync(passphrase string) (secret.UnlockHandle, error) {
+	return v.UnlockAsyncWith(passphrase, nil)
+}
+
+// UnlockAsyncWith implements secret.ExternalSecretVault, reporting progress as
+// UnlockAsync does.
+func (v *vault) UnlockAsyncWith(passphrase string, extra []byte) (secret.UnlockHandle, error) {
+	start := time.Now()
+	v.derivationMu.Lock()
+	expected := v.derivationTime
+	v.derivationMu.Unlock()
+	var progress func() (float64, bool)
+	if expected > 0 {
+		progress = func() (float64, bool) {
+			// Never claim to be done before the unlock actually completes.
+			f := float64(time.Since(start)) / float64(expected)
+			if f > maxEstimatedProgress {
+				f = maxEstimatedProgress
+			}
+			return f, true
+		}
+	}
+	return secret.StartUnlock(func() (secret.Store, error) { return v.UnlockWith(passphrase, extra) }, progress), nil
+}
+
+// errWiped is returned when using a crypter whose key has been wiped.
+var errWiped = errors.New("key has been wiped")
 
-	return file.NewStore(v.baseDir, ".harp", crypter{ek}), nil
+// crypter implements file.AttachmentCrypter & file.WipingCrypter.
+type crypter struct {
+	mu    sync.RWMutex // protects key & wiped
+	key   [keySize]byte
+	wiped bool
 }
 
-type crypter struct{ key [keySize]byte }
+var (
+	_ secret.AsyncVault          = (*vault)(nil)
+	_ secret.ExternalSecretVault = (*vault)(nil)
+	_ file.AttachmentCrypter     = (*crypter)(nil)
+	_ file.WipingCrypter         = (*crypter)(nil)
+	_ file.MACCrypter            = (*crypter)(nil)
+)
 
-func (c crypter) Encrypt(entryName, content string) (ciphertext []byte, _ error) {
+// Wipe zeroes the crypter's key.
+func (c *crypter) Wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wipe(c.key[:])
+	c.wiped = true
+}
+
+func (c *crypter) Encrypt(entryName, content string) (ciphertext []byte, _ error) {
+	return c.seal([]byte(content))
+}
+
+func (c *crypter) Decrypt(entryName string, ciphertext []byte) (content string, _ error) {
+	contentBytes, err := c.open(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(contentBytes), nil
+}
+
+func (c *crypter) EncryptAttachments(entryName string, attachments map[string][]byte) (ciphertext []byte, _ error) {
+	attBytes, err := proto.Marshal(&epb.Entry{Attachments: attachments})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal attachments: %w", err)
+	}
+	return c.seal(attBytes)
+}
+
+func (c *crypter) DecryptAttachments(entryName string, ciphertext []byte) (attachments map[string][]byte, _ error) {
+	attBytes, err := c.open(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	atts := &epb.Entry{}
+	if err := proto.Unmarshal(attBytes, atts); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal attachments: %w", err)
+	}
+	return atts.Attachments, nil
+}
+
+// MAC computes HMAC-SHA256 of the given data, keyed with a key derived from
+// the EK, so that MACs do not reuse the key used for encryption. It returns
+// nil if the crypter has been wiped.
+func (c *crypter) MAC(data []byte) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.wiped {
+		return nil
+	}
+	kh := hmac.New(sha256.New, c.key[:])
+	kh.Write([]byte("harpocrates_manifest_mac_key"))
+	macKey := kh.Sum(nil)
+	defer wipe(macKey)
+	h := hmac.New(sha256.New, macKey)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// seal encrypts the given plaintext with a fresh nonce, returning a serialized
+// Entry.
+func (c *crypter) seal(plaintext []byte) ([]byte, error) {
 	var nonce [nonceSize]byte
 	if _, err := rand.Read(nonce[:]); err != nil {
 		return nil, fmt.Errorf("couldn't generate nonce: %w", err)
 	}
 
-	encryptedContent := secretbox.Seal(nil, []byte(content), &nonce, &c.key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.wiped {
+		return nil, errWiped
+	}
+	encryptedContent := secretbox.Seal(nil, plaintext, &nonce, &c.key)
 	ciphertext, err := proto.Marshal(&epb.Entry{
 		EncryptedContent: encryptedContent,
 		Nonce:            nonce[:],
@@ -103,17 +456,30 @@ func (c crypter) Encrypt(entryName, content string) (ciphertext []byte, _ error)
 	return ciphertext, nil
 }
 
-func (c crypter) Decrypt(entryName string, ciphertext []byte) (content string, _ error) {
+// open decrypts a serialized Entry, as returned by seal.
+func (c *crypter) open(ciphertext []byte) ([]byte, error) {
 	entry := &epb.Entry{}
 	if err := proto.Unmarshal(ciphertext, entry); err != nil {
-		return "", fmt.Errorf("couldn't unmarshal entry: %w", err)
+		return nil, fmt.Errorf("couldn't unmarshal entry: %w", err)
 	}
 	var nonce [nonceSize]byte
 	copy(nonce[:], entry.Nonce)
 
-	contentBytes, ok := secretbox.Open(nil, entry.EncryptedContent, &nonce, &c.key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.wiped {
+		return nil, errWiped
+	}
+	plaintext, ok := secretbox.Open(nil, entry.EncryptedContent, &nonce, &c.key)
 	if !ok {
-		return "", errors.New("couldn't decrypt")
+		return nil, errors.New("couldn't decrypt")
+	}
+	return plaintext, nil
+}
+
+// wipe zeroes the given buffer.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
 	}
-	return string(contentBytes), nil
 }
@@ -0,0 +1,123 @@
+package secret
+
+// UnlockHandle tracks an unlock of a Vault which runs in the background, as
+// started by UnlockAsync.
+type UnlockHandle interface {
+	// Done returns a channel which is closed once the unlock completes.
+	Done() <-chan struct{}
+
+	// Result returns the result of the unlock, as Vault.Unlock would. It
+	// blocks until the unlock completes.
+	Result() (Store, error)
+
+	// Progress returns an estimate of the fraction of the unlock's work
+	// which is complete, between 0 & 1. It returns false if no estimate is
+	// available.
+	Progress() (fraction float64, ok bool)
+}
+
+// AsyncVault is a Vault which can unlock in the background, reporting the
+// progress of the unlock. Vaults whose unlock is dominated by a slow key
+// derivation may implement it to let users know how long they will wait.
+type AsyncVault interface {
+	Vault
+
+	// UnlockAsync starts opening the vault, as Unlock does, returning a
+	// handle to the result.
+	UnlockAsync(passphrase string) (UnlockHandle, error)
+}
+
+// UnlockAsync starts unlocking the given vault in the background. If the vault
+// is an AsyncVault, its UnlockAsync method is used; otherwise, Unlock is run
+// in a new goroutine & no progress is reported.
+func UnlockAsync(v Vault, passphrase string) (UnlockHandle, error) {
+	if av, ok := v.(AsyncVault); ok {
+		return av.UnlockAsync(passphrase)
+	}
+	return StartUnlock(func() (Store, error) { return v.Unlock(passphrase) }, nil), nil
+}
+
+// ExternalSecretVault is a Vault whose key may require secret material besides
+// the passphrase to unlock, such as the hmac-secret output of a hardware token
+// or the content of a file on removable media.
+type ExternalSecretVault interface {
+	Vault
+
+	// UnlockWith is like Unlock, but also supplies the given external
+	// secret, which may be nil. If the vault's key requires an external
+	// secret & it is missing or incorrect, ErrWrongPassphrase is returned;
+	// otherwise, it is ignored.
+	UnlockWith(passphrase string, extra []byte) (Store, error)
+
+	// UnlockAsyncWith is like UnlockWith, but unlocks in the background,
+	// as UnlockAsync does.
+	UnlockAsyncWith(passphrase string, extra []byte) (UnlockHandle, error)
+}
+
+// UnlockWith opens the given vault with the given passphrase & external
+// secret (see ExternalSecretVault). If the vault is not an
+// ExternalSecretVault, the external secret is ignored.
+func UnlockWith(v Vault, passphrase string, extra []byte) (Store, error) {
+	if ev, ok := v.(ExternalSecretVault); ok {
+		return ev.UnlockWith(passphrase, extra)
+	}
+	return v.Unlock(passphrase)
+}
+
+// UnlockAsyncWith is like UnlockAsync, but also supplies the given external
+// secret, as UnlockWith does.
+func UnlockAsyncWith(v Vault, passphrase string, extra []byte) (UnlockHandle, error) {
+	if ev, ok := v.(ExternalSecretVault); ok {
+		return ev.UnlockAsyncWith(passphrase, extra)
+	}
+	return UnlockAsync(v, passphrase)
+}
+
+// StartUnlock runs unlock in a new goroutine, returning a handle to its
+// result. It is intended for implementing AsyncVault. The handle's Progress
+// method calls progress, possibly concurrently, until the unlock completes;
+// progress may be nil if no estimate is available.
+func StartUnlock(unlock func() (Store, error), progress func() (float64, bool)) UnlockHandle {
+	h := &unlockHandle{done: make(chan struct{}), progress: progress}
+	go func() {
+		defer close(h.done)
+		h.store, h.err = unlock()
+	}()
+	return h
+}
+
+// unlockHandle implements UnlockHandle.
+type unlockHandle struct {
+	done     chan struct{} // closed once store & err are set
+	store    Store
+	err      error
+	progress func() (float64, bool)
+}
+
+func (h *unlockHandle) Done() <-chan struct{} { return h.done }
+
+func (h *unlockHandle) Result() (Store, error) {
+	<-h.done
+	return h.store, h.err
+}
+
+func (h *unlockHandle) Progress() (float64, bool) {
+	select {
+	case <-h.done:
+		return 1, true
+	default:
+	}
+	if h.progress == nil {
+		return 0, false
+	}
+	f, ok := h.progress()
+	switch {
+	case !ok:
+		return 0, false
+	case f < 0:
+		return 0, true
+	case f > 1:
+		return 1, true
+	}
+	return f, true
+}
@@ -0,0 +1,66 @@
+package secret_test
+
+import (
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestUnlockAsync(t *testing.T) {
+	t.Parallel()
+
+	// A vault which can't report progress is unlocked in the background.
+	release := make(chan struct{})
+	h, err := secret.UnlockAsync(blockingVault{release}, "passphrase")
+	if err != nil {
+		t.Fatalf("Could not start unlock: %v", err)
+	}
+	select {
+	case <-h.Done():
+		t.Fatalf("Unlock completed before vault was unlocked")
+	default:
+	}
+	if p, ok := h.Progress(); ok {
+		t.Errorf("Progress of unlock = (%v, true), want no estimate", p)
+	}
+	close(release)
+	<-h.Done()
+	if _, err := h.Result(); err != secret.ErrWrongPassphrase {
+		t.Errorf("Result returned error %v, want %v", err, secret.ErrWrongPassphrase)
+	}
+	if p, ok := h.Progress(); !ok || p != 1 {
+		t.Errorf("Progress of completed unlock = (%v, %v), want (1, true)", p, ok)
+	}
+}
+
+func TestStartUnlockProgress(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	for _, test := range []struct {
+		progress float64
+		want     float64
+	}{
+		{-1, 0},
+		{0.25, 0.25},
+		{2, 1},
+	} {
+		progress := test.progress
+		h := secret.StartUnlock(blockingVault{release}.unlock, func() (float64, bool) { return progress, true })
+		if got, ok := h.Progress(); !ok || got != test.want {
+			t.Errorf("Progress with estimate %v = (%v, %v), want (%v, true)", test.progress, got, ok, test.want)
+		}
+	}
+}
+
+// blockingVault is a secret.Vault whose Unlock blocks until release is
+// closed, then fails.
+type blockingVault struct{ release <-chan struct{} }
+
+func (v blockingVault) Unlock(string) (secret.Store, error) { return v.unlock() }
+
+func (v blockingVault) unlock() (secret.Store, error) {
+	<-v.release
+	return nil, secret.ErrWrongPassphrase
+}
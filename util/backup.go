@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/BranLwyd/harpocrates/secret/file"
+	"github.com/BranLwyd/harpocrates/secret/kdf"
+	"github.com/BranLwyd/harpocrates/util/backupcrypt"
+)
+
+var (
+	location       = flag.String("location", "", "Location of the password entries.")
+	counterFile    = flag.String("counters", "", "Location of the MFA counter file. If specified, the counter file is included in the backup, or written when restoring.")
+	keyFile        = flag.String("key", "", "Location of the key. If specified, a hash of the key is included in the backup, or checked when restoring.")
+	backupFile     = flag.String("file", "-", "Location of the backup to write, or to read when restoring. \"-\" means standard output or input.")
+	restore        = flag.Bool("restore", false, "If set, restore the backup to --location rather than creating a backup.")
+	force          = flag.Bool("force", false, "If set, allow restoring over existing files.")
+	encrypt        = flag.Bool("encrypt", false, "If set, encrypt the backup with a backup passphrase, which is prompted for.")
+	passphraseFile = flag.String("passphrase_file", "", "Location of a file holding the backup passphrase. Implies --encrypt; useful for scheduled backups, and required to restore an encrypted backup from standard input.")
+)
+
+// Names of the extra files stored in the backup.
+const (
+	countersName = "mfa_counters"
+	keyHashName  = "key.sha256"
+)
+
+func main() {
+	// Parse & validate flags.
+	flag.Parse()
+	if *location == "" {
+		die("--location is required")
+	}
+	if *passphraseFile != "" {
+		*encrypt = true
+	}
+
+	if *restore {
+		doRestore()
+	} else {
+		doBackup()
+	}
+}
+
+func doBackup() {
+	var extra []file.SnapshotFile
+	if *counterFile != "" {
+		ctrs, err := ioutil.ReadFile(*counterFile)
+		if err != nil {
+			die("Could not read counter file: %v", err)
+		}
+		extra = append(extra, file.SnapshotFile{Name: countersName, Content: ctrs})
+	}
+	if *keyFile != "" {
+		extra = append(extra, file.SnapshotFile{Name: keyHashName, Content: []byte(keyHash())})
+	}
+
+	out := os.Stdout
+	if *backupFile != "-" {
+		f, err := os.OpenFile(*backupFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			die("Could not create backup file: %v", err)
+		}
+		out = f
+	}
+	var w io.Writer = out
+	var ew io.WriteCloser
+	if *encrypt {
+		var err error
+		if ew, err = backupcrypt.NewWriter(w, backupPassphrase(true), kdf.DefaultParams); err != nil {
+			die("Could not encrypt backup: %v", err)
+		}
+		w = ew
+	}
+
+	if err := file.Snapshot(w, *location, extra...); err != nil {
+		die("Could not write backup: %v", err)
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			die("Could not write backup: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		die("Could not close backup file: %v", err)
+	}
+}
+
+func doRestore() {
+	var r io.Reader = os.Stdin
+	if *backupFile != "-" {
+		f, err := os.Open(*backupFile)
+		if err != nil {
+			die("Could not open backup file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	if *encrypt {
+		var err error
+		if r, err = backupcrypt.NewReader(r, backupPassphrase(false)); err != nil {
+			die("Could not decrypt backup: %v", err)
+		}
+	}
+
+	// Check the key before restoring anything, so that a mismatch leaves
+	// the disk untouched.
+	checkKey := func(extra []file.SnapshotFile) error {
+		if *keyFile == "" {
+			return nil
+		}
+		for _, f := range extra {
+			if f.Name != keyHashName {
+				continue
+			}
+			if h := keyHash(); !bytes.Equal([]byte(h), f.Content) {
+				return fmt.Errorf("backup was made with a different key (key hash %s, want %s)", f.Content, h)
+			}
+		}
+		return nil
+	}
+	extra, err := file.RestoreSnapshot(r, *location, *force, checkKey)
+	if errors.Is(err, file.ErrNotEmpty) {
+		die("%v; pass --force to restore over existing files", err)
+	}
+	if err != nil {
+		die("Could not restore backup: %v", err)
+	}
+	for _, f := range extra {
+		if f.Name == countersName && *counterFile != "" {
+			flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			if *force {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			cf, err := os.OpenFile(*counterFile, flags, 0600)
+			if err != nil {
+				die("Could not create counter file: %v", err)
+			}
+			if _, err := cf.Write(f.Content); err != nil {
+				die("Could not write counter file: %v", err)
+			}
+			if err := cf.Close(); err != nil {
+				die("Could not close counter file: %v", err)
+			}
+		}
+	}
+}
+
+// keyHash returns the hex-encoded SHA-256 hash of the key file.
+func keyHash() string {
+	keyBytes, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		die("Could not read key file: %v", err)
+	}
+	h := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(h[:])
+}
+
+// backupPassphrase gets the backup passphrase, from --passphrase_file if
+// specified or by prompting otherwise. If confirm is set, a prompted
+// passphrase must be entered twice.
+func backupPassphrase(confirm bool) string {
+	if *passphraseFile != "" {
+		pass, err := ioutil.ReadFile(*passphraseFile)
+		if err != nil {
+			die("Could not read passphrase file: %v", err)
+		}
+		return string(bytes.TrimRight(pass, "\r\n"))
+	}
+	// Standard output may be the backup, so prompt on standard error.
+	fmt.Fprintf(os.Stderr, "Backup passphrase: ")
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	if confirm {
+		fmt.Fprintf(os.Stderr, "Confirm backup passphrase: ")
+		secondTry, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			die("Could not get passphrase: %v", err)
+		}
+		if !bytes.Equal(pass, secondTry) {
+			die("Passphrases don't match.")
+		}
+	}
+	return string(pass)
+}
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
@@ -0,0 +1,232 @@
+// Package backupcrypt provides streaming encryption of backups with a
+// passphrase. It is separate from the vault's passphrase, so that backups may
+// be handled by someone who cannot unlock the vault.
+//
+// An encrypted backup consists of a header holding a random salt & the scrypt
+// parameters used to derive the key from the passphrase, followed by the
+// plaintext split into chunks, each sealed with secretbox. Chunk nonces hold
+// the chunk's index and a flag marking the final chunk, so that chunks can't
+// be reordered, and truncation of the backup is detected.
+package backupcrypt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/BranLwyd/harpocrates/secret/kdf"
+)
+
+const (
+	magic      = "harp-backup-v1\n"
+	saltLength = 16
+	chunkSize  = 64 << 10
+
+	// headerLength is the length of the header, other than its seal: the
+	// magic string, salt, and scrypt N, r & p.
+	headerLength = len(magic) + saltLength + 12
+
+	// maxScryptN bounds the scrypt N accepted from a backup's header, so that
+	// a corrupt header can't exhaust memory.
+	maxScryptN = 1 << 24
+
+	// Values of the last byte of the nonce.
+	nonceChunk      = 0
+	nonceFinalChunk = 1
+	nonceHeader     = 2
+)
+
+// ErrWrongPassphrase is returned when opening a backup with a passphrase other
+// than the one it was encrypted with.
+var ErrWrongPassphrase = errors.New("wrong backup passphrase")
+
+// ErrCorrupt is returned when a backup has been corrupted or truncated.
+var ErrCorrupt = errors.New("backup is corrupt")
+
+// NewWriter returns a writer which encrypts everything written to it with the
+// given passphrase, writing the result to w. The key is derived with the given
+// scrypt parameters. The returned writer must be closed to finish the backup;
+// closing it does not close w.
+func NewWriter(w io.Writer, passphrase string, p kdf.Params) (io.WriteCloser, error) {
+	var salt [saltLength]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, fmt.Errorf("couldn't generate salt: %w", err)
+	}
+	key, err := deriveKey(passphrase, salt[:], p)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, headerLength, headerLength+secretbox.Overhead)
+	copy(hdr, magic)
+	copy(hdr[len(magic):], salt[:])
+	params := hdr[len(magic)+saltLength:]
+	binary.BigEndian.PutUint32(params[0:], uint32(p.N))
+	binary.BigEndian.PutUint32(params[4:], uint32(p.R))
+	binary.BigEndian.PutUint32(params[8:], uint32(p.P))
+	// The header ends with an empty message sealed with the key. The salt &
+	// parameters determine the key, so this authenticates them, and allows a
+	// wrong passphrase to be distinguished from a corrupt backup.
+	hdr = secretbox.Seal(hdr, nil, nonce(0, nonceHeader), &key)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, fmt.Errorf("couldn't write header: %w", err)
+	}
+	return &writer{w: w, key: key, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+type writer struct {
+	w      io.Writer
+	key    [32]byte
+	buf    []byte // plaintext not yet written; never more than chunkSize
+	idx    uint64 // index of the next chunk
+	closed bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed backup")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// A full buffer is only written once more data arrives, so that the
+		// final chunk is written by Close.
+		if len(w.buf) == chunkSize {
+			if err := w.writeChunk(nonceChunk); err != nil {
+				return 0, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.writeChunk(nonceFinalChunk)
+}
+
+func (w *writer) writeChunk(flag byte) error {
+	if _, err := w.w.Write(secretbox.Seal(nil, w.buf, nonce(w.idx, flag), &w.key)); err != nil {
+		return fmt.Errorf("couldn't write backup: %w", err)
+	}
+	w.idx++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// NewReader returns a reader which decrypts the backup read from r, as written
+// by a writer returned from NewWriter. It returns ErrWrongPassphrase if the
+// backup was encrypted with a different passphrase. Reads return ErrCorrupt if
+// the backup has been modified or truncated.
+func NewReader(r io.Reader, passphrase string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, headerLength+secretbox.Overhead)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("couldn't read header: %w", err)
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, errors.New("not an encrypted backup")
+	}
+	salt := hdr[len(magic) : len(magic)+saltLength]
+	params := hdr[len(magic)+saltLength : headerLength]
+	p := kdf.Params{
+		N: int(binary.BigEndian.Uint32(params[0:])),
+		R: int(binary.BigEndian.Uint32(params[4:])),
+		P: int(binary.BigEndian.Uint32(params[8:])),
+	}
+	if p.N > maxScryptN {
+		return nil, fmt.Errorf("%w: scrypt N of %d is too large", ErrCorrupt, p.N)
+	}
+	key, err := deriveKey(passphrase, salt, p)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := secretbox.Open(nil, hdr[headerLength:], nonce(0, nonceHeader), &key); !ok {
+		return nil, ErrWrongPassphrase
+	}
+	return &reader{r: br, key: key}, nil
+}
+
+type reader struct {
+	r    *bufio.Reader
+	key  [32]byte
+	buf  []byte // plaintext not yet returned
+	idx  uint64 // index of the next chunk
+	done bool   // whether the final chunk has been read
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) readChunk() error {
+	sealed := make([]byte, chunkSize+secretbox.Overhead)
+	n, err := io.ReadFull(r.r, sealed)
+	switch {
+	case err == io.EOF:
+		// The final chunk is always written, so this is a truncation.
+		return ErrCorrupt
+	case err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return fmt.Errorf("couldn't read backup: %w", err)
+	default:
+		// A full chunk is the final chunk only if nothing follows it.
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return fmt.Errorf("couldn't read backup: %w", err)
+		}
+	}
+	flag := byte(nonceChunk)
+	if r.done {
+		flag = nonceFinalChunk
+	}
+	pt, ok := secretbox.Open(nil, sealed[:n], nonce(r.idx, flag), &r.key)
+	if !ok {
+		return ErrCorrupt
+	}
+	r.idx++
+	r.buf = pt
+	return nil
+}
+
+func deriveKey(passphrase string, salt []byte, p kdf.Params) ([32]byte, error) {
+	var key [32]byte
+	k, err := scrypt.Key([]byte(passphrase), salt, p.N, p.R, p.P, len(key))
+	if err != nil {
+		return key, fmt.Errorf("couldn't derive key: %w", err)
+	}
+	copy(key[:], k)
+	return key, nil
+}
+
+// nonce returns the nonce for the chunk with the given index. The last byte
+// of the nonce distinguishes the final chunk, and the header, from other
+// chunks.
+func nonce(idx uint64, flag byte) *[24]byte {
+	var n [24]byte
+	binary.BigEndian.PutUint64(n[:], idx)
+	n[len(n)-1] = flag
+	return &n
+}
@@ -0,0 +1,95 @@
+package backupcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret/kdf"
+)
+
+// params are cheap scrypt parameters, for testing.
+var params = kdf.Params{N: 2, R: 1, P: 1}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		want := make([]byte, size)
+		if _, err := rand.Read(want); err != nil {
+			t.Fatalf("Could not generate content: %v", err)
+		}
+		backup := encrypt(t, want)
+		// Shorter content may appear in the backup by chance.
+		if size >= 16 && bytes.Contains(backup, want) {
+			t.Errorf("Backup of %d bytes contains plaintext", size)
+		}
+		r, err := NewReader(bytes.NewReader(backup), "passphrase")
+		if err != nil {
+			t.Fatalf("Could not open backup of %d bytes: %v", size, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Could not read backup of %d bytes: %v", size, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("Backup of %d bytes read back as %d different bytes", size, len(got))
+		}
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	t.Parallel()
+
+	backup := encrypt(t, []byte("content"))
+	if _, err := NewReader(bytes.NewReader(backup), "wrong passphrase"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("NewReader with wrong passphrase returned error %v, want %v", err, ErrWrongPassphrase)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	t.Parallel()
+
+	backup := encrypt(t, make([]byte, 2*chunkSize+10))
+	for _, test := range []struct {
+		desc   string
+		backup []byte
+	}{
+		{"truncated after a chunk", backup[:len(backup)-(10+16)]},
+		{"truncated mid-chunk", backup[:len(backup)-5]},
+		{"modified", flip(backup, len(backup)-1)},
+		{"extended", append(append([]byte(nil), backup...), 0)},
+	} {
+		r, err := NewReader(bytes.NewReader(test.backup), "passphrase")
+		if err != nil {
+			t.Errorf("%s: could not open backup: %v", test.desc, err)
+			continue
+		}
+		if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: reading backup returned error %v, want %v", test.desc, err, ErrCorrupt)
+		}
+	}
+}
+
+func encrypt(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, "passphrase", params)
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Could not write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Could not close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func flip(b []byte, i int) []byte {
+	b = append([]byte(nil), b...)
+	b[i] ^= 1
+	return b
+}
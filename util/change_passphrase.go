@@ -0,0 +1,124 @@
+// change_passphrase changes the passphrase of a Harpocrates secretbox key in
+// place. The encrypted password entries protected by the key are unchanged.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh/terminal"
+
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+var (
+	keyFile = flag.String("key", "", "Location of the key to update.")
+	scryptN = flag.Int("N", 0, "New scrypt `N` value. Must be a power of 2 greater than 1. If unspecified, the existing value is kept.")
+	scryptR = flag.Int("r", 0, "New scrypt `r` value. Must satisfy r * p < 2^30. If unspecified, the existing value is kept.")
+	scryptP = flag.Int("p", 0, "New scrypt `p` value. Must satisfy r * p < 2^30. If unspecified, the existing value is kept.")
+
+	externalSecretFile = flag.String("external_secret_file", "", "Location of the external secret `file`, for keys which require one.")
+)
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+	if *keyFile == "" {
+		die("--key is required")
+	}
+
+	// Read key.
+	keyBytes, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		die("Could not read key file: %v", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		die("Could not parse key: %v", err)
+	}
+
+	var externalSecret []byte
+	if *externalSecretFile != "" {
+		if externalSecret, err = ioutil.ReadFile(*externalSecretFile); err != nil {
+			die("Could not read external secret: %v", err)
+		}
+	}
+
+	// Get old & new passphrases from user.
+	fmt.Printf("Current passphrase: ")
+	oldPassphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	fmt.Printf("New passphrase: ")
+	newPassphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	fmt.Printf("Enter it again: ")
+	secondTry, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	if !bytes.Equal(newPassphrase, secondTry) {
+		die("Passphrases don't match.")
+	}
+
+	// Rewrap key.
+	newKey, err := key.Rewrap(k, string(oldPassphrase), string(newPassphrase), key.WithScryptParams(*scryptN, *scryptR, *scryptP), key.WithExternalSecret(externalSecret))
+	if errors.Is(err, secret.ErrWrongPassphrase) {
+		die("Current passphrase is incorrect.")
+	}
+	if err != nil {
+		die("Could not change passphrase: %v", err)
+	}
+	newKeyBytes, err := proto.Marshal(newKey)
+	if err != nil {
+		die("Could not marshal key: %v", err)
+	}
+
+	// Atomically replace the existing key file.
+	if err := writeFileAtomically(*keyFile, newKeyBytes); err != nil {
+		die("Could not write key: %v", err)
+	}
+}
+
+// writeFileAtomically replaces the content of the given file. On
+// POSIX-compliant systems, the update is atomic.
+func writeFileAtomically(filename string, content []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".harp_key_tmp_")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+	if _, err := tempFile.Write(content); err != nil {
+		return fmt.Errorf("couldn't write key: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close %q: %w", tempFilename, err)
+	}
+	if err := os.Chmod(tempFilename, 0400); err != nil {
+		return fmt.Errorf("couldn't set permissions: %w", err)
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		return fmt.Errorf("couldn't rename %q -> %q: %w", tempFilename, filename, err)
+	}
+	return nil
+}
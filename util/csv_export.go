@@ -1,27 +1,36 @@
-// csv_export exports a vault to an UNENCRYPTED CSV file.
-// It is developed for use with 1Password's import feature, but is likely generally useful.
+// csv_export exports a vault to a file in a format suitable for import by other password managers.
+// Supported formats are CSV, 1Password's 1PIF, and KeePass 2 XML. None of these formats are encrypted, so
+// the output is either encrypted with a password (OpenPGP symmetric encryption, decryptable with
+// `gpg --decrypt`), or written in plaintext only if explicitly requested.
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/BranLwyd/harpocrates/secret"
 	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/BranLwyd/harpocrates/util/export"
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/ssh/terminal"
 
 	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
 )
 
 var (
-	inKeyFile   = flag.String("in_key", "", "Location of the input key.")
-	inLocation  = flag.String("in_location", "", "Location of the input password entries.")
-	outLocation = flag.String("out_location", "", "Location of the output CSV file.")
+	inKeyFile      = flag.String("in_key", "", "Location of the input key.")
+	inLocation     = flag.String("in_location", "", "Location of the input password entries.")
+	outLocation    = flag.String("out_location", "", "Location of the output file.")
+	format         = flag.String("format", "csv", fmt.Sprintf("Format of the output file. One of: %s.", strings.Join(formatNames(), ", ")))
+	outPassword    = flag.Bool("out_password", false, "If set, prompt for a password, and encrypt the output file with it.")
+	allowPlaintext = flag.Bool("allow_plaintext", false, "If set, allow writing the output file UNENCRYPTED. Ignored if --out_password is set.")
 )
 
 func main() {
@@ -36,60 +45,109 @@ func main() {
 	if *outLocation == "" {
 		die("--out_location is required")
 	}
+	f, ok := export.Formats[*format]
+	if !ok {
+		die("--format must be one of: %s", strings.Join(formatNames(), ", "))
+	}
+	if !*outPassword && !*allowPlaintext {
+		die("Refusing to write an unencrypted file: pass --out_password to encrypt the output, or --allow_plaintext to write it unencrypted")
+	}
 
 	// Create & unlock vault.
 	v, err := vault(*inLocation, *inKeyFile)
 	if err != nil {
 		die("Couldn't create vault: %v", err)
 	}
-	fmt.Printf("Passphrase: ")
-	inPass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Println()
+	inPass, err := readPassword("Passphrase: ")
 	if err != nil {
 		die("Could not get passphrase: %v", err)
 	}
-	s, err := v.Unlock(string(inPass))
+	s, err := v.Unlock(inPass)
 	if err != nil {
 		die("Could not open vault: %v", err)
 	}
-
-	// Write entries to CSV file.
-	f, err := os.Create(*outLocation)
-	if err != nil {
-		die("Couldn't create CSV file: %v", err)
+	var outPass string
+	if *outPassword {
+		if outPass, err = readPassword("Output password: "); err != nil {
+			die("Could not get output password: %v", err)
+		}
+		confirmPass, err := readPassword("Confirm output password: ")
+		if err != nil {
+			die("Could not get output password: %v", err)
+		}
+		if outPass != confirmPass {
+			die("Passwords do not match")
+		}
 	}
-	defer f.Close()
-	cw := csv.NewWriter(f)
 
+	// Read entries.
 	es, err := s.List()
 	if err != nil {
 		die("Couldn't list entries in password store: %v", err)
 	}
+	sort.Strings(es)
+	var rs []export.Record
 	for _, e := range es {
 		content, err := s.Get(e)
 		if err != nil {
 			die("Couldn't get content of %q: %v", e, err)
 		}
-		if err := cw.Write(record(e, content)); err != nil {
-			die("Couldn't write content of %q: %v", e, err)
-		}
+		rs = append(rs, export.NewRecord(e, content))
 	}
-	cw.Flush()
-	if err := cw.Error(); err != nil {
-		die("Couldn't ")
+
+	// Marshal entries & write the output file.
+	var buf bytes.Buffer
+	if err := f.Write(&buf, rs); err != nil {
+		die("Couldn't marshal entries: %v", err)
+	}
+	out, err := os.OpenFile(*outLocation, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		die("Couldn't create output file: %v", err)
+	}
+	if err := writeOutput(out, buf.Bytes(), outPass); err != nil {
+		out.Close()
+		os.Remove(*outLocation)
+		die("Couldn't write output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		die("Couldn't close output file: %v", err)
 	}
 }
 
-func record(entry, content string) []string {
-	lines := strings.Split(content, "\n")
-	rec := append([]string{entry}, lines...)
-
-	// Remove any trailing empty lines.
-	for len(rec) > 0 && rec[len(rec)-1] == "" {
-		rec = rec[:len(rec)-1]
+// writeOutput writes data to w, encrypted with the given password if it is
+// non-empty.
+func writeOutput(w io.Writer, data []byte, password string) error {
+	if password == "" {
+		_, err := w.Write(data)
+		return err
+	}
+	ew, err := openpgp.SymmetricallyEncrypt(w, []byte(password), nil, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't start encryption: %w", err)
+	}
+	if _, err := ew.Write(data); err != nil {
+		return fmt.Errorf("couldn't encrypt: %w", err)
 	}
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("couldn't finish encryption: %w", err)
+	}
+	return nil
+}
+
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(pass), err
+}
 
-	return rec
+func formatNames() []string {
+	var names []string
+	for name := range export.Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func vault(location, keyFile string) (secret.Vault, error) {
@@ -58,10 +58,20 @@ func describeKey(kf string) {
 	switch k := key.Key.(type) {
 	case *kpb.Key_PgpKey:
 		fmt.Printf("%s: PGP key\n", kf)
-		// TODO: more detail?
+		fmt.Printf("Additional recipients: %d\n", len(k.PgpKey.AdditionalRecipients))
+	case *kpb.Key_GpgAgentKey:
+		fmt.Printf("%s: gpg-agent key\n", kf)
+		fmt.Printf("Fingerprint: %s\n", k.GpgAgentKey.Fingerprint)
 	case *kpb.Key_SecretboxKey:
 		fmt.Printf("%s: Secretbox key\n", kf)
-		fmt.Printf("Parameters: N = %d, r = %d, p = %d\n", k.SecretboxKey.N, k.SecretboxKey.R, k.SecretboxKey.P)
+		if a := k.SecretboxKey.Argon2; a != nil {
+			fmt.Printf("Argon2id parameters: memory = %d KiB, iterations = %d, parallelism = %d\n", a.Memory, a.Iterations, a.Parallelism)
+		} else {
+			fmt.Printf("Scrypt parameters: N = %d, r = %d, p = %d\n", k.SecretboxKey.N, k.SecretboxKey.R, k.SecretboxKey.P)
+		}
+		if k.SecretboxKey.RequiresExternalSecret {
+			fmt.Println("Requires external secret: yes")
+		}
 	case nil:
 		die("%s: couldn't parse keyfile: no key", kf)
 	default:
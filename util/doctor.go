@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/BranLwyd/harpocrates/harpd/counter"
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/file"
+	"github.com/BranLwyd/harpocrates/secret/key"
+
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+var (
+	keyFile     = flag.String("key", "", "Location of the key.")
+	location    = flag.String("location", "", "Location of the password entries.")
+	counterFile = flag.String("counters", "", "Location of the MFA counter file. If unspecified, the counter file is not checked.")
+	fix         = flag.Bool("fix", false, "If set, remove orphaned temporary files.")
+	manifest    = flag.Bool("manifest", false, "If set, verify the store against its manifest, as kept by harpd's manifest option.")
+	rebuild     = flag.Bool("rebuild_manifest", false, "If set, replace the store's manifest with one describing the store's files as they are now, accepting any changes made other than via harpd. Requires --manifest.")
+)
+
+// check is a single check of a vault's health. Checks return a list of
+// problems found; if no problems are found, the check passes.
+type check struct {
+	desc string
+	run  func() ([]string, error)
+}
+
+func main() {
+	// Parse & validate flags.
+	flag.Parse()
+	if *keyFile == "" {
+		die("--key is required")
+	}
+	if *location == "" {
+		die("--location is required")
+	}
+	if *rebuild && !*manifest {
+		die("--rebuild_manifest requires --manifest")
+	}
+
+	// Read key & unlock vault.
+	keyBytes, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		die("Could not read key file: %v", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		die("Could not parse key: %v", err)
+	}
+	var vaultOpts []key.VaultOption
+	if *manifest {
+		vaultOpts = append(vaultOpts, key.WithManifest())
+	}
+	v, err := key.NewVault(*location, k, vaultOpts...)
+	if err != nil {
+		die("Could not create vault: %v", err)
+	}
+	fmt.Printf("Passphrase: ")
+	inPass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	s, err := v.Unlock(string(inPass))
+	if err != nil {
+		die("Could not open vault: %v", err)
+	}
+
+	// Run checks & report results.
+	ext := extension(k)
+	checks := []check{
+		{"key parameters are sane", func() ([]string, error) { return checkKey(k), nil }},
+		{"entries decrypt", func() ([]string, error) { return problems(file.CheckEntries(s)) }},
+		{"no entries with another store's extension", func() ([]string, error) { return file.FindForeignEntries(*location, ext) }},
+		{"no symlinks outside of the store", func() ([]string, error) { return problems(file.FindEscapingSymlinks(*location)) }},
+		{"no orphaned temporary files", checkTempFiles},
+	}
+	if ext == ".gpg" {
+		checks = append(checks, check{".gpg-id is present", checkGPGID})
+	}
+	if *counterFile != "" {
+		checks = append(checks, check{"MFA counter file parses", checkCounters})
+	}
+	if *manifest {
+		checks = append(checks, check{"store matches its manifest", func() ([]string, error) { return checkManifest(s) }})
+	}
+
+	failed := false
+	for _, c := range checks {
+		ps, err := c.run()
+		if err != nil {
+			ps = append(ps, fmt.Sprintf("couldn't run check: %v", err))
+		}
+		if len(ps) == 0 {
+			fmt.Printf("[PASS] %s\n", c.desc)
+			continue
+		}
+		failed = true
+		fmt.Printf("[FAIL] %s\n", c.desc)
+		for _, p := range ps {
+			fmt.Printf("         %s\n", p)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkKey checks that the parameters of the given key are in sane ranges.
+func checkKey(k *kpb.Key) []string {
+	var ps []string
+	switch k := k.Key.(type) {
+	case *kpb.Key_PgpKey:
+		if len(k.PgpKey.SerializedEntity) == 0 {
+			ps = append(ps, "PGP key has no entity")
+		}
+	case *kpb.Key_GpgAgentKey:
+		if k.GpgAgentKey.Fingerprint == "" {
+			ps = append(ps, "gpg-agent key has no fingerprint")
+		}
+	case *kpb.Key_SecretboxKey:
+		sk := k.SecretboxKey
+		if len(sk.EncryptedKey) != 48 {
+			ps = append(ps, fmt.Sprintf("encrypted key is %d bytes, want 48", len(sk.EncryptedKey)))
+		}
+		if len(sk.EncryptedKeyNonce) != 24 {
+			ps = append(ps, fmt.Sprintf("encrypted key nonce is %d bytes, want 24", len(sk.EncryptedKeyNonce)))
+		}
+		if a := sk.Argon2; a != nil {
+			if len(a.Salt) < 16 {
+				ps = append(ps, fmt.Sprintf("Argon2id salt is %d bytes, want at least 16", len(a.Salt)))
+			}
+			if a.Memory < 19*1024 {
+				ps = append(ps, fmt.Sprintf("Argon2id memory is %d KiB, want at least %d KiB", a.Memory, 19*1024))
+			}
+			if a.Iterations < 1 {
+				ps = append(ps, "Argon2id iterations is 0, want at least 1")
+			}
+			if a.Parallelism < 1 || a.Parallelism > 255 {
+				ps = append(ps, fmt.Sprintf("Argon2id parallelism is %d, want 1-255", a.Parallelism))
+			}
+		} else {
+			if len(sk.Salt) < 16 {
+				ps = append(ps, fmt.Sprintf("scrypt salt is %d bytes, want at least 16", len(sk.Salt)))
+			}
+			if sk.N < 1<<14 || sk.N&(sk.N-1) != 0 {
+				ps = append(ps, fmt.Sprintf("scrypt N is %d, want a power of two, at least %d", sk.N, 1<<14))
+			}
+			if sk.R < 1 || sk.P < 1 {
+				ps = append(ps, fmt.Sprintf("scrypt r = %d, p = %d, want both at least 1", sk.R, sk.P))
+			}
+		}
+	default:
+		ps = append(ps, "unknown key type")
+	}
+	return ps
+}
+
+// checkTempFiles checks for orphaned temporary files in the store and beside
+// the counter file, removing them if requested.
+func checkTempFiles() ([]string, error) {
+	dirs := []string{*location}
+	if *counterFile != "" {
+		if d := filepath.Dir(*counterFile); d != filepath.Clean(*location) {
+			dirs = append(dirs, d)
+		}
+	}
+	var ps []string
+	for _, d := range dirs {
+		fns, err := file.FindTempFiles(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range fns {
+			if !*fix {
+				ps = append(ps, fn)
+				continue
+			}
+			if err := os.Remove(fn); err != nil {
+				ps = append(ps, fmt.Sprintf("%s: couldn't remove: %v", fn, err))
+				continue
+			}
+			fmt.Printf("Removed %s\n", fn)
+		}
+	}
+	return ps, nil
+}
+
+func checkGPGID() ([]string, error) {
+	if _, err := os.Stat(filepath.Join(*location, ".gpg-id")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{"no .gpg-id file; pass-compatible tools will not be able to use this store"}, nil
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// checkManifest verifies the store against its manifest, rebuilding the
+// manifest if requested.
+func checkManifest(s secret.Store) ([]string, error) {
+	if *rebuild {
+		if err := file.RebuildManifest(s); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Rebuilt manifest\n")
+	}
+	vs, ok := secret.AsVerifyStore(s)
+	if !ok {
+		return []string{"store does not keep a manifest"}, nil
+	}
+	return vs.Verify()
+}
+
+func checkCounters() ([]string, error) {
+	if _, err := counter.NewStore(*counterFile); err != nil {
+		return []string{err.Error()}, nil
+	}
+	return nil, nil
+}
+
+// extension returns the extension used for entry files by vaults of the given key.
+func extension(k *kpb.Key) string {
+	if k.GetSecretboxKey() != nil {
+		return ".harp"
+	}
+	return ".gpg"
+}
+
+// problems converts the result of a check returning problems to a list of strings.
+func problems(ps []file.Problem, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	var ss []string
+	for _, p := range ps {
+		ss = append(ss, p.String())
+	}
+	return ss, nil
+}
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
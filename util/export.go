@@ -0,0 +1,117 @@
+// Package export provides marshaling of password entries into formats
+// understood by other password managers.
+package export
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret/entry"
+)
+
+// Format is an export format.
+type Format interface {
+	// Write writes the given records to w.
+	Write(w io.Writer, rs []Record) error
+
+	// Read reads records from r, as written by Write.
+	Read(r io.Reader) ([]Record, error)
+}
+
+// Formats holds the supported formats, keyed by name.
+var Formats = map[string]Format{
+	"csv":         CSV,
+	"1pif":        OnePIF,
+	"keepass-xml": KeePassXML,
+}
+
+// Record is a single exported entry.
+type Record struct {
+	Path     string // entry name, e.g. "/web/example.com"
+	Password string
+	Username string
+	URL      string
+	OTP      string
+	Fields   []Field // `key: value` lines other than known fields
+	Notes    string  // all other lines
+}
+
+// Field is a custom `key: value` field of an entry.
+type Field struct {
+	Name, Value string
+}
+
+// NewRecord creates a record from the given entry name & content.
+func NewRecord(entryName, content string) Record {
+	e := entry.Parse(content)
+	fields, notes := splitNotes(e.Notes)
+	if e.Expires != "" {
+		// Other password managers have no notion of expiration, so keep it
+		// as a custom field.
+		fields = append([]Field{{"expires", e.Expires}}, fields...)
+	}
+	return Record{
+		Path:     entryName,
+		Password: e.Password,
+		Username: e.Username,
+		URL:      e.URL,
+		OTP:      e.OTP,
+		Fields:   fields,
+		Notes:    notes,
+	}
+}
+
+// Content serializes the record back into entry content.
+func (r Record) Content() string {
+	return entry.Entry{
+		Password: r.Password,
+		Username: r.Username,
+		URL:      r.URL,
+		OTP:      r.OTP,
+		Notes:    r.joinNotes(),
+	}.String()
+}
+
+// joinNotes returns the record's custom fields as `key: value` lines,
+// followed by its notes.
+func (r Record) joinNotes() string {
+	var lines []string
+	for _, f := range r.Fields {
+		lines = append(lines, f.Name+": "+f.Value)
+	}
+	if r.Notes != "" {
+		lines = append(lines, r.Notes)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitNotes splits custom `key: value` fields from other notes. It is the
+// inverse of joinNotes.
+func splitNotes(s string) (fields []Field, notes string) {
+	var ns []string
+	for _, l := range strings.Split(s, "\n") {
+		if idx := strings.Index(l, ": "); idx > 0 && !strings.HasPrefix(l, " ") && strings.TrimSpace(l[idx+2:]) != "" {
+			fields = append(fields, Field{l[:idx], strings.TrimSpace(l[idx+2:])})
+			continue
+		}
+		ns = append(ns, l)
+	}
+	return fields, strings.Join(ns, "\n")
+}
+
+// Group returns the directory holding the record, without leading or
+// trailing slashes, e.g. "web". Entries at the root have an empty group.
+func (r Record) Group() string {
+	return strings.Trim(path.Dir(path.Join("/", r.Path)), "/")
+}
+
+// Title returns the base name of the record, e.g. "example.com".
+func (r Record) Title() string {
+	return path.Base(path.Join("/", r.Path))
+}
+
+// recordPath determines an entry name from a group & title.
+func recordPath(group, title string) string {
+	return path.Join("/", group, title)
+}
@@ -0,0 +1,175 @@
+package export
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// OnePIF is the 1Password Interchange Format. Each record is exported as a
+// login item; the record's group is exported as a tag.
+var OnePIF Format = onePIFFormat{}
+
+// onePIFSeparator separates items in a 1PIF file.
+const onePIFSeparator = "***5642bee8-a5ff-11dc-8314-0800200c9a66***"
+
+type onePIFFormat struct{}
+
+type onePIFItem struct {
+	UUID           string             `json:"uuid"`
+	TypeName       string             `json:"typeName"`
+	Title          string             `json:"title"`
+	Location       string             `json:"location,omitempty"`
+	OpenContents   onePIFOpenContents `json:"openContents"`
+	SecureContents onePIFSecure       `json:"secureContents"`
+}
+
+type onePIFOpenContents struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+type onePIFSecure struct {
+	Fields     []onePIFField   `json:"fields,omitempty"`
+	URLs       []onePIFURL     `json:"URLs,omitempty"`
+	NotesPlain string          `json:"notesPlain,omitempty"`
+	Sections   []onePIFSection `json:"sections,omitempty"`
+}
+
+type onePIFField struct {
+	Designation string `json:"designation"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Value       string `json:"value"`
+}
+
+type onePIFURL struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+type onePIFSection struct {
+	Name   string               `json:"name"`
+	Title  string               `json:"title"`
+	Fields []onePIFSectionField `json:"fields"`
+}
+
+type onePIFSectionField struct {
+	Kind  string `json:"k"`
+	Name  string `json:"n"`
+	Title string `json:"t"`
+	Value string `json:"v"`
+}
+
+const (
+	onePIFOTPName   = "TOTP"
+	onePIFOTPTitle  = "one-time password"
+	onePIFSectionID = "harpocrates"
+)
+
+func (onePIFFormat) Write(w io.Writer, rs []Record) error {
+	for _, r := range rs {
+		uuid, err := onePIFUUID()
+		if err != nil {
+			return err
+		}
+		item := onePIFItem{
+			UUID:     uuid,
+			TypeName: "webforms.WebForm",
+			Title:    r.Title(),
+			Location: r.URL,
+			SecureContents: onePIFSecure{
+				Fields: []onePIFField{
+					{Designation: "username", Name: "username", Type: "T", Value: r.Username},
+					{Designation: "password", Name: "password", Type: "P", Value: r.Password},
+				},
+				NotesPlain: r.Notes,
+			},
+		}
+		if g := r.Group(); g != "" {
+			item.OpenContents.Tags = []string{g}
+		}
+		if r.URL != "" {
+			item.SecureContents.URLs = []onePIFURL{{Label: "website", URL: r.URL}}
+		}
+		var sfs []onePIFSectionField
+		if r.OTP != "" {
+			sfs = append(sfs, onePIFSectionField{Kind: "concealed", Name: onePIFOTPName, Title: onePIFOTPTitle, Value: r.OTP})
+		}
+		for _, f := range r.Fields {
+			sfs = append(sfs, onePIFSectionField{Kind: "string", Name: f.Name, Title: f.Name, Value: f.Value})
+		}
+		if len(sfs) > 0 {
+			item.SecureContents.Sections = []onePIFSection{{Name: onePIFSectionID, Title: "Fields", Fields: sfs}}
+		}
+
+		buf, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal %q: %w", r.Path, err)
+		}
+		if _, err := fmt.Fprintf(w, "%s\n%s\n", buf, onePIFSeparator); err != nil {
+			return fmt.Errorf("couldn't write %q: %w", r.Path, err)
+		}
+	}
+	return nil
+}
+
+func (onePIFFormat) Read(r io.Reader) ([]Record, error) {
+	var rs []Record
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line == onePIFSeparator {
+			continue
+		}
+		var item onePIFItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return nil, fmt.Errorf("couldn't unmarshal item: %w", err)
+		}
+
+		var group string
+		if len(item.OpenContents.Tags) > 0 {
+			group = item.OpenContents.Tags[0]
+		}
+		rec := Record{
+			Path:  recordPath(group, item.Title),
+			URL:   item.Location,
+			Notes: item.SecureContents.NotesPlain,
+		}
+		for _, f := range item.SecureContents.Fields {
+			switch f.Designation {
+			case "username":
+				rec.Username = f.Value
+			case "password":
+				rec.Password = f.Value
+			}
+		}
+		for _, sec := range item.SecureContents.Sections {
+			for _, f := range sec.Fields {
+				if f.Name == onePIFOTPName && f.Title == onePIFOTPTitle {
+					rec.OTP = f.Value
+					continue
+				}
+				rec.Fields = append(rec.Fields, Field{f.Title, f.Value})
+			}
+		}
+		rs = append(rs, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read 1PIF: %w", err)
+	}
+	return rs, nil
+}
+
+// onePIFUUID generates a new random item UUID, in the form used by 1PIF.
+func onePIFUUID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("couldn't generate UUID: %w", err)
+	}
+	return strings.ToUpper(hex.EncodeToString(id[:])), nil
+}
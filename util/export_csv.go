@@ -0,0 +1,62 @@
+package export
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CSV is a CSV format with one record per row, suitable for import by most
+// password managers. Custom fields are included in the notes column.
+var CSV Format = csvFormat{}
+
+var csvHeader = []string{"group", "title", "username", "password", "url", "otp", "notes"}
+
+type csvFormat struct{}
+
+func (csvFormat) Write(w io.Writer, rs []Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("couldn't write header: %w", err)
+	}
+	for _, r := range rs {
+		if err := cw.Write([]string{r.Group(), r.Title(), r.Username, r.Password, r.URL, r.OTP, r.joinNotes()}); err != nil {
+			return fmt.Errorf("couldn't write %q: %w", r.Path, err)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvFormat) Read(r io.Reader) ([]Record, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	recs, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CSV: %w", err)
+	}
+	if len(recs) == 0 {
+		return nil, errors.New("missing header")
+	}
+	for i, h := range csvHeader {
+		if recs[0][i] != h {
+			return nil, fmt.Errorf("unexpected header %q", recs[0])
+		}
+	}
+
+	var rs []Record
+	for _, rec := range recs[1:] {
+		fields, notes := splitNotes(rec[6])
+		rs = append(rs, Record{
+			Path:     recordPath(rec[0], rec[1]),
+			Username: rec[2],
+			Password: rec[3],
+			URL:      rec[4],
+			OTP:      rec[5],
+			Fields:   fields,
+			Notes:    notes,
+		})
+	}
+	return rs, nil
+}
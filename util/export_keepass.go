@@ -0,0 +1,184 @@
+package export
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeePassXML is the KeePass 2 XML format, as accepted by KeePass' and
+// KeePassXC's XML import. Each record's group is exported as a (possibly
+// nested) KeePass group.
+var KeePassXML Format = keepassFormat{}
+
+type keepassFormat struct{}
+
+type keepassFile struct {
+	XMLName xml.Name    `xml:"KeePassFile"`
+	Meta    keepassMeta `xml:"Meta"`
+	Root    keepassRoot `xml:"Root"`
+}
+
+type keepassMeta struct {
+	Generator    string `xml:"Generator"`
+	DatabaseName string `xml:"DatabaseName"`
+}
+
+type keepassRoot struct {
+	Group *keepassGroup `xml:"Group"`
+}
+
+type keepassGroup struct {
+	UUID    string          `xml:"UUID"`
+	Name    string          `xml:"Name"`
+	Entries []keepassEntry  `xml:"Entry"`
+	Groups  []*keepassGroup `xml:"Group"`
+}
+
+type keepassEntry struct {
+	UUID    string          `xml:"UUID"`
+	Strings []keepassString `xml:"String"`
+}
+
+type keepassString struct {
+	Key   string       `xml:"Key"`
+	Value keepassValue `xml:"Value"`
+}
+
+type keepassValue struct {
+	Value           string `xml:",chardata"`
+	ProtectInMemory string `xml:"ProtectInMemory,attr,omitempty"`
+}
+
+const keepassRootName = "Root"
+
+func (keepassFormat) Write(w io.Writer, rs []Record) error {
+	root, err := newKeePassGroup(keepassRootName)
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		// Find (or create) the group holding this record.
+		g := root
+		if group := r.Group(); group != "" {
+		nextName:
+			for _, name := range strings.Split(group, "/") {
+				for _, sg := range g.Groups {
+					if sg.Name == name {
+						g = sg
+						continue nextName
+					}
+				}
+				sg, err := newKeePassGroup(name)
+				if err != nil {
+					return err
+				}
+				g.Groups = append(g.Groups, sg)
+				g = sg
+			}
+		}
+
+		uuid, err := keepassUUID()
+		if err != nil {
+			return err
+		}
+		e := keepassEntry{UUID: uuid}
+		add := func(k, v string, protect bool) {
+			kv := keepassString{Key: k, Value: keepassValue{Value: v}}
+			if protect {
+				kv.Value.ProtectInMemory = "True"
+			}
+			e.Strings = append(e.Strings, kv)
+		}
+		add("Title", r.Title(), false)
+		add("UserName", r.Username, false)
+		add("Password", r.Password, true)
+		add("URL", r.URL, false)
+		add("Notes", r.Notes, false)
+		if r.OTP != "" {
+			add("otp", r.OTP, true)
+		}
+		for _, f := range r.Fields {
+			add(f.Name, f.Value, false)
+		}
+		g.Entries = append(g.Entries, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("couldn't write XML header: %w", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(keepassFile{
+		Meta: keepassMeta{Generator: "harpocrates", DatabaseName: "harpocrates"},
+		Root: keepassRoot{Group: root},
+	}); err != nil {
+		return fmt.Errorf("couldn't encode XML: %w", err)
+	}
+	return nil
+}
+
+func (keepassFormat) Read(r io.Reader) ([]Record, error) {
+	var f keepassFile
+	if err := xml.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("couldn't decode XML: %w", err)
+	}
+	if f.Root.Group == nil {
+		return nil, nil
+	}
+
+	var rs []Record
+	var walk func(group string, g *keepassGroup)
+	walk = func(group string, g *keepassGroup) {
+		for _, e := range g.Entries {
+			var title string
+			var rec Record
+			for _, kv := range e.Strings {
+				v := kv.Value.Value
+				switch kv.Key {
+				case "Title":
+					title = v
+				case "UserName":
+					rec.Username = v
+				case "Password":
+					rec.Password = v
+				case "URL":
+					rec.URL = v
+				case "Notes":
+					rec.Notes = v
+				case "otp":
+					rec.OTP = v
+				default:
+					rec.Fields = append(rec.Fields, Field{kv.Key, v})
+				}
+			}
+			rec.Path = recordPath(group, title)
+			rs = append(rs, rec)
+		}
+		for _, sg := range g.Groups {
+			walk(strings.TrimPrefix(group+"/"+sg.Name, "/"), sg)
+		}
+	}
+	walk("", f.Root.Group)
+	return rs, nil
+}
+
+func newKeePassGroup(name string) (*keepassGroup, error) {
+	uuid, err := keepassUUID()
+	if err != nil {
+		return nil, err
+	}
+	return &keepassGroup{UUID: uuid, Name: name}, nil
+}
+
+// keepassUUID generates a new random UUID, in the form used by KeePass XML.
+func keepassUUID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("couldn't generate UUID: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(id[:]), nil
+}
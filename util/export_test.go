@@ -0,0 +1,72 @@
+package export
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+var testEntries = map[string]string{
+	"/bank":               "hunter2",
+	"/web/example.com":    "pa55word\nusername: alice\nurl: https://example.com/login\nfree-form notes\non two lines",
+	"/web/mail/work":      "correct horse\nusername: bob\notpauth://totp/Work:bob?secret=JBSWY3DPEHPK3PXP&issuer=Work\npin: 1234",
+	"/social/network.org": "p,a\"s;s\nurl: https://network.org\notp: JBSWY3DPEHPK3PXP\nsecurity question: first pet\n<b>& not markup</b>",
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	var rs []Record
+	for e, content := range testEntries {
+		rs = append(rs, NewRecord(e, content))
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Path < rs[j].Path })
+
+	for name, f := range Formats {
+		var buf bytes.Buffer
+		if err := f.Write(&buf, rs); err != nil {
+			t.Errorf("[%s] Could not write: %v", name, err)
+			continue
+		}
+		got, err := f.Read(&buf)
+		if err != nil {
+			t.Errorf("[%s] Could not read: %v", name, err)
+			continue
+		}
+
+		if len(got) != len(testEntries) {
+			t.Errorf("[%s] Got %d records, want %d", name, len(got), len(testEntries))
+		}
+		for _, r := range got {
+			want, ok := testEntries[r.Path]
+			if !ok {
+				t.Errorf("[%s] Got unexpected record %q", name, r.Path)
+				continue
+			}
+			if content := r.Content(); content != want {
+				t.Errorf("[%s] Content of %q was %q, want %q", name, r.Path, content, want)
+			}
+		}
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	t.Parallel()
+
+	r := NewRecord("/web/mail/work", testEntries["/web/mail/work"])
+	if got, want := r.Group(), "web/mail"; got != want {
+		t.Errorf("Group() = %q, want %q", got, want)
+	}
+	if got, want := r.Title(), "work"; got != want {
+		t.Errorf("Title() = %q, want %q", got, want)
+	}
+	if r.Password != "correct horse" || r.Username != "bob" || r.OTP == "" {
+		t.Errorf("Known fields were not parsed: %+v", r)
+	}
+	if len(r.Fields) != 1 || r.Fields[0] != (Field{"pin", "1234"}) {
+		t.Errorf("Fields = %v, want [{pin 1234}]", r.Fields)
+	}
+	if r := NewRecord("/bank", "hunter2"); r.Group() != "" {
+		t.Errorf("Group() of root entry = %q, want empty", r.Group())
+	}
+}
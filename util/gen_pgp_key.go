@@ -4,6 +4,11 @@
 //   [generate a private key suing standard PGP tools]
 //  $ pgp --export-secret-key "key identity" >serialized_entity
 //  $ wrap_serialized_pgp_entity --in=serialized_entity --out=key
+//
+// To allow others to decrypt entries, export their public keys and pass them
+// as additional recipients:
+//  $ pgp --export "other identity" >other_pubkey
+//  $ wrap_serialized_pgp_entity --in=serialized_entity --additional_recipients=other_pubkey --out=key
 package main
 
 import (
@@ -12,6 +17,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/crypto/openpgp"
@@ -23,6 +29,7 @@ import (
 var (
 	out    = flag.String("out", "", "Location to write harpocrates key.")
 	seFile = flag.String("serialized_entity", "", "Location of serialized PGP entity.")
+	recips = flag.String("additional_recipients", "", "Comma-separated locations of serialized PGP public keys of additional recipients, who will also be able to decrypt entries.")
 )
 
 func die(format string, a ...interface{}) {
@@ -48,9 +55,33 @@ func main() {
 		die("Could not parse serialized entity: %v", err)
 	}
 
+	// Read additional recipients, reserializing each entity so that one file may hold several keys.
+	var additionalRecipients [][]byte
+	if *recips != "" {
+		for _, fn := range strings.Split(*recips, ",") {
+			f, err := os.Open(fn)
+			if err != nil {
+				die("Could not open %q: %v", fn, err)
+			}
+			el, err := openpgp.ReadKeyRing(f)
+			f.Close()
+			if err != nil {
+				die("Could not parse keys in %q: %v", fn, err)
+			}
+			for _, e := range el {
+				var buf bytes.Buffer
+				if err := e.Serialize(&buf); err != nil {
+					die("Could not serialize key from %q: %v", fn, err)
+				}
+				additionalRecipients = append(additionalRecipients, buf.Bytes())
+			}
+		}
+	}
+
 	keyBytes, err := proto.Marshal(&pb.Key{
 		Key: &pb.Key_PgpKey{&pb.PGPKey{
-			SerializedEntity: se,
+			SerializedEntity:     se,
+			AdditionalRecipients: additionalRecipients,
 		}},
 	})
 	if err != nil {
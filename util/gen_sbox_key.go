@@ -8,25 +8,39 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/scrypt"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/BranLwyd/harpocrates/secret/kdf"
+
 	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
 )
 
 var (
 	out     = flag.String("out", "", "Location to write key.")
+	kdfName = flag.String("kdf", "scrypt", "Key derivation function used to derive the key-encryption key from the passphrase. One of `scrypt` or argon2id.")
 	scryptN = flag.Int("N", 32768, "Scrypt `N` value. Must be a power of 2 greater than 1.")
 	scryptR = flag.Int("r", 8, "Scrypt `r` value. Must satisfy r * p < 2^30.")
 	scryptP = flag.Int("p", 1, "Scrypt `p` value. Must satisfy r * p < 2^30.")
+
+	calibrate = flag.Int("calibrate", 0, "If positive, choose scrypt parameters by benchmarking this machine, using the largest N for which key derivation takes at most `target_ms` milliseconds. Overrides --N, --r & --p.")
+
+	argon2Memory      = flag.Uint("argon2_memory", 64*1024, "Argon2id memory, in `KiB`.")
+	argon2Iterations  = flag.Uint("argon2_iterations", 3, "Argon2id `iterations`. Must be positive.")
+	argon2Parallelism = flag.Uint("argon2_parallelism", 4, "Argon2id `parallelism`. Must be between 1 and 255.")
+
+	externalSecretFile = flag.String("external_secret_file", "", "If set, the key requires the external secret held in this `file` (e.g. on a USB stick) to be unlocked, in addition to the passphrase.")
 )
 
 const (
-	keySize   = 32
-	nonceSize = 24
+	keySize          = 32
+	nonceSize        = 24
+	externalSaltSize = 16
 )
 
 func die(format string, a ...interface{}) {
@@ -39,6 +53,52 @@ func main() {
 	if *out == "" {
 		die("--out is required")
 	}
+	switch *kdfName {
+	case "scrypt":
+		if *calibrate < 0 {
+			die("--calibrate must be nonnegative")
+		}
+	case "argon2id":
+		if *calibrate != 0 {
+			die("--calibrate is only supported with --kdf=scrypt")
+		}
+		if *argon2Iterations == 0 {
+			die("--argon2_iterations must be positive")
+		}
+		if *argon2Parallelism == 0 || *argon2Parallelism > 255 {
+			die("--argon2_parallelism must be between 1 and 255")
+		}
+	default:
+		die("--kdf must be one of scrypt or argon2id")
+	}
+
+	var externalSecret []byte
+	if *externalSecretFile != "" {
+		es, err := ioutil.ReadFile(*externalSecretFile)
+		if err != nil {
+			die("Could not read external secret: %v", err)
+		}
+		if len(es) == 0 {
+			die("External secret file %q is empty", *externalSecretFile)
+		}
+		externalSecret = es
+	}
+
+	// Choose scrypt parameters, if requested. This is done before asking for
+	// the passphrase, so that the user can decide whether to continue.
+	if *calibrate > 0 {
+		target := time.Duration(*calibrate) * time.Millisecond
+		fmt.Printf("Calibrating scrypt parameters for a target of %v...\n", target)
+		p, err := kdf.Calibrate(target)
+		if err != nil {
+			die("Could not calibrate scrypt parameters: %v", err)
+		}
+		fmt.Printf("Chose scrypt parameters %v.\n", p)
+		if target < kdf.WeakDuration {
+			fmt.Printf("Warning: derivation in under %v makes guessing the passphrase cheap; consider a larger target.\n", kdf.WeakDuration)
+		}
+		*scryptN, *scryptR, *scryptP = p.N, p.R, p.P
+	}
 
 	// Get passphrase from user.
 	fmt.Printf("Passphrase: ")
@@ -72,24 +132,45 @@ func main() {
 	if _, err := rand.Read(salt[len("harpocrates_key_"):]); err != nil {
 		die("Could not generate salt: %v", err)
 	}
-	kekBuf, err := scrypt.Key(passphrase, salt, *scryptN, *scryptR, *scryptP, keySize)
-	if err != nil {
-		die("Could not derive KEK: %v", err)
-	}
+	sk := &kpb.SecretboxKey{}
 	var kek [keySize]byte
-	copy(kek[:], kekBuf)
+	switch *kdfName {
+	case "scrypt":
+		kekBuf, err := scrypt.Key(passphrase, salt, *scryptN, *scryptR, *scryptP, keySize)
+		if err != nil {
+			die("Could not derive KEK: %v", err)
+		}
+		copy(kek[:], kekBuf)
+		sk.Salt, sk.N, sk.R, sk.P = salt, int32(*scryptN), int32(*scryptR), int32(*scryptP)
+
+	case "argon2id":
+		copy(kek[:], argon2.IDKey(passphrase, salt, uint32(*argon2Iterations), uint32(*argon2Memory), uint8(*argon2Parallelism), keySize))
+		sk.Argon2 = &kpb.Argon2Params{
+			Salt:        salt,
+			Memory:      uint32(*argon2Memory),
+			Iterations:  uint32(*argon2Iterations),
+			Parallelism: uint32(*argon2Parallelism),
+		}
+	}
+
+	// Combine the KEK with the external secret, if requested.
+	if externalSecret != nil {
+		externalSalt := make([]byte, externalSaltSize)
+		if _, err := rand.Read(externalSalt); err != nil {
+			die("Could not generate salt: %v", err)
+		}
+		combined, err := kdf.CombineExternalSecret(kek[:], externalSalt, externalSecret)
+		if err != nil {
+			die("Could not derive KEK: %v", err)
+		}
+		copy(kek[:], combined)
+		sk.RequiresExternalSecret, sk.ExternalSalt = true, externalSalt
+	}
 
 	// Generate key proto & write to disk.
-	keyBytes, err := proto.Marshal(&kpb.Key{
-		Key: &kpb.Key_SecretboxKey{&kpb.SecretboxKey{
-			EncryptedKey:      secretbox.Seal(nil, ek[:], &eekNonce, &kek),
-			EncryptedKeyNonce: eekNonce[:],
-			Salt:              salt,
-			N:                 int32(*scryptN),
-			R:                 int32(*scryptR),
-			P:                 int32(*scryptP),
-		}},
-	})
+	sk.EncryptedKey = secretbox.Seal(nil, ek[:], &eekNonce, &kek)
+	sk.EncryptedKeyNonce = eekNonce[:]
+	keyBytes, err := proto.Marshal(&kpb.Key{Key: &kpb.Key_SecretboxKey{SecretboxKey: sk}})
 	if err != nil {
 		die("Could not marshal key: %v", err)
 	}
@@ -0,0 +1,180 @@
+// import imports entries into a vault, from either a pass password store or a file written by csv_export.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/BranLwyd/harpocrates/util/export"
+	"github.com/BranLwyd/harpocrates/util/importer"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh/terminal"
+
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+const passDirFormat = "pass-dir"
+
+var (
+	inFormat    = flag.String("in_format", "csv", fmt.Sprintf("Format of the input. One of: %s.", strings.Join(formatNames(), ", ")))
+	inLocation  = flag.String("in_location", "", "Location of the input file, or of the pass password store if --in_format=pass-dir.")
+	outKeyFile  = flag.String("out_key", "", "Location of the output key.")
+	outLocation = flag.String("out_location", "", "Location of the output password entries.")
+	onConflict  = flag.String("on_conflict", "skip", "What to do if an imported entry already exists. One of: skip, overwrite, suffix.")
+	dryRun      = flag.Bool("dry_run", false, "If set, list the entries that would be imported without writing them.")
+	resume      = flag.Bool("resume", false, "If set, finish an interrupted import rather than reading input. --in_location is not required.")
+)
+
+func main() {
+	// Parse & validate flags.
+	flag.Parse()
+	if *inLocation == "" && !*resume {
+		die("--in_location is required")
+	}
+	if *outKeyFile == "" {
+		die("--out_key is required")
+	}
+	if *outLocation == "" {
+		die("--out_location is required")
+	}
+	switch importer.Conflict(*onConflict) {
+	case importer.Skip, importer.Overwrite, importer.Suffix:
+	default:
+		die("--on_conflict must be one of: skip, overwrite, suffix")
+	}
+
+	// Read records.
+	var rs []export.Record
+	var err error
+	switch {
+	case *resume:
+		// The records of an interrupted import are already staged.
+	case *inFormat == passDirFormat:
+		rs, err = importer.ReadPassDir(*inLocation, gpgDecrypt)
+	default:
+		f, ok := export.Formats[*inFormat]
+		if !ok {
+			die("--in_format must be one of: %s", strings.Join(formatNames(), ", "))
+		}
+		rs, err = readFile(f, *inLocation)
+	}
+	if err != nil {
+		die("Couldn't read input: %v", err)
+	}
+
+	// Create & unlock vault.
+	v, err := vault(*outLocation, *outKeyFile)
+	if err != nil {
+		die("Couldn't create vault: %v", err)
+	}
+	fmt.Printf("Passphrase: ")
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	s, err := v.Unlock(string(pass))
+	if err != nil {
+		die("Could not open vault: %v", err)
+	}
+
+	// Finish an interrupted import, if requested.
+	if *resume {
+		n, err := secret.ResumeBatch(s)
+		if err != nil {
+			dieBatch(err)
+		}
+		if n == 0 {
+			fmt.Println("No interrupted import to finish")
+			return
+		}
+		fmt.Printf("Finished import (%d entries)\n", n)
+		return
+	}
+
+	// Import records. Imported entries appear in the vault together, once
+	// every record has been handled.
+	res, err := importer.Import(s, rs, importer.Conflict(*onConflict), *dryRun, os.Stdout)
+	if err != nil {
+		dieBatch(err)
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d entries (%d overwritten); skipped %d entries.\n", verb, res.Imported, res.Overwritten, res.Skipped)
+}
+
+// dieBatch reports an error importing entries, including how to finish the
+// import if it was interrupted.
+func dieBatch(err error) {
+	var be *secret.BatchError
+	switch {
+	case errors.As(err, &be):
+		die("Import interrupted after %d of %d changes: %v\nRerun with --resume to finish importing.", be.Done, be.Total, be.Err)
+	case errors.Is(err, secret.ErrBatchPending):
+		die("A previous import was interrupted. Rerun with --resume to finish it.")
+	default:
+		die("Couldn't import entries: %v", err)
+	}
+}
+
+func readFile(f export.Format, location string) ([]export.Record, error) {
+	in, err := os.Open(location)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open input file: %w", err)
+	}
+	defer in.Close()
+	return f.Read(in)
+}
+
+// gpgDecrypt decrypts the given file of a pass password store with gpg, as
+// pass itself does.
+func gpgDecrypt(filename string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--quiet", "--decrypt", filename)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func formatNames() []string {
+	names := []string{passDirFormat}
+	for name := range export.Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func vault(location, keyFile string) (secret.Vault, error) {
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read key file: %w", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal key: %w", err)
+	}
+	v, err := key.NewVault(location, k)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create vault: %w", err)
+	}
+	return v, nil
+}
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
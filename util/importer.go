@@ -0,0 +1,160 @@
+// Package importer imports records, read from another password manager's
+// export or from a pass password store, into a vault.
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/util/export"
+)
+
+// Conflict determines what Import does with a record whose entry already
+// exists.
+type Conflict string
+
+const (
+	Skip      Conflict = "skip"      // the record is not imported
+	Overwrite Conflict = "overwrite" // the existing entry is replaced
+	Suffix    Conflict = "suffix"    // the record is imported under an unused name, e.g. "/entry-2"
+)
+
+// Result summarizes the records handled by Import.
+type Result struct {
+	Imported    int // including overwritten entries
+	Overwritten int
+	Skipped     int
+}
+
+// Import imports the given records into s, handling records whose entries
+// already exist (in s, or from an earlier record) as onConflict directs. The
+// imported entries are written in a single batch (see secret.Batch), so they
+// appear together, once every record has been handled; batch errors are
+// returned as-is. If dryRun is set, nothing is written. Each record handled is
+// reported to out.
+func Import(s secret.Store, rs []export.Record, onConflict Conflict, dryRun bool, out io.Writer) (Result, error) {
+	var res Result
+	pending := map[string]bool{} // entries imported so far, which s does not yet contain
+	exists := func(entry string) (bool, error) {
+		if pending[entry] {
+			return true, nil
+		}
+		return entryExists(s, entry)
+	}
+	err := batch(s, dryRun, func(tx secret.Tx) error {
+		for _, r := range rs {
+			entry := r.Path
+			ok, err := exists(entry)
+			if err != nil {
+				return fmt.Errorf("couldn't check for existing entry %q: %w", entry, err)
+			}
+			if ok {
+				switch onConflict {
+				case Skip:
+					fmt.Fprintf(out, "Skipping %q: entry already exists\n", entry)
+					res.Skipped++
+					continue
+				case Overwrite:
+					res.Overwritten++
+				case Suffix:
+					if entry, err = suffixedEntry(exists, entry); err != nil {
+						return fmt.Errorf("couldn't find unused name for %q: %w", r.Path, err)
+					}
+				default:
+					return fmt.Errorf("unknown conflict handling %q", onConflict)
+				}
+			}
+
+			if dryRun {
+				fmt.Fprintf(out, "Would import %q\n", entry)
+			} else {
+				if err := tx.Put(entry, r.Content()); err != nil {
+					return fmt.Errorf("couldn't write %q: %w", entry, err)
+				}
+				fmt.Fprintf(out, "Imported %q\n", entry)
+			}
+			pending[entry] = true
+			res.Imported++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// batch runs f in a batch of changes to s, unless dryRun is set, in which case
+// f must make no changes.
+func batch(s secret.Store, dryRun bool, f func(tx secret.Tx) error) error {
+	if dryRun {
+		return f(nil)
+	}
+	return secret.Batch(s, f)
+}
+
+func entryExists(s secret.Store, entry string) (bool, error) {
+	switch _, err := s.Get(entry); {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, secret.ErrNoEntry):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// suffixedEntry finds an unused entry name by adding a numeric suffix to the
+// given entry name, e.g. "/entry-2". exists reports whether an entry name is
+// in use.
+func suffixedEntry(exists func(entry string) (bool, error), entry string) (string, error) {
+	for i := 2; ; i++ {
+		e := fmt.Sprintf("%s-%d", entry, i)
+		ok, err := exists(e)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return e, nil
+		}
+	}
+}
+
+// ReadPassDir reads the entries of a pass password store at the given
+// location: each file with a ".gpg" extension holds the entry named after its
+// path relative to the location, without the extension. Hidden directories
+// (such as pass's ".git") are skipped. decrypt returns the content of the
+// given file.
+func ReadPassDir(location string, decrypt func(filename string) (string, error)) ([]export.Record, error) {
+	var rs []export.Record
+	if err := filepath.Walk(location, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != location && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), ".gpg") {
+			return nil
+		}
+		rel, err := filepath.Rel(location, path)
+		if err != nil {
+			return fmt.Errorf("couldn't determine entry name for %q: %w", path, err)
+		}
+		entry := "/" + filepath.ToSlash(strings.TrimSuffix(rel, ".gpg"))
+		content, err := decrypt(path)
+		if err != nil {
+			return fmt.Errorf("couldn't decrypt %q: %w", entry, err)
+		}
+		rs = append(rs, export.NewRecord(entry, content))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
@@ -0,0 +1,208 @@
+package importer
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/BranLwyd/harpocrates/util/export"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+	existing := map[string]string{
+		"/a":   "old a",
+		"/a-2": "old a-2",
+	}
+	rs := []export.Record{
+		export.NewRecord("/a", "new a"),
+		export.NewRecord("/b", "first b"),
+		export.NewRecord("/b", "second b"),
+		export.NewRecord("/dir/c", "c"),
+	}
+
+	for _, test := range []struct {
+		desc       string
+		onConflict Conflict
+		dryRun     bool
+		want       map[string]string
+		wantResult Result
+	}{
+		{
+			desc:       "skip",
+			onConflict: Skip,
+			want:       map[string]string{"/a": "old a", "/a-2": "old a-2", "/b": "first b", "/dir/c": "c"},
+			wantResult: Result{Imported: 2, Skipped: 2},
+		},
+		{
+			desc:       "overwrite",
+			onConflict: Overwrite,
+			want:       map[string]string{"/a": "new a", "/a-2": "old a-2", "/b": "second b", "/dir/c": "c"},
+			wantResult: Result{Imported: 4, Overwritten: 2},
+		},
+		{
+			desc:       "suffix",
+			onConflict: Suffix,
+			want:       map[string]string{"/a": "old a", "/a-2": "old a-2", "/a-3": "new a", "/b": "first b", "/b-2": "second b", "/dir/c": "c"},
+			wantResult: Result{Imported: 4},
+		},
+		{
+			desc:       "dry run",
+			onConflict: Suffix,
+			dryRun:     true,
+			want:       existing,
+			wantResult: Result{Imported: 4},
+		},
+	} {
+		s, cleanup := newStore(t)
+		defer cleanup()
+		for e, content := range existing {
+			if err := s.Put(e, content); err != nil {
+				t.Fatalf("[%s] Could not put %q: %v", test.desc, e, err)
+			}
+		}
+
+		got, err := Import(s, rs, test.onConflict, test.dryRun, ioutil.Discard)
+		if err != nil {
+			t.Errorf("[%s] Import returned error: %v", test.desc, err)
+			continue
+		}
+		if got != test.wantResult {
+			t.Errorf("[%s] Import = %+v, want %+v", test.desc, got, test.wantResult)
+		}
+		if got := contents(t, s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%s] After Import, store contents = %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestReadPassDir(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "harp_importer_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{
+		"bank.gpg",
+		"web/example.com.gpg",
+		"web/mail/work.gpg",
+		".gpg-id",       // not an entry
+		"notes.txt",     // not an entry
+		".git/old.gpg",  // in a hidden directory
+		"web/.hide.gpg", // hidden, but not a directory
+	} {
+		fn := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatalf("Could not create directory for %q: %v", f, err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(f), 0600); err != nil {
+			t.Fatalf("Could not write %q: %v", f, err)
+		}
+	}
+
+	// Entries are named after their files; the decrypted content of each
+	// is used.
+	decrypt := func(filename string) (string, error) {
+		content, err := ioutil.ReadFile(filename)
+		return "content of " + string(content), err
+	}
+	rs, err := ReadPassDir(dir, decrypt)
+	if err != nil {
+		t.Fatalf("Could not read pass directory: %v", err)
+	}
+	got := map[string]string{}
+	for _, r := range rs {
+		got[r.Path] = r.Content()
+	}
+	want := map[string]string{
+		"/bank":            "content of bank.gpg",
+		"/web/.hide":       "content of web/.hide.gpg",
+		"/web/example.com": "content of web/example.com.gpg",
+		"/web/mail/work":   "content of web/mail/work.gpg",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadPassDir = %q, want %q", got, want)
+	}
+
+	// Failures to decrypt are reported.
+	errDecrypt := errors.New("decrypt")
+	if _, err := ReadPassDir(dir, func(string) (string, error) { return "", errDecrypt }); !errors.Is(err, errDecrypt) {
+		t.Errorf("ReadPassDir with failing decryption returned error %v, want %v", err, errDecrypt)
+	}
+}
+
+// newStore returns an empty store in a temporary secretbox vault, and a
+// function which removes the vault.
+func newStore(t *testing.T) (secret.Store, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "harp_importer_test_")
+	if err != nil {
+		t.Fatalf("Could not get temporary directory: %v", err)
+	}
+	v, err := key.NewVault(dir, secretboxKey(t, "passphrase"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not create vault: %v", err)
+	}
+	s, err := v.Unlock("passphrase")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not unlock vault: %v", err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func contents(t *testing.T, s secret.Store) map[string]string {
+	t.Helper()
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("Could not list entries: %v", err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		content, err := s.Get(e)
+		if err != nil {
+			t.Fatalf("Could not get %q: %v", e, err)
+		}
+		got[e] = content
+	}
+	return got
+}
+
+// secretboxKey generates a secretbox key with cheap scrypt parameters.
+func secretboxKey(t *testing.T, passphrase string) *kpb.Key {
+	t.Helper()
+	var ek [32]byte
+	var nonce [24]byte
+	salt := make([]byte, 16)
+	for _, b := range [][]byte{ek[:], nonce[:], salt} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatalf("Could not generate random bytes: %v", err)
+		}
+	}
+	kekBuf, err := scrypt.Key([]byte(passphrase), salt, 2, 1, 1, 32)
+	if err != nil {
+		t.Fatalf("Could not derive KEK: %v", err)
+	}
+	var kek [32]byte
+	copy(kek[:], kekBuf)
+	return &kpb.Key{Key: &kpb.Key_SecretboxKey{SecretboxKey: &kpb.SecretboxKey{
+		EncryptedKey:      secretbox.Seal(nil, ek[:], &nonce, &kek),
+		EncryptedKeyNonce: nonce[:],
+		Salt:              salt,
+		N:                 2,
+		R:                 1,
+		P:                 1,
+	}}}
+}
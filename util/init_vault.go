@@ -0,0 +1,88 @@
+// init_vault initializes a new Harpocrates vault for a key: it creates the
+// vault's directory & writes a marker recording the key's type & fingerprint,
+// so that the vault will later refuse to unlock with a different key. It can
+// also seed the vault with a welcome entry.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh/terminal"
+
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+)
+
+var (
+	keyFile  = flag.String("key", "", "Location of the key to initialize the vault for.")
+	location = flag.String("location", "", "Location of the vault's directory. It is created if it does not exist.")
+	welcome  = flag.Bool("welcome", false, "If set, seed the vault with a welcome entry.")
+)
+
+const (
+	welcomeEntry   = "/Welcome"
+	welcomeContent = "Welcome to Harpocrates! This entry was created when the vault was initialized, and may be deleted.\n"
+)
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+	if *keyFile == "" {
+		die("--key is required")
+	}
+	if *location == "" {
+		die("--location is required")
+	}
+
+	// Read key.
+	keyBytes, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		die("Could not read key file: %v", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		die("Could not parse key: %v", err)
+	}
+
+	// Get passphrase from user.
+	fmt.Printf("Passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+
+	// Initialize vault.
+	if err := key.InitVault(*location, k, string(passphrase)); err != nil {
+		if errors.Is(err, secret.ErrWrongPassphrase) {
+			die("Passphrase is incorrect.")
+		}
+		die("Could not initialize vault: %v", err)
+	}
+	if !*welcome {
+		return
+	}
+
+	// Seed welcome entry.
+	v, err := key.NewVault(*location, k)
+	if err != nil {
+		die("Could not create vault: %v", err)
+	}
+	s, err := v.Unlock(string(passphrase))
+	if err != nil {
+		die("Could not unlock vault: %v", err)
+	}
+	if err := s.Put(welcomeEntry, welcomeContent); err != nil {
+		die("Could not write welcome entry: %v", err)
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -20,6 +21,7 @@ var (
 	inLocation  = flag.String("in_location", "", "Location of the input password entries.")
 	outKeyFile  = flag.String("out_key", "", "Location of the output key.")
 	outLocation = flag.String("out_location", "", "Location of the output password entries.")
+	resume      = flag.Bool("resume", false, "If set, finish an interrupted copy into the output password entries. --in_key & --in_location are not required.")
 )
 
 func die(format string, a ...interface{}) {
@@ -43,13 +45,43 @@ func vault(location, keyFile string) (secret.Vault, error) {
 	return v, nil
 }
 
+func unlock(name string, v secret.Vault) secret.Store {
+	fmt.Printf("Passphrase for `%s` key: ", name)
+	pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		die("Could not get passphrase: %v", err)
+	}
+	s, err := v.Unlock(string(pass))
+	if err != nil {
+		die("Could not open `%s` vault: %v", name, err)
+	}
+	return s
+}
+
+// dieBatch reports an error copying entries, including how to finish the
+// copy if it was interrupted.
+func dieBatch(err error) {
+	var be *secret.BatchError
+	switch {
+	case errors.As(err, &be):
+		die("Copy interrupted after %d of %d changes: %v\nRerun with --resume to finish copying.", be.Done, be.Total, be.Err)
+	case errors.Is(err, secret.ErrBatchPending):
+		die("A previous copy into the `out` vault was interrupted. Rerun with --resume to finish it.")
+	default:
+		die("Could not copy entries: %v", err)
+	}
+}
+
 func main() {
 	flag.Parse()
-	if *inKeyFile == "" {
-		die("--in_key is required")
-	}
-	if *inLocation == "" {
-		die("--in_location is required")
+	if !*resume {
+		if *inKeyFile == "" {
+			die("--in_key is required")
+		}
+		if *inLocation == "" {
+			die("--in_location is required")
+		}
 	}
 	if *outKeyFile == "" {
 		die("--out_key is required")
@@ -59,9 +91,13 @@ func main() {
 	}
 
 	// Create vaults.
-	inVault, err := vault(*inLocation, *inKeyFile)
-	if err != nil {
-		die("Could not initialize `in` vault: %v", err)
+	var inVault secret.Vault
+	if !*resume {
+		v, err := vault(*inLocation, *inKeyFile)
+		if err != nil {
+			die("Could not initialize `in` vault: %v", err)
+		}
+		inVault = v
 	}
 	outVault, err := vault(*outLocation, *outKeyFile)
 	if err != nil {
@@ -69,40 +105,46 @@ func main() {
 	}
 
 	// Unlock vaults.
-	fmt.Printf("Passphrase for `in` key: ")
-	inPass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Println()
-	if err != nil {
-		die("Could not get passphrase: %v", err)
-	}
-	inStore, err := inVault.Unlock(string(inPass))
-	if err != nil {
-		die("Could not open `in` vault: %v", err)
-	}
-	fmt.Printf("Passphrase for `out` key: ")
-	outPass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Println()
-	if err != nil {
-		die("Could not get passphrase: %v", err)
+	var inStore secret.Store
+	if !*resume {
+		inStore = unlock("in", inVault)
 	}
-	outStore, err := outVault.Unlock(string(outPass))
-	if err != nil {
-		die("Could not open `out` vault: %v", err)
+	outStore := unlock("out", outVault)
+
+	// Finish an interrupted copy, if requested.
+	if *resume {
+		n, err := secret.ResumeBatch(outStore)
+		if err != nil {
+			dieBatch(err)
+		}
+		if n == 0 {
+			fmt.Println("No interrupted copy to finish")
+			return
+		}
+		fmt.Printf("Finished copying (%d changes)\n", n)
+		return
 	}
 
-	// Copy entries from `inStore` to `outStore`.
+	// Copy entries from `inStore` to `outStore`. The copied entries appear in
+	// `outStore` together, once every entry has been read.
 	es, err := inStore.List()
 	if err != nil {
 		die("Could not list entries in `in` vault: %v", err)
 	}
-	for _, e := range es {
-		fmt.Printf("Copying %s\n", e)
-		content, err := inStore.Get(e)
-		if err != nil {
-			die("Could not get %q: %v", e, err)
-		}
-		if err := outStore.Put(e, content); err != nil {
-			die("Could not put %q: %v", e, err)
+	if err := secret.Batch(outStore, func(tx secret.Tx) error {
+		for _, e := range es {
+			fmt.Printf("Copying %s\n", e)
+			content, err := inStore.Get(e)
+			if err != nil {
+				return fmt.Errorf("couldn't get %q: %w", e, err)
+			}
+			if err := tx.Put(e, content); err != nil {
+				return fmt.Errorf("couldn't put %q: %w", e, err)
+			}
 		}
+		return nil
+	}); err != nil {
+		dieBatch(err)
 	}
+	fmt.Printf("Copied %d entries\n", len(es))
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+	"github.com/BranLwyd/harpocrates/secret/key"
+	kpb "github.com/BranLwyd/harpocrates/secret/proto/key_go_proto"
+	"github.com/BranLwyd/harpocrates/util/shellcmd"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	keyFile  = flag.String("key", "", "Location of the key.")
+	location = flag.String("location", "", "Location of the password entries.")
+	timeout  = flag.Duration("timeout", 5*time.Minute, "How long the shell waits for input before locking. If zero, the shell never locks.")
+)
+
+func main() {
+	// Parse & validate flags.
+	flag.Parse()
+	if *keyFile == "" {
+		die("--key is required")
+	}
+	if *location == "" {
+		die("--location is required")
+	}
+	if *timeout < 0 {
+		die("--timeout must be nonnegative")
+	}
+
+	// Create vault.
+	v, err := vault(*location, *keyFile)
+	if err != nil {
+		die("Could not initialize vault: %v", err)
+	}
+
+	// Run the shell, with the terminal in raw mode so that lines can be
+	// edited & completed.
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		die("Standard input must be a terminal.")
+	}
+	oldState, err := terminal.MakeRaw(fd)
+	if err != nil {
+		die("Could not put terminal into raw mode: %v", err)
+	}
+	t := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "harp> ")
+	if w, h, err := terminal.GetSize(fd); err == nil {
+		t.SetSize(w, h)
+	}
+	unlock := func() (secret.Store, error) {
+		pass, err := t.ReadPassword("Passphrase: ")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get passphrase: %w", err)
+		}
+		return v.Unlock(pass)
+	}
+	sh := shellcmd.New(t, unlock, editor(fd, oldState), shellcmd.WithTimeout(*timeout))
+	t.AutoCompleteCallback = sh.AutoComplete
+	err = sh.Run()
+	terminal.Restore(fd, oldState)
+	if err != nil {
+		die("%v", err)
+	}
+}
+
+// editor returns an editor which runs $EDITOR (or vi) on a temporary file
+// holding the content, which is shredded afterward. The temporary file is
+// created in memory-backed /dev/shm if it exists. The terminal is restored to
+// its original state while the editor runs.
+func editor(fd int, oldState *terminal.State) shellcmd.Editor {
+	return func(content string) (string, error) {
+		dir := ""
+		if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+			dir = "/dev/shm"
+		}
+		f, err := ioutil.TempFile(dir, "harp_shell_")
+		if err != nil {
+			return "", fmt.Errorf("couldn't create temporary file: %w", err)
+		}
+		defer shred(f.Name())
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			return "", fmt.Errorf("couldn't write temporary file: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("couldn't close temporary file: %w", err)
+		}
+
+		ed := os.Getenv("EDITOR")
+		if ed == "" {
+			ed = "vi"
+		}
+		// $EDITOR may include arguments, so it is run by the shell.
+		cmd := exec.Command("/bin/sh", "-c", ed+` "$1"`, "sh", f.Name())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := terminal.Restore(fd, oldState); err != nil {
+			return "", fmt.Errorf("couldn't restore terminal: %w", err)
+		}
+		runErr := cmd.Run()
+		if _, err := terminal.MakeRaw(fd); err != nil {
+			return "", fmt.Errorf("couldn't put terminal into raw mode: %w", err)
+		}
+		if runErr != nil {
+			return "", fmt.Errorf("couldn't run editor: %w", runErr)
+		}
+
+		newContent, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			return "", fmt.Errorf("couldn't read temporary file: %w", err)
+		}
+		return string(newContent), nil
+	}
+}
+
+// shred overwrites the given file with zeroes, then removes it.
+func shred(name string) {
+	if f, err := os.OpenFile(name, os.O_WRONLY, 0); err == nil {
+		if fi, err := f.Stat(); err == nil {
+			f.Write(make([]byte, fi.Size()))
+			f.Sync()
+		}
+		f.Close()
+	}
+	if err := os.Remove(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not remove temporary file %q: %v\r\n", name, err)
+	}
+}
+
+func vault(location, keyFile string) (secret.Vault, error) {
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read key file: %w", err)
+	}
+	k := &kpb.Key{}
+	if err := proto.Unmarshal(keyBytes, k); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal key: %w", err)
+	}
+	v, err := key.NewVault(location, k)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create vault: %w", err)
+	}
+	return v, nil
+}
+
+func die(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
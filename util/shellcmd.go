@@ -0,0 +1,490 @@
+// Package shellcmd implements the commands of the interactive shell, which
+// operates on an unlocked password store. Terminal I/O & editing are
+// abstracted, so that the shell can be driven without a terminal.
+package shellcmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/harpd/random"
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+const (
+	// defaultCharsets are the character sets used by gen if none are given.
+	defaultCharsets = "luds"
+
+	// clearScreen clears a VT100 terminal & moves the cursor to the top left.
+	clearScreen = "\x1b[2J\x1b[H"
+)
+
+// errExit is returned by Exec when the user asks to leave the shell.
+var errExit = errors.New("exit")
+
+// Terminal reads lines of input from the user, and displays output. Writes
+// may happen concurrently with ReadLine.
+// *golang.org/x/crypto/ssh/terminal.Terminal implements Terminal.
+type Terminal interface {
+	io.Writer
+
+	// ReadLine reads a line of input, returning io.EOF once there is no
+	// more input.
+	ReadLine() (string, error)
+}
+
+// Editor lets the user edit the given content, returning the edited content.
+type Editor func(content string) (string, error)
+
+// Unlocker prompts the user for a passphrase, returning the store it unlocks.
+type Unlocker func() (secret.Store, error)
+
+// Shell runs commands entered on a terminal against a password store. It
+// unlocks the store before running the first command & whenever it has been
+// locked, e.g. after a period of inactivity.
+type Shell struct {
+	t       Terminal
+	unlock  Unlocker
+	edit    Editor
+	timeout time.Duration // how long the shell waits for input before locking; zero for no limit
+
+	mu      sync.Mutex   // protects store, unlocks
+	store   secret.Store // nil while locked
+	unlocks int          // number of times the store has been unlocked
+}
+
+// Option configures optional behavior of a Shell.
+type Option func(*Shell)
+
+// WithTimeout causes the shell to lock after waiting d for input. The store's
+// key material is wiped, if it is a secret.WipeStore, and the screen is
+// cleared; the passphrase must be entered again before running further
+// commands. By default, the shell does not lock.
+func WithTimeout(d time.Duration) Option {
+	return func(sh *Shell) { sh.timeout = d }
+}
+
+// New creates a new shell, which reads commands from t, unlocks its store
+// with unlock, and edits entries with edit.
+func New(t Terminal, unlock Unlocker, edit Editor, opts ...Option) *Shell {
+	sh := &Shell{t: t, unlock: unlock, edit: edit}
+	for _, opt := range opts {
+		opt(sh)
+	}
+	return sh
+}
+
+// Run reads & runs commands until there is no more input, or the user exits.
+// Errors from commands are displayed rather than returned.
+func (sh *Shell) Run() error {
+	for {
+		if sh.getStore() == nil {
+			s, err := sh.unlock()
+			if errors.Is(err, secret.ErrWrongPassphrase) {
+				fmt.Fprintln(sh.t, "Wrong passphrase.")
+				continue
+			} else if err != nil {
+				return err
+			}
+			sh.mu.Lock()
+			sh.store = s
+			sh.unlocks++
+			sh.mu.Unlock()
+		}
+
+		var lockTimer *time.Timer
+		if sh.timeout > 0 {
+			unlocks := sh.unlockCount()
+			lockTimer = time.AfterFunc(sh.timeout, func() { sh.lock(unlocks) })
+		}
+		line, err := sh.t.ReadLine()
+		timedOut := lockTimer != nil && !lockTimer.Stop()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("couldn't read command: %w", err)
+		}
+		if timedOut || sh.getStore() == nil {
+			// The shell locked while the line was being entered; the
+			// command is discarded, since it may not have been
+			// entered by the user who unlocked the shell.
+			sh.Lock()
+			continue
+		}
+
+		if err := sh.Exec(line); errors.Is(err, errExit) {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(sh.t, "%v\n", err)
+		}
+	}
+}
+
+// Lock locks the shell, dropping its store & wiping the store's key material
+// if it is a secret.WipeStore. The passphrase must be entered again before
+// further commands run.
+func (sh *Shell) Lock() {
+	sh.lock(sh.unlockCount())
+}
+
+// lock locks the shell, unless its store has been unlocked again since the
+// given number of unlocks.
+func (sh *Shell) lock(unlocks int) {
+	sh.mu.Lock()
+	s := sh.store
+	if sh.unlocks != unlocks {
+		s = nil
+	}
+	if s != nil {
+		sh.store = nil
+	}
+	sh.mu.Unlock()
+	if s == nil {
+		return
+	}
+	if ws, ok := secret.AsWipeStore(s); ok {
+		ws.Wipe()
+	}
+	fmt.Fprintf(sh.t, "%sLocked. Press enter to unlock.\n", clearScreen)
+}
+
+func (sh *Shell) getStore() secret.Store {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.store
+}
+
+func (sh *Shell) unlockCount() int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.unlocks
+}
+
+// command is a shell command.
+type command struct {
+	usage string
+	help  string
+	args  func(n int) bool // determines if the command accepts n arguments
+	run   func(sh *Shell, s secret.Store, args []string) error
+}
+
+// commands holds the shell's commands, keyed by name.
+var commands map[string]command
+
+func init() {
+	exactly := func(n int) func(int) bool { return func(m int) bool { return m == n } }
+	atMost := func(n int) func(int) bool { return func(m int) bool { return m <= n } }
+	commands = map[string]command{
+		"ls":     {"ls [dir]", "list the entries & directories in dir, or in /", atMost(1), (*Shell).ls},
+		"cat":    {"cat <entry>", "display an entry", exactly(1), (*Shell).cat},
+		"edit":   {"edit <entry>", "edit an entry, creating it if it does not exist", exactly(1), (*Shell).editEntry},
+		"rm":     {"rm <entry>", "delete an entry", exactly(1), (*Shell).rm},
+		"mv":     {"mv <entry> <new-entry>", "move an entry", exactly(2), (*Shell).mv},
+		"search": {"search <query>", "list the entries whose names contain query", exactly(1), (*Shell).search},
+		"gen":    {"gen <length> [luds]", "generate a random password, from lowercase, uppercase, digits &/or symbols", func(n int) bool { return n == 1 || n == 2 }, (*Shell).gen},
+		"help":   {"help", "list commands", exactly(0), (*Shell).help},
+		"exit":   {"exit", "leave the shell", exactly(0), func(*Shell, secret.Store, []string) error { return errExit }},
+	}
+}
+
+// Exec runs the given command line. Arguments are separated by spaces, and
+// may be quoted with double quotes to include spaces. Blank lines are
+// ignored.
+func (sh *Shell) Exec(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q; try help", args[0])
+	}
+	if !cmd.args(len(args) - 1) {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	s := sh.getStore()
+	if s == nil {
+		return errors.New("shell is locked")
+	}
+	return cmd.run(sh, s, args[1:])
+}
+
+func (sh *Shell) ls(s secret.Store, args []string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = dirName(args[0])
+	}
+	entries, err := s.List()
+	if err != nil {
+		return fmt.Errorf("couldn't list entries: %w", err)
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, e := range visible(entries) {
+		if !strings.HasPrefix(e, dir) {
+			continue
+		}
+		name := e[len(dir):]
+		if i := strings.Index(name, "/"); i != -1 {
+			name = name[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 && dir != "/" {
+		return fmt.Errorf("no such directory %q", dir)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintln(sh.t, n)
+	}
+	return nil
+}
+
+func (sh *Shell) cat(s secret.Store, args []string) error {
+	content, err := s.Get(entryName(args[0]))
+	if err != nil {
+		return fmt.Errorf("couldn't get entry: %w", err)
+	}
+	fmt.Fprint(sh.t, content)
+	if !strings.HasSuffix(content, "\n") {
+		fmt.Fprintln(sh.t)
+	}
+	return nil
+}
+
+func (sh *Shell) editEntry(s secret.Store, args []string) error {
+	entry := entryName(args[0])
+	content, err := s.Get(entry)
+	if err != nil && !errors.Is(err, secret.ErrNoEntry) {
+		return fmt.Errorf("couldn't get entry: %w", err)
+	}
+	newContent, err := sh.edit(content)
+	if err != nil {
+		return fmt.Errorf("couldn't edit entry: %w", err)
+	}
+	switch {
+	case newContent == content:
+		fmt.Fprintln(sh.t, "No changes.")
+		return nil
+	case strings.TrimSpace(newContent) == "":
+		fmt.Fprintln(sh.t, "Not saving empty entry; use rm to delete it.")
+		return nil
+	}
+	if err := s.Put(entry, newContent); err != nil {
+		return fmt.Errorf("couldn't update entry: %w", err)
+	}
+	fmt.Fprintf(sh.t, "Saved %s.\n", entry)
+	return nil
+}
+
+func (sh *Shell) rm(s secret.Store, args []string) error {
+	if err := s.Delete(entryName(args[0])); err != nil {
+		return fmt.Errorf("couldn't delete entry: %w", err)
+	}
+	return nil
+}
+
+func (sh *Shell) mv(s secret.Store, args []string) error {
+	if err := s.Move(entryName(args[0]), entryName(args[1])); err != nil {
+		return fmt.Errorf("couldn't move entry: %w", err)
+	}
+	return nil
+}
+
+func (sh *Shell) search(s secret.Store, args []string) error {
+	entries, err := s.List()
+	if err != nil {
+		return fmt.Errorf("couldn't list entries: %w", err)
+	}
+	q := strings.ToLower(args[0])
+	var matches []string
+	for _, e := range visible(entries) {
+		if strings.Contains(strings.ToLower(e), q) {
+			matches = append(matches, e)
+		}
+	}
+	sort.Strings(matches)
+	for _, m := range matches {
+		fmt.Fprintln(sh.t, m)
+	}
+	return nil
+}
+
+func (sh *Shell) gen(_ secret.Store, args []string) error {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid length %q", args[0])
+	}
+	sets := defaultCharsets
+	if len(args) > 1 {
+		sets = args[1]
+	}
+	charsets, err := random.Charsets(sets, false)
+	if err != nil {
+		return err
+	}
+	pw, err := random.Password(n, charsets)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(sh.t, pw)
+	return nil
+}
+
+func (sh *Shell) help(secret.Store, []string) error {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(sh.t, "%-24s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+// AutoComplete completes the command or entry name before the cursor when tab
+// is pressed, as far as it is unambiguous. It is suitable for use as a
+// terminal's AutoCompleteCallback.
+func (sh *Shell) AutoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := strings.LastIndex(line[:pos], " ") + 1
+	word := line[start:pos]
+
+	var candidates []string
+	if start == 0 {
+		for name := range commands {
+			candidates = append(candidates, name+" ")
+		}
+	} else if s := sh.getStore(); s != nil {
+		entries, err := s.List()
+		if err != nil {
+			return "", 0, false
+		}
+		if word != "" && !strings.HasPrefix(word, "/") {
+			word = "/" + word
+		}
+		// Complete one path component at a time.
+		seen := map[string]bool{}
+		for _, e := range visible(entries) {
+			if !strings.HasPrefix(e, word) {
+				continue
+			}
+			c := e
+			if i := strings.Index(e[len(word):], "/"); i != -1 {
+				c = e[:len(word)+i+1]
+			} else {
+				c += " "
+			}
+			if !seen[c] {
+				seen[c] = true
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	var completion string
+	for _, c := range candidates {
+		if !strings.HasPrefix(c, word) {
+			continue
+		}
+		if completion == "" {
+			completion = c
+		} else {
+			completion = commonPrefix(completion, c)
+		}
+	}
+	if len(completion) <= len(word) {
+		return "", 0, false
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+// splitArgs splits a command line into arguments, separated by spaces. Double
+// quotes group characters, including spaces, into a single argument; a
+// backslash escapes the following character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			inArg, escaped = true, true
+		case r == '"':
+			inArg, quoted = true, !quoted
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			arg.WriteRune(r)
+		}
+	}
+	if quoted || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// entryName returns the name of the entry given by the user, which need not
+// begin with a slash.
+func entryName(e string) string {
+	if !strings.HasPrefix(e, "/") {
+		return "/" + e
+	}
+	return e
+}
+
+// dirName returns the name of the directory given by the user, which need not
+// begin or end with a slash.
+func dirName(d string) string {
+	d = entryName(d)
+	if !strings.HasSuffix(d, "/") {
+		d += "/"
+	}
+	return d
+}
+
+// visible returns the given entries, omitting hidden entries (those with a
+// path component beginning with a dot).
+func visible(entries []string) []string {
+	var vis []string
+	for _, e := range entries {
+		if !strings.Contains(e, "/.") {
+			vis = append(vis, e)
+		}
+	}
+	return vis
+}
+
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
@@ -0,0 +1,383 @@
+package shellcmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/harpocrates/secret"
+)
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"ls", "email/\nwork/\n", false},
+		{"ls work", "bank\nvpn\n", false},
+		{"ls /email/", "personal\n", false},
+		{"ls nope", "", true},
+		{"cat work/vpn", "hunter2\nuser: alice\n", false},
+		{`cat "/work/vpn"`, "hunter2\nuser: alice\n", false},
+		{"cat /email/personal", "p4ss\n", false},
+		{"cat /nope", "", true},
+		{"cat", "", true},
+		{"search WORK", "/work/bank\n/work/vpn\n", false},
+		{"search secret", "", false},
+		{"gen 0", "", true},
+		{"gen 8 x", "", true},
+		{"frobnicate", "", true},
+		{`cat "unterminated`, "", true},
+	} {
+		term := &fakeTerminal{}
+		sh := newTestShell(t, term, newTestStore())
+		err := sh.Exec(test.line)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("Exec(%q) returned error %v, want error: %v", test.line, err, test.wantErr)
+		}
+		if got := term.output(); got != test.want {
+			t.Errorf("Exec(%q) wrote %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestExecModifies(t *testing.T) {
+	t.Parallel()
+
+	s := newTestStore()
+	sh := newTestShell(t, &fakeTerminal{}, s)
+	for _, line := range []string{"rm work/bank", "mv /email/personal email/home"} {
+		if err := sh.Exec(line); err != nil {
+			t.Errorf("Exec(%q) failed: %v", line, err)
+		}
+	}
+	if got, want := s.list(), "[/.favorites /email/home /work/vpn]"; got != want {
+		t.Errorf("After rm & mv, entries = %s, want %s", got, want)
+	}
+	if err := sh.Exec("rm /nope"); !errors.Is(err, secret.ErrNoEntry) {
+		t.Errorf("Removing missing entry returned error %v, want %v", err, secret.ErrNoEntry)
+	}
+}
+
+func TestGen(t *testing.T) {
+	t.Parallel()
+
+	term := &fakeTerminal{}
+	sh := newTestShell(t, term, newTestStore())
+	if err := sh.Exec("gen 12 d"); err != nil {
+		t.Fatalf("Could not generate password: %v", err)
+	}
+	pw := strings.TrimSuffix(term.output(), "\n")
+	if len(pw) != 12 || strings.Trim(pw, "0123456789") != "" {
+		t.Errorf("gen 12 d generated %q, want 12 digits", pw)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	t.Parallel()
+
+	const vpn = "hunter2\nuser: alice\n"
+	for _, test := range []struct {
+		entry, edited string
+		wantOriginal  string
+		wantContent   string
+		wantOutput    string
+	}{
+		{"work/vpn", "hunter3\n", vpn, "hunter3\n", "Saved /work/vpn.\n"},
+		{"new/entry", "fresh\n", "", "fresh\n", "Saved /new/entry.\n"},
+		{"work/vpn", vpn, vpn, vpn, "No changes.\n"},
+		{"work/vpn", "  \n", vpn, vpn, "Not saving empty entry; use rm to delete it.\n"},
+	} {
+		s, term := newTestStore(), &fakeTerminal{}
+		var gotOriginal string
+		sh := New(term, func() (secret.Store, error) { return s, nil }, func(content string) (string, error) {
+			gotOriginal = content
+			return test.edited, nil
+		})
+		sh.store = s
+		if err := sh.Exec("edit " + test.entry); err != nil {
+			t.Errorf("Editing %q failed: %v", test.entry, err)
+			continue
+		}
+		if gotOriginal != test.wantOriginal {
+			t.Errorf("Editing %q: editor got %q, want %q", test.entry, gotOriginal, test.wantOriginal)
+		}
+		if got := s.entries[entryName(test.entry)]; got != test.wantContent {
+			t.Errorf("After editing %q, content = %q, want %q", test.entry, got, test.wantContent)
+		}
+		if got := term.output(); got != test.wantOutput {
+			t.Errorf("Editing %q wrote %q, want %q", test.entry, got, test.wantOutput)
+		}
+	}
+
+	// Failed edits leave the entry unchanged.
+	s := newTestStore()
+	sh := New(&fakeTerminal{}, nil, func(string) (string, error) { return "", errors.New("editor crashed") })
+	sh.store = s
+	if err := sh.Exec("edit work/vpn"); err == nil {
+		t.Errorf("Edit with failing editor succeeded")
+	}
+	if got := s.entries["/work/vpn"]; got != vpn {
+		t.Errorf("After failed edit, content = %q", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	s, term := newTestStore(), &fakeTerminal{lines: []string{"ls work", "nope", "exit", "rm work/vpn"}}
+	passphrases := []string{"wrong", "password"}
+	sh := New(term, func() (secret.Store, error) {
+		pass := passphrases[0]
+		passphrases = passphrases[1:]
+		if pass != "password" {
+			return nil, secret.ErrWrongPassphrase
+		}
+		return s, nil
+	}, nil)
+	if err := sh.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if got, want := term.output(), "Wrong passphrase.\nbank\nvpn\nunknown command \"nope\"; try help\n"; got != want {
+		t.Errorf("Run wrote %q, want %q", got, want)
+	}
+	if _, ok := s.entries["/work/vpn"]; !ok {
+		t.Errorf("Command after exit was run")
+	}
+
+	// Run stops at the end of input.
+	term = &fakeTerminal{lines: []string{"ls"}}
+	if err := New(term, func() (secret.Store, error) { return s, nil }, nil).Run(); err != nil {
+		t.Errorf("Run failed at end of input: %v", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The first command is entered after the shell locks, so it is discarded
+	// & the passphrase is requested again.
+	s := &wipingStore{memStore: newTestStore()}
+	term := &fakeTerminal{lines: []string{"rm work/vpn", "rm work/bank"}, delays: []time.Duration{200 * time.Millisecond}}
+	unlocks := 0
+	sh := New(term, func() (secret.Store, error) {
+		unlocks++
+		return s, nil
+	}, nil, WithTimeout(50*time.Millisecond))
+	if err := sh.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if unlocks != 2 {
+		t.Errorf("Shell unlocked %d times, want 2", unlocks)
+	}
+	if s.wipes() != 1 {
+		t.Errorf("Store wiped %d times, want 1", s.wipes())
+	}
+	if got, want := s.list(), "[/.favorites /email/personal /work/vpn]"; got != want {
+		t.Errorf("After commands, entries = %s, want %s", got, want)
+	}
+	if !strings.Contains(term.output(), clearScreen) {
+		t.Errorf("Locking did not clear the screen: %q", term.output())
+	}
+}
+
+func TestAutoComplete(t *testing.T) {
+	t.Parallel()
+
+	sh := newTestShell(t, &fakeTerminal{}, newTestStore())
+	for _, test := range []struct {
+		line     string
+		pos      int
+		wantLine string
+		wantPos  int
+	}{
+		{"c", 1, "cat ", 4},
+		{"e", 1, "e", 1}, // edit or exit
+		{"ed", 2, "edit ", 5},
+		{"cat w", 5, "cat /work/", 10},
+		{"cat /work/v", 11, "cat /work/vpn ", 14},
+		{"cat /work/", 10, "cat /work/", 10}, // bank or vpn
+		{"cat /e", 6, "cat /email/", 11},
+		{"cat /.", 6, "cat /.", 6}, // hidden
+		{"cat /x", 6, "cat /x", 6},
+		{"mv /work/b /work/v", 10, "mv /work/bank  /work/v", 14},
+	} {
+		gotLine, gotPos, ok := sh.AutoComplete(test.line, test.pos, '\t')
+		if !ok {
+			gotLine, gotPos = test.line, test.pos
+		}
+		if gotLine != test.wantLine || gotPos != test.wantPos {
+			t.Errorf("AutoComplete(%q, %d) = (%q, %d), want (%q, %d)", test.line, test.pos, gotLine, gotPos, test.wantLine, test.wantPos)
+		}
+	}
+	if _, _, ok := sh.AutoComplete("c", 1, 'a'); ok {
+		t.Errorf("AutoComplete completed on a key other than tab")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"  ls   /work ", []string{"ls", "/work"}, false},
+		{`cat "/my entry"`, []string{"cat", "/my entry"}, false},
+		{`cat /my\ entry`, []string{"cat", "/my entry"}, false},
+		{`search ""`, []string{"search", ""}, false},
+		{`cat "open`, nil, true},
+		{`cat \`, nil, true},
+	} {
+		got, err := splitArgs(test.line)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("splitArgs(%q) returned error %v, want error: %v", test.line, err, test.wantErr)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func newTestShell(t *testing.T, term Terminal, s secret.Store) *Shell {
+	t.Helper()
+	sh := New(term, func() (secret.Store, error) { return s, nil }, nil)
+	sh.store = s
+	return sh
+}
+
+// fakeTerminal is a Terminal which reads the given lines, each after the
+// corresponding delay (if any).
+type fakeTerminal struct {
+	lines  []string
+	delays []time.Duration
+
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (ft *fakeTerminal) ReadLine() (string, error) {
+	if len(ft.delays) > 0 {
+		time.Sleep(ft.delays[0])
+		ft.delays = ft.delays[1:]
+	}
+	if len(ft.lines) == 0 {
+		return "", io.EOF
+	}
+	line := ft.lines[0]
+	ft.lines = ft.lines[1:]
+	return line, nil
+}
+
+func (ft *fakeTerminal) Write(p []byte) (int, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.out.Write(p)
+}
+
+func (ft *fakeTerminal) output() string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.out.String()
+}
+
+// memStore is an in-memory secret.Store.
+type memStore struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func newTestStore() *memStore {
+	return &memStore{entries: map[string]string{
+		"/.favorites":     "/work/vpn\n",
+		"/email/personal": "p4ss",
+		"/work/bank":      "1234\n",
+		"/work/vpn":       "hunter2\nuser: alice\n",
+	}}
+}
+
+func (s *memStore) list() string {
+	entries, _ := s.List()
+	sort.Strings(entries)
+	return fmt.Sprint(entries)
+}
+
+func (s *memStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []string
+	for e := range s.entries {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *memStore) Get(entry string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.entries[entry]
+	if !ok {
+		return "", secret.ErrNoEntry
+	}
+	return content, nil
+}
+
+func (s *memStore) Put(entry, content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry] = content
+	return nil
+}
+
+func (s *memStore) Delete(entry string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[entry]; !ok {
+		return secret.ErrNoEntry
+	}
+	delete(s.entries, entry)
+	return nil
+}
+
+func (s *memStore) Move(oldEntry, newEntry string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.entries[oldEntry]
+	if !ok {
+		return secret.ErrNoEntry
+	}
+	delete(s.entries, oldEntry)
+	s.entries[newEntry] = content
+	return nil
+}
+
+// wipingStore is a secret.WipeStore which counts how often it is wiped.
+type wipingStore struct {
+	*memStore
+	wipeMu    sync.Mutex
+	wipeCount int
+}
+
+func (s *wipingStore) Wipe() {
+	s.wipeMu.Lock()
+	defer s.wipeMu.Unlock()
+	s.wipeCount++
+}
+
+func (s *wipingStore) wipes() int {
+	s.wipeMu.Lock()
+	defer s.wipeMu.Unlock()
+	return s.wipeCount
+}